@@ -0,0 +1,125 @@
+// Package anonymize replaces the names and IDs in the diagnostic data guac-update-db writes
+// with pseudonyms, so fixtures, reports and ID maps can be shared without leaking internal
+// package names, documents or collectors.
+package anonymize
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"regexp"
+
+	"github.com/google/uuid"
+)
+
+// uuidPattern matches the UUIDs in a message, as uuid.UUID.String and Postgres write them.
+var uuidPattern = regexp.MustCompile(`[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}`)
+
+// Anonymizer derives pseudonyms with a secret key, by default a random one of its own that is
+// never written anywhere: a value cannot be recovered by hashing guesses, while equal values
+// get equal pseudonyms from the same key. Everything written with one key can be correlated.
+type Anonymizer struct {
+	key []byte
+}
+
+// minKeySize is the length of the shortest key NewFromKeyFile accepts.
+const minKeySize = 16
+
+// New returns an Anonymizer with a new key.
+func New() (*Anonymizer, error) {
+	a := &Anonymizer{key: make([]byte, 32)}
+	if _, err := rand.Read(a.key); err != nil {
+		return nil, fmt.Errorf("failed to generate the anonymization key: %w", err)
+	}
+	return a, nil
+}
+
+// NewFromKeyFile returns an Anonymizer keyed by the content of the file at path, without the
+// whitespace around it, so that runs given the same file give the same pseudonyms. Whoever has
+// the key can recover a value by hashing guesses, so it must be kept as secret as the values.
+func NewFromKeyFile(path string) (*Anonymizer, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the anonymization key: %w", err)
+	}
+	key := bytes.TrimSpace(data)
+	if len(key) < minKeySize {
+		return nil, fmt.Errorf("the anonymization key in %s is shorter than %d bytes", path, minKeySize)
+	}
+	return &Anonymizer{key: key}, nil
+}
+
+func (a *Anonymizer) sum(kind, s string) []byte {
+	mac := hmac.New(sha256.New, a.key)
+	mac.Write([]byte(kind))
+	mac.Write([]byte{0})
+	mac.Write([]byte(s))
+	return mac.Sum(nil)
+}
+
+// Text returns the pseudonym of s. An empty string stays empty, since GUAC gives an empty
+// string a meaning of its own, as the namespace of a package type without namespaces.
+func (a *Anonymizer) Text(s string) string {
+	if s == "" {
+		return s
+	}
+	return "anon-" + hex.EncodeToString(a.sum("text", s)[:8])
+}
+
+// UUID returns the pseudonym of id, a version 8 UUID. An ID derived from the names of a row,
+// as GUAC derives the new ones, would otherwise confirm a guess of those names.
+func (a *Anonymizer) UUID(id uuid.UUID) uuid.UUID {
+	var p uuid.UUID
+	copy(p[:], a.sum("uuid", id.String()))
+	p[6] = p[6]&0x0f | 0x80
+	p[8] = p[8]&0x3f | 0x80
+	return p
+}
+
+// UUIDString is UUID for an ID in text; anything but a UUID is anonymized as Text.
+func (a *Anonymizer) UUIDString(s string) string {
+	id, err := uuid.Parse(s)
+	if err != nil {
+		return a.Text(s)
+	}
+	return a.UUID(id).String()
+}
+
+// Message replaces the UUIDs in the message s with their pseudonyms, and keeps the rest.
+func (a *Anonymizer) Message(s string) string {
+	return uuidPattern.ReplaceAllStringFunc(s, a.UUIDString)
+}
+
+// JSON replaces every string in the JSON value v with its pseudonym, such as the values of the
+// qualifiers of a package version. The values of "key" fields are kept, as the qualifier keys
+// are the standard purl ones.
+func (a *Anonymizer) JSON(v json.RawMessage) (json.RawMessage, error) {
+	var x interface{}
+	if err := json.Unmarshal(v, &x); err != nil {
+		return nil, err
+	}
+	return json.Marshal(a.walk(x))
+}
+
+func (a *Anonymizer) walk(x interface{}) interface{} {
+	switch x := x.(type) {
+	case string:
+		return a.Text(x)
+	case []interface{}:
+		for i := range x {
+			x[i] = a.walk(x[i])
+		}
+	case map[string]interface{}:
+		for k, v := range x {
+			if k != "key" {
+				x[k] = a.walk(v)
+			}
+		}
+	}
+	return x
+}
@@ -0,0 +1,56 @@
+-- A small GUAC v0.8 database: pypi and npm packages ingested from deps.dev and from SPDX
+-- documents, with dependencies in each of the shapes the migration meets in the wild.
+
+INSERT INTO package_types (id, type) VALUES
+    ('10000000-0000-4000-8000-000000000001', 'pypi'),
+    ('10000000-0000-4000-8000-000000000002', 'npm');
+
+INSERT INTO package_namespaces (id, namespace, package_id) VALUES
+    ('20000000-0000-4000-8000-000000000001', '', '10000000-0000-4000-8000-000000000001'),
+    ('20000000-0000-4000-8000-000000000002', '', '10000000-0000-4000-8000-000000000002');
+
+INSERT INTO package_names (id, name, namespace_id) VALUES
+    ('30000000-0000-4000-8000-000000000001', 'requests', '20000000-0000-4000-8000-000000000001'),
+    ('30000000-0000-4000-8000-000000000002', 'urllib3', '20000000-0000-4000-8000-000000000001'),
+    ('30000000-0000-4000-8000-000000000003', 'certifi', '20000000-0000-4000-8000-000000000001'),
+    ('30000000-0000-4000-8000-000000000004', 'express', '20000000-0000-4000-8000-000000000002'),
+    ('30000000-0000-4000-8000-000000000005', 'left-pad', '20000000-0000-4000-8000-000000000002'),
+    ('30000000-0000-4000-8000-000000000006', 'debug', '20000000-0000-4000-8000-000000000002');
+
+INSERT INTO package_versions (id, name_id, version, hash) VALUES
+    ('40000000-0000-4000-8000-000000000001', '30000000-0000-4000-8000-000000000001', '2.31.0', 'b6aa5f1c0a2fbcfc4fb08c6fa1ad4bf3'),
+    ('40000000-0000-4000-8000-000000000002', '30000000-0000-4000-8000-000000000001', '2.32.0', '0e2fe1f5ad2d9c7b36f43f0a1fd87e7b'),
+    ('40000000-0000-4000-8000-000000000003', '30000000-0000-4000-8000-000000000002', '1.26.18', '5b0c38a1bd1e1c8a3089ae0c0f4e1cb3'),
+    ('40000000-0000-4000-8000-000000000004', '30000000-0000-4000-8000-000000000002', '2.2.1', 'c7a5a03f8a48ee1b1a2ae5cbbe5bd690'),
+    ('40000000-0000-4000-8000-000000000005', '30000000-0000-4000-8000-000000000003', '2023.7.22', '8d1c3fd0bb0658a66dcd38f4e3f5d6a6'),
+    ('40000000-0000-4000-8000-000000000006', '30000000-0000-4000-8000-000000000004', '4.18.2', '2fd4d7b6ec1b28d0b8c3f26f3de1e2a4'),
+    ('40000000-0000-4000-8000-000000000007', '30000000-0000-4000-8000-000000000005', '1.3.0', '91ac3a2af52e3b8b4b9f9d2d6d517d0c'),
+    ('40000000-0000-4000-8000-000000000008', '30000000-0000-4000-8000-000000000006', '2.6.9', 'e3fb1a8848ecb1dd4db84a8045bf3a0f');
+
+INSERT INTO dependencies (id, package_id, dependent_package_name_id, dependent_package_version_id, version_range, dependency_type, justification, origin, collector, document_ref) VALUES
+    -- Dependencies by name and version range, the v0.8 shape the backfill resolves.
+    ('50000000-0000-4000-8000-000000000001', '40000000-0000-4000-8000-000000000001', '30000000-0000-4000-8000-000000000002', NULL, '1.26.18', 'DIRECT', 'dependency data collected via deps.dev', 'deps.dev', 'deps.dev', ''),
+    ('50000000-0000-4000-8000-000000000002', '40000000-0000-4000-8000-000000000001', '30000000-0000-4000-8000-000000000003', NULL, '2023.7.22', 'DIRECT', 'dependency data collected via deps.dev', 'deps.dev', 'deps.dev', ''),
+    ('50000000-0000-4000-8000-000000000003', '40000000-0000-4000-8000-000000000002', '30000000-0000-4000-8000-000000000002', NULL, '2.2.1', 'DIRECT', 'dependency data collected via deps.dev', 'deps.dev', 'deps.dev', ''),
+    -- The same edge ingested from two SPDX documents, told apart only by document_ref.
+    ('50000000-0000-4000-8000-000000000004', '40000000-0000-4000-8000-000000000006', '30000000-0000-4000-8000-000000000005', NULL, '1.3.0', 'INDIRECT', 'top-level package GUAC heuristic connecting to each file/package', 'file:///sboms/express.spdx.json', 'FileCollector', 'SPDXRef-Package-left-pad'),
+    ('50000000-0000-4000-8000-000000000005', '40000000-0000-4000-8000-000000000006', '30000000-0000-4000-8000-000000000005', NULL, '1.3.0', 'INDIRECT', 'top-level package GUAC heuristic connecting to each file/package', 'file:///sboms/express.spdx.json', 'FileCollector', 'SPDXRef-Package-left-pad-1.3.0'),
+    -- A dependency that already references the dependent version.
+    ('50000000-0000-4000-8000-000000000006', '40000000-0000-4000-8000-000000000006', NULL, '40000000-0000-4000-8000-000000000008', '', 'DIRECT', 'top-level package GUAC heuristic connecting to each file/package', 'file:///sboms/express.spdx.json', 'FileCollector', 'SPDXRef-Package-debug'),
+    -- A dependency carrying both the name and the version.
+    ('50000000-0000-4000-8000-000000000007', '40000000-0000-4000-8000-000000000006', '30000000-0000-4000-8000-000000000006', '40000000-0000-4000-8000-000000000008', '2.6.9', 'DIRECT', 'top-level package GUAC heuristic connecting to each file/package', 'file:///sboms/express-lock.spdx.json', 'FileCollector', 'SPDXRef-Package-debug');
+
+-- The hashes of the included dependencies and the SBOM IDs are the ones GUAC v0.8 derives.
+INSERT INTO bill_of_materials (id, package_id, uri, algorithm, digest, download_location, origin, collector, document_ref, known_since, included_packages_hash, included_artifacts_hash, included_dependencies_hash, included_occurrences_hash) VALUES
+    ('3c252950-aaaf-5cb4-a2a5-a63529230bc2', '40000000-0000-4000-8000-000000000001', 'https://deps.dev/pypi/requests/2.31.0', 'sha256', '58cd2187c01e70e6e26505bca751777aa9f2ee0b7f4300988b709f44e013003f', '', 'deps.dev', 'deps.dev', '', '2024-05-02 10:00:00+00', 'da39a3ee5e6b4b0d3255bfef95601890afd80709', 'da39a3ee5e6b4b0d3255bfef95601890afd80709', 'f8298738c96bcd0876f419cf886f3a4ed871da6e', 'da39a3ee5e6b4b0d3255bfef95601890afd80709'),
+    ('fadba42b-f285-501a-9878-aabd5a11e6bc', '40000000-0000-4000-8000-000000000006', 'file:///sboms/express.spdx.json', 'sha256', '0a4f5f7d2a3b88a5e3f963e1d4d7c1c0b2e9f5a6c8d7e4b3a2f1c0d9e8f7a6b5', '', 'file:///sboms/express.spdx.json', 'FileCollector', 'SPDXRef-DOCUMENT', '2024-05-03 10:00:00+00', 'da39a3ee5e6b4b0d3255bfef95601890afd80709', 'da39a3ee5e6b4b0d3255bfef95601890afd80709', '0ca609862aad243719f26f27c4c18c02b5430ae2', 'da39a3ee5e6b4b0d3255bfef95601890afd80709'),
+    ('229f9d61-e7f4-5bdd-89f9-737127c750c3', '40000000-0000-4000-8000-000000000006', 'file:///sboms/express-lock.spdx.json', 'sha256', '7c1e3b9d5f2a4c6e8b0d2f4a6c8e0b2d4f6a8c0e2b4d6f8a0c2e4b6d8f0a2c4e', '', 'file:///sboms/express-lock.spdx.json', 'FileCollector', 'SPDXRef-DOCUMENT', '2024-05-03 11:00:00+00', 'da39a3ee5e6b4b0d3255bfef95601890afd80709', 'da39a3ee5e6b4b0d3255bfef95601890afd80709', '1020deaddd4b3b469df25202443df86b12aa1683', 'da39a3ee5e6b4b0d3255bfef95601890afd80709');
+
+INSERT INTO bill_of_materials_included_dependencies (bill_of_materials_id, dependency_id) VALUES
+    ('3c252950-aaaf-5cb4-a2a5-a63529230bc2', '50000000-0000-4000-8000-000000000001'),
+    ('3c252950-aaaf-5cb4-a2a5-a63529230bc2', '50000000-0000-4000-8000-000000000002'),
+    ('fadba42b-f285-501a-9878-aabd5a11e6bc', '50000000-0000-4000-8000-000000000004'),
+    ('fadba42b-f285-501a-9878-aabd5a11e6bc', '50000000-0000-4000-8000-000000000005'),
+    ('fadba42b-f285-501a-9878-aabd5a11e6bc', '50000000-0000-4000-8000-000000000006'),
+    ('229f9d61-e7f4-5bdd-89f9-737127c750c3', '50000000-0000-4000-8000-000000000006'),
+    ('229f9d61-e7f4-5bdd-89f9-737127c750c3', '50000000-0000-4000-8000-000000000007');
@@ -0,0 +1,160 @@
+package fixtures
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+	"github.com/pxp928/guac-update-db/pkg/keys"
+)
+
+// Factory inserts GUAC v0.8 rows with random IDs, filling every field a test leaves empty.
+// Package types, namespaces and names are created on first use and reused afterwards.
+type Factory struct {
+	conn  *pgx.Conn
+	names map[string]uuid.UUID
+}
+
+// NewFactory returns a Factory inserting into the database of conn.
+func NewFactory(conn *pgx.Conn) *Factory {
+	return &Factory{conn: conn, names: make(map[string]uuid.UUID)}
+}
+
+// PackageVersion is a package_versions row along with the package name it belongs to.
+type PackageVersion struct {
+	ID     uuid.UUID
+	NameID uuid.UUID
+	// Version is also the version range a dependency on this version is recorded with.
+	Version string
+}
+
+// PackageVersion inserts version of the package pkgType/name, creating the package if needed.
+func (f *Factory) PackageVersion(ctx context.Context, pkgType, name, version string) (PackageVersion, error) {
+	nameID, err := f.packageName(ctx, pkgType, name)
+	if err != nil {
+		return PackageVersion{}, err
+	}
+	pv := PackageVersion{ID: uuid.New(), NameID: nameID, Version: version}
+	_, err = f.conn.Exec(ctx, `INSERT INTO package_versions (id, name_id, version, hash) VALUES ($1, $2, $3, $4)`,
+		pv.ID, nameID, version, pv.ID.String())
+	if err != nil {
+		return PackageVersion{}, fmt.Errorf("failed to insert package version %s/%s@%s: %w", pkgType, name, version, err)
+	}
+	return pv, nil
+}
+
+func (f *Factory) packageName(ctx context.Context, pkgType, name string) (uuid.UUID, error) {
+	if id, ok := f.names[pkgType+"/"+name]; ok {
+		return id, nil
+	}
+	namespaceID, ok := f.names[pkgType]
+	if !ok {
+		typeID := uuid.New()
+		namespaceID = uuid.New()
+		_, err := f.conn.Exec(ctx, `INSERT INTO package_types (id, type) VALUES ($1, $2)`, typeID, pkgType)
+		if err == nil {
+			_, err = f.conn.Exec(ctx, `INSERT INTO package_namespaces (id, namespace, package_id) VALUES ($1, '', $2)`, namespaceID, typeID)
+		}
+		if err != nil {
+			return uuid.Nil, fmt.Errorf("failed to insert package type %s: %w", pkgType, err)
+		}
+		f.names[pkgType] = namespaceID
+	}
+	id := uuid.New()
+	_, err := f.conn.Exec(ctx, `INSERT INTO package_names (id, name, namespace_id) VALUES ($1, $2, $3)`, id, name, namespaceID)
+	if err != nil {
+		return uuid.Nil, fmt.Errorf("failed to insert package name %s/%s: %w", pkgType, name, err)
+	}
+	f.names[pkgType+"/"+name] = id
+	return id, nil
+}
+
+// Dependency describes a dependencies row. The dependent package is referenced by name and
+// version range, as GUAC v0.8 ingested it, unless ByVersion is set.
+type Dependency struct {
+	Package        PackageVersion
+	DependsOn      PackageVersion
+	ByVersion      bool
+	DependencyType string
+	Justification  string
+	Origin         string
+	Collector      string
+	DocumentRef    string
+}
+
+// Dependency inserts d and returns its ID.
+func (f *Factory) Dependency(ctx context.Context, d Dependency) (uuid.UUID, error) {
+	if d.DependencyType == "" {
+		d.DependencyType = "DIRECT"
+	}
+	if d.Justification == "" {
+		d.Justification = "dependency data collected via deps.dev"
+	}
+	if d.Origin == "" {
+		d.Origin = "deps.dev"
+	}
+	if d.Collector == "" {
+		d.Collector = "deps.dev"
+	}
+	nameID := uuid.NullUUID{UUID: d.DependsOn.NameID, Valid: !d.ByVersion}
+	versionID := uuid.NullUUID{UUID: d.DependsOn.ID, Valid: d.ByVersion}
+	versionRange := d.DependsOn.Version
+	if d.ByVersion {
+		versionRange = ""
+	}
+
+	id := uuid.New()
+	_, err := f.conn.Exec(ctx, `
+		INSERT INTO dependencies (id, package_id, dependent_package_name_id, dependent_package_version_id, version_range, dependency_type, justification, origin, collector, document_ref)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)
+	`, id, d.Package.ID, nameID, versionID, versionRange, d.DependencyType, d.Justification, d.Origin, d.Collector, d.DocumentRef)
+	if err != nil {
+		return uuid.Nil, fmt.Errorf("failed to insert dependency: %w", err)
+	}
+	return id, nil
+}
+
+// SBOM inserts a bill of materials for pkg that includes dependencies and returns its ID, with
+// the hashes and the ID GUAC v0.8 derives from them.
+func (f *Factory) SBOM(ctx context.Context, pkg PackageVersion, dependencies ...uuid.UUID) (uuid.UUID, error) {
+	doc := uuid.New().String()
+	uri := "file:///sboms/" + doc + ".spdx.json"
+	var ids []string
+	for _, dep := range dependencies {
+		ids = append(ids, dep.String())
+	}
+	b := keys.BillOfMaterials{
+		SubjectID:                pkg.ID,
+		IncludedPackagesHash:     keys.NoneIncluded,
+		IncludedArtifactsHash:    keys.NoneIncluded,
+		IncludedDependenciesHash: keys.IncludedHash("dependencies", ids),
+		IncludedOccurrencesHash:  keys.NoneIncluded,
+		URI:                      uri,
+		Algorithm:                "sha256",
+		Digest:                   doc,
+		Origin:                   uri,
+		Collector:                "FileCollector",
+		// Postgres keeps microseconds, so the ID derived from the row is this one.
+		KnownSince:  time.Now().UTC().Truncate(time.Microsecond),
+		DocumentRef: "SPDXRef-DOCUMENT",
+	}
+	id := b.Key()
+	_, err := f.conn.Exec(ctx, `
+		INSERT INTO bill_of_materials (id, package_id, uri, algorithm, digest, download_location, origin, collector, document_ref, known_since,
+			included_packages_hash, included_artifacts_hash, included_dependencies_hash, included_occurrences_hash)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14)
+	`, id, pkg.ID, b.URI, b.Algorithm, b.Digest, b.DownloadLocation, b.Origin, b.Collector, b.DocumentRef, b.KnownSince,
+		b.IncludedPackagesHash, b.IncludedArtifactsHash, b.IncludedDependenciesHash, b.IncludedOccurrencesHash)
+	if err != nil {
+		return uuid.Nil, fmt.Errorf("failed to insert SBOM: %w", err)
+	}
+	for _, dep := range dependencies {
+		_, err := f.conn.Exec(ctx, `INSERT INTO bill_of_materials_included_dependencies (bill_of_materials_id, dependency_id) VALUES ($1, $2)`, id, dep)
+		if err != nil {
+			return uuid.Nil, fmt.Errorf("failed to include dependency %s in SBOM: %w", dep, err)
+		}
+	}
+	return id, nil
+}
@@ -0,0 +1,64 @@
+// Package fixtures creates GUAC ENT databases for testing the migration: the v0.8 schema the
+// migration starts from, named datasets loaded from SQL files or NDJSON fixtures, and factories
+// that insert packages, dependencies and SBOMs row by row.
+package fixtures
+
+import (
+	"context"
+	"embed"
+	"fmt"
+	"io/fs"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/jackc/pgx/v5"
+)
+
+//go:embed schema.sql
+var schemaSQL string
+
+//go:embed data
+var dataFS embed.FS
+
+// CreateSchema creates the GUAC v0.8 tables the migration touches in the database of conn.
+func CreateSchema(ctx context.Context, conn *pgx.Conn) error {
+	if _, err := conn.Exec(ctx, schemaSQL); err != nil {
+		return fmt.Errorf("failed to create the fixture schema: %w", err)
+	}
+	return nil
+}
+
+// Load inserts the rows of the named dataset, one of Datasets, into a database created with
+// CreateSchema. A dataset is an SQL file, or an NDJSON fixture written by Export, such as one
+// exported from a database a migration went wrong on.
+func Load(ctx context.Context, conn *pgx.Conn, name string) error {
+	if f, err := dataFS.Open(path.Join("data", name+".ndjson")); err == nil {
+		defer f.Close()
+		if _, _, err := Import(ctx, conn, f); err != nil {
+			return fmt.Errorf("failed to load dataset %s: %w", name, err)
+		}
+		return nil
+	}
+	data, err := dataFS.ReadFile(path.Join("data", name+".sql"))
+	if err != nil {
+		return fmt.Errorf("unknown dataset %q: must be one of %s", name, strings.Join(Datasets(), ", "))
+	}
+	if _, err := conn.Exec(ctx, string(data)); err != nil {
+		return fmt.Errorf("failed to load dataset %s: %w", name, err)
+	}
+	return nil
+}
+
+// Datasets returns the names of the datasets Load knows, sorted.
+func Datasets() []string {
+	entries, _ := fs.ReadDir(dataFS, "data")
+	var names []string
+	for _, e := range entries {
+		if ext := path.Ext(e.Name()); ext == ".sql" || ext == ".ndjson" {
+			names = append(names, strings.TrimSuffix(e.Name(), ext))
+		}
+	}
+	sort.Strings(names)
+	return names
+}
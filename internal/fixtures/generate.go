@@ -0,0 +1,200 @@
+package fixtures
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+	"github.com/pxp928/guac-update-db/pkg/keys"
+)
+
+// GenerateOptions sizes a synthetic dataset.
+type GenerateOptions struct {
+	Dependencies int
+	// Packages is the number of package names, each with VersionsPerPackage versions.
+	Packages           int
+	VersionsPerPackage int
+	// SBOMs is the number of bills of materials. Every dependency is included in one of them.
+	SBOMs int
+	// Seed makes the generated rows, IDs included, the same on every run.
+	Seed int64
+}
+
+// GenerateStats counts the rows Generate inserted.
+type GenerateStats struct {
+	PackageVersions  int64
+	Dependencies     int64
+	SBOMs            int64
+	SBOMDependencies int64
+}
+
+// byVersionEvery is how often a generated dependency references the dependent package by
+// version rather than by name and version range. Most v0.8 rows are by name.
+const byVersionEvery = 10
+
+var generatedTypes = []string{"golang", "maven", "npm", "pypi"}
+
+var dependencyColumns = []string{"id", "package_id", "dependent_package_name_id", "dependent_package_version_id", "version_range", "dependency_type", "justification", "origin", "collector", "document_ref"}
+
+var sbomColumns = []string{"id", "package_id", "uri", "algorithm", "digest", "download_location", "origin", "collector", "document_ref", "known_since",
+	"included_packages_hash", "included_artifacts_hash", "included_dependencies_hash", "included_occurrences_hash"}
+
+// Generate fills a database created with CreateSchema with a synthetic GUAC v0.8 graph sized
+// by opts, using COPY. Every dependency can be backfilled and gets a distinct new ID, so the
+// dataset exercises every step of the migration. Everything is inserted in one transaction.
+// progress, if not nil, is called after each table is loaded.
+func Generate(ctx context.Context, conn *pgx.Conn, opts GenerateOptions, progress func(table string, rows int64)) (GenerateStats, error) {
+	var stats GenerateStats
+	if opts.Dependencies <= 0 || opts.Packages <= 0 || opts.VersionsPerPackage <= 0 || opts.SBOMs <= 0 {
+		return stats, fmt.Errorf("every size of a generated dataset must be positive")
+	}
+	rng := rand.New(rand.NewSource(opts.Seed))
+	newID := func() uuid.UUID {
+		id, err := uuid.NewRandomFromReader(rng)
+		if err != nil {
+			// math/rand never fails to read.
+			panic(err)
+		}
+		return id
+	}
+	if progress == nil {
+		progress = func(string, int64) {}
+	}
+
+	tx, err := conn.Begin(ctx)
+	if err != nil {
+		return stats, err
+	}
+	defer tx.Rollback(ctx)
+
+	copyRows := func(table string, columns []string, n int, row func(i int) []interface{}) (int64, error) {
+		copied, err := tx.CopyFrom(ctx, pgx.Identifier{table}, columns, pgx.CopyFromSlice(n, func(i int) ([]interface{}, error) {
+			return row(i), nil
+		}))
+		if err != nil {
+			return copied, fmt.Errorf("failed to load %s: %w", table, err)
+		}
+		progress(table, copied)
+		return copied, nil
+	}
+
+	typeIDs := make([]uuid.UUID, len(generatedTypes))
+	namespaceIDs := make([]uuid.UUID, len(generatedTypes))
+	for i := range generatedTypes {
+		typeIDs[i], namespaceIDs[i] = newID(), newID()
+	}
+	if _, err := copyRows("package_types", []string{"id", "type"}, len(generatedTypes), func(i int) []interface{} {
+		return []interface{}{typeIDs[i], generatedTypes[i]}
+	}); err != nil {
+		return stats, err
+	}
+	if _, err := copyRows("package_namespaces", []string{"id", "namespace", "package_id"}, len(generatedTypes), func(i int) []interface{} {
+		return []interface{}{namespaceIDs[i], "", typeIDs[i]}
+	}); err != nil {
+		return stats, err
+	}
+
+	nameIDs := make([]uuid.UUID, opts.Packages)
+	for i := range nameIDs {
+		nameIDs[i] = newID()
+	}
+	if _, err := copyRows("package_names", []string{"id", "name", "namespace_id"}, opts.Packages, func(i int) []interface{} {
+		return []interface{}{nameIDs[i], fmt.Sprintf("synthetic-package-%d", i), namespaceIDs[i%len(namespaceIDs)]}
+	}); err != nil {
+		return stats, err
+	}
+
+	// Version v of package p is versionIDs[p*VersionsPerPackage+v].
+	versionIDs := make([]uuid.UUID, opts.Packages*opts.VersionsPerPackage)
+	for i := range versionIDs {
+		versionIDs[i] = newID()
+	}
+	versionString := func(i int) string { return fmt.Sprintf("1.%d.0", i%opts.VersionsPerPackage) }
+	stats.PackageVersions, err = copyRows("package_versions", []string{"id", "name_id", "version", "hash"}, len(versionIDs), func(i int) []interface{} {
+		return []interface{}{versionIDs[i], nameIDs[i/opts.VersionsPerPackage], versionString(i), versionIDs[i].String()}
+	})
+	if err != nil {
+		return stats, err
+	}
+
+	digests := make([]uuid.UUID, opts.SBOMs)
+	for i := range digests {
+		digests[i] = newID()
+	}
+	dependencyIDs := make([]uuid.UUID, opts.Dependencies)
+	stats.Dependencies, err = copyRows("dependencies", dependencyColumns, opts.Dependencies, func(i int) []interface{} {
+		dependencyIDs[i] = newID()
+		pkg := versionIDs[rng.Intn(len(versionIDs))]
+		dep := rng.Intn(len(versionIDs))
+		nameID := uuid.NullUUID{UUID: nameIDs[dep/opts.VersionsPerPackage], Valid: true}
+		versionID := uuid.NullUUID{}
+		versionRange := versionString(dep)
+		if i%byVersionEvery == 0 {
+			nameID = uuid.NullUUID{}
+			versionID = uuid.NullUUID{UUID: versionIDs[dep], Valid: true}
+			versionRange = ""
+		}
+		// The document_ref keeps every row, and so every new ID, distinct as in a real
+		// database, where the unique indexes on dependencies guarantee it.
+		return []interface{}{dependencyIDs[i], pkg, nameID, versionID, versionRange, "DIRECT",
+			"dependency data collected via deps.dev", "deps.dev", "deps.dev", fmt.Sprintf("SPDXRef-Package-%d", i)}
+	})
+	if err != nil {
+		return stats, err
+	}
+
+	// Dependency i is included in SBOM i % SBOMs, whose hashes and ID GUAC derives from them.
+	included := make([][]string, opts.SBOMs)
+	for i, id := range dependencyIDs {
+		included[i%opts.SBOMs] = append(included[i%opts.SBOMs], id.String())
+	}
+	knownSince := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	sboms := make([]keys.BillOfMaterials, opts.SBOMs)
+	sbomIDs := make([]uuid.UUID, opts.SBOMs)
+	for i := range sboms {
+		uri := fmt.Sprintf("file:///sboms/synthetic-%d.spdx.json", i)
+		sboms[i] = keys.BillOfMaterials{
+			SubjectID:                versionIDs[i%len(versionIDs)],
+			IncludedPackagesHash:     keys.NoneIncluded,
+			IncludedArtifactsHash:    keys.NoneIncluded,
+			IncludedDependenciesHash: keys.IncludedHash("dependencies", included[i]),
+			IncludedOccurrencesHash:  keys.NoneIncluded,
+			URI:                      uri,
+			Algorithm:                "sha256",
+			Digest:                   digests[i].String(),
+			Origin:                   uri,
+			Collector:                "FileCollector",
+			KnownSince:               knownSince,
+			DocumentRef:              "SPDXRef-DOCUMENT",
+		}
+		sbomIDs[i] = sboms[i].Key()
+	}
+	stats.SBOMs, err = copyRows("bill_of_materials", sbomColumns, opts.SBOMs, func(i int) []interface{} {
+		b := sboms[i]
+		return []interface{}{sbomIDs[i], b.SubjectID, b.URI, b.Algorithm, b.Digest, b.DownloadLocation, b.Origin, b.Collector, b.DocumentRef, b.KnownSince,
+			b.IncludedPackagesHash, b.IncludedArtifactsHash, b.IncludedDependenciesHash, b.IncludedOccurrencesHash}
+	})
+	if err != nil {
+		return stats, err
+	}
+	stats.SBOMDependencies, err = copyRows("bill_of_materials_included_dependencies", []string{"bill_of_materials_id", "dependency_id"}, opts.Dependencies, func(i int) []interface{} {
+		return []interface{}{sbomIDs[i%opts.SBOMs], dependencyIDs[i]}
+	})
+	if err != nil {
+		return stats, err
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return stats, err
+	}
+	// The migration estimates table sizes from the planner's statistics.
+	for _, table := range []string{"package_names", "package_versions", "dependencies", "bill_of_materials", "bill_of_materials_included_dependencies"} {
+		if _, err := conn.Exec(ctx, "ANALYZE "+table); err != nil {
+			return stats, fmt.Errorf("failed to analyze %s: %w", table, err)
+		}
+	}
+	return stats, nil
+}
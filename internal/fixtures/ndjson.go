@@ -0,0 +1,318 @@
+package fixtures
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/pxp928/guac-update-db/internal/anonymize"
+)
+
+// Format is the version of the NDJSON fixtures Export writes and Import reads.
+const Format = 1
+
+// importBatch is how many rows Import inserts with one statement.
+const importBatch = 1000
+
+// fixtureTable is a table of an NDJSON fixture: the key its rows are exported in the order of,
+// and the ID columns and the columns whose text Export anonymizes.
+type fixtureTable struct {
+	name    string
+	orderBy string
+	ids     []string
+	text    []string
+}
+
+// fixtureTables are the tables the migration reads or rewrites, in the order their rows can be
+// inserted. The package types and versions, the version ranges and the dependency types are
+// kept when anonymizing: which versions a range matches, and how purls normalize, depend on
+// them.
+var fixtureTables = []fixtureTable{
+	{name: "package_types", orderBy: "id", ids: []string{"id"}},
+	{name: "package_namespaces", orderBy: "id", ids: []string{"id", "package_id"}, text: []string{"namespace"}},
+	{name: "package_names", orderBy: "id", ids: []string{"id", "namespace_id"}, text: []string{"name"}},
+	{name: "package_versions", orderBy: "id", ids: []string{"id", "name_id"}, text: []string{"subpath", "qualifiers", "hash"}},
+	{
+		name: "dependencies", orderBy: "id",
+		ids:  []string{"id", "package_id", "dependent_package_name_id", "dependent_package_version_id"},
+		text: []string{"justification", "origin", "collector", "document_ref"},
+	},
+	{
+		name: "bill_of_materials", orderBy: "id",
+		ids:  []string{"id", "package_id", "artifact_id"},
+		text: []string{"uri", "digest", "download_location", "origin", "collector", "document_ref"},
+	},
+	{name: "bill_of_materials_included_dependencies", orderBy: "bill_of_materials_id, dependency_id", ids: []string{"bill_of_materials_id", "dependency_id"}},
+	{name: "bill_of_materials_included_software_packages", orderBy: "bill_of_materials_id, package_version_id", ids: []string{"bill_of_materials_id", "package_version_id"}},
+	{name: "bill_of_materials_included_software_artifacts", orderBy: "bill_of_materials_id, artifact_id", ids: []string{"bill_of_materials_id", "artifact_id"}},
+	{name: "bill_of_materials_included_occurrences", orderBy: "bill_of_materials_id, occurrence_id", ids: []string{"bill_of_materials_id", "occurrence_id"}},
+}
+
+// Tables returns the tables of an NDJSON fixture, in the order of their rows.
+func Tables() []string {
+	var names []string
+	for _, t := range fixtureTables {
+		names = append(names, t.name)
+	}
+	return names
+}
+
+// Header is the first line of an NDJSON fixture. Columns are the columns of every table as
+// exported; the rows have no others.
+type Header struct {
+	Format      int                 `json:"format"`
+	ExportedAt  time.Time           `json:"exported_at"`
+	ToolVersion string              `json:"tool_version,omitempty"`
+	Anonymized  bool                `json:"anonymized"`
+	Columns     map[string][]string `json:"columns"`
+}
+
+// Row is every further line of an NDJSON fixture, a row of Table. The rows of a table follow
+// those of the tables it references.
+type Row struct {
+	Table string                     `json:"table"`
+	Row   map[string]json.RawMessage `json:"row"`
+}
+
+// ExportOptions configure Export.
+type ExportOptions struct {
+	// ToolVersion is recorded in the header.
+	ToolVersion string
+	// Anonymizer, when set, replaces the IDs and the text of the columns that may name
+	// internal packages, documents and collectors with pseudonyms: equal values get equal
+	// pseudonyms, and empty ones stay empty, so the migration meets the same shapes as in the
+	// database.
+	Anonymizer *anonymize.Anonymizer
+}
+
+// Export writes the rows of the tables the migration involves in the database of conn to w as
+// an NDJSON fixture, read in one snapshot, and returns how many rows of each table it wrote.
+func Export(ctx context.Context, conn *pgx.Conn, w io.Writer, opts ExportOptions) (map[string]int64, error) {
+	tx, err := conn.BeginTx(ctx, pgx.TxOptions{IsoLevel: pgx.RepeatableRead, AccessMode: pgx.ReadOnly})
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback(ctx)
+
+	header := Header{Format: Format, ExportedAt: time.Now().UTC(), ToolVersion: opts.ToolVersion, Anonymized: opts.Anonymizer != nil, Columns: make(map[string][]string)}
+	for _, t := range fixtureTables {
+		columns, err := tableColumns(ctx, tx, t.name)
+		if err != nil {
+			return nil, err
+		}
+		if len(columns) == 0 {
+			return nil, fmt.Errorf("table %s does not exist", t.name)
+		}
+		header.Columns[t.name] = columns
+	}
+	bw := bufio.NewWriter(w)
+	enc := json.NewEncoder(bw)
+	if err := enc.Encode(header); err != nil {
+		return nil, err
+	}
+	counts := make(map[string]int64)
+	for _, t := range fixtureTables {
+		n, err := exportTable(ctx, tx, enc, t, opts.Anonymizer)
+		if err != nil {
+			return nil, fmt.Errorf("failed to export %s: %w", t.name, err)
+		}
+		counts[t.name] = n
+	}
+	return counts, bw.Flush()
+}
+
+func exportTable(ctx context.Context, tx pgx.Tx, enc *json.Encoder, t fixtureTable, a *anonymize.Anonymizer) (int64, error) {
+	rows, err := tx.Query(ctx, `SELECT row_to_json(t)::text FROM `+t.name+` t ORDER BY `+t.orderBy)
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+	var n int64
+	for rows.Next() {
+		var data string
+		if err := rows.Scan(&data); err != nil {
+			return n, err
+		}
+		row := Row{Table: t.name}
+		if err := json.Unmarshal([]byte(data), &row.Row); err != nil {
+			return n, err
+		}
+		if a != nil {
+			if err := t.anonymize(a, row.Row); err != nil {
+				return n, err
+			}
+		}
+		if err := enc.Encode(row); err != nil {
+			return n, err
+		}
+		n++
+	}
+	return n, rows.Err()
+}
+
+// anonymize replaces the IDs and the text of row with their pseudonyms.
+func (t fixtureTable) anonymize(a *anonymize.Anonymizer, row map[string]json.RawMessage) error {
+	for _, c := range t.ids {
+		var id *string
+		if err := json.Unmarshal(row[c], &id); err != nil || id == nil {
+			continue
+		}
+		row[c], _ = json.Marshal(a.UUIDString(*id))
+	}
+	for _, c := range t.text {
+		v, ok := row[c]
+		if !ok {
+			continue
+		}
+		var err error
+		if row[c], err = a.JSON(v); err != nil {
+			return fmt.Errorf("failed to anonymize %s: %w", c, err)
+		}
+	}
+	return nil
+}
+
+// Import inserts the rows of the NDJSON fixture r into the database of conn in one transaction,
+// and returns its header and how many rows of each table it inserted. Columns the database does
+// not have are left out, and those the fixture does not have get their defaults, so a fixture
+// exported from one GUAC schema loads into another one with the same tables.
+func Import(ctx context.Context, conn *pgx.Conn, r io.Reader) (*Header, map[string]int64, error) {
+	dec := json.NewDecoder(bufio.NewReader(r))
+	var header Header
+	if err := dec.Decode(&header); err != nil {
+		return nil, nil, fmt.Errorf("failed to read the fixture header: %w", err)
+	}
+	if header.Format != Format {
+		return nil, nil, fmt.Errorf("unsupported fixture format %d, want %d", header.Format, Format)
+	}
+
+	tx, err := conn.Begin(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer tx.Rollback(ctx)
+	order := make(map[string]int)
+	for i, t := range fixtureTables {
+		order[t.name] = i
+	}
+	counts := make(map[string]int64)
+	l := &loader{tx: tx, header: &header, current: -1}
+	for line := 2; ; line++ {
+		var row Row
+		err := dec.Decode(&row)
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to read line %d of the fixture: %w", line, err)
+		}
+		i, ok := order[row.Table]
+		switch {
+		case !ok:
+			return nil, nil, fmt.Errorf("line %d of the fixture: unknown table %q", line, row.Table)
+		case i < l.current:
+			return nil, nil, fmt.Errorf("line %d of the fixture: a row of %s after those of %s", line, row.Table, fixtureTables[l.current].name)
+		case i > l.current:
+			if err := l.flush(ctx); err != nil {
+				return nil, nil, err
+			}
+			if err := l.open(ctx, i); err != nil {
+				return nil, nil, err
+			}
+		}
+		l.rows = append(l.rows, row.Row)
+		counts[row.Table]++
+		if len(l.rows) >= importBatch {
+			if err := l.flush(ctx); err != nil {
+				return nil, nil, err
+			}
+		}
+	}
+	if err := l.flush(ctx); err != nil {
+		return nil, nil, err
+	}
+	return &header, counts, tx.Commit(ctx)
+}
+
+// loader inserts the rows of the table of the fixture being read, importBatch at a time.
+type loader struct {
+	tx      pgx.Tx
+	header  *Header
+	current int
+	insert  string
+	rows    []map[string]json.RawMessage
+}
+
+// open starts inserting the rows of fixtureTables[i], in the columns both the fixture and the
+// database have.
+func (l *loader) open(ctx context.Context, i int) error {
+	t := fixtureTables[i]
+	have, err := tableColumns(ctx, l.tx, t.name)
+	if err != nil {
+		return err
+	}
+	if len(have) == 0 {
+		return fmt.Errorf("table %s does not exist", t.name)
+	}
+	exported := make(map[string]bool)
+	for _, c := range l.header.Columns[t.name] {
+		exported[c] = true
+	}
+	var columns []string
+	for _, c := range have {
+		if exported[c] {
+			columns = append(columns, pgx.Identifier{c}.Sanitize())
+		}
+	}
+	if len(columns) == 0 {
+		return fmt.Errorf("the fixture has none of the columns of %s", t.name)
+	}
+	list := strings.Join(columns, ", ")
+	l.current = i
+	l.insert = `INSERT INTO ` + t.name + ` (` + list + `) SELECT ` + list + ` FROM json_populate_recordset(NULL::` + t.name + `, $1::json)`
+	return nil
+}
+
+func (l *loader) flush(ctx context.Context) error {
+	if len(l.rows) == 0 {
+		return nil
+	}
+	data, err := json.Marshal(l.rows)
+	if err != nil {
+		return err
+	}
+	if _, err := l.tx.Exec(ctx, l.insert, string(data)); err != nil {
+		return fmt.Errorf("failed to import the rows of %s: %w", fixtureTables[l.current].name, err)
+	}
+	l.rows = l.rows[:0]
+	return nil
+}
+
+// tableColumns returns the columns of table in the first schema of the search path, in order,
+// none when there is no such table.
+func tableColumns(ctx context.Context, tx pgx.Tx, table string) ([]string, error) {
+	rows, err := tx.Query(ctx, `
+		SELECT column_name FROM information_schema.columns
+		WHERE table_schema = current_schema() AND table_name = $1
+		ORDER BY ordinal_position
+	`, table)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the columns of %s: %w", table, err)
+	}
+	defer rows.Close()
+	var columns []string
+	for rows.Next() {
+		var c string
+		if err := rows.Scan(&c); err != nil {
+			return nil, err
+		}
+		columns = append(columns, c)
+	}
+	return columns, rows.Err()
+}
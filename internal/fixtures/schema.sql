@@ -0,0 +1,113 @@
+-- The GUAC ENT tables this tool reads or rewrites, as created by GUAC v0.8 before
+-- guacsec/guac#2021 and #2060. Tables GUAC has that the migration never touches are left out,
+-- as in schemas/v0.8.json.
+
+CREATE TABLE package_types (
+    id uuid PRIMARY KEY,
+    type character varying NOT NULL
+);
+CREATE UNIQUE INDEX packagetype_type ON package_types (type);
+
+CREATE TABLE package_namespaces (
+    id uuid PRIMARY KEY,
+    namespace character varying NOT NULL,
+    package_id uuid NOT NULL,
+    CONSTRAINT package_namespaces_package_types_namespaces FOREIGN KEY (package_id) REFERENCES package_types (id) ON DELETE NO ACTION
+);
+CREATE UNIQUE INDEX packagenamespace_namespace_package_id ON package_namespaces (namespace, package_id);
+
+CREATE TABLE package_names (
+    id uuid PRIMARY KEY,
+    name character varying NOT NULL,
+    namespace_id uuid NOT NULL,
+    CONSTRAINT package_names_package_namespaces_names FOREIGN KEY (namespace_id) REFERENCES package_namespaces (id) ON DELETE NO ACTION
+);
+CREATE UNIQUE INDEX packagename_name_namespace_id ON package_names (name, namespace_id);
+
+CREATE TABLE package_versions (
+    id uuid PRIMARY KEY,
+    name_id uuid NOT NULL,
+    version character varying NOT NULL DEFAULT '',
+    subpath character varying NOT NULL DEFAULT '',
+    qualifiers jsonb,
+    hash character varying NOT NULL,
+    CONSTRAINT package_versions_package_names_versions FOREIGN KEY (name_id) REFERENCES package_names (id) ON DELETE NO ACTION
+);
+CREATE UNIQUE INDEX packageversion_hash_name_id ON package_versions (hash, name_id);
+
+CREATE TABLE dependencies (
+    id uuid PRIMARY KEY,
+    package_id uuid NOT NULL,
+    dependent_package_name_id uuid,
+    dependent_package_version_id uuid,
+    version_range character varying,
+    dependency_type character varying NOT NULL,
+    justification character varying NOT NULL,
+    origin character varying NOT NULL,
+    collector character varying NOT NULL,
+    document_ref character varying NOT NULL,
+    CONSTRAINT dependencies_package_versions_package FOREIGN KEY (package_id) REFERENCES package_versions (id) ON DELETE NO ACTION,
+    CONSTRAINT dependencies_package_names_dependent_package_name FOREIGN KEY (dependent_package_name_id) REFERENCES package_names (id) ON DELETE SET NULL,
+    CONSTRAINT dependencies_package_versions_dependent_package_version FOREIGN KEY (dependent_package_version_id) REFERENCES package_versions (id) ON DELETE SET NULL
+);
+CREATE UNIQUE INDEX dep_package_name_id ON dependencies (package_id, dependent_package_name_id, version_range, dependency_type, justification, origin, collector, document_ref)
+    WHERE dependent_package_name_id IS NOT NULL AND dependent_package_version_id IS NULL;
+CREATE UNIQUE INDEX dep_package_version_id ON dependencies (package_id, dependent_package_version_id, dependency_type, justification, origin, collector, document_ref)
+    WHERE dependent_package_name_id IS NULL AND dependent_package_version_id IS NOT NULL;
+CREATE INDEX dependency_package_id ON dependencies (package_id);
+
+CREATE TABLE bill_of_materials (
+    id uuid PRIMARY KEY,
+    package_id uuid,
+    artifact_id uuid,
+    uri character varying NOT NULL,
+    algorithm character varying NOT NULL,
+    digest character varying NOT NULL,
+    download_location character varying NOT NULL,
+    origin character varying NOT NULL,
+    collector character varying NOT NULL,
+    document_ref character varying NOT NULL,
+    known_since timestamp with time zone NOT NULL,
+    included_packages_hash character varying NOT NULL,
+    included_artifacts_hash character varying NOT NULL,
+    included_dependencies_hash character varying NOT NULL,
+    included_occurrences_hash character varying NOT NULL,
+    CONSTRAINT bill_of_materials_package_versions_sbom FOREIGN KEY (package_id) REFERENCES package_versions (id) ON DELETE SET NULL
+);
+CREATE UNIQUE INDEX sbom_package_id ON bill_of_materials (algorithm, digest, uri, download_location, known_since, included_packages_hash, included_artifacts_hash, included_dependencies_hash, included_occurrences_hash, origin, collector, document_ref, package_id)
+    WHERE package_id IS NOT NULL AND artifact_id IS NULL;
+CREATE UNIQUE INDEX sbom_artifact_id ON bill_of_materials (algorithm, digest, uri, download_location, known_since, included_packages_hash, included_artifacts_hash, included_dependencies_hash, included_occurrences_hash, origin, collector, document_ref, artifact_id)
+    WHERE package_id IS NULL AND artifact_id IS NOT NULL;
+
+CREATE TABLE bill_of_materials_included_dependencies (
+    bill_of_materials_id uuid NOT NULL,
+    dependency_id uuid NOT NULL,
+    PRIMARY KEY (bill_of_materials_id, dependency_id),
+    CONSTRAINT bill_of_materials_included_dependencies_bill_of_materials_id FOREIGN KEY (bill_of_materials_id) REFERENCES bill_of_materials (id) ON DELETE CASCADE,
+    CONSTRAINT bill_of_materials_included_dependencies_dependency_id FOREIGN KEY (dependency_id) REFERENCES dependencies (id) ON DELETE CASCADE
+);
+CREATE INDEX bill_of_materials_included_dependencies_dependency_id_idx ON bill_of_materials_included_dependencies (dependency_id);
+
+-- What else an SBOM includes. GUAC's artifacts and occurrences tables are left out, and with them
+-- the foreign keys to those.
+CREATE TABLE bill_of_materials_included_software_packages (
+    bill_of_materials_id uuid NOT NULL,
+    package_version_id uuid NOT NULL,
+    PRIMARY KEY (bill_of_materials_id, package_version_id),
+    CONSTRAINT bill_of_materials_included_software_packages_bill_of_materials_id FOREIGN KEY (bill_of_materials_id) REFERENCES bill_of_materials (id) ON DELETE CASCADE,
+    CONSTRAINT bill_of_materials_included_software_packages_package_version_id FOREIGN KEY (package_version_id) REFERENCES package_versions (id) ON DELETE CASCADE
+);
+
+CREATE TABLE bill_of_materials_included_software_artifacts (
+    bill_of_materials_id uuid NOT NULL,
+    artifact_id uuid NOT NULL,
+    PRIMARY KEY (bill_of_materials_id, artifact_id),
+    CONSTRAINT bill_of_materials_included_software_artifacts_bill_of_materials_id FOREIGN KEY (bill_of_materials_id) REFERENCES bill_of_materials (id) ON DELETE CASCADE
+);
+
+CREATE TABLE bill_of_materials_included_occurrences (
+    bill_of_materials_id uuid NOT NULL,
+    occurrence_id uuid NOT NULL,
+    PRIMARY KEY (bill_of_materials_id, occurrence_id),
+    CONSTRAINT bill_of_materials_included_occurrences_bill_of_materials_id FOREIGN KEY (bill_of_materials_id) REFERENCES bill_of_materials (id) ON DELETE CASCADE
+);
@@ -0,0 +1,156 @@
+// Package keys derives the deterministic IDs GUAC's ENT backend assigns to nodes.
+//
+// The derivations here must stay byte-for-byte identical to guacsec/guac: a database whose IDs
+// were computed with a drifted format is silently inconsistent with the code that reads it.
+// The tests in this package check the schemes, including their quirks, against IDs guacsec/guac
+// v0.8.0 and v0.12.0 derived with their own code (see testdata/guac-v0.8.0 and
+// testdata/guac-v0.12.0).
+package keys
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/google/uuid"
+)
+
+// GenerateUUIDKey returns the UUID GUAC derives from data: a version 5 style name-based UUID in
+// the DNS namespace, hashed with SHA-256 instead of SHA-1.
+func GenerateUUIDKey(data []byte) uuid.UUID {
+	return uuid.NewHash(sha256.New(), uuid.NameSpaceDNS, data, 5)
+}
+
+// Dependency holds the columns of a dependencies row that make up its ID.
+type Dependency struct {
+	PackageID                 uuid.UUID
+	DependentPackageVersionID uuid.UUID
+	DependencyType            string
+	Justification             string
+	Origin                    string
+	Collector                 string
+	DocumentRef               string
+}
+
+// dependencyColumns are the dependencies columns in the order every scheme composes them.
+var dependencyColumns = []string{
+	"package_id::text",
+	"dependent_package_version_id::text",
+	"dependency_type",
+	"justification",
+	"origin",
+	"collector",
+	"document_ref",
+}
+
+func (d Dependency) values() []interface{} {
+	return []interface{}{d.PackageID.String(), d.DependentPackageVersionID.String(), d.DependencyType, d.Justification, d.Origin, d.Collector, d.DocumentRef}
+}
+
+// Scheme is one version of the way a dependency's ID string is composed before hashing.
+type Scheme struct {
+	// Name selects the scheme on the command line.
+	Name string
+	// Description says which code composes IDs this way.
+	Description string
+	// format lays out dependencyColumns, in order, as a fmt format of %s verbs.
+	format string
+}
+
+var (
+	// GUACPR2060 is the composition of guacsec/guac's ent backend since guacsec/guac#2060.
+	// That change stopped dependencies from referencing package names, but kept the
+	// composition itself: like the SBOM IDs, it separates document_ref by a single ':'.
+	GUACPR2060 = &Scheme{
+		Name:        "guac-pr2060",
+		Description: "the composition of guacsec/guac's ent backend since guacsec/guac#2060",
+		format:      "%s::%s::%s::%s::%s::%s:%s?",
+	}
+	// UpdateDBV1 is the composition earlier releases of this tool wrote, the same as GUAC's
+	// ent backend before guacsec/guac#2060 (v0.8.0 included).
+	UpdateDBV1 = &Scheme{
+		Name:        "guac-update-db-v1",
+		Description: "the composition written by earlier releases of guac-update-db",
+		format:      "%s::%s::%s::%s::%s::%s:%s?",
+	}
+)
+
+// DefaultScheme is the scheme migrations target unless told otherwise.
+var DefaultScheme = UpdateDBV1
+
+var schemes = map[string]*Scheme{
+	GUACPR2060.Name: GUACPR2060,
+	UpdateDBV1.Name: UpdateDBV1,
+}
+
+// LookupScheme returns the scheme called name.
+func LookupScheme(name string) (*Scheme, error) {
+	s, ok := schemes[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown ID scheme %q: must be one of %s", name, strings.Join(SchemeNames(), ", "))
+	}
+	return s, nil
+}
+
+// SchemeNames returns the names of all schemes, sorted.
+func SchemeNames() []string {
+	var names []string
+	for name := range schemes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// IDString returns the string s hashes to obtain the ID of d.
+func (s *Scheme) IDString(d Dependency) string {
+	return fmt.Sprintf(s.format, d.values()...)
+}
+
+// Key returns the ID s assigns to d.
+func (s *Scheme) Key(d Dependency) uuid.UUID {
+	return GenerateUUIDKey([]byte(s.IDString(d)))
+}
+
+// KeyOf returns the ID s assigns to the dependency whose DependencyColumns have the text
+// values, in order. It lets callers that read rows as text, rather than into a Dependency,
+// derive the same ID.
+func (s *Scheme) KeyOf(values []string) uuid.UUID {
+	args := make([]interface{}, len(values))
+	for i, v := range values {
+		args[i] = v
+	}
+	return GenerateUUIDKey([]byte(fmt.Sprintf(s.format, args...)))
+}
+
+// DependencyColumns returns the SQL expressions reading the columns of a dependencies row that
+// make up its ID, as text and in the order every scheme composes them.
+func DependencyColumns() []string {
+	return append([]string(nil), dependencyColumns...)
+}
+
+// KeySQL returns a scalar SQL expression computing Key for the dependencies row aliased as
+// alias, so set-based migrations can run entirely inside Postgres. uuid::text renders UUIDs in
+// the same lowercase hyphenated form as uuid.UUID.String, and the version and variant bits are
+// set exactly as uuid.NewHash does.
+func (s *Scheme) KeySQL(alias string) string {
+	seps := formatSeparators(s.format)
+	var parts []string
+	for i, col := range dependencyColumns {
+		parts = append(parts, alias+"."+col, quoteLiteral(seps[i]))
+	}
+	namespace := strings.ReplaceAll(uuid.NameSpaceDNS.String(), "-", "")
+	hash := fmt.Sprintf(`sha256('\x%s'::bytea || convert_to(%s, 'UTF8'))`, namespace, strings.Join(parts, " || "))
+	return fmt.Sprintf(`(SELECT encode(set_byte(set_byte(substring(h.digest FROM 1 FOR 16), 6, (get_byte(h.digest, 6) & 15) | 80), 8, (get_byte(h.digest, 8) & 63) | 128), 'hex')::uuid FROM (SELECT %s AS digest) h)`, hash)
+}
+
+// formatSeparators returns the literal text following each verb of format.
+func formatSeparators(format string) []string {
+	parts := strings.Split(format, "%s")
+	return parts[1:]
+}
+
+func quoteLiteral(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", "''") + "'"
+}
@@ -0,0 +1,191 @@
+package keys
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+// upstreamDependency is one fixture of testdata/guac_<release>_dependency_keys.json, whose IDs
+// guacsec/guac derived itself at that release; see testdata/guac-<release>.
+type upstreamDependency struct {
+	Name                      string `json:"name"`
+	Package                   string `json:"package"`
+	DependentPackage          string `json:"dependent_package"`
+	PackageID                 string `json:"package_id"`
+	DependentPackageVersionID string `json:"dependent_package_version_id"`
+	DependencyType            string `json:"dependency_type"`
+	Justification             string `json:"justification"`
+	Origin                    string `json:"origin"`
+	Collector                 string `json:"collector"`
+	DocumentRef               string `json:"document_ref"`
+	IDString                  string `json:"id_string"`
+	Key                       string `json:"key"`
+}
+
+func (u upstreamDependency) dependency() Dependency {
+	return Dependency{
+		PackageID:                 uuid.MustParse(u.PackageID),
+		DependentPackageVersionID: uuid.MustParse(u.DependentPackageVersionID),
+		DependencyType:            u.DependencyType,
+		Justification:             u.Justification,
+		Origin:                    u.Origin,
+		Collector:                 u.Collector,
+		DocumentRef:               u.DocumentRef,
+	}
+}
+
+func (u upstreamDependency) values() []string {
+	return []string{u.PackageID, u.DependentPackageVersionID, u.DependencyType, u.Justification, u.Origin, u.Collector, u.DocumentRef}
+}
+
+func readUpstreamDependencies(t *testing.T, release string) []upstreamDependency {
+	t.Helper()
+	data, err := os.ReadFile(filepath.Join("testdata", "guac_"+release+"_dependency_keys.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var fixtures []upstreamDependency
+	if err := json.Unmarshal(data, &fixtures); err != nil {
+		t.Fatal(err)
+	}
+	if len(fixtures) == 0 {
+		t.Fatal("no fixtures")
+	}
+	return fixtures
+}
+
+// TestGUACV080DependencyKeys checks the composition GUAC used before guacsec/guac#2060, which
+// is the one the databases being migrated hold, against the IDs GUAC v0.8.0 derived.
+func TestGUACV080DependencyKeys(t *testing.T) {
+	testUpstreamDependencyKeys(t, UpdateDBV1, "v0.8.0")
+}
+
+// TestGUACPR2060DependencyKeys checks the composition since guacsec/guac#2060 against the IDs
+// GUAC v0.12.0, which includes it, derived.
+func TestGUACPR2060DependencyKeys(t *testing.T) {
+	testUpstreamDependencyKeys(t, GUACPR2060, "v0.12.0")
+}
+
+func testUpstreamDependencyKeys(t *testing.T, s *Scheme, release string) {
+	for _, u := range readUpstreamDependencies(t, release) {
+		t.Run(u.Name, func(t *testing.T) {
+			d := u.dependency()
+			if got := s.IDString(d); got != u.IDString {
+				t.Errorf("IDString() = %q, want %q", got, u.IDString)
+			}
+			if got := s.Key(d).String(); got != u.Key {
+				t.Errorf("Key() = %s, want %s", got, u.Key)
+			}
+			if got := s.KeyOf(u.values()).String(); got != u.Key {
+				t.Errorf("KeyOf() = %s, want %s", got, u.Key)
+			}
+		})
+	}
+}
+
+func TestDependencyIDStringQuirks(t *testing.T) {
+	d := Dependency{
+		PackageID:                 uuid.MustParse("00000000-0000-0000-0000-000000000001"),
+		DependentPackageVersionID: uuid.MustParse("00000000-0000-0000-0000-000000000002"),
+		DependencyType:            "DIRECT",
+		Justification:             "j",
+		Origin:                    "o",
+		Collector:                 "c",
+		DocumentRef:               "d",
+	}
+	prefix := "00000000-0000-0000-0000-000000000001::00000000-0000-0000-0000-000000000002::DIRECT::j::o::"
+	for _, tc := range []struct {
+		scheme *Scheme
+		want   string
+	}{
+		{GUACPR2060, prefix + "c:d?"},
+		{UpdateDBV1, prefix + "c:d?"},
+	} {
+		if got := tc.scheme.IDString(d); got != tc.want {
+			t.Errorf("%s: IDString() = %q, want %q", tc.scheme.Name, got, tc.want)
+		}
+	}
+
+	// The separators are not escaped, so values containing "::" can shift between fields and
+	// still produce the same ID. GUAC has the same property; it is pinned here so a change to it
+	// is deliberate.
+	shifted := d
+	shifted.Justification = "j::o"
+	shifted.Origin = ""
+	if DefaultScheme.Key(shifted) == DefaultScheme.Key(d) {
+		t.Errorf("an empty field must not be elided from the ID string")
+	}
+	a, b := d, d
+	a.Justification, a.Origin = "x::y", "z"
+	b.Justification, b.Origin = "x", "y::z"
+	if DefaultScheme.Key(a) != DefaultScheme.Key(b) {
+		t.Errorf("fields containing the separator are expected to be ambiguous")
+	}
+}
+
+func TestLookupScheme(t *testing.T) {
+	for _, name := range SchemeNames() {
+		s, err := LookupScheme(name)
+		if err != nil || s.Name != name {
+			t.Errorf("LookupScheme(%q) = %v, %v", name, s, err)
+		}
+	}
+	if _, err := LookupScheme("nope"); err == nil {
+		t.Errorf("LookupScheme accepted an unknown scheme")
+	}
+}
+
+func TestGenerateUUIDKey(t *testing.T) {
+	k := GenerateUUIDKey([]byte("guac"))
+	if k.Version() != 5 {
+		t.Errorf("version = %d, want 5", k.Version())
+	}
+	if k.Variant() != uuid.RFC4122 {
+		t.Errorf("variant = %v, want RFC4122", k.Variant())
+	}
+	if GenerateUUIDKey([]byte("guac")) != k {
+		t.Errorf("GenerateUUIDKey is not deterministic")
+	}
+	if GenerateUUIDKey([]byte("guac?")) == k {
+		t.Errorf("different data produced the same key")
+	}
+}
+
+func TestKeySQLUsesGoFormat(t *testing.T) {
+	for _, name := range SchemeNames() {
+		s := schemes[name]
+		sql := s.KeySQL("d")
+
+		// Every column must appear in format order, each followed by its literal separator.
+		seps := formatSeparators(s.format)
+		if len(seps) != len(dependencyColumns) {
+			t.Fatalf("%s: %d separators for %d columns", name, len(seps), len(dependencyColumns))
+		}
+		rest := sql
+		for i, col := range dependencyColumns {
+			want := "d." + col + " || " + quoteLiteral(seps[i])
+			j := strings.Index(rest, want)
+			if j < 0 {
+				t.Fatalf("%s: SQL does not contain %q in order: %s", name, want, sql)
+			}
+			rest = rest[j+len(want):]
+		}
+	}
+
+	sql := DefaultScheme.KeySQL("d")
+	namespace := strings.ReplaceAll(uuid.NameSpaceDNS.String(), "-", "")
+	if !strings.Contains(sql, `'\x`+namespace+`'::bytea`) {
+		t.Errorf("SQL does not hash the DNS namespace: %s", sql)
+	}
+	// Version 5 in the high nibble of byte 6 and the RFC 4122 variant in byte 8.
+	for _, frag := range []string{"get_byte(h.digest, 6) & 15) | 80", "get_byte(h.digest, 8) & 63) | 128"} {
+		if !strings.Contains(sql, frag) {
+			t.Errorf("SQL does not contain %q: %s", frag, sql)
+		}
+	}
+}
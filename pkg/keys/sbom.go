@@ -0,0 +1,61 @@
+package keys
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// IncludedHash returns the hash GUAC stores in an included_*_hash column of bill_of_materials
+// for the IDs of the nodes of table an SBOM includes: the hex SHA-1 of their global IDs,
+// "table:id", sorted, without duplicates and concatenated. An SBOM including none of them
+// hashes the empty string.
+func IncludedHash(table string, ids []string) string {
+	globalIDs := make([]string, len(ids))
+	for i, id := range ids {
+		globalIDs[i] = table + ":" + id
+	}
+	slices.Sort(globalIDs)
+	sum := sha1.Sum([]byte(strings.Join(slices.Compact(globalIDs), "")))
+	return hex.EncodeToString(sum[:])
+}
+
+// NoneIncluded is the IncludedHash of an SBOM including no node of a table.
+var NoneIncluded = IncludedHash("", nil)
+
+// BillOfMaterials holds the columns of a bill_of_materials row that make up its ID.
+type BillOfMaterials struct {
+	// SubjectID is the package_id of the row, or its artifact_id for the SBOM of an artifact.
+	SubjectID                uuid.UUID
+	IncludedPackagesHash     string
+	IncludedArtifactsHash    string
+	IncludedDependenciesHash string
+	IncludedOccurrencesHash  string
+	URI                      string
+	Algorithm                string
+	Digest                   string
+	DownloadLocation         string
+	Origin                   string
+	Collector                string
+	KnownSince               time.Time
+	DocumentRef              string
+}
+
+// IDString returns the string GUAC's ent backend hashes to obtain the ID of b. Like the
+// dependency schemes it separates document_ref by a single ':', and known_since is Go's
+// default rendering of the time in UTC.
+func (b BillOfMaterials) IDString() string {
+	return fmt.Sprintf("%s::%s::%s::%s::%s::%s::%s::%s::%s::%s::%s::%s:%s?", b.SubjectID, b.IncludedPackagesHash, b.IncludedArtifactsHash,
+		b.IncludedDependenciesHash, b.IncludedOccurrencesHash, b.URI, b.Algorithm, b.Digest, b.DownloadLocation, b.Origin, b.Collector,
+		b.KnownSince.UTC(), b.DocumentRef)
+}
+
+// Key returns the ID GUAC's ent backend assigns to b.
+func (b BillOfMaterials) Key() uuid.UUID {
+	return GenerateUUIDKey([]byte(b.IDString()))
+}
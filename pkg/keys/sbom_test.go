@@ -0,0 +1,91 @@
+package keys
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// upstreamSBOM is one fixture of testdata/guac_<release>_sbom_keys.json, whose hashes and IDs
+// guacsec/guac derived itself at that release; see testdata/guac-<release>.
+type upstreamSBOM struct {
+	Name                     string   `json:"name"`
+	PackageID                string   `json:"package_id"`
+	URI                      string   `json:"uri"`
+	Algorithm                string   `json:"algorithm"`
+	Digest                   string   `json:"digest"`
+	DownloadLocation         string   `json:"download_location"`
+	Origin                   string   `json:"origin"`
+	Collector                string   `json:"collector"`
+	KnownSince               string   `json:"known_since"`
+	DocumentRef              string   `json:"document_ref"`
+	IncludedDependencies     []string `json:"included_dependencies"`
+	IncludedNoneHash         string   `json:"included_none_hash"`
+	IncludedDependenciesHash string   `json:"included_dependencies_hash"`
+	IDString                 string   `json:"id_string"`
+	Key                      string   `json:"key"`
+}
+
+func readUpstreamSBOMs(t *testing.T, release string) []upstreamSBOM {
+	t.Helper()
+	data, err := os.ReadFile(filepath.Join("testdata", "guac_"+release+"_sbom_keys.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var fixtures []upstreamSBOM
+	if err := json.Unmarshal(data, &fixtures); err != nil {
+		t.Fatal(err)
+	}
+	if len(fixtures) == 0 {
+		t.Fatal("no fixtures")
+	}
+	return fixtures
+}
+
+// TestGUACSBOMKeys checks the hashes of the included dependencies and the SBOM IDs against
+// those GUAC v0.8.0 and v0.12.0 derived, from a known_since read back in another time zone as
+// Postgres returns it.
+func TestGUACSBOMKeys(t *testing.T) {
+	for _, release := range []string{"v0.8.0", "v0.12.0"} {
+		for _, f := range readUpstreamSBOMs(t, release) {
+			t.Run(release+"/"+f.Name, func(t *testing.T) {
+				if NoneIncluded != f.IncludedNoneHash {
+					t.Errorf("NoneIncluded = %s, want %s", NoneIncluded, f.IncludedNoneHash)
+				}
+				hash := IncludedHash("dependencies", f.IncludedDependencies)
+				if hash != f.IncludedDependenciesHash {
+					t.Errorf("IncludedHash() = %s, want %s", hash, f.IncludedDependenciesHash)
+				}
+				knownSince, err := time.Parse(time.RFC3339Nano, f.KnownSince)
+				if err != nil {
+					t.Fatal(err)
+				}
+				b := BillOfMaterials{
+					SubjectID:                uuid.MustParse(f.PackageID),
+					IncludedPackagesHash:     NoneIncluded,
+					IncludedArtifactsHash:    NoneIncluded,
+					IncludedDependenciesHash: hash,
+					IncludedOccurrencesHash:  NoneIncluded,
+					URI:                      f.URI,
+					Algorithm:                f.Algorithm,
+					Digest:                   f.Digest,
+					DownloadLocation:         f.DownloadLocation,
+					Origin:                   f.Origin,
+					Collector:                f.Collector,
+					KnownSince:               knownSince.In(time.FixedZone("UTC-5", -5*60*60)),
+					DocumentRef:              f.DocumentRef,
+				}
+				if got := b.IDString(); got != f.IDString {
+					t.Errorf("IDString() =\n%s\nwant\n%s", got, f.IDString)
+				}
+				if got := b.Key().String(); got != f.Key {
+					t.Errorf("Key() = %s, want %s", got, f.Key)
+				}
+			})
+		}
+	}
+}
@@ -0,0 +1,121 @@
+// Command gen derives the dependency IDs of ../guac_v0.12.0_dependency_keys.json, and with the
+// argument sbom the SBOM hashes and IDs of ../guac_v0.12.0_sbom_keys.json, with guacsec/guac
+// v0.12.0's own ent backend code.
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"time"
+	_ "unsafe"
+
+	"github.com/google/uuid"
+	_ "github.com/guacsec/guac/pkg/assembler/backends/ent/backend"
+	"github.com/guacsec/guac/pkg/assembler/backends/helper"
+	"github.com/guacsec/guac/pkg/assembler/graphql/model"
+	"github.com/guacsec/guac/pkg/assembler/helpers"
+)
+
+//go:linkname guacDependencyKey github.com/guacsec/guac/pkg/assembler/backends/ent/backend.guacDependencyKey
+func guacDependencyKey(pkgVersionID *string, depPkgVersionID *string, dep model.IsDependencyInputSpec) (*uuid.UUID, error)
+
+//go:linkname canonicalDependencyString github.com/guacsec/guac/pkg/assembler/backends/ent/backend.canonicalDependencyString
+func canonicalDependencyString(dep model.IsDependencyInputSpec) string
+
+//go:linkname guacHasSBOMKey github.com/guacsec/guac/pkg/assembler/backends/ent/backend.guacHasSBOMKey
+func guacHasSBOMKey(pkgVersionID *string, artID *string, includedPkgHash, includedArtHash, includedDepHash, includedOccurHash string, hasSBOM *model.HasSBOMInputSpec) (*uuid.UUID, error)
+
+//go:linkname canonicalHasSBOMString github.com/guacsec/guac/pkg/assembler/backends/ent/backend.canonicalHasSBOMString
+func canonicalHasSBOMString(hasSBOM *model.HasSBOMInputSpec) string
+
+//go:linkname hashListOfSortedKeys github.com/guacsec/guac/pkg/assembler/backends/ent/backend.hashListOfSortedKeys
+func hashListOfSortedKeys(slc []string) string
+
+//go:linkname toGlobalIDs github.com/guacsec/guac/pkg/assembler/backends/ent/backend.toGlobalIDs
+func toGlobalIDs(nodeType string, ids []string) []string
+
+//go:linkname generateUUIDKey github.com/guacsec/guac/pkg/assembler/backends/ent/backend.generateUUIDKey
+func generateUUIDKey(data []byte) uuid.UUID
+
+// versionID is the ID the ent backend gives the package version of purl, as upsertPackage does
+// (PkgClientKey and PkgServerKey derive the same string).
+func versionID(purl string) string {
+	pkg, err := helpers.PurlToPkg(purl)
+	if err != nil {
+		panic(err)
+	}
+	return generateUUIDKey([]byte(helpers.PkgClientKey(pkg).VersionId)).String()
+}
+
+func main() {
+	var cases []map[string]any
+	if err := json.NewDecoder(os.Stdin).Decode(&cases); err != nil {
+		panic(err)
+	}
+	for _, c := range cases {
+		if len(os.Args) > 1 && os.Args[1] == "sbom" {
+			sbom(c)
+		} else {
+			dependency(c)
+		}
+	}
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	enc.SetEscapeHTML(false)
+	enc.Encode(cases)
+}
+
+func dependency(c map[string]any) {
+	pkg, dep := versionID(c["package"].(string)), versionID(c["dependent_package"].(string))
+	spec := model.IsDependencyInputSpec{
+		DependencyType: model.DependencyType(c["dependency_type"].(string)),
+		Justification:  c["justification"].(string),
+		Origin:         c["origin"].(string),
+		Collector:      c["collector"].(string),
+		DocumentRef:    c["document_ref"].(string),
+	}
+	id, err := guacDependencyKey(&pkg, &dep, spec)
+	if err != nil {
+		panic(err)
+	}
+	c["package_id"], c["dependent_package_version_id"] = pkg, dep
+	c["id_string"] = pkg + "::" + dep + "::" + canonicalDependencyString(spec) + "?"
+	c["key"] = id.String()
+}
+
+// sbom hashes the included dependencies and derives the ID as generateSBOMCreate does for an
+// SBOM of a package that includes no packages, artifacts or occurrences.
+func sbom(c map[string]any) {
+	pkg := versionID(c["package"].(string))
+	knownSince, err := time.Parse(time.RFC3339Nano, c["known_since"].(string))
+	if err != nil {
+		panic(err)
+	}
+	spec := model.HasSBOMInputSpec{
+		URI:              c["uri"].(string),
+		Algorithm:        c["algorithm"].(string),
+		Digest:           c["digest"].(string),
+		DownloadLocation: c["download_location"].(string),
+		KnownSince:       knownSince,
+		Origin:           c["origin"].(string),
+		Collector:        c["collector"].(string),
+		DocumentRef:      c["document_ref"].(string),
+	}
+	var deps []string
+	for _, id := range c["included_dependencies"].([]any) {
+		deps = append(deps, id.(string))
+	}
+	none := hashListOfSortedKeys([]string{""})
+	depHash := none
+	if sorted := helper.SortAndRemoveDups(toGlobalIDs("dependencies", deps)); len(sorted) > 0 {
+		depHash = hashListOfSortedKeys(sorted)
+	}
+	id, err := guacHasSBOMKey(&pkg, nil, none, none, depHash, none, &spec)
+	if err != nil {
+		panic(err)
+	}
+	c["package_id"] = pkg
+	c["included_none_hash"], c["included_dependencies_hash"] = none, depHash
+	c["id_string"] = pkg + "::" + none + "::" + none + "::" + depHash + "::" + none + "::" + canonicalHasSBOMString(&spec) + "?"
+	c["key"] = id.String()
+}
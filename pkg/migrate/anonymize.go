@@ -0,0 +1,105 @@
+package migrate
+
+import (
+	"errors"
+	"strings"
+
+	"github.com/pxp928/guac-update-db/internal/anonymize"
+)
+
+// checkAnonymizeOptions fails on the flags --anonymize cannot be combined with.
+func checkAnonymizeOptions(o *options) error {
+	switch {
+	case o.anonymizeKey != "" && !o.anonymize:
+		return errors.New("--anonymize-key-file needs --anonymize")
+	case !o.anonymize:
+		return nil
+	case o.reportFile == "" && o.reportHTML == "" && o.exportIDMap == "":
+		return errors.New("--anonymize needs --report-file, --report-html or --export-id-map, the files it anonymizes")
+	case o.targetsFile != "":
+		return errors.New("--anonymize cannot be combined with --targets; anonymize the report of one database at a time")
+	}
+	return nil
+}
+
+// newAnonymizer returns an Anonymizer keyed by the content of keyFile, or by a random key of
+// the run when keyFile is empty.
+func newAnonymizer(keyFile string) (*anonymize.Anonymizer, error) {
+	if keyFile == "" {
+		return anonymize.New()
+	}
+	return anonymize.NewFromKeyFile(keyFile)
+}
+
+// anonymized returns a copy of r for sharing, with the database, the values of filter and the
+// IDs replaced by their pseudonyms from a, in the fields and in the error messages. The names
+// the migration itself gives the steps and tables are kept. It is r itself when a is nil.
+func (r *Report) anonymized(a *anonymize.Anonymizer, filter *rowFilter) *Report {
+	if a == nil {
+		return r
+	}
+	var names []string
+	if r.Database != "" {
+		names = append(names, r.Database)
+	}
+	hidden := &rowFilter{}
+	if !filter.empty() {
+		hidden.collectors = anonymizeValues(a, filter.collectors, &names)
+		hidden.origins = anonymizeValues(a, filter.origins, &names)
+		hidden.documentRefs = anonymizeValues(a, filter.documentRefs, &names)
+	}
+	message := func(s string) string {
+		s = a.Message(s)
+		for _, n := range names {
+			s = strings.ReplaceAll(s, n, a.Text(n))
+		}
+		return s
+	}
+
+	c := *r
+	c.Database = a.Text(r.Database)
+	c.DatabaseFingerprint = a.Text(r.DatabaseFingerprint)
+	c.Filter = hidden.String()
+	c.Error = message(r.Error)
+	c.Steps = make([]StepReport, len(r.Steps))
+	for i, s := range r.Steps {
+		s.Error = message(s.Error)
+		c.Steps[i] = s
+	}
+	c.Collisions = anonymizeCollisions(a, r.Collisions)
+	c.Merged = anonymizeCollisions(a, r.Merged)
+	if r.Quarantined != nil {
+		c.Quarantined = make([]Quarantined, len(r.Quarantined))
+		for i, q := range r.Quarantined {
+			q.ID = a.UUIDString(q.ID)
+			q.Error = message(q.Error)
+			c.Quarantined[i] = q
+		}
+	}
+	return &c
+}
+
+// anonymizeValues returns the pseudonyms of values, and adds values to the names to hide in
+// the error messages.
+func anonymizeValues(a *anonymize.Anonymizer, values valueList, names *[]string) valueList {
+	var hidden valueList
+	for _, v := range values {
+		*names = append(*names, v)
+		hidden = append(hidden, a.Text(v))
+	}
+	return hidden
+}
+
+func anonymizeCollisions(a *anonymize.Anonymizer, collisions []IDCollision) []IDCollision {
+	if collisions == nil {
+		return nil
+	}
+	hidden := make([]IDCollision, len(collisions))
+	for i, c := range collisions {
+		hidden[i] = IDCollision{NewID: a.UUIDString(c.NewID)}
+		for _, id := range c.OldIDs {
+			hidden[i].OldIDs = append(hidden[i].OldIDs, a.UUIDString(id))
+		}
+	}
+	return hidden
+}
@@ -0,0 +1,111 @@
+package migrate
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/pxp928/guac-update-db/internal/anonymize"
+)
+
+func TestCheckAnonymizeOptions(t *testing.T) {
+	for _, o := range []*options{{}, {anonymize: true, reportFile: "report.json"}, {anonymize: true, exportIDMap: "ids.csv"}} {
+		if err := checkAnonymizeOptions(o); err != nil {
+			t.Errorf("checkAnonymizeOptions(%+v) = %v", o, err)
+		}
+	}
+	for _, o := range []*options{{anonymize: true}, {anonymize: true, reportFile: "report.json", targetsFile: "targets.yaml"}, {anonymizeKey: "key", reportFile: "report.json"}} {
+		if err := checkAnonymizeOptions(o); err == nil {
+			t.Errorf("checkAnonymizeOptions(%+v) succeeded", o)
+		}
+	}
+}
+
+func TestReportAnonymized(t *testing.T) {
+	const (
+		oldID = "6f1c2a52-4b0e-4c59-9f2e-0c7f1f0c1a11"
+		newID = "0b8f5a5e-2c7e-5d0f-8a4b-3f7c0a1e2d33"
+	)
+	filter := &rowFilter{collectors: valueList{"internal-collector"}}
+	r := newReport()
+	r.Database = "prod-db/guac"
+	r.Filter = filter.String()
+	r.Collisions = []IDCollision{{NewID: newID, OldIDs: []string{oldID}}}
+	r.Quarantined = []Quarantined{{Step: "backfill", Table: "dependencies", ID: oldID, Error: "no package for " + oldID}}
+	r.addStep("rewrite-ids", 1, 0, nil).Error = "dependency " + oldID + " of internal-collector in prod-db/guac"
+	r.Error = r.Steps[0].Error
+
+	if got := r.anonymized(nil, filter); got != r {
+		t.Errorf("anonymized(nil) = %p, want the report itself", got)
+	}
+	a, err := anonymize.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := r.anonymized(a, filter)
+	if got.Database != a.Text(r.Database) || got.Filter != "collector="+a.Text("internal-collector") {
+		t.Errorf("anonymized database %q, filter %q", got.Database, got.Filter)
+	}
+	if got.Collisions[0].NewID != a.UUIDString(newID) || got.Collisions[0].OldIDs[0] != a.UUIDString(oldID) || got.Quarantined[0].ID != a.UUIDString(oldID) {
+		t.Errorf("anonymized IDs %+v, %+v", got.Collisions, got.Quarantined)
+	}
+	for _, s := range []string{got.Error, got.Steps[0].Error, got.Quarantined[0].Error} {
+		for _, leak := range []string{oldID, "internal-collector", "prod-db/guac"} {
+			if strings.Contains(s, leak) {
+				t.Errorf("anonymized error %q contains %q", s, leak)
+			}
+		}
+	}
+	if got.Error != got.Steps[0].Error {
+		t.Errorf("the same error anonymized as %q and %q", got.Error, got.Steps[0].Error)
+	}
+	if r.Collisions[0].NewID != newID || r.Steps[0].Error == got.Steps[0].Error || r.Database != "prod-db/guac" {
+		t.Error("anonymized() changed the report itself")
+	}
+	if a.UUIDString(oldID) == oldID || a.UUIDString(oldID) != a.UUIDString(strings.ToUpper(oldID)) {
+		t.Errorf("UUIDString(%s) = %s", oldID, a.UUIDString(oldID))
+	}
+}
+
+func TestAnonymizeKeyFile(t *testing.T) {
+	dir := t.TempDir()
+	keyFile := filepath.Join(dir, "key")
+	if err := os.WriteFile(keyFile, []byte("0123456789abcdef0123456789abcdef\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	const id = "6f1c2a52-4b0e-4c59-9f2e-0c7f1f0c1a11"
+	var pseudonyms []string
+	for i := 0; i < 2; i++ {
+		a, err := newAnonymizer(keyFile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		pseudonyms = append(pseudonyms, a.Text("internal-collector")+" "+a.UUIDString(id))
+	}
+	if pseudonyms[0] != pseudonyms[1] {
+		t.Errorf("the same key file gave the pseudonyms %q and %q", pseudonyms[0], pseudonyms[1])
+	}
+
+	other := filepath.Join(dir, "other")
+	if err := os.WriteFile(other, []byte("fedcba9876543210fedcba9876543210"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	for _, keyFile := range []string{other, ""} {
+		a, err := newAnonymizer(keyFile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := a.Text("internal-collector") + " " + a.UUIDString(id); got == pseudonyms[0] {
+			t.Errorf("newAnonymizer(%q) gave the pseudonyms of another key", keyFile)
+		}
+	}
+
+	short := filepath.Join(dir, "short")
+	if err := os.WriteFile(short, []byte("secret\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := newAnonymizer(short); err == nil {
+		t.Errorf("newAnonymizer() accepted a 6 byte key")
+	}
+}
@@ -0,0 +1,137 @@
+package migrate
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/pxp928/guac-update-db/pkg/keys"
+)
+
+const (
+	// atlasSumFile is the integrity file Atlas keeps next to versioned migrations.
+	atlasSumFile = "atlas.sum"
+	// atlasMigrationName is the description part of the generated migration file name, which
+	// Atlas records in the description column of its revision table.
+	atlasMigrationName = "guac_dependency_ids"
+	// atlasVersionLayout is the timestamp layout Atlas uses for migration versions.
+	atlasVersionLayout = "20060102150405"
+)
+
+func runGenerateAtlas(args []string) {
+	fs := flag.NewFlagSet("generate atlas", flag.ExitOnError)
+	dir := fs.String("dir", "", "Atlas migration `directory` to write the data migration into")
+	var scheme idSchemeFlag
+	scheme.register(fs)
+	version := fs.String("version", time.Now().UTC().Format(atlasVersionLayout), "Atlas `version` of the migration; it must sort between the migrations before and after GUAC's schema change")
+	fs.Parse(args)
+	if *dir == "" {
+		log.Fatalf("--dir is required\n")
+	}
+
+	path, err := writeAtlasMigration(dbSchema("public"), *dir, *version, scheme.get())
+	if err != nil {
+		log.Fatalf("Failed to generate Atlas migration: %v\n", err)
+	}
+	fmt.Printf("Wrote %s and updated %s\n", path, filepath.Join(*dir, atlasSumFile))
+}
+
+// writeAtlasMigration adds the data migration to an Atlas versioned migration directory and
+// recomputes atlas.sum so "atlas migrate apply" accepts the directory.
+func writeAtlasMigration(schema dbSchema, dir, version string, scheme *keys.Scheme) (string, error) {
+	if _, err := time.Parse(atlasVersionLayout, version); err != nil {
+		return "", fmt.Errorf("invalid version %q: must be a timestamp like %s", version, atlasVersionLayout)
+	}
+	name := fmt.Sprintf("%s_%s.sql", version, atlasMigrationName)
+	path := filepath.Join(dir, name)
+	content := "-- Data migration for guacsec/guac#2021 and #2060, generated by guac-update-db.\n" +
+		"-- It must be applied before the migration that drops dependencies.dependent_package_name_id.\n" +
+		"-- Dependency IDs are composed with the " + scheme.Name + " ID scheme.\n" +
+		dependencyMigrationSQL(schema, scheme)
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		return "", err
+	}
+	if err := writeAtlasSum(dir); err != nil {
+		return "", err
+	}
+	return path, nil
+}
+
+// writeAtlasSum writes atlas.sum for every .sql file in dir using Atlas' h1 scheme, as atlas
+// migrate hash does: each file entry is the running SHA-256 over the names and contents of all
+// files so far, and the first line is a hash over all entries.
+func writeAtlasSum(dir string) error {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	var names []string
+	for _, e := range entries {
+		if !e.IsDir() && strings.HasSuffix(e.Name(), ".sql") {
+			names = append(names, e.Name())
+		}
+	}
+	sort.Strings(names)
+
+	running := sha256.New()
+	sum := sha256.New()
+	var lines strings.Builder
+	for _, name := range names {
+		data, err := os.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			return err
+		}
+		running.Write([]byte(name))
+		running.Write(data)
+		h := base64.StdEncoding.EncodeToString(running.Sum(nil))
+
+		sum.Write([]byte(name))
+		sum.Write([]byte(h))
+		fmt.Fprintf(&lines, "%s h1:%s\n", name, h)
+	}
+	content := fmt.Sprintf("h1:%s\n%s", base64.StdEncoding.EncodeToString(sum.Sum(nil)), lines.String())
+	return os.WriteFile(filepath.Join(dir, atlasSumFile), []byte(content), 0o644)
+}
+
+// atlasApplied reports whether the generated data migration was already applied through Atlas,
+// according to any atlas_schema_revisions table in the database. A database without Atlas
+// revisions, or one whose revisions do not include the data migration, still needs it.
+func atlasApplied(ctx context.Context, conn *pgx.Conn) (bool, string, error) {
+	var schema string
+	err := conn.QueryRow(ctx, `
+		SELECT table_schema FROM information_schema.tables
+		WHERE table_name = 'atlas_schema_revisions'
+		ORDER BY table_schema = 'atlas_schema_revisions' DESC
+		LIMIT 1
+	`).Scan(&schema)
+	if err == pgx.ErrNoRows {
+		return false, "", nil
+	}
+	if err != nil {
+		return false, "", fmt.Errorf("failed to look for the Atlas revision table: %w", err)
+	}
+
+	var version string
+	err = conn.QueryRow(ctx, fmt.Sprintf(`
+		SELECT version FROM %s.atlas_schema_revisions
+		WHERE description = $1 AND applied = total
+		ORDER BY version DESC
+		LIMIT 1
+	`, pgx.Identifier{schema}.Sanitize()), atlasMigrationName).Scan(&version)
+	if err == pgx.ErrNoRows {
+		return false, "", nil
+	}
+	if err != nil {
+		return false, "", fmt.Errorf("failed to read the Atlas revision table: %w", err)
+	}
+	return true, version, nil
+}
@@ -0,0 +1,65 @@
+package migrate
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// auditTable records every value --audit runs changed, so what the tool did to a database can
+// be traced long after the run's logs are gone. It outlives the run and is never dropped.
+const auditTable = "guac_update_db_audit"
+
+// createAuditTableSQL returns the statement creating the audit table. row_id identifies the
+// changed row: the dependency's ID before the run for dependencies, and the SBOM for
+// bill_of_materials_included_dependencies, whose rows have no ID of their own.
+func createAuditTableSQL(schema dbSchema) string {
+	return `CREATE TABLE IF NOT EXISTS ` + schema.prefix() + auditTable + ` (
+	id bigserial PRIMARY KEY,
+	migration_id uuid NOT NULL,
+	table_name text NOT NULL,
+	column_name text NOT NULL,
+	row_id uuid NOT NULL,
+	old_id uuid,
+	new_id uuid NOT NULL,
+	changed_at timestamptz NOT NULL DEFAULT now()
+)`
+}
+
+// createAuditTable creates the audit table unless the run does not audit.
+func (m *migration) createAuditTable(ctx context.Context) error {
+	if m.auditID == "" {
+		return nil
+	}
+	err := m.retry(ctx, "audit", func(conn *pgx.Conn) error {
+		_, err := conn.Exec(ctx, createAuditTableSQL(m.schema))
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("failed to create the audit table: %w", err)
+	}
+	m.logger.Printf("Recording every changed ID in %s with migration_id %s\n", auditTable, m.auditID)
+	return nil
+}
+
+// audited turns update into a statement that also records the rows it changes in the audit
+// table, in the same transaction, when the run audits. returning must yield the row_id, old_id
+// and new_id of each changed row. The statement affects as many rows as update does.
+func (m *migration) audited(update, returning, table, column string) string {
+	if m.auditID == "" {
+		return update
+	}
+	return "WITH changed AS (\n" + update + "\nRETURNING " + returning + "\n)\n" + m.auditInsert("changed", table, column)
+}
+
+// auditInsert returns the INSERT recording the rows of source, a CTE with row_id, old_id and
+// new_id columns, as changes to table.column, or "" when the run does not audit. The migration
+// ID is a UUID the tool generated, so it is safe to inline.
+func (m *migration) auditInsert(source, table, column string) string {
+	if m.auditID == "" {
+		return ""
+	}
+	return fmt.Sprintf(`INSERT INTO %s (migration_id, table_name, column_name, row_id, old_id, new_id)
+SELECT '%s', '%s', '%s', row_id, old_id, new_id FROM %s`, m.schema.prefix()+auditTable, m.auditID, table, column, source)
+}
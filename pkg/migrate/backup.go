@@ -0,0 +1,259 @@
+package migrate
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// backupsTable holds the backups operators recorded with record-backup, or by inserting a row
+// themselves, for --require-backup-within.
+const backupsTable = "guac_update_db_backups"
+
+func createBackupsTableSQL(schema dbSchema) string {
+	return `CREATE TABLE IF NOT EXISTS ` + schema.prefix() + backupsTable + ` (
+	taken_at timestamptz NOT NULL,
+	label text NOT NULL DEFAULT '',
+	recorded_by text NOT NULL DEFAULT current_user,
+	recorded_at timestamptz NOT NULL DEFAULT now()
+)`
+}
+
+// backupSource is where --require-backup-within looks for the latest backup: the marker rows
+// of backupsTable, pgBackRest's info for a stanza, or WAL-G's backup list.
+type backupSource struct {
+	kind   string
+	stanza string
+}
+
+const (
+	backupSourceMarker     = "marker"
+	backupSourcePgBackRest = "pgbackrest"
+	backupSourceWALG       = "wal-g"
+)
+
+// backupInfo is the latest backup a source knows of.
+type backupInfo struct {
+	label   string
+	takenAt time.Time
+	age     time.Duration
+}
+
+func (s *backupSource) String() string {
+	switch s.kind {
+	case "":
+		return backupSourceMarker
+	case backupSourcePgBackRest:
+		return backupSourcePgBackRest + ":" + s.stanza
+	}
+	return s.kind
+}
+
+func (s *backupSource) Set(v string) error {
+	kind, stanza, _ := strings.Cut(v, ":")
+	switch {
+	case kind == backupSourceMarker && stanza == "", kind == backupSourceWALG && stanza == "":
+	case kind == backupSourcePgBackRest && stanza != "":
+	default:
+		return fmt.Errorf("must be marker, pgbackrest:<stanza> or wal-g")
+	}
+	s.kind, s.stanza = kind, stanza
+	return nil
+}
+
+// latest returns the latest successful backup of the source, or an error when it knows of none.
+func (s *backupSource) latest(ctx context.Context, conn *pgx.Conn, schema dbSchema) (backupInfo, error) {
+	switch s.kind {
+	case backupSourcePgBackRest:
+		out, err := runBackupTool(ctx, "pgbackrest", "--stanza="+s.stanza, "--output=json", "info")
+		if err != nil {
+			return backupInfo{}, err
+		}
+		return latestPgBackRest(out, time.Now())
+	case backupSourceWALG:
+		out, err := runBackupTool(ctx, "wal-g", "backup-list", "--json", "--detail")
+		if err != nil {
+			return backupInfo{}, err
+		}
+		return latestWALG(out, time.Now())
+	default:
+		return latestMarker(ctx, conn, schema)
+	}
+}
+
+// latestMarker returns the latest backup recorded in backupsTable.
+func latestMarker(ctx context.Context, conn *pgx.Conn, schema dbSchema) (backupInfo, error) {
+	var exists bool
+	if err := conn.QueryRow(ctx, `SELECT to_regclass($1) IS NOT NULL`, schema.prefix()+backupsTable).Scan(&exists); err != nil {
+		return backupInfo{}, err
+	}
+	if !exists {
+		return backupInfo{}, fmt.Errorf("no backup is recorded: %s does not exist; record one with record-backup after taking it", schema.prefix()+backupsTable)
+	}
+	// The age is computed by the server, whose clock the operator's INSERT used too.
+	var b backupInfo
+	var age float64
+	err := conn.QueryRow(ctx, `
+		SELECT label, taken_at, extract(epoch FROM now() - taken_at)::float8
+		FROM `+schema.prefix()+backupsTable+`
+		ORDER BY taken_at DESC LIMIT 1
+	`).Scan(&b.label, &b.takenAt, &age)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return backupInfo{}, fmt.Errorf("no backup is recorded in %s; record one with record-backup after taking it", schema.prefix()+backupsTable)
+	}
+	if err != nil {
+		return backupInfo{}, err
+	}
+	b.age = time.Duration(age * float64(time.Second))
+	return b, nil
+}
+
+// runBackupTool runs a backup tool's command and returns its standard output.
+func runBackupTool(ctx context.Context, name string, args ...string) ([]byte, error) {
+	var stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, name, args...)
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("%s %s failed: %w: %s", name, strings.Join(args, " "), err, strings.TrimSpace(stderr.String()))
+	}
+	return out, nil
+}
+
+// latestPgBackRest returns the latest backup without errors in the output of pgbackrest info
+// --output=json.
+func latestPgBackRest(out []byte, now time.Time) (backupInfo, error) {
+	var stanzas []struct {
+		Name   string `json:"name"`
+		Backup []struct {
+			Label     string `json:"label"`
+			Error     bool   `json:"error"`
+			Timestamp struct {
+				Stop int64 `json:"stop"`
+			} `json:"timestamp"`
+		} `json:"backup"`
+	}
+	if err := json.Unmarshal(out, &stanzas); err != nil {
+		return backupInfo{}, fmt.Errorf("invalid pgbackrest info output: %w", err)
+	}
+	var latest backupInfo
+	for _, s := range stanzas {
+		for _, b := range s.Backup {
+			if b.Error {
+				continue
+			}
+			if taken := time.Unix(b.Timestamp.Stop, 0); taken.After(latest.takenAt) {
+				latest = backupInfo{label: s.Name + "/" + b.Label, takenAt: taken}
+			}
+		}
+	}
+	if latest.takenAt.IsZero() {
+		return backupInfo{}, errors.New("pgbackrest info lists no successful backup")
+	}
+	latest.age = now.Sub(latest.takenAt)
+	return latest, nil
+}
+
+// latestWALG returns the latest finished backup in the output of wal-g backup-list --json
+// --detail.
+func latestWALG(out []byte, now time.Time) (backupInfo, error) {
+	var backups []struct {
+		Name       string    `json:"backup_name"`
+		FinishTime time.Time `json:"finish_time"`
+	}
+	if err := json.Unmarshal(out, &backups); err != nil {
+		return backupInfo{}, fmt.Errorf("invalid wal-g backup-list output: %w", err)
+	}
+	var latest backupInfo
+	for _, b := range backups {
+		if b.FinishTime.After(latest.takenAt) {
+			latest = backupInfo{label: b.Name, takenAt: b.FinishTime}
+		}
+	}
+	if latest.takenAt.IsZero() {
+		return backupInfo{}, errors.New("wal-g backup-list lists no finished backup")
+	}
+	latest.age = now.Sub(latest.takenAt)
+	return latest, nil
+}
+
+// checkBackup fails unless the latest backup of m.backupSource is at most m.backupWithin old.
+// It runs once, before the first step that rewrites the database.
+func (m *migration) checkBackup(ctx context.Context) error {
+	if m.backupWithin == 0 || m.backupChecked {
+		return nil
+	}
+	var b backupInfo
+	err := m.retry(ctx, "backup-check", func(conn *pgx.Conn) error {
+		var err error
+		b, err = m.backupSource.latest(ctx, conn, m.schema)
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("--require-backup-within: %w", err)
+	}
+	described := b.takenAt.UTC().Format(time.RFC3339)
+	if b.label != "" {
+		described = b.label + ", taken " + described
+	}
+	if b.age > m.backupWithin {
+		return fmt.Errorf("the latest backup (%s) is %s old, more than --require-backup-within %s; take a backup before migrating", described, b.age.Round(time.Minute), m.backupWithin)
+	}
+	m.logger.Printf("Latest backup (%s) is %s old\n", described, b.age.Round(time.Minute))
+	m.backupChecked = true
+	return nil
+}
+
+func runRecordBackup(args []string) {
+	var cf connFlags
+	fs := flag.NewFlagSet("record-backup", flag.ExitOnError)
+	cf.register(fs)
+	label := fs.String("label", "", "describe the backup, e.g. the pg_dump file or the snapshot ID")
+	takenAt := fs.String("taken-at", "", "when the backup was taken, as an RFC 3339 `time`; now when empty")
+	fs.Parse(args)
+
+	if err := recordBackup(&cf, *label, *takenAt); err != nil {
+		log.Fatalf("%v\n", err)
+	}
+	fmt.Fprintf(os.Stdout, "Recorded the backup in %s\n", cf.schema.prefix()+backupsTable)
+}
+
+// recordBackup records a backup the operator took in backupsTable.
+func recordBackup(cf *connFlags, label, takenAt string) error {
+	var at interface{}
+	if takenAt != "" {
+		t, err := time.Parse(time.RFC3339, takenAt)
+		if err != nil {
+			return fmt.Errorf("invalid --taken-at %q: must be an RFC 3339 time such as 2024-07-01T02:00:00Z", takenAt)
+		}
+		at = t
+	}
+	ctx := context.Background()
+	config, err := cf.config()
+	if err != nil {
+		return err
+	}
+	conn, err := pgx.ConnectConfig(ctx, config)
+	if err != nil {
+		return fmt.Errorf("unable to connect to database: %w", err)
+	}
+	defer conn.Close(ctx)
+	if _, err := conn.Exec(ctx, createBackupsTableSQL(cf.schema)); err != nil {
+		return fmt.Errorf("failed to create %s: %w", backupsTable, err)
+	}
+	_, err = conn.Exec(ctx, `INSERT INTO `+cf.schema.prefix()+backupsTable+` (taken_at, label) VALUES (coalesce($1::timestamptz, now()), $2)`, at, label)
+	if err != nil {
+		return fmt.Errorf("failed to record the backup: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,89 @@
+package migrate
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBackupSourceFlag(t *testing.T) {
+	for _, tc := range []struct {
+		value string
+		want  string
+		ok    bool
+	}{
+		{"marker", "marker", true},
+		{"wal-g", "wal-g", true},
+		{"pgbackrest:main", "pgbackrest:main", true},
+		{"pgbackrest", "", false},
+		{"wal-g:main", "", false},
+		{"barman", "", false},
+	} {
+		var s backupSource
+		err := s.Set(tc.value)
+		if (err == nil) != tc.ok {
+			t.Errorf("Set(%q) = %v, want ok %v", tc.value, err, tc.ok)
+			continue
+		}
+		if tc.ok && s.String() != tc.want {
+			t.Errorf("Set(%q).String() = %q, want %q", tc.value, s.String(), tc.want)
+		}
+	}
+	if got := (&backupSource{}).String(); got != "marker" {
+		t.Errorf("default backup source = %q, want marker", got)
+	}
+}
+
+func TestLatestPgBackRest(t *testing.T) {
+	now := time.Unix(1720000000, 0)
+	out := []byte(`[{"name": "main", "backup": [
+		{"label": "20240702-010000F", "error": false, "timestamp": {"start": 1719882000, "stop": 1719882600}},
+		{"label": "20240703-010000F_20240703-090000I", "error": true, "timestamp": {"start": 1719997200, "stop": 1719997800}},
+		{"label": "20240703-010000F", "error": false, "timestamp": {"start": 1719968400, "stop": 1719969000}}
+	]}]`)
+	b, err := latestPgBackRest(out, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b.label != "main/20240703-010000F" || b.age != 31000*time.Second {
+		t.Errorf("latestPgBackRest() = %s, %s old, want main/20240703-010000F, 8h36m40s old", b.label, b.age)
+	}
+	if _, err := latestPgBackRest([]byte(`[{"name": "main", "backup": []}]`), now); err == nil {
+		t.Errorf("latestPgBackRest() succeeded without backups")
+	}
+}
+
+func TestLatestWALG(t *testing.T) {
+	now := time.Date(2024, 7, 3, 12, 0, 0, 0, time.UTC)
+	out := []byte(`[
+		{"backup_name": "base_000000010000000000000002", "start_time": "2024-07-02T01:00:00Z", "finish_time": "2024-07-02T01:10:00Z"},
+		{"backup_name": "base_000000010000000000000007", "start_time": "2024-07-03T01:00:00Z", "finish_time": "2024-07-03T01:30:00Z"}
+	]`)
+	b, err := latestWALG(out, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b.label != "base_000000010000000000000007" || b.age != 10*time.Hour+30*time.Minute {
+		t.Errorf("latestWALG() = %s, %s old, want base_000000010000000000000007, 10h30m0s old", b.label, b.age)
+	}
+	if _, err := latestWALG([]byte(`[]`), now); err == nil {
+		t.Errorf("latestWALG() succeeded without backups")
+	}
+}
+
+func TestRewrites(t *testing.T) {
+	for step, want := range map[string]bool{
+		"backfill":             false,
+		"snapshot-constraints": false,
+		"add-shadow-columns":   false,
+		"verify":               false,
+		"post-maintenance":     false,
+		"drop-constraints":     true,
+		"defer-constraints":    true,
+		"rewrite-ids":          true,
+		"cutover":              true,
+	} {
+		if got := rewrites(step); got != want {
+			t.Errorf("rewrites(%q) = %v, want %v", step, got, want)
+		}
+	}
+}
@@ -0,0 +1,74 @@
+package migrate
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+// batchSender is what sends a batch: a connection or a transaction.
+type batchSender interface {
+	SendBatch(ctx context.Context, b *pgx.Batch) pgx.BatchResults
+}
+
+// sendBatch sends b and reads the result of every statement, so that a statement the server
+// rejects is reported as a batchError naming it rather than as the bare error Close returns.
+func sendBatch(ctx context.Context, s batchSender, b *pgx.Batch) error {
+	results := s.SendBatch(ctx, b)
+	for i, q := range b.QueuedQueries {
+		if _, err := results.Exec(); err != nil {
+			results.Close()
+			var pgErr *pgconn.PgError
+			if !errors.As(err, &pgErr) {
+				// The connection failed rather than the statement; every later one fails with it.
+				return err
+			}
+			return &batchError{index: i, size: b.Len(), sql: q.SQL, args: q.Arguments, err: err}
+		}
+	}
+	return results.Close()
+}
+
+// batchError is the first statement of a batch the server rejected. The statements of the batch
+// run in one transaction, so none of the others took effect either.
+type batchError struct {
+	index, size int
+	sql         string
+	args        []any
+	err         error
+}
+
+func (e *batchError) Error() string {
+	return fmt.Sprintf("statement %d of %d of the batch failed%s: %s: %v", e.index+1, e.size, e.ids(), firstLine(e.sql), e.err)
+}
+
+func (e *batchError) Unwrap() error { return e.err }
+
+// ids names the row the statement was queued for. The per-row statements of the migrations
+// take the new ID as $1 and the old ID as $2.
+func (e *batchError) ids() string {
+	if len(e.args) < 2 {
+		return ""
+	}
+	newID, ok := e.args[0].(uuid.UUID)
+	oldID, ok2 := e.args[1].(uuid.UUID)
+	if !ok || !ok2 {
+		return ""
+	}
+	return fmt.Sprintf(" for old ID %s, new ID %s", oldID, newID)
+}
+
+// firstLine is the first non-blank line of a statement, enough to tell which one it is.
+func firstLine(sql string) string {
+	for _, line := range strings.Split(sql, "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			return line
+		}
+	}
+	return ""
+}
@@ -0,0 +1,29 @@
+package migrate
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+func TestBatchError(t *testing.T) {
+	newID, oldID := uuid.New(), uuid.New()
+	pgErr := &pgconn.PgError{Code: "23503", Message: "insert or update violates foreign key constraint"}
+	err := error(&batchError{index: 2, size: 10, sql: "\n\t\tUPDATE dependencies SET id = $1\n\t\tWHERE id = $2\n", args: []any{newID, oldID}, err: pgErr})
+	want := "statement 3 of 10 of the batch failed for old ID " + oldID.String() + ", new ID " + newID.String() + ": UPDATE dependencies SET id = $1: "
+	if !strings.HasPrefix(err.Error(), want) {
+		t.Errorf("Error() = %q, want it to start with %q", err, want)
+	}
+	var got *pgconn.PgError
+	if !errors.As(err, &got) || got.Code != "23503" {
+		t.Errorf("errors.As(%v) = %v, want the server error", err, got)
+	}
+
+	quarantine := &batchError{index: 0, size: 1, sql: "INSERT INTO quarantine", args: []any{newID, "backfill"}, err: pgErr}
+	if strings.Contains(quarantine.Error(), "old ID") {
+		t.Errorf("Error() = %q, want no IDs for a statement not queued per row", quarantine)
+	}
+}
@@ -0,0 +1,106 @@
+package migrate
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/google/uuid"
+)
+
+// dependencyChecksumSQL is the checksum of the dependencies rows d of a chunk: an md5 of every
+// column the backfill and the new IDs are computed from, in primary key order. It is the same
+// expression when the script is written and when it is applied, so the two compare as text.
+const dependencyChecksumSQL = `count(*)::text || ':' || coalesce(md5(string_agg(ROW(d.id, d.package_id, d.dependent_package_name_id, d.dependent_package_version_id, d.version_range, d.dependency_type, d.justification, d.origin, d.collector, d.document_ref)::text, ',' ORDER BY d.id)), '')`
+
+// chunkChecksum is the checksum of one --chunk-size chunk of the dependencies, read when an
+// --emit-sql script is written. The chunk holds the IDs after after, up to and including last.
+// The first chunk has no lower bound and the last no upper bound, so a row ingested anywhere
+// falls in one of them.
+type chunkChecksum struct {
+	after, last uuid.NullUUID
+	sum         string
+}
+
+// dependencyChunkChecksums splits the dependencies into chunks of chunkSize rows in primary key
+// order and returns their checksums. An empty table is one chunk without bounds.
+func dependencyChunkChecksums(ctx context.Context, q queryer, schema dbSchema, chunkSize int) ([]chunkChecksum, error) {
+	rows, err := q.Query(ctx, `
+		SELECT (array_agg(d.id ORDER BY d.id DESC))[1], `+dependencyChecksumSQL+`
+		FROM (SELECT d.*, (row_number() OVER (ORDER BY d.id) - 1) / $1 AS chunk FROM `+schema.prefix()+`dependencies d) d
+		GROUP BY d.chunk
+		ORDER BY d.chunk
+	`, chunkSize)
+	if err != nil {
+		return nil, fmt.Errorf("failed to checksum the dependencies: %w", err)
+	}
+	defer rows.Close()
+	var chunks []chunkChecksum
+	var after uuid.NullUUID
+	for rows.Next() {
+		c := chunkChecksum{after: after}
+		if err := rows.Scan(&c.last, &c.sum); err != nil {
+			return nil, fmt.Errorf("failed to scan row: %w", err)
+		}
+		after = c.last
+		chunks = append(chunks, c)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to checksum the dependencies: %w", err)
+	}
+	if len(chunks) == 0 {
+		return []chunkChecksum{{sum: "0:"}}, nil
+	}
+	chunks[len(chunks)-1].last = uuid.NullUUID{}
+	return chunks, nil
+}
+
+// contains reports whether id falls in the chunk. IDs are compared bytewise, as Postgres
+// orders uuids.
+func (c chunkChecksum) contains(id uuid.UUID) bool {
+	return (!c.after.Valid || bytes.Compare(id[:], c.after.UUID[:]) > 0) &&
+		(!c.last.Valid || bytes.Compare(id[:], c.last.UUID[:]) <= 0)
+}
+
+// where is the condition selecting the rows d of the chunk.
+func (c chunkChecksum) where() string {
+	var conds []string
+	if c.after.Valid {
+		conds = append(conds, fmt.Sprintf("d.id > '%s'", c.after.UUID))
+	}
+	if c.last.Valid {
+		conds = append(conds, fmt.Sprintf("d.id <= '%s'", c.last.UUID))
+	}
+	if len(conds) == 0 {
+		return "true"
+	}
+	return strings.Join(conds, " AND ")
+}
+
+// String describes the chunk for the error raised when it changed.
+func (c chunkChecksum) String() string {
+	switch {
+	case c.after.Valid && c.last.Valid:
+		return fmt.Sprintf("after id %s up to id %s", c.after.UUID, c.last.UUID)
+	case c.after.Valid:
+		return fmt.Sprintf("after id %s", c.after.UUID)
+	case c.last.Valid:
+		return fmt.Sprintf("up to id %s", c.last.UUID)
+	default:
+		return "in the table"
+	}
+}
+
+// checkSQL is a block raising an exception, which rolls back the transaction of the chunk,
+// when the rows of the chunk no longer have the checksum they had when the script was written.
+func (c chunkChecksum) checkSQL(schema dbSchema) string {
+	return fmt.Sprintf(`DO $$
+BEGIN
+  IF (SELECT %s FROM %sdependencies d WHERE %s) <> '%s' THEN
+    RAISE EXCEPTION 'the dependencies %s changed after the script was generated; generate it again';
+  END IF;
+END
+$$;
+`, dependencyChecksumSQL, schema.prefix(), c.where(), c.sum, c)
+}
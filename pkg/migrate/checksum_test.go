@@ -0,0 +1,57 @@
+package migrate
+
+import (
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+func TestChunkChecksumBounds(t *testing.T) {
+	id := func(s string) uuid.NullUUID { return uuid.NullUUID{UUID: uuid.MustParse(s), Valid: true} }
+	low, high := id("10000000-0000-0000-0000-000000000000"), id("20000000-0000-0000-0000-000000000000")
+	tests := []struct {
+		chunk chunkChecksum
+		where string
+		in    []string
+		out   []string
+	}{
+		{
+			chunk: chunkChecksum{},
+			where: "true",
+			in:    []string{"00000000-0000-0000-0000-000000000000", "ffffffff-ffff-ffff-ffff-ffffffffffff"},
+		},
+		{
+			chunk: chunkChecksum{last: low},
+			where: "d.id <= '10000000-0000-0000-0000-000000000000'",
+			in:    []string{"00000000-0000-0000-0000-000000000000", "10000000-0000-0000-0000-000000000000"},
+			out:   []string{"10000000-0000-0000-0000-000000000001"},
+		},
+		{
+			chunk: chunkChecksum{after: low, last: high},
+			where: "d.id > '10000000-0000-0000-0000-000000000000' AND d.id <= '20000000-0000-0000-0000-000000000000'",
+			in:    []string{"10000000-0000-0000-0000-000000000001", "20000000-0000-0000-0000-000000000000"},
+			out:   []string{"10000000-0000-0000-0000-000000000000", "20000000-0000-0000-0000-000000000001"},
+		},
+		{
+			chunk: chunkChecksum{after: high},
+			where: "d.id > '20000000-0000-0000-0000-000000000000'",
+			in:    []string{"f0000000-0000-0000-0000-000000000000"},
+			out:   []string{"20000000-0000-0000-0000-000000000000"},
+		},
+	}
+	for _, tt := range tests {
+		if got := tt.chunk.where(); got != tt.where {
+			t.Errorf("where() = %q, want %q", got, tt.where)
+		}
+		for _, s := range tt.in {
+			if !tt.chunk.contains(uuid.MustParse(s)) {
+				t.Errorf("chunk %s does not contain %s", tt.chunk, s)
+			}
+		}
+		for _, s := range tt.out {
+			if tt.chunk.contains(uuid.MustParse(s)) {
+				t.Errorf("chunk %s contains %s", tt.chunk, s)
+			}
+		}
+	}
+}
@@ -0,0 +1,68 @@
+package migrate
+
+import (
+	"math"
+	"time"
+)
+
+const (
+	// adaptiveFirstChunk is the size of the first chunk with --target-batch-latency, small
+	// enough to be quick on any hardware.
+	adaptiveFirstChunk = 1000
+	// adaptiveMinChunk is the smallest chunk --target-batch-latency shrinks to, below which
+	// the round trips cost more than the rows.
+	adaptiveMinChunk = 100
+	// chunkSmoothing is the weight of the latest chunk in the average time per row.
+	chunkSmoothing = 0.3
+)
+
+// chunkSizer picks the number of rows of the next chunk of a keyset-paginated step, one per
+// worker. With a target latency it starts small, measures how long every chunk took to commit,
+// lock waits and retries included, and resizes the next one to take about the target, up to
+// max. Without one every chunk has max rows.
+type chunkSizer struct {
+	// metricsTarget is the target label of the chunk_size metric, the target of the run.
+	metricsTarget string
+	step          string
+	target        time.Duration
+	max           int
+	size          int
+	// perRow is the moving average of the seconds a row took.
+	perRow float64
+}
+
+func (m *migration) newChunkSizer(step string) *chunkSizer {
+	s := &chunkSizer{metricsTarget: m.target, step: step, target: m.targetLatency, max: m.chunkSize, size: m.chunkSize}
+	if s.target > 0 {
+		s.size = min(adaptiveFirstChunk, s.max)
+	}
+	metrics.chunkSized(m.target, step, s.size)
+	return s
+}
+
+// next is the number of rows of the next chunk.
+func (s *chunkSizer) next() int {
+	return s.size
+}
+
+// observe records that a chunk of rows took d. The chunks grow at most twofold at a time, by
+// the average time per row, and shrink at once to the latest chunk when it was slower than the
+// average, so a burst of lock waits is backed off from immediately.
+func (s *chunkSizer) observe(rows int64, d time.Duration) {
+	if s.target <= 0 || rows <= 0 {
+		return
+	}
+	perRow := d.Seconds() / float64(rows)
+	switch {
+	case s.perRow == 0, perRow > s.perRow:
+		s.perRow = perRow
+	default:
+		s.perRow = chunkSmoothing*perRow + (1-chunkSmoothing)*s.perRow
+	}
+	want := s.max
+	if s.perRow > 0 {
+		want = int(math.Round(min(s.target.Seconds()/s.perRow, float64(s.max))))
+	}
+	s.size = max(min(want, 2*s.size, s.max), min(adaptiveMinChunk, s.max))
+	metrics.chunkSized(s.metricsTarget, s.step, s.size)
+}
@@ -0,0 +1,41 @@
+package migrate
+
+import (
+	"testing"
+	"time"
+)
+
+func TestChunkSizer(t *testing.T) {
+	fixed := (&migration{chunkSize: 5000}).newChunkSizer("backfill")
+	fixed.observe(5000, time.Minute)
+	if got := fixed.next(); got != 5000 {
+		t.Errorf("chunk without --target-batch-latency = %d rows, want --chunk-size", got)
+	}
+
+	s := (&migration{chunkSize: 50000, targetLatency: 500 * time.Millisecond}).newChunkSizer("backfill")
+	if got := s.next(); got != adaptiveFirstChunk {
+		t.Fatalf("first chunk = %d rows, want %d", got, adaptiveFirstChunk)
+	}
+	// At 10µs a row the target is 50000 rows, reached by doubling.
+	for i, want := range []int{2000, 4000, 8000, 16000, 32000, 50000, 50000} {
+		s.observe(int64(s.next()), time.Duration(s.next())*10*time.Microsecond)
+		if got := s.next(); got != want {
+			t.Fatalf("chunk after %d fast chunks = %d rows, want %d", i+1, got, want)
+		}
+	}
+	// A chunk waiting 4s on a lock shrinks the next one at once.
+	s.observe(50000, 4*time.Second)
+	if got := s.next(); got != 6250 {
+		t.Errorf("chunk after a slow chunk = %d rows, want 6250", got)
+	}
+	s.observe(6250, time.Hour)
+	if got := s.next(); got != adaptiveMinChunk {
+		t.Errorf("chunk after a stuck chunk = %d rows, want at least %d", got, adaptiveMinChunk)
+	}
+
+	small := (&migration{chunkSize: 50, targetLatency: time.Second}).newChunkSizer("backfill")
+	small.observe(50, time.Hour)
+	if got := small.next(); got != 50 {
+		t.Errorf("chunk with --chunk-size 50 = %d rows, want 50", got)
+	}
+}
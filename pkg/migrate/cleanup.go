@@ -0,0 +1,126 @@
+package migrate
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// The values of --cleanup-name-columns, what the cleanup-name-columns step does with the
+// dependent_package_name_id and version_range columns of the dependencies once the backfill
+// replaced them with dependent_package_version_id.
+const (
+	// cleanupNone leaves them as they are, for GUAC's own schema migration to drop.
+	cleanupNone = "none"
+	// cleanupNull sets them to NULL, as the rows GUAC v0.9 writes have them while the
+	// columns still exist.
+	cleanupNull = "null"
+	// cleanupDrop drops them, as the schema of GUAC v0.9 has no such columns.
+	cleanupDrop = "drop"
+)
+
+func validCleanup(mode string) bool {
+	return mode == cleanupNone || mode == cleanupNull || mode == cleanupDrop
+}
+
+// versionIDIndexSQL is the unique index of the dependencies of GUAC v0.9. The index GUAC v0.8
+// has under the same name is limited to the rows without dependent_package_name_id, so
+// dropping the column drops it too.
+func versionIDIndexSQL(schema dbSchema) string {
+	return `CREATE UNIQUE INDEX IF NOT EXISTS dep_package_version_id ON ` + schema.prefix() + `dependencies (package_id, dependent_package_version_id, dependency_type, justification, origin, collector, document_ref)`
+}
+
+// cleanupSQL returns the statements of --cleanup-name-columns=mode.
+func cleanupSQL(schema dbSchema, mode string) []string {
+	if mode == cleanupDrop {
+		return []string{
+			`ALTER TABLE ` + schema.prefix() + `dependencies DROP COLUMN IF EXISTS dependent_package_name_id, DROP COLUMN IF EXISTS version_range`,
+			versionIDIndexSQL(schema),
+		}
+	}
+	return []string{`
+		UPDATE ` + schema.prefix() + `dependencies
+		SET dependent_package_name_id = NULL, version_range = NULL
+		WHERE dependent_package_name_id IS NOT NULL OR version_range IS NOT NULL
+	`}
+}
+
+// cleanupNameColumns NULLs or drops the columns the backfill replaced, in one transaction. It
+// refuses while a dependency has no dependent_package_version_id, whose name and version range
+// are then the only record of what it depends on.
+func (m *migration) cleanupNameColumns(ctx context.Context) (int64, error) {
+	var cleaned int64
+	err := m.retry(ctx, "cleanup-name-columns", func(conn *pgx.Conn) error {
+		cleaned = 0
+		tx, err := conn.Begin(ctx)
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback(ctx)
+
+		// A run of another mode, or GUAC's own migration, may have dropped the columns already.
+		var remaining int64
+		err = tx.QueryRow(ctx, `
+			SELECT count(*) FROM pg_attribute
+			WHERE attrelid = $1::regclass AND attname IN ('dependent_package_name_id', 'version_range') AND NOT attisdropped
+		`, m.schema.prefix()+"dependencies").Scan(&remaining)
+		if err != nil || remaining == 0 {
+			return err
+		}
+		unresolved, err := countUnresolved(ctx, tx, m.schema, nil)
+		if err != nil {
+			return err
+		}
+		if unresolved > 0 {
+			return fmt.Errorf("%d dependencies have no dependent_package_version_id and would lose what they depend on; resolve them, or run without --cleanup-name-columns", unresolved)
+		}
+		for _, stmt := range cleanupSQL(m.schema, m.cleanup) {
+			tag, err := tx.Exec(ctx, stmt)
+			if err != nil {
+				return err
+			}
+			cleaned += tag.RowsAffected()
+		}
+		return tx.Commit(ctx)
+	})
+	if err != nil {
+		return 0, fmt.Errorf("failed to %s dependent_package_name_id and version_range: %w", m.cleanup, err)
+	}
+	return cleaned, nil
+}
+
+// emitCleanupNameColumns writes the statements of cleanupNameColumns, after a check failing the
+// script while a dependency has no dependent_package_version_id.
+func (m *migration) emitCleanupNameColumns(_ context.Context, w io.Writer) error {
+	fmt.Fprintf(w, `BEGIN;
+DO $$
+BEGIN
+  IF EXISTS (SELECT 1 FROM %sdependencies WHERE dependent_package_name_id IS NOT NULL AND dependent_package_version_id IS NULL) THEN
+    RAISE EXCEPTION 'dependencies rows have no dependent_package_version_id and would lose what they depend on';
+  END IF;
+END
+$$;
+`, m.schema.prefix())
+	for _, stmt := range cleanupSQL(m.schema, m.cleanup) {
+		fmt.Fprintf(w, "%s;\n", stmt)
+	}
+	_, err := fmt.Fprintf(w, "COMMIT;\n")
+	return err
+}
+
+// checkCleanupOptions fails on the flags --cleanup-name-columns cannot be combined with.
+func checkCleanupOptions(opts *options) error {
+	if opts.cleanup == cleanupNone {
+		return nil
+	}
+	switch {
+	case !opts.filter.empty():
+		return errors.New("--cleanup-name-columns cleans every dependency and cannot be combined with the --filter flags")
+	case opts.estimate:
+		return errors.New("--estimate does not measure --cleanup-name-columns")
+	}
+	return nil
+}
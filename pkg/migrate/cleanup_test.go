@@ -0,0 +1,38 @@
+package migrate
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+)
+
+func TestCleanupNameColumnsStep(t *testing.T) {
+	for _, mode := range []string{"", cleanupNone, cleanupNull, cleanupDrop} {
+		steps := (&migration{cleanup: mode}).dependencyVersionIDSteps()
+		last := steps[len(steps)-1].name
+		want := "verify"
+		if mode == cleanupNull || mode == cleanupDrop {
+			want = "cleanup-name-columns"
+		}
+		if last != want {
+			t.Errorf("last step with --cleanup-name-columns=%q = %s, want %s", mode, last, want)
+		}
+	}
+}
+
+func TestEmitCleanupNameColumns(t *testing.T) {
+	for mode, want := range map[string]string{
+		cleanupNull: "SET dependent_package_name_id = NULL, version_range = NULL",
+		cleanupDrop: "DROP COLUMN IF EXISTS dependent_package_name_id, DROP COLUMN IF EXISTS version_range;\nCREATE UNIQUE INDEX IF NOT EXISTS dep_package_version_id ON public.dependencies (package_id, dependent_package_version_id,",
+	} {
+		var buf bytes.Buffer
+		if err := (&migration{cleanup: mode}).emitCleanupNameColumns(context.Background(), &buf); err != nil {
+			t.Fatal(err)
+		}
+		script := buf.String()
+		if !strings.HasPrefix(script, "BEGIN;\nDO $$") || !strings.HasSuffix(script, "COMMIT;\n") || !strings.Contains(script, want) {
+			t.Errorf("%s script:\n%s\nwant the check and %q in one transaction", mode, script, want)
+		}
+	}
+}
@@ -0,0 +1,792 @@
+package migrate
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+	"github.com/pxp928/guac-update-db/internal/anonymize"
+)
+
+// options are the command-line settings of a run.
+type options struct {
+	conn           connFlags
+	pool           poolSettings
+	metricsAddr    string
+	reportFile     string
+	reportHTML     string
+	force          bool
+	waitForQuiesce bool
+	quiesceTimeout time.Duration
+	retry          retryPolicy
+	timeouts       timeoutSettings
+	chunkSize      int
+	targetLatency  time.Duration
+	workers        int
+	yes            bool
+	poolerCompat   string
+	dialect        dialect
+	fromVersion    string
+	toVersion      string
+	idScheme       idSchemeFlag
+	fast           bool
+	rebuildIndexes bool
+	deferFKs       bool
+	online         bool
+	noDDL          bool
+	normalizePurls bool
+	unsafeSpeedups bool
+	maxMemory      byteSize
+	diskCheck      string
+	diskAvailable  byteSize
+	maintenance    string
+	analyzeDSN     string
+	targetsFile    string
+	parallel       int
+	steps          stepList
+	skipSteps      stepList
+	exportIDMap    string
+	anonymize      bool
+	anonymizeKey   string
+	daemon         bool
+	interval       time.Duration
+	estimate       bool
+	estimateFrac   float64
+	emitSQL        string
+	audit          bool
+	notify         notifier
+	otlpEndpoint   string
+	throttle       throttle
+	windows        windowList
+	stateFile      string
+	eventsFile     string
+	recordFile     string
+	logSQL         string
+	expectDB       string
+	snapshotFile   string
+	errorPolicy    string
+	versionRanges  string
+	filter         rowFilter
+	cleanup        string
+	guac           guacInstallation
+	maxQuarantined int
+	backupWithin   time.Duration
+	backupSource   backupSource
+	serveAddr      string
+	serveToken     string
+	hookMode       bool
+	initContainer  bool
+	waitForDB      bool
+	waitTimeout    time.Duration
+	completionFile string
+	completionRow  bool
+	maxRuntime     time.Duration
+	deadlineAt     deadlineFlag
+	stepTimeouts   stepDurations
+	// deadline is when a run with --deadline or --max-runtime stops, the earlier of the two,
+	// from the start of the process.
+	deadline time.Time
+	// control is the API --serve starts, through which an orchestrator drives the run.
+	control *controlServer
+	// observer is told about the progress of the run, and writes --events-file.
+	observer Observer
+	// reconciling is set for the passes of --daemon after the migration, which only migrate
+	// the rows written in the old ID scheme since.
+	reconciling bool
+	// anonymizer, with --anonymize, replaces the names and IDs of --report-file and
+	// --export-id-map with pseudonyms.
+	anonymizer *anonymize.Anonymizer
+	// target is the name of the --targets target the run is against, empty otherwise.
+	target string
+}
+
+// parseMigrateFlags parses the flags of the migrate command in args, returning the error of an
+// invalid flag or combination of flags. Its flag set handles parse errors as handling says.
+func parseMigrateFlags(args []string, handling flag.ErrorHandling) (*options, error) {
+	o := &options{}
+	fs := flag.NewFlagSet("migrate", handling)
+	o.conn.register(fs)
+	o.pool.register(fs)
+	o.notify.register(fs)
+	fs.StringVar(&o.otlpEndpoint, "otlp-endpoint", "", "export traces of the steps and batches over OTLP/HTTP to this `url` (e.g. http://localhost:4318); OTEL_EXPORTER_OTLP_ENDPOINT is used when empty")
+	fs.StringVar(&o.serveAddr, "serve", "", "serve the control API on `address` (e.g. localhost:8099, or any address with --serve-token-file) and wait for POST /start before migrating; implies --yes")
+	fs.StringVar(&o.serveToken, "serve-token-file", "", "require the bearer token in `path` on the control API requests that start, pause, resume or abort the run")
+	fs.StringVar(&o.metricsAddr, "metrics-addr", "", "serve Prometheus metrics on `address` (e.g. :9090) while the migration runs")
+	fs.StringVar(&o.reportFile, "report-file", "", "write a JSON report of the run to `path` (YAML when it ends in .yaml or .yml)")
+	fs.StringVar(&o.reportHTML, "report-html", "", "write a report of the run to `path` as an HTML page with charts of the throughput of every step, for runbooks and readers who do not read JSON")
+	fs.BoolVar(&o.force, "force", false, "run even if other sessions are writing to the database")
+	fs.BoolVar(&o.waitForQuiesce, "wait-for-quiesce", false, "wait for other sessions to stop writing to the database instead of failing")
+	fs.DurationVar(&o.quiesceTimeout, "quiesce-timeout", 30*time.Minute, "how long --wait-for-quiesce waits before giving up")
+	fs.IntVar(&o.retry.maxRetries, "max-retries", 5, "retry a statement this many times after a transient database error (0 disables retries)")
+	fs.DurationVar(&o.retry.initialBackoff, "retry-backoff", time.Second, "wait this long before the first retry, doubling on every further attempt")
+	fs.DurationVar(&o.retry.maxBackoff, "retry-max-backoff", time.Minute, "upper bound on the wait between retries")
+	fs.IntVar(&o.chunkSize, "chunk-size", 10000, "number of dependencies the backfill updates and commits at a time")
+	fs.DurationVar(&o.targetLatency, "target-batch-latency", 0, "resize the backfill chunks to commit in about this `duration` each (e.g. 500ms), starting small and growing up to --chunk-size (0 keeps every chunk at --chunk-size)")
+	fs.IntVar(&o.workers, "workers", 1, "backfill `n` disjoint key ranges of the dependencies at the same time, each on a connection of its own")
+	fs.Float64Var(&o.throttle.maxRowsPerSecond, "max-rows-per-second", 0, "update at most this many `rows` per second on average in the backfill, rewrite-ids and fix-refs steps (0 is unlimited)")
+	fs.DurationVar(&o.throttle.pause, "pause-between-batches", 0, "wait this long after every --chunk-size batch of the backfill, rewrite-ids and fix-refs steps")
+	fs.Var(&o.windows, "window", "only run during these comma-separated daily `windows` in local time (e.g. 22:00-06:00), pausing between batches outside them")
+	fs.StringVar(&o.expectDB, "expect-db-fingerprint", "", "refuse to run unless the database has this `fingerprint`, as printed by schema-diff and at the start of every run")
+	fs.StringVar(&o.eventsFile, "events-file", "", "write every step started, batch committed, collision found and the outcome of the run to `path` as JSON lines")
+	fs.StringVar(&o.recordFile, "record", "", "record every statement of the run, its parameters hashed, and the errors the server returned to `path`, for guac-update-db replay")
+	fs.StringVar(&o.logSQL, "log-sql", logSQLOff, "log the statements of the run with their duration and error, but not their parameters: errors logs only those that failed, all every one, off none")
+	fs.StringVar(&o.snapshotFile, "constraint-snapshot", "guac-update-db-constraints.json", "before dropping any constraint or index, also save their definitions to `path`, for restore-constraints (empty to only save them in the database)")
+	fs.BoolVar(&o.hookMode, "hook-mode", false, "run as a Helm pre-upgrade hook: succeed when nothing needs migrating, stop at --max-runtime and keep the state in the database")
+	fs.BoolVar(&o.initContainer, "init-container", false, "run as an init container of guac-graphql: wait for the database, succeed when nothing needs migrating and keep the state in the database")
+	fs.BoolVar(&o.waitForDB, "wait-for-db", false, "wait for the database to accept connections instead of failing when it cannot be reached")
+	fs.DurationVar(&o.waitTimeout, "wait-timeout", defaultDBWaitTimeout, "how long --wait-for-db waits before giving up")
+	fs.StringVar(&o.completionFile, "completion-file", "", "write a marker to `path` once the database is migrated or needs no migration, removing any earlier one when the run starts")
+	fs.BoolVar(&o.completionRow, "completion-row", false, "once the database is migrated or needs no migration, record it in the "+completionTable+" table of --schema")
+	fs.DurationVar(&o.maxRuntime, "max-runtime", 0, "stop at the next batch or step after this `duration`, saving the state for the next run to resume from (0 is unlimited; "+defaultHookRuntime.String()+" with --hook-mode)")
+	fs.Var(&o.deadlineAt, "deadline", "stop at the next batch or step after this `deadline`, a duration such as 2h or an RFC 3339 time, saving the state as --max-runtime does; the earlier of the two applies")
+	fs.Var(&o.stepTimeouts, "step-timeout", "how long a step may run, as a `duration` optionally followed by per-step overrides (e.g. 30m,backfill=2h): past it the step stops at its next batch, and it is not started when the deadline is closer")
+	fs.StringVar(&o.stateFile, "state-file", "", "save the progress of the run to `path` and resume from it when the run is started again")
+	fs.Var(&o.timeouts.statement, "statement-timeout", "statement_timeout for the session, as a `duration` optionally followed by per-step overrides (e.g. 10m,backfill=1h)")
+	fs.Var(&o.timeouts.lock, "lock-timeout", "lock_timeout for the session, as a `duration` optionally followed by per-step overrides (e.g. 5s,add-constraints=1m)")
+	fs.BoolVar(&o.yes, "yes", false, "do not ask for confirmation before modifying the database")
+	fs.BoolVar(&o.yes, "non-interactive", false, "alias for --yes")
+	fs.StringVar(&o.poolerCompat, "pooler-compat", "auto", "`mode` for connecting through a transaction-pooling pooler such as pgbouncer: auto, on or off")
+	fs.Var(&o.dialect, "dialect", "`database` being migrated: postgres or cockroach")
+	fs.StringVar(&o.fromVersion, "from", "", "GUAC `version` the database is on (e.g. v0.8.0); detected from the schema when empty")
+	fs.StringVar(&o.toVersion, "to", latestVersion, "GUAC `version` being upgraded to, or \"latest\"")
+	o.guac.register(fs)
+	o.idScheme.register(fs)
+	fs.BoolVar(&o.rebuildIndexes, "rebuild-indexes", false, "drop the secondary indexes of the rewritten tables during the rewrite and rebuild them concurrently afterwards")
+	fs.StringVar(&o.maintenance, "post-maintenance", maintenanceAnalyze, "`maintenance` to run on the rewritten tables afterwards: analyze, vacuum-analyze or none")
+	fs.StringVar(&o.analyzeDSN, "analyze-dsn", "", "run the read-only scans against the database at this connection `string`, typically a read replica; without a password the primary's is used")
+	fs.StringVar(&o.targetsFile, "targets", "", "migrate every database listed in the YAML file at `path` instead of a single one")
+	fs.IntVar(&o.parallel, "parallel", 1, "with --targets, migrate up to `n` databases at a time")
+	fs.Var(&o.steps, "steps", "run only these comma-separated `steps` (e.g. backfill,verify)")
+	fs.Var(&o.skipSteps, "skip-steps", "skip these comma-separated `steps`")
+	fs.StringVar(&o.exportIDMap, "export-id-map", "", "write the old to new ID of every rewritten dependency to `path` (.csv, .ndjson, .jsonl or .parquet)")
+	fs.BoolVar(&o.anonymize, "anonymize", false, "replace the IDs, database name and --filter values in --report-file and --export-id-map with pseudonyms, to share them without leaking internal package names")
+	fs.StringVar(&o.anonymizeKey, "anonymize-key-file", "", "key the --anonymize pseudonyms with the secret in `path`, so runs given the same file give the same pseudonyms")
+	fs.BoolVar(&o.daemon, "daemon", false, "after migrating, keep running and migrate the dependencies written in the old ID scheme since, such as by a collector still on the old GUAC version, every --interval")
+	fs.DurationVar(&o.interval, "interval", defaultReconcileInterval, "with --daemon, the `duration` between two scans for dependencies in the old ID scheme")
+	fs.BoolVar(&o.estimate, "estimate", false, "measure the migration on a sample of the rows in a transaction that is rolled back, and print the projected runtime and WAL volume instead of migrating")
+	fs.Float64Var(&o.estimateFrac, "estimate-fraction", 0.01, "`fraction` of the dependencies --estimate samples")
+	fs.StringVar(&o.emitSQL, "emit-sql", "", "write every statement the migration would run to a psql script at `path` instead of running them")
+	fs.BoolVar(&o.audit, "audit", false, "record every dependency ID and reference the migration changes in the "+auditTable+" table of --schema")
+	fs.StringVar(&o.errorPolicy, "error-policy", errorPolicyAbort, "what to do when a row fails to migrate: abort the run, or quarantine the row in "+quarantineTable+", leave it as it is and go on")
+	fs.StringVar(&o.versionRanges, "version-ranges", versionRangesSkip, "what the backfill does with a dependency whose version_range is a range such as >=1.2.0 rather than a version: skip it and report it, fail before changing anything, or exact to match the range as text as a version")
+	o.filter.register(fs)
+	fs.StringVar(&o.cleanup, "cleanup-name-columns", cleanupNone, "after verify, what to do with dependencies.dependent_package_name_id and version_range, which the backfill replaced: none, null to set them to NULL, or drop to drop them as GUAC v0.9 does")
+	fs.IntVar(&o.maxQuarantined, "max-quarantined", 1000, "with --error-policy=quarantine, fail the run once more than `n` rows failed (0 is unlimited)")
+	fs.DurationVar(&o.backupWithin, "require-backup-within", 0, "refuse to run the steps that rewrite the database unless the latest backup is at most this `duration` old (0 does not check)")
+	fs.Var(&o.backupSource, "backup-source", "where --require-backup-within finds the latest backup: marker (the rows of "+backupsTable+"), pgbackrest:<stanza> or wal-g")
+	fs.BoolVar(&o.fast, "fast", false, "bulk-load the ID mapping with COPY and rewrite with set-based updates, for very large databases")
+	fs.BoolVar(&o.deferFKs, "defer-constraints", false, "make the foreign keys deferrable and rewrite the IDs and references in one transaction instead of dropping and re-adding the foreign keys")
+	fs.BoolVar(&o.noDDL, "no-ddl", false, "rewrite the IDs with plain INSERT, UPDATE and DELETE statements that keep the foreign keys valid, for a user without owner privileges on the GUAC tables; slower, since every statement checks the constraints")
+	fs.BoolVar(&o.online, "online", false, "fill in the new IDs in shadow columns while GUAC keeps running, and swap them in with a short cutover once it stopped")
+	fs.Var(&o.maxMemory, "max-memory", "keep at most `size` of the old to new ID map in memory, such as 512MiB, and spill the rest to temporary files in $TMPDIR (0 keeps it all in memory)")
+	fs.StringVar(&o.diskCheck, "disk-check", diskCheckEnforce, "before changing anything, estimate the disk space the run takes and compare it to the free space of the database's volumes: enforce fails the run without enough room, warn only logs it, off skips the check")
+	fs.Var(&o.diskAvailable, "disk-available", "the free `size` of the database's volume, such as 200GiB, for --disk-check when the tool cannot read it itself, as when it does not run on the database server")
+	fs.BoolVar(&o.unsafeSpeedups, "unsafe-speedups", false, "trade durability for speed: synchronous_commit=off for every session, an unlogged --fast staging table and a larger maintenance_work_mem for index builds; a crash of the server during the run can lose its latest commits")
+	fs.BoolVar(&o.normalizePurls, "normalize-purls", false, "before the backfill, lowercase the package types and sort the qualifiers as GUAC normalizes purls, merging the packages and dependencies that become identical")
+	if handling == flag.ContinueOnError {
+		fs.SetOutput(io.Discard)
+	}
+	if err := parseConfigArgs(fs, args); err != nil {
+		return nil, err
+	}
+	if o.chunkSize <= 0 {
+		return nil, errors.New("--chunk-size must be positive")
+	}
+	if o.targetLatency < 0 {
+		return nil, errors.New("--target-batch-latency must not be negative")
+	}
+	if o.workers <= 0 {
+		return nil, errors.New("--workers must be positive")
+	}
+	if o.parallel <= 0 {
+		return nil, errors.New("--parallel must be positive")
+	}
+	if o.throttle.maxRowsPerSecond < 0 || o.throttle.pause < 0 {
+		return nil, errors.New("--max-rows-per-second and --pause-between-batches must not be negative")
+	}
+	if err := o.notify.validate(); err != nil {
+		return nil, err
+	}
+	if o.pool.maxConns < 2 {
+		return nil, errors.New("--max-conns must be at least 2: one connection holds the migration lock")
+	}
+	if o.workers >= o.pool.maxConns {
+		return nil, errors.New("--workers must be less than --max-conns: every worker needs a connection besides the one holding the migration lock")
+	}
+	if o.targetsFile != "" && (o.conn.dsnFile != "" || o.conn.passwordFile != "" || o.analyzeDSN != "") {
+		return nil, errors.New("--targets cannot be combined with --dsn-file, --password-file or --analyze-dsn; set them per target")
+	}
+	if o.targetsFile != "" && o.expectDB != "" {
+		return nil, errors.New("--expect-db-fingerprint cannot be combined with --targets; set fingerprint per target")
+	}
+	if o.targetsFile != "" && o.recordFile != "" {
+		return nil, errors.New("--record records a single database and cannot be combined with --targets")
+	}
+	if len(o.steps) > 0 && len(o.skipSteps) > 0 {
+		return nil, errors.New("--steps and --skip-steps cannot be combined")
+	}
+	if o.exportIDMap != "" {
+		if err := checkIDMapPath(o.exportIDMap); err != nil {
+			return nil, err
+		}
+	}
+	if err := checkAnonymizeOptions(o); err != nil {
+		return nil, err
+	}
+	if err := checkDaemonOptions(o); err != nil {
+		return nil, err
+	}
+	if o.maxRuntime < 0 {
+		return nil, errors.New("--max-runtime must not be negative")
+	}
+	if err := applyHookMode(o); err != nil {
+		return nil, err
+	}
+	if err := applyInitContainerMode(o); err != nil {
+		return nil, err
+	}
+	start := time.Now()
+	if o.maxRuntime > 0 {
+		o.deadline = start.Add(o.maxRuntime)
+	}
+	if at := o.deadlineAt.from(start); !at.IsZero() {
+		if !at.After(start) {
+			return nil, fmt.Errorf("--deadline %s has already passed", at.Format(time.RFC3339))
+		}
+		if o.deadline.IsZero() || at.Before(o.deadline) {
+			o.deadline = at
+		}
+	}
+	if o.serveToken != "" && o.serveAddr == "" {
+		return nil, errors.New("--serve-token-file needs --serve")
+	}
+	if o.serveAddr != "" && (o.emitSQL != "" || o.estimate) {
+		return nil, errors.New("--serve drives a migration and cannot be combined with --emit-sql or --estimate")
+	}
+	if o.serveAddr != "" && o.serveToken == "" && !loopbackAddr(o.serveAddr) {
+		return nil, fmt.Errorf("--serve %s listens beyond this host: pass --serve-token-file, or listen on a loopback address such as localhost:8099", o.serveAddr)
+	}
+	if o.serveAddr != "" {
+		// POST /start is the confirmation; there is no terminal to ask on.
+		o.yes = true
+	}
+	if o.backupWithin < 0 {
+		return nil, errors.New("--require-backup-within must not be negative")
+	}
+	if o.estimateFrac <= 0 || o.estimateFrac > 1 {
+		return nil, errors.New("--estimate-fraction must be greater than 0 and at most 1")
+	}
+	if o.estimate && o.targetsFile != "" {
+		return nil, errors.New("--estimate cannot be combined with --targets")
+	}
+	if o.estimate && o.emitSQL != "" {
+		return nil, errors.New("--estimate and --emit-sql cannot be combined")
+	}
+	if o.estimate && o.deferFKs {
+		return nil, errors.New("--estimate measures the run that drops the foreign keys and cannot be combined with --defer-constraints")
+	}
+	if !validMaintenance(o.maintenance) {
+		return nil, fmt.Errorf("invalid --post-maintenance %q: must be analyze, vacuum-analyze or none", o.maintenance)
+	}
+	if err := checkDialectOptions(o); err != nil {
+		return nil, err
+	}
+	if err := checkOnlineOptions(o); err != nil {
+		return nil, err
+	}
+	if err := checkNoDDLOptions(o); err != nil {
+		return nil, err
+	}
+	if !validLogSQL(o.logSQL) {
+		return nil, fmt.Errorf("invalid --log-sql %q: must be off, errors or all", o.logSQL)
+	}
+	if !validDiskCheck(o.diskCheck) {
+		return nil, fmt.Errorf("invalid --disk-check %q: must be enforce, warn or off", o.diskCheck)
+	}
+	if !validErrorPolicy(o.errorPolicy) {
+		return nil, fmt.Errorf("invalid --error-policy %q: must be abort or quarantine", o.errorPolicy)
+	}
+	if err := checkErrorPolicyOptions(o); err != nil {
+		return nil, err
+	}
+	if !validVersionRanges(o.versionRanges) {
+		return nil, fmt.Errorf("invalid --version-ranges %q: must be skip, fail or exact", o.versionRanges)
+	}
+	if err := checkNormalizeOptions(o); err != nil {
+		return nil, err
+	}
+	if err := checkFilterOptions(o); err != nil {
+		return nil, err
+	}
+	if err := checkGUACOptions(o); err != nil {
+		return nil, err
+	}
+	if !validCleanup(o.cleanup) {
+		return nil, fmt.Errorf("invalid --cleanup-name-columns %q: must be none, null or drop", o.cleanup)
+	}
+	if err := checkCleanupOptions(o); err != nil {
+		return nil, err
+	}
+	if err := checkSpeedupsOptions(o); err != nil {
+		return nil, err
+	}
+	if err := checkInitContainerOptions(o); err != nil {
+		return nil, err
+	}
+	return o, nil
+}
+
+// usageFatalf reports an invalid combination of flags and exits with exitUsage.
+func usageFatalf(format string, v ...interface{}) {
+	log.Printf(format, v...)
+	os.Exit(exitUsage)
+}
+
+// Main runs the guac-update-db command with args, the command line without the program name,
+// exiting with the exit code of the command as the guac-update-db binary does.
+func Main(args []string) {
+	if len(args) > 0 {
+		switch args[0] {
+		case "migrate":
+			args = args[1:]
+		case "generate":
+			runGenerate(args[1:])
+			return
+		case "schema-diff":
+			runSchemaDiff(args[1:])
+			return
+		case "verify-ids":
+			runVerifyIDs(args[1:])
+			return
+		case "verify-graphql":
+			runVerifyGraphQL(args[1:])
+			return
+		case "diff":
+			runDiff(args[1:])
+			return
+		case "audit":
+			runAudit(args[1:])
+			return
+		case "apply":
+			runApply(args[1:])
+			return
+		case "gen-testdata":
+			runGenTestdata(args[1:])
+			return
+		case "rewrite-dump":
+			runRewriteDump(args[1:])
+			return
+		case "repair-orphans":
+			runRepairOrphans(args[1:])
+			return
+		case "restore-constraints":
+			runRestoreConstraints(args[1:])
+			return
+		case "record-backup":
+			runRecordBackup(args[1:])
+			return
+		case "replay":
+			runReplay(args[1:])
+			return
+		case "export-fixture":
+			runExportFixture(args[1:])
+			return
+		case "import-fixture":
+			runImportFixture(args[1:])
+			return
+		case "version", "-version", "--version":
+			runVersion(args[1:])
+			return
+		case "help", "-h", "-help", "--help":
+			usage()
+			return
+		}
+	}
+	runMigrate(args)
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "%s\n\n", buildInfo())
+	fmt.Fprintf(os.Stderr, `Usage: guac-update-db [command] [flags]
+
+Commands:
+  migrate              run the migration (the default when no command is given)
+  verify-ids           check every dependency ID against GUAC's ID algorithm
+  verify-graphql       check that a running GUAC resolves sampled dependencies and SBOMs
+  schema-diff          compare the live schema against the expected GUAC schemas
+  audit                list the inconsistencies of the database and write a plan fixing them
+  apply                run the plan audit wrote
+  diff                 compare the dependency graphs of two databases by content rather than by ID
+  gen-testdata         fill a scratch database with synthetic data to time the migration
+  rewrite-dump         migrate a plain-format pg_dump file without a database
+  repair-orphans       find, delete or remap bill of materials rows pointing at missing dependencies
+  restore-constraints  re-create the constraints and indexes a crashed run left dropped
+  record-backup        record a backup taken of the database, for --require-backup-within
+  replay               run the statements a run recorded with --record against a scratch database
+  export-fixture       write the tables the migration involves as an anonymized NDJSON fixture
+  import-fixture       load an NDJSON fixture into a scratch database
+  generate manifests   print a Kubernetes Job that runs the migration
+  generate atlas       add the migration to an Atlas versioned migration directory
+  version              print the version of the binary and the data migrations it runs
+
+Data migrations:
+`)
+	printMigrations(os.Stderr)
+	fmt.Fprintf(os.Stderr, `
+Run "guac-update-db <command> -h" for the flags of a command.
+`)
+}
+
+// runMigrate runs the migration, writing the report and exiting with the exit code of its
+// outcome.
+func runMigrate(args []string) {
+	opts, err := parseMigrateFlags(args, flag.ExitOnError)
+	if err != nil {
+		usageFatalf("%v\n", err)
+	}
+	if err := removeCompletionFile(opts.completionFile); err != nil {
+		log.Fatalf("%v\n", err)
+	}
+
+	if opts.metricsAddr != "" {
+		serveMetrics(opts.metricsAddr)
+	}
+	flushTraces, err := setupTracing(context.Background(), opts.otlpEndpoint)
+	if err != nil {
+		log.Fatalf("%v\n", err)
+	}
+	// The events file is left open until the process exits.
+	if opts.observer, _, err = openEvents(opts.eventsFile); err != nil {
+		log.Fatalf("%v\n", err)
+	}
+	if opts.anonymize {
+		if opts.anonymizer, err = newAnonymizer(opts.anonymizeKey); err != nil {
+			log.Fatalf("%v\n", err)
+		}
+	}
+	if opts.serveAddr != "" {
+		if opts.control, err = startControlServer(opts.serveAddr, opts.serveToken); err != nil {
+			log.Fatalf("%v\n", err)
+		}
+		opts.observer = Observers(opts.observer, opts.control)
+		if err := opts.control.waitForStart(); err != nil {
+			opts.control.close()
+			log.Fatalf("%v\n", err)
+		}
+	}
+	if opts.targetsFile != "" {
+		runMigrateTargets(opts, flushTraces)
+		return
+	}
+
+	report := newReport()
+	err = migrateDatabase(opts.control.context(), opts, report, log.Default())
+	werr := finishRun(opts, report, err)
+	opts.control.close()
+	flushTraces()
+	if werr != nil {
+		log.Fatalf("%v\n", werr)
+	}
+	if opts.daemon && report.Success {
+		runDaemon(opts)
+		return
+	}
+	if errors.Is(err, errAlreadyMigrated) {
+		log.Printf("Nothing to migrate.\n")
+		return
+	}
+	if err != nil {
+		log.Printf("%v\n", err)
+		os.Exit(report.ExitCode)
+	}
+	fmt.Print("Success!")
+}
+
+// finishRun records in report that the run against a single database ended with err, and
+// reports it to the observer, the notification webhooks, --report-file and --report-html. It
+// writes --completion-file when the run succeeded.
+func finishRun(opts *options, report *Report, err error) error {
+	report.finish(err)
+	opts.observer.OnFinish(report.result())
+	opts.notify.notifyRun(report)
+	report.write(opts)
+	if report.Success && opts.completionFile != "" {
+		return writeCompletionFile(opts.completionFile, report)
+	}
+	return nil
+}
+
+// migrateDatabase connects to the database and runs every migration step until ctx is done,
+// recording progress in report.
+func migrateDatabase(ctx context.Context, opts *options, report *Report, logger *log.Logger) (err error) {
+	ctx, span := tracer.Start(ctx, "migrate")
+	defer func() {
+		if errors.Is(context.Cause(ctx), errAborted) && err != nil {
+			err = fmt.Errorf("%w: %w", errAborted, err)
+		}
+		endSpan(span, err)
+	}()
+
+	logger.Printf("%s\n", buildInfo())
+	config, err := opts.conn.config()
+	if err != nil {
+		return err
+	}
+	report.Database = config.Database
+	span.SetAttributes(dbAttributes(config.Database)...)
+	if opts.waitForDB {
+		if err := waitForDatabase(ctx, config, opts.waitTimeout, logger); err != nil {
+			return err
+		}
+	}
+
+	var analyzeConfig *pgx.ConnConfig
+	if opts.analyzeDSN != "" {
+		if analyzeConfig, err = analysisConfig(opts.analyzeDSN, config); err != nil {
+			return err
+		}
+	}
+
+	var speedups *unsafeSpeedups
+	if opts.unsafeSpeedups {
+		speedups = &unsafeSpeedups{}
+	}
+	var recorder *traceRecorder
+	if opts.recordFile != "" {
+		if recorder, err = openTrace(opts.recordFile); err != nil {
+			return err
+		}
+		defer func() {
+			if err := recorder.close(); err != nil {
+				logger.Printf("%v\n", err)
+			}
+		}()
+		logger.Printf("Recording the statements of the run to %s\n", opts.recordFile)
+	}
+	config.Tracer = sqlTracer(logger, opts.logSQL, recorder)
+
+	poolerCompat, err := resolvePoolerCompat(ctx, config, logger, opts.poolerCompat)
+	if err != nil {
+		return err
+	}
+	if poolerCompat {
+		if err := checkPoolerCompatOptions(opts); err != nil {
+			return err
+		}
+		usePoolerCompat(config)
+		if analyzeConfig != nil {
+			usePoolerCompat(analyzeConfig)
+		}
+	} else if !opts.dialect.advisoryLocks() {
+		logger.Printf("CockroachDB has no advisory locks: the migration lock is not taken, make sure no other migration runs against this database\n")
+	}
+
+	observer := opts.observer
+	if observer == nil {
+		observer = NopObserver{}
+	}
+	m := &migration{
+		config:           config,
+		schema:           opts.conn.schema,
+		poolSettings:     opts.pool,
+		retryPolicy:      opts.retry,
+		timeouts:         &opts.timeouts,
+		chunkSize:        opts.chunkSize,
+		targetLatency:    opts.targetLatency,
+		workers:          opts.workers,
+		observer:         observer,
+		target:           opts.target,
+		throttle:         opts.throttle,
+		windows:          opts.windows,
+		poolerCompat:     poolerCompat,
+		dialect:          opts.dialect,
+		scheme:           opts.idScheme.get(),
+		fast:             opts.fast,
+		diskCheck:        opts.diskCheck,
+		diskAvailable:    int64(opts.diskAvailable),
+		indexRebuild:     opts.rebuildIndexes,
+		deferConstraints: opts.deferFKs,
+		online:           opts.online,
+		noDDL:            opts.noDDL,
+		normalize:        opts.normalizePurls,
+		postMaintenance:  opts.maintenance,
+		analyzeConfig:    analyzeConfig,
+		speedups:         speedups,
+		recorder:         recorder,
+		logger:           logger,
+		idMapPath:        opts.exportIDMap,
+		anonymizer:       opts.anonymizer,
+		snapshotPath:     opts.snapshotFile,
+		control:          opts.control,
+		backupWithin:     opts.backupWithin,
+		backupSource:     opts.backupSource,
+		steps:            stepFilter{only: opts.steps, skip: opts.skipSteps},
+		stepTimeouts:     opts.stepTimeouts,
+		versionRanges:    opts.versionRanges,
+		filter:           &opts.filter,
+		cleanup:          opts.cleanup,
+		completedSteps:   make(map[string]bool),
+		report:           report,
+	}
+	m.changes.limit = int64(opts.maxMemory)
+	if m.target == "" {
+		m.target = config.Database
+	}
+	report.IDScheme = m.scheme.Name
+	if report.Filter = opts.filter.String(); report.Filter != "" {
+		logger.Printf("Migrating only the dependencies with %s\n", report.Filter)
+	}
+	if opts.audit {
+		m.auditID = uuid.NewString()
+		report.AuditMigrationID = m.auditID
+	}
+	if opts.errorPolicy == errorPolicyQuarantine {
+		m.quarantineID = uuid.NewString()
+		m.maxQuarantined = opts.maxQuarantined
+		report.QuarantineMigrationID = m.quarantineID
+	}
+	if opts.stateFile != "" {
+		if m.state, err = loadState(opts.stateFile, config.Database); err != nil {
+			return err
+		}
+	}
+	m.deadline = opts.deadline
+	if err := m.connect(ctx); err != nil {
+		return err
+	}
+	defer m.close(ctx)
+	if opts.completionRow {
+		defer func() {
+			if err == nil || errors.Is(err, errAlreadyMigrated) {
+				if rerr := m.recordCompletion(ctx, err); rerr != nil {
+					err = rerr
+				}
+			}
+		}()
+	}
+
+	report.DatabaseFingerprint, err = checkGUACDatabase(ctx, m.session.Conn(), opts.conn.schema, logger, opts.expectDB)
+	recorder.database(report.DatabaseFingerprint)
+	if err != nil {
+		return err
+	}
+	if opts.reconciling {
+		return m.reconcile(ctx)
+	}
+	applied, version, err := atlasApplied(ctx, m.session.Conn())
+	if err != nil {
+		return err
+	}
+	if applied {
+		logger.Printf("The data migration was already applied through Atlas (revision %s); nothing to do\n", version)
+		return errAlreadyMigrated
+	}
+
+	migrations, err := selectMigrations(ctx, m.session.Conn(), opts.conn.schema, logger, opts.fromVersion, opts.toVersion)
+	if err != nil {
+		return err
+	}
+	if len(migrations) == 0 {
+		logger.Printf("No data migrations are needed; run Atlas as usual\n")
+		return errAlreadyMigrated
+	}
+	if err := opts.guac.check(ctx, migrations, report, logger); err != nil {
+		return err
+	}
+
+	pending, err := pendingIndexRebuild(ctx, m.session.Conn(), opts.conn.schema)
+	if err != nil {
+		return fmt.Errorf("failed to look for indexes dropped by an earlier run: %w", err)
+	}
+	if pending > 0 && !opts.rebuildIndexes {
+		logger.Printf("An earlier --rebuild-indexes run dropped %d indexes without rebuilding them; pass --rebuild-indexes to restore them\n", pending)
+	}
+
+	if (opts.hookMode || opts.initContainer) && m.state == nil {
+		if m.state, err = loadDatabaseState(ctx, config, opts.conn.schema); err != nil {
+			return err
+		}
+	}
+
+	if err := m.state.restrict(report.Filter); err != nil {
+		return err
+	}
+
+	if opts.estimate {
+		return m.runEstimate(ctx, migrations, opts.estimateFrac, os.Stdout, config.Database)
+	}
+	if opts.emitSQL != "" {
+		return m.emitScript(ctx, migrations, opts.emitSQL, config.Database)
+	}
+
+	quiesceTimeout := opts.quiesceTimeout
+	if !m.deadline.IsZero() {
+		quiesceTimeout = min(quiesceTimeout, time.Until(m.deadline))
+	}
+	switch {
+	case opts.force:
+		logger.Printf("Skipping the active writer check (--force)\n")
+	case opts.online:
+		logger.Printf("Online migration: checking for active writers before the cutover\n")
+		m.checkWriters = func(ctx context.Context) error {
+			return checkQuiesced(ctx, m.session.Conn(), logger, opts.waitForQuiesce, quiesceTimeout)
+		}
+	default:
+		if err := checkQuiesced(ctx, m.session.Conn(), logger, opts.waitForQuiesce, quiesceTimeout); err != nil {
+			if opts.hookMode && !opts.waitForQuiesce && errors.Is(err, errActiveWriters) {
+				return hookWritersError(err)
+			}
+			return err
+		}
+	}
+
+	if err := m.prepareSpeedups(ctx); err != nil {
+		return err
+	}
+	defer m.restoreSpeedups(ctx)
+
+	if err := m.checkDMLPrivileges(ctx); err != nil {
+		return err
+	}
+	if err := m.checkDiskHeadroom(ctx); err != nil {
+		return err
+	}
+	im, err := m.estimateImpact(ctx)
+	if err != nil {
+		return err
+	}
+	if opts.yes {
+		im.print(os.Stdout, config.Database)
+	} else if err := confirm(os.Stdin, os.Stdout, im, config.Database, opts.conn.usesStdin()); err != nil {
+		return err
+	}
+
+	return m.run(ctx, migrations)
+}
+
+// selectMigrations picks the data migrations needed to go from GUAC version from to version to.
+// When from is empty the database's version is detected with the same comparison as schema-diff.
+func selectMigrations(ctx context.Context, conn *pgx.Conn, schema dbSchema, logger *log.Logger, from, to string) ([]dataMigration, error) {
+	if from == "" {
+		result, err := closestSchema(ctx, conn, schema)
+		if err != nil {
+			return nil, fmt.Errorf("%w, pass --from: %w", ErrSchemaMismatch, err)
+		}
+		if !result.Exact {
+			logger.Printf("The schema does not exactly match any known GUAC release; assuming the closest, %s (run schema-diff for details)\n", result.Closest)
+		}
+		from = result.Closest
+		logger.Printf("Detected GUAC %s schema\n", from)
+	}
+	if to != latestVersion && compareVersions(from, to) >= 0 {
+		return nil, fmt.Errorf("--to %s must be newer than the database's version %s", to, from)
+	}
+	return migrationsBetween(from, to)
+}
@@ -0,0 +1,127 @@
+package migrate
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"time"
+)
+
+// guacRelease matches the GUAC versions --guac-version takes, such as v0.8.5, 0.9 or
+// v0.9.0-rc.1.
+var guacRelease = regexp.MustCompile(`^v?[0-9]+(\.[0-9]+)*([-+].*)?$`)
+
+// guacInstallation is the GUAC version installed against the database, which the data
+// migrations must apply to: --guac-version as given, or read from the GraphQL API at
+// --guac-endpoint.
+type guacInstallation struct {
+	version   string
+	endpoint  string
+	tokenFile string
+	timeout   time.Duration
+}
+
+func (g *guacInstallation) register(fs *flag.FlagSet) {
+	fs.StringVar(&g.version, "guac-version", "", "refuse to run data migrations that do not apply to this installed GUAC `version` (e.g. v0.8.5)")
+	fs.StringVar(&g.endpoint, "guac-endpoint", "", "read the installed GUAC version from the GraphQL API at `url` (e.g. http://guac-graphql:8080/query), as --guac-version")
+	fs.StringVar(&g.tokenFile, "guac-token-file", "", "read a bearer token for --guac-endpoint from `path` (\"-\" for stdin)")
+	fs.DurationVar(&g.timeout, "guac-timeout", 30*time.Second, "timeout of the request to --guac-endpoint")
+}
+
+// checkGUACOptions fails on an invalid --guac-version or a --guac-endpoint combined with it.
+func checkGUACOptions(opts *options) error {
+	g := &opts.guac
+	switch {
+	case g.version != "" && g.endpoint != "":
+		return errors.New("--guac-version and --guac-endpoint cannot be combined")
+	case g.version != "" && !guacRelease.MatchString(g.version):
+		return fmt.Errorf("invalid --guac-version %q: must be a GUAC release such as v0.8.5", g.version)
+	case g.tokenFile != "" && g.endpoint == "":
+		return errors.New("--guac-token-file needs --guac-endpoint")
+	case g.tokenFile == stdinPath && opts.conn.usesStdin():
+		return errors.New("only one of --guac-token-file, --dsn-file and --password-file can be read from stdin")
+	}
+	return nil
+}
+
+// isDependencyFieldsQuery lists the fields of the IsDependency type of the GraphQL API.
+const isDependencyFieldsQuery = `query IsDependencyFields {
+  __type(name: "IsDependency") { fields { name } }
+}`
+
+// graphQLRelease tells the GUAC release line serving the GraphQL API of c. The API does not
+// report a version, so it is told apart by the fields of IsDependency: guacsec/guac#2060
+// removed versionRange, which GUAC v0.8 has.
+func graphQLRelease(ctx context.Context, c *graphQLClient) (string, error) {
+	var data struct {
+		Type *struct {
+			Fields []struct {
+				Name string `json:"name"`
+			} `json:"fields"`
+		} `json:"__type"`
+	}
+	if err := c.query(ctx, isDependencyFieldsQuery, nil, &data); err != nil {
+		return "", err
+	}
+	if data.Type == nil {
+		return "", errors.New("the GraphQL API has no IsDependency type; is it GUAC's?")
+	}
+	for _, f := range data.Type.Fields {
+		if f.Name == "versionRange" {
+			return "v0.8", nil
+		}
+	}
+	return "v0.9", nil
+}
+
+// installed returns the installed GUAC version, and an empty string when neither
+// --guac-version nor --guac-endpoint is set.
+func (g *guacInstallation) installed(ctx context.Context) (string, error) {
+	if g.endpoint == "" {
+		return g.version, nil
+	}
+	c := &graphQLClient{endpoint: g.endpoint, http: &http.Client{Timeout: g.timeout}}
+	if g.tokenFile != "" {
+		token, err := readSecret(g.tokenFile)
+		if err != nil {
+			return "", fmt.Errorf("failed to read --guac-token-file: %w", err)
+		}
+		c.token = token
+	}
+	version, err := graphQLRelease(ctx, c)
+	if err != nil {
+		return "", fmt.Errorf("failed to read the GUAC version from %s: %w", g.endpoint, err)
+	}
+	return version, nil
+}
+
+// checkCompatible fails unless every one of migrations applies to a database GUAC version
+// writes: version is at least the release the migration starts from, and older than the one
+// it migrates to.
+func checkCompatible(version string, migrations []dataMigration) error {
+	for _, dm := range migrations {
+		switch {
+		case compareVersions(version, dm.From) < 0:
+			return fmt.Errorf("%w: %s migrates the databases of GUAC %s, but GUAC %s is installed; upgrade GUAC to %s first", ErrIncompatibleGUAC, dm.Name, dm.From, version, dm.From)
+		case compareVersions(version, dm.To) >= 0:
+			return fmt.Errorf("%w: %s migrates the databases of GUAC %s to %s, but GUAC %s is installed, whose database never had the old schema", ErrIncompatibleGUAC, dm.Name, dm.From, dm.To, version)
+		}
+	}
+	return nil
+}
+
+// check refuses migrations that do not apply to the installed GUAC version, when
+// it is known, and records it in report.
+func (g *guacInstallation) check(ctx context.Context, migrations []dataMigration, report *Report, logger *log.Logger) error {
+	version, err := g.installed(ctx)
+	if err != nil || version == "" {
+		return err
+	}
+	report.GUACVersion = version
+	logger.Printf("Installed GUAC version: %s\n", version)
+	return checkCompatible(version, migrations)
+}
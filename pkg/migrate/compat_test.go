@@ -0,0 +1,60 @@
+package migrate
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestCheckCompatible(t *testing.T) {
+	migrations, err := migrationsBetween("v0.8", latestVersion)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		version string
+		ok      bool
+	}{
+		{"v0.8", true},
+		{"v0.8.5", true},
+		{"0.8.0-rc.1", true},
+		{"v0.7.2", false},
+		{"v0.9.0", false},
+		{"v1.0.0", false},
+	} {
+		err := checkCompatible(tc.version, migrations)
+		if (err == nil) != tc.ok || (err != nil && !errors.Is(err, ErrIncompatibleGUAC)) {
+			t.Errorf("checkCompatible(%s) = %v, want ok %v", tc.version, err, tc.ok)
+		}
+	}
+}
+
+func TestGraphQLRelease(t *testing.T) {
+	for _, tc := range []struct {
+		fields string
+		want   string
+	}{
+		{`[{"name": "id"}, {"name": "dependencyPackage"}, {"name": "versionRange"}]`, "v0.8"},
+		{`[{"name": "id"}, {"name": "dependencyPackage"}]`, "v0.9"},
+	} {
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprintf(w, `{"data": {"__type": {"fields": %s}}}`, tc.fields)
+		}))
+		got, err := graphQLRelease(context.Background(), &graphQLClient{endpoint: srv.URL, http: srv.Client()})
+		srv.Close()
+		if err != nil || got != tc.want {
+			t.Errorf("graphQLRelease() with fields %s = %s, %v; want %s", tc.fields, got, err, tc.want)
+		}
+	}
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"data": {"__type": null}}`)
+	}))
+	defer srv.Close()
+	if _, err := graphQLRelease(context.Background(), &graphQLClient{endpoint: srv.URL, http: srv.Client()}); err == nil {
+		t.Error("graphQLRelease() of an API without IsDependency succeeded, want an error")
+	}
+}
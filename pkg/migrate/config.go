@@ -0,0 +1,120 @@
+package migrate
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+// configFlag is the flag naming a configuration file.
+const configFlag = "config"
+
+// parseWithConfig parses args into fs after applying the configuration file named by --config,
+// if any. The file's keys are the flag names, so anything that can be passed on the command line
+// can be put in it; flags given on the command line override the file.
+func parseWithConfig(fs *flag.FlagSet, args []string) {
+	if err := parseConfigArgs(fs, args); err != nil {
+		fmt.Fprintf(fs.Output(), "%v\n", err)
+		os.Exit(exitUsage)
+	}
+}
+
+// parseConfigArgs is parseWithConfig returning the error with the configuration file or args
+// instead of exiting, for a flag set that does not exit on errors either.
+func parseConfigArgs(fs *flag.FlagSet, args []string) error {
+	fs.String(configFlag, "", "read flags from the YAML or TOML file at `path` (TOML when it ends in .toml); flags on the command line override it")
+	if path := findConfigPath(args); path != "" {
+		if err := applyConfigFile(fs, path); err != nil {
+			return err
+		}
+	}
+	return fs.Parse(args)
+}
+
+// findConfigPath returns the value of --config in args without parsing the other flags.
+func findConfigPath(args []string) string {
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		if arg == "--" {
+			return ""
+		}
+		if !strings.HasPrefix(arg, "-") {
+			continue
+		}
+		name := strings.TrimLeft(arg, "-")
+		if value, ok := strings.CutPrefix(name, configFlag+"="); ok {
+			return value
+		}
+		if name == configFlag && i+1 < len(args) {
+			return args[i+1]
+		}
+	}
+	return ""
+}
+
+// applyConfigFile sets the flags of fs from the file at path. Lists are joined with commas,
+// the syntax of the flags that take several values.
+func applyConfigFile(fs *flag.FlagSet, path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to read config file: %w", err)
+	}
+	values := make(map[string]interface{})
+	if strings.ToLower(filepath.Ext(path)) == ".toml" {
+		err = toml.Unmarshal(data, &values)
+	} else {
+		err = yaml.Unmarshal(data, &values)
+	}
+	if err != nil {
+		return fmt.Errorf("invalid config file %s: %w", path, err)
+	}
+
+	var names []string
+	for name := range values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if name == configFlag {
+			return fmt.Errorf("config file %s: %s cannot be set from a config file", path, configFlag)
+		}
+		if fs.Lookup(name) == nil {
+			return fmt.Errorf("config file %s: unknown option %q", path, name)
+		}
+		value, err := configValue(values[name])
+		if err != nil {
+			return fmt.Errorf("config file %s: %s: %w", path, name, err)
+		}
+		if err := fs.Set(name, value); err != nil {
+			return fmt.Errorf("config file %s: invalid value %q for %s: %w", path, value, name, err)
+		}
+	}
+	return nil
+}
+
+func configValue(v interface{}) (string, error) {
+	switch v := v.(type) {
+	case []interface{}:
+		var parts []string
+		for _, item := range v {
+			s, err := configValue(item)
+			if err != nil {
+				return "", err
+			}
+			parts = append(parts, s)
+		}
+		return strings.Join(parts, ","), nil
+	case map[string]interface{}:
+		return "", fmt.Errorf("nested tables are not supported")
+	case nil:
+		return "", nil
+	default:
+		return fmt.Sprint(v), nil
+	}
+}
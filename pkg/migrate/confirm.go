@@ -0,0 +1,127 @@
+package migrate
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// errNotConfirmed is returned when the operator does not confirm the migration.
+var errNotConfirmed = errors.New("migration not confirmed")
+
+// impact is what a run is about to change, shown to the operator before anything is modified.
+type impact struct {
+	backfillRows       int64
+	rewriteRows        int64
+	referenceRows      int64
+	droppedConstraints []string
+	// deferred is set when the constraints are made deferrable rather than dropped, and online
+	// when the IDs are filled in shadow columns and swapped in at a cutover.
+	deferred bool
+	online   bool
+	// cleanup is the --cleanup-name-columns mode.
+	cleanup string
+	// speedups are the settings --unsafe-speedups changes.
+	speedups []SpeedupChange
+}
+
+// estimateImpact counts the rows each destructive step will modify.
+func (m *migration) estimateImpact(ctx context.Context) (*impact, error) {
+	im := &impact{deferred: m.deferConstraints, online: m.online, cleanup: m.cleanup, speedups: m.report.UnsafeSpeedups}
+	if err := m.waitForReplica(ctx, "confirm"); err != nil {
+		return nil, err
+	}
+	err := m.retryAnalysis(ctx, "confirm", func(conn *pgx.Conn) error {
+		fks, err := findForeignKeys(ctx, conn, m.schema, dependencyIDs)
+		if err != nil {
+			return err
+		}
+		im.droppedConstraints = im.droppedConstraints[:0]
+		for _, fk := range fks {
+			im.droppedConstraints = append(im.droppedConstraints, fk.name)
+		}
+		// With the --filter flags only the references to the selected dependencies are repointed.
+		filter, args := m.filter.condition("d", 1)
+		references := `SELECT count(*) FROM ` + m.schema.prefix() + `bill_of_materials_included_dependencies`
+		if !m.filter.empty() {
+			references += ` b WHERE EXISTS (SELECT 1 FROM ` + m.schema.prefix() + `dependencies d WHERE d.id = b.dependency_id AND ` + filter + `)`
+		}
+		return conn.QueryRow(ctx, `
+		SELECT
+			(SELECT count(*) FROM `+m.schema.prefix()+`dependencies d
+			 WHERE d.dependent_package_name_id IS NOT NULL
+			   AND d.dependent_package_version_id IS NULL
+			   AND `+filter+`
+			   AND EXISTS (SELECT 1 FROM `+m.schema.prefix()+`package_versions pv
+			               WHERE pv.name_id = d.dependent_package_name_id AND `+m.versionMatchSQL("d", "pv")+`)),
+			(SELECT count(*) FROM `+m.schema.prefix()+`dependencies d WHERE `+filter+`),
+			(`+references+`)
+	`, args...).Scan(&im.backfillRows, &im.rewriteRows, &im.referenceRows)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to estimate the impact of the migration: %w", err)
+	}
+	return im, nil
+}
+
+func (im *impact) print(w io.Writer, database string) {
+	fmt.Fprintf(w, "This migration will modify database %q:\n", database)
+	fmt.Fprintf(w, "  - set dependent_package_version_id on %d dependencies rows\n", im.backfillRows)
+	if im.online {
+		fmt.Fprintf(w, "  - add shadow columns and triggers to dependencies and bill_of_materials_included_dependencies\n")
+		fmt.Fprintf(w, "  - fill in the new id of %d dependencies rows and %d bill_of_materials_included_dependencies rows while GUAC runs\n", im.rewriteRows, im.referenceRows)
+		fmt.Fprintf(w, "  - swap the shadow columns in once GUAC stopped, in one transaction locking both tables\n")
+	} else {
+		fmt.Fprintf(w, "  - rewrite the id of %d dependencies rows\n", im.rewriteRows)
+		fmt.Fprintf(w, "  - repoint %d bill_of_materials_included_dependencies rows\n", im.referenceRows)
+	}
+	for _, c := range im.droppedConstraints {
+		if im.deferred {
+			fmt.Fprintf(w, "  - make foreign key constraint %s deferrable while the IDs are rewritten\n", c)
+		} else {
+			fmt.Fprintf(w, "  - temporarily drop foreign key constraint %s\n", c)
+		}
+	}
+	switch im.cleanup {
+	case cleanupNull:
+		fmt.Fprintf(w, "  - set dependent_package_name_id and version_range of every dependencies row to NULL\n")
+	case cleanupDrop:
+		fmt.Fprintf(w, "  - drop the dependent_package_name_id and version_range columns of dependencies, for good\n")
+	}
+	for _, c := range im.speedups {
+		fmt.Fprintf(w, "  - set %s to %s for %s, losing the latest commits if the server crashes\n", c.Setting, c.Value, c.Scope)
+	}
+}
+
+// confirm prints the impact summary and requires the operator to type "yes". A run that cannot
+// prompt, because stdin is not a terminal or was used for credentials, must pass --yes.
+func confirm(in *os.File, out io.Writer, im *impact, database string, stdinUsed bool) error {
+	im.print(out, database)
+	return promptConfirmation(in, out, stdinUsed)
+}
+
+// promptConfirmation requires the operator to type "yes" after a summary of the changes.
+func promptConfirmation(in *os.File, out io.Writer, stdinUsed bool) error {
+	if stdinUsed {
+		return fmt.Errorf("%w: stdin was used for credentials, pass --yes to run", errNotConfirmed)
+	}
+	if fi, err := in.Stat(); err != nil || fi.Mode()&os.ModeCharDevice == 0 {
+		return fmt.Errorf("%w: stdin is not a terminal, pass --yes or --non-interactive to run", errNotConfirmed)
+	}
+
+	fmt.Fprint(out, "Type \"yes\" to continue: ")
+	answer, err := bufio.NewReader(in).ReadString('\n')
+	if err != nil && err != io.EOF {
+		return fmt.Errorf("failed to read confirmation: %w", err)
+	}
+	if strings.TrimSpace(answer) != "yes" {
+		return errNotConfirmed
+	}
+	return nil
+}
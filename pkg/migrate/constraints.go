@@ -0,0 +1,595 @@
+package migrate
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// droppedForeignKeysTable records the foreign keys drop-constraints dropped, with the names
+// and definitions they had, so add-constraints restores them as they were, also when it runs
+// after a failed run.
+const droppedForeignKeysTable = "guac_update_db_dropped_foreign_keys"
+
+// foreignKey is a foreign key constraint referencing the rewritten table. Databases created
+// by different ENT and Atlas versions name them differently, so they are looked up in the
+// catalog rather than assumed.
+type foreignKey struct {
+	// table is the referencing table, as Postgres prints it.
+	table  string
+	column string
+	name   string
+	// definition is the constraint as pg_get_constraintdef returns it.
+	definition string
+	deferrable bool
+	validated  bool
+}
+
+func (fk foreignKey) dropSQL() string {
+	return `ALTER TABLE ` + fk.table + ` DROP CONSTRAINT ` + pgx.Identifier{fk.name}.Sanitize() + `;`
+}
+
+// addSQL adds fk back as NOT VALID, which only checks the rows written from then on and holds
+// its exclusive lock for a moment. validateSQL checks the existing rows afterwards under a lock
+// that lets GUAC keep reading and writing the table.
+func (fk foreignKey) addSQL() string {
+	definition := fk.definition
+	if !strings.HasSuffix(definition, " NOT VALID") {
+		definition += " NOT VALID"
+	}
+	return `ALTER TABLE ` + fk.table + ` ADD CONSTRAINT ` + pgx.Identifier{fk.name}.Sanitize() + ` ` + definition + `;`
+}
+
+func (fk foreignKey) validateSQL() string {
+	return `ALTER TABLE ` + fk.table + ` VALIDATE CONSTRAINT ` + pgx.Identifier{fk.name}.Sanitize() + `;`
+}
+
+// findForeignKeys returns the foreign keys referencing the id column of r's table. The copies
+// Postgres keeps of a foreign key on every partition of a partitioned table come and go with
+// it, and are left out.
+func findForeignKeys(ctx context.Context, q queryer, schema dbSchema, r *idRewrite) ([]foreignKey, error) {
+	return foreignKeysReferencing(ctx, q, schema, r.table)
+}
+
+// foreignKeysReferencing returns the foreign keys referencing table in the schema of the run.
+func foreignKeysReferencing(ctx context.Context, q queryer, schema dbSchema, table string) ([]foreignKey, error) {
+	rows, err := q.Query(ctx, `
+		SELECT c.conrelid::regclass::text, a.attname, c.conname, pg_get_constraintdef(c.oid), c.condeferrable, c.convalidated
+		FROM pg_constraint c
+		JOIN pg_attribute a ON a.attrelid = c.conrelid AND a.attnum = c.conkey[1]
+		WHERE c.contype = 'f' AND c.confrelid = to_regclass($1) AND c.conislocal
+		ORDER BY 1, 3
+	`, schema.prefix()+table)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var fks []foreignKey
+	for rows.Next() {
+		var fk foreignKey
+		if err := rows.Scan(&fk.table, &fk.column, &fk.name, &fk.definition, &fk.deferrable, &fk.validated); err != nil {
+			return nil, err
+		}
+		fks = append(fks, fk)
+	}
+	return fks, rows.Err()
+}
+
+// checkForeignKeys fails when one of fks is on a column that is not one of r's referencers:
+// its rows would keep the old IDs, and the constraint could not be restored.
+func (r *idRewrite) checkForeignKeys(fks []foreignKey) error {
+	for _, fk := range fks {
+		if !r.references(fk.table, fk.column) {
+			return fmt.Errorf("foreign key %s on %s(%s) references %s, but the migration does not repoint %s.%s", fk.name, fk.table, fk.column, r.table, fk.table, fk.column)
+		}
+	}
+	return nil
+}
+
+func (r *idRewrite) references(table, column string) bool {
+	for _, ref := range r.referencers {
+		if ref.table == table && ref.column == column {
+			return true
+		}
+	}
+	return false
+}
+
+// noForeignKeysError is the error of drop-constraints when nothing references r's table and
+// no earlier run recorded dropping the foreign keys.
+func (r *idRewrite) noForeignKeysError() error {
+	var columns []string
+	for _, ref := range r.referencers {
+		columns = append(columns, ref.table+"("+ref.column+")")
+	}
+	return fmt.Errorf("no foreign key references %s(id), and no earlier run recorded dropping one; add the foreign key from %s before migrating, or run the remaining steps with --steps", r.table, strings.Join(columns, ", "))
+}
+
+// dropConstraints records the foreign keys referencing r's table in droppedForeignKeysTable
+// and drops them, in one transaction. When none is left because an earlier run dropped them
+// and failed, the ones it recorded are kept for add-constraints.
+func (m *migration) dropConstraints(ctx context.Context, r *idRewrite) (int64, error) {
+	var dropped []foreignKey
+	err := m.retry(ctx, "drop-constraints", func(conn *pgx.Conn) error {
+		tx, err := conn.Begin(ctx)
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback(ctx)
+
+		_, err = tx.Exec(ctx, `
+		CREATE TABLE IF NOT EXISTS `+m.schema.prefix()+droppedForeignKeysTable+` (
+			table_name text NOT NULL,
+			column_name text NOT NULL,
+			constraint_name text NOT NULL,
+			definition text NOT NULL,
+			PRIMARY KEY (table_name, constraint_name)
+		)
+	`)
+		if err != nil {
+			return err
+		}
+		dropped, err = findForeignKeys(ctx, tx, m.schema, r)
+		if err != nil {
+			return err
+		}
+		if err := r.checkForeignKeys(dropped); err != nil {
+			return err
+		}
+		if len(dropped) == 0 {
+			saved, err := savedForeignKeys(ctx, tx, m.schema)
+			if err != nil {
+				return err
+			}
+			if len(saved) == 0 {
+				return r.noForeignKeysError()
+			}
+			m.logger.Printf("drop-constraints: the %d foreign keys an earlier run dropped are still missing\n", len(saved))
+			return tx.Commit(ctx)
+		}
+
+		for _, fk := range dropped {
+			_, err := tx.Exec(ctx, `INSERT INTO `+m.schema.prefix()+droppedForeignKeysTable+` (table_name, column_name, constraint_name, definition) VALUES ($1, $2, $3, $4) ON CONFLICT DO NOTHING`, fk.table, fk.column, fk.name, fk.definition)
+			if err != nil {
+				return err
+			}
+			if !m.dialect.transactionalDDL() {
+				continue
+			}
+			if _, err := tx.Exec(ctx, fk.dropSQL()); err != nil {
+				return err
+			}
+		}
+		if err := tx.Commit(ctx); err != nil || m.dialect.transactionalDDL() {
+			return err
+		}
+		// Without transactional DDL the foreign keys are committed to the record first and
+		// dropped one at a time, so an attempt failing in between is finished by the next.
+		for _, fk := range dropped {
+			if _, err := conn.Exec(ctx, fk.dropSQL()); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, fmt.Errorf("failed to drop foreign key constraints: %w", err)
+	}
+	for _, fk := range dropped {
+		m.logger.Printf("drop-constraints: dropped %s on %s\n", fk.name, fk.table)
+	}
+	return 0, nil
+}
+
+// savedForeignKeys returns the foreign keys recorded in droppedForeignKeysTable, if it exists.
+func savedForeignKeys(ctx context.Context, q queryer, schema dbSchema) ([]foreignKey, error) {
+	var exists bool
+	if err := q.QueryRow(ctx, `SELECT to_regclass($1) IS NOT NULL`, schema.prefix()+droppedForeignKeysTable).Scan(&exists); err != nil || !exists {
+		return nil, err
+	}
+	rows, err := q.Query(ctx, `
+		SELECT table_name, column_name, constraint_name, definition
+		FROM `+schema.prefix()+droppedForeignKeysTable+`
+		ORDER BY table_name, constraint_name
+	`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var fks []foreignKey
+	for rows.Next() {
+		var fk foreignKey
+		if err := rows.Scan(&fk.table, &fk.column, &fk.name, &fk.definition); err != nil {
+			return nil, err
+		}
+		fks = append(fks, fk)
+	}
+	return fks, rows.Err()
+}
+
+// foreignKeysToAdd returns the foreign keys add-constraints restores: the recorded ones that
+// are missing, or when none was recorded, the default foreign key of every referencer that has
+// none.
+func foreignKeysToAdd(ctx context.Context, q queryer, schema dbSchema, r *idRewrite) ([]foreignKey, error) {
+	present, err := findForeignKeys(ctx, q, schema, r)
+	if err != nil {
+		return nil, err
+	}
+	saved, err := savedForeignKeys(ctx, q, schema)
+	if err != nil {
+		return nil, err
+	}
+	var add []foreignKey
+	if len(saved) > 0 {
+		for _, fk := range saved {
+			if !hasForeignKey(present, func(p foreignKey) bool { return p.table == fk.table && p.name == fk.name }) {
+				add = append(add, fk)
+			}
+		}
+		return add, nil
+	}
+	for _, ref := range r.referencers {
+		if !hasForeignKey(present, func(p foreignKey) bool { return p.table == ref.table && p.column == ref.column }) {
+			add = append(add, ref.foreignKey(r))
+		}
+	}
+	return add, nil
+}
+
+func hasForeignKey(fks []foreignKey, match func(fk foreignKey) bool) bool {
+	for _, fk := range fks {
+		if match(fk) {
+			return true
+		}
+	}
+	return false
+}
+
+// addConstraints restores the foreign keys drop-constraints dropped and forgets them. A
+// foreign key that is already in place, because an earlier attempt added it, is skipped.
+func (m *migration) addConstraints(ctx context.Context, r *idRewrite) (int64, error) {
+	var add []foreignKey
+	err := m.retry(ctx, "add-constraints", func(conn *pgx.Conn) error {
+		var err error
+		add, err = foreignKeysToAdd(ctx, conn, m.schema, r)
+		return err
+	})
+	if err != nil {
+		return 0, fmt.Errorf("failed to read the dropped foreign keys: %w", err)
+	}
+	for _, fk := range add {
+		err := m.retry(ctx, "add-constraints", func(conn *pgx.Conn) error {
+			var exists bool
+			err := conn.QueryRow(ctx, `
+			SELECT EXISTS (SELECT 1 FROM pg_constraint WHERE conrelid = to_regclass($1) AND conname = $2)
+		`, fk.table, fk.name).Scan(&exists)
+			if err != nil || exists {
+				return err
+			}
+			_, err = conn.Exec(ctx, fk.addSQL())
+			return err
+		})
+		if err != nil {
+			return 0, fmt.Errorf("failed to add foreign key constraint %s: %w", fk.name, err)
+		}
+		m.logger.Printf("add-constraints: added %s on %s\n", fk.name, fk.table)
+	}
+
+	err = m.retry(ctx, "add-constraints", func(conn *pgx.Conn) error {
+		_, err := conn.Exec(ctx, `DROP TABLE IF EXISTS `+m.schema.prefix()+droppedForeignKeysTable)
+		return err
+	})
+	if err != nil {
+		return 0, fmt.Errorf("failed to drop %s: %w", droppedForeignKeysTable, err)
+	}
+	return 0, nil
+}
+
+// emitDropConstraints writes a DROP CONSTRAINT for every foreign key referencing r's table.
+// They are kept for emitAddConstraints rather than recorded in the database as
+// drop-constraints does, since the script itself records them.
+func (m *migration) emitDropConstraints(ctx context.Context, w io.Writer, r *idRewrite) error {
+	err := m.retry(ctx, "drop-constraints", func(conn *pgx.Conn) error {
+		var err error
+		m.emittedForeignKeys, err = findForeignKeys(ctx, conn, m.schema, r)
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("failed to read the foreign keys: %w", err)
+	}
+	if err := r.checkForeignKeys(m.emittedForeignKeys); err != nil {
+		return err
+	}
+	if len(m.emittedForeignKeys) == 0 {
+		return r.noForeignKeysError()
+	}
+	for _, fk := range m.emittedForeignKeys {
+		fmt.Fprintf(w, "%s\n", fk.dropSQL())
+	}
+	return nil
+}
+
+// emitAddConstraints writes an ADD CONSTRAINT for every foreign key emitDropConstraints
+// dropped, or when drop-constraints is not part of the script, for every one add-constraints
+// would restore.
+func (m *migration) emitAddConstraints(ctx context.Context, w io.Writer, r *idRewrite) error {
+	add := m.emittedForeignKeys
+	if add == nil {
+		err := m.retry(ctx, "add-constraints", func(conn *pgx.Conn) error {
+			var err error
+			add, err = foreignKeysToAdd(ctx, conn, m.schema, r)
+			return err
+		})
+		if err != nil {
+			return fmt.Errorf("failed to read the dropped foreign keys: %w", err)
+		}
+	}
+	for _, fk := range add {
+		fmt.Fprintf(w, "%s\n", fk.addSQL())
+	}
+	m.emittedForeignKeys = add
+	return nil
+}
+
+// validateConstraints validates every foreign key referencing r's table that add-constraints
+// added NOT VALID. VALIDATE CONSTRAINT scans the referencing table under a SHARE UPDATE
+// EXCLUSIVE lock, which does not block GUAC's reads and writes; validating a foreign key that
+// is valid already is a no-op, so a retried or repeated step is harmless. It fails on the
+// first referencing row without a dependency, which repair-orphans can fix.
+func (m *migration) validateConstraints(ctx context.Context, r *idRewrite) (int64, error) {
+	var fks []foreignKey
+	var dangling int64
+	err := m.retry(ctx, "validate-constraints", func(conn *pgx.Conn) error {
+		var err error
+		if fks, err = findForeignKeys(ctx, conn, m.schema, r); err != nil || !m.quarantining() {
+			return err
+		}
+		dangling, err = countDanglingReferences(ctx, conn, m.schema)
+		return err
+	})
+	if err != nil {
+		return 0, fmt.Errorf("failed to read the foreign keys: %w", err)
+	}
+	// References fix-refs quarantined still point at the old IDs, and would fail the validation.
+	if dangling > 0 {
+		m.logger.Printf("validate-constraints: leaving the foreign keys NOT VALID: %d references point at missing dependencies; fix them with repair-orphans and run --steps validate-constraints\n", dangling)
+		return 0, nil
+	}
+	for _, fk := range fks {
+		if fk.validated {
+			continue
+		}
+		err := m.retry(ctx, "validate-constraints", func(conn *pgx.Conn) error {
+			_, err := conn.Exec(ctx, fk.validateSQL())
+			return err
+		})
+		if err != nil {
+			return 0, fmt.Errorf("failed to validate foreign key constraint %s: %w", fk.name, err)
+		}
+		m.logger.Printf("validate-constraints: validated %s on %s\n", fk.name, fk.table)
+	}
+	return 0, nil
+}
+
+// emitValidateConstraints writes a VALIDATE CONSTRAINT for every foreign key
+// emitAddConstraints added, or when add-constraints is not part of the script, for every one
+// that is not valid.
+func (m *migration) emitValidateConstraints(ctx context.Context, w io.Writer, r *idRewrite) error {
+	validate := m.emittedForeignKeys
+	if validate == nil {
+		err := m.retry(ctx, "validate-constraints", func(conn *pgx.Conn) error {
+			fks, err := findForeignKeys(ctx, conn, m.schema, r)
+			for _, fk := range fks {
+				if !fk.validated {
+					validate = append(validate, fk)
+				}
+			}
+			return err
+		})
+		if err != nil {
+			return fmt.Errorf("failed to read the foreign keys: %w", err)
+		}
+	}
+	for _, fk := range validate {
+		fmt.Fprintf(w, "%s\n", fk.validateSQL())
+	}
+	return nil
+}
+
+// deferredForeignKeysTable records the foreign keys --defer-constraints made deferrable, so
+// restore-constraints makes them NOT DEFERRABLE again, also when it runs after a failed run.
+const deferredForeignKeysTable = "guac_update_db_deferred_foreign_keys"
+
+// deferConstraintsSQL defers the deferrable foreign keys to the commit of the transaction that
+// rewrites the IDs and the references.
+const deferConstraintsSQL = `SET CONSTRAINTS ALL DEFERRED`
+
+// deferSQL makes fk deferrable. INITIALLY IMMEDIATE keeps it checked after every statement of
+// GUAC's own transactions; only the rewrite defers it.
+func (fk foreignKey) deferSQL() string {
+	return `ALTER TABLE ` + fk.table + ` ALTER CONSTRAINT ` + pgx.Identifier{fk.name}.Sanitize() + ` DEFERRABLE INITIALLY IMMEDIATE;`
+}
+
+func (fk foreignKey) undeferSQL() string {
+	return `ALTER TABLE ` + fk.table + ` ALTER CONSTRAINT ` + pgx.Identifier{fk.name}.Sanitize() + ` NOT DEFERRABLE;`
+}
+
+// deferForeignKeys makes the foreign keys referencing r's table deferrable and records the
+// ones that were not, in one transaction. Unlike drop-constraints, this only changes the
+// catalog: the foreign keys stay in place and are not validated again afterwards.
+func (m *migration) deferForeignKeys(ctx context.Context, r *idRewrite) (int64, error) {
+	var deferred []foreignKey
+	err := m.retry(ctx, "defer-constraints", func(conn *pgx.Conn) error {
+		deferred = deferred[:0]
+		tx, err := conn.Begin(ctx)
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback(ctx)
+
+		_, err = tx.Exec(ctx, `
+		CREATE TABLE IF NOT EXISTS `+m.schema.prefix()+deferredForeignKeysTable+` (
+			table_name text NOT NULL,
+			constraint_name text NOT NULL,
+			PRIMARY KEY (table_name, constraint_name)
+		)
+	`)
+		if err != nil {
+			return err
+		}
+		fks, err := foreignKeysToDefer(ctx, tx, m.schema, r)
+		if err != nil {
+			return err
+		}
+		for _, fk := range fks {
+			if fk.deferrable {
+				continue
+			}
+			_, err := tx.Exec(ctx, `INSERT INTO `+m.schema.prefix()+deferredForeignKeysTable+` (table_name, constraint_name) VALUES ($1, $2) ON CONFLICT DO NOTHING`, fk.table, fk.name)
+			if err != nil {
+				return err
+			}
+			if _, err := tx.Exec(ctx, fk.deferSQL()); err != nil {
+				return err
+			}
+			deferred = append(deferred, fk)
+		}
+		return tx.Commit(ctx)
+	})
+	if err != nil {
+		return 0, fmt.Errorf("failed to make the foreign keys deferrable: %w", err)
+	}
+	for _, fk := range deferred {
+		m.logger.Printf("defer-constraints: made %s on %s deferrable\n", fk.name, fk.table)
+	}
+	return 0, nil
+}
+
+// foreignKeysToDefer returns the foreign keys referencing r's table, failing when there are
+// none: either the database never had one, or a run without --defer-constraints dropped them.
+func foreignKeysToDefer(ctx context.Context, q queryer, schema dbSchema, r *idRewrite) ([]foreignKey, error) {
+	fks, err := findForeignKeys(ctx, q, schema, r)
+	if err != nil {
+		return nil, err
+	}
+	if err := r.checkForeignKeys(fks); err != nil {
+		return nil, err
+	}
+	if len(fks) > 0 {
+		return fks, nil
+	}
+	saved, err := savedForeignKeys(ctx, q, schema)
+	if err != nil {
+		return nil, err
+	}
+	if len(saved) > 0 {
+		return nil, fmt.Errorf("an earlier run dropped the %d foreign keys referencing %s(id); run again without --defer-constraints to restore them", len(saved), r.table)
+	}
+	return nil, r.noForeignKeysError()
+}
+
+// deferredForeignKeys returns the foreign keys recorded in deferredForeignKeysTable, if it
+// exists.
+func deferredForeignKeys(ctx context.Context, q queryer, schema dbSchema) ([]foreignKey, error) {
+	var exists bool
+	if err := q.QueryRow(ctx, `SELECT to_regclass($1) IS NOT NULL`, schema.prefix()+deferredForeignKeysTable).Scan(&exists); err != nil || !exists {
+		return nil, err
+	}
+	rows, err := q.Query(ctx, `
+		SELECT table_name, constraint_name FROM `+schema.prefix()+deferredForeignKeysTable+`
+		ORDER BY table_name, constraint_name
+	`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var fks []foreignKey
+	for rows.Next() {
+		var fk foreignKey
+		if err := rows.Scan(&fk.table, &fk.name); err != nil {
+			return nil, err
+		}
+		fks = append(fks, fk)
+	}
+	return fks, rows.Err()
+}
+
+// restoreForeignKeys makes the foreign keys defer-constraints made deferrable NOT DEFERRABLE
+// again and forgets them, in one transaction.
+func (m *migration) restoreForeignKeys(ctx context.Context) (int64, error) {
+	var restored []foreignKey
+	err := m.retry(ctx, "restore-constraints", func(conn *pgx.Conn) error {
+		tx, err := conn.Begin(ctx)
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback(ctx)
+
+		restored, err = deferredForeignKeys(ctx, tx, m.schema)
+		if err != nil {
+			return err
+		}
+		for _, fk := range restored {
+			if _, err := tx.Exec(ctx, fk.undeferSQL()); err != nil {
+				return err
+			}
+		}
+		if _, err := tx.Exec(ctx, `DROP TABLE IF EXISTS `+m.schema.prefix()+deferredForeignKeysTable); err != nil {
+			return err
+		}
+		return tx.Commit(ctx)
+	})
+	if err != nil {
+		return 0, fmt.Errorf("failed to restore the foreign keys: %w", err)
+	}
+	for _, fk := range restored {
+		m.logger.Printf("restore-constraints: made %s on %s NOT DEFERRABLE again\n", fk.name, fk.table)
+	}
+	return 0, nil
+}
+
+// emitDeferForeignKeys writes the ALTER CONSTRAINT making every foreign key referencing r's
+// table deferrable, keeping them for emitRestoreForeignKeys.
+func (m *migration) emitDeferForeignKeys(ctx context.Context, w io.Writer, r *idRewrite) error {
+	err := m.retry(ctx, "defer-constraints", func(conn *pgx.Conn) error {
+		fks, err := foreignKeysToDefer(ctx, conn, m.schema, r)
+		m.emittedForeignKeys = []foreignKey{}
+		for _, fk := range fks {
+			if !fk.deferrable {
+				m.emittedForeignKeys = append(m.emittedForeignKeys, fk)
+			}
+		}
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("failed to read the foreign keys: %w", err)
+	}
+	for _, fk := range m.emittedForeignKeys {
+		fmt.Fprintf(w, "%s\n", fk.deferSQL())
+	}
+	return nil
+}
+
+// emitRestoreForeignKeys writes the ALTER CONSTRAINT making every foreign key
+// emitDeferForeignKeys made deferrable NOT DEFERRABLE again, or when defer-constraints is not
+// part of the script, every one an earlier run recorded.
+func (m *migration) emitRestoreForeignKeys(ctx context.Context, w io.Writer) error {
+	restore := m.emittedForeignKeys
+	if restore == nil {
+		err := m.retry(ctx, "restore-constraints", func(conn *pgx.Conn) error {
+			var err error
+			restore, err = deferredForeignKeys(ctx, conn, m.schema)
+			return err
+		})
+		if err != nil {
+			return fmt.Errorf("failed to read the deferred foreign keys: %w", err)
+		}
+	}
+	for _, fk := range restore {
+		fmt.Fprintf(w, "%s\n", fk.undeferSQL())
+	}
+	return nil
+}
@@ -0,0 +1,416 @@
+package migrate
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// errAborted is the cause of a run cancelled through the control API.
+var errAborted = errors.New("aborted through the control API")
+
+// The states of a run driven through the control API.
+const (
+	controlWaiting  = "waiting"
+	controlRunning  = "running"
+	controlPaused   = "paused"
+	controlAborting = "aborting"
+	controlFinished = "finished"
+)
+
+// controlServer is the HTTP API --serve starts, through which an orchestrator starts, pauses,
+// resumes and aborts the run and follows its progress. It observes the run like --events-file
+// and pauses it where a maintenance window would. A nil *controlServer lets the run go on
+// without waiting for anything.
+type controlServer struct {
+	token  string
+	srv    *http.Server
+	ctx    context.Context
+	cancel context.CancelCauseFunc
+	// started is closed by the start request.
+	started chan struct{}
+
+	mu sync.Mutex
+	// resumed is closed by the resume request; it is nil unless a pause was requested.
+	resumed   chan struct{}
+	paused    bool
+	aborted   bool
+	finished  bool
+	databases map[string]*controlDatabase
+	results   []Result
+	streams   map[chan []byte]bool
+}
+
+// controlDatabase is the progress of the run against one database.
+type controlDatabase struct {
+	Migration       string    `json:"migration,omitempty"`
+	MigrationNumber int       `json:"migration_number,omitempty"`
+	Migrations      int       `json:"migrations,omitempty"`
+	Step            string    `json:"step"`
+	StepRows        int64     `json:"step_rows"`
+	Updated         time.Time `json:"updated"`
+}
+
+// controlStatus is the answer to GET /status.
+type controlStatus struct {
+	State string `json:"state"`
+	// PauseRequested is set from the pause request until the resume request; the run pauses at
+	// the next batch or step unless the foreign key is dropped.
+	PauseRequested bool                        `json:"pause_requested"`
+	Databases      map[string]*controlDatabase `json:"databases"`
+	Results        []Result                    `json:"results"`
+}
+
+// startControlServer listens on addr and serves the control API in the background. With a
+// tokenFile, the requests changing the run must carry its content as a bearer token.
+func startControlServer(addr, tokenFile string) (*controlServer, error) {
+	token := ""
+	if tokenFile != "" {
+		data, err := os.ReadFile(tokenFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read --serve-token-file: %w", err)
+		}
+		if token = strings.TrimSpace(string(data)); token == "" {
+			return nil, fmt.Errorf("--serve-token-file %s is empty", tokenFile)
+		}
+	}
+	c := newControlServer(token)
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen on --serve %s: %w", addr, err)
+	}
+	go func() {
+		if err := c.srv.Serve(ln); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Printf("control API stopped: %v", err)
+		}
+	}()
+	log.Printf("Serving the control API on %s; POST /start to run the migration\n", ln.Addr())
+	return c, nil
+}
+
+// loopbackAddr reports whether the listen address addr only accepts connections from this host.
+// An address without a host listens on every interface.
+func loopbackAddr(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+func newControlServer(token string) *controlServer {
+	c := &controlServer{
+		token:     token,
+		started:   make(chan struct{}),
+		databases: make(map[string]*controlDatabase),
+		streams:   make(map[chan []byte]bool),
+	}
+	c.ctx, c.cancel = context.WithCancelCause(context.Background())
+	mux := http.NewServeMux()
+	mux.HandleFunc("/status", c.handleStatus)
+	mux.HandleFunc("/events", c.handleEvents)
+	mux.HandleFunc("/start", c.action(c.start))
+	mux.HandleFunc("/pause", c.action(c.pause))
+	mux.HandleFunc("/resume", c.action(c.resume))
+	mux.HandleFunc("/abort", c.action(c.abort))
+	c.srv = &http.Server{Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+	return c
+}
+
+// context returns the context of the run, cancelled by the abort request.
+func (c *controlServer) context() context.Context {
+	if c == nil {
+		return context.Background()
+	}
+	return c.ctx
+}
+
+// waitForStart blocks until the start or the abort request.
+func (c *controlServer) waitForStart() error {
+	if c == nil {
+		return nil
+	}
+	select {
+	case <-c.started:
+		return nil
+	case <-c.ctx.Done():
+		return context.Cause(c.ctx)
+	}
+}
+
+// pauseRequested reports whether the run is to pause at the next batch or step.
+func (c *controlServer) pauseRequested() bool {
+	if c == nil {
+		return false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.resumed != nil
+}
+
+// wait pauses the run while a pause is requested.
+func (c *controlServer) wait(ctx context.Context, logger *log.Logger, step string) error {
+	if c == nil {
+		return nil
+	}
+	c.mu.Lock()
+	resumed := c.resumed
+	if resumed != nil {
+		c.paused = true
+	}
+	c.mu.Unlock()
+	if resumed == nil {
+		return nil
+	}
+	logger.Printf("%s: paused through the control API until POST /resume\n", step)
+	defer func() {
+		c.mu.Lock()
+		c.paused = false
+		c.mu.Unlock()
+	}()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-resumed:
+	}
+	logger.Printf("%s: resumed through the control API\n", step)
+	return nil
+}
+
+// close stops serving once the run is over, after the event streams got the last events.
+func (c *controlServer) close() {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	c.finished = true
+	for s := range c.streams {
+		close(s)
+		delete(c.streams, s)
+	}
+	c.mu.Unlock()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	c.srv.Shutdown(ctx)
+}
+
+// action wraps the handler of a request changing the run: it must be a POST, with the bearer
+// token when there is one, and answers with the status after the change or 409 with the
+// reason the change is not possible.
+func (c *controlServer) action(change func() error) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			http.Error(w, "use POST", http.StatusMethodNotAllowed)
+			return
+		}
+		if c.token != "" {
+			got, _ := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+			if subtle.ConstantTimeCompare([]byte(got), []byte(c.token)) != 1 {
+				http.Error(w, "missing or wrong bearer token", http.StatusUnauthorized)
+				return
+			}
+		}
+		if err := change(); err != nil {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		c.handleStatus(w, r)
+	}
+}
+
+func (c *controlServer) start() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	select {
+	case <-c.started:
+		return errors.New("the migration was already started")
+	default:
+	}
+	if c.aborted {
+		return errors.New("the migration was aborted")
+	}
+	close(c.started)
+	return nil
+}
+
+func (c *controlServer) pause() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.finished || c.aborted {
+		return errors.New("the migration is over")
+	}
+	if c.resumed == nil {
+		c.resumed = make(chan struct{})
+	}
+	return nil
+}
+
+func (c *controlServer) resume() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.resumed == nil {
+		return errors.New("the migration is not paused")
+	}
+	close(c.resumed)
+	c.resumed = nil
+	return nil
+}
+
+func (c *controlServer) abort() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.finished {
+		return errors.New("the migration is over")
+	}
+	c.aborted = true
+	c.cancel(errAborted)
+	return nil
+}
+
+func (c *controlServer) status() controlStatus {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	s := controlStatus{PauseRequested: c.resumed != nil, Databases: make(map[string]*controlDatabase), Results: append([]Result{}, c.results...)}
+	for name, d := range c.databases {
+		copied := *d
+		s.Databases[name] = &copied
+	}
+	select {
+	case <-c.started:
+		s.State = controlRunning
+	default:
+		s.State = controlWaiting
+	}
+	switch {
+	case c.finished:
+		s.State = controlFinished
+	case c.aborted:
+		s.State = controlAborting
+	case c.paused:
+		s.State = controlPaused
+	}
+	return s
+}
+
+func (c *controlServer) handleStatus(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(c.status())
+}
+
+// handleEvents streams the events of the run from now on as JSON lines, in the format of
+// --events-file, until the run is over or the client goes away.
+func (c *controlServer) handleEvents(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming is not supported", http.StatusInternalServerError)
+		return
+	}
+	events := make(chan []byte, 256)
+	c.mu.Lock()
+	if c.finished {
+		c.mu.Unlock()
+		http.Error(w, "the migration is over", http.StatusGone)
+		return
+	}
+	c.streams[events] = true
+	c.mu.Unlock()
+	defer func() {
+		c.mu.Lock()
+		if c.streams[events] {
+			delete(c.streams, events)
+		}
+		c.mu.Unlock()
+	}()
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case line, ok := <-events:
+			if !ok {
+				return
+			}
+			if _, err := w.Write(line); err != nil {
+				return
+			}
+			flusher.Flush()
+		}
+	}
+}
+
+// publish sends an event to every stream. A client too slow to keep up misses events rather
+// than holding up the run.
+func (c *controlServer) publish(event string, data interface{}) {
+	line, err := json.Marshal(struct {
+		Event string      `json:"event"`
+		Data  interface{} `json:"data"`
+	}{event, data})
+	if err != nil {
+		return
+	}
+	line = append(line, '\n')
+	for s := range c.streams {
+		select {
+		case s <- line:
+		default:
+		}
+	}
+}
+
+// database returns the progress of the run against name; c.mu must be held.
+func (c *controlServer) database(name string) *controlDatabase {
+	d := c.databases[name]
+	if d == nil {
+		d = &controlDatabase{}
+		c.databases[name] = d
+	}
+	return d
+}
+
+func (c *controlServer) OnStepStart(e StepStart) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	d := c.database(e.Database)
+	d.Migration, d.MigrationNumber, d.Migrations = e.Migration, e.MigrationNumber, e.Migrations
+	d.Step, d.StepRows, d.Updated = e.Step, 0, e.Time
+	c.publish("step_start", e)
+}
+
+func (c *controlServer) OnBatchComplete(e Batch) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	d := c.database(e.Database)
+	d.StepRows += e.Rows
+	d.Updated = e.Time
+	c.publish("batch_complete", e)
+}
+
+func (c *controlServer) OnCollision(e Collision) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.publish("collision", e)
+}
+
+func (c *controlServer) OnFinish(e Result) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.results = append(c.results, e)
+	c.publish("finish", e)
+}
@@ -0,0 +1,145 @@
+package migrate
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestControlServer(t *testing.T) {
+	c := newControlServer("secret")
+	srv := httptest.NewServer(c.srv.Handler)
+	defer srv.Close()
+
+	post := func(path, token string) (int, controlStatus) {
+		t.Helper()
+		req, _ := http.NewRequest(http.MethodPost, srv.URL+path, nil)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		var s controlStatus
+		if resp.StatusCode == http.StatusOK {
+			if err := json.NewDecoder(resp.Body).Decode(&s); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return resp.StatusCode, s
+	}
+
+	if code, _ := post("/start", "wrong"); code != http.StatusUnauthorized {
+		t.Errorf("POST /start with a wrong token = %d, want 401", code)
+	}
+	if resp, err := http.Get(srv.URL + "/start"); err != nil || resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Errorf("GET /start = %v, %v; want 405", resp, err)
+	}
+	if code, s := post("/start", "secret"); code != http.StatusOK || s.State != controlRunning {
+		t.Fatalf("POST /start = %d, %+v; want running", code, s)
+	}
+	if err := c.waitForStart(); err != nil {
+		t.Fatalf("waitForStart() = %v after POST /start", err)
+	}
+	if code, _ := post("/start", "secret"); code != http.StatusConflict {
+		t.Errorf("second POST /start = %d, want 409", code)
+	}
+	if code, _ := post("/resume", "secret"); code != http.StatusConflict {
+		t.Errorf("POST /resume without a pause = %d, want 409", code)
+	}
+
+	if code, s := post("/pause", "secret"); code != http.StatusOK || !s.PauseRequested {
+		t.Fatalf("POST /pause = %d, %+v; want the pause requested", code, s)
+	}
+	logger := log.New(io.Discard, "", 0)
+	waited := make(chan error)
+	go func() { waited <- c.wait(context.Background(), logger, "backfill") }()
+	for c.status().State != controlPaused {
+		time.Sleep(time.Millisecond)
+	}
+	post("/resume", "secret")
+	if err := <-waited; err != nil {
+		t.Errorf("wait() = %v after POST /resume", err)
+	}
+	if s := c.status(); s.State != controlRunning || s.PauseRequested {
+		t.Errorf("status after POST /resume = %+v, want running", s)
+	}
+
+	if code, s := post("/abort", "secret"); code != http.StatusOK || s.State != controlAborting {
+		t.Errorf("POST /abort = %d, %+v; want aborting", code, s)
+	}
+	if err := context.Cause(c.context()); !errors.Is(err, errAborted) {
+		t.Errorf("context cause after POST /abort = %v, want errAborted", err)
+	}
+}
+
+func TestControlServerEvents(t *testing.T) {
+	c := newControlServer("")
+	srv := httptest.NewServer(c.srv.Handler)
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL + "/events")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	for {
+		c.mu.Lock()
+		n := len(c.streams)
+		c.mu.Unlock()
+		if n == 1 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	o := Observer(c)
+	o.OnStepStart(StepStart{Database: "guac", Step: "backfill"})
+	o.OnBatchComplete(Batch{Database: "guac", Step: "backfill", Rows: 7})
+	o.OnFinish(Result{Database: "guac", Success: true, Outcome: "success"})
+	c.close()
+
+	var events []string
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		var line struct {
+			Event string `json:"event"`
+		}
+		if err := json.Unmarshal(scanner.Bytes(), &line); err != nil {
+			t.Fatalf("invalid event line %q: %v", scanner.Text(), err)
+		}
+		events = append(events, line.Event)
+	}
+	if got, want := strings.Join(events, ","), "step_start,batch_complete,finish"; got != want {
+		t.Errorf("streamed events %s, want %s", got, want)
+	}
+	if d := c.status().Databases["guac"]; d == nil || d.Step != "backfill" || d.StepRows != 7 {
+		t.Errorf("status of guac = %+v, want backfill with 7 rows", d)
+	}
+}
+
+func TestLoopbackAddr(t *testing.T) {
+	for addr, want := range map[string]bool{
+		"localhost:8099": true,
+		"127.0.0.1:8099": true,
+		"[::1]:8099":     true,
+		":8099":          false,
+		"0.0.0.0:8099":   false,
+		"10.0.0.5:8099":  false,
+		"example:8099":   false,
+		"8099":           false,
+	} {
+		if got := loopbackAddr(addr); got != want {
+			t.Errorf("loopbackAddr(%q) = %v, want %v", addr, got, want)
+		}
+	}
+}
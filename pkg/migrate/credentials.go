@@ -0,0 +1,136 @@
+package migrate
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// stdinPath is the path value that makes --dsn-file and --password-file read from stdin.
+const stdinPath = "-"
+
+// connFlags are the connection settings shared by every subcommand that talks to the database.
+type connFlags struct {
+	dsnFile      string
+	passwordFile string
+	schema       dbSchema
+	// base, when set, are the connection settings Run was given, used instead of --dsn-file,
+	// --password-file and the PG* environment variables.
+	base *pgx.ConnConfig
+}
+
+func (c *connFlags) register(fs *flag.FlagSet) {
+	fs.StringVar(&c.dsnFile, "dsn-file", "", "read the connection string from `path` (\"-\" for stdin) instead of the PG* environment variables")
+	fs.StringVar(&c.passwordFile, "password-file", "", "read the database password from `path` (\"-\" for stdin)")
+	registerSchema(fs, &c.schema)
+}
+
+// registerNamed registers the connection settings of one of the databases a subcommand talks
+// to, as --<name>-dsn-file and --<name>-password-file.
+func (c *connFlags) registerNamed(fs *flag.FlagSet, name, what string) {
+	fs.StringVar(&c.dsnFile, name+"-dsn-file", "", "read the connection string of the "+what+" from `path` (\"-\" for stdin) instead of the PG* environment variables")
+	fs.StringVar(&c.passwordFile, name+"-password-file", "", "read the password of the "+what+" from `path` (\"-\" for stdin)")
+}
+
+// usesStdin reports whether stdin is consumed for credentials.
+func (c *connFlags) usesStdin() bool {
+	return c.dsnFile == stdinPath || c.passwordFile == stdinPath
+}
+
+func (c *connFlags) config() (*pgx.ConnConfig, error) {
+	var config *pgx.ConnConfig
+	if c.base != nil {
+		config = c.base.Copy()
+	} else {
+		var err error
+		if config, err = connConfig(c.dsnFile, c.passwordFile); err != nil {
+			return nil, fmt.Errorf("unable to load connection settings: %w", err)
+		}
+	}
+	if c.schema.name() != "public" {
+		// Puts the schema first on the search path, so Postgres names its tables unqualified,
+		// as it does those of public, wherever a regclass is read back as text.
+		config.RuntimeParams["search_path"] = quoteIdentifier(c.schema.name()) + ", public"
+	}
+	return config, nil
+}
+
+// connConfig builds the connection settings for the GUAC ENT database.
+//
+// The connection string is read from dsnFile when it is set, otherwise the standard
+// libpq environment variables (PGHOST, PGPORT, PGDATABASE, PGUSER, PGPASSWORD, ...) are
+// used. When no password is supplied, PGPASSFILE or ~/.pgpass is consulted by pgx. A
+// password read from passwordFile always takes precedence, so mounted Kubernetes secrets
+// can be used without the password ever appearing in process arguments or logs.
+func connConfig(dsnFile, passwordFile string) (*pgx.ConnConfig, error) {
+	if dsnFile == stdinPath && passwordFile == stdinPath {
+		return nil, errors.New("--dsn-file and --password-file cannot both be read from stdin")
+	}
+
+	dsn := ""
+	if dsnFile != "" {
+		s, err := readSecret(dsnFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read DSN file: %w", err)
+		}
+		dsn = s
+	}
+
+	config, err := pgx.ParseConfig(dsn)
+	if err != nil {
+		// pgconn redacts the password from parse errors.
+		return nil, fmt.Errorf("failed to parse connection settings: %w", err)
+	}
+
+	if passwordFile != "" {
+		password, err := readSecret(passwordFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read password file: %w", err)
+		}
+		config.Password = password
+	}
+
+	if config.Password == "" {
+		return nil, errors.New("no database password found: set PGPASSWORD, use --password-file or --dsn-file, or add an entry to PGPASSFILE/.pgpass")
+	}
+	return config, nil
+}
+
+// readSecret returns the first line of the file at path, or of stdin when path is "-".
+// Kubernetes secrets and most editors end files with a newline which is not part of the value.
+func readSecret(path string) (string, error) {
+	var r io.Reader
+	if path == stdinPath {
+		r = os.Stdin
+	} else {
+		f, err := os.Open(path)
+		if err != nil {
+			return "", err
+		}
+		defer f.Close()
+		r = f
+	}
+
+	line, err := bufio.NewReader(r).ReadString('\n')
+	if err != nil && err != io.EOF {
+		return "", err
+	}
+	line = strings.TrimRight(line, "\r\n")
+	if line == "" {
+		return "", fmt.Errorf("%s is empty", displayPath(path))
+	}
+	return line, nil
+}
+
+func displayPath(path string) string {
+	if path == stdinPath {
+		return "stdin"
+	}
+	return path
+}
@@ -0,0 +1,370 @@
+package migrate
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+)
+
+// defaultReconcileInterval is the time between two scans of --daemon unless --interval says
+// otherwise.
+const defaultReconcileInterval = 10 * time.Minute
+
+// checkDaemonOptions fails on the flags --daemon cannot be combined with.
+func checkDaemonOptions(o *options) error {
+	if !o.daemon {
+		return nil
+	}
+	switch {
+	case o.interval <= 0:
+		return errors.New("--interval must be positive")
+	case o.emitSQL != "", o.estimate:
+		return errors.New("--daemon keeps migrating the database and cannot be combined with --emit-sql or --estimate")
+	case o.targetsFile != "":
+		return errors.New("--daemon reconciles a single database and cannot be combined with --targets")
+	case o.hookMode, o.initContainer:
+		return errors.New("--daemon runs until it is stopped and cannot be combined with --hook-mode or --init-container, which must exit for the release or the pod to go on")
+	case o.serveAddr != "":
+		return errors.New("--daemon and --serve cannot be combined: the control API drives a single run")
+	}
+	return nil
+}
+
+// runDaemon scans the database every --interval for the dependencies written in the old ID
+// scheme since the migration, by a collector or GraphQL server still on the old GUAC version,
+// and migrates them, until SIGINT or SIGTERM. A failed pass is logged and retried at the next
+// one. Every pass writes --report-file and --report-html anew, and is notified when it migrated
+// or failed.
+func runDaemon(opts *options) {
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+	// The passes run the reconcile step only, and leave what describes the first run alone.
+	pass := *opts
+	pass.reconciling = true
+	pass.completionRow = false
+	pass.steps, pass.skipSteps = nil, nil
+	pass.stateFile, pass.recordFile = "", ""
+	pass.deadline = time.Time{}
+	log.Printf("Scanning for dependencies in the old ID scheme every %s\n", opts.interval)
+	for {
+		select {
+		case <-ctx.Done():
+			log.Printf("Stopping the reconciliation\n")
+			return
+		case <-time.After(opts.interval):
+		}
+		report := newReport()
+		err := migrateDatabase(opts.control.context(), &pass, report, log.Default())
+		report.finish(err)
+		opts.observer.OnFinish(report.result())
+		report.write(opts)
+		if err != nil {
+			log.Printf("Reconciliation failed, retrying in %s: %v\n", opts.interval, err)
+		}
+		if err != nil || report.reconciled() > 0 {
+			opts.notify.notifyRun(report)
+		}
+	}
+}
+
+// reconciled is the number of dependencies a reconciliation pass migrated.
+func (r *Report) reconciled() int64 {
+	var n int64
+	for _, s := range r.Steps {
+		if s.Name == "reconcile" {
+			n += s.Rows
+		}
+	}
+	return n
+}
+
+// reconcile migrates the rows written in the old ID scheme since the migration, in a reconcile
+// step, and moves the SBOMs including them in a fix-sbom-ids step. It runs while GUAC keeps
+// writing, so it neither drops the foreign keys nor waits for the writers to stop: every row is
+// backfilled, moved or merged by statements of its own.
+func (m *migration) reconcile(ctx context.Context) error {
+	if err := m.createAuditTable(ctx); err != nil {
+		return err
+	}
+	return m.runSteps(ctx, "", []step{
+		{name: "reconcile", run: func(ctx context.Context) (int64, error) { return m.reconcileIDs(ctx, dependencyIDs) }},
+		{name: "fix-sbom-ids", run: m.fixSBOMIDs},
+	})
+}
+
+// reconcileQueueTable holds the IDs of the dependencies --daemon has yet to look at, which the
+// reconcileQueueTrigger adds as GUAC writes them, so that a pass reads only those rather than
+// the whole table. Its row with the nil ID stands for the dependencies written before the
+// trigger existed, until a pass queued them too.
+const (
+	reconcileQueueTable   = "guac_update_db_reconcile_queue"
+	reconcileQueueTrigger = "guac_update_db_reconcile_queue"
+)
+
+// reconcileQueueSQL creates the queue and the trigger queueing every dependency of r's table
+// inserted or updated with an ID other than the one its key derives. The trigger runs as the
+// owner of its function, so that the users GUAC writes with need no privileges on the queue,
+// with a search path GUAC's users cannot change.
+func (m *migration) reconcileQueueSQL(r *idRewrite) []string {
+	fn := m.schema.prefix() + reconcileQueueTrigger
+	return []string{
+		`CREATE TABLE IF NOT EXISTS ` + m.schema.prefix() + reconcileQueueTable + ` (id uuid PRIMARY KEY)`,
+		`INSERT INTO ` + m.schema.prefix() + reconcileQueueTable + ` (id) VALUES ('` + uuid.Nil.String() + `') ON CONFLICT DO NOTHING`,
+		`CREATE OR REPLACE FUNCTION ` + fn + `() RETURNS trigger LANGUAGE plpgsql SECURITY DEFINER SET search_path = pg_catalog, pg_temp AS $$
+BEGIN
+  IF NEW.id IS DISTINCT FROM ` + r.keySQL(m.scheme, "NEW") + ` THEN
+    INSERT INTO ` + m.schema.prefix() + reconcileQueueTable + ` (id) VALUES (NEW.id) ON CONFLICT DO NOTHING;
+  END IF;
+  RETURN NULL;
+END
+$$`,
+		`DROP TRIGGER IF EXISTS ` + reconcileQueueTrigger + ` ON ` + m.schema.prefix() + r.table,
+		`CREATE TRIGGER ` + reconcileQueueTrigger + ` AFTER INSERT OR UPDATE ON ` + m.schema.prefix() + r.table + ` FOR EACH ROW EXECUTE FUNCTION ` + fn + `()`,
+	}
+}
+
+// queueReconcile makes sure the queue and its trigger exist, in one short transaction, and
+// queues the dependencies in the old ID scheme written before the trigger did, once. It
+// returns false when the passes scan the whole table instead: --no-ddl cannot create the
+// trigger, nor can CockroachDB run it.
+func (m *migration) queueReconcile(ctx context.Context, r *idRewrite) (bool, error) {
+	if m.noDDL || m.dialect == dialectCockroach {
+		return false, nil
+	}
+	queue := m.schema.prefix() + reconcileQueueTable
+	var seeded int64
+	err := m.retry(ctx, "reconcile", func(conn *pgx.Conn) error {
+		var exists bool
+		err := conn.QueryRow(ctx, `
+			SELECT EXISTS (SELECT 1 FROM pg_trigger WHERE tgrelid = $1::regclass AND tgname = $2)
+		`, m.schema.prefix()+r.table, reconcileQueueTrigger).Scan(&exists)
+		if err != nil {
+			return err
+		}
+		if !exists {
+			tx, err := conn.Begin(ctx)
+			if err != nil {
+				return err
+			}
+			defer tx.Rollback(ctx)
+			for _, stmt := range m.reconcileQueueSQL(r) {
+				if _, err := tx.Exec(ctx, stmt); err != nil {
+					return err
+				}
+			}
+			if err := tx.Commit(ctx); err != nil {
+				return err
+			}
+			m.logger.Printf("reconcile: %s queues the dependencies written in the old ID scheme\n", reconcileQueueTrigger)
+		}
+
+		// The scan runs after the trigger exists, so that no dependency is written between the
+		// two, and holds no lock keeping GUAC from writing.
+		tx, err := conn.Begin(ctx)
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback(ctx)
+		tag, err := tx.Exec(ctx, `DELETE FROM `+queue+` WHERE id = $1`, uuid.Nil)
+		if err != nil || tag.RowsAffected() == 0 {
+			return err
+		}
+		tag, err = tx.Exec(ctx, `INSERT INTO `+queue+` (id)
+SELECT d.id FROM `+m.schema.prefix()+r.table+` d WHERE d.id IS DISTINCT FROM `+r.keySQL(m.scheme, "d")+`
+ON CONFLICT DO NOTHING`)
+		if err != nil {
+			return err
+		}
+		seeded = tag.RowsAffected()
+		return tx.Commit(ctx)
+	})
+	if err != nil {
+		return false, fmt.Errorf("failed to create %s: %w", reconcileQueueTable, err)
+	}
+	if seeded > 0 {
+		m.logger.Printf("reconcile: queued %d dependencies written in the old ID scheme before %s existed\n", seeded, reconcileQueueTrigger)
+	}
+	return true, nil
+}
+
+// reconcileIDs fills in dependent_package_version_id as the backfill does, then migrates every
+// row of r's table the --filter flags select whose ID is not the one its key derives: a row
+// whose new ID another row already has is merged into it, as mergeDuplicates does, and any
+// other is moved to its new ID. Rows the backfill cannot resolve keep their ID. Only the rows
+// queueReconcile queued are looked at, a chunk of --chunk-size at a time, unless the passes
+// scan the whole table. It returns the number of rows migrated.
+func (m *migration) reconcileIDs(ctx context.Context, r *idRewrite) (int64, error) {
+	queued, err := m.queueReconcile(ctx, r)
+	if err != nil {
+		return 0, err
+	}
+	filter, args := m.filter.condition("d", 1)
+	queue := m.schema.prefix() + reconcileQueueTable
+	scope := filter
+	if queued {
+		scope += ` AND d.id IN (SELECT q.id FROM ` + queue + ` q)`
+	}
+	var named bool
+	var backfilled int64
+	err = m.retry(ctx, "reconcile", func(conn *pgx.Conn) error {
+		// Once --cleanup-name-columns=drop or GUAC's own migration dropped the name columns,
+		// nothing on the old version can write to the table, and there is nothing to backfill.
+		err := conn.QueryRow(ctx, `
+			SELECT EXISTS (SELECT 1 FROM pg_attribute WHERE attrelid = $1::regclass AND attname = 'dependent_package_name_id' AND NOT attisdropped)
+		`, m.schema.prefix()+"dependencies").Scan(&named)
+		if err != nil || !named {
+			return err
+		}
+		tag, err := conn.Exec(ctx, m.audited(`UPDATE `+m.schema.prefix()+`dependencies d
+SET dependent_package_version_id = pv.id
+FROM `+m.schema.prefix()+`package_versions pv
+WHERE d.dependent_package_version_id IS NULL
+  AND d.dependent_package_name_id = pv.name_id
+  AND `+m.versionMatchSQL("d", "pv")+`
+  AND `+scope,
+			"d.id AS row_id, NULL::uuid AS old_id, d.dependent_package_version_id AS new_id", "dependencies", "dependent_package_version_id"), args...)
+		backfilled = tag.RowsAffected()
+		return err
+	})
+	if err != nil {
+		return 0, fmt.Errorf("failed to update dependent_package_version_id: %w", err)
+	}
+
+	var moved, merged int64
+	move := m.moveInPlaceSQL(r)
+	merge := m.mergeSQL(r)
+	migrate := func(ctx context.Context, tx pgx.Tx, c idChange) error {
+		// The rows are migrated one after the other, so a row sharing its new ID with one
+		// moved before it is merged into that one.
+		var taken bool
+		if err := tx.QueryRow(ctx, `SELECT EXISTS (SELECT 1 FROM `+m.schema.prefix()+r.table+` WHERE id = $1)`, c.newID).Scan(&taken); err != nil {
+			return err
+		}
+		if !taken {
+			if _, err := tx.Exec(ctx, move, c.newID, c.oldID); err != nil {
+				return err
+			}
+			if err := tx.Commit(ctx); err != nil {
+				return err
+			}
+			moved++
+			return nil
+		}
+		batch := &pgx.Batch{}
+		for _, stmt := range merge {
+			batch.Queue(stmt, c.newID, c.oldID)
+		}
+		if err := sendBatch(ctx, tx, batch); err != nil {
+			return err
+		}
+		if err := tx.Commit(ctx); err != nil {
+			return err
+		}
+		m.report.Merged = append(m.report.Merged, IDCollision{NewID: c.newID.String(), OldIDs: []string{c.oldID.String()}})
+		merged++
+		return nil
+	}
+	columns := strings.Join(r.keyColumns, ", ")
+	var after uuid.UUID
+	for {
+		// A chunk is the next IDs of the queue, or the next rows of the table in the old ID
+		// scheme if there is no queue.
+		var ids []uuid.UUID
+		err := m.retry(ctx, "reconcile", func(conn *pgx.Conn) error {
+			ids = ids[:0]
+			sql := `SELECT q.id FROM ` + queue + ` q WHERE q.id > $1 ORDER BY q.id LIMIT $2`
+			if !queued {
+				sql = `SELECT d.id FROM ` + m.schema.prefix() + r.table + ` d
+WHERE d.id > $1 AND d.id <> ` + r.keySQL(m.scheme, "d") + `
+ORDER BY d.id LIMIT $2`
+			}
+			rows, err := conn.Query(ctx, sql, after, m.chunkSize)
+			if err != nil {
+				return err
+			}
+			ids, err = pgx.CollectRows(rows, pgx.RowTo[uuid.UUID])
+			return err
+		})
+		if err != nil {
+			return moved + merged, fmt.Errorf("failed to query %s: %w", r.table, err)
+		}
+		for _, id := range ids {
+			// The row is locked and taken off the queue in the transaction migrating it, so
+			// that a write changing it again queues it anew once the transaction commits. A
+			// row left as it is stays queued.
+			err := m.retry(ctx, "reconcile", func(conn *pgx.Conn) error {
+				tx, err := conn.Begin(ctx)
+				if err != nil {
+					return err
+				}
+				defer tx.Rollback(ctx)
+				if queued {
+					if _, err := tx.Exec(ctx, `DELETE FROM `+queue+` WHERE id = $1`, id); err != nil {
+						return err
+					}
+				}
+				var selected, resolved, changed bool
+				values := make([]string, len(r.keyColumns))
+				err = tx.QueryRow(ctx, `SELECT COALESCE(`+filter+`, false), d.dependent_package_version_id IS NOT NULL, d.id IS DISTINCT FROM `+r.keySQL(m.scheme, "d")+`
+FROM `+m.schema.prefix()+r.table+` d WHERE d.id = $`+fmt.Sprint(len(args)+1)+` FOR UPDATE`, append(args, id)...).Scan(&selected, &resolved, &changed)
+				switch {
+				case errors.Is(err, pgx.ErrNoRows), err == nil && !changed:
+					return tx.Commit(ctx)
+				case err != nil:
+					return err
+				case !selected || !resolved:
+					return nil
+				}
+				dest := make([]interface{}, len(values))
+				for i := range values {
+					dest[i] = &values[i]
+				}
+				if err := tx.QueryRow(ctx, `SELECT `+columns+` FROM `+m.schema.prefix()+r.table+` WHERE id = $1`, id).Scan(dest...); err != nil {
+					return fmt.Errorf("failed to scan row: %w", err)
+				}
+				return migrate(ctx, tx, idChange{oldID: id, newID: r.key(m.scheme, values)})
+			})
+			if err != nil {
+				return moved + merged, fmt.Errorf("failed to migrate %s %s: %w", r.singular, id, err)
+			}
+		}
+		if len(ids) < m.chunkSize {
+			break
+		}
+		after = ids[len(ids)-1]
+	}
+
+	if named {
+		err = m.retry(ctx, "reconcile", func(conn *pgx.Conn) error {
+			if !queued {
+				var err error
+				m.report.UnresolvedRows, err = countUnresolved(ctx, conn, m.schema, m.filter)
+				return err
+			}
+			// The rows the backfill could not resolve are still queued.
+			return conn.QueryRow(ctx, `SELECT count(*) FROM `+queue+` q JOIN `+m.schema.prefix()+`dependencies d ON d.id = q.id
+WHERE d.dependent_package_name_id IS NOT NULL
+  AND d.dependent_package_version_id IS NULL
+  AND `+filter, args...).Scan(&m.report.UnresolvedRows)
+		})
+		if err != nil {
+			return moved + merged, fmt.Errorf("failed to count unresolved dependencies: %w", err)
+		}
+	}
+	if backfilled > 0 || moved+merged > 0 {
+		m.logger.Printf("reconcile: backfilled %d dependencies; %d were in the old ID scheme, %d moved to their new ID and %d merged into the rows already there\n",
+			backfilled, moved+merged, moved, merged)
+	}
+	if m.report.UnresolvedRows > 0 {
+		m.logger.Printf("reconcile: %d dependencies have no dependent_package_version_id yet and keep their ID until a later pass\n", m.report.UnresolvedRows)
+	}
+	return moved + merged, nil
+}
@@ -0,0 +1,34 @@
+package migrate
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCheckDaemonOptions(t *testing.T) {
+	for _, o := range []*options{{}, {daemon: true, interval: time.Minute}, {daemon: true, interval: time.Minute, online: true}} {
+		if err := checkDaemonOptions(o); err != nil {
+			t.Errorf("checkDaemonOptions(%+v) = %v", o, err)
+		}
+	}
+	for _, o := range []*options{
+		{daemon: true},
+		{daemon: true, interval: time.Minute, emitSQL: "migrate.sql"},
+		{daemon: true, interval: time.Minute, targetsFile: "targets.yaml"},
+		{daemon: true, interval: time.Minute, hookMode: true},
+		{daemon: true, interval: time.Minute, serveAddr: ":8099"},
+	} {
+		if err := checkDaemonOptions(o); err == nil {
+			t.Errorf("checkDaemonOptions(%+v) succeeded", o)
+		}
+	}
+}
+
+func TestReportReconciled(t *testing.T) {
+	r := newReport()
+	r.addStep("reconcile", 3, 0, nil)
+	r.skipStep("verify")
+	if n := r.reconciled(); n != 3 {
+		t.Errorf("reconciled() = %d, want 3", n)
+	}
+}
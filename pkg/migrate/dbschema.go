@@ -0,0 +1,87 @@
+package migrate
+
+import (
+	"errors"
+	"flag"
+	"regexp"
+	"strings"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// dbSchema is the Postgres schema GUAC's tables are in, from --schema or the schema of a
+// target; the zero value is public. The tables of the tool are created in the same schema.
+type dbSchema string
+
+// name is the name of the schema as Postgres reports it.
+func (s dbSchema) name() string {
+	if s == "" {
+		return "public"
+	}
+	return string(s)
+}
+
+// prefix qualifies a table of the schema in a statement.
+func (s dbSchema) prefix() string {
+	return quoteIdentifier(s.name()) + "."
+}
+
+// regclassLiteral is the literal of table in the schema cast to regclass, for the statements
+// of a DO block, which take no parameters.
+func (s dbSchema) regclassLiteral(table string) string {
+	return "'" + strings.ReplaceAll(s.prefix()+table, "'", "''") + "'::regclass"
+}
+
+// schemaFlag is the flag.Value of --schema.
+type schemaFlag struct{ schema *dbSchema }
+
+func (f schemaFlag) String() string {
+	if f.schema == nil {
+		return "public"
+	}
+	return f.schema.name()
+}
+
+func (f schemaFlag) Set(s string) error {
+	if s == "" {
+		return errors.New("must not be empty")
+	}
+	*f.schema = dbSchema(s)
+	return nil
+}
+
+func registerSchema(fs *flag.FlagSet, schema *dbSchema) {
+	fs.Var(schemaFlag{schema}, "schema", "the `schema` GUAC's tables are in, quoted in the statements when it needs to be")
+}
+
+// plainIdentifier matches the names Postgres reads as written without quotes, reserved
+// keywords aside.
+var plainIdentifier = regexp.MustCompile(`^[a-z_][a-z0-9_]*$`)
+
+// reservedKeywords are the keywords Postgres does not accept as a schema name unquoted.
+var reservedKeywords = map[string]bool{
+	"all": true, "analyse": true, "analyze": true, "and": true, "any": true, "array": true, "as": true, "asc": true,
+	"asymmetric": true, "authorization": true, "binary": true, "both": true, "case": true, "cast": true, "check": true,
+	"collate": true, "collation": true, "column": true, "concurrently": true, "constraint": true, "create": true,
+	"cross": true, "current_catalog": true, "current_date": true, "current_role": true, "current_schema": true,
+	"current_time": true, "current_timestamp": true, "current_user": true, "default": true, "deferrable": true,
+	"desc": true, "distinct": true, "do": true, "else": true, "end": true, "except": true, "false": true, "fetch": true,
+	"for": true, "foreign": true, "freeze": true, "from": true, "full": true, "grant": true, "group": true, "having": true,
+	"ilike": true, "in": true, "initially": true, "inner": true, "intersect": true, "into": true, "is": true, "isnull": true,
+	"join": true, "lateral": true, "leading": true, "left": true, "like": true, "limit": true, "localtime": true,
+	"localtimestamp": true, "natural": true, "not": true, "notnull": true, "null": true, "offset": true, "on": true,
+	"only": true, "or": true, "order": true, "outer": true, "overlaps": true, "placing": true, "primary": true,
+	"references": true, "returning": true, "right": true, "select": true, "session_user": true, "similar": true,
+	"some": true, "symmetric": true, "system_user": true, "table": true, "tablesample": true, "then": true, "to": true,
+	"trailing": true, "true": true, "union": true, "unique": true, "user": true, "using": true, "variadic": true,
+	"verbose": true, "when": true, "where": true, "window": true, "with": true,
+}
+
+// quoteIdentifier quotes name only when Postgres would not read it as written, so the
+// statements on the public schema read as they always did.
+func quoteIdentifier(name string) string {
+	if plainIdentifier.MatchString(name) && !reservedKeywords[name] {
+		return name
+	}
+	return pgx.Identifier{name}.Sanitize()
+}
@@ -0,0 +1,42 @@
+package migrate
+
+import "testing"
+
+func TestQuoteIdentifier(t *testing.T) {
+	for _, tc := range []struct{ in, want string }{
+		{"public", "public"},
+		{"guac_2", "guac_2"},
+		{"Guac", `"Guac"`},
+		{"tenant a", `"tenant a"`},
+		{"user", `"user"`},
+		{"1st", `"1st"`},
+		{`a"b`, `"a""b"`},
+	} {
+		if got := quoteIdentifier(tc.in); got != tc.want {
+			t.Errorf("quoteIdentifier(%q) = %s, want %s", tc.in, got, tc.want)
+		}
+	}
+}
+
+func TestSchemaFlag(t *testing.T) {
+	var schema dbSchema
+	if got := schema.prefix(); got != "public." {
+		t.Errorf("prefix() of the zero schema = %s, want public.", got)
+	}
+	f := schemaFlag{&schema}
+	if err := f.Set(""); err == nil {
+		t.Error("Set(\"\") succeeded, want an error")
+	}
+	if err := f.Set("Tenant's"); err != nil {
+		t.Fatal(err)
+	}
+	if schema.name() != "Tenant's" || schema.prefix() != `"Tenant's".` {
+		t.Errorf("name(), prefix() = %s, %s, want Tenant's, \"Tenant's\".", schema.name(), schema.prefix())
+	}
+	if got, want := schema.regclassLiteral("dependencies"), `'"Tenant''s".dependencies'::regclass`; got != want {
+		t.Errorf("regclassLiteral() = %s, want %s", got, want)
+	}
+	if got, want := (&migration{schema: schema}).rewriteIDSQL(dependencyIDs), `UPDATE "Tenant's".dependencies SET id = $1 WHERE id = $2`; got != want {
+		t.Errorf("rewriteIDSQL() = %s, want %s", got, want)
+	}
+}
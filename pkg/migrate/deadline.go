@@ -0,0 +1,123 @@
+package migrate
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// deadlineFlag is the flag.Value of --deadline: a duration from the start of the run, as
+// --max-runtime takes, or an RFC 3339 time such as the end of a maintenance window.
+type deadlineFlag struct {
+	after time.Duration
+	at    time.Time
+}
+
+func (d *deadlineFlag) String() string {
+	if d == nil {
+		return ""
+	}
+	if !d.at.IsZero() {
+		return d.at.Format(time.RFC3339)
+	}
+	if d.after > 0 {
+		return d.after.String()
+	}
+	return ""
+}
+
+func (d *deadlineFlag) Set(s string) error {
+	*d = deadlineFlag{}
+	if at, err := time.Parse(time.RFC3339, s); err == nil {
+		d.at = at
+		return nil
+	}
+	after, err := time.ParseDuration(s)
+	if err != nil {
+		return fmt.Errorf("%q is neither a duration nor an RFC 3339 time", s)
+	}
+	if after <= 0 {
+		return fmt.Errorf("%s is not a positive duration", after)
+	}
+	d.after = after
+	return nil
+}
+
+// from returns the deadline of a run started at start, and the zero time when none is set.
+func (d deadlineFlag) from(start time.Time) time.Time {
+	if d.after > 0 {
+		return start.Add(d.after)
+	}
+	return d.at
+}
+
+// Remaining is what a run stopped at its deadline left for the next run to do.
+type Remaining struct {
+	// Steps are the steps not completed yet, as migration/step.
+	Steps []string `json:"steps" yaml:"steps"`
+	// BackfillRows are the dependencies still without a dependent_package_version_id.
+	BackfillRows int64 `json:"backfill_rows" yaml:"backfill_rows"`
+}
+
+// checkTimeLeft stops the run before step when the deadline is closer than its --step-timeout,
+// so a step is only started when it has the time to finish. While the foreign key is dropped
+// the run goes on, as it does not stop there.
+func (m *migration) checkTimeLeft(step string) error {
+	m.stepDeadline = time.Time{}
+	timeout, ok := m.stepTimeouts.forStep(step)
+	if !ok || timeout == 0 {
+		return nil
+	}
+	start := time.Now()
+	m.stepDeadline = start.Add(timeout)
+	if m.deadline.IsZero() || m.constraintsDropped || !m.deadline.Before(m.stepDeadline) {
+		return nil
+	}
+	if err := m.state.save(); err != nil {
+		return err
+	}
+	return fmt.Errorf("%w: %s left, less than the --step-timeout of %s of %s; run the migration again to resume", ErrDeadlineReached, m.deadline.Sub(start).Round(time.Second), timeout, step)
+}
+
+// deadlineReached returns the error stopping the run at a pause point in step, once now is past
+// the deadline of the run or the --step-timeout of the step.
+func (m *migration) deadlineReached(step string, now time.Time) error {
+	switch {
+	case !m.deadline.IsZero() && now.After(m.deadline):
+		return fmt.Errorf("%w: stopped in %s; run the migration again to resume", ErrDeadlineReached, step)
+	case !m.stepDeadline.IsZero() && now.After(m.stepDeadline):
+		timeout, _ := m.stepTimeouts.forStep(m.currentStep)
+		return fmt.Errorf("%w: %s ran for its --step-timeout of %s; run the migration again to resume", ErrDeadlineReached, step, timeout)
+	}
+	return nil
+}
+
+// recordRemaining puts what is left of the run in the report once it stopped at its deadline:
+// the steps of plan and post not completed, and the rows the backfill has yet to resolve.
+func (m *migration) recordRemaining(ctx context.Context, migrations []dataMigration, plan [][]step, post []step) {
+	r := &Remaining{Steps: []string{}}
+	add := func(migration string, steps []step) {
+		for _, s := range steps {
+			key := stateKey(migration, s.name)
+			if m.steps.selected(s.name) && !m.state.completed(key) && !m.completedSteps[key] {
+				r.Steps = append(r.Steps, key)
+			}
+		}
+	}
+	for i, dm := range migrations {
+		add(dm.Name, plan[i])
+	}
+	add("", post)
+	err := m.retry(ctx, "remaining", func(conn *pgx.Conn) error {
+		var err error
+		r.BackfillRows, err = countUnresolved(ctx, conn, m.schema, m.filter)
+		return err
+	})
+	if err != nil {
+		m.logger.Printf("failed to count the dependencies left to backfill: %v\n", err)
+	}
+	m.report.Remaining = r
+	m.logger.Printf("Stopped at the deadline with %d steps left (%v) and %d dependencies left to backfill\n", len(r.Steps), r.Steps, r.BackfillRows)
+}
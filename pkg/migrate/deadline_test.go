@@ -0,0 +1,63 @@
+package migrate
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestDeadlineFlag(t *testing.T) {
+	start := time.Date(2024, 3, 1, 22, 0, 0, 0, time.UTC)
+	for _, tc := range []struct {
+		in   string
+		want time.Time
+		ok   bool
+	}{
+		{"2h", start.Add(2 * time.Hour), true},
+		{"90m", start.Add(90 * time.Minute), true},
+		{"2024-03-02T06:00:00Z", time.Date(2024, 3, 2, 6, 0, 0, 0, time.UTC), true},
+		{"0s", time.Time{}, false},
+		{"-1h", time.Time{}, false},
+		{"06:00", time.Time{}, false},
+	} {
+		var d deadlineFlag
+		err := d.Set(tc.in)
+		if (err == nil) != tc.ok || (tc.ok && !d.from(start).Equal(tc.want)) {
+			t.Errorf("Set(%q) = %s, %v, want %s, ok %v", tc.in, d.from(start), err, tc.want, tc.ok)
+		}
+	}
+	if got := (deadlineFlag{}).from(start); !got.IsZero() {
+		t.Errorf("from() without a deadline = %s, want the zero time", got)
+	}
+}
+
+func TestStepTimeouts(t *testing.T) {
+	m := &migration{currentStep: "backfill"}
+	if err := m.stepTimeouts.Set("30m,backfill=2h"); err != nil {
+		t.Fatal(err)
+	}
+
+	m.deadline = time.Now().Add(time.Hour)
+	if err := m.checkTimeLeft("backfill"); !errors.Is(err, ErrDeadlineReached) {
+		t.Errorf("checkTimeLeft(backfill) an hour before the deadline = %v, want ErrDeadlineReached", err)
+	}
+	if err := m.checkTimeLeft("rewrite-ids"); err != nil {
+		t.Errorf("checkTimeLeft(rewrite-ids) an hour before the deadline = %v, want nil", err)
+	}
+	m.constraintsDropped = true
+	if err := m.checkTimeLeft("backfill"); err != nil {
+		t.Errorf("checkTimeLeft(backfill) with the foreign key dropped = %v, want nil", err)
+	}
+
+	m.constraintsDropped = false
+	m.deadline = time.Time{}
+	if err := m.checkTimeLeft("backfill"); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.deadlineReached("backfill", time.Now().Add(time.Hour)); err != nil {
+		t.Errorf("deadlineReached() within the --step-timeout = %v, want nil", err)
+	}
+	if err := m.deadlineReached("backfill", time.Now().Add(3*time.Hour)); !errors.Is(err, ErrDeadlineReached) {
+		t.Errorf("deadlineReached() past the --step-timeout = %v, want ErrDeadlineReached", err)
+	}
+}
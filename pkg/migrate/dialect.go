@@ -0,0 +1,78 @@
+package migrate
+
+import (
+	"errors"
+	"fmt"
+)
+
+// dialect is the database the migration runs against. CockroachDB speaks the Postgres wire
+// protocol and runs GUAC's ent schema, but lacks some of the Postgres features the migration
+// relies on.
+type dialect string
+
+const (
+	dialectPostgres  dialect = "postgres"
+	dialectCockroach dialect = "cockroach"
+)
+
+func (d *dialect) String() string {
+	if *d == "" {
+		return string(dialectPostgres)
+	}
+	return string(*d)
+}
+
+func (d *dialect) Set(s string) error {
+	switch dialect(s) {
+	case dialectPostgres, dialectCockroach:
+		*d = dialect(s)
+		return nil
+	default:
+		return fmt.Errorf("must be postgres or cockroach")
+	}
+}
+
+// advisoryLocks reports whether the database has session-level advisory locks to hold the
+// migration lock with. CockroachDB does not.
+func (d dialect) advisoryLocks() bool {
+	return d != dialectCockroach
+}
+
+// transactionalDDL reports whether schema changes can share a transaction with writes.
+// CockroachDB runs schema changes asynchronously and may fail a transaction combining them.
+func (d dialect) transactionalDDL() bool {
+	return d != dialectCockroach
+}
+
+// statisticsViews reports whether the database keeps the Postgres statistics views the report
+// reads the server-side cost of every step from. CockroachDB only has empty stand-ins.
+func (d dialect) statisticsViews() bool {
+	return d != dialectCockroach
+}
+
+// diskSpace reports whether the database exposes the sizes of its relations and where its files
+// are, which the disk space check needs. CockroachDB spreads its ranges over nodes whose free
+// space SQL does not show.
+func (d dialect) diskSpace() bool {
+	return d != dialectCockroach
+}
+
+// checkDialectOptions rejects settings that rely on Postgres features the database lacks.
+func checkDialectOptions(opts *options) error {
+	if opts.dialect != dialectCockroach {
+		return nil
+	}
+	switch {
+	case opts.deferFKs:
+		return errors.New("--defer-constraints cannot be used with --dialect=cockroach: CockroachDB has no deferrable foreign keys")
+	case opts.estimate:
+		return errors.New("--estimate measures the WAL Postgres writes and cannot be used with --dialect=cockroach")
+	case opts.analyzeDSN != "":
+		return errors.New("--analyze-dsn waits for a Postgres streaming replica and cannot be used with --dialect=cockroach")
+	case opts.maintenance == maintenanceVacuumAnalyze:
+		return errors.New("--post-maintenance=vacuum-analyze cannot be used with --dialect=cockroach, which has no VACUUM; use analyze")
+	case !opts.force && opts.emitSQL == "":
+		return errors.New("--dialect=cockroach cannot see which sessions are writing to the database; stop GUAC ingestion and pass --force")
+	}
+	return nil
+}
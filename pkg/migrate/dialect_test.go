@@ -0,0 +1,28 @@
+package migrate
+
+import "testing"
+
+func TestCheckDialectOptions(t *testing.T) {
+	tests := []struct {
+		name    string
+		opts    options
+		wantErr bool
+	}{
+		{name: "postgres", opts: options{deferFKs: true, estimate: true}},
+		{name: "cockroach", opts: options{dialect: dialectCockroach, force: true, maintenance: maintenanceAnalyze}},
+		{name: "cockroach emit-sql", opts: options{dialect: dialectCockroach, emitSQL: "migration.sql"}},
+		{name: "cockroach without force", opts: options{dialect: dialectCockroach}, wantErr: true},
+		{name: "cockroach defer-constraints", opts: options{dialect: dialectCockroach, force: true, deferFKs: true}, wantErr: true},
+		{name: "cockroach estimate", opts: options{dialect: dialectCockroach, force: true, estimate: true}, wantErr: true},
+		{name: "cockroach analyze-dsn", opts: options{dialect: dialectCockroach, force: true, analyzeDSN: "host=replica"}, wantErr: true},
+		{name: "cockroach vacuum", opts: options{dialect: dialectCockroach, force: true, maintenance: maintenanceVacuumAnalyze}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := checkDialectOptions(&tt.opts)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("checkDialectOptions() = %v, want error %v", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,331 @@
+package migrate
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// graphEdge is a dependency edge of a GUAC graph by content rather than by ID, so it compares
+// equal across databases whose IDs differ: before and after the migration, or a dump restored
+// elsewhere. Packages are written as purls without percent-encoding.
+type graphEdge struct {
+	// SBOM identifies the bill of materials including the edge by its URI and digest; it is
+	// empty for the edges of the dependencies table.
+	SBOM string `json:"sbom,omitempty"`
+	// Package is the depending package version, with its subpath and qualifiers.
+	Package string `json:"package"`
+	// DependsOn is the package the edge depends on with the version of
+	// dependent_package_version_id, or its name with version_range when that is not set, as
+	// before the migration backfilled it.
+	DependsOn      string `json:"depends_on"`
+	DependencyType string `json:"dependency_type"`
+	Justification  string `json:"justification"`
+	Origin         string `json:"origin"`
+	Collector      string `json:"collector"`
+	DocumentRef    string `json:"document_ref"`
+}
+
+func (e *graphEdge) fields() []string {
+	return []string{e.SBOM, e.Package, e.DependsOn, e.DependencyType, e.Justification, e.Origin, e.Collector, e.DocumentRef}
+}
+
+// compareEdges orders edges by their fields, byte by byte as the COLLATE "C" of edgesSQL does.
+func compareEdges(a, b *graphEdge) int {
+	fa, fb := a.fields(), b.fields()
+	for i := range fa {
+		if c := strings.Compare(fa[i], fb[i]); c != 0 {
+			return c
+		}
+	}
+	return 0
+}
+
+func (e *graphEdge) String() string {
+	s := e.Package + " -> " + e.DependsOn + " (" + e.DependencyType + ", " + e.Justification + ", " + e.Origin + ", " + e.Collector + ", " + e.DocumentRef + ")"
+	if e.SBOM != "" {
+		s = e.SBOM + ": " + s
+	}
+	return s
+}
+
+// The relations diff compares.
+const (
+	relationDependencies = "dependencies"
+	relationSBOMs        = "bill_of_materials_included_dependencies"
+)
+
+// purlSQL renders the purl of the package name whose type, namespace and name rows are aliased
+// t, ns and n.
+func purlSQL(t, ns, n string) string {
+	return fmt.Sprintf(`'pkg:' || %[1]s.type || '/' || CASE WHEN %[2]s.namespace = '' THEN '' ELSE %[2]s.namespace || '/' END || %[3]s.name`, t, ns, n)
+}
+
+// edgesSQL selects the distinct edges of relation with how often each occurs, in the order of
+// compareEdges.
+func edgesSQL(schema dbSchema, relation string) string {
+	pkg := purlSQL("t", "ns", "n") + ` || coalesce('@' || nullif(v.version, ''), '') || coalesce('#' || nullif(v.subpath, ''), '')` +
+		` || CASE WHEN v.qualifiers IS NULL OR v.qualifiers IN ('[]', 'null') THEN '' ELSE ' ' || v.qualifiers::text END`
+	dependsOn := `coalesce(` + purlSQL("dt", "dns", "dn") + ` || coalesce('@' || nullif(coalesce(dv.version, d.version_range), ''), ''), '')`
+	sbom, from := `''`, schema.prefix()+`dependencies d`
+	if relation == relationSBOMs {
+		sbom = `b.uri || '@' || b.algorithm || ':' || b.digest`
+		from = schema.prefix() + `bill_of_materials_included_dependencies i
+		JOIN ` + schema.prefix() + `bill_of_materials b ON b.id = i.bill_of_materials_id
+		JOIN ` + schema.prefix() + `dependencies d ON d.id = i.dependency_id`
+	}
+	// An ordinal in ORDER BY cannot take a COLLATE, so the edges are ordered by name outside.
+	return `
+		SELECT * FROM (
+		SELECT ` + sbom + ` AS sbom, ` + pkg + ` AS package, ` + dependsOn + ` AS depends_on,
+		       d.dependency_type, d.justification, d.origin, d.collector, d.document_ref, count(*) AS n
+		FROM ` + from + `
+		JOIN ` + schema.prefix() + `package_versions v ON v.id = d.package_id
+		JOIN ` + schema.prefix() + `package_names n ON n.id = v.name_id
+		JOIN ` + schema.prefix() + `package_namespaces ns ON ns.id = n.namespace_id
+		JOIN ` + schema.prefix() + `package_types t ON t.id = ns.package_id
+		LEFT JOIN ` + schema.prefix() + `package_versions dv ON dv.id = d.dependent_package_version_id
+		LEFT JOIN ` + schema.prefix() + `package_names dn ON dn.id = coalesce(dv.name_id, d.dependent_package_name_id)
+		LEFT JOIN ` + schema.prefix() + `package_namespaces dns ON dns.id = dn.namespace_id
+		LEFT JOIN ` + schema.prefix() + `package_types dt ON dt.id = dns.package_id
+		GROUP BY 1, 2, 3, 4, 5, 6, 7, 8
+		) e
+		ORDER BY sbom COLLATE "C", package COLLATE "C", depends_on COLLATE "C", dependency_type COLLATE "C",
+		         justification COLLATE "C", origin COLLATE "C", collector COLLATE "C", document_ref COLLATE "C"
+	`
+}
+
+// edgeSource yields distinct edges in the order of compareEdges with how often each occurs,
+// and ok false once there are no more.
+type edgeSource interface {
+	next() (e graphEdge, n int64, ok bool, err error)
+}
+
+// rowsEdges reads the edges edgesSQL selects.
+type rowsEdges struct {
+	rows pgx.Rows
+}
+
+func (r *rowsEdges) next() (graphEdge, int64, bool, error) {
+	if !r.rows.Next() {
+		return graphEdge{}, 0, false, r.rows.Err()
+	}
+	var e graphEdge
+	var n int64
+	err := r.rows.Scan(&e.SBOM, &e.Package, &e.DependsOn, &e.DependencyType, &e.Justification, &e.Origin, &e.Collector, &e.DocumentRef, &n)
+	return e, n, err == nil, err
+}
+
+// edgeDifference is an edge the two databases have a different number of.
+type edgeDifference struct {
+	graphEdge
+	From int64 `json:"from"`
+	To   int64 `json:"to"`
+}
+
+// relationDiff compares the edges of one relation of the two databases.
+type relationDiff struct {
+	Relation  string `json:"relation"`
+	FromEdges int64  `json:"from_edges"`
+	ToEdges   int64  `json:"to_edges"`
+	// Missing counts the edges of the from database the to database lacks, and Extra those of
+	// the to database the from database lacks.
+	Missing     int64            `json:"missing"`
+	Extra       int64            `json:"extra"`
+	Differences []edgeDifference `json:"differences"`
+}
+
+// graphDiff is the result of the diff command.
+type graphDiff struct {
+	Identical bool            `json:"identical"`
+	Relations []*relationDiff `json:"relations"`
+}
+
+// diffEdges merges the edges of the two sources, which are in the same order, and lists at most
+// listLimit of the edges they differ in.
+func diffEdges(relation string, from, to edgeSource, listLimit int) (*relationDiff, error) {
+	d := &relationDiff{Relation: relation, Differences: []edgeDifference{}}
+	var prevFrom, prevTo *graphEdge
+	read := func(s edgeSource, prev **graphEdge, which string) (*graphEdge, int64, error) {
+		e, n, ok, err := s.next()
+		if err != nil || !ok {
+			return nil, 0, err
+		}
+		if *prev != nil && compareEdges(*prev, &e) >= 0 {
+			return nil, 0, fmt.Errorf("the %s database returned the edges out of byte order, which diff relies on", which)
+		}
+		*prev = &e
+		return &e, n, nil
+	}
+	fe, fn, err := read(from, &prevFrom, "from")
+	if err != nil {
+		return nil, err
+	}
+	te, tn, err := read(to, &prevTo, "to")
+	if err != nil {
+		return nil, err
+	}
+	for fe != nil || te != nil {
+		var diff edgeDifference
+		c := 0
+		switch {
+		case fe == nil:
+			c = 1
+		case te == nil:
+			c = -1
+		default:
+			c = compareEdges(fe, te)
+		}
+		if c <= 0 {
+			diff.graphEdge, diff.From = *fe, fn
+			d.FromEdges += fn
+		}
+		if c >= 0 {
+			diff.graphEdge, diff.To = *te, tn
+			d.ToEdges += tn
+		}
+		if diff.From != diff.To {
+			d.Missing += max(diff.From-diff.To, 0)
+			d.Extra += max(diff.To-diff.From, 0)
+			if len(d.Differences) < listLimit {
+				d.Differences = append(d.Differences, diff)
+			}
+		}
+		if c <= 0 {
+			if fe, fn, err = read(from, &prevFrom, "from"); err != nil {
+				return nil, err
+			}
+		}
+		if c >= 0 {
+			if te, tn, err = read(to, &prevTo, "to"); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return d, nil
+}
+
+func (g *graphDiff) print(w io.Writer) {
+	for _, d := range g.Relations {
+		fmt.Fprintf(w, "%s: %d edges in the from database, %d in the to database; %d missing, %d extra\n", d.Relation, d.FromEdges, d.ToEdges, d.Missing, d.Extra)
+		shown := int64(0)
+		for _, diff := range d.Differences {
+			fmt.Fprintf(w, "  %s: from %d, to %d\n", diff.String(), diff.From, diff.To)
+			shown += max(diff.From-diff.To, diff.To-diff.From)
+		}
+		if shown < d.Missing+d.Extra {
+			fmt.Fprintf(w, "  ... %d more (raise --list)\n", d.Missing+d.Extra-shown)
+		}
+	}
+	if g.Identical {
+		fmt.Fprintln(w, "The two databases have the same dependency graph.")
+	}
+}
+
+func runDiff(args []string) {
+	var from, to connFlags
+	fs := flag.NewFlagSet("diff", flag.ExitOnError)
+	from.registerNamed(fs, "from", "database to compare from, e.g. a snapshot taken before the migration")
+	to.registerNamed(fs, "to", "database to compare to, e.g. the migrated one")
+	registerSchema(fs, &from.schema)
+	format := fs.String("format", "text", "output `format`: text or json")
+	list := fs.Int("list", 20, "list at most `n` differing edges of each relation")
+	fs.Parse(args)
+	to.schema = from.schema
+
+	identical, err := diffGraphs(&from, &to, *format, *list, os.Stdout)
+	if err != nil {
+		log.Fatalf("%v\n", err)
+	}
+	if !identical {
+		os.Exit(exitVerificationFailed)
+	}
+}
+
+// diffGraphs compares the dependency edges of two databases, and the edges their SBOMs
+// include, by content, and reports whether they are the same. Each database is read in a
+// single read-only transaction, so a database in use is compared as of one point in time.
+func diffGraphs(from, to *connFlags, format string, listLimit int, w io.Writer) (bool, error) {
+	if format != "text" && format != "json" {
+		return false, fmt.Errorf("invalid --format %q: must be text or json", format)
+	}
+	if from.dsnFile == "" && to.dsnFile == "" {
+		return false, errors.New("set --from-dsn-file or --to-dsn-file: both databases would be the one of the PG* environment variables")
+	}
+	if from.usesStdin() && to.usesStdin() {
+		return false, errors.New("only one of the --from and --to files can be read from stdin")
+	}
+	ctx := context.Background()
+	fromTx, err := beginDiff(ctx, from, "from")
+	if err != nil {
+		return false, err
+	}
+	defer fromTx.Conn().Close(ctx)
+	toTx, err := beginDiff(ctx, to, "to")
+	if err != nil {
+		return false, err
+	}
+	defer toTx.Conn().Close(ctx)
+
+	g := &graphDiff{Identical: true}
+	for _, relation := range []string{relationDependencies, relationSBOMs} {
+		d, err := diffRelation(ctx, from.schema, fromTx, toTx, relation, listLimit)
+		if err != nil {
+			return false, fmt.Errorf("failed to compare %s: %w", relation, err)
+		}
+		g.Relations = append(g.Relations, d)
+		g.Identical = g.Identical && d.Missing == 0 && d.Extra == 0
+	}
+
+	if format == "json" {
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return g.Identical, enc.Encode(g)
+	}
+	g.print(w)
+	return g.Identical, nil
+}
+
+// beginDiff connects to one of the databases diff compares and starts the read-only
+// transaction it is read in.
+func beginDiff(ctx context.Context, cf *connFlags, which string) (pgx.Tx, error) {
+	config, err := cf.config()
+	if err != nil {
+		return nil, fmt.Errorf("%s database: %w", which, err)
+	}
+	conn, err := pgx.ConnectConfig(ctx, config)
+	if err != nil {
+		return nil, fmt.Errorf("unable to connect to the %s database: %w", which, err)
+	}
+	tx, err := conn.BeginTx(ctx, pgx.TxOptions{IsoLevel: pgx.RepeatableRead, AccessMode: pgx.ReadOnly})
+	if err != nil {
+		conn.Close(ctx)
+		return nil, fmt.Errorf("failed to start a transaction in the %s database: %w", which, err)
+	}
+	return tx, nil
+}
+
+// diffRelation streams the edges of relation from both databases at once and merges them, so
+// neither is held in memory.
+func diffRelation(ctx context.Context, schema dbSchema, fromTx, toTx pgx.Tx, relation string, listLimit int) (*relationDiff, error) {
+	query := edgesSQL(schema, relation)
+	fromRows, err := fromTx.Query(ctx, query)
+	if err != nil {
+		return nil, fmt.Errorf("from database: %w", err)
+	}
+	defer fromRows.Close()
+	toRows, err := toTx.Query(ctx, query)
+	if err != nil {
+		return nil, fmt.Errorf("to database: %w", err)
+	}
+	defer toRows.Close()
+	return diffEdges(relation, &rowsEdges{fromRows}, &rowsEdges{toRows}, listLimit)
+}
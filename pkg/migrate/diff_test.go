@@ -0,0 +1,93 @@
+package migrate
+
+import (
+	"testing"
+)
+
+// sliceEdges yields edges from a slice, each occurring counts[i] times.
+type sliceEdges struct {
+	edges  []graphEdge
+	counts []int64
+}
+
+func (s *sliceEdges) next() (graphEdge, int64, bool, error) {
+	if len(s.edges) == 0 {
+		return graphEdge{}, 0, false, nil
+	}
+	e, n := s.edges[0], s.counts[0]
+	s.edges, s.counts = s.edges[1:], s.counts[1:]
+	return e, n, true, nil
+}
+
+func TestDiffEdges(t *testing.T) {
+	a := graphEdge{Package: "pkg:npm/a@1", DependsOn: "pkg:npm/b@2", DependencyType: "DIRECT"}
+	b := graphEdge{Package: "pkg:npm/a@1", DependsOn: "pkg:npm/c@1", DependencyType: "DIRECT"}
+	c := graphEdge{Package: "pkg:npm/b@2", DependsOn: "pkg:npm/c@1", DependencyType: "INDIRECT"}
+	tests := []struct {
+		name               string
+		from, to           *sliceEdges
+		list               int
+		missing, extra     int64
+		fromEdges, toEdges int64
+		differences        int
+	}{
+		{
+			name:      "identical",
+			from:      &sliceEdges{[]graphEdge{a, b, c}, []int64{1, 1, 2}},
+			to:        &sliceEdges{[]graphEdge{a, b, c}, []int64{1, 1, 2}},
+			list:      20,
+			fromEdges: 4,
+			toEdges:   4,
+		},
+		{
+			name:        "missing and extra",
+			from:        &sliceEdges{[]graphEdge{a, b}, []int64{1, 1}},
+			to:          &sliceEdges{[]graphEdge{b, c}, []int64{1, 1}},
+			list:        20,
+			missing:     1,
+			extra:       1,
+			fromEdges:   2,
+			toEdges:     2,
+			differences: 2,
+		},
+		{
+			name:        "duplicates",
+			from:        &sliceEdges{[]graphEdge{a}, []int64{3}},
+			to:          &sliceEdges{[]graphEdge{a}, []int64{1}},
+			list:        20,
+			missing:     2,
+			fromEdges:   3,
+			toEdges:     1,
+			differences: 1,
+		},
+		{
+			name:        "empty to",
+			from:        &sliceEdges{[]graphEdge{a, b, c}, []int64{1, 1, 1}},
+			to:          &sliceEdges{},
+			list:        1,
+			missing:     3,
+			fromEdges:   3,
+			differences: 1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d, err := diffEdges(relationDependencies, tt.from, tt.to, tt.list)
+			if err != nil {
+				t.Fatalf("diffEdges() failed: %v", err)
+			}
+			if d.Missing != tt.missing || d.Extra != tt.extra || d.FromEdges != tt.fromEdges || d.ToEdges != tt.toEdges || len(d.Differences) != tt.differences {
+				t.Errorf("diffEdges() = %+v, want %d missing, %d extra, %d and %d edges, %d differences listed", d, tt.missing, tt.extra, tt.fromEdges, tt.toEdges, tt.differences)
+			}
+		})
+	}
+}
+
+func TestDiffEdgesRejectsUnsortedInput(t *testing.T) {
+	a := graphEdge{Package: "pkg:npm/a@1"}
+	b := graphEdge{Package: "pkg:npm/b@1"}
+	_, err := diffEdges(relationDependencies, &sliceEdges{[]graphEdge{b, a}, []int64{1, 1}}, &sliceEdges{}, 20)
+	if err == nil {
+		t.Error("diffEdges() of unsorted edges succeeded, want an error")
+	}
+}
@@ -0,0 +1,188 @@
+package migrate
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+// The modes of --disk-check.
+const (
+	diskCheckEnforce = "enforce"
+	diskCheckWarn    = "warn"
+	diskCheckOff     = "off"
+)
+
+// stagingRowBytes is about what a row of the --fast staging table takes, with its index.
+const stagingRowBytes = 64
+
+func validDiskCheck(mode string) bool {
+	return mode == diskCheckEnforce || mode == diskCheckWarn || mode == diskCheckOff
+}
+
+// DiskHeadroom is what the disk space check before the run found.
+type DiskHeadroom struct {
+	DatabaseBytes int64 `json:"database_bytes" yaml:"database_bytes"`
+	// RequiredBytes is the space the run is estimated to take on top of the database: about
+	// the size of the rewritten tables again for the new versions of their rows until they are
+	// vacuumed, as much WAL, and the staging table of --fast.
+	RequiredBytes int64 `json:"required_bytes" yaml:"required_bytes"`
+	// Volumes are the volumes the estimate was checked against, none when their free space
+	// could not be determined.
+	Volumes []DiskVolume `json:"volumes,omitempty" yaml:"volumes,omitempty"`
+}
+
+// DiskVolume is a volume the database writes to during the run: the data directory, the
+// directory of a tablespace, or pg_wal.
+type DiskVolume struct {
+	Path           string `json:"path" yaml:"path"`
+	RequiredBytes  int64  `json:"required_bytes" yaml:"required_bytes"`
+	AvailableBytes int64  `json:"available_bytes" yaml:"available_bytes"`
+}
+
+// diskVolumes adds up what every volume must hold: tableBytes on the volumes of tablePaths, and
+// walBytes on the one of walPath. stat returns the free space and the device of a path; the
+// volumes are unknown, with the error, when one of the paths cannot be read, as when the tool
+// does not run on the database server.
+func diskVolumes(tablePaths []string, tableBytes int64, walPath string, walBytes int64, stat func(string) (free, device uint64, err error)) ([]DiskVolume, error) {
+	var volumes []DiskVolume
+	byDevice := make(map[uint64]int)
+	add := func(path string, bytes int64) error {
+		free, device, err := stat(path)
+		if err != nil {
+			return err
+		}
+		i, ok := byDevice[device]
+		if !ok {
+			i = len(volumes)
+			byDevice[device] = i
+			volumes = append(volumes, DiskVolume{Path: path, AvailableBytes: int64(free)})
+		}
+		volumes[i].RequiredBytes += bytes
+		return nil
+	}
+	for _, path := range tablePaths {
+		if err := add(path, tableBytes); err != nil {
+			return nil, err
+		}
+	}
+	if err := add(walPath, walBytes); err != nil {
+		return nil, err
+	}
+	return volumes, nil
+}
+
+// short returns the volumes of h without room for what they must hold.
+func (h *DiskHeadroom) short() []DiskVolume {
+	var short []DiskVolume
+	for _, v := range h.Volumes {
+		if v.RequiredBytes > v.AvailableBytes {
+			short = append(short, v)
+		}
+	}
+	return short
+}
+
+// checkDiskHeadroom estimates the space the run takes on top of the database from the size of
+// the rewritten tables, and compares it to the free space of the volumes the database writes
+// to, from --disk-available or, when the tool runs where it can see them, the file system.
+// Without enough room it fails the run before changing anything, or only warns with
+// --disk-check=warn, since a database server out of disk space stops accepting writes.
+func (m *migration) checkDiskHeadroom(ctx context.Context) error {
+	if m.diskCheck == diskCheckOff {
+		return nil
+	}
+	if !m.dialect.diskSpace() {
+		m.logger.Printf("Skipping the disk space check: CockroachDB does not show the free space of its nodes\n")
+		return nil
+	}
+	tables := dependencyIDs.tables()
+	for i, t := range tables {
+		tables[i] = m.schema.prefix() + t
+	}
+	h := &DiskHeadroom{}
+	var tableBytes, rows int64
+	var dataDir *string
+	var tablespaces []string
+	err := m.retry(ctx, "disk-check", func(conn *pgx.Conn) error {
+		err := conn.QueryRow(ctx, `
+			SELECT pg_database_size(current_database()),
+			       (SELECT coalesce(sum(pg_total_relation_size(p.relid)), 0)::bigint
+			        FROM unnest($1::text[]) t(name), pg_partition_tree(t.name::regclass) p)
+		`, tables).Scan(&h.DatabaseBytes, &tableBytes)
+		if err != nil {
+			return err
+		}
+		if rows, err = estimatedRows(ctx, conn, m.schema.prefix()+"dependencies"); err != nil {
+			return err
+		}
+		dataDir, tablespaces = nil, nil
+		err = conn.QueryRow(ctx, `
+			SELECT current_setting('data_directory'),
+			       array(SELECT DISTINCT pg_tablespace_location(c.reltablespace)
+			             FROM unnest($1::text[]) t(name), pg_partition_tree(t.name::regclass) p
+			             JOIN pg_class c ON c.oid = p.relid
+			             WHERE c.reltablespace <> 0)
+		`, tables).Scan(&dataDir, &tablespaces)
+		// Only superusers and members of pg_read_all_settings can read data_directory.
+		var pgErr *pgconn.PgError
+		if errors.As(err, &pgErr) && pgErr.Code == "42501" {
+			return nil
+		}
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("failed to estimate the disk space the migration needs: %w", err)
+	}
+	growth := tableBytes
+	if m.fast {
+		growth += rows * stagingRowBytes
+	}
+	h.RequiredBytes = growth + tableBytes
+	m.report.DiskHeadroom = h
+
+	switch {
+	case m.diskAvailable > 0:
+		h.Volumes = []DiskVolume{{Path: "--disk-available", RequiredBytes: h.RequiredBytes, AvailableBytes: m.diskAvailable}}
+	case dataDir == nil:
+		m.logger.Printf("The migration needs about %s of disk space on top of the %s of the database; the data directory is not readable by this user, pass --disk-available to check the free space\n",
+			formatBytes(h.RequiredBytes), formatBytes(h.DatabaseBytes))
+		return nil
+	default:
+		paths := tablespaces
+		if len(tablespaces) == 0 {
+			paths = []string{*dataDir}
+		}
+		volumes, err := diskVolumes(paths, growth, filepath.Join(*dataDir, "pg_wal"), tableBytes, freeSpace)
+		if err != nil {
+			m.logger.Printf("The migration needs about %s of disk space on top of the %s of the database; the free space of %s cannot be read from here (%v), pass --disk-available to check it\n",
+				formatBytes(h.RequiredBytes), formatBytes(h.DatabaseBytes), *dataDir, err)
+			return nil
+		}
+		h.Volumes = volumes
+	}
+
+	short := h.short()
+	if len(short) == 0 {
+		for _, v := range h.Volumes {
+			m.logger.Printf("Disk space: %s needs about %s, %s is free\n", v.Path, formatBytes(v.RequiredBytes), formatBytes(v.AvailableBytes))
+		}
+		return nil
+	}
+	var lacking []string
+	for _, v := range short {
+		lacking = append(lacking, fmt.Sprintf("%s needs about %s but only %s is free", v.Path, formatBytes(v.RequiredBytes), formatBytes(v.AvailableBytes)))
+	}
+	err = fmt.Errorf("not enough disk space for the migration: %s. Rewriting the dependencies leaves their old row versions behind until they are vacuumed, next to the WAL of the rewrite; "+
+		"grow the volume, VACUUM FULL bloated tables, migrate in parts with the --filter flags, or pass --disk-check=warn to run anyway", strings.Join(lacking, "; "))
+	if m.diskCheck == diskCheckWarn {
+		m.logger.Printf("Warning: %v\n", err)
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,11 @@
+//go:build !linux && !darwin
+
+package migrate
+
+import "errors"
+
+// freeSpace is only implemented on Linux and macOS; elsewhere --disk-available gives the free
+// space.
+func freeSpace(path string) (free, device uint64, err error) {
+	return 0, 0, errors.ErrUnsupported
+}
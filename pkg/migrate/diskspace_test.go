@@ -0,0 +1,72 @@
+package migrate
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestDiskVolumes(t *testing.T) {
+	devices := map[string]uint64{"/data": 1, "/data/pg_wal": 1, "/ts/fast": 2, "/wal": 3}
+	stat := func(path string) (uint64, uint64, error) {
+		device, ok := devices[path]
+		if !ok {
+			return 0, 0, errors.New("no such file or directory")
+		}
+		return device * 1000, device, nil
+	}
+	for _, tc := range []struct {
+		tables []string
+		wal    string
+		want   []DiskVolume
+	}{
+		{[]string{"/data"}, "/data/pg_wal", []DiskVolume{{Path: "/data", RequiredBytes: 300, AvailableBytes: 1000}}},
+		{[]string{"/data"}, "/wal", []DiskVolume{{Path: "/data", RequiredBytes: 100, AvailableBytes: 1000}, {Path: "/wal", RequiredBytes: 200, AvailableBytes: 3000}}},
+		{[]string{"/data", "/ts/fast"}, "/data/pg_wal", []DiskVolume{{Path: "/data", RequiredBytes: 300, AvailableBytes: 1000}, {Path: "/ts/fast", RequiredBytes: 100, AvailableBytes: 2000}}},
+	} {
+		got, err := diskVolumes(tc.tables, 100, tc.wal, 200, stat)
+		if err != nil || !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("diskVolumes(%v, %s) = %+v, %v, want %+v", tc.tables, tc.wal, got, err, tc.want)
+		}
+	}
+	if got, err := diskVolumes([]string{"/remote"}, 100, "/remote/pg_wal", 200, stat); err == nil {
+		t.Errorf("diskVolumes of an unreadable path = %+v, want an error", got)
+	}
+}
+
+func TestDiskHeadroomShort(t *testing.T) {
+	h := &DiskHeadroom{Volumes: []DiskVolume{
+		{Path: "/data", RequiredBytes: 100, AvailableBytes: 100},
+		{Path: "/wal", RequiredBytes: 200, AvailableBytes: 199},
+	}}
+	if got := h.short(); len(got) != 1 || got[0].Path != "/wal" {
+		t.Errorf("short() = %+v, want /wal", got)
+	}
+	if got := (&DiskHeadroom{}).short(); got != nil {
+		t.Errorf("short() without volumes = %+v", got)
+	}
+}
+
+func TestValidDiskCheck(t *testing.T) {
+	for _, mode := range []string{diskCheckEnforce, diskCheckWarn, diskCheckOff} {
+		if !validDiskCheck(mode) {
+			t.Errorf("validDiskCheck(%q) = false", mode)
+		}
+	}
+	if validDiskCheck("skip") {
+		t.Error(`validDiskCheck("skip") = true`)
+	}
+}
+
+func TestFreeSpace(t *testing.T) {
+	free, _, err := freeSpace(t.TempDir())
+	if errors.Is(err, errors.ErrUnsupported) {
+		t.Skip(err)
+	}
+	if err != nil || free == 0 {
+		t.Errorf("freeSpace = %d, %v", free, err)
+	}
+	if _, _, err := freeSpace(t.TempDir() + "/missing"); err == nil {
+		t.Error("freeSpace of a missing directory succeeded")
+	}
+}
@@ -0,0 +1,19 @@
+//go:build linux || darwin
+
+package migrate
+
+import "syscall"
+
+// freeSpace returns the space available to unprivileged users on the volume of path, and the
+// device of path, which tells volumes apart.
+func freeSpace(path string) (free, device uint64, err error) {
+	var fs syscall.Statfs_t
+	if err := syscall.Statfs(path, &fs); err != nil {
+		return 0, 0, err
+	}
+	var st syscall.Stat_t
+	if err := syscall.Stat(path, &st); err != nil {
+		return 0, 0, err
+	}
+	return uint64(fs.Bavail) * uint64(fs.Bsize), uint64(st.Dev), nil
+}
@@ -0,0 +1,592 @@
+package migrate
+
+import (
+	"bufio"
+	"bytes"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/pxp928/guac-update-db/pkg/keys"
+)
+
+func runRewriteDump(args []string) {
+	var scheme idSchemeFlag
+	var schema dbSchema
+	fs := flag.NewFlagSet("rewrite-dump", flag.ExitOnError)
+	scheme.register(fs)
+	registerSchema(fs, &schema)
+	in := fs.String("in", "", "plain-format pg_dump of the GUAC database to read, at `path`")
+	out := fs.String("out", "", "write the migrated dump to `path`")
+	fs.Parse(args)
+
+	if *in == "" || *out == "" {
+		log.Fatalf("--in and --out are required\n")
+	}
+	if err := rewriteDumpFile(*in, *out, scheme.get(), schema, os.Stdout); err != nil {
+		log.Fatalf("%v\n", err)
+	}
+}
+
+// copyHeader matches the COPY statement pg_dump writes before the rows of a table, after the
+// schema of the table.
+var copyHeader = regexp.MustCompile(`^("?[a-z_]+"?) \((.*)\) FROM stdin;$`)
+
+// dumpTable is the COPY block of one table in a plain-format dump.
+type dumpTable struct {
+	name    string
+	columns map[string]int
+}
+
+func parseCopyHeader(schema dbSchema, line string) *dumpTable {
+	rest, ok := strings.CutPrefix(line, "COPY "+schema.prefix())
+	if !ok {
+		return nil
+	}
+	match := copyHeader.FindStringSubmatch(rest)
+	if match == nil {
+		return nil
+	}
+	t := &dumpTable{name: strings.Trim(match[1], `"`), columns: make(map[string]int)}
+	for i, c := range strings.Split(match[2], ", ") {
+		t.columns[strings.Trim(c, `"`)] = i
+	}
+	return t
+}
+
+// column returns the position of name in the rows of t.
+func (t *dumpTable) column(name string) (int, error) {
+	i, ok := t.columns[name]
+	if !ok {
+		return 0, fmt.Errorf("COPY of %s has no column %s; is this a GUAC v0.8 database?", t.name, name)
+	}
+	return i, nil
+}
+
+// dumpRewrite is the dependency ID rewrite of a dump, computed from its package_versions and
+// dependencies rows.
+type dumpRewrite struct {
+	scheme *keys.Scheme
+	// schema is the schema of the tables in the COPY statements.
+	schema dbSchema
+	// versions maps a package name ID and version to the package version, as the backfill
+	// resolves dependent_package_version_id.
+	versions map[packageVersionKey]uuid.UUID
+	deps     []dumpDependency
+	// byOldID maps the current ID of a dependency to its position in deps.
+	byOldID map[uuid.UUID]int
+
+	// sboms are the bill_of_materials rows of the dump, sbomByOldID maps the current ID of an
+	// SBOM to its position in sboms and sbomDependencies to the dependencies it includes.
+	sboms            []dumpSBOM
+	sbomByOldID      map[uuid.UUID]int
+	sbomDependencies map[uuid.UUID][]uuid.UUID
+
+	unresolved int64
+	changed    int64
+	references int64
+	movedSBOMs int64
+}
+
+// dumpSBOM is a bill_of_materials row of the dump.
+type dumpSBOM struct {
+	idChange
+	bom keys.BillOfMaterials
+}
+
+type packageVersionKey struct {
+	nameID  uuid.UUID
+	version string
+}
+
+// dumpDependency is a dependencies row of the dump. nameID and versionRange are only kept
+// while the row still needs backfilling.
+type dumpDependency struct {
+	dependency
+	nameID       uuid.UUID
+	versionRange string
+	needsVersion bool
+}
+
+// rewriteDumpFile migrates a plain-format pg_dump of a GUAC v0.8 database, without a database.
+// The dump is read twice: first to compute the new ID of every dependency, since pg_dump does
+// not write the tables in an order that would allow a single pass, then to write the copy.
+func rewriteDumpFile(in, out string, scheme *keys.Scheme, schema dbSchema, w io.Writer) error {
+	r := &dumpRewrite{scheme: scheme, schema: schema, versions: make(map[packageVersionKey]uuid.UUID), byOldID: make(map[uuid.UUID]int),
+		sbomByOldID: make(map[uuid.UUID]int), sbomDependencies: make(map[uuid.UUID][]uuid.UUID)}
+	f, err := os.Open(in)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if err := r.read(f); err != nil {
+		return fmt.Errorf("%s: %w", in, err)
+	}
+	if err := r.resolve(); err != nil {
+		return err
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(out), "."+filepath.Base(out)+".*")
+	if err != nil {
+		return fmt.Errorf("failed to create the migrated dump: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+	if err := tmp.Chmod(0o644); err != nil {
+		return fmt.Errorf("failed to create the migrated dump: %w", err)
+	}
+	bw := bufio.NewWriterSize(tmp, 1<<20)
+	if err := r.write(f, bw); err != nil {
+		return fmt.Errorf("%s: %w", in, err)
+	}
+	err = bw.Flush()
+	if err == nil {
+		err = tmp.Close()
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), out)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to write the migrated dump: %w", err)
+	}
+	fmt.Fprintf(w, "Rewrote %d of %d dependency IDs with the %s ID scheme and %d SBOM references, and moved %d SBOMs; restore %s with psql.\n",
+		r.changed, len(r.deps), scheme.Name, r.references, r.movedSBOMs, out)
+	return nil
+}
+
+// eachCopyRow calls row with the table and fields of every COPY row of the dump and other with
+// every other line, including the COPY headers and terminators. Lines keep their newline.
+func eachCopyRow(schema dbSchema, in io.Reader, row func(t *dumpTable, line string, fields []string) error, other func(line string) error) error {
+	br := bufio.NewReaderSize(in, 1<<20)
+	magic, _ := br.Peek(5)
+	if bytes.Equal(magic, []byte("PGDMP")) {
+		return fmt.Errorf("this is a custom-format dump; convert it with pg_restore -f plain.sql first, or take it with pg_dump --format=plain")
+	}
+	var table *dumpTable
+	for n := 1; ; n++ {
+		line, err := br.ReadString('\n')
+		if err == io.EOF && line == "" {
+			if table != nil {
+				return fmt.Errorf("COPY of %s is not terminated", table.name)
+			}
+			return nil
+		}
+		if err != nil && err != io.EOF {
+			return err
+		}
+		text := strings.TrimSuffix(line, "\n")
+		switch {
+		case table != nil && text == `\.`:
+			table = nil
+		case table != nil:
+			if err := row(table, line, strings.Split(text, "\t")); err != nil {
+				return fmt.Errorf("line %d: %w", n, err)
+			}
+			continue
+		case strings.HasPrefix(text, "COPY "):
+			table = parseCopyHeader(schema, text)
+			if table == nil {
+				table = &dumpTable{}
+			}
+		case strings.HasPrefix(text, "INSERT INTO "+schema.prefix()+"dependencies ") || strings.HasPrefix(text, "INSERT INTO "+schema.prefix()+"bill_of_materials_included_dependencies "):
+			return fmt.Errorf("line %d: the dump has INSERT statements; take it without --inserts so the rows are COPY data", n)
+		}
+		if err := other(line); err != nil {
+			return err
+		}
+	}
+}
+
+// read collects the package versions, dependencies and SBOMs of the dump.
+func (r *dumpRewrite) read(in io.Reader) error {
+	return eachCopyRow(r.schema, in, func(t *dumpTable, _ string, fields []string) error {
+		switch t.name {
+		case "package_versions":
+			return r.readPackageVersion(t, fields)
+		case "dependencies":
+			return r.readDependency(t, fields)
+		case "bill_of_materials":
+			return r.readSBOM(t, fields)
+		case "bill_of_materials_included_dependencies":
+			return r.readInclusion(t, fields)
+		}
+		return nil
+	}, func(string) error { return nil })
+}
+
+func (r *dumpRewrite) readPackageVersion(t *dumpTable, fields []string) error {
+	values, err := copyFields(t, fields, "id", "name_id", "version")
+	if err != nil {
+		return err
+	}
+	id, err := uuid.Parse(values[0])
+	if err != nil {
+		return err
+	}
+	nameID, err := uuid.Parse(values[1])
+	if err != nil {
+		return err
+	}
+	// Several versions matching one name and version range resolve to the lowest ID, the
+	// choice --emit-sql makes too.
+	key := packageVersionKey{nameID: nameID, version: values[2]}
+	if existing, ok := r.versions[key]; !ok || bytes.Compare(id[:], existing[:]) < 0 {
+		r.versions[key] = id
+	}
+	return nil
+}
+
+func (r *dumpRewrite) readDependency(t *dumpTable, fields []string) error {
+	values, err := copyFields(t, fields, "id", "package_id", "dependent_package_name_id", "dependent_package_version_id",
+		"version_range", "dependency_type", "justification", "origin", "collector", "document_ref")
+	if err != nil {
+		return err
+	}
+	var d dumpDependency
+	if d.oldID, err = uuid.Parse(values[0]); err != nil {
+		return err
+	}
+	if d.PackageID, err = uuid.Parse(values[1]); err != nil {
+		return err
+	}
+	switch {
+	case values[3] != "":
+		if d.DependentPackageVersionID, err = uuid.Parse(values[3]); err != nil {
+			return err
+		}
+	case values[2] != "":
+		if d.nameID, err = uuid.Parse(values[2]); err != nil {
+			return err
+		}
+		d.versionRange = values[4]
+		d.needsVersion = true
+	default:
+		r.unresolved++
+	}
+	d.DependencyType, d.Justification, d.Origin, d.Collector, d.DocumentRef = values[5], values[6], values[7], values[8], values[9]
+	if _, ok := r.byOldID[d.oldID]; ok {
+		return fmt.Errorf("dependency %s appears twice", d.oldID)
+	}
+	r.byOldID[d.oldID] = len(r.deps)
+	r.deps = append(r.deps, d)
+	return nil
+}
+
+func (r *dumpRewrite) readSBOM(t *dumpTable, fields []string) error {
+	values, err := copyFields(t, fields, "id", "package_id", "artifact_id", "included_packages_hash", "included_artifacts_hash",
+		"included_dependencies_hash", "included_occurrences_hash", "uri", "algorithm", "digest", "download_location", "origin",
+		"collector", "known_since", "document_ref")
+	if err != nil {
+		return err
+	}
+	var s dumpSBOM
+	if s.oldID, err = uuid.Parse(values[0]); err != nil {
+		return err
+	}
+	subject := values[1]
+	if subject == "" {
+		subject = values[2]
+	}
+	if s.bom.SubjectID, err = uuid.Parse(subject); err != nil {
+		return fmt.Errorf("SBOM %s: %w", s.oldID, err)
+	}
+	b := &s.bom
+	b.IncludedPackagesHash, b.IncludedArtifactsHash, b.IncludedDependenciesHash, b.IncludedOccurrencesHash = values[3], values[4], values[5], values[6]
+	b.URI, b.Algorithm, b.Digest, b.DownloadLocation, b.Origin, b.Collector = values[7], values[8], values[9], values[10], values[11], values[12]
+	if b.KnownSince, err = parseDumpTime(values[13]); err != nil {
+		return fmt.Errorf("SBOM %s: %w", s.oldID, err)
+	}
+	b.DocumentRef = values[14]
+	if _, ok := r.sbomByOldID[s.oldID]; ok {
+		return fmt.Errorf("SBOM %s appears twice", s.oldID)
+	}
+	r.sbomByOldID[s.oldID] = len(r.sboms)
+	r.sboms = append(r.sboms, s)
+	return nil
+}
+
+func (r *dumpRewrite) readInclusion(t *dumpTable, fields []string) error {
+	values, err := copyFields(t, fields, "bill_of_materials_id", "dependency_id")
+	if err != nil {
+		return err
+	}
+	sbom, err := uuid.Parse(values[0])
+	if err != nil {
+		return err
+	}
+	dep, err := uuid.Parse(values[1])
+	if err != nil {
+		return err
+	}
+	r.sbomDependencies[sbom] = append(r.sbomDependencies[sbom], dep)
+	return nil
+}
+
+// parseDumpTime parses a timestamp with time zone as pg_dump writes it, in the ISO date style
+// with the offset of the session's time zone.
+func parseDumpTime(value string) (time.Time, error) {
+	for _, layout := range []string{"2006-01-02 15:04:05-07", "2006-01-02 15:04:05-07:00", "2006-01-02 15:04:05-07:00:00"} {
+		if t, err := time.Parse(layout, value); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("cannot parse known_since %q", value)
+}
+
+// resolve backfills the dependencies and computes their new IDs, failing like the migration
+// does on unresolved rows and collisions, then the new IDs of the SBOMs including them.
+func (r *dumpRewrite) resolve() error {
+	if len(r.deps) == 0 {
+		return fmt.Errorf("the dump has no dependencies data; is it a plain-format pg_dump of a GUAC database?")
+	}
+	for i := range r.deps {
+		d := &r.deps[i]
+		if d.needsVersion {
+			id, ok := r.versions[packageVersionKey{nameID: d.nameID, version: d.versionRange}]
+			if !ok || isVersionRange(d.versionRange) {
+				r.unresolved++
+				continue
+			}
+			d.DependentPackageVersionID = id
+		}
+	}
+	if r.unresolved > 0 {
+		return fmt.Errorf("%d dependencies have no package version matching their name and version range, or a range rather than a version; the migration cannot give them an ID", r.unresolved)
+	}
+	r.versions = nil
+
+	changes := make([]idChange, len(r.deps))
+	for i := range r.deps {
+		d := &r.deps[i]
+		d.newID = r.scheme.Key(d.Dependency)
+		if d.newID != d.oldID {
+			r.changed++
+		}
+		changes[i] = d.idChange
+	}
+	if collisions := findCollisions(changes); len(collisions) > 0 {
+		return fmt.Errorf("%d new IDs are shared by more than one dependency, for example %s by %s",
+			len(collisions), collisions[0].NewID, strings.Join(collisions[0].OldIDs, ", "))
+	}
+	return r.resolveSBOMs()
+}
+
+// resolveSBOMs gives every SBOM whose included_dependencies_hash no longer matches the new IDs
+// of its dependencies the hash and the ID GUAC derives for it, as fix-sbom-ids does. The dump
+// cannot merge two SBOMs that end up on the same ID, so it fails on them instead.
+func (r *dumpRewrite) resolveSBOMs() error {
+	changes := make([]idChange, len(r.sboms))
+	for i := range r.sboms {
+		s := &r.sboms[i]
+		s.newID = s.oldID
+		if deps := r.sbomDependencies[s.oldID]; len(deps) > 0 {
+			ids := make([]string, len(deps))
+			for j, dep := range deps {
+				if k, ok := r.byOldID[dep]; ok {
+					dep = r.deps[k].newID
+				}
+				ids[j] = dep.String()
+			}
+			if hash := keys.IncludedHash(dependencyIDs.table, ids); hash != s.bom.IncludedDependenciesHash {
+				s.bom.IncludedDependenciesHash = hash
+				s.newID = s.bom.Key()
+				r.movedSBOMs++
+			}
+		}
+		changes[i] = s.idChange
+	}
+	r.sbomDependencies = nil
+	if collisions := findCollisions(changes); len(collisions) > 0 {
+		return fmt.Errorf("%d new IDs are shared by more than one SBOM, for example %s by %s; migrate the restored database instead, which merges them",
+			len(collisions), collisions[0].NewID, strings.Join(collisions[0].OldIDs, ", "))
+	}
+	return nil
+}
+
+// write copies the dump to out with the dependencies rows backfilled and given their new IDs,
+// the SBOM rows pointing at them and the SBOMs including them moved to their new IDs.
+// Everything else, including the schema, is kept as is.
+func (r *dumpRewrite) write(in io.Reader, out *bufio.Writer) error {
+	return eachCopyRow(r.schema, in, func(t *dumpTable, line string, fields []string) error {
+		switch t.name {
+		case "dependencies":
+			return r.writeDependency(t, line, fields, out)
+		case "bill_of_materials":
+			return r.writeSBOM(t, line, fields, out)
+		}
+		for _, inc := range sbomIncludes {
+			if t.name == inc.table {
+				return r.writeInclusion(t, line, fields, out)
+			}
+		}
+		_, err := out.WriteString(line)
+		return err
+	}, func(line string) error {
+		_, err := out.WriteString(line)
+		return err
+	})
+}
+
+func (r *dumpRewrite) writeDependency(t *dumpTable, line string, fields []string, out *bufio.Writer) error {
+	id, _ := t.column("id")
+	version, _ := t.column("dependent_package_version_id")
+	d := r.deps[r.byOldID[uuid.MustParse(fields[id])]]
+	if d.oldID == d.newID && !d.needsVersion {
+		_, err := out.WriteString(line)
+		return err
+	}
+	fields[id] = d.newID.String()
+	fields[version] = d.DependentPackageVersionID.String()
+	_, err := out.WriteString(strings.Join(fields, "\t") + "\n")
+	return err
+}
+
+func (r *dumpRewrite) writeSBOM(t *dumpTable, line string, fields []string, out *bufio.Writer) error {
+	id, _ := t.column("id")
+	hash, _ := t.column("included_dependencies_hash")
+	s := r.sboms[r.sbomByOldID[uuid.MustParse(fields[id])]]
+	if s.oldID != s.newID {
+		fields[id] = s.newID.String()
+		fields[hash] = s.bom.IncludedDependenciesHash
+		line = strings.Join(fields, "\t") + "\n"
+	}
+	_, err := out.WriteString(line)
+	return err
+}
+
+// writeInclusion writes a row of one of the sbomIncludes tables pointing at the new ID of its
+// SBOM and, for bill_of_materials_included_dependencies, of its dependency.
+func (r *dumpRewrite) writeInclusion(t *dumpTable, line string, fields []string, out *bufio.Writer) error {
+	sbom, err := t.column("bill_of_materials_id")
+	if err != nil {
+		return err
+	}
+	oldSBOM, err := uuid.Parse(fields[sbom])
+	if err != nil {
+		return err
+	}
+	changed := false
+	if i, ok := r.sbomByOldID[oldSBOM]; ok && r.sboms[i].newID != oldSBOM {
+		fields[sbom] = r.sboms[i].newID.String()
+		changed = true
+	}
+	if t.name == "bill_of_materials_included_dependencies" {
+		col, err := t.column("dependency_id")
+		if err != nil {
+			return err
+		}
+		oldID, err := uuid.Parse(fields[col])
+		if err != nil {
+			return err
+		}
+		i, ok := r.byOldID[oldID]
+		if !ok {
+			return fmt.Errorf("bill_of_materials_included_dependencies references missing dependency %s", oldID)
+		}
+		if d := r.deps[i]; d.newID != d.oldID {
+			fields[col] = d.newID.String()
+			r.references++
+			changed = true
+		}
+	}
+	if changed {
+		line = strings.Join(fields, "\t") + "\n"
+	}
+	_, err = out.WriteString(line)
+	return err
+}
+
+// copyFields returns the decoded values of the named columns of a COPY row. NULL reads as "".
+func copyFields(t *dumpTable, fields []string, names ...string) ([]string, error) {
+	values := make([]string, len(names))
+	for i, name := range names {
+		col, err := t.column(name)
+		if err != nil {
+			return nil, err
+		}
+		if col >= len(fields) {
+			return nil, fmt.Errorf("COPY row of %s has %d columns, want %d", t.name, len(fields), len(t.columns))
+		}
+		if values[i], err = unescapeCopyText(fields[col]); err != nil {
+			return nil, fmt.Errorf("column %s: %w", name, err)
+		}
+	}
+	return values, nil
+}
+
+// unescapeCopyText decodes a field of COPY's text format.
+func unescapeCopyText(field string) (string, error) {
+	if field == `\N` {
+		return "", nil
+	}
+	if !strings.Contains(field, `\`) {
+		return field, nil
+	}
+	var b strings.Builder
+	for i := 0; i < len(field); i++ {
+		c := field[i]
+		if c != '\\' || i+1 == len(field) {
+			b.WriteByte(c)
+			continue
+		}
+		i++
+		switch c = field[i]; c {
+		case 'b':
+			b.WriteByte('\b')
+		case 'f':
+			b.WriteByte('\f')
+		case 'n':
+			b.WriteByte('\n')
+		case 'r':
+			b.WriteByte('\r')
+		case 't':
+			b.WriteByte('\t')
+		case 'v':
+			b.WriteByte('\v')
+		case 'x':
+			j := i + 1
+			for j < len(field) && j < i+3 && isHexDigit(field[j]) {
+				j++
+			}
+			if j == i+1 {
+				b.WriteByte('x')
+				continue
+			}
+			v, err := strconv.ParseUint(field[i+1:j], 16, 8)
+			if err != nil {
+				return "", err
+			}
+			b.WriteByte(byte(v))
+			i = j - 1
+		case '0', '1', '2', '3', '4', '5', '6', '7':
+			j := i
+			for j < len(field) && j < i+3 && field[j] >= '0' && field[j] <= '7' {
+				j++
+			}
+			v, err := strconv.ParseUint(field[i:j], 8, 16)
+			if err != nil {
+				return "", err
+			}
+			b.WriteByte(byte(v))
+			i = j - 1
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.String(), nil
+}
+
+func isHexDigit(c byte) bool {
+	return '0' <= c && c <= '9' || 'a' <= c && c <= 'f' || 'A' <= c && c <= 'F'
+}
@@ -0,0 +1,152 @@
+package migrate
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/pxp928/guac-update-db/pkg/keys"
+)
+
+// testDump is an excerpt of the plain-format pg_dump of the basic fixture, with the tables in
+// the order pg_dump writes them.
+const testDump = `--
+-- PostgreSQL database dump
+--
+
+COPY public.bill_of_materials (id, package_id, artifact_id, uri, algorithm, digest, download_location, origin, collector, document_ref, known_since, included_packages_hash, included_artifacts_hash, included_dependencies_hash, included_occurrences_hash) FROM stdin;
+60000000-0000-4000-8000-000000000001	40000000-0000-4000-8000-000000000001	\N	file:///sboms/requests.spdx.json	sha256	3f7d1c0e	https://example.com/requests.spdx.json	file:///sboms/requests.spdx.json	FileCollector		2024-03-15 07:30:12.345678+00	da39a3ee5e6b4b0d3255bfef95601890afd80709	da39a3ee5e6b4b0d3255bfef95601890afd80709	7a191708d16038aa6d0db8218b9ccd2e7eb23250	da39a3ee5e6b4b0d3255bfef95601890afd80709
+\.
+
+
+COPY public.bill_of_materials_included_dependencies (bill_of_materials_id, dependency_id) FROM stdin;
+60000000-0000-4000-8000-000000000001	50000000-0000-4000-8000-000000000001
+60000000-0000-4000-8000-000000000002	50000000-0000-4000-8000-000000000006
+\.
+
+
+COPY public.bill_of_materials_included_software_packages (bill_of_materials_id, package_version_id) FROM stdin;
+60000000-0000-4000-8000-000000000001	40000000-0000-4000-8000-000000000003
+\.
+
+
+COPY public.dependencies (id, package_id, dependent_package_name_id, dependent_package_version_id, version_range, dependency_type, justification, origin, collector, document_ref) FROM stdin;
+50000000-0000-4000-8000-000000000001	40000000-0000-4000-8000-000000000001	30000000-0000-4000-8000-000000000002	\N	1.26.18	DIRECT	dependency data collected via deps.dev	deps.dev	deps.dev	
+50000000-0000-4000-8000-000000000006	40000000-0000-4000-8000-000000000006	\N	40000000-0000-4000-8000-000000000008		DIRECT	top-level package\theuristic	file:///sboms/express.spdx.json	FileCollector	SPDXRef-Package-debug
+\.
+
+
+COPY public.package_versions (id, name_id, version, hash) FROM stdin;
+40000000-0000-4000-8000-000000000001	30000000-0000-4000-8000-000000000001	2.31.0	b6aa5f1c0a2fbcfc4fb08c6fa1ad4bf3
+40000000-0000-4000-8000-000000000003	30000000-0000-4000-8000-000000000002	1.26.18	5b0c38a1bd1e1c8a3089ae0c0f4e1cb3
+40000000-0000-4000-8000-000000000008	30000000-0000-4000-8000-000000000006	2.6.9	e3fb1a8848ecb1dd4db84a8045bf3a0f
+\.
+
+
+ALTER TABLE ONLY public.bill_of_materials_included_dependencies
+    ADD CONSTRAINT bill_of_materials_included_dependencies_dependency_id FOREIGN KEY (dependency_id) REFERENCES public.dependencies(id) ON DELETE CASCADE;
+`
+
+func TestRewriteDump(t *testing.T) {
+	dir := t.TempDir()
+	in, out := filepath.Join(dir, "dump.sql"), filepath.Join(dir, "migrated.sql")
+	if err := os.WriteFile(in, []byte(testDump), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := rewriteDumpFile(in, out, keys.DefaultScheme, "", io.Discard); err != nil {
+		t.Fatalf("rewriteDumpFile() failed: %v", err)
+	}
+	data, err := os.ReadFile(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := string(data)
+
+	backfilled := keys.DefaultScheme.Key(keys.Dependency{
+		PackageID:                 uuid.MustParse("40000000-0000-4000-8000-000000000001"),
+		DependentPackageVersionID: uuid.MustParse("40000000-0000-4000-8000-000000000003"),
+		DependencyType:            "DIRECT",
+		Justification:             "dependency data collected via deps.dev",
+		Origin:                    "deps.dev",
+		Collector:                 "deps.dev",
+	})
+	versioned := keys.DefaultScheme.Key(keys.Dependency{
+		PackageID:                 uuid.MustParse("40000000-0000-4000-8000-000000000006"),
+		DependentPackageVersionID: uuid.MustParse("40000000-0000-4000-8000-000000000008"),
+		DependencyType:            "DIRECT",
+		Justification:             "top-level package\theuristic",
+		Origin:                    "file:///sboms/express.spdx.json",
+		Collector:                 "FileCollector",
+		DocumentRef:               "SPDXRef-Package-debug",
+	})
+	sbom := keys.BillOfMaterials{
+		SubjectID:                uuid.MustParse("40000000-0000-4000-8000-000000000001"),
+		IncludedPackagesHash:     keys.NoneIncluded,
+		IncludedArtifactsHash:    keys.NoneIncluded,
+		IncludedDependenciesHash: keys.IncludedHash("dependencies", []string{backfilled.String()}),
+		IncludedOccurrencesHash:  keys.NoneIncluded,
+		URI:                      "file:///sboms/requests.spdx.json",
+		Algorithm:                "sha256",
+		Digest:                   "3f7d1c0e",
+		DownloadLocation:         "https://example.com/requests.spdx.json",
+		Origin:                   "file:///sboms/requests.spdx.json",
+		Collector:                "FileCollector",
+		KnownSince:               time.Date(2024, 3, 15, 7, 30, 12, 345678000, time.UTC),
+	}
+	moved := sbom.Key().String()
+	for _, want := range []string{
+		moved + "\t40000000-0000-4000-8000-000000000001\t\\N\tfile:///sboms/requests.spdx.json\t",
+		"\t" + sbom.IncludedDependenciesHash + "\t",
+		moved + "\t" + backfilled.String() + "\n",
+		moved + "\t40000000-0000-4000-8000-000000000003\n",
+		backfilled.String() + "\t40000000-0000-4000-8000-000000000001\t30000000-0000-4000-8000-000000000002\t40000000-0000-4000-8000-000000000003\t1.26.18\t",
+		versioned.String() + "\t40000000-0000-4000-8000-000000000006\t\\N\t40000000-0000-4000-8000-000000000008\t\tDIRECT\ttop-level package\\theuristic\t",
+		"60000000-0000-4000-8000-000000000002\t" + versioned.String() + "\n",
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("migrated dump does not contain %q", want)
+		}
+	}
+	if strings.Contains(got, "50000000-0000-4000-8000-00000000000") {
+		t.Errorf("migrated dump still references old dependency IDs")
+	}
+	if strings.Contains(got, "60000000-0000-4000-8000-000000000001") {
+		t.Errorf("migrated dump still has the old ID of the SBOM whose dependencies moved")
+	}
+	if !strings.HasSuffix(got, "REFERENCES public.dependencies(id) ON DELETE CASCADE;\n") {
+		t.Errorf("migrated dump does not keep the statements after the data")
+	}
+}
+
+func TestRewriteDumpUnresolved(t *testing.T) {
+	dir := t.TempDir()
+	in := filepath.Join(dir, "dump.sql")
+	dump := strings.Replace(testDump, "30000000-0000-4000-8000-000000000002\t1.26.18", "30000000-0000-4000-8000-000000000002\t1.26.19", 1)
+	if err := os.WriteFile(in, []byte(dump), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	err := rewriteDumpFile(in, filepath.Join(dir, "migrated.sql"), keys.DefaultScheme, "", io.Discard)
+	if err == nil || !strings.Contains(err.Error(), "1 dependencies have no package version") {
+		t.Fatalf("rewriteDumpFile() = %v, want an error about the unresolved dependency", err)
+	}
+}
+
+func TestUnescapeCopyText(t *testing.T) {
+	for field, want := range map[string]string{
+		`plain`:      "plain",
+		`\N`:         "",
+		`a\tb\nc`:    "a\tb\nc",
+		`back\\hash`: `back\hash`,
+		`\101\x42`:   "AB",
+		`\.`:         ".",
+	} {
+		got, err := unescapeCopyText(field)
+		if err != nil || got != want {
+			t.Errorf("unescapeCopyText(%q) = %q, %v, want %q", field, got, err, want)
+		}
+	}
+}
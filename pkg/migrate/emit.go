@@ -0,0 +1,317 @@
+package migrate
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+)
+
+// plannedDependency is a dependency as the migration will leave it, computed for --emit-sql
+// without changing the database. backfill is set when the backfill step fills in its
+// dependent_package_version_id.
+type plannedDependency struct {
+	dependency
+	backfill bool
+}
+
+// emitScript writes every statement the run would execute to a psql script at path instead of
+// executing it. The per-row values are read from the database now, so the script is only valid
+// as long as nothing else writes to the tables before it is applied.
+func (m *migration) emitScript(ctx context.Context, migrations []dataMigration, path, database string) error {
+	plan, post, err := m.plan(migrations)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*")
+	if err != nil {
+		return fmt.Errorf("failed to create the SQL script: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+	if err := tmp.Chmod(0o644); err != nil {
+		return fmt.Errorf("failed to create the SQL script: %w", err)
+	}
+	w := bufio.NewWriter(tmp)
+
+	fmt.Fprintf(w, "-- Generated by guac-update-db --emit-sql for database %q at %s.\n", database, time.Now().UTC().Format(time.RFC3339))
+	fmt.Fprintf(w, "-- Dependency IDs are composed with the %s ID scheme.\n", m.scheme.Name)
+	fmt.Fprintf(w, "-- The row values below were read when the script was generated: keep GUAC ingestion stopped\n")
+	fmt.Fprintf(w, "-- until it has been applied, with: psql -f %s\n", filepath.Base(path))
+	fmt.Fprintf(w, "-- Every backfill chunk checks that its rows are unchanged and stops the script if they are not.\n")
+	fmt.Fprintf(w, "\\set ON_ERROR_STOP on\n\n")
+	if m.schema.name() != "public" {
+		// The foreign keys below name their tables as the search path of the run did.
+		fmt.Fprintf(w, "SET search_path TO %s, public;\n\n", quoteIdentifier(m.schema.name()))
+	}
+	lock := m.takesLock() && !m.poolerCompat
+	if lock {
+		fmt.Fprintf(w, "-- The lock guac-update-db holds while it migrates, so the two cannot run at once.\nSELECT pg_advisory_lock(%d);\n\n", migrationLockKey)
+	}
+
+	if m.auditID != "" {
+		fmt.Fprintf(w, "-- Every changed ID is recorded in %s with migration_id %s.\n%s;\n\n", auditTable, m.auditID, createAuditTableSQL(m.schema))
+	}
+
+	emitSteps := func(steps []step) error {
+		for _, s := range steps {
+			if !m.steps.selected(s.name) {
+				continue
+			}
+			fmt.Fprintf(w, "-- Step %s\n", s.name)
+			if s.emit == nil {
+				fmt.Fprintf(w, "-- (changes nothing in the database and is not part of the script)\n\n")
+				continue
+			}
+			for _, stmt := range m.timeouts.statements(s.name) {
+				fmt.Fprintf(w, "%s;\n", stmt)
+			}
+			if err := s.emit(ctx, w); err != nil {
+				return fmt.Errorf("%s: %w", s.name, err)
+			}
+			fmt.Fprintln(w)
+		}
+		return nil
+	}
+	for i, dm := range migrations {
+		fmt.Fprintf(w, "-- Data migration %s (%s -> %s)\n\n", dm.Name, dm.From, dm.To)
+		m.report.Migrations = append(m.report.Migrations, dm.Name)
+		if err := emitSteps(plan[i]); err != nil {
+			return fmt.Errorf("%s: %w", dm.Name, err)
+		}
+	}
+	if err := emitSteps(post); err != nil {
+		return err
+	}
+	if lock {
+		fmt.Fprintf(w, "SELECT pg_advisory_unlock(%d);\n", migrationLockKey)
+	}
+
+	err = w.Flush()
+	if err == nil {
+		err = tmp.Close()
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to write the SQL script: %w", err)
+	}
+	m.logger.Printf("Wrote the statements of the migration to %s; nothing was changed\n", path)
+	return nil
+}
+
+// emitStatement returns an emit function writing a fixed statement.
+func emitStatement(sql string) func(ctx context.Context, w io.Writer) error {
+	return func(_ context.Context, w io.Writer) error {
+		_, err := fmt.Fprintf(w, "%s;\n", strings.TrimSuffix(sql, ";"))
+		return err
+	}
+}
+
+// plannedDependencies reads every dependency, resolves the version the backfill would give it
+// and computes its new ID, failing like rewrite-ids would on unresolved rows and collisions.
+// The result is computed once per run.
+func (m *migration) plannedDependencies(ctx context.Context) ([]plannedDependency, error) {
+	if m.planned != nil {
+		return m.planned, nil
+	}
+	if err := m.waitForReplica(ctx, "emit-sql"); err != nil {
+		return nil, err
+	}
+	if err := m.checkVersionRanges(ctx); err != nil {
+		return nil, err
+	}
+	var planned []plannedDependency
+	var chunks []chunkChecksum
+	var unresolved int64
+	err := m.retryAnalysis(ctx, "emit-sql", func(conn *pgx.Conn) error {
+		planned, chunks, unresolved = planned[:0], chunks[:0], 0
+		// The rows and their checksums are read from the same snapshot, so a change made while
+		// the script is written is caught when it is applied too.
+		tx, err := conn.BeginTx(ctx, pgx.TxOptions{IsoLevel: pgx.RepeatableRead, AccessMode: pgx.ReadOnly})
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback(ctx)
+		// A name and version range matching several package versions is resolved to the
+		// first of them; the backfill's UPDATE ... FROM picks an arbitrary one.
+		rows, err := tx.Query(ctx, `
+			SELECT DISTINCT ON (d.id) d.id, d.package_id, coalesce(d.dependent_package_version_id, pv.id),
+			       d.dependent_package_version_id IS NULL AND pv.id IS NOT NULL,
+			       d.dependency_type, d.justification, d.origin, d.collector, d.document_ref
+			FROM `+m.schema.prefix()+`dependencies d
+			LEFT JOIN `+m.schema.prefix()+`package_versions pv
+			  ON d.dependent_package_version_id IS NULL
+			 AND d.dependent_package_name_id IS NOT NULL
+			 AND pv.name_id = d.dependent_package_name_id
+			 AND `+m.versionMatchSQL("d", "pv")+`
+			ORDER BY d.id, pv.id
+		`)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var p plannedDependency
+			var versionID uuid.NullUUID
+			err := rows.Scan(&p.oldID, &p.PackageID, &versionID, &p.backfill, &p.DependencyType, &p.Justification, &p.Origin, &p.Collector, &p.DocumentRef)
+			if err != nil {
+				return fmt.Errorf("failed to scan row: %w", err)
+			}
+			if !versionID.Valid {
+				unresolved++
+				continue
+			}
+			p.DependentPackageVersionID = versionID.UUID
+			p.newID = m.scheme.Key(p.Dependency)
+			planned = append(planned, p)
+		}
+		if err := rows.Err(); err != nil {
+			return err
+		}
+		chunks, err = dependencyChunkChecksums(ctx, tx, m.schema, m.chunkSize)
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to query dependencies: %w", err)
+	}
+	m.report.UnresolvedRows = unresolved
+	if unresolved > 0 {
+		return nil, fmt.Errorf("%d dependencies cannot be backfilled and would stop the migration at rewrite-ids; resolve them before generating the script", unresolved)
+	}
+
+	changes := make([]idChange, len(planned))
+	for i, p := range planned {
+		changes[i] = p.idChange
+	}
+	merges, collisions := splitMergeable(findCollisions(changes))
+	if len(collisions) > 0 {
+		m.collisionsFound("dependencies", collisions)
+		return nil, fmt.Errorf("%d new IDs are shared by more than one existing dependency row", len(collisions))
+	}
+	if len(merges) > 0 {
+		return nil, fmt.Errorf("%d dependency rows already have the new ID of other rows; run the migration to merge them before generating the script", len(merges))
+	}
+	m.planned, m.plannedChunks = planned, chunks
+	return planned, nil
+}
+
+// plannedDependencyChanges are the changes of dependencyIDs, with the versions the backfill
+// fills in.
+func (m *migration) plannedDependencyChanges(ctx context.Context) ([]idChange, error) {
+	planned, err := m.plannedDependencies(ctx)
+	if err != nil {
+		return nil, err
+	}
+	changes := make([]idChange, len(planned))
+	for i, p := range planned {
+		changes[i] = p.idChange
+	}
+	return changes, nil
+}
+
+// emitBackfill writes the backfill as one UPDATE per row, committed every --chunk-size rows as
+// the step commits its chunks. Each chunk first checks the checksum of its rows, so a chunk
+// ingestion changed after the script was written is rolled back and stops the script.
+func (m *migration) emitBackfill(ctx context.Context, w io.Writer) error {
+	planned, err := m.plannedDependencies(ctx)
+	if err != nil {
+		return err
+	}
+	i := 0
+	for _, c := range m.plannedChunks {
+		fmt.Fprintf(w, "BEGIN;\n%s", c.checkSQL(m.schema))
+		for ; i < len(planned) && c.contains(planned[i].oldID); i++ {
+			p := planned[i]
+			if !p.backfill {
+				continue
+			}
+			update := fmt.Sprintf("UPDATE %sdependencies SET dependent_package_version_id = '%s' WHERE id = '%s' AND dependent_package_version_id IS NULL", m.schema.prefix(), p.DependentPackageVersionID, p.oldID)
+			fmt.Fprintf(w, "%s;\n", m.audited(update, "id AS row_id, NULL::uuid AS old_id, dependent_package_version_id AS new_id", "dependencies", "dependent_package_version_id"))
+		}
+		fmt.Fprintf(w, "COMMIT;\n")
+	}
+	return nil
+}
+
+// emitStageIDs writes the staging table of r and its rows as a COPY from the script itself.
+func (m *migration) emitStageIDs(ctx context.Context, w io.Writer, r *idRewrite) error {
+	changes, err := m.plannedChanges(ctx, r)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(w, "BEGIN;\n%s;\n", r.createStagingSQL(m.schema, m.speedups))
+	fmt.Fprintf(w, "COPY %s (old_id, new_id) FROM stdin;\n", m.schema.prefix()+r.stagingTable)
+	for _, c := range changes {
+		if c.oldID != c.newID {
+			fmt.Fprintf(w, "%s\t%s\n", c.oldID, c.newID)
+		}
+	}
+	fmt.Fprintf(w, "\\.\n%s;\nCOMMIT;\n", r.analyzeStagingSQL(m.schema))
+	return nil
+}
+
+// emitVerify writes the checks of the verify step as a block that fails the script.
+func (m *migration) emitVerify(_ context.Context, w io.Writer) error {
+	_, err := fmt.Fprintf(w, `DO $$
+BEGIN
+  IF EXISTS (SELECT 1 FROM %[1]sdependencies d WHERE d.dependent_package_version_id IS NULL OR d.id <> %[2]s) THEN
+    RAISE EXCEPTION 'dependencies rows do not have the IDs GUAC computes for them';
+  END IF;
+  IF EXISTS (SELECT 1 FROM %[1]sbill_of_materials_included_dependencies b
+             WHERE NOT EXISTS (SELECT 1 FROM %[1]sdependencies d WHERE d.id = b.dependency_id)) THEN
+    RAISE EXCEPTION 'bill_of_materials_included_dependencies rows reference missing dependencies';
+  END IF;
+END
+$$;
+`, m.schema.prefix(), m.scheme.KeySQL("d"))
+	return err
+}
+
+// emitDropIndexes writes a DROP INDEX for every secondary index of the rewritten tables. The
+// definitions are kept for emitRebuildIndexes rather than saved in the database as
+// drop-indexes does, since the script itself records them.
+func (m *migration) emitDropIndexes(ctx context.Context, w io.Writer) error {
+	err := m.retry(ctx, "drop-indexes", func(conn *pgx.Conn) error {
+		var err error
+		m.emittedIndexes, err = secondaryIndexes(ctx, conn, m.schema)
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("failed to read the indexes: %w", err)
+	}
+	fmt.Fprintf(w, "BEGIN;\n")
+	for _, ix := range m.emittedIndexes {
+		fmt.Fprintf(w, "DROP INDEX %s;\n", m.schema.prefix()+pgx.Identifier{ix.name}.Sanitize())
+	}
+	fmt.Fprintf(w, "COMMIT;\n")
+	return nil
+}
+
+// emitRebuildIndexes writes a concurrent build of every index emitDropIndexes dropped.
+func (m *migration) emitRebuildIndexes(_ context.Context, w io.Writer) error {
+	for _, ix := range m.emittedIndexes {
+		create, err := concurrentIndexDefinition(ix.definition)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(w, "%s;\n", create)
+	}
+	return nil
+}
+
+func (m *migration) emitPostMaintenance(_ context.Context, w io.Writer) error {
+	for _, table := range rewrittenTables {
+		fmt.Fprintf(w, "%s %s;\n", m.maintenanceCommand(), pgx.Identifier{m.schema.name(), table}.Sanitize())
+	}
+	return nil
+}
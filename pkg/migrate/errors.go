@@ -0,0 +1,28 @@
+package migrate
+
+import "errors"
+
+var (
+	// ErrSchemaMismatch is returned when the schema of the database is not one of a GUAC
+	// release the migration knows.
+	ErrSchemaMismatch = errors.New("failed to detect the GUAC version of the database")
+	// ErrVerificationFailed is returned when the verify step finds wrong IDs or dangling
+	// references.
+	ErrVerificationFailed = errors.New("verification failed")
+	// ErrDeadlineReached is returned when the run stopped at --deadline or --max-runtime, or a
+	// step at its --step-timeout, after saving its state for the next run to resume from.
+	ErrDeadlineReached = errors.New("deadline reached")
+	// ErrIncompatibleGUAC is returned when a data migration does not apply to the GUAC version
+	// --guac-version or --guac-endpoint says is installed.
+	ErrIncompatibleGUAC = errors.New("incompatible GUAC version")
+)
+
+// PartialError is a failure after the run had started rewriting the database, which leaves it
+// between versions until the migration is run again.
+type PartialError struct {
+	Err error
+}
+
+func (e *PartialError) Error() string { return e.Err.Error() }
+
+func (e *PartialError) Unwrap() error { return e.Err }
@@ -0,0 +1,362 @@
+package migrate
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"math"
+	"text/tabwriter"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+)
+
+// estimateStagingTable is the staging table of an --estimate run in --fast mode. It only ever
+// exists inside the estimate's transaction, and is named apart from dependencyIDStagingTable so
+// a staging table left by an earlier migration does not get in the way.
+const estimateStagingTable = "guac_update_db_estimate_staging"
+
+// Estimate is the projected cost of a data migration, measured on a sample of its rows.
+type Estimate struct {
+	Migration string  `json:"migration" yaml:"migration"`
+	Fraction  float64 `json:"fraction" yaml:"fraction"`
+	// Dependencies and SBOMDependencies are the approximate sizes of the rewritten tables.
+	Dependencies        int64 `json:"dependencies" yaml:"dependencies"`
+	SBOMDependencies    int64 `json:"sbom_dependencies" yaml:"sbom_dependencies"`
+	SampledDependencies int64 `json:"sampled_dependencies" yaml:"sampled_dependencies"`
+	// UnresolvedSampleRows are sampled dependencies the backfill could not resolve; the real
+	// run stops at rewrite-ids on such rows.
+	UnresolvedSampleRows int64           `json:"unresolved_sample_rows" yaml:"unresolved_sample_rows"`
+	Phases               []PhaseEstimate `json:"phases" yaml:"phases"`
+	ProjectedSeconds     float64         `json:"projected_seconds" yaml:"projected_seconds"`
+	ProjectedWALBytes    int64           `json:"projected_wal_bytes" yaml:"projected_wal_bytes"`
+}
+
+// PhaseEstimate is one step of a migration as measured on the sample and projected to the
+// full tables.
+type PhaseEstimate struct {
+	Name       string `json:"name" yaml:"name"`
+	SampleRows int64  `json:"sample_rows" yaml:"sample_rows"`
+	Batches    int    `json:"batches" yaml:"batches"`
+	// BatchSeconds is the mean latency of one batch of --chunk-size rows.
+	BatchSeconds      float64 `json:"batch_seconds" yaml:"batch_seconds"`
+	ProjectedSeconds  float64 `json:"projected_seconds" yaml:"projected_seconds"`
+	ProjectedWALBytes int64   `json:"projected_wal_bytes" yaml:"projected_wal_bytes"`
+}
+
+// runEstimate measures every data migration on a sample instead of running it and prints the
+// projections. Nothing is changed: each measurement runs in a transaction that is rolled back.
+func (m *migration) runEstimate(ctx context.Context, migrations []dataMigration, fraction float64, w io.Writer, database string) error {
+	m.currentStep = "estimate"
+	for _, dm := range migrations {
+		if dm.estimate == nil {
+			m.logger.Printf("Data migration %s cannot be estimated; skipping it\n", dm.Name)
+			continue
+		}
+		m.logger.Printf("Estimating data migration %s on a %.2g%% sample\n", dm.Name, fraction*100)
+		e, err := dm.estimate(m, ctx, fraction)
+		if err != nil {
+			return fmt.Errorf("%s: failed to estimate: %w", dm.Name, err)
+		}
+		e.Migration = dm.Name
+		m.report.Estimates = append(m.report.Estimates, e)
+		e.print(w, database)
+	}
+	return nil
+}
+
+// phaseMeasurer times the batches of one phase inside the estimate's transaction and reads the
+// WAL the phase generated.
+type phaseMeasurer struct {
+	tx pgx.Tx
+	// scale is the ratio of the full table size to the sample size.
+	scale float64
+}
+
+func (p *phaseMeasurer) measure(ctx context.Context, name string, batches [][]uuid.UUID, run func(i int, batch []uuid.UUID) error) (PhaseEstimate, error) {
+	var before string
+	if err := p.tx.QueryRow(ctx, `SELECT pg_current_wal_insert_lsn()::text`).Scan(&before); err != nil {
+		return PhaseEstimate{}, err
+	}
+	start := time.Now()
+	pe := PhaseEstimate{Name: name, Batches: len(batches)}
+	for i, batch := range batches {
+		if err := run(i, batch); err != nil {
+			return pe, fmt.Errorf("%s: %w", name, err)
+		}
+		pe.SampleRows += int64(len(batch))
+	}
+	elapsed := time.Since(start)
+
+	var wal int64
+	if err := p.tx.QueryRow(ctx, `SELECT pg_wal_lsn_diff(pg_current_wal_insert_lsn(), $1::pg_lsn)::bigint`, before).Scan(&wal); err != nil {
+		return pe, err
+	}
+	if len(batches) > 0 {
+		pe.BatchSeconds = elapsed.Seconds() / float64(len(batches))
+	}
+	pe.ProjectedSeconds = elapsed.Seconds() * p.scale
+	pe.ProjectedWALBytes = int64(float64(wal) * p.scale)
+	return pe, nil
+}
+
+// estimatePhase is a step measured batch by batch on the sample.
+type estimatePhase struct {
+	name string
+	run  func(i int, batch []uuid.UUID) error
+}
+
+// estimateDependencyVersionIDs runs the backfill, rewrite-ids, fix-refs, validate-constraints and
+// verify steps of the dependency-version-ids migration on a random sample of the dependencies,
+// in one transaction that is rolled back, and projects their duration and WAL volume to the
+// whole table. The transaction drops the foreign keys just as drop-constraints does, so until
+// it is rolled back the same locks are held.
+func (m *migration) estimateDependencyVersionIDs(ctx context.Context, fraction float64) (*Estimate, error) {
+	e := &Estimate{Fraction: fraction}
+	err := m.retry(ctx, "estimate", func(conn *pgx.Conn) error {
+		e.Phases = nil
+		e.UnresolvedSampleRows = 0
+		var err error
+		if e.Dependencies, err = estimatedRows(ctx, conn, m.schema.prefix()+"dependencies"); err != nil {
+			return err
+		}
+		if e.SBOMDependencies, err = estimatedRows(ctx, conn, m.schema.prefix()+"bill_of_materials_included_dependencies"); err != nil {
+			return err
+		}
+		if e.Dependencies == 0 || e.SBOMDependencies == 0 {
+			// Never analyzed: the planner knows nothing about the size yet.
+			err := conn.QueryRow(ctx, `
+			SELECT (SELECT count(*) FROM `+m.schema.prefix()+`dependencies), (SELECT count(*) FROM `+m.schema.prefix()+`bill_of_materials_included_dependencies)
+		`).Scan(&e.Dependencies, &e.SBOMDependencies)
+			if err != nil {
+				return err
+			}
+		}
+
+		tx, err := conn.Begin(ctx)
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback(ctx)
+
+		var sample []uuid.UUID
+		rows, err := tx.Query(ctx, `SELECT id FROM `+m.schema.prefix()+`dependencies TABLESAMPLE BERNOULLI ($1)`, fraction*100)
+		if err != nil {
+			return err
+		}
+		for rows.Next() {
+			var id uuid.UUID
+			if err := rows.Scan(&id); err != nil {
+				rows.Close()
+				return err
+			}
+			sample = append(sample, id)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+		e.SampledDependencies = int64(len(sample))
+		if len(sample) == 0 {
+			return fmt.Errorf("the %.2g%% sample of ~%d dependencies is empty; raise --estimate-fraction", fraction*100, e.Dependencies)
+		}
+
+		var batches [][]uuid.UUID
+		for start := 0; start < len(sample); start += m.chunkSize {
+			batches = append(batches, sample[start:min(start+m.chunkSize, len(sample))])
+		}
+		p := &phaseMeasurer{tx: tx, scale: float64(e.Dependencies) / float64(len(sample))}
+
+		fks, err := findForeignKeys(ctx, tx, m.schema, dependencyIDs)
+		if err != nil {
+			return fmt.Errorf("failed to read the foreign keys: %w", err)
+		}
+		for _, fk := range fks {
+			if _, err := tx.Exec(ctx, fk.dropSQL()); err != nil {
+				return fmt.Errorf("failed to drop foreign key constraint %s: %w", fk.name, err)
+			}
+		}
+
+		pe, err := p.measure(ctx, "backfill", batches, func(_ int, batch []uuid.UUID) error {
+			_, err := tx.Exec(ctx, `
+			UPDATE `+m.schema.prefix()+`dependencies d
+			SET dependent_package_version_id = pv.id
+			FROM `+m.schema.prefix()+`package_versions pv
+			WHERE d.id = ANY($1)
+			  AND d.dependent_package_name_id IS NOT NULL
+			  AND d.dependent_package_version_id IS NULL
+			  AND d.dependent_package_name_id = pv.name_id
+			  AND `+m.versionMatchSQL("d", "pv")+`
+		`, uuidStrings(batch))
+			return err
+		})
+		if err != nil {
+			return err
+		}
+		e.Phases = append(e.Phases, pe)
+
+		// mapping holds the new IDs of each batch, computed by rewrite-ids in the default mode
+		// and by stage-ids in --fast mode, as the real steps do.
+		mapping := make([][]dependency, len(batches))
+		computeBatch := func(i int, batch []uuid.UUID) error {
+			return scanDependencyIDs(ctx, tx, m.schema, batch, func(dep dependency, resolved bool) error {
+				if !resolved {
+					e.UnresolvedSampleRows++
+					return nil
+				}
+				dep.newID = m.scheme.Key(dep.Dependency)
+				mapping[i] = append(mapping[i], dep)
+				return nil
+			})
+		}
+
+		var phases []estimatePhase
+		add := func(name string, run func(i int, batch []uuid.UUID) error) {
+			phases = append(phases, estimatePhase{name: name, run: run})
+		}
+		if m.fast {
+			_, err := tx.Exec(ctx, `CREATE UNLOGGED TABLE `+m.schema.prefix()+estimateStagingTable+` (old_id uuid PRIMARY KEY, new_id uuid NOT NULL)`)
+			if err != nil {
+				return err
+			}
+			add("stage-ids", func(i int, batch []uuid.UUID) error {
+				if err := computeBatch(i, batch); err != nil {
+					return err
+				}
+				var rows [][]interface{}
+				for _, dep := range mapping[i] {
+					if dep.oldID != dep.newID {
+						rows = append(rows, []interface{}{dep.oldID, dep.newID})
+					}
+				}
+				_, err := tx.CopyFrom(ctx, pgx.Identifier{m.schema.name(), estimateStagingTable}, []string{"old_id", "new_id"}, pgx.CopyFromRows(rows))
+				return err
+			})
+			add("rewrite-ids", func(_ int, batch []uuid.UUID) error {
+				_, err := tx.Exec(ctx, `
+				UPDATE `+m.schema.prefix()+`dependencies d
+				SET id = s.new_id
+				FROM `+m.schema.prefix()+estimateStagingTable+` s
+				WHERE d.id = s.old_id AND s.old_id = ANY($1)
+			`, uuidStrings(batch))
+				return err
+			})
+			add("fix-refs", func(_ int, batch []uuid.UUID) error {
+				_, err := tx.Exec(ctx, `
+				UPDATE `+m.schema.prefix()+`bill_of_materials_included_dependencies b
+				SET dependency_id = s.new_id
+				FROM `+m.schema.prefix()+estimateStagingTable+` s
+				WHERE b.dependency_id = s.old_id AND s.old_id = ANY($1)
+			`, uuidStrings(batch))
+				return err
+			})
+		} else {
+			add("rewrite-ids", func(i int, batch []uuid.UUID) error {
+				if err := computeBatch(i, batch); err != nil {
+					return err
+				}
+				b := &pgx.Batch{}
+				for _, dep := range mapping[i] {
+					b.Queue("UPDATE "+m.schema.prefix()+"dependencies SET id = $1 WHERE id = $2", dep.newID, dep.oldID)
+				}
+				return sendBatch(ctx, tx, b)
+			})
+			add("fix-refs", func(i int, _ []uuid.UUID) error {
+				b := &pgx.Batch{}
+				for _, dep := range mapping[i] {
+					b.Queue("UPDATE "+m.schema.prefix()+"bill_of_materials_included_dependencies SET dependency_id = $1 WHERE dependency_id = $2", dep.newID, dep.oldID)
+				}
+				return sendBatch(ctx, tx, b)
+			})
+		}
+		for _, phase := range phases {
+			pe, err := p.measure(ctx, phase.name, batches, phase.run)
+			if err != nil {
+				return err
+			}
+			e.Phases = append(e.Phases, pe)
+		}
+
+		// validate-constraints checks every bill of materials row in one statement that writes
+		// no rows, so it is measured on a sample of that table instead.
+		start := time.Now()
+		var sampledRefs, missing int64
+		err = tx.QueryRow(ctx, `
+		SELECT count(*), count(*) FILTER (WHERE d.id IS NULL)
+		FROM `+m.schema.prefix()+`bill_of_materials_included_dependencies b TABLESAMPLE BERNOULLI ($1)
+		LEFT JOIN `+m.schema.prefix()+`dependencies d ON d.id = b.dependency_id
+	`, fraction*100).Scan(&sampledRefs, &missing)
+		if err != nil {
+			return fmt.Errorf("validate-constraints: %w", err)
+		}
+		pe = PhaseEstimate{Name: "validate-constraints", SampleRows: sampledRefs, Batches: 1, BatchSeconds: time.Since(start).Seconds()}
+		if sampledRefs > 0 {
+			pe.ProjectedSeconds = pe.BatchSeconds * float64(e.SBOMDependencies) / float64(sampledRefs)
+		}
+		e.Phases = append(e.Phases, pe)
+
+		// verify reads every dependency back and recomputes its ID; the sample now has its new IDs.
+		newIDs := make([][]uuid.UUID, len(mapping))
+		for i, deps := range mapping {
+			for _, dep := range deps {
+				newIDs[i] = append(newIDs[i], dep.newID)
+			}
+		}
+		pe, err = p.measure(ctx, "verify", newIDs, func(_ int, batch []uuid.UUID) error {
+			return scanDependencyIDs(ctx, tx, m.schema, batch, func(dep dependency, _ bool) error {
+				_ = m.scheme.Key(dep.Dependency)
+				return nil
+			})
+		})
+		if err != nil {
+			return err
+		}
+		e.Phases = append(e.Phases, pe)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	e.ProjectedSeconds, e.ProjectedWALBytes = 0, 0
+	for _, pe := range e.Phases {
+		e.ProjectedSeconds += pe.ProjectedSeconds
+		e.ProjectedWALBytes += pe.ProjectedWALBytes
+	}
+	return e, nil
+}
+
+func (e *Estimate) print(w io.Writer, database string) {
+	fmt.Fprintf(w, "Estimate for %s on database %q, from a %.2g%% sample of %d of ~%d dependencies (~%d SBOM references):\n",
+		e.Migration, database, e.Fraction*100, e.SampledDependencies, e.Dependencies, e.SBOMDependencies)
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintf(tw, "  step\tsampled rows\tbatches\tper batch\tprojected\tprojected WAL\t\n")
+	for _, pe := range e.Phases {
+		fmt.Fprintf(tw, "  %s\t%d\t%d\t%s\t%s\t%s\t\n", pe.Name, pe.SampleRows, pe.Batches,
+			seconds(pe.BatchSeconds).Round(time.Millisecond), seconds(pe.ProjectedSeconds).Round(time.Second), formatBytes(pe.ProjectedWALBytes))
+	}
+	fmt.Fprintf(tw, "  total\t\t\t\t%s\t%s\t\n", seconds(e.ProjectedSeconds).Round(time.Second), formatBytes(e.ProjectedWALBytes))
+	tw.Flush()
+	if e.UnresolvedSampleRows > 0 {
+		fmt.Fprintf(w, "Warning: %d sampled dependencies cannot be backfilled; the migration stops at rewrite-ids until they are fixed.\n", e.UnresolvedSampleRows)
+	}
+	fmt.Fprintf(w, "Not included: waiting for locks, post-maintenance, --rebuild-indexes and WAL archiving or replication lag. The WAL figures include whatever other sessions wrote during the measurement.\n")
+	fmt.Fprintf(w, "Nothing was changed: the sample was migrated in a transaction that was rolled back.\n")
+}
+
+func seconds(s float64) time.Duration {
+	return time.Duration(s * float64(time.Second))
+}
+
+// formatBytes formats n in binary units, e.g. 1.5 GiB.
+func formatBytes(n int64) string {
+	if n < 1024 {
+		return fmt.Sprintf("%d B", n)
+	}
+	exp := int(math.Log(float64(n)) / math.Log(1024))
+	if exp > 5 {
+		exp = 5
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/math.Pow(1024, float64(exp)), "KMGTP"[exp-1])
+}
@@ -0,0 +1,61 @@
+package migrate
+
+import (
+	"fmt"
+	"os"
+	"time"
+)
+
+// openEvents returns the observer writing the events of the run to --events-file, or one
+// ignoring them without it, and the function closing the file once the run is over.
+func openEvents(path string) (Observer, func(), error) {
+	if path == "" {
+		return NopObserver{}, func() {}, nil
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to open events file: %w", err)
+	}
+	return NewJSONLines(f), func() { f.Close() }, nil
+}
+
+// stepStarted tells the observer the step of the data migration called migration, the
+// m.migrationNumber-th of the run, is starting.
+func (m *migration) stepStarted(migration, step string) {
+	now := time.Now().UTC()
+	m.report.batches.started(migration, step, now)
+	m.observer.OnStepStart(StepStart{
+		Database: m.config.Database, Migration: migration, MigrationNumber: m.migrationNumber, Migrations: m.migrationCount,
+		Step: step, Time: now,
+	})
+}
+
+// batchCommitted records that step committed a batch of rows, in the metrics, the report and
+// for the observer.
+func (m *migration) batchCommitted(step string, rows int64) {
+	now := time.Now().UTC()
+	metrics.batchCommitted(m.target, step)
+	m.report.batches.committed(step, rows, now)
+	m.observer.OnBatchComplete(Batch{Database: m.config.Database, Step: step, Rows: rows, Time: now})
+}
+
+// collisionsFound records the new IDs of table shared by more than one row in the report and
+// tells the observer about each of them.
+func (m *migration) collisionsFound(table string, collisions []IDCollision) {
+	m.report.Collisions = collisions
+	for _, c := range collisions {
+		m.observer.OnCollision(Collision{Database: m.config.Database, Table: table, NewID: c.NewID, OldIDs: c.OldIDs})
+	}
+}
+
+// result is the outcome of the run for the observer.
+func (r *Report) result() Result {
+	return Result{
+		Database:        r.Database,
+		Success:         r.Success,
+		Outcome:         r.Outcome,
+		ExitCode:        r.ExitCode,
+		Error:           r.Error,
+		DurationSeconds: r.DurationSeconds,
+	}
+}
@@ -0,0 +1,49 @@
+package migrate
+
+import (
+	"errors"
+)
+
+// Exit codes of the migrate command, so wrapper scripts and Kubernetes Jobs can branch on the
+// outcome of a run instead of parsing its log. Invalid flags exit with 2, as the flag package
+// does.
+const (
+	exitFailure            = 1
+	exitUsage              = 2
+	exitSchemaMismatch     = 3
+	exitVerificationFailed = 5
+	exitTransient          = 6
+	exitPartial            = 7
+	exitDeadlineReached    = 8
+	exitIncompatibleGUAC   = 9
+)
+
+// errAlreadyMigrated is returned by migrateDatabase when the database needs none of the data
+// migrations. It is a success: the report says so and the run exits with 0, under an outcome of
+// its own.
+var errAlreadyMigrated = errors.New("the database is already migrated")
+
+// outcome classifies the result of a run for the report and the exit code.
+func outcome(err error) (string, int) {
+	var partial *PartialError
+	switch {
+	case err == nil:
+		return "success", 0
+	case errors.Is(err, errAlreadyMigrated):
+		return "already-migrated", 0
+	case errors.Is(err, ErrSchemaMismatch):
+		return "schema-mismatch", exitSchemaMismatch
+	case errors.Is(err, ErrIncompatibleGUAC):
+		return "incompatible-guac", exitIncompatibleGUAC
+	case errors.Is(err, ErrVerificationFailed):
+		return "verification-failed", exitVerificationFailed
+	case errors.Is(err, ErrDeadlineReached):
+		return "deadline-reached", exitDeadlineReached
+	case errors.As(err, &partial):
+		return "partial", exitPartial
+	case isTransient(err):
+		return "transient-error", exitTransient
+	default:
+		return "failed", exitFailure
+	}
+}
@@ -0,0 +1,36 @@
+package migrate
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+func TestOutcome(t *testing.T) {
+	lockTimeout := &pgconn.PgError{Code: "55P03"}
+	tests := []struct {
+		name string
+		err  error
+		want string
+		code int
+	}{
+		{"success", nil, "success", 0},
+		{"already migrated", errAlreadyMigrated, "already-migrated", 0},
+		{"deadline", &PartialError{Err: fmt.Errorf("rewrite-ids: %w", ErrDeadlineReached)}, "deadline-reached", exitDeadlineReached},
+		{"schema mismatch", fmt.Errorf("%w, pass --from: %w", ErrSchemaMismatch, errors.New("no tables")), "schema-mismatch", exitSchemaMismatch},
+		{"incompatible GUAC", fmt.Errorf("%w: GUAC v0.9.0 is installed", ErrIncompatibleGUAC), "incompatible-guac", exitIncompatibleGUAC},
+		{"verification", &PartialError{Err: fmt.Errorf("verify: %w: 1 ID mismatches", ErrVerificationFailed)}, "verification-failed", exitVerificationFailed},
+		{"partial", &PartialError{Err: fmt.Errorf("rewrite-ids: %w", lockTimeout)}, "partial", exitPartial},
+		{"transient", fmt.Errorf("backfill: %w", lockTimeout), "transient-error", exitTransient},
+		{"other", errNotConfirmed, "failed", exitFailure},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got, code := outcome(tt.err); got != tt.want || code != tt.code {
+				t.Errorf("outcome(%v) = %s, %d; want %s, %d", tt.err, got, code, tt.want, tt.code)
+			}
+		})
+	}
+}
@@ -0,0 +1,252 @@
+package migrate
+
+import (
+	"context"
+	"fmt"
+	"io"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// dependencyIDStagingTable holds the old to new dependency ID mapping in --fast mode. It is a
+// regular table rather than a temporary one so a retry on a new connection still sees it.
+const dependencyIDStagingTable = "guac_dependency_id_staging"
+
+func (r *idRewrite) createStagingSQL(schema dbSchema, u *unsafeSpeedups) string {
+	return `CREATE ` + u.stagingPersistence() + `TABLE ` + schema.prefix() + r.stagingTable + ` (old_id uuid PRIMARY KEY, new_id uuid NOT NULL)`
+}
+
+func (r *idRewrite) analyzeStagingSQL(schema dbSchema) string {
+	return `ANALYZE ` + schema.prefix() + r.stagingTable
+}
+
+func (r *idRewrite) dropStagingSQL(schema dbSchema) string {
+	return `DROP TABLE IF EXISTS ` + schema.prefix() + r.stagingTable
+}
+
+// stageIDs computes the new IDs and COPYs the rows whose ID changes into the staging table. The
+// table is created and loaded in one transaction, so a retried attempt starts over and a table
+// that exists is complete. One left by an earlier run is reused: after rewrite-ids the old IDs
+// can no longer be recomputed, and the table is the only record of them.
+func (m *migration) stageIDs(ctx context.Context, r *idRewrite) (int64, error) {
+	var existing int64 = -1
+	err := m.retry(ctx, "stage-ids", func(conn *pgx.Conn) error {
+		var exists bool
+		err := conn.QueryRow(ctx, `SELECT to_regclass($1) IS NOT NULL`, m.schema.prefix()+r.stagingTable).Scan(&exists)
+		if err != nil || !exists {
+			return err
+		}
+		return conn.QueryRow(ctx, `SELECT count(*) FROM `+m.schema.prefix()+r.stagingTable).Scan(&existing)
+	})
+	if err != nil {
+		return 0, fmt.Errorf("failed to look for the staging table: %w", err)
+	}
+	if existing >= 0 {
+		m.logger.Printf("stage-ids: reusing the %d staged IDs of an earlier run; drop %s to stage them again\n", existing, r.stagingTable)
+		return existing, nil
+	}
+
+	if err := m.computeNewIDs(ctx, "stage-ids", r); err != nil {
+		return 0, err
+	}
+	var staged int64
+	err = m.retry(ctx, "stage-ids", func(conn *pgx.Conn) error {
+		tx, err := conn.Begin(ctx)
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback(ctx)
+
+		_, err = tx.Exec(ctx, r.createStagingSQL(m.schema, m.speedups))
+		if err != nil {
+			return err
+		}
+		it, err := m.changes.iter()
+		if err != nil {
+			return err
+		}
+		defer it.close()
+		staged, err = tx.CopyFrom(ctx, pgx.Identifier{m.schema.name(), r.stagingTable}, []string{"old_id", "new_id"}, &stagedChanges{it: it})
+		if err != nil {
+			return err
+		}
+		// The planner has no statistics on a freshly loaded table; without them the join
+		// below may be planned as a nested loop over millions of rows.
+		if _, err := tx.Exec(ctx, r.analyzeStagingSQL(m.schema)); err != nil {
+			return err
+		}
+		return tx.Commit(ctx)
+	})
+	if err != nil {
+		return 0, fmt.Errorf("failed to stage new %s IDs: %w", r.singular, err)
+	}
+	m.batchCommitted("stage-ids", staged)
+	return staged, nil
+}
+
+// stagedChanges streams the changed IDs to COPY, so they are not all held as rows at once.
+type stagedChanges struct {
+	it  *changeIter
+	c   idChange
+	err error
+}
+
+func (s *stagedChanges) Next() bool {
+	for {
+		c, ok, err := s.it.next()
+		if err != nil || !ok {
+			s.err = err
+			return false
+		}
+		if c.oldID != c.newID {
+			s.c = c
+			return true
+		}
+	}
+}
+
+func (s *stagedChanges) Values() ([]interface{}, error) {
+	return []interface{}{s.c.oldID, s.c.newID}, nil
+}
+
+func (s *stagedChanges) Err() error {
+	return s.err
+}
+
+// rewriteStagedIDs moves every staged row to its new ID. Rows already moved no longer match an
+// old ID, so repeating the statement is harmless.
+func (m *migration) rewriteStagedIDs(ctx context.Context, r *idRewrite) (int64, error) {
+	if err := m.requireStaging(ctx, "rewrite-ids", r); err != nil {
+		return 0, err
+	}
+	var n int64
+	err := m.retry(ctx, "rewrite-ids", func(conn *pgx.Conn) error {
+		tag, err := conn.Exec(ctx, m.stagedRewriteSQL(r))
+		n = tag.RowsAffected()
+		return err
+	})
+	if err != nil {
+		return 0, fmt.Errorf("failed to update %s with new UUIDs: %w", r.table, err)
+	}
+	m.batchCommitted("rewrite-ids", n)
+	return n, nil
+}
+
+// updateStagedReferences repoints the rows of every referencer from staged old IDs to new ones.
+func (m *migration) updateStagedReferences(ctx context.Context, r *idRewrite) (int64, error) {
+	if err := m.requireStaging(ctx, "fix-refs", r); err != nil {
+		return 0, err
+	}
+	var n int64
+	for _, ref := range r.referencers {
+		err := m.retry(ctx, "fix-refs", func(conn *pgx.Conn) error {
+			tag, err := conn.Exec(ctx, m.stagedReferencesSQL(r, ref))
+			if err == nil {
+				n += tag.RowsAffected()
+			}
+			return err
+		})
+		if err != nil {
+			return 0, fmt.Errorf("failed to update %s with new UUIDs: %w", ref.table, err)
+		}
+	}
+	m.batchCommitted("fix-refs", n)
+	return n, nil
+}
+
+// rewriteStagedDeferred runs the set-based UPDATEs of rewrite-ids and fix-refs in one
+// transaction that defers the foreign keys to its commit.
+func (m *migration) rewriteStagedDeferred(ctx context.Context, r *idRewrite) (int64, error) {
+	if err := m.requireStaging(ctx, "rewrite-ids", r); err != nil {
+		return 0, err
+	}
+	var n int64
+	err := m.retry(ctx, "rewrite-ids", func(conn *pgx.Conn) error {
+		tx, err := conn.Begin(ctx)
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback(ctx)
+		if _, err := tx.Exec(ctx, deferConstraintsSQL); err != nil {
+			return err
+		}
+		tag, err := tx.Exec(ctx, m.stagedRewriteSQL(r))
+		if err != nil {
+			return err
+		}
+		n = tag.RowsAffected()
+		for _, ref := range r.referencers {
+			if _, err := tx.Exec(ctx, m.stagedReferencesSQL(r, ref)); err != nil {
+				return err
+			}
+		}
+		return tx.Commit(ctx)
+	})
+	if err != nil {
+		return 0, fmt.Errorf("failed to update %s and the related tables with new UUIDs: %w", r.table, err)
+	}
+	m.batchCommitted("rewrite-ids", n)
+	return n, nil
+}
+
+func (m *migration) stagedRewriteSQL(r *idRewrite) string {
+	return m.audited(`UPDATE `+m.schema.prefix()+r.table+` d
+SET id = s.new_id
+FROM `+m.schema.prefix()+r.stagingTable+` s
+WHERE d.id = s.old_id`, "s.old_id AS row_id, s.old_id AS old_id, s.new_id AS new_id", r.table, "id")
+}
+
+func (m *migration) stagedReferencesSQL(r *idRewrite, ref referencer) string {
+	return m.audited(`UPDATE `+m.schema.prefix()+ref.table+` b
+SET `+ref.column+` = s.new_id
+FROM `+m.schema.prefix()+r.stagingTable+` s
+WHERE b.`+ref.column+` = s.old_id`, "b."+ref.rowID+" AS row_id, s.old_id AS old_id, s.new_id AS new_id", ref.table, ref.column)
+}
+
+// emitStagedReferences writes the set-based UPDATE of every referencer of r.
+func (m *migration) emitStagedReferences(r *idRewrite) func(ctx context.Context, w io.Writer) error {
+	return m.emitPerReferencer(r, func(ref referencer) string { return m.stagedReferencesSQL(r, ref) })
+}
+
+// emitStagedDeferred writes the transaction of rewriteStagedDeferred.
+func (m *migration) emitStagedDeferred(r *idRewrite) func(ctx context.Context, w io.Writer) error {
+	return func(ctx context.Context, w io.Writer) error {
+		stmts := []string{"BEGIN", deferConstraintsSQL, m.stagedRewriteSQL(r)}
+		for _, ref := range r.referencers {
+			stmts = append(stmts, m.stagedReferencesSQL(r, ref))
+		}
+		for _, stmt := range append(stmts, "COMMIT") {
+			if err := emitStatement(stmt)(ctx, w); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+// requireStaging fails when the staging table does not exist, which happens when stage-ids was
+// skipped and never ran before, or drop-staging already removed it.
+func (m *migration) requireStaging(ctx context.Context, step string, r *idRewrite) error {
+	var exists bool
+	err := m.retry(ctx, step, func(conn *pgx.Conn) error {
+		return conn.QueryRow(ctx, `SELECT to_regclass($1) IS NOT NULL`, m.schema.prefix()+r.stagingTable).Scan(&exists)
+	})
+	if err != nil {
+		return fmt.Errorf("failed to look for the staging table: %w", err)
+	}
+	if !exists {
+		return fmt.Errorf("%s needs the staging table %s, which stage-ids creates", step, r.stagingTable)
+	}
+	return nil
+}
+
+func (m *migration) dropStaging(ctx context.Context, r *idRewrite) (int64, error) {
+	err := m.retry(ctx, "drop-staging", func(conn *pgx.Conn) error {
+		_, err := conn.Exec(ctx, r.dropStagingSQL(m.schema))
+		return err
+	})
+	if err != nil {
+		return 0, fmt.Errorf("failed to drop the staging table: %w", err)
+	}
+	return 0, nil
+}
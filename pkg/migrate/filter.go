@@ -0,0 +1,118 @@
+package migrate
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"strings"
+)
+
+// valueList is a flag.Value holding a comma-separated list of values.
+type valueList []string
+
+func (l *valueList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *valueList) Set(s string) error {
+	*l = (*l)[:0]
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			*l = append(*l, v)
+		}
+	}
+	return nil
+}
+
+// rowFilter restricts a run to the dependencies ingested from some collectors, origins or
+// documents, from --filter-collector, --filter-origin and --filter-document-ref. A row is
+// selected when it has one of the values of every flag that is set.
+type rowFilter struct {
+	collectors   valueList
+	origins      valueList
+	documentRefs valueList
+}
+
+func (f *rowFilter) register(fs *flag.FlagSet) {
+	fs.Var(&f.collectors, "filter-collector", "only migrate and verify the dependencies ingested by these comma-separated `collectors`")
+	fs.Var(&f.origins, "filter-origin", "only migrate and verify the dependencies with these comma-separated `origins`")
+	fs.Var(&f.documentRefs, "filter-document-ref", "only migrate and verify the dependencies ingested from these comma-separated `documents`, as their document_ref")
+}
+
+// filterColumn is a column of the dependencies and the values a rowFilter selects of it.
+type filterColumn struct {
+	name   string
+	values []string
+}
+
+func (f *rowFilter) columns() []filterColumn {
+	return []filterColumn{{"collector", f.collectors}, {"origin", f.origins}, {"document_ref", f.documentRefs}}
+}
+
+// empty reports whether f selects every row.
+func (f *rowFilter) empty() bool {
+	return f == nil || len(f.collectors)+len(f.origins)+len(f.documentRefs) == 0
+}
+
+// String describes f for the log and the report, such as collector=deps.dev origin=osv, and is
+// empty when f selects every row.
+func (f *rowFilter) String() string {
+	if f.empty() {
+		return ""
+	}
+	var parts []string
+	for _, c := range f.columns() {
+		if len(c.values) > 0 {
+			parts = append(parts, c.name+"="+strings.Join(c.values, ","))
+		}
+	}
+	return strings.Join(parts, " ")
+}
+
+// condition returns the SQL condition selecting the rows of f on the row aliased as row, or on
+// the columns as they are when row is empty, with its parameters numbered from first and their
+// arguments. It is TRUE when f selects every row.
+func (f *rowFilter) condition(row string, first int) (string, []interface{}) {
+	if f.empty() {
+		return "TRUE", nil
+	}
+	if row != "" {
+		row += "."
+	}
+	var conds []string
+	var args []interface{}
+	for _, c := range f.columns() {
+		if len(c.values) == 0 {
+			continue
+		}
+		conds = append(conds, fmt.Sprintf("%s%s = ANY($%d)", row, c.name, first+len(args)))
+		args = append(args, c.values)
+	}
+	return strings.Join(conds, " AND "), args
+}
+
+// where is condition as a WHERE clause, empty when f selects every row.
+func (f *rowFilter) where(row string, first int) (string, []interface{}) {
+	if f.empty() {
+		return "", nil
+	}
+	cond, args := f.condition(row, first)
+	return "WHERE " + cond, args
+}
+
+// checkFilterOptions fails on the flags a run restricted by the --filter flags cannot be
+// combined with.
+func checkFilterOptions(opts *options) error {
+	if opts.filter.empty() {
+		return nil
+	}
+	switch {
+	case opts.online:
+		return errors.New("--online keeps every new row current through triggers and cannot be combined with the --filter flags")
+	case opts.normalizePurls:
+		return errors.New("--normalize-purls merges dependencies whatever their source and cannot be combined with the --filter flags")
+	case opts.emitSQL != "", opts.estimate:
+		return errors.New("the --filter flags cannot be combined with --emit-sql or --estimate")
+	}
+	return nil
+}
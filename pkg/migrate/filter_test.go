@@ -0,0 +1,60 @@
+package migrate
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+func TestRowFilter(t *testing.T) {
+	var empty rowFilter
+	if cond, args := empty.condition("d", 1); cond != "TRUE" || args != nil {
+		t.Errorf("condition() without filters = %s, %v, want TRUE and no arguments", cond, args)
+	}
+	if where, _ := (*rowFilter)(nil).where("", 1); where != "" {
+		t.Errorf("where() of a nil filter = %q, want none", where)
+	}
+
+	var f rowFilter
+	if err := f.collectors.Set("deps.dev, FileCollector,"); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.documentRefs.Set("sbom.spdx.json"); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := f.String(), "collector=deps.dev,FileCollector document_ref=sbom.spdx.json"; got != want {
+		t.Errorf("String() = %q, want %q", got, want)
+	}
+	cond, args := f.condition("d", 5)
+	if want := "d.collector = ANY($5) AND d.document_ref = ANY($6)"; cond != want {
+		t.Errorf("condition() = %s, want %s", cond, want)
+	}
+	if want := []interface{}{[]string{"deps.dev", "FileCollector"}, []string{"sbom.spdx.json"}}; !reflect.DeepEqual(args, want) {
+		t.Errorf("condition() arguments = %v, want %v", args, want)
+	}
+	if where, _ := f.where("", 1); where != "WHERE collector = ANY($1) AND document_ref = ANY($2)" {
+		t.Errorf("where() = %s", where)
+	}
+}
+
+func TestRunStateRestrict(t *testing.T) {
+	s := &runState{}
+	if err := s.restrict("collector=deps.dev"); err != nil {
+		t.Fatalf("restrict() of a new state = %v", err)
+	}
+	if err := s.restrict(""); err != nil {
+		t.Errorf("restrict() of a state without progress = %v, want nil", err)
+	}
+	after := uuid.New()
+	s.BackfillAfter = &after
+	if err := s.restrict("origin=osv"); err == nil {
+		t.Error("restrict() to another filter than the saved progress succeeded, want an error")
+	}
+	if err := s.restrict(""); err != nil {
+		t.Errorf("restrict() to the filter of the saved progress = %v, want nil", err)
+	}
+	if err := (*runState)(nil).restrict("origin=osv"); err != nil {
+		t.Errorf("restrict() without a state = %v, want nil", err)
+	}
+}
@@ -0,0 +1,120 @@
+package migrate
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// guacTables are the tables of GUAC's ENT schema a database must have before it is migrated:
+// the ones the migration rewrites or moves rows of and the package tables they hang off. A
+// database that only happens to have a dependencies table is not GUAC's.
+var guacTables = []string{
+	"bill_of_materials",
+	"bill_of_materials_included_dependencies",
+	"bill_of_materials_included_occurrences",
+	"bill_of_materials_included_software_artifacts",
+	"bill_of_materials_included_software_packages",
+	"dependencies",
+	"package_names",
+	"package_namespaces",
+	"package_types",
+	"package_versions",
+}
+
+// databaseIdentity is what tells a GUAC database apart from others.
+type databaseIdentity struct {
+	// Fingerprint identifies the database within its cluster, for --expect-db-fingerprint.
+	Fingerprint string `json:"fingerprint"`
+	// MissingTables are the guacTables the database does not have.
+	MissingTables []string `json:"missing_tables,omitempty"`
+	// EntTypes and AtlasRevisions are set when the database has the tables ENT and Atlas
+	// create alongside GUAC's.
+	EntTypes       bool `json:"ent_types"`
+	AtlasRevisions bool `json:"atlas_revisions"`
+}
+
+// identifyDatabase reads the identity of the database conn is connected to.
+func identifyDatabase(ctx context.Context, conn *pgx.Conn, schema dbSchema) (*databaseIdentity, error) {
+	var name, oid string
+	var tables []string
+	err := conn.QueryRow(ctx, `
+		SELECT current_database(),
+		       (SELECT oid FROM pg_database WHERE datname = current_database())::text,
+		       coalesce((SELECT array_agg(DISTINCT table_name::text) FROM information_schema.tables
+		                 WHERE (table_schema = $2 AND table_name = ANY($1)) OR table_name IN ('ent_types', 'atlas_schema_revisions')), '{}')
+	`, guacTables, schema.name()).Scan(&name, &oid, &tables)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the tables of the database: %w", err)
+	}
+	present := make(map[string]bool)
+	for _, t := range tables {
+		present[t] = true
+	}
+	id := &databaseIdentity{
+		Fingerprint:    databaseFingerprint(clusterID(ctx, conn), name, oid),
+		EntTypes:       present["ent_types"],
+		AtlasRevisions: present["atlas_schema_revisions"],
+	}
+	for _, t := range guacTables {
+		if !present[t] {
+			id.MissingTables = append(id.MissingTables, t)
+		}
+	}
+	return id, nil
+}
+
+// clusterID identifies the database cluster: the system identifier Postgres generates when the
+// cluster is initialized, or CockroachDB's cluster ID. It is empty when neither can be read.
+func clusterID(ctx context.Context, conn *pgx.Conn) string {
+	for _, query := range []string{
+		`SELECT system_identifier::text FROM pg_control_system()`,
+		`SELECT crdb_internal.cluster_id()::text`,
+	} {
+		var id string
+		if err := conn.QueryRow(ctx, query).Scan(&id); err == nil {
+			return id
+		}
+	}
+	return ""
+}
+
+// databaseFingerprint hashes what identifies a database: its cluster, its name and its OID. A
+// restored copy, or another database of the same name on a different cluster, gets another one.
+func databaseFingerprint(cluster, name, oid string) string {
+	sum := sha256.Sum256([]byte(cluster + "\x00" + name + "\x00" + oid))
+	return hex.EncodeToString(sum[:8])
+}
+
+// checkGUACDatabase refuses to migrate a database that does not look like GUAC's, or, when
+// expected is set, whose fingerprint is not the expected one. It returns the fingerprint.
+func checkGUACDatabase(ctx context.Context, conn *pgx.Conn, schema dbSchema, logger *log.Logger, expected string) (string, error) {
+	id, err := identifyDatabase(ctx, conn, schema)
+	if err != nil {
+		return "", err
+	}
+	if len(id.MissingTables) > 0 {
+		return id.Fingerprint, fmt.Errorf("%w: the database does not look like a GUAC ENT database, it has no %s table", ErrSchemaMismatch, strings.Join(id.MissingTables, ", "))
+	}
+	if expected != "" && !strings.EqualFold(expected, id.Fingerprint) {
+		return id.Fingerprint, fmt.Errorf("the database has fingerprint %s, not the %s given with --expect-db-fingerprint; check the connection settings", id.Fingerprint, expected)
+	}
+	var also []string
+	if id.EntTypes {
+		also = append(also, "ent_types")
+	}
+	if id.AtlasRevisions {
+		also = append(also, "atlas_schema_revisions")
+	}
+	details := ""
+	if len(also) > 0 {
+		details = " and " + strings.Join(also, " and ")
+	}
+	logger.Printf("Database fingerprint %s: has the GUAC ENT tables%s\n", id.Fingerprint, details)
+	return id.Fingerprint, nil
+}
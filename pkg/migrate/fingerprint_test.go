@@ -0,0 +1,25 @@
+package migrate
+
+import "testing"
+
+func TestDatabaseFingerprint(t *testing.T) {
+	fp := databaseFingerprint("7301234567890123456", "guac", "16384")
+	if len(fp) != 16 {
+		t.Fatalf("databaseFingerprint() = %q, want 16 hex digits", fp)
+	}
+	if again := databaseFingerprint("7301234567890123456", "guac", "16384"); again != fp {
+		t.Errorf("databaseFingerprint() = %s, then %s for the same database", fp, again)
+	}
+	// Fresh clusters often give their first database the same OID and name.
+	others := [][3]string{
+		{"7309999999999999999", "guac", "16384"},
+		{"7301234567890123456", "guac_staging", "16384"},
+		{"7301234567890123456", "guac", "16385"},
+		{"730123456789012345", "6guac", "16384"},
+	}
+	for _, o := range others {
+		if got := databaseFingerprint(o[0], o[1], o[2]); got == fp {
+			t.Errorf("databaseFingerprint(%q, %q, %q) = %s, the same as another database's", o[0], o[1], o[2], got)
+		}
+	}
+}
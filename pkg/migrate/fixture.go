@@ -0,0 +1,133 @@
+package migrate
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/pxp928/guac-update-db/internal/anonymize"
+	"github.com/pxp928/guac-update-db/internal/fixtures"
+)
+
+func runExportFixture(args []string) {
+	var cf connFlags
+	fs := flag.NewFlagSet("export-fixture", flag.ExitOnError)
+	cf.register(fs)
+	output := fs.String("output", "", "write the fixture to `path` instead of stdout")
+	anonymized := fs.Bool("anonymize", true, "replace the IDs, package names, namespaces, qualifiers, SBOM and evidence fields with pseudonyms")
+	keyFile := fs.String("anonymize-key-file", "", "key the pseudonyms with the secret in `path`, so exports given the same file give the same pseudonyms")
+	fs.Parse(args)
+	if *keyFile != "" && !*anonymized {
+		log.Fatalf("--anonymize-key-file cannot be combined with --anonymize=false\n")
+	}
+
+	w := io.Writer(os.Stdout)
+	if *output != "" {
+		f, err := os.Create(*output)
+		if err != nil {
+			log.Fatalf("Failed to create the fixture: %v\n", err)
+		}
+		defer f.Close()
+		w = f
+	}
+	var a *anonymize.Anonymizer
+	if *anonymized {
+		var err error
+		if a, err = newAnonymizer(*keyFile); err != nil {
+			log.Fatalf("%v\n", err)
+		}
+	}
+	if err := exportFixture(&cf, w, a); err != nil {
+		log.Fatalf("%v\n", err)
+	}
+}
+
+// exportFixture writes the tables the migration involves to w as an NDJSON fixture, for a bug
+// report or the integration tests, and logs how many rows of each it holds. With a, the values
+// are replaced with its pseudonyms.
+func exportFixture(cf *connFlags, w io.Writer, a *anonymize.Anonymizer) error {
+	ctx := context.Background()
+	config, err := cf.config()
+	if err != nil {
+		return err
+	}
+	conn, err := pgx.ConnectConfig(ctx, config)
+	if err != nil {
+		return fmt.Errorf("unable to connect to database: %w", err)
+	}
+	defer conn.Close(ctx)
+
+	opts := fixtures.ExportOptions{ToolVersion: buildInfo().Version, Anonymizer: a}
+	counts, err := fixtures.Export(ctx, conn, w, opts)
+	if err != nil {
+		return fmt.Errorf("failed to export the fixture: %w", err)
+	}
+	logFixtureCounts("export-fixture: exported", counts)
+	return nil
+}
+
+func runImportFixture(args []string) {
+	var cf connFlags
+	fs := flag.NewFlagSet("import-fixture", flag.ExitOnError)
+	cf.register(fs)
+	createSchema := fs.Bool("create-schema", false, "create the GUAC v0.8 tables first, in an empty scratch database")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		usageFatalf("usage: guac-update-db import-fixture [flags] <fixture>\n")
+	}
+	if err := importFixture(&cf, fs.Arg(0), *createSchema, os.Stdout); err != nil {
+		log.Fatalf("%v\n", err)
+	}
+}
+
+// importFixture loads the NDJSON fixture at path into an empty scratch database, refusing one
+// that already has packages or dependencies as gen-testdata does.
+func importFixture(cf *connFlags, path string, createSchema bool, w io.Writer) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("failed to open the fixture: %w", err)
+	}
+	defer f.Close()
+
+	ctx := context.Background()
+	config, err := cf.config()
+	if err != nil {
+		return err
+	}
+	conn, err := pgx.ConnectConfig(ctx, config)
+	if err != nil {
+		return fmt.Errorf("unable to connect to database: %w", err)
+	}
+	defer conn.Close(ctx)
+
+	if createSchema {
+		if err := fixtures.CreateSchema(ctx, conn); err != nil {
+			return err
+		}
+	}
+	if err := checkEmptyScratch(ctx, conn, cf.schema, config.Database, "import-fixture"); err != nil {
+		return err
+	}
+	header, counts, err := fixtures.Import(ctx, conn, f)
+	if err != nil {
+		return fmt.Errorf("failed to import %s: %w", path, err)
+	}
+	logFixtureCounts("import-fixture: imported", counts)
+	anonymized := ""
+	if header.Anonymized {
+		anonymized = " anonymized"
+	}
+	fmt.Fprintf(w, "Imported the%s fixture exported by guac-update-db %s at %s into database %s.\n", anonymized, header.ToolVersion, header.ExportedAt.Format("2006-01-02 15:04:05 MST"), config.Database)
+	return nil
+}
+
+// logFixtureCounts logs how many rows of each table of a fixture were exported or imported.
+func logFixtureCounts(prefix string, counts map[string]int64) {
+	for _, table := range fixtures.Tables() {
+		log.Printf("%s %d rows of %s\n", prefix, counts[table], table)
+	}
+}
@@ -0,0 +1,91 @@
+package migrate
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/pxp928/guac-update-db/internal/fixtures"
+)
+
+func runGenTestdata(args []string) {
+	var cf connFlags
+	var opts fixtures.GenerateOptions
+	fs := flag.NewFlagSet("gen-testdata", flag.ExitOnError)
+	cf.register(fs)
+	fs.IntVar(&opts.Dependencies, "dependencies", 1000000, "number of dependencies to generate")
+	fs.IntVar(&opts.Packages, "packages", 0, "number of package names; dependencies/10 when 0")
+	fs.IntVar(&opts.VersionsPerPackage, "versions-per-package", 3, "number of versions of each package")
+	fs.IntVar(&opts.SBOMs, "sboms", 0, "number of SBOMs the dependencies are spread over; dependencies/1000 when 0")
+	fs.Int64Var(&opts.Seed, "seed", 1, "random `seed`; the same seed generates the same rows")
+	createSchema := fs.Bool("create-schema", false, "create the GUAC v0.8 tables first, in an empty scratch database")
+	fs.Parse(args)
+
+	if opts.Dependencies <= 0 || opts.VersionsPerPackage <= 0 || opts.Packages < 0 || opts.SBOMs < 0 {
+		log.Fatalf("--dependencies and --versions-per-package must be positive, --packages and --sboms must not be negative\n")
+	}
+	if opts.Packages == 0 {
+		opts.Packages = max(opts.Dependencies/10, 1)
+	}
+	if opts.SBOMs == 0 {
+		opts.SBOMs = max(opts.Dependencies/1000, 1)
+	}
+	if err := genTestdata(&cf, opts, *createSchema, os.Stdout); err != nil {
+		log.Fatalf("%v\n", err)
+	}
+}
+
+// genTestdata fills a scratch database with a synthetic GUAC v0.8 dataset. It refuses to touch
+// a database that already has dependencies, so it cannot add fake rows to a real GUAC.
+func genTestdata(cf *connFlags, opts fixtures.GenerateOptions, createSchema bool, w io.Writer) error {
+	ctx := context.Background()
+	config, err := cf.config()
+	if err != nil {
+		return err
+	}
+	conn, err := pgx.ConnectConfig(ctx, config)
+	if err != nil {
+		return fmt.Errorf("unable to connect to database: %w", err)
+	}
+	defer conn.Close(ctx)
+
+	if createSchema {
+		if err := fixtures.CreateSchema(ctx, conn); err != nil {
+			return err
+		}
+	}
+	if err := checkEmptyScratch(ctx, conn, cf.schema, config.Database, "gen-testdata"); err != nil {
+		return err
+	}
+
+	start := time.Now()
+	stats, err := fixtures.Generate(ctx, conn, opts, func(table string, rows int64) {
+		log.Printf("gen-testdata: loaded %d rows into %s\n", rows, table)
+	})
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(w, "Generated %d package versions, %d dependencies and %d SBOMs including %d dependencies in %s.\n",
+		stats.PackageVersions, stats.Dependencies, stats.SBOMs, stats.SBOMDependencies, time.Since(start).Round(time.Second))
+	fmt.Fprintf(w, "Time a migration of this size with: guac-update-db migrate --yes --report-file report.json\n")
+	return nil
+}
+
+// checkEmptyScratch refuses a database that already has packages or dependencies, so command
+// cannot add rows to a real GUAC.
+func checkEmptyScratch(ctx context.Context, conn *pgx.Conn, schema dbSchema, database, command string) error {
+	var populated bool
+	err := conn.QueryRow(ctx, `SELECT EXISTS (SELECT 1 FROM `+schema.prefix()+`dependencies) OR EXISTS (SELECT 1 FROM `+schema.prefix()+`package_names)`).Scan(&populated)
+	if err != nil {
+		return fmt.Errorf("failed to check that the database is empty (pass --create-schema for a database without the GUAC tables): %w", err)
+	}
+	if populated {
+		return fmt.Errorf("database %s already has packages or dependencies; %s only fills an empty scratch database", database, command)
+	}
+	return nil
+}
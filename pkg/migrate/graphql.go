@@ -0,0 +1,315 @@
+package migrate
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// graphQLClient posts queries to a GUAC GraphQL endpoint.
+type graphQLClient struct {
+	endpoint string
+	token    string
+	http     *http.Client
+}
+
+type graphQLError struct {
+	Message string `json:"message"`
+}
+
+func (e *graphQLError) Error() string {
+	return "GraphQL error: " + e.Message
+}
+
+// query runs q with vars and decodes the data member of the response into out.
+func (c *graphQLClient) query(ctx context.Context, q string, vars map[string]interface{}, out interface{}) error {
+	body, err := json.Marshal(map[string]interface{}{"query": q, "variables": vars})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("GraphQL endpoint returned %s: %s", resp.Status, bytes.TrimSpace(msg))
+	}
+
+	var result struct {
+		Data   json.RawMessage `json:"data"`
+		Errors []graphQLError  `json:"errors"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return fmt.Errorf("invalid GraphQL response: %w", err)
+	}
+	if len(result.Errors) > 0 {
+		return &result.Errors[0]
+	}
+	return json.Unmarshal(result.Data, out)
+}
+
+const (
+	isDependencyByIDQuery = `query IsDependencyByID($id: ID!) {
+  IsDependency(isDependencySpec: {id: $id}) { id package { id } dependencyPackage { id } }
+}`
+	hasSBOMByIDQuery = `query HasSBOMByID($id: ID!) {
+  HasSBOM(hasSBOMSpec: {id: $id}) { id includedDependencies { id } }
+}`
+)
+
+// graphQLFailure is a sampled node the GraphQL API does not resolve as the database says it
+// should.
+type graphQLFailure struct {
+	Kind    string `json:"kind"`
+	ID      string `json:"id"`
+	Problem string `json:"problem"`
+}
+
+// graphQLVerification is the output of the verify-graphql subcommand.
+type graphQLVerification struct {
+	Passed              bool             `json:"passed"`
+	DependenciesChecked int              `json:"dependencies_checked"`
+	SBOMsChecked        int              `json:"sboms_checked"`
+	Failures            []graphQLFailure `json:"failures"`
+}
+
+func (r *graphQLVerification) print(w io.Writer) {
+	fmt.Fprintf(w, "Checked %d dependencies and %d SBOMs through the GraphQL API: %d failures\n", r.DependenciesChecked, r.SBOMsChecked, len(r.Failures))
+	for _, f := range r.Failures {
+		fmt.Fprintf(w, "  %s %s: %s\n", f.Kind, f.ID, f.Problem)
+	}
+	if r.Passed {
+		fmt.Fprintln(w, "GUAC resolves every sampled node.")
+	}
+}
+
+// checkDependenciesGraphQL looks up each dependency ID through IsDependency and expects exactly
+// that node back. Resolving the package and dependencyPackage edges exercises the backfilled
+// dependent_package_version_id, which the resolver needs to load the dependency package.
+func checkDependenciesGraphQL(ctx context.Context, c *graphQLClient, ids []string, r *graphQLVerification) error {
+	for _, id := range ids {
+		var data struct {
+			IsDependency []struct {
+				ID string `json:"id"`
+			} `json:"IsDependency"`
+		}
+		err := c.query(ctx, isDependencyByIDQuery, map[string]interface{}{"id": id}, &data)
+		var gqlErr *graphQLError
+		if errors.As(err, &gqlErr) {
+			// The API is reachable but could not resolve this node.
+			r.DependenciesChecked++
+			r.Failures = append(r.Failures, graphQLFailure{Kind: "dependency", ID: id, Problem: gqlErr.Message})
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("failed to query dependency %s: %w", id, err)
+		}
+		r.DependenciesChecked++
+		switch {
+		case len(data.IsDependency) == 0:
+			r.Failures = append(r.Failures, graphQLFailure{Kind: "dependency", ID: id, Problem: "not found through IsDependency"})
+		case len(data.IsDependency) > 1 || data.IsDependency[0].ID != id:
+			r.Failures = append(r.Failures, graphQLFailure{Kind: "dependency", ID: id, Problem: fmt.Sprintf("IsDependency returned %d other nodes", len(data.IsDependency))})
+		}
+	}
+	return nil
+}
+
+// checkSBOMsGraphQL compares the included dependencies GUAC returns for each SBOM with the
+// bill of materials rows in the database.
+func checkSBOMsGraphQL(ctx context.Context, c *graphQLClient, sboms map[string][]string, r *graphQLVerification) error {
+	var ids []string
+	for id := range sboms {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	for _, id := range ids {
+		var data struct {
+			HasSBOM []struct {
+				ID                   string `json:"id"`
+				IncludedDependencies []struct {
+					ID string `json:"id"`
+				} `json:"includedDependencies"`
+			} `json:"HasSBOM"`
+		}
+		err := c.query(ctx, hasSBOMByIDQuery, map[string]interface{}{"id": id}, &data)
+		var gqlErr *graphQLError
+		if errors.As(err, &gqlErr) {
+			r.SBOMsChecked++
+			r.Failures = append(r.Failures, graphQLFailure{Kind: "sbom", ID: id, Problem: gqlErr.Message})
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("failed to query SBOM %s: %w", id, err)
+		}
+		r.SBOMsChecked++
+		if len(data.HasSBOM) != 1 {
+			r.Failures = append(r.Failures, graphQLFailure{Kind: "sbom", ID: id, Problem: fmt.Sprintf("HasSBOM returned %d nodes", len(data.HasSBOM))})
+			continue
+		}
+		got := make(map[string]bool)
+		for _, d := range data.HasSBOM[0].IncludedDependencies {
+			got[d.ID] = true
+		}
+		var missing int
+		for _, dep := range sboms[id] {
+			if !got[dep] {
+				missing++
+			}
+		}
+		if missing > 0 {
+			r.Failures = append(r.Failures, graphQLFailure{Kind: "sbom", ID: id, Problem: fmt.Sprintf("%d of %d included dependencies are not returned", missing, len(sboms[id]))})
+		}
+	}
+	return nil
+}
+
+// sampleDependencies returns up to n random dependency IDs.
+func sampleDependencies(ctx context.Context, conn *pgx.Conn, schema dbSchema, n int) ([]string, error) {
+	rows, err := conn.Query(ctx, `SELECT id::text FROM `+schema.prefix()+`dependencies ORDER BY random() LIMIT $1`, n)
+	if err != nil {
+		return nil, fmt.Errorf("failed to sample dependencies: %w", err)
+	}
+	defer rows.Close()
+	var ids []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+// sampleSBOMs returns up to n random SBOMs with included dependencies, and the dependency IDs
+// each one includes according to the database.
+func sampleSBOMs(ctx context.Context, conn *pgx.Conn, schema dbSchema, n int) (map[string][]string, error) {
+	rows, err := conn.Query(ctx, `
+		SELECT b.bill_of_materials_id::text, array_agg(b.dependency_id::text)
+		FROM `+schema.prefix()+`bill_of_materials_included_dependencies b
+		WHERE b.bill_of_materials_id IN (
+			SELECT s.bill_of_materials_id
+			FROM (SELECT DISTINCT bill_of_materials_id FROM `+schema.prefix()+`bill_of_materials_included_dependencies) s
+			ORDER BY random()
+			LIMIT $1
+		)
+		GROUP BY b.bill_of_materials_id
+	`, n)
+	if err != nil {
+		return nil, fmt.Errorf("failed to sample SBOMs: %w", err)
+	}
+	defer rows.Close()
+	sboms := make(map[string][]string)
+	for rows.Next() {
+		var id string
+		var deps []string
+		if err := rows.Scan(&id, &deps); err != nil {
+			return nil, err
+		}
+		sboms[id] = deps
+	}
+	return sboms, rows.Err()
+}
+
+func runVerifyGraphQL(args []string) {
+	var cf connFlags
+	fs := flag.NewFlagSet("verify-graphql", flag.ExitOnError)
+	cf.register(fs)
+	endpoint := fs.String("endpoint", "", "GUAC GraphQL `url`, e.g. http://guac-graphql:8080/query")
+	tokenFile := fs.String("token-file", "", "read a bearer token for the endpoint from `path` (\"-\" for stdin)")
+	sample := fs.Int("sample", 100, "number of random dependencies to look up")
+	sboms := fs.Int("sboms", 20, "number of random SBOMs whose included dependencies are compared")
+	timeout := fs.Duration("timeout", 30*time.Second, "timeout of each GraphQL request")
+	format := fs.String("format", "text", "output `format`: text or json")
+	fs.Parse(args)
+	if *endpoint == "" {
+		log.Fatalf("--endpoint is required\n")
+	}
+
+	c := &graphQLClient{endpoint: *endpoint, http: &http.Client{Timeout: *timeout}}
+	if *tokenFile != "" {
+		if *tokenFile == stdinPath && cf.usesStdin() {
+			log.Fatalf("only one of --token-file, --dsn-file and --password-file can be read from stdin\n")
+		}
+		token, err := readSecret(*tokenFile)
+		if err != nil {
+			log.Fatalf("Failed to read token file: %v\n", err)
+		}
+		c.token = token
+	}
+
+	passed, err := verifyGraphQL(&cf, c, *sample, *sboms, *format, os.Stdout)
+	if err != nil {
+		log.Fatalf("%v\n", err)
+	}
+	if !passed {
+		os.Exit(1)
+	}
+}
+
+// verifyGraphQL samples nodes from the database and checks that GUAC's GraphQL API resolves
+// them, reporting whether every sampled node passed.
+func verifyGraphQL(cf *connFlags, c *graphQLClient, sample, sbomSample int, format string, w io.Writer) (bool, error) {
+	if format != "text" && format != "json" {
+		return false, fmt.Errorf("invalid --format %q: must be text or json", format)
+	}
+	ctx := context.Background()
+	config, err := cf.config()
+	if err != nil {
+		return false, err
+	}
+	conn, err := pgx.ConnectConfig(ctx, config)
+	if err != nil {
+		return false, fmt.Errorf("unable to connect to database: %w", err)
+	}
+	defer conn.Close(ctx)
+
+	ids, err := sampleDependencies(ctx, conn, cf.schema, sample)
+	if err != nil {
+		return false, err
+	}
+	sboms, err := sampleSBOMs(ctx, conn, cf.schema, sbomSample)
+	if err != nil {
+		return false, err
+	}
+
+	r := &graphQLVerification{Failures: []graphQLFailure{}}
+	if err := checkDependenciesGraphQL(ctx, c, ids, r); err != nil {
+		return false, err
+	}
+	if err := checkSBOMsGraphQL(ctx, c, sboms, r); err != nil {
+		return false, err
+	}
+	r.Passed = len(r.Failures) == 0
+
+	if format == "json" {
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return r.Passed, enc.Encode(r)
+	}
+	r.print(w)
+	return r.Passed, nil
+}
@@ -0,0 +1,38 @@
+package migrate
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// defaultHookRuntime is the --max-runtime of --hook-mode: within Helm's default --timeout of
+// five minutes, with time left to connect and to save the state.
+const defaultHookRuntime = 4*time.Minute + 30*time.Second
+
+// applyHookMode sets the defaults of --hook-mode. A pre-upgrade hook cannot answer a prompt,
+// and fails the upgrade unless it exits 0, which it does when the run succeeded or there was
+// nothing to migrate. It stops in time for Helm to see the outcome, so it does not wait for the
+// writers of the old GUAC release, which Helm only replaces once the hook is done: the active
+// writer check fails right away, with hookWritersError, unless --wait-for-quiesce is passed.
+func applyHookMode(o *options) error {
+	if !o.hookMode {
+		return nil
+	}
+	switch {
+	case o.emitSQL != "", o.estimate:
+		return errors.New("--hook-mode migrates the database and cannot be combined with --emit-sql or --estimate")
+	case o.serveAddr != "":
+		return errors.New("--hook-mode and --serve cannot be combined: Helm, not the control API, starts the hook")
+	}
+	o.yes = true
+	if o.maxRuntime == 0 {
+		o.maxRuntime = defaultHookRuntime
+	}
+	return nil
+}
+
+// hookWritersError explains an active writer check that failed a --hook-mode run.
+func hookWritersError(err error) error {
+	return fmt.Errorf("%w; in a pre-upgrade hook, stop the writers of the old GUAC release first, for example by scaling the collectors down in a hook of lower weight", err)
+}
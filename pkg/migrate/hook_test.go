@@ -0,0 +1,33 @@
+package migrate
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestApplyHookMode(t *testing.T) {
+	o := &options{hookMode: true}
+	if err := applyHookMode(o); err != nil {
+		t.Fatal(err)
+	}
+	if !o.yes || o.waitForQuiesce || o.maxRuntime != defaultHookRuntime {
+		t.Errorf("applyHookMode() = yes %v, wait-for-quiesce %v, max-runtime %s; want true, false, %s", o.yes, o.waitForQuiesce, o.maxRuntime, defaultHookRuntime)
+	}
+	o = &options{hookMode: true, maxRuntime: 10 * time.Minute}
+	if err := applyHookMode(o); err != nil || o.maxRuntime != 10*time.Minute {
+		t.Errorf("applyHookMode() changed --max-runtime 10m to %s, %v", o.maxRuntime, err)
+	}
+	for _, o := range []*options{{hookMode: true, emitSQL: "migrate.sql"}, {hookMode: true, estimate: true}, {hookMode: true, serveAddr: ":8099"}} {
+		if err := applyHookMode(o); err == nil {
+			t.Errorf("applyHookMode(%+v) succeeded", o)
+		}
+	}
+	if err := hookWritersError(errActiveWriters); !errors.Is(err, errActiveWriters) {
+		t.Errorf("hookWritersError() = %v, want it to wrap errActiveWriters", err)
+	}
+	o = &options{}
+	if err := applyHookMode(o); err != nil || o.yes || o.maxRuntime != 0 {
+		t.Errorf("applyHookMode() changed the options without --hook-mode")
+	}
+}
@@ -0,0 +1,280 @@
+package migrate
+
+import (
+	"bufio"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+	"github.com/parquet-go/parquet-go"
+)
+
+// idMapEntry is one line of an --export-id-map file.
+type idMapEntry struct {
+	Table string `json:"table" parquet:"table"`
+	OldID string `json:"old_id" parquet:"old_id"`
+	NewID string `json:"new_id" parquet:"new_id"`
+}
+
+// idMapWriter writes --export-id-map entries in the format chosen by the file extension.
+type idMapWriter interface {
+	write(e idMapEntry) error
+	flush() error
+}
+
+type csvIDMapWriter struct{ w *csv.Writer }
+
+func (c *csvIDMapWriter) write(e idMapEntry) error {
+	return c.w.Write([]string{e.Table, e.OldID, e.NewID})
+}
+
+func (c *csvIDMapWriter) flush() error {
+	c.w.Flush()
+	return c.w.Error()
+}
+
+type ndjsonIDMapWriter struct {
+	enc *json.Encoder
+	buf *bufio.Writer
+}
+
+func (n *ndjsonIDMapWriter) write(e idMapEntry) error { return n.enc.Encode(e) }
+
+func (n *ndjsonIDMapWriter) flush() error { return n.buf.Flush() }
+
+// idMapRowGroup is the number of rows of a row group of a Parquet ID map, which the writer
+// holds in memory until it is full.
+const idMapRowGroup = 100000
+
+type parquetIDMapWriter struct {
+	w *parquet.GenericWriter[idMapEntry]
+}
+
+func (p *parquetIDMapWriter) write(e idMapEntry) error {
+	_, err := p.w.Write([]idMapEntry{e})
+	return err
+}
+
+// flush writes the last row group and the footer, without which the file cannot be read.
+func (p *parquetIDMapWriter) flush() error { return p.w.Close() }
+
+func newIDMapWriter(path string, w io.Writer) (idMapWriter, error) {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".csv":
+		c := csv.NewWriter(w)
+		if err := c.Write([]string{"table", "old_id", "new_id"}); err != nil {
+			return nil, err
+		}
+		return &csvIDMapWriter{w: c}, nil
+	case ".ndjson", ".jsonl":
+		buf := bufio.NewWriter(w)
+		return &ndjsonIDMapWriter{enc: json.NewEncoder(buf), buf: buf}, nil
+	case ".parquet":
+		return &parquetIDMapWriter{w: parquet.NewGenericWriter[idMapEntry](w, parquet.Compression(&parquet.Zstd), parquet.MaxRowsPerRowGroup(idMapRowGroup))}, nil
+	default:
+		return nil, fmt.Errorf("unsupported --export-id-map file %q: must end in .csv, .ndjson, .jsonl or .parquet", path)
+	}
+}
+
+// checkIDMapPath fails early on an --export-id-map path whose format is not supported.
+func checkIDMapPath(path string) error {
+	_, err := newIDMapWriter(path, io.Discard)
+	return err
+}
+
+// withIDMapExport adds an export-id-map step right after the step that computes the mapping, so
+// the file exists even if a later step fails.
+func (m *migration) withIDMapExport(steps []step, after string) []step {
+	var wrapped []step
+	for _, s := range steps {
+		wrapped = append(wrapped, s)
+		if s.name == after {
+			wrapped = append(wrapped, step{name: "export-id-map", run: m.exportIDMap})
+		}
+	}
+	return wrapped
+}
+
+// exportIDMap writes the old to new ID of every dependency whose ID changes to m.idMapPath,
+// both replaced with their pseudonyms with --anonymize.
+// The file is written next to its destination and renamed into place, so a reader never sees
+// a partial mapping.
+func (m *migration) exportIDMap(ctx context.Context) (int64, error) {
+	tmp, err := os.CreateTemp(filepath.Dir(m.idMapPath), "."+filepath.Base(m.idMapPath)+".*")
+	if err != nil {
+		return 0, fmt.Errorf("failed to create the ID map file: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+	if err := tmp.Chmod(0o644); err != nil {
+		return 0, fmt.Errorf("failed to create the ID map file: %w", err)
+	}
+
+	w, err := newIDMapWriter(m.idMapPath, tmp)
+	if err != nil {
+		return 0, err
+	}
+	var n int64
+	emit := func(oldID, newID uuid.UUID) error {
+		n++
+		if m.anonymizer != nil {
+			oldID, newID = m.anonymizer.UUID(oldID), m.anonymizer.UUID(newID)
+		}
+		return w.write(idMapEntry{Table: "dependencies", OldID: oldID.String(), NewID: newID.String()})
+	}
+
+	if m.fast {
+		// The staging table may come from an earlier run, so it is the source of truth.
+		err = m.retry(ctx, "export-id-map", func(conn *pgx.Conn) error {
+			n = 0
+			if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+				return err
+			}
+			if err := tmp.Truncate(0); err != nil {
+				return err
+			}
+			if w, err = newIDMapWriter(m.idMapPath, tmp); err != nil {
+				return err
+			}
+			rows, err := conn.Query(ctx, `SELECT old_id, new_id FROM `+m.schema.prefix()+dependencyIDStagingTable+` ORDER BY old_id`)
+			if err != nil {
+				return err
+			}
+			defer rows.Close()
+			for rows.Next() {
+				var oldID, newID uuid.UUID
+				if err := rows.Scan(&oldID, &newID); err != nil {
+					return err
+				}
+				if err := emit(oldID, newID); err != nil {
+					return err
+				}
+			}
+			return rows.Err()
+		})
+	} else {
+		if !m.idsComputed {
+			return 0, fmt.Errorf("export-id-map needs the mapping computed by rewrite-ids in the same run")
+		}
+		err = m.changes.each(func(c idChange) error {
+			if c.oldID == c.newID {
+				return nil
+			}
+			return emit(c.oldID, c.newID)
+		})
+	}
+	if err == nil {
+		err = w.flush()
+	}
+	if err == nil {
+		err = tmp.Close()
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), m.idMapPath)
+	}
+	if err != nil {
+		return 0, fmt.Errorf("failed to export the ID map: %w", err)
+	}
+	m.logger.Printf("export-id-map: wrote %d changed IDs to %s\n", n, m.idMapPath)
+	return n, nil
+}
+
+// readIDMap reads the old to new dependency IDs of an --export-id-map file.
+func readIDMap(path string) (map[uuid.UUID]uuid.UUID, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the ID map: %w", err)
+	}
+	defer f.Close()
+
+	ids := make(map[uuid.UUID]uuid.UUID)
+	add := func(e idMapEntry) error {
+		if e.Table != "dependencies" {
+			return nil
+		}
+		oldID, err := uuid.Parse(e.OldID)
+		if err != nil {
+			return fmt.Errorf("invalid old_id %q", e.OldID)
+		}
+		newID, err := uuid.Parse(e.NewID)
+		if err != nil {
+			return fmt.Errorf("invalid new_id %q", e.NewID)
+		}
+		ids[oldID] = newID
+		return nil
+	}
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".csv":
+		r := csv.NewReader(f)
+		r.FieldsPerRecord = 3
+		for line := 1; ; line++ {
+			record, err := r.Read()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return nil, fmt.Errorf("invalid ID map %s: %w", path, err)
+			}
+			if line == 1 && record[0] == "table" {
+				continue
+			}
+			if err := add(idMapEntry{Table: record[0], OldID: record[1], NewID: record[2]}); err != nil {
+				return nil, fmt.Errorf("invalid ID map %s, line %d: %w", path, line, err)
+			}
+		}
+	case ".ndjson", ".jsonl":
+		scanner := bufio.NewScanner(f)
+		for line := 1; scanner.Scan(); line++ {
+			if len(strings.TrimSpace(scanner.Text())) == 0 {
+				continue
+			}
+			var e idMapEntry
+			if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+				return nil, fmt.Errorf("invalid ID map %s, line %d: %w", path, line, err)
+			}
+			if err := add(e); err != nil {
+				return nil, fmt.Errorf("invalid ID map %s, line %d: %w", path, line, err)
+			}
+		}
+		if err := scanner.Err(); err != nil {
+			return nil, fmt.Errorf("failed to read the ID map: %w", err)
+		}
+	case ".parquet":
+		info, err := f.Stat()
+		if err != nil {
+			return nil, fmt.Errorf("failed to read the ID map: %w", err)
+		}
+		file, err := parquet.OpenFile(f, info.Size())
+		if err != nil {
+			return nil, fmt.Errorf("invalid ID map %s: %w", path, err)
+		}
+		r := parquet.NewGenericReader[idMapEntry](file)
+		defer r.Close()
+		entries := make([]idMapEntry, 1024)
+		for row := int64(1); ; {
+			n, err := r.Read(entries)
+			for _, e := range entries[:n] {
+				if err := add(e); err != nil {
+					return nil, fmt.Errorf("invalid ID map %s, row %d: %w", path, row, err)
+				}
+				row++
+			}
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return nil, fmt.Errorf("invalid ID map %s: %w", path, err)
+			}
+		}
+	default:
+		return nil, fmt.Errorf("unsupported ID map file %q: must end in .csv, .ndjson, .jsonl or .parquet", path)
+	}
+	return ids, nil
+}
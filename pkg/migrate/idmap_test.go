@@ -0,0 +1,54 @@
+package migrate
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+// TestIDMapRoundTrip writes an ID map in every format and reads it back as repair-orphans does.
+func TestIDMapRoundTrip(t *testing.T) {
+	want := map[uuid.UUID]uuid.UUID{uuid.New(): uuid.New(), uuid.New(): uuid.New()}
+	for _, name := range []string{"ids.csv", "ids.ndjson", "ids.jsonl", "ids.parquet"} {
+		t.Run(name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), name)
+			f, err := os.Create(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			w, err := newIDMapWriter(path, f)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for oldID, newID := range want {
+				if err := w.write(idMapEntry{Table: "dependencies", OldID: oldID.String(), NewID: newID.String()}); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := w.flush(); err != nil {
+				t.Fatal(err)
+			}
+			if err := f.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			got, err := readIDMap(path)
+			if err != nil {
+				t.Fatalf("readIDMap() failed: %v", err)
+			}
+			if len(got) != len(want) {
+				t.Fatalf("readIDMap() read %d IDs, want %d", len(got), len(want))
+			}
+			for oldID, newID := range want {
+				if got[oldID] != newID {
+					t.Errorf("readIDMap()[%s] = %s, want %s", oldID, got[oldID], newID)
+				}
+			}
+		})
+	}
+	if err := checkIDMapPath("ids.xlsx"); err == nil {
+		t.Errorf("checkIDMapPath(ids.xlsx) succeeded")
+	}
+}
@@ -0,0 +1,38 @@
+package migrate
+
+import (
+	"flag"
+	"strings"
+
+	"github.com/pxp928/guac-update-db/pkg/keys"
+)
+
+// idSchemeFlag is a flag.Value selecting the ID scheme dependency IDs are rewritten to, or
+// checked against. The zero value selects keys.DefaultScheme.
+type idSchemeFlag struct {
+	scheme *keys.Scheme
+}
+
+func (f *idSchemeFlag) register(fs *flag.FlagSet) {
+	fs.Var(f, "id-scheme", "`scheme` composing dependency IDs: "+strings.Join(keys.SchemeNames(), " or "))
+}
+
+func (f *idSchemeFlag) String() string {
+	return f.get().Name
+}
+
+func (f *idSchemeFlag) Set(value string) error {
+	s, err := keys.LookupScheme(value)
+	if err != nil {
+		return err
+	}
+	f.scheme = s
+	return nil
+}
+
+func (f *idSchemeFlag) get() *keys.Scheme {
+	if f == nil || f.scheme == nil {
+		return keys.DefaultScheme
+	}
+	return f.scheme
+}
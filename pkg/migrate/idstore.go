@@ -0,0 +1,501 @@
+package migrate
+
+import (
+	"bufio"
+	"bytes"
+	"container/heap"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/google/uuid"
+)
+
+// idChangeSize is the size of an idChange, in memory and in a spill file.
+const idChangeSize = 2 * len(uuid.UUID{})
+
+// byteSize is a flag.Value holding a number of bytes, given with an optional binary unit as in
+// 512MiB or 2GiB.
+type byteSize int64
+
+var byteUnits = []struct {
+	suffix string
+	size   int64
+}{
+	{"KiB", 1 << 10}, {"MiB", 1 << 20}, {"GiB", 1 << 30}, {"TiB", 1 << 40},
+	{"K", 1 << 10}, {"M", 1 << 20}, {"G", 1 << 30}, {"T", 1 << 40},
+	{"B", 1},
+}
+
+func (b *byteSize) String() string {
+	if *b == 0 {
+		return "0"
+	}
+	return formatBytes(int64(*b))
+}
+
+func (b *byteSize) Set(s string) error {
+	s = strings.TrimSpace(s)
+	unit := int64(1)
+	for _, u := range byteUnits {
+		if strings.HasSuffix(s, u.suffix) {
+			s, unit = strings.TrimSpace(strings.TrimSuffix(s, u.suffix)), u.size
+			break
+		}
+	}
+	n, err := strconv.ParseFloat(s, 64)
+	if err != nil || n < 0 {
+		return errors.New("must be a size such as 512MiB or 2GiB")
+	}
+	*b = byteSize(n * float64(unit))
+	return nil
+}
+
+// idChanges are the old and new IDs of the rows a rewrite moves, in the order of their old IDs
+// once finish has run. Within limit bytes they are kept in memory; beyond it, each limit's
+// worth is sorted and spilled to temporary files, which finish merges into one, in passes of
+// mergeFanIn files, so a laptop or a small jump host can rewrite more rows than it has memory
+// for. A zero limit keeps them all in memory.
+type idChanges struct {
+	limit int64
+	mem   []idChange
+	// byOld and byNew are the spilled runs, sorted by old and by new ID; merged is the file
+	// finish merges byOld into.
+	byOld, byNew []string
+	merged       string
+	n            int
+}
+
+// spilled reports whether the changes are on disk.
+func (s *idChanges) spilled() bool {
+	return len(s.byOld) > 0 || s.merged != ""
+}
+
+// len is the number of changes.
+func (s *idChanges) len() int {
+	return s.n
+}
+
+// reset forgets every change and removes the spill files.
+func (s *idChanges) reset() {
+	for _, f := range append(append(s.byOld, s.byNew...), s.merged) {
+		if f != "" {
+			os.Remove(f)
+		}
+	}
+	s.mem, s.byOld, s.byNew, s.merged, s.n = s.mem[:0], nil, nil, "", 0
+}
+
+// add records a change, spilling the ones in memory once they reach the limit.
+func (s *idChanges) add(c idChange) error {
+	if s.limit > 0 && len(s.mem) > 0 && int64(len(s.mem)+1)*int64(idChangeSize) > s.limit {
+		if err := s.spill(); err != nil {
+			return err
+		}
+	}
+	s.mem = append(s.mem, c)
+	s.n++
+	return nil
+}
+
+func compareOld(a, b idChange) int { return bytes.Compare(a.oldID[:], b.oldID[:]) }
+func compareNew(a, b idChange) int { return bytes.Compare(a.newID[:], b.newID[:]) }
+
+// spill writes the changes in memory to a run sorted by old ID and one sorted by new ID.
+func (s *idChanges) spill() error {
+	for _, run := range []struct {
+		files *[]string
+		cmp   func(a, b idChange) int
+	}{{&s.byNew, compareNew}, {&s.byOld, compareOld}} {
+		slices.SortFunc(s.mem, run.cmp)
+		name, err := writeChanges(s.mem)
+		if err != nil {
+			return fmt.Errorf("failed to spill the ID map to disk: %w", err)
+		}
+		*run.files = append(*run.files, name)
+	}
+	s.mem = s.mem[:0]
+	return nil
+}
+
+// writeChanges writes changes to a new temporary file and returns its name.
+func writeChanges(changes []idChange) (string, error) {
+	f, err := os.CreateTemp("", "guac-update-db-ids-*")
+	if err != nil {
+		return "", err
+	}
+	w := bufio.NewWriter(f)
+	for _, c := range changes {
+		w.Write(c.oldID[:])
+		w.Write(c.newID[:])
+	}
+	err = w.Flush()
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return "", err
+	}
+	return f.Name(), nil
+}
+
+// finish puts the changes in the order of their old IDs and returns the new IDs shared by more
+// than one row.
+func (s *idChanges) finish() ([]IDCollision, error) {
+	if !s.spilled() {
+		if s.limit == 0 {
+			slices.SortFunc(s.mem, compareOld)
+			return findCollisions(s.mem), nil
+		}
+		// Within a budget, the collisions are found in the order of the new IDs rather than
+		// with a map of them.
+		slices.SortFunc(s.mem, compareNew)
+		collisions, _ := adjacentCollisions(func(visit func(c idChange) error) error {
+			for _, c := range s.mem {
+				visit(c)
+			}
+			return nil
+		})
+		slices.SortFunc(s.mem, compareOld)
+		return collisions, nil
+	}
+	if len(s.mem) > 0 {
+		if err := s.spill(); err != nil {
+			return nil, err
+		}
+	}
+	var err error
+	if s.byNew, err = mergePasses(s.byNew, compareNew); err == nil {
+		s.byOld, err = mergePasses(s.byOld, compareOld)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to merge the spilled ID map: %w", err)
+	}
+	collisions, err := adjacentCollisions(func(visit func(c idChange) error) error {
+		return mergeEach(s.byNew, compareNew, visit)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the spilled ID map: %w", err)
+	}
+	merged, err := mergeRuns(s.byOld, compareOld, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to merge the spilled ID map: %w", err)
+	}
+	for _, f := range append(s.byOld, s.byNew...) {
+		os.Remove(f)
+	}
+	s.byOld, s.byNew, s.merged = nil, nil, merged
+	return collisions, nil
+}
+
+// adjacentCollisions returns the new IDs shared by more than one of the changes each visits in
+// the order of their new IDs, as findCollisions does.
+func adjacentCollisions(each func(visit func(c idChange) error) error) ([]IDCollision, error) {
+	var collisions []IDCollision
+	var prev idChange
+	var oldIDs []string
+	done := func() {
+		if len(oldIDs) > 1 {
+			slices.Sort(oldIDs)
+			collisions = append(collisions, IDCollision{NewID: prev.newID.String(), OldIDs: oldIDs})
+		}
+	}
+	err := each(func(c idChange) error {
+		if len(oldIDs) > 0 && c.newID != prev.newID {
+			done()
+			oldIDs = nil
+		}
+		prev = c
+		oldIDs = append(oldIDs, c.oldID.String())
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	done()
+	return collisions, nil
+}
+
+// mergeFanIn is the most runs merged at once, so that merging thousands of spilled runs does not
+// run out of file descriptors.
+const mergeFanIn = 64
+
+// mergePasses merges the sorted runs, mergeFanIn at a time, until at most mergeFanIn are left,
+// and returns those. The runs it merged are removed; on error, the runs returned are the ones
+// left on disk.
+func mergePasses(runs []string, cmp func(a, b idChange) int) ([]string, error) {
+	for len(runs) > mergeFanIn {
+		var next []string
+		for len(runs) > 0 {
+			n := min(mergeFanIn, len(runs))
+			if n == 1 {
+				next, runs = append(next, runs[0]), nil
+				break
+			}
+			merged, err := mergeRuns(runs[:n], cmp, nil)
+			if err != nil {
+				return append(next, runs...), err
+			}
+			for _, f := range runs[:n] {
+				os.Remove(f)
+			}
+			next, runs = append(next, merged), runs[n:]
+		}
+		runs = next
+	}
+	return runs, nil
+}
+
+// mergeRuns merges sorted runs into a new temporary file, leaving out the changes skip returns
+// true for.
+func mergeRuns(runs []string, cmp func(a, b idChange) int, skip func(c idChange) bool) (string, error) {
+	f, err := os.CreateTemp("", "guac-update-db-ids-*")
+	if err != nil {
+		return "", err
+	}
+	w := bufio.NewWriter(f)
+	err = mergeEach(runs, cmp, func(c idChange) error {
+		if skip != nil && skip(c) {
+			return nil
+		}
+		w.Write(c.oldID[:])
+		_, err := w.Write(c.newID[:])
+		return err
+	})
+	if err == nil {
+		err = w.Flush()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return "", err
+	}
+	return f.Name(), nil
+}
+
+// changeReader reads the changes of a spill file in order.
+type changeReader struct {
+	f    *os.File
+	r    *bufio.Reader
+	head idChange
+}
+
+func openChanges(name string) (*changeReader, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	return &changeReader{f: f, r: bufio.NewReaderSize(f, 1<<16)}, nil
+}
+
+// next reads the next change into head, and returns false at the end of the file.
+func (r *changeReader) next() (bool, error) {
+	var buf [idChangeSize]byte
+	if _, err := io.ReadFull(r.r, buf[:]); err != nil {
+		if errors.Is(err, io.EOF) {
+			return false, nil
+		}
+		return false, err
+	}
+	copy(r.head.oldID[:], buf[:len(uuid.UUID{})])
+	copy(r.head.newID[:], buf[len(uuid.UUID{}):])
+	return true, nil
+}
+
+// runHeap orders the readers of the runs being merged by their head.
+type runHeap struct {
+	readers []*changeReader
+	cmp     func(a, b idChange) int
+}
+
+func (h *runHeap) Len() int           { return len(h.readers) }
+func (h *runHeap) Less(i, j int) bool { return h.cmp(h.readers[i].head, h.readers[j].head) < 0 }
+func (h *runHeap) Swap(i, j int)      { h.readers[i], h.readers[j] = h.readers[j], h.readers[i] }
+func (h *runHeap) Push(x interface{}) { h.readers = append(h.readers, x.(*changeReader)) }
+func (h *runHeap) Pop() interface{} {
+	r := h.readers[len(h.readers)-1]
+	h.readers = h.readers[:len(h.readers)-1]
+	return r
+}
+
+// mergeEach visits the changes of the sorted runs in order.
+func mergeEach(runs []string, cmp func(a, b idChange) int, visit func(c idChange) error) error {
+	h := &runHeap{cmp: cmp}
+	defer func() {
+		for _, r := range h.readers {
+			r.f.Close()
+		}
+	}()
+	for _, name := range runs {
+		r, err := openChanges(name)
+		if err != nil {
+			return err
+		}
+		ok, err := r.next()
+		if err != nil || !ok {
+			r.f.Close()
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		h.readers = append(h.readers, r)
+	}
+	heap.Init(h)
+	for h.Len() > 0 {
+		r := h.readers[0]
+		if err := visit(r.head); err != nil {
+			return err
+		}
+		ok, err := r.next()
+		if err != nil {
+			return err
+		}
+		if ok {
+			heap.Fix(h, 0)
+		} else {
+			r.f.Close()
+			heap.Pop(h)
+		}
+	}
+	return nil
+}
+
+// changeIter reads the changes in order, from memory or from the merged spill file.
+type changeIter struct {
+	mem []idChange
+	r   *changeReader
+}
+
+// iter returns an iterator over the changes, which must be closed.
+func (s *idChanges) iter() (*changeIter, error) {
+	if !s.spilled() {
+		return &changeIter{mem: s.mem}, nil
+	}
+	if s.merged == "" {
+		return nil, errors.New("the spilled ID map is read before it was merged")
+	}
+	r, err := openChanges(s.merged)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the spilled ID map: %w", err)
+	}
+	return &changeIter{r: r}, nil
+}
+
+// next returns the next change, and false after the last one.
+func (it *changeIter) next() (idChange, bool, error) {
+	if it.r == nil {
+		if len(it.mem) == 0 {
+			return idChange{}, false, nil
+		}
+		c := it.mem[0]
+		it.mem = it.mem[1:]
+		return c, true, nil
+	}
+	ok, err := it.r.next()
+	if err != nil {
+		return idChange{}, false, fmt.Errorf("failed to read the spilled ID map: %w", err)
+	}
+	return it.r.head, ok, nil
+}
+
+func (it *changeIter) close() {
+	if it.r != nil {
+		it.r.f.Close()
+	}
+}
+
+// chunks visits the changes in order, size at a time. The chunk is only valid during the call.
+func (s *idChanges) chunks(size int, visit func(chunk []idChange) error) error {
+	if !s.spilled() {
+		for start := 0; start < len(s.mem); start += size {
+			if err := visit(s.mem[start:min(start+size, len(s.mem))]); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	it, err := s.iter()
+	if err != nil {
+		return err
+	}
+	defer it.close()
+	chunk := make([]idChange, 0, size)
+	for {
+		c, ok, err := it.next()
+		if err != nil {
+			return err
+		}
+		if ok {
+			chunk = append(chunk, c)
+		}
+		if len(chunk) == size || (!ok && len(chunk) > 0) {
+			if err := visit(chunk); err != nil {
+				return err
+			}
+			chunk = chunk[:0]
+		}
+		if !ok {
+			return nil
+		}
+	}
+}
+
+// each visits the changes in order.
+func (s *idChanges) each(visit func(c idChange) error) error {
+	return s.chunks(4096, func(chunk []idChange) error {
+		for _, c := range chunk {
+			if err := visit(c); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// all returns every change, reading them into memory when they were spilled.
+func (s *idChanges) all() ([]idChange, error) {
+	if !s.spilled() {
+		return s.mem, nil
+	}
+	changes := make([]idChange, 0, s.n)
+	err := s.each(func(c idChange) error {
+		changes = append(changes, c)
+		return nil
+	})
+	return changes, err
+}
+
+// remove forgets the changes of the old IDs in ids.
+func (s *idChanges) remove(ids map[uuid.UUID]bool) error {
+	if len(ids) == 0 {
+		return nil
+	}
+	if !s.spilled() {
+		s.mem = slices.DeleteFunc(s.mem, func(c idChange) bool { return ids[c.oldID] })
+		s.n = len(s.mem)
+		return nil
+	}
+	removed := 0
+	merged, err := mergeRuns([]string{s.merged}, compareOld, func(c idChange) bool {
+		if ids[c.oldID] {
+			removed++
+			return true
+		}
+		return false
+	})
+	if err != nil {
+		return fmt.Errorf("failed to rewrite the spilled ID map: %w", err)
+	}
+	os.Remove(s.merged)
+	s.merged = merged
+	s.n -= removed
+	return nil
+}
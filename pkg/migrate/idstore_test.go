@@ -0,0 +1,153 @@
+package migrate
+
+import (
+	"os"
+	"reflect"
+	"slices"
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+func TestByteSizeFlag(t *testing.T) {
+	for _, tc := range []struct {
+		in   string
+		want byteSize
+		ok   bool
+	}{
+		{"0", 0, true},
+		{"4096", 4096, true},
+		{"512MiB", 512 << 20, true},
+		{"2GiB", 2 << 30, true},
+		{"1.5G", 3 << 29, true},
+		{"64 K", 64 << 10, true},
+		{"lots", 0, false},
+		{"-1MiB", 0, false},
+	} {
+		var b byteSize
+		err := b.Set(tc.in)
+		if (err == nil) != tc.ok || (tc.ok && b != tc.want) {
+			t.Errorf("Set(%q) = %d, %v, want %d, ok %v", tc.in, b, err, tc.want, tc.ok)
+		}
+	}
+}
+
+// testChanges returns n changes with random old IDs, the first collide of them sharing a new ID.
+func testChanges(n, collide int) []idChange {
+	shared := uuid.New()
+	changes := make([]idChange, n)
+	for i := range changes {
+		changes[i] = idChange{oldID: uuid.New(), newID: uuid.New()}
+		if i < collide {
+			changes[i].newID = shared
+		}
+	}
+	return changes
+}
+
+func TestIDChangesSpill(t *testing.T) {
+	t.Setenv("TMPDIR", t.TempDir())
+	changes := testChanges(1000, 3)
+
+	inMemory := &idChanges{}
+	spilled := &idChanges{limit: 10 * int64(idChangeSize)}
+	var want, got []IDCollision
+	for _, s := range []*idChanges{inMemory, spilled} {
+		for _, c := range changes {
+			if err := s.add(c); err != nil {
+				t.Fatal(err)
+			}
+		}
+		collisions, err := s.finish()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if s == inMemory {
+			want = collisions
+		} else {
+			got = collisions
+		}
+	}
+	if inMemory.spilled() || !spilled.spilled() {
+		t.Fatalf("spilled() = %v and %v, want false and true", inMemory.spilled(), spilled.spilled())
+	}
+	if len(want) != 1 || len(want[0].OldIDs) != 3 || !reflect.DeepEqual(got, want) {
+		t.Errorf("collisions = %v, want %v", got, want)
+	}
+
+	all, err := spilled.all()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if spilled.len() != len(changes) || !reflect.DeepEqual(all, inMemory.mem) {
+		t.Errorf("the spilled changes differ from the ones in memory")
+	}
+
+	var chunked int
+	err = spilled.chunks(64, func(chunk []idChange) error {
+		if len(chunk) > 64 {
+			t.Errorf("chunk of %d changes, want at most 64", len(chunk))
+		}
+		chunked += len(chunk)
+		return nil
+	})
+	if err != nil || chunked != len(changes) {
+		t.Errorf("chunks visited %d changes, %v, want %d", chunked, err, len(changes))
+	}
+
+	removed := map[uuid.UUID]bool{all[0].oldID: true, all[500].oldID: true}
+	if err := spilled.remove(removed); err != nil {
+		t.Fatal(err)
+	}
+	if err := spilled.each(func(c idChange) error {
+		if removed[c.oldID] {
+			t.Errorf("%s is still there after remove", c.oldID)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if spilled.len() != len(changes)-2 {
+		t.Errorf("len() = %d after remove, want %d", spilled.len(), len(changes)-2)
+	}
+
+	spilled.reset()
+	if files, _ := os.ReadDir(os.Getenv("TMPDIR")); len(files) > 0 {
+		t.Errorf("reset left %d spill files behind", len(files))
+	}
+}
+
+func TestMergePasses(t *testing.T) {
+	t.Setenv("TMPDIR", t.TempDir())
+	changes := testChanges(2*mergeFanIn+3, 0)
+	var runs []string
+	for _, c := range changes {
+		name, err := writeChanges([]idChange{c})
+		if err != nil {
+			t.Fatal(err)
+		}
+		runs = append(runs, name)
+	}
+
+	runs, err := mergePasses(runs, compareOld)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(runs) > mergeFanIn {
+		t.Errorf("mergePasses() left %d runs, want at most %d", len(runs), mergeFanIn)
+	}
+	if files, _ := os.ReadDir(os.Getenv("TMPDIR")); len(files) != len(runs) {
+		t.Errorf("%d spill files for %d runs; the merged runs were not removed", len(files), len(runs))
+	}
+	var got []idChange
+	if err := mergeEach(runs, compareOld, func(c idChange) error {
+		got = append(got, c)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	slices.SortFunc(changes, compareOld)
+	if !reflect.DeepEqual(got, changes) {
+		t.Errorf("the merged runs hold %d changes, not the %d written in order", len(got), len(changes))
+	}
+}
@@ -0,0 +1,203 @@
+package migrate
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// droppedIndexesTable records the definitions of the indexes --rebuild-indexes dropped, so a run
+// that fails before rebuilding them can restore them on the next attempt.
+const droppedIndexesTable = "guac_update_db_dropped_indexes"
+
+// savedIndex is an index dropped by --rebuild-indexes.
+type savedIndex struct {
+	name       string
+	definition string
+}
+
+// withIndexRebuild wraps steps so secondary indexes are dropped after drop-constraints and
+// rebuilt before add-constraints, or with --defer-constraints, after defer-constraints and
+// before restore-constraints.
+func (m *migration) withIndexRebuild(steps []step) []step {
+	var wrapped []step
+	for _, s := range steps {
+		if s.name == "add-constraints" || s.name == "restore-constraints" {
+			wrapped = append(wrapped, step{name: "rebuild-indexes", run: m.rebuildIndexes, emit: m.emitRebuildIndexes})
+		}
+		wrapped = append(wrapped, s)
+		if s.name == "drop-constraints" || s.name == "defer-constraints" {
+			wrapped = append(wrapped, step{name: "drop-indexes", run: m.dropIndexes, emit: m.emitDropIndexes})
+		}
+	}
+	return wrapped
+}
+
+// dropIndexes saves the definitions of the secondary indexes of rewrittenTables and drops
+// them, in one transaction. Indexes backing a constraint, such as the primary keys, are kept.
+// Definitions saved by an earlier failed run are kept too.
+func (m *migration) dropIndexes(ctx context.Context) (int64, error) {
+	var dropped int64
+	err := m.retry(ctx, "drop-indexes", func(conn *pgx.Conn) error {
+		tx, err := conn.Begin(ctx)
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback(ctx)
+
+		_, err = tx.Exec(ctx, `
+		CREATE TABLE IF NOT EXISTS `+m.schema.prefix()+droppedIndexesTable+` (
+			index_name text PRIMARY KEY,
+			definition text NOT NULL
+		)
+	`)
+		if err != nil {
+			return err
+		}
+		indexes, err := secondaryIndexes(ctx, tx, m.schema)
+		if err != nil {
+			return err
+		}
+
+		for _, ix := range indexes {
+			_, err := tx.Exec(ctx, `INSERT INTO `+m.schema.prefix()+droppedIndexesTable+` (index_name, definition) VALUES ($1, $2) ON CONFLICT DO NOTHING`, ix.name, ix.definition)
+			if err != nil {
+				return err
+			}
+			if _, err := tx.Exec(ctx, `DROP INDEX `+m.schema.prefix()+pgx.Identifier{ix.name}.Sanitize()); err != nil {
+				return err
+			}
+			m.logger.Printf("drop-indexes: dropped %s\n", ix.definition)
+		}
+		dropped = int64(len(indexes))
+		return tx.Commit(ctx)
+	})
+	if err != nil {
+		return 0, fmt.Errorf("failed to drop indexes: %w", err)
+	}
+	return dropped, nil
+}
+
+// secondaryIndexes returns the indexes of rewrittenTables that do not back a constraint.
+func secondaryIndexes(ctx context.Context, q queryer, schema dbSchema) ([]savedIndex, error) {
+	rows, err := q.Query(ctx, `
+		SELECT c.relname, pg_get_indexdef(i.indexrelid)
+		FROM pg_index i
+		JOIN pg_class c ON c.oid = i.indexrelid
+		JOIN pg_class t ON t.oid = i.indrelid
+		JOIN pg_namespace n ON n.oid = t.relnamespace
+		WHERE n.nspname = $2 AND t.relname = ANY($1)
+		  AND NOT EXISTS (SELECT 1 FROM pg_constraint WHERE conindid = i.indexrelid)
+		ORDER BY c.relname
+	`, rewrittenTables, schema.name())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var indexes []savedIndex
+	for rows.Next() {
+		var ix savedIndex
+		if err := rows.Scan(&ix.name, &ix.definition); err != nil {
+			return nil, err
+		}
+		indexes = append(indexes, ix)
+	}
+	return indexes, rows.Err()
+}
+
+// rebuildIndexes recreates every saved index concurrently and forgets it once it is valid.
+// CREATE INDEX CONCURRENTLY cannot run in a transaction, and a failed build leaves an invalid
+// index behind, which is dropped before the build is retried.
+func (m *migration) rebuildIndexes(ctx context.Context) (int64, error) {
+	var indexes []savedIndex
+	err := m.retry(ctx, "rebuild-indexes", func(conn *pgx.Conn) error {
+		indexes = indexes[:0]
+		if n, err := pendingIndexRebuild(ctx, conn, m.schema); err != nil || n == 0 {
+			return err
+		}
+		rows, err := conn.Query(ctx, `
+		SELECT index_name, definition FROM `+m.schema.prefix()+droppedIndexesTable+` ORDER BY index_name
+	`)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var ix savedIndex
+			if err := rows.Scan(&ix.name, &ix.definition); err != nil {
+				return err
+			}
+			indexes = append(indexes, ix)
+		}
+		return rows.Err()
+	})
+	if err != nil {
+		return 0, fmt.Errorf("failed to read the dropped indexes: %w", err)
+	}
+
+	for _, ix := range indexes {
+		create, err := concurrentIndexDefinition(ix.definition)
+		if err != nil {
+			return 0, err
+		}
+		name := m.schema.prefix() + pgx.Identifier{ix.name}.Sanitize()
+		err = m.retry(ctx, "rebuild-indexes", func(conn *pgx.Conn) error {
+			var invalid bool
+			err := conn.QueryRow(ctx, `
+			SELECT EXISTS (SELECT 1 FROM pg_index WHERE indexrelid = to_regclass($1) AND NOT indisvalid)
+		`, name).Scan(&invalid)
+			if err != nil {
+				return err
+			}
+			if invalid {
+				if _, err := conn.Exec(ctx, `DROP INDEX CONCURRENTLY IF EXISTS `+name); err != nil {
+					return err
+				}
+			}
+			if _, err := conn.Exec(ctx, create); err != nil {
+				return err
+			}
+			_, err = conn.Exec(ctx, `DELETE FROM `+m.schema.prefix()+droppedIndexesTable+` WHERE index_name = $1`, ix.name)
+			return err
+		})
+		if err != nil {
+			return 0, fmt.Errorf("failed to rebuild index %s: %w", ix.name, err)
+		}
+		m.logger.Printf("rebuild-indexes: rebuilt %s\n", ix.name)
+	}
+
+	err = m.retry(ctx, "rebuild-indexes", func(conn *pgx.Conn) error {
+		_, err := conn.Exec(ctx, `DROP TABLE IF EXISTS `+m.schema.prefix()+droppedIndexesTable)
+		return err
+	})
+	if err != nil {
+		return 0, fmt.Errorf("failed to drop %s: %w", droppedIndexesTable, err)
+	}
+	return int64(len(indexes)), nil
+}
+
+// concurrentIndexDefinition turns a pg_get_indexdef definition into a CREATE INDEX CONCURRENTLY
+// IF NOT EXISTS statement.
+func concurrentIndexDefinition(def string) (string, error) {
+	for _, prefix := range []string{"CREATE UNIQUE INDEX ", "CREATE INDEX "} {
+		if strings.HasPrefix(def, prefix) {
+			return prefix + "CONCURRENTLY IF NOT EXISTS " + strings.TrimPrefix(def, prefix), nil
+		}
+	}
+	return "", fmt.Errorf("unexpected index definition %q", def)
+}
+
+// pendingIndexRebuild reports how many indexes an earlier --rebuild-indexes run dropped and
+// did not rebuild.
+func pendingIndexRebuild(ctx context.Context, conn *pgx.Conn, schema dbSchema) (int64, error) {
+	var exists bool
+	err := conn.QueryRow(ctx, `SELECT to_regclass($1) IS NOT NULL`, schema.prefix()+droppedIndexesTable).Scan(&exists)
+	if err != nil || !exists {
+		return 0, err
+	}
+	var n int64
+	err = conn.QueryRow(ctx, `SELECT count(*) FROM `+schema.prefix()+droppedIndexesTable).Scan(&n)
+	return n, err
+}
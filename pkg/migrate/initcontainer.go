@@ -0,0 +1,169 @@
+package migrate
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+const (
+	// defaultDBWaitTimeout is how long --wait-for-db waits for Postgres unless --wait-timeout
+	// says otherwise: long enough for a Postgres pod scheduled alongside GUAC to start.
+	defaultDBWaitTimeout = 5 * time.Minute
+	// dbWaitInterval is the time between two connection attempts of --wait-for-db.
+	dbWaitInterval = 2 * time.Second
+)
+
+// completionTable records every run that left the database migrated, with --completion-row, so
+// whatever waits for the migration can check the database itself. It outlives the run and is
+// never dropped.
+const completionTable = "guac_update_db_completions"
+
+// applyInitContainerMode sets the defaults of --init-container. An init container runs ahead of
+// the guac-graphql container of its pod, where no one answers a prompt and Postgres may still be
+// starting; the pod only starts once it exits 0, which it does when there was nothing to
+// migrate too. Pod restarts resume from the state kept in the database.
+func applyInitContainerMode(o *options) error {
+	if !o.initContainer {
+		return nil
+	}
+	switch {
+	case o.emitSQL != "", o.estimate:
+		return errors.New("--init-container migrates the database and cannot be combined with --emit-sql or --estimate")
+	case o.serveAddr != "":
+		return errors.New("--init-container and --serve cannot be combined: the pod, not the control API, starts the migration")
+	case o.hookMode:
+		return errors.New("--init-container and --hook-mode cannot be combined; a Helm hook runs as a Job of its own")
+	}
+	o.yes = true
+	o.waitForDB = true
+	return nil
+}
+
+// checkInitContainerOptions fails on the flags waiting for the database and marking its
+// migration complete cannot be combined with.
+func checkInitContainerOptions(o *options) error {
+	if o.waitForDB && o.waitTimeout <= 0 {
+		return errors.New("--wait-timeout must be positive")
+	}
+	marked := o.completionFile != "" || o.completionRow
+	switch {
+	case marked && (o.emitSQL != "" || o.estimate):
+		return errors.New("--completion-file and --completion-row mark a migrated database and cannot be combined with --emit-sql or --estimate")
+	case (marked || o.initContainer) && o.targetsFile != "":
+		return errors.New("--init-container, --completion-file and --completion-row are about the database of one pod and cannot be combined with --targets")
+	}
+	return nil
+}
+
+// waitForDatabase tries to connect to the database of config every dbWaitInterval until it
+// succeeds, for up to timeout.
+func waitForDatabase(ctx context.Context, config *pgx.ConnConfig, timeout time.Duration, logger *log.Logger) error {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	for attempt := 1; ; attempt++ {
+		conn, err := pgx.ConnectConfig(ctx, config)
+		if err == nil {
+			conn.Close(ctx)
+			if attempt > 1 {
+				logger.Printf("Postgres at %s is reachable after %d attempts\n", config.Host, attempt)
+			}
+			return nil
+		}
+		if attempt == 1 {
+			logger.Printf("Waiting up to %s for Postgres at %s: %v\n", timeout, config.Host, err)
+		}
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("the database at %s was not reachable within --wait-timeout %s: %w", config.Host, timeout, err)
+		case <-time.After(dbWaitInterval):
+		}
+	}
+}
+
+// completionMarker is what --completion-file holds once the database is migrated.
+type completionMarker struct {
+	Database            string    `json:"database"`
+	DatabaseFingerprint string    `json:"database_fingerprint,omitempty"`
+	Outcome             string    `json:"outcome"`
+	Migrations          []string  `json:"migrations"`
+	ToolVersion         string    `json:"tool_version"`
+	CompletedAt         time.Time `json:"completed_at"`
+}
+
+// removeCompletionFile removes the marker an earlier run left at path, so nothing takes it for
+// the outcome of this one.
+func removeCompletionFile(path string) error {
+	if path == "" {
+		return nil
+	}
+	if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("failed to remove the completion marker %s: %w", path, err)
+	}
+	return nil
+}
+
+// writeCompletionFile writes the marker of report to path, through a temporary file renamed
+// into place, so a readiness probe polling path never reads half of it.
+func writeCompletionFile(path string, report *Report) error {
+	data, err := json.MarshalIndent(completionMarker{
+		Database:            report.Database,
+		DatabaseFingerprint: report.DatabaseFingerprint,
+		Outcome:             report.Outcome,
+		Migrations:          report.Migrations,
+		ToolVersion:         report.ToolVersion,
+		CompletedAt:         report.FinishedAt,
+	}, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*")
+	if err != nil {
+		return fmt.Errorf("failed to write the completion marker: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(append(data, '\n')); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write the completion marker: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to write the completion marker: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("failed to write the completion marker: %w", err)
+	}
+	return nil
+}
+
+// recordCompletion adds the row of --completion-row for a run that left the database migrated,
+// with the outcome of err.
+func (m *migration) recordCompletion(ctx context.Context, err error) error {
+	result, _ := outcome(err)
+	werr := m.retry(ctx, "completion", func(conn *pgx.Conn) error {
+		if _, err := conn.Exec(ctx, `CREATE TABLE IF NOT EXISTS `+m.schema.prefix()+completionTable+` (
+			id bigserial PRIMARY KEY,
+			database_fingerprint text NOT NULL,
+			outcome text NOT NULL,
+			migrations text[] NOT NULL,
+			tool_version text NOT NULL,
+			completed_at timestamptz NOT NULL DEFAULT now()
+		)`); err != nil {
+			return err
+		}
+		_, err := conn.Exec(ctx, `INSERT INTO `+m.schema.prefix()+completionTable+` (database_fingerprint, outcome, migrations, tool_version) VALUES ($1, $2, $3, $4)`,
+			m.report.DatabaseFingerprint, result, m.report.Migrations, m.report.ToolVersion)
+		return err
+	})
+	if werr != nil {
+		return fmt.Errorf("failed to record the completion in %s: %w", completionTable, werr)
+	}
+	m.logger.Printf("Recorded the completed migration in %s\n", completionTable)
+	return nil
+}
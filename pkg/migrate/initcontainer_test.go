@@ -0,0 +1,83 @@
+package migrate
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+func TestApplyInitContainerMode(t *testing.T) {
+	o := &options{initContainer: true}
+	if err := applyInitContainerMode(o); err != nil {
+		t.Fatal(err)
+	}
+	if !o.yes || !o.waitForDB {
+		t.Errorf("applyInitContainerMode() = yes %v, wait-for-db %v; want true, true", o.yes, o.waitForDB)
+	}
+	for _, o := range []*options{{initContainer: true, emitSQL: "migrate.sql"}, {initContainer: true, serveAddr: ":8099"}, {initContainer: true, hookMode: true}} {
+		if err := applyInitContainerMode(o); err == nil {
+			t.Errorf("applyInitContainerMode(%+v) succeeded", o)
+		}
+	}
+	for _, o := range []*options{{waitTimeout: time.Minute, completionRow: true, estimate: true}, {waitTimeout: time.Minute, initContainer: true, targetsFile: "targets.yaml"}, {waitForDB: true}} {
+		if err := checkInitContainerOptions(o); err == nil {
+			t.Errorf("checkInitContainerOptions(%+v) succeeded", o)
+		}
+	}
+}
+
+func TestCompletionFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "migrated")
+	report := newReport()
+	report.Database = "guac"
+	report.Migrations = []string{"dependency-version-ids"}
+	report.finish(nil)
+	if err := writeCompletionFile(path, report); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var marker completionMarker
+	if err := json.Unmarshal(data, &marker); err != nil {
+		t.Fatal(err)
+	}
+	if marker.Database != "guac" || marker.Outcome != "success" || len(marker.Migrations) != 1 {
+		t.Errorf("marker = %+v, want the database, outcome and migrations of the report", marker)
+	}
+	if entries, _ := os.ReadDir(filepath.Dir(path)); len(entries) != 1 {
+		t.Errorf("%d files next to the marker, want the marker only", len(entries))
+	}
+
+	if err := removeCompletionFile(path); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("the marker is still there after removeCompletionFile(): %v", err)
+	}
+	if err := removeCompletionFile(path); err != nil {
+		t.Errorf("removeCompletionFile() of no marker = %v", err)
+	}
+}
+
+func TestWaitForDatabaseTimesOut(t *testing.T) {
+	config, err := pgx.ParseConfig("postgres://guac@127.0.0.1:1/guac?connect_timeout=1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	if err := waitForDatabase(context.Background(), config, 100*time.Millisecond, log.New(io.Discard, "", 0)); err == nil {
+		t.Fatal("waitForDatabase() of a closed port succeeded")
+	}
+	if d := time.Since(start); d > 5*time.Second {
+		t.Errorf("waitForDatabase() took %s, past its timeout", d)
+	}
+}
@@ -0,0 +1,1822 @@
+//go:build integration
+
+package migrate
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+	"github.com/pxp928/guac-update-db/internal/anonymize"
+	"github.com/pxp928/guac-update-db/internal/fixtures"
+	"github.com/pxp928/guac-update-db/pkg/keys"
+	"github.com/testcontainers/testcontainers-go"
+	"github.com/testcontainers/testcontainers-go/modules/postgres"
+	"github.com/testcontainers/testcontainers-go/wait"
+)
+
+// testDSNEnv points the integration tests at an existing Postgres server instead of a container.
+// The role needs to be allowed to create databases.
+const testDSNEnv = "GUAC_UPDATE_DB_TEST_DSN"
+
+// serverDSN is the connection string of the server every test creates its database on.
+var serverDSN string
+
+func TestMain(m *testing.M) {
+	serverDSN = os.Getenv(testDSNEnv)
+	if serverDSN != "" {
+		os.Exit(m.Run())
+	}
+
+	ctx := context.Background()
+	container, err := postgres.Run(ctx, "postgres:16-alpine",
+		postgres.WithUsername("guac"),
+		postgres.WithPassword("guac"),
+		postgres.WithDatabase("guac"),
+		testcontainers.WithWaitStrategy(
+			// Postgres restarts once after running the init scripts.
+			wait.ForLog("database system is ready to accept connections").WithOccurrence(2).WithStartupTimeout(time.Minute),
+		),
+	)
+	if err != nil {
+		log.Fatalf("Failed to start Postgres (set %s to use an existing server): %v\n", testDSNEnv, err)
+	}
+	serverDSN, err = container.ConnectionString(ctx, "sslmode=disable")
+	if err != nil {
+		log.Fatalf("Failed to get the Postgres connection string: %v\n", err)
+	}
+	code := m.Run()
+	if err := container.Terminate(ctx); err != nil {
+		log.Printf("Failed to stop Postgres: %v\n", err)
+	}
+	os.Exit(code)
+}
+
+// testDB is a database of its own for one test, with the fixture schema created.
+type testDB struct {
+	conn    *pgx.Conn
+	dsnFile string
+}
+
+var testDBCount atomic.Int64
+
+var nonIdentifier = regexp.MustCompile(`[^a-z0-9_]+`)
+
+// newTestDB creates an empty GUAC v0.8 database that is dropped when the test ends.
+func newTestDB(t *testing.T) *testDB {
+	t.Helper()
+	ctx := context.Background()
+
+	name := fmt.Sprintf("%s_%d", nonIdentifier.ReplaceAllString(strings.ToLower(t.Name()), "_"), testDBCount.Add(1))
+	if len(name) > 63 {
+		name = name[len(name)-63:]
+	}
+	server, err := pgx.Connect(ctx, serverDSN)
+	if err != nil {
+		t.Fatalf("failed to connect to the test server: %v", err)
+	}
+	defer server.Close(ctx)
+	if _, err := server.Exec(ctx, "CREATE DATABASE "+pgx.Identifier{name}.Sanitize()); err != nil {
+		t.Fatalf("failed to create test database: %v", err)
+	}
+	t.Cleanup(func() {
+		server, err := pgx.Connect(ctx, serverDSN)
+		if err != nil {
+			t.Errorf("failed to connect to the test server: %v", err)
+			return
+		}
+		defer server.Close(ctx)
+		if _, err := server.Exec(ctx, "DROP DATABASE "+pgx.Identifier{name}.Sanitize()+" WITH (FORCE)"); err != nil {
+			t.Errorf("failed to drop test database: %v", err)
+		}
+	})
+
+	u, err := url.Parse(serverDSN)
+	if err != nil {
+		t.Fatalf("invalid test server DSN: %v", err)
+	}
+	u.Path = "/" + name
+	dsnFile := filepath.Join(t.TempDir(), "dsn")
+	if err := os.WriteFile(dsnFile, []byte(u.String()+"\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	conn, err := pgx.Connect(ctx, u.String())
+	if err != nil {
+		t.Fatalf("failed to connect to test database: %v", err)
+	}
+	t.Cleanup(func() { conn.Close(ctx) })
+	if err := fixtures.CreateSchema(ctx, conn); err != nil {
+		t.Fatal(err)
+	}
+	return &testDB{conn: conn, dsnFile: dsnFile}
+}
+
+// load inserts the named fixtures dataset.
+func (db *testDB) load(t *testing.T, dataset string) {
+	t.Helper()
+	if err := fixtures.Load(context.Background(), db.conn, dataset); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// testWriter sends log output to the test log, so it is only shown for failing tests.
+type testWriter struct{ t *testing.T }
+
+func (w testWriter) Write(p []byte) (int, error) {
+	w.t.Log(string(bytes.TrimRight(p, "\n")))
+	return len(p), nil
+}
+
+// migrateDB runs the migration against db non-interactively. configure adjusts the options
+// beforehand, and may be nil.
+func (db *testDB) migrate(t *testing.T, configure func(o *options)) (*Report, error) {
+	t.Helper()
+	opts := &options{
+		conn: connFlags{dsnFile: db.dsnFile},
+		// The test's own connection to the database is idle, but checking takes seconds.
+		force:        true,
+		yes:          true,
+		chunkSize:    3,
+		poolerCompat: "off",
+		toVersion:    latestVersion,
+		maintenance:  maintenanceAnalyze,
+		parallel:     1,
+		workers:      1,
+		pool:         poolSettings{maxConns: 4, healthCheck: time.Second},
+	}
+	if configure != nil {
+		configure(opts)
+	}
+	report := newReport()
+	err := migrateDatabase(context.Background(), opts, report, log.New(testWriter{t}, "", 0))
+	report.finish(err)
+	return report, err
+}
+
+// expectedIDs returns the new ID of every dependency, keyed by its current ID, computed from
+// the rows as they are before the migration with the default scheme.
+func (db *testDB) expectedIDs(t *testing.T) map[uuid.UUID]uuid.UUID {
+	t.Helper()
+	rows, err := db.conn.Query(context.Background(), `
+		SELECT d.id, d.package_id, coalesce(d.dependent_package_version_id, pv.id), d.dependency_type, d.justification, d.origin, d.collector, d.document_ref
+		FROM dependencies d
+		LEFT JOIN package_versions pv ON pv.name_id = d.dependent_package_name_id AND pv.version = d.version_range
+	`)
+	if err != nil {
+		t.Fatalf("failed to read dependencies: %v", err)
+	}
+	defer rows.Close()
+	ids := make(map[uuid.UUID]uuid.UUID)
+	for rows.Next() {
+		var id uuid.UUID
+		var d keys.Dependency
+		if err := rows.Scan(&id, &d.PackageID, &d.DependentPackageVersionID, &d.DependencyType, &d.Justification, &d.Origin, &d.Collector, &d.DocumentRef); err != nil {
+			t.Fatalf("failed to scan dependency: %v", err)
+		}
+		ids[id] = keys.DefaultScheme.Key(d)
+	}
+	if err := rows.Err(); err != nil {
+		t.Fatal(err)
+	}
+	return ids
+}
+
+// dependencyIDs returns the IDs of the dependencies table, sorted.
+func (db *testDB) dependencyIDs(t *testing.T) []uuid.UUID {
+	t.Helper()
+	return db.uuids(t, `SELECT id FROM dependencies ORDER BY id`)
+}
+
+// sbomDependencies returns the included dependency IDs of every SBOM, sorted, by the URI of
+// the SBOM, which fix-sbom-ids keeps as it moves the SBOM to a new ID.
+func (db *testDB) sbomDependencies(t *testing.T) map[string][]uuid.UUID {
+	t.Helper()
+	rows, err := db.conn.Query(context.Background(), `
+		SELECT b.uri, i.dependency_id FROM bill_of_materials_included_dependencies i
+		JOIN bill_of_materials b ON b.id = i.bill_of_materials_id
+		ORDER BY b.uri, i.dependency_id
+	`)
+	if err != nil {
+		t.Fatalf("failed to read SBOM dependencies: %v", err)
+	}
+	defer rows.Close()
+	refs := make(map[string][]uuid.UUID)
+	for rows.Next() {
+		var sbom string
+		var dep uuid.UUID
+		if err := rows.Scan(&sbom, &dep); err != nil {
+			t.Fatal(err)
+		}
+		refs[sbom] = append(refs[sbom], dep)
+	}
+	if err := rows.Err(); err != nil {
+		t.Fatal(err)
+	}
+	return refs
+}
+
+func (db *testDB) uuids(t *testing.T, query string) []uuid.UUID {
+	t.Helper()
+	rows, err := db.conn.Query(context.Background(), query)
+	if err != nil {
+		t.Fatalf("query failed: %v", err)
+	}
+	defer rows.Close()
+	var ids []uuid.UUID
+	for rows.Next() {
+		var id uuid.UUID
+		if err := rows.Scan(&id); err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, id)
+	}
+	if err := rows.Err(); err != nil {
+		t.Fatal(err)
+	}
+	return ids
+}
+
+func (db *testDB) count(t *testing.T, query string) int64 {
+	t.Helper()
+	var n int64
+	if err := db.conn.QueryRow(context.Background(), query).Scan(&n); err != nil {
+		t.Fatalf("query failed: %v", err)
+	}
+	return n
+}
+
+func (db *testDB) exec(t *testing.T, sql string) {
+	t.Helper()
+	if _, err := db.conn.Exec(context.Background(), sql); err != nil {
+		t.Fatalf("%s failed: %v", sql, err)
+	}
+}
+
+func sortUUIDs(ids []uuid.UUID) {
+	sort.Slice(ids, func(i, j int) bool { return bytes.Compare(ids[i][:], ids[j][:]) < 0 })
+}
+
+func equalUUIDs(a, b []uuid.UUID) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// assertSBOMKeys checks that every SBOM including dependencies has the hash of their IDs and
+// the ID GUAC derives from it.
+func (db *testDB) assertSBOMKeys(t *testing.T) {
+	t.Helper()
+	err := scanSBOMs(context.Background(), db.conn, "public", func(id uuid.UUID, b keys.BillOfMaterials, dependencies []string) error {
+		if hash := keys.IncludedHash("dependencies", dependencies); b.IncludedDependenciesHash != hash {
+			t.Errorf("SBOM %s has included_dependencies_hash %s, want %s", id, b.IncludedDependenciesHash, hash)
+		}
+		if key := b.Key(); key != id {
+			t.Errorf("SBOM %s is not at the ID %s GUAC derives for it", id, key)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("failed to read SBOMs: %v", err)
+	}
+}
+
+// assertMigrated checks db against the state it was in before the migration: the same rows,
+// every dependency at the ID expected computed for it, the SBOMs including the new IDs at the
+// IDs GUAC derives from them and the foreign key back in place.
+func (db *testDB) assertMigrated(t *testing.T, expected map[uuid.UUID]uuid.UUID, sboms map[string][]uuid.UUID) {
+	t.Helper()
+	ctx := context.Background()
+
+	var want []uuid.UUID
+	for _, id := range expected {
+		want = append(want, id)
+	}
+	sortUUIDs(want)
+	if got := db.dependencyIDs(t); !equalUUIDs(got, want) {
+		t.Errorf("dependency IDs = %v, want %v", got, want)
+	}
+
+	gotSBOMs := db.sbomDependencies(t)
+	if len(gotSBOMs) != len(sboms) {
+		t.Errorf("%d SBOMs include dependencies, want %d", len(gotSBOMs), len(sboms))
+	}
+	for sbom, deps := range sboms {
+		var want []uuid.UUID
+		for _, dep := range deps {
+			want = append(want, expected[dep])
+		}
+		sortUUIDs(want)
+		if got := gotSBOMs[sbom]; !equalUUIDs(got, want) {
+			t.Errorf("SBOM %s includes %v, want %v", sbom, got, want)
+		}
+	}
+	db.assertSBOMKeys(t)
+
+	if n := db.count(t, `SELECT count(*) FROM dependencies WHERE dependent_package_version_id IS NULL`); n != 0 {
+		t.Errorf("%d dependencies have no dependent_package_version_id after the migration", n)
+	}
+	if n, err := countDanglingReferences(ctx, db.conn, "public"); err != nil || n != 0 {
+		t.Errorf("countDanglingReferences() = %d, %v; want 0", n, err)
+	}
+	if n := db.count(t, `SELECT count(*) FROM pg_constraint WHERE contype = 'f' AND confrelid = `+dbSchema("public").regclassLiteral("dependencies")+` AND convalidated`); n != 1 {
+		t.Errorf("%d foreign keys reference dependencies after the migration, want 1", n)
+	}
+
+	v := &Verification{}
+	mismatches, unresolved, err := checkDependencyIDs(ctx, db.conn, "public", keys.DefaultScheme, v, 10, nil)
+	if err != nil {
+		t.Fatalf("checkDependencyIDs() failed: %v", err)
+	}
+	if len(mismatches) > 0 || len(unresolved) > 0 {
+		t.Errorf("checkDependencyIDs() found mismatches %v and unresolved rows %v", mismatches, unresolved)
+	}
+}
+
+func TestMigrateBasicFixture(t *testing.T) {
+	tests := []struct {
+		name      string
+		configure func(o *options)
+	}{
+		{name: "default"},
+		{name: "fast", configure: func(o *options) { o.fast = true }},
+		{name: "rebuild-indexes", configure: func(o *options) { o.rebuildIndexes = true }},
+		{name: "fast-rebuild-indexes", configure: func(o *options) { o.fast = true; o.rebuildIndexes = true }},
+		{name: "defer-constraints", configure: func(o *options) { o.deferFKs = true }},
+		{name: "fast-defer-constraints", configure: func(o *options) { o.fast = true; o.deferFKs = true }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := newTestDB(t)
+			db.load(t, "basic")
+			expected := db.expectedIDs(t)
+			sboms := db.sbomDependencies(t)
+			indexes := db.count(t, `SELECT count(*) FROM pg_indexes WHERE tablename IN ('dependencies', 'bill_of_materials_included_dependencies')`)
+
+			report, err := db.migrate(t, tt.configure)
+			if err != nil {
+				t.Fatalf("migrate() failed: %v", err)
+			}
+			if !report.Success || report.UnresolvedRows != 0 || len(report.Collisions) != 0 {
+				t.Errorf("report = %+v, want a clean success", report)
+			}
+			if report.Verification == nil || !report.Verification.Passed {
+				t.Errorf("verification = %+v, want no problems", report.Verification)
+			}
+			db.assertMigrated(t, expected, sboms)
+			for _, step := range report.Steps {
+				if step.Name != "rewrite-ids" {
+					continue
+				}
+				// Statistics can trail the step on older servers, so only their presence is checked.
+				if step.Server == nil || step.Server.WALBytes == nil || *step.Server.WALBytes <= 0 {
+					t.Errorf("rewrite-ids server statistics = %+v, want the WAL it wrote", step.Server)
+				} else if len(step.Server.Tables) != len(rewrittenTables) {
+					t.Errorf("rewrite-ids has statistics of %d tables, want %d", len(step.Server.Tables), len(rewrittenTables))
+				}
+			}
+
+			if got := db.count(t, `SELECT count(*) FROM pg_indexes WHERE tablename IN ('dependencies', 'bill_of_materials_included_dependencies')`); got != indexes {
+				t.Errorf("%d indexes after the migration, want %d", got, indexes)
+			}
+			if n := db.count(t, `SELECT count(*) FROM pg_constraint WHERE conname = '`+dependencyFKName+`' AND condeferrable`); n != 0 {
+				t.Errorf("foreign key %s is still deferrable after the migration", dependencyFKName)
+			}
+			for _, table := range []string{dependencyIDStagingTable, droppedIndexesTable, droppedForeignKeysTable, deferredForeignKeysTable} {
+				if n := db.count(t, `SELECT count(*) FROM pg_class WHERE relname = '`+table+`'`); n != 0 {
+					t.Errorf("%s was left behind", table)
+				}
+			}
+		})
+	}
+}
+
+// Databases created by other ENT or Atlas versions name the foreign key differently; it is
+// dropped and restored under the name it has.
+func TestMigrateDiscoversForeignKeys(t *testing.T) {
+	for _, fast := range []bool{false, true} {
+		t.Run(fmt.Sprintf("fast=%v", fast), func(t *testing.T) {
+			db := newTestDB(t)
+			db.load(t, "basic")
+			expected := db.expectedIDs(t)
+			sboms := db.sbomDependencies(t)
+			db.exec(t, `ALTER TABLE bill_of_materials_included_dependencies RENAME CONSTRAINT `+dependencyFKName+` TO "BOMIncludedDependencies_fk"`)
+
+			if _, err := db.migrate(t, func(o *options) { o.fast = fast }); err != nil {
+				t.Fatalf("migrate() failed: %v", err)
+			}
+			db.assertMigrated(t, expected, sboms)
+			if n := db.count(t, `SELECT count(*) FROM pg_constraint WHERE conname = 'BOMIncludedDependencies_fk' AND convalidated`); n != 1 {
+				t.Errorf("foreign key BOMIncludedDependencies_fk was not restored under its name")
+			}
+			if n := db.count(t, `SELECT count(*) FROM pg_class WHERE relname = '`+droppedForeignKeysTable+`'`); n != 0 {
+				t.Errorf("%s was left behind", droppedForeignKeysTable)
+			}
+		})
+	}
+}
+
+func TestMigrateOnline(t *testing.T) {
+	for _, staged := range []bool{false, true} {
+		t.Run(fmt.Sprintf("staged=%v", staged), func(t *testing.T) {
+			db := newTestDB(t)
+			db.load(t, "basic")
+			sboms := db.sbomDependencies(t)
+
+			if staged {
+				// GUAC keeps writing between the runs: the trigger recomputes the new ID of an
+				// updated row and passes it on to the SBOMs including it.
+				if _, err := db.migrate(t, func(o *options) {
+					o.online = true
+					o.skipSteps = stepList{"cutover", "validate-constraints", "verify"}
+				}); err != nil {
+					t.Fatalf("migrate() up to the cutover failed: %v", err)
+				}
+				db.exec(t, `UPDATE dependencies SET justification = justification || ' (updated)' WHERE id = (SELECT id FROM dependencies ORDER BY id LIMIT 1)`)
+			}
+			expected := db.expectedIDs(t)
+			if _, err := db.migrate(t, func(o *options) { o.online = true }); err != nil {
+				t.Fatalf("migrate() with --online failed: %v", err)
+			}
+			db.assertMigrated(t, expected, sboms)
+			for _, table := range []string{"dependencies", "bill_of_materials_included_dependencies"} {
+				if n := db.count(t, `SELECT count(*) FROM pg_constraint WHERE conrelid = 'public.`+table+`'::regclass AND contype = 'p'`); n != 1 {
+					t.Errorf("%s has %d primary keys after the cutover, want 1", table, n)
+				}
+			}
+			if n := db.count(t, `SELECT (SELECT count(*) FROM pg_proc WHERE proname LIKE 'guac\_shadow\_%') + (SELECT count(*) FROM pg_class WHERE relname LIKE 'guac\_shadow\_%') + (SELECT count(*) FROM pg_attribute WHERE attname LIKE 'new\_%' AND NOT attisdropped AND attrelid IN ('public.dependencies'::regclass, 'public.bill_of_materials_included_dependencies'::regclass))`); n != 0 {
+				t.Errorf("%d shadow columns, functions or indexes were left behind", n)
+			}
+		})
+	}
+}
+
+func TestMigrateWithWorkers(t *testing.T) {
+	for _, online := range []bool{false, true} {
+		t.Run(fmt.Sprintf("online=%v", online), func(t *testing.T) {
+			db := newTestDB(t)
+			db.load(t, "basic")
+			sboms := db.sbomDependencies(t)
+			expected := db.expectedIDs(t)
+			if _, err := db.migrate(t, func(o *options) {
+				o.online = online
+				o.workers = 3
+			}); err != nil {
+				t.Fatalf("migrate() with 3 workers failed: %v", err)
+			}
+			db.assertMigrated(t, expected, sboms)
+		})
+	}
+}
+
+// eventRecorder collects the events of a run.
+type eventRecorder struct {
+	NopObserver
+	mu      sync.Mutex
+	steps   []string
+	batches map[string]int64
+	// progress is the migration of every step, with its number among the migrations of the run.
+	progress []string
+	outcomes []string
+}
+
+func (r *eventRecorder) OnStepStart(e StepStart) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.steps = append(r.steps, e.Step)
+	r.progress = append(r.progress, fmt.Sprintf("%s %d/%d", e.Migration, e.MigrationNumber, e.Migrations))
+}
+
+func (r *eventRecorder) OnBatchComplete(e Batch) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.batches[e.Step] += e.Rows
+}
+
+func (r *eventRecorder) OnFinish(e Result) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.outcomes = append(r.outcomes, e.Outcome)
+}
+
+func TestRun(t *testing.T) {
+	db := newTestDB(t)
+	db.load(t, "basic")
+	expected := db.expectedIDs(t)
+	sboms := db.sbomDependencies(t)
+
+	events := &eventRecorder{batches: map[string]int64{}}
+	opts := Options{
+		Flags:      []string{"--force", "--chunk-size", "3", "--pooler-compat", "off"},
+		ConnConfig: db.conn.Config(),
+		Logger:     log.New(testWriter{t}, "", 0),
+	}
+	if err := Run(context.Background(), opts, events); err != nil {
+		t.Fatalf("Run() failed: %v", err)
+	}
+	if err := Run(context.Background(), opts, events); err != nil {
+		t.Fatalf("Run() of a migrated database = %v, want nil", err)
+	}
+	if got, want := strings.Join(events.outcomes, ","), "success,already-migrated"; got != want {
+		t.Errorf("observer was told about outcomes %s, want %s", got, want)
+	}
+	if events.batches["backfill"] == 0 {
+		t.Errorf("observer was told about no backfill batch")
+	}
+	db.assertMigrated(t, expected, sboms)
+}
+
+func TestMigrateReportsEvents(t *testing.T) {
+	db := newTestDB(t)
+	db.load(t, "basic")
+	dependencies := db.count(t, `SELECT count(*) FROM dependencies`)
+
+	events := &eventRecorder{batches: map[string]int64{}}
+	report, err := db.migrate(t, func(o *options) { o.observer = events })
+	if err != nil {
+		t.Fatalf("migrate() failed: %v", err)
+	}
+	var steps, progress []string
+	for _, s := range report.Steps {
+		if !s.Skipped {
+			steps = append(steps, s.Name)
+			if s.Migration == "" {
+				progress = append(progress, " 0/1")
+			} else {
+				progress = append(progress, s.Migration+" 1/1")
+			}
+		}
+	}
+	if got, want := strings.Join(events.steps, ","), strings.Join(steps, ","); got != want {
+		t.Errorf("observer was told about steps %s, want %s", got, want)
+	}
+	if got, want := strings.Join(events.progress, ","), strings.Join(progress, ","); got != want {
+		t.Errorf("observer was told about the progress %s, want %s", got, want)
+	}
+	if !reflect.DeepEqual(report.CompletedMigrations, report.Migrations) {
+		t.Errorf("report completed migrations %v, want %v", report.CompletedMigrations, report.Migrations)
+	}
+	if got := events.batches["backfill"]; got != dependencies {
+		t.Errorf("backfill batches covered %d rows, want all %d dependencies", got, dependencies)
+	}
+	if events.batches["rewrite-ids"] == 0 {
+		t.Errorf("observer was told about no rewrite-ids batch")
+	}
+}
+
+func TestMigrateChecksTheDatabase(t *testing.T) {
+	t.Run("unrelated", func(t *testing.T) {
+		db := newTestDB(t)
+		db.exec(t, `CREATE TABLE dependencies (id uuid PRIMARY KEY, name text)`)
+		if _, err := db.migrate(t, nil); !errors.Is(err, ErrSchemaMismatch) || !strings.Contains(err.Error(), "package_versions") {
+			t.Fatalf("migrate() = %v, want a refusal naming the missing GUAC tables", err)
+		}
+		if n := db.count(t, `SELECT count(*) FROM information_schema.columns WHERE table_name = 'dependencies'`); n != 2 {
+			t.Errorf("the unrelated dependencies table has %d columns afterwards, want it untouched", n)
+		}
+	})
+
+	t.Run("fingerprint", func(t *testing.T) {
+		db := newTestDB(t)
+		db.load(t, "basic")
+		report, err := db.migrate(t, func(o *options) { o.expectDB = "0123456789abcdef" })
+		if err == nil || !strings.Contains(err.Error(), "--expect-db-fingerprint") {
+			t.Fatalf("migrate() with the wrong fingerprint = %v, want a refusal", err)
+		}
+		fingerprint := report.DatabaseFingerprint
+		if len(fingerprint) != 16 {
+			t.Fatalf("report has fingerprint %q, want 16 hex digits", fingerprint)
+		}
+		if _, err := db.migrate(t, func(o *options) { o.expectDB = strings.ToUpper(fingerprint) }); err != nil {
+			t.Fatalf("migrate() with fingerprint %s failed: %v", fingerprint, err)
+		}
+	})
+}
+
+func TestMigrateFailsWithoutForeignKey(t *testing.T) {
+	db := newTestDB(t)
+	db.load(t, "basic")
+	db.exec(t, `ALTER TABLE bill_of_materials_included_dependencies DROP CONSTRAINT `+dependencyFKName)
+
+	if _, err := db.migrate(t, nil); err == nil || !strings.Contains(err.Error(), "no foreign key references dependencies(id)") {
+		t.Fatalf("migrate() = %v, want an error naming the missing foreign key", err)
+	}
+	if n := db.count(t, `SELECT count(*) FROM pg_class WHERE relname = '`+droppedForeignKeysTable+`'`); n != 0 {
+		t.Errorf("%s was created although nothing was dropped", droppedForeignKeysTable)
+	}
+}
+
+// In pooler compatibility mode the run still takes the migration lock, so it excludes another
+// run, an earlier release holding the session-level lock included.
+func TestMigrateExcludesConcurrentRuns(t *testing.T) {
+	db := newTestDB(t)
+	db.load(t, "basic")
+	ctx := context.Background()
+	config, err := (&connFlags{dsnFile: db.dsnFile}).config()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lock, err := holdMigrationLock(ctx, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := holdMigrationLock(ctx, config); !errors.Is(err, errMigrationInProgress) {
+		t.Errorf("holdMigrationLock() with the lock held = %v, want %v", err, errMigrationInProgress)
+	}
+	if err := lock.release(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	db.exec(t, fmt.Sprintf(`SELECT pg_advisory_lock(%d)`, migrationLockKey))
+	if _, err := db.migrate(t, func(o *options) { o.poolerCompat = "on" }); !errors.Is(err, errMigrationInProgress) {
+		t.Fatalf("migrate() with the lock held = %v, want %v", err, errMigrationInProgress)
+	}
+	db.exec(t, fmt.Sprintf(`SELECT pg_advisory_unlock(%d)`, migrationLockKey))
+	if _, err := db.migrate(t, func(o *options) { o.poolerCompat = "on" }); err != nil {
+		t.Fatalf("migrate() = %v", err)
+	}
+}
+
+func TestMigrateIsIdempotent(t *testing.T) {
+	db := newTestDB(t)
+	db.load(t, "basic")
+	expected := db.expectedIDs(t)
+	sboms := db.sbomDependencies(t)
+
+	if _, err := db.migrate(t, nil); err != nil {
+		t.Fatalf("first migrate() failed: %v", err)
+	}
+	// Atlas has not dropped the old columns yet, so the database still looks like v0.8 and the
+	// second run goes through every step again.
+	report, err := db.migrate(t, nil)
+	if err != nil {
+		t.Fatalf("second migrate() failed: %v", err)
+	}
+	if len(report.Migrations) != 1 {
+		t.Errorf("second run ran migrations %v, want the dependency migration again", report.Migrations)
+	}
+	db.assertMigrated(t, expected, sboms)
+}
+
+// populate inserts the same graph of packages, dependencies and SBOMs into db every time it is
+// called, under fresh random IDs.
+func populate(t *testing.T, db *testDB) {
+	t.Helper()
+	ctx := context.Background()
+	f := fixtures.NewFactory(db.conn)
+
+	version := func(pkgType, name, v string) fixtures.PackageVersion {
+		pv, err := f.PackageVersion(ctx, pkgType, name, v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return pv
+	}
+	dependency := func(d fixtures.Dependency) uuid.UUID {
+		id, err := f.Dependency(ctx, d)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return id
+	}
+
+	app := version("golang", "github.com/example/app", "v1.0.0")
+	var deps []uuid.UUID
+	for i := 0; i < 20; i++ {
+		lib := version("golang", fmt.Sprintf("github.com/example/lib%d", i), fmt.Sprintf("v0.%d.0", i))
+		deps = append(deps, dependency(fixtures.Dependency{Package: app, DependsOn: lib, ByVersion: i%4 == 0}))
+		deps = append(deps, dependency(fixtures.Dependency{
+			Package:       app,
+			DependsOn:     lib,
+			Justification: "top-level package GUAC heuristic connecting to each file/package",
+			Origin:        "file:///sboms/app.spdx.json",
+			Collector:     "FileCollector",
+			DocumentRef:   fmt.Sprintf("SPDXRef-Package-lib%d", i),
+		}))
+	}
+	if _, err := f.SBOM(ctx, app, deps...); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.SBOM(ctx, app, deps[:10]...); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMigrateIsDeterministic(t *testing.T) {
+	var migrated [][]uuid.UUID
+	for i := 0; i < 2; i++ {
+		db := newTestDB(t)
+		populate(t, db)
+		before := db.dependencyIDs(t)
+		expected := db.expectedIDs(t)
+		sboms := db.sbomDependencies(t)
+
+		if _, err := db.migrate(t, nil); err != nil {
+			t.Fatalf("migrate() failed: %v", err)
+		}
+		db.assertMigrated(t, expected, sboms)
+		after := db.dependencyIDs(t)
+		if equalUUIDs(after, before) {
+			t.Errorf("dependency IDs did not change")
+		}
+		migrated = append(migrated, after)
+	}
+	if !equalUUIDs(migrated[0], migrated[1]) {
+		t.Errorf("the same dependencies were migrated to different IDs: %v and %v", migrated[0], migrated[1])
+	}
+}
+
+func TestMigrateStopsOnUnresolvedDependency(t *testing.T) {
+	ctx := context.Background()
+	db := newTestDB(t)
+	db.load(t, "basic")
+	f := fixtures.NewFactory(db.conn)
+	pkg, err := f.PackageVersion(ctx, "pypi", "flask", "3.0.0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A version range that matches no ingested version cannot be backfilled.
+	missing := fixtures.PackageVersion{NameID: pkg.NameID, Version: ">=2.0"}
+	if _, err := f.Dependency(ctx, fixtures.Dependency{Package: pkg, DependsOn: missing}); err != nil {
+		t.Fatal(err)
+	}
+	before := db.dependencyIDs(t)
+
+	report, err := db.migrate(t, nil)
+	if err == nil {
+		t.Fatalf("migrate() succeeded with an unresolved dependency")
+	}
+	if report.UnresolvedRows != 1 {
+		t.Errorf("report.UnresolvedRows = %d, want 1", report.UnresolvedRows)
+	}
+	if got := db.dependencyIDs(t); !equalUUIDs(got, before) {
+		t.Errorf("dependency IDs changed although the migration failed")
+	}
+}
+
+// A version_range that is a range is not resolved to a version spelled the same unless
+// --version-ranges=exact says so.
+func TestMigrateVersionRanges(t *testing.T) {
+	for _, policy := range []string{versionRangesSkip, versionRangesFail, versionRangesExact} {
+		t.Run(policy, func(t *testing.T) {
+			ctx := context.Background()
+			db := newTestDB(t)
+			db.load(t, "basic")
+			f := fixtures.NewFactory(db.conn)
+			pkg, err := f.PackageVersion(ctx, "pypi", "flask", "3.0.0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			spelledLikeRange, err := f.PackageVersion(ctx, "pypi", "werkzeug", "^3.0.0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := f.Dependency(ctx, fixtures.Dependency{Package: pkg, DependsOn: spelledLikeRange}); err != nil {
+				t.Fatal(err)
+			}
+			const unresolved = `SELECT count(*) FROM dependencies WHERE dependent_package_name_id IS NOT NULL AND dependent_package_version_id IS NULL`
+			before := db.count(t, unresolved)
+
+			report, err := db.migrate(t, func(o *options) { o.versionRanges = policy })
+			switch policy {
+			case versionRangesExact:
+				if err != nil {
+					t.Fatalf("migrate() failed: %v", err)
+				}
+			case versionRangesFail:
+				if err == nil || !strings.Contains(err.Error(), "version range") {
+					t.Fatalf("migrate() = %v, want it to fail on the version range", err)
+				}
+				if n := db.count(t, unresolved); n != before {
+					t.Errorf("%d dependencies left to backfill, want the %d before the run", n, before)
+				}
+			default:
+				if err == nil {
+					t.Fatalf("migrate() succeeded with a dependency on a range")
+				}
+				if report.VersionRanges != 1 || report.UnresolvedRows != 1 {
+					t.Errorf("report has %d version ranges and %d unresolved rows, want 1 and 1", report.VersionRanges, report.UnresolvedRows)
+				}
+			}
+		})
+	}
+}
+
+func TestMigrateFilterCollector(t *testing.T) {
+	ctx := context.Background()
+	db := newTestDB(t)
+	db.load(t, "basic")
+	f := fixtures.NewFactory(db.conn)
+	pkg, err := f.PackageVersion(ctx, "pypi", "flask", "3.0.0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dep, err := f.PackageVersion(ctx, "pypi", "werkzeug", "3.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	filed, err := f.Dependency(ctx, fixtures.Dependency{Package: pkg, DependsOn: dep, Collector: "FileCollector", DocumentRef: "sbom.spdx.json"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sbom, err := f.SBOM(ctx, pkg, filed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var uri string
+	if err := db.conn.QueryRow(ctx, `SELECT uri FROM bill_of_materials WHERE id = $1`, sbom).Scan(&uri); err != nil {
+		t.Fatal(err)
+	}
+	expected := db.expectedIDs(t)
+	sboms := db.sbomDependencies(t)
+	before := db.dependencyIDs(t)
+
+	report, err := db.migrate(t, func(o *options) { o.filter.collectors = valueList{"FileCollector"} })
+	if err != nil {
+		t.Fatalf("migrate() failed: %v", err)
+	}
+	if report.Filter != "collector=FileCollector" {
+		t.Errorf("report filter = %q, want collector=FileCollector", report.Filter)
+	}
+	var want []uuid.UUID
+	for _, id := range before {
+		if id == filed {
+			id = expected[filed]
+		}
+		want = append(want, id)
+	}
+	sortUUIDs(want)
+	if got := db.dependencyIDs(t); !equalUUIDs(got, want) {
+		t.Errorf("dependency IDs = %v, want only %s moved to %s", got, filed, expected[filed])
+	}
+	if got := db.sbomDependencies(t)[uri]; !equalUUIDs(got, []uuid.UUID{expected[filed]}) {
+		t.Errorf("SBOM %s includes %v, want %s", uri, got, expected[filed])
+	}
+	db.assertSBOMKeys(t)
+	filter := &rowFilter{collectors: valueList{"FileCollector"}}
+	v := &Verification{}
+	if _, _, err := checkDependencyIDs(ctx, db.conn, "public", keys.DefaultScheme, v, 10, filter); err != nil || v.RowsChecked != 1 || v.IDMismatches != 0 {
+		t.Errorf("checkDependencyIDs() of FileCollector = %+v, %v; want 1 row checked and no mismatch", v, err)
+	}
+
+	// The rest of the database is migrated by a run without the filter.
+	if _, err := db.migrate(t, nil); err != nil {
+		t.Fatalf("migrate() failed: %v", err)
+	}
+	db.assertMigrated(t, expected, sboms)
+}
+
+func TestMigrateCleanupNameColumns(t *testing.T) {
+	for _, mode := range []string{cleanupNull, cleanupDrop} {
+		t.Run(mode, func(t *testing.T) {
+			ctx := context.Background()
+			db := newTestDB(t)
+			db.load(t, "basic")
+			expected := db.expectedIDs(t)
+			sboms := db.sbomDependencies(t)
+
+			if _, err := db.migrate(t, func(o *options) { o.cleanup = mode }); err != nil {
+				t.Fatalf("migrate() failed: %v", err)
+			}
+			db.assertMigrated(t, expected, sboms)
+			columns := db.count(t, `SELECT count(*) FROM pg_attribute WHERE attrelid = `+dbSchema("public").regclassLiteral("dependencies")+` AND attname IN ('dependent_package_name_id', 'version_range') AND NOT attisdropped`)
+			if mode == cleanupNull {
+				if n := db.count(t, `SELECT count(*) FROM dependencies WHERE dependent_package_name_id IS NOT NULL OR version_range IS NOT NULL`); columns != 2 || n != 0 {
+					t.Errorf("%d of the columns left with %d rows set, want both left with none", columns, n)
+				}
+				return
+			}
+			if columns != 0 {
+				t.Errorf("%d of the columns left, want none", columns)
+			}
+			if n := db.count(t, `SELECT count(*) FROM pg_index WHERE indexrelid = `+dbSchema("public").regclassLiteral("dep_package_version_id")+` AND indisunique AND indpred IS NULL`); n != 1 {
+				t.Errorf("%d unique dep_package_version_id indexes on every row, want 1", n)
+			}
+			result, err := closestSchema(ctx, db.conn, "public")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if result.Closest != "v0.9" || !result.Exact {
+				t.Errorf("closestSchema() = %s (exact %v), want exactly v0.9", result.Closest, result.Exact)
+			}
+		})
+	}
+}
+
+func TestMigrateUnsafeSpeedups(t *testing.T) {
+	db := newTestDB(t)
+	db.load(t, "basic")
+	expected := db.expectedIDs(t)
+	sboms := db.sbomDependencies(t)
+
+	report, err := db.migrate(t, func(o *options) {
+		o.unsafeSpeedups = true
+		o.fast = true
+	})
+	if err != nil {
+		t.Fatalf("migrate() failed: %v", err)
+	}
+	db.assertMigrated(t, expected, sboms)
+	var settings []string
+	for _, c := range report.UnsafeSpeedups {
+		if c.Restored == "" {
+			t.Errorf("unsafe speedup %+v not restored", c)
+		}
+		settings = append(settings, c.Setting)
+	}
+	if len(settings) < 2 || settings[0] != "synchronous_commit" || settings[len(settings)-1] != "persistence of "+dependencyIDStagingTable {
+		t.Errorf("unsafe speedups reported %v, want synchronous_commit and the staging table among them", settings)
+	}
+}
+
+func TestMigrateGeneratedData(t *testing.T) {
+	ctx := context.Background()
+	db := newTestDB(t)
+	opts := fixtures.GenerateOptions{Dependencies: 2000, Packages: 50, VersionsPerPackage: 3, SBOMs: 7, Seed: 42}
+	stats, err := fixtures.Generate(ctx, db.conn, opts, nil)
+	if err != nil {
+		t.Fatalf("Generate() failed: %v", err)
+	}
+	if stats.Dependencies != 2000 || stats.SBOMDependencies != 2000 || stats.SBOMs != 7 || stats.PackageVersions != 150 {
+		t.Errorf("Generate() stats = %+v", stats)
+	}
+	expected := db.expectedIDs(t)
+	sboms := db.sbomDependencies(t)
+
+	if _, err := db.migrate(t, func(o *options) { o.fast = true; o.chunkSize = 500 }); err != nil {
+		t.Fatalf("migrate() failed: %v", err)
+	}
+	db.assertMigrated(t, expected, sboms)
+
+	// The same seed generates the same rows, and so the same IDs, again.
+	again := newTestDB(t)
+	if _, err := fixtures.Generate(ctx, again.conn, opts, nil); err != nil {
+		t.Fatalf("Generate() failed: %v", err)
+	}
+	var before []uuid.UUID
+	for id := range expected {
+		before = append(before, id)
+	}
+	sortUUIDs(before)
+	if got := again.dependencyIDs(t); !equalUUIDs(got, before) {
+		t.Errorf("Generate() with the same seed produced different dependencies")
+	}
+}
+
+func TestEstimateChangesNothing(t *testing.T) {
+	for _, fast := range []bool{false, true} {
+		t.Run(fmt.Sprintf("fast=%v", fast), func(t *testing.T) {
+			db := newTestDB(t)
+			db.load(t, "basic")
+			before := db.dependencyIDs(t)
+			sboms := db.sbomDependencies(t)
+
+			report, err := db.migrate(t, func(o *options) { o.estimate = true; o.estimateFrac = 1; o.fast = fast })
+			if err != nil {
+				t.Fatalf("migrate() with --estimate failed: %v", err)
+			}
+			if len(report.Estimates) != 1 {
+				t.Fatalf("report has %d estimates, want 1", len(report.Estimates))
+			}
+			e := report.Estimates[0]
+			if e.SampledDependencies != int64(len(before)) || e.UnresolvedSampleRows != 0 {
+				t.Errorf("estimate = %+v, want every dependency sampled and resolved", e)
+			}
+			var names []string
+			for _, pe := range e.Phases {
+				names = append(names, pe.Name)
+			}
+			want := "backfill,rewrite-ids,fix-refs,validate-constraints,verify"
+			if fast {
+				want = "backfill,stage-ids,rewrite-ids,fix-refs,validate-constraints,verify"
+			}
+			if got := strings.Join(names, ","); got != want {
+				t.Errorf("estimated phases %s, want %s", got, want)
+			}
+
+			if got := db.dependencyIDs(t); !equalUUIDs(got, before) {
+				t.Errorf("--estimate changed dependency IDs")
+			}
+			if n := db.count(t, `SELECT count(*) FROM dependencies WHERE dependent_package_version_id IS NOT NULL`); n != 2 {
+				t.Errorf("%d dependencies have dependent_package_version_id after --estimate, want the 2 of the fixture", n)
+			}
+			if got := db.sbomDependencies(t); len(got) != len(sboms) {
+				t.Errorf("--estimate changed SBOM references")
+			}
+			if n := db.count(t, `SELECT count(*) FROM pg_constraint WHERE conname = '`+dependencyFKName+`'`); n != 1 {
+				t.Errorf("foreign key %s is missing after --estimate", dependencyFKName)
+			}
+		})
+	}
+}
+
+func TestEmitSQLChangesNothing(t *testing.T) {
+	for _, fast := range []bool{false, true} {
+		t.Run(fmt.Sprintf("fast=%v", fast), func(t *testing.T) {
+			db := newTestDB(t)
+			db.load(t, "basic")
+			before := db.dependencyIDs(t)
+			expected := db.expectedIDs(t)
+
+			path := filepath.Join(t.TempDir(), "migration.sql")
+			if _, err := db.migrate(t, func(o *options) { o.emitSQL = path; o.fast = fast }); err != nil {
+				t.Fatalf("migrate() with --emit-sql failed: %v", err)
+			}
+			data, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			script := string(data)
+			for oldID, newID := range expected {
+				if oldID == newID {
+					continue
+				}
+				row := fmt.Sprintf("UPDATE public.dependencies SET id = '%s' WHERE id = '%s';", newID, oldID)
+				if fast {
+					row = fmt.Sprintf("%s\t%s\n", oldID, newID)
+				}
+				if !strings.Contains(script, row) {
+					t.Errorf("script does not rewrite %s to %s", oldID, newID)
+				}
+			}
+			if !strings.Contains(script, "-- Step verify\n") {
+				t.Errorf("script has no verify step")
+			}
+			var sum string
+			if err := db.conn.QueryRow(context.Background(), `SELECT `+dependencyChecksumSQL+` FROM public.dependencies d`).Scan(&sum); err != nil {
+				t.Fatal(err)
+			}
+			if !strings.Contains(script, "<> '"+sum+"' THEN") {
+				t.Errorf("script does not check the backfill chunk has checksum %s", sum)
+			}
+
+			if got := db.dependencyIDs(t); !equalUUIDs(got, before) {
+				t.Errorf("--emit-sql changed dependency IDs")
+			}
+			if n := db.count(t, `SELECT count(*) FROM dependencies WHERE dependent_package_version_id IS NOT NULL`); n != 2 {
+				t.Errorf("%d dependencies have dependent_package_version_id after --emit-sql, want the 2 of the fixture", n)
+			}
+		})
+	}
+}
+
+func TestMigrateWithAudit(t *testing.T) {
+	for _, fast := range []bool{false, true} {
+		t.Run(fmt.Sprintf("fast=%v", fast), func(t *testing.T) {
+			db := newTestDB(t)
+			db.load(t, "basic")
+			expected := db.expectedIDs(t)
+			sboms := db.sbomDependencies(t)
+
+			report, err := db.migrate(t, func(o *options) { o.audit = true; o.fast = fast })
+			if err != nil {
+				t.Fatalf("migrate() with --audit failed: %v", err)
+			}
+			db.assertMigrated(t, expected, sboms)
+			if report.AuditMigrationID == "" {
+				t.Fatalf("report has no audit_migration_id")
+			}
+
+			var changed, references int64
+			for oldID, newID := range expected {
+				if oldID == newID {
+					continue
+				}
+				changed++
+				for _, deps := range sboms {
+					for _, dep := range deps {
+						if dep == oldID {
+							references++
+						}
+					}
+				}
+			}
+			audited := func(table, column string) int64 {
+				return db.count(t, `SELECT count(*) FROM `+auditTable+` WHERE migration_id = '`+report.AuditMigrationID+`'
+					AND table_name = '`+table+`' AND column_name = '`+column+`'`)
+			}
+			if n := audited("dependencies", "dependent_package_version_id"); n != 5 {
+				t.Errorf("%d backfilled rows audited, want the 5 without a version in the fixture", n)
+			}
+			if n := audited("dependencies", "id"); n != changed {
+				t.Errorf("%d dependency ID changes audited, want %d", n, changed)
+			}
+			if n := audited("bill_of_materials_included_dependencies", "dependency_id"); n != references {
+				t.Errorf("%d SBOM reference changes audited, want %d", n, references)
+			}
+			if n := db.count(t, `SELECT count(*) FROM `+auditTable+` a
+				WHERE a.table_name = 'dependencies' AND a.column_name = 'id'
+				  AND NOT EXISTS (SELECT 1 FROM dependencies d WHERE d.id = a.new_id)`); n != 0 {
+				t.Errorf("%d audited new IDs do not exist", n)
+			}
+		})
+	}
+}
+
+func TestRepairOrphansRemapsFromAuditLog(t *testing.T) {
+	db := newTestDB(t)
+	db.load(t, "basic")
+	expected := db.expectedIDs(t)
+	sboms := db.sbomDependencies(t)
+
+	// A run that rewrote the IDs but stopped before repointing the SBOMs.
+	_, err := db.migrate(t, func(o *options) {
+		o.audit = true
+		o.skipSteps = stepList{"fix-refs", "add-constraints", "validate-constraints", "verify"}
+	})
+	if err != nil {
+		t.Fatalf("migrate() failed: %v", err)
+	}
+	orphans, err := countDanglingReferences(context.Background(), db.conn, "public")
+	if err != nil || orphans == 0 {
+		t.Fatalf("countDanglingReferences() = %d, %v; want orphans", orphans, err)
+	}
+
+	cf := &connFlags{dsnFile: db.dsnFile}
+	if repaired, err := repairOrphans(cf, orphanPolicyReport, "", "json", 0, true, io.Discard); err != nil || repaired {
+		t.Fatalf("repairOrphans(report) = %v, %v; want false", repaired, err)
+	}
+	if n, _ := countDanglingReferences(context.Background(), db.conn, "public"); n != orphans {
+		t.Fatalf("repairOrphans(report) changed the orphans from %d to %d", orphans, n)
+	}
+	if repaired, err := repairOrphans(cf, orphanPolicyRemap, "", "json", 0, true, io.Discard); err != nil || !repaired {
+		t.Fatalf("repairOrphans(remap) = %v, %v; want true", repaired, err)
+	}
+
+	if _, err := db.migrate(t, func(o *options) { o.steps = stepList{"add-constraints", "validate-constraints"} }); err != nil {
+		t.Fatalf("migrate() restoring the foreign key failed: %v", err)
+	}
+	db.assertMigrated(t, expected, sboms)
+}
+
+func TestRestoreConstraintsAfterCrash(t *testing.T) {
+	for _, fromFile := range []bool{false, true} {
+		t.Run(fmt.Sprintf("from-file=%v", fromFile), func(t *testing.T) {
+			db := newTestDB(t)
+			db.load(t, "basic")
+			expected := db.expectedIDs(t)
+			sboms := db.sbomDependencies(t)
+			snapshot := filepath.Join(t.TempDir(), "constraints.json")
+
+			// A run that dropped the foreign key and the indexes and died before rewriting anything.
+			_, err := db.migrate(t, func(o *options) {
+				o.rebuildIndexes = true
+				o.snapshotFile = snapshot
+				o.steps = stepList{"backfill", "snapshot-constraints", "drop-constraints", "drop-indexes"}
+			})
+			if err != nil {
+				t.Fatalf("migrate() failed: %v", err)
+			}
+			if n := db.count(t, `SELECT count(*) FROM pg_constraint WHERE conname = '`+dependencyFKName+`'`); n != 0 {
+				t.Fatalf("drop-constraints left %s in place", dependencyFKName)
+			}
+			if fromFile {
+				db.exec(t, `DROP TABLE `+constraintSnapshotTable+`, `+droppedForeignKeysTable+`, `+droppedIndexesTable)
+			}
+
+			file := ""
+			if fromFile {
+				file = snapshot
+			}
+			cf := &connFlags{dsnFile: db.dsnFile}
+			var out bytes.Buffer
+			if err := restoreConstraints(cf, file, false, &out); err != nil {
+				t.Fatalf("restoreConstraints() failed: %v", err)
+			}
+			t.Log(out.String())
+			if n := db.count(t, `SELECT count(*) FROM pg_constraint WHERE conname = '`+dependencyFKName+`' AND convalidated`); n != 1 {
+				t.Errorf("restoreConstraints() did not restore %s", dependencyFKName)
+			}
+			if n := db.count(t, `SELECT count(*) FROM pg_class WHERE relname IN ('`+constraintSnapshotTable+`', '`+droppedForeignKeysTable+`', '`+droppedIndexesTable+`')`); n != 0 {
+				t.Errorf("restoreConstraints() left %d of the tables recording the dropped constraints behind", n)
+			}
+			if err := restoreConstraints(cf, snapshot, false, io.Discard); err != nil {
+				t.Errorf("restoreConstraints() failed with everything in place: %v", err)
+			}
+
+			if _, err := db.migrate(t, nil); err != nil {
+				t.Fatalf("migrate() after restoring the constraints failed: %v", err)
+			}
+			db.assertMigrated(t, expected, sboms)
+			if n := db.count(t, `SELECT count(*) FROM pg_class WHERE relname = '`+constraintSnapshotTable+`'`); n != 0 {
+				t.Errorf("%s was left behind", constraintSnapshotTable)
+			}
+		})
+	}
+}
+
+func TestMigrateQuarantinesFailingRows(t *testing.T) {
+	ctx := context.Background()
+	db := newTestDB(t)
+	db.load(t, "basic")
+	expected := db.expectedIDs(t)
+	ids := db.dependencyIDs(t)
+	failing := ids[0]
+	db.exec(t, `
+		CREATE FUNCTION fail_rewrite() RETURNS trigger LANGUAGE plpgsql AS $$
+		BEGIN
+			IF OLD.id = '`+failing.String()+`' THEN
+				RAISE EXCEPTION 'refusing to move %', OLD.id;
+			END IF;
+			RETURN NEW;
+		END $$;
+		CREATE TRIGGER fail_rewrite BEFORE UPDATE OF id ON dependencies FOR EACH ROW EXECUTE FUNCTION fail_rewrite();
+	`)
+	f := fixtures.NewFactory(db.conn)
+	pkg, err := f.PackageVersion(ctx, "pypi", "flask", "3.0.0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	unresolved, err := f.Dependency(ctx, fixtures.Dependency{Package: pkg, DependsOn: fixtures.PackageVersion{NameID: pkg.NameID, Version: ">=2.0"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	report, err := db.migrate(t, func(o *options) { o.errorPolicy = errorPolicyQuarantine; o.maxQuarantined = 10 })
+	if err != nil {
+		t.Fatalf("migrate() failed: %v", err)
+	}
+	quarantined := map[string]bool{}
+	for _, q := range report.Quarantined {
+		quarantined[q.ID] = true
+	}
+	if len(report.Quarantined) != 2 || !quarantined[failing.String()] || !quarantined[unresolved.String()] {
+		t.Errorf("report.Quarantined = %+v, want %s and %s", report.Quarantined, failing, unresolved)
+	}
+	if n := db.count(t, `SELECT count(*) FROM `+quarantineTable+` WHERE migration_id = '`+report.QuarantineMigrationID+`'`); n != 2 {
+		t.Errorf("%s has %d rows of the run, want 2", quarantineTable, n)
+	}
+	if v := report.Verification; v == nil || !v.Passed || v.Quarantined != 2 {
+		t.Errorf("report.Verification = %+v, want passed with 2 quarantined", v)
+	}
+
+	want := []uuid.UUID{failing, unresolved}
+	for _, id := range ids[1:] {
+		want = append(want, expected[id])
+	}
+	sortUUIDs(want)
+	if got := db.dependencyIDs(t); !equalUUIDs(got, want) {
+		t.Errorf("dependency IDs = %v, want %v", got, want)
+	}
+	if n, err := countDanglingReferences(ctx, db.conn, "public"); err != nil || n != 0 {
+		t.Errorf("countDanglingReferences() = %d, %v; want 0", n, err)
+	}
+
+	report, err = db.migrate(t, func(o *options) { o.errorPolicy = errorPolicyQuarantine; o.maxQuarantined = 1 })
+	if err == nil {
+		t.Fatalf("migrate() succeeded with more failing rows than --max-quarantined")
+	}
+	if len(report.Quarantined) > 1 {
+		t.Errorf("report.Quarantined = %+v, more than --max-quarantined", report.Quarantined)
+	}
+}
+
+func TestMigrateRequiresRecentBackup(t *testing.T) {
+	db := newTestDB(t)
+	db.load(t, "basic")
+	expected := db.expectedIDs(t)
+	sboms := db.sbomDependencies(t)
+	ids := db.dependencyIDs(t)
+	requireBackup := func(o *options) { o.backupWithin = 24 * time.Hour }
+
+	if _, err := db.migrate(t, requireBackup); err == nil || !strings.Contains(err.Error(), "record-backup") {
+		t.Fatalf("migrate() without a recorded backup = %v, want an error pointing at record-backup", err)
+	}
+	if got := db.dependencyIDs(t); !equalUUIDs(got, ids) {
+		t.Errorf("migrate() without a recorded backup rewrote the dependency IDs")
+	}
+
+	cf := &connFlags{dsnFile: db.dsnFile}
+	if err := recordBackup(cf, "stale", time.Now().Add(-48*time.Hour).Format(time.RFC3339)); err != nil {
+		t.Fatalf("recordBackup() failed: %v", err)
+	}
+	if _, err := db.migrate(t, requireBackup); err == nil || !strings.Contains(err.Error(), "stale") {
+		t.Fatalf("migrate() with a 48h old backup = %v, want it refused", err)
+	}
+
+	if err := recordBackup(cf, "pg_dump guac.dump", ""); err != nil {
+		t.Fatalf("recordBackup() failed: %v", err)
+	}
+	if _, err := db.migrate(t, requireBackup); err != nil {
+		t.Fatalf("migrate() with a fresh backup failed: %v", err)
+	}
+	db.assertMigrated(t, expected, sboms)
+}
+
+func TestMigratePartitionedDependencies(t *testing.T) {
+	db := newTestDB(t)
+	db.load(t, "basic")
+	expected := db.expectedIDs(t)
+	sboms := db.sbomDependencies(t)
+	db.exec(t, `
+		ALTER TABLE bill_of_materials_included_dependencies DROP CONSTRAINT `+dependencyFKName+`;
+		ALTER TABLE dependencies RENAME TO dependencies_unpartitioned;
+		CREATE TABLE dependencies (LIKE dependencies_unpartitioned INCLUDING DEFAULTS) PARTITION BY HASH (id);
+		ALTER TABLE dependencies ADD PRIMARY KEY (id);
+		CREATE TABLE dependencies_p0 PARTITION OF dependencies FOR VALUES WITH (MODULUS 3, REMAINDER 0);
+		CREATE TABLE dependencies_p1 PARTITION OF dependencies FOR VALUES WITH (MODULUS 3, REMAINDER 1);
+		CREATE TABLE dependencies_p2 PARTITION OF dependencies FOR VALUES WITH (MODULUS 3, REMAINDER 2);
+		INSERT INTO dependencies SELECT * FROM dependencies_unpartitioned;
+		DROP TABLE dependencies_unpartitioned;
+		ALTER TABLE bill_of_materials_included_dependencies ADD CONSTRAINT `+dependencyFKName+`
+			FOREIGN KEY (dependency_id) REFERENCES dependencies(id) ON DELETE CASCADE;
+	`)
+
+	for _, configure := range []func(o *options){
+		func(o *options) { o.online = true },
+		func(o *options) { o.rebuildIndexes = true },
+	} {
+		if _, err := db.migrate(t, configure); err == nil || !strings.Contains(err.Error(), "partitioned") {
+			t.Errorf("migrate() = %v, want it refused on a partitioned table", err)
+		}
+	}
+
+	if _, err := db.migrate(t, func(o *options) { o.workers = 2 }); err != nil {
+		t.Fatalf("migrate() failed: %v", err)
+	}
+	db.assertMigrated(t, expected, sboms)
+	if n := db.count(t, `SELECT count(*) FROM pg_constraint WHERE contype = 'f' AND conrelid = 'bill_of_materials_included_dependencies'::regclass AND conislocal`); n != 1 {
+		t.Errorf("%d foreign keys on bill_of_materials_included_dependencies after the migration, want 1", n)
+	}
+}
+
+func TestMigrateHookMode(t *testing.T) {
+	db := newTestDB(t)
+	db.load(t, "basic")
+	expected := db.expectedIDs(t)
+	sboms := db.sbomDependencies(t)
+	hook := func(o *options) { o.hookMode = true }
+
+	_, err := db.migrate(t, func(o *options) { hook(o); o.deadline = time.Now() })
+	if !errors.Is(err, ErrDeadlineReached) {
+		t.Fatalf("migrate() past --max-runtime = %v, want ErrDeadlineReached", err)
+	}
+	if n := db.count(t, `SELECT count(*) FROM `+runStateTable+` WHERE state->'completed' ? 'dependency-version-ids/backfill'`); n != 0 {
+		t.Errorf("the saved state has the backfill completed, though the run stopped before it")
+	}
+	if n := db.count(t, `SELECT count(*) FROM `+runStateTable); n != 1 {
+		t.Fatalf("%d states saved in %s, want 1", n, runStateTable)
+	}
+
+	if _, err := db.migrate(t, hook); err != nil {
+		t.Fatalf("migrate() failed: %v", err)
+	}
+	db.assertMigrated(t, expected, sboms)
+	if n := db.count(t, `SELECT count(*) FROM `+runStateTable); n != 0 {
+		t.Errorf("%d states left in %s after the run finished", n, runStateTable)
+	}
+	if _, err := db.migrate(t, hook); !errors.Is(err, errAlreadyMigrated) {
+		t.Errorf("migrate() of a migrated database = %v, want errAlreadyMigrated", err)
+	}
+}
+
+// An init container succeeds whether it migrated the database or found nothing to migrate, and
+// records both in the completion table.
+func TestMigrateInitContainer(t *testing.T) {
+	db := newTestDB(t)
+	db.load(t, "basic")
+	expected := db.expectedIDs(t)
+	sboms := db.sbomDependencies(t)
+	initContainer := func(o *options) {
+		o.initContainer, o.waitForDB, o.waitTimeout = true, true, time.Minute
+		o.completionRow = true
+	}
+
+	if _, err := db.migrate(t, initContainer); err != nil {
+		t.Fatalf("migrate() failed: %v", err)
+	}
+	db.assertMigrated(t, expected, sboms)
+	if _, err := db.migrate(t, initContainer); !errors.Is(err, errAlreadyMigrated) {
+		t.Errorf("migrate() of a migrated database = %v, want errAlreadyMigrated", err)
+	}
+	if n := db.count(t, `SELECT count(*) FROM `+completionTable+` WHERE outcome = 'success' AND 'dependency-version-ids' = ANY(migrations)`); n != 1 {
+		t.Errorf("%d successful migrations recorded in %s, want 1", n, completionTable)
+	}
+	if n := db.count(t, `SELECT count(*) FROM `+completionTable+` WHERE outcome = 'already-migrated'`); n != 1 {
+		t.Errorf("%d runs with nothing to migrate recorded in %s, want 1", n, completionTable)
+	}
+}
+
+// A step is not started when the deadline is closer than its --step-timeout; the report says
+// what is left, and the next run resumes from the saved state.
+func TestMigrateStopsBeforeStepTimeout(t *testing.T) {
+	db := newTestDB(t)
+	db.load(t, "basic")
+	expected := db.expectedIDs(t)
+	sboms := db.sbomDependencies(t)
+	unresolved := db.count(t, `SELECT count(*) FROM dependencies WHERE dependent_package_name_id IS NOT NULL AND dependent_package_version_id IS NULL`)
+	stateFile := filepath.Join(t.TempDir(), "state.json")
+
+	report, err := db.migrate(t, func(o *options) {
+		o.stateFile = stateFile
+		o.deadline = time.Now().Add(time.Hour)
+		if err := o.stepTimeouts.Set("backfill=2h"); err != nil {
+			t.Fatal(err)
+		}
+	})
+	if !errors.Is(err, ErrDeadlineReached) {
+		t.Fatalf("migrate() with less time left than the --step-timeout = %v, want ErrDeadlineReached", err)
+	}
+	if report.Remaining == nil || len(report.Remaining.Steps) == 0 || report.Remaining.Steps[0] != "dependency-version-ids/backfill" {
+		t.Fatalf("remaining = %+v, want the steps from the backfill on", report.Remaining)
+	}
+	if report.Remaining.BackfillRows != unresolved {
+		t.Errorf("%d rows left to backfill, want %d", report.Remaining.BackfillRows, unresolved)
+	}
+
+	if _, err := db.migrate(t, func(o *options) { o.stateFile = stateFile }); err != nil {
+		t.Fatalf("migrate() failed: %v", err)
+	}
+	db.assertMigrated(t, expected, sboms)
+}
+
+func TestDiffAfterMigration(t *testing.T) {
+	before := newTestDB(t)
+	before.load(t, "basic")
+	after := newTestDB(t)
+	after.load(t, "basic")
+	if _, err := after.migrate(t, nil); err != nil {
+		t.Fatalf("migrate() failed: %v", err)
+	}
+
+	var out bytes.Buffer
+	identical, err := diffGraphs(&connFlags{dsnFile: before.dsnFile}, &connFlags{dsnFile: after.dsnFile}, "text", 20, &out)
+	if err != nil {
+		t.Fatalf("diffGraphs() failed: %v", err)
+	}
+	if !identical {
+		t.Errorf("diffGraphs() of the migrated database reports differences:\n%s", out.String())
+	}
+
+	after.exec(t, `DELETE FROM bill_of_materials_included_dependencies WHERE dependency_id = (SELECT min(dependency_id::text)::uuid FROM bill_of_materials_included_dependencies)`)
+	after.exec(t, `UPDATE dependencies SET justification = 'changed' WHERE id = (SELECT min(id::text)::uuid FROM dependencies)`)
+	out.Reset()
+	identical, err = diffGraphs(&connFlags{dsnFile: before.dsnFile}, &connFlags{dsnFile: after.dsnFile}, "json", 20, &out)
+	if err != nil {
+		t.Fatalf("diffGraphs() failed: %v", err)
+	}
+	var g graphDiff
+	if err := json.Unmarshal(out.Bytes(), &g); err != nil {
+		t.Fatalf("invalid JSON output: %v", err)
+	}
+	if identical || g.Identical {
+		t.Fatal("diffGraphs() of a changed database reports no differences")
+	}
+	deps, inclusions := g.Relations[0], g.Relations[1]
+	if deps.Missing != 1 || deps.Extra != 1 {
+		t.Errorf("dependencies: %d missing, %d extra, want 1 and 1", deps.Missing, deps.Extra)
+	}
+	if inclusions.Missing == 0 {
+		t.Errorf("%s: nothing missing, though a row was deleted", inclusions.Relation)
+	}
+}
+
+func TestAuditAndApplyPlan(t *testing.T) {
+	db := newTestDB(t)
+	db.load(t, "basic")
+	expected := db.expectedIDs(t)
+	sboms := db.sbomDependencies(t)
+	ids := db.dependencyIDs(t)
+	cf := &connFlags{dsnFile: db.dsnFile}
+	plan := filepath.Join(t.TempDir(), "plan.json")
+
+	if consistent, err := auditDatabase(cf, keys.DefaultScheme, plan, "", false, "json", 0, io.Discard); err != nil || consistent {
+		t.Fatalf("auditDatabase() = %v, %v; want inconsistencies", consistent, err)
+	}
+	if got := db.dependencyIDs(t); !equalUUIDs(got, ids) {
+		t.Fatal("auditDatabase() changed the dependency IDs")
+	}
+
+	// A plan made before the database changed is rolled back as a whole.
+	if _, err := db.migrate(t, func(o *options) { o.steps = stepList{"backfill"} }); err != nil {
+		t.Fatalf("migrate() failed: %v", err)
+	}
+	if err := applyPlan(cf, plan, true, io.Discard); err == nil || !strings.Contains(err.Error(), "audit it again") {
+		t.Fatalf("applyPlan() of a stale plan = %v, want it rolled back", err)
+	}
+	if got := db.dependencyIDs(t); !equalUUIDs(got, ids) {
+		t.Fatal("applyPlan() of a stale plan changed the dependency IDs")
+	}
+
+	if _, err := auditDatabase(cf, keys.DefaultScheme, plan, "", false, "json", 0, io.Discard); err != nil {
+		t.Fatalf("auditDatabase() failed: %v", err)
+	}
+	if err := applyPlan(cf, plan, true, io.Discard); err != nil {
+		t.Fatalf("applyPlan() failed: %v", err)
+	}
+	db.assertMigrated(t, expected, sboms)
+	if consistent, err := auditDatabase(cf, keys.DefaultScheme, plan, "", false, "json", 0, io.Discard); err != nil || !consistent {
+		t.Errorf("auditDatabase() after applyPlan() = %v, %v; want consistent", consistent, err)
+	}
+}
+
+func TestMigrateNormalizesPurls(t *testing.T) {
+	db := newTestDB(t)
+	db.load(t, "basic")
+	expected := db.expectedIDs(t)
+	sboms := db.sbomDependencies(t)
+	types := db.count(t, `SELECT count(*) FROM package_types`)
+
+	// A copy of the package of an included dependency, under the type spelled in upper case,
+	// with a copy of the dependency in the same SBOMs.
+	const first = `(SELECT min(dependency_id::text)::uuid FROM bill_of_materials_included_dependencies)`
+	const pkg = `FROM dependencies d JOIN package_versions v ON v.id = d.package_id JOIN package_names n ON n.id = v.name_id
+		JOIN package_namespaces ns ON ns.id = n.namespace_id JOIN package_types t ON t.id = ns.package_id WHERE d.id = ` + first
+	db.exec(t, `INSERT INTO package_types (id, type) SELECT '00000000-0000-4000-8000-000000000001', upper(t.type) `+pkg)
+	db.exec(t, `INSERT INTO package_namespaces (id, namespace, package_id) SELECT '00000000-0000-4000-8000-000000000002', ns.namespace, '00000000-0000-4000-8000-000000000001' `+pkg)
+	db.exec(t, `INSERT INTO package_names (id, name, namespace_id) SELECT '00000000-0000-4000-8000-000000000003', n.name, '00000000-0000-4000-8000-000000000002' `+pkg)
+	db.exec(t, `INSERT INTO package_versions (id, name_id, version, subpath, qualifiers, hash)
+		SELECT '00000000-0000-4000-8000-000000000004', '00000000-0000-4000-8000-000000000003', v.version, v.subpath, v.qualifiers, v.hash `+pkg)
+	db.exec(t, `INSERT INTO dependencies (id, package_id, dependent_package_name_id, dependent_package_version_id, version_range, dependency_type, justification, origin, collector, document_ref)
+		SELECT '00000000-0000-4000-8000-000000000005', '00000000-0000-4000-8000-000000000004', dependent_package_name_id, dependent_package_version_id, version_range, dependency_type, justification, origin, collector, document_ref
+		FROM dependencies WHERE id = `+first)
+	db.exec(t, `INSERT INTO bill_of_materials_included_dependencies (bill_of_materials_id, dependency_id)
+		SELECT bill_of_materials_id, '00000000-0000-4000-8000-000000000005' FROM bill_of_materials_included_dependencies WHERE dependency_id = `+first)
+
+	if _, err := db.migrate(t, func(o *options) { o.normalizePurls = true; o.audit = true }); err != nil {
+		t.Fatalf("migrate() failed: %v", err)
+	}
+	db.assertMigrated(t, expected, sboms)
+	if n := db.count(t, `SELECT count(*) FROM package_types`); n != types {
+		t.Errorf("%d package types after the migration, want %d", n, types)
+	}
+	if n := db.count(t, `SELECT count(*) FROM package_types WHERE type <> lower(type)`); n != 0 {
+		t.Errorf("%d package types are not lowercase after the migration", n)
+	}
+	if n := db.count(t, `SELECT count(*) FROM `+auditTable+` WHERE table_name = 'dependencies' AND column_name = 'id' AND old_id = '00000000-0000-4000-8000-000000000005'`); n != 1 {
+		t.Errorf("%d audit rows record merging the copied dependency, want 1", n)
+	}
+}
+
+// A dependency a GUAC on the new scheme ingested again, under the new ID of an old-scheme row, is
+// merged with it instead of failing on the primary key.
+func TestMigrateMergesRowsAlreadyAtTheirNewID(t *testing.T) {
+	db := newTestDB(t)
+	db.load(t, "basic")
+	expected := db.expectedIDs(t)
+	sboms := db.sbomDependencies(t)
+
+	const resolved = `FROM dependencies d
+		JOIN bill_of_materials_included_dependencies b ON b.dependency_id = d.id
+		LEFT JOIN package_versions pv ON pv.name_id = d.dependent_package_name_id AND pv.version = d.version_range
+		WHERE coalesce(d.dependent_package_version_id, pv.id) IS NOT NULL`
+	old := db.uuids(t, `SELECT min(d.id::text)::uuid `+resolved)[0]
+	kept := expected[old]
+	db.exec(t, `INSERT INTO dependencies (id, package_id, dependent_package_version_id, dependency_type, justification, origin, collector, document_ref)
+		SELECT '`+kept.String()+`', d.package_id, coalesce(d.dependent_package_version_id, pv.id), d.dependency_type, d.justification, d.origin, d.collector, d.document_ref
+		`+resolved+` AND d.id = '`+old.String()+`' LIMIT 1`)
+	db.exec(t, `INSERT INTO bill_of_materials_included_dependencies (bill_of_materials_id, dependency_id)
+		SELECT bill_of_materials_id, '`+kept.String()+`' FROM bill_of_materials_included_dependencies WHERE dependency_id = '`+old.String()+`'`)
+
+	report, err := db.migrate(t, func(o *options) { o.audit = true })
+	if err != nil {
+		t.Fatalf("migrate() failed: %v", err)
+	}
+	db.assertMigrated(t, expected, sboms)
+	if len(report.Merged) != 1 || report.Merged[0].NewID != kept.String() || len(report.Merged[0].OldIDs) != 1 || report.Merged[0].OldIDs[0] != old.String() {
+		t.Errorf("report merged %+v, want %s merged into %s", report.Merged, old, kept)
+	}
+	if n := db.count(t, `SELECT count(*) FROM `+auditTable+` WHERE table_name = 'dependencies' AND column_name = 'id' AND old_id = '`+old.String()+`' AND new_id = '`+kept.String()+`'`); n != 1 {
+		t.Errorf("%d audit rows record merging %s, want 1", n, old)
+	}
+}
+
+// A dependency a GUAC still on the old version writes after the migration is moved to its new
+// ID by a pass of --daemon, or merged into the row already at it, with its SBOM references.
+func TestMigrateDaemonReconciles(t *testing.T) {
+	db := newTestDB(t)
+	db.load(t, "basic")
+	if _, err := db.migrate(t, nil); err != nil {
+		t.Fatalf("migrate() failed: %v", err)
+	}
+	row := db.uuids(t, `SELECT min(d.id::text)::uuid FROM dependencies d
+		JOIN bill_of_materials_included_dependencies b ON b.dependency_id = d.id
+		WHERE d.dependent_package_name_id IS NOT NULL`)[0]
+	moved, merged := uuid.New(), uuid.New()
+	for id, suffix := range map[uuid.UUID]string{moved: " (straggler)", merged: ""} {
+		db.exec(t, `INSERT INTO dependencies (id, package_id, dependent_package_name_id, version_range, dependency_type, justification, origin, collector, document_ref)
+			SELECT '`+id.String()+`', package_id, dependent_package_name_id, version_range, dependency_type, justification || '`+suffix+`', origin, collector, document_ref
+			FROM dependencies WHERE id = '`+row.String()+`'`)
+		db.exec(t, `INSERT INTO bill_of_materials_included_dependencies (bill_of_materials_id, dependency_id)
+			SELECT bill_of_materials_id, '`+id.String()+`' FROM bill_of_materials_included_dependencies WHERE dependency_id = '`+row.String()+`'`)
+	}
+	expected := db.expectedIDs(t)
+	if expected[merged] != row {
+		t.Fatalf("the duplicate of %s hashes to %s", row, expected[merged])
+	}
+	sboms := db.count(t, `SELECT count(*) FROM bill_of_materials_included_dependencies WHERE dependency_id = '`+row.String()+`'`)
+
+	report, err := db.migrate(t, func(o *options) { o.reconciling = true; o.audit = true })
+	if err != nil {
+		t.Fatalf("reconcile failed: %v", err)
+	}
+	if n := report.reconciled(); n != 2 {
+		t.Errorf("reconciled %d dependencies, want 2", n)
+	}
+	if len(report.Merged) != 1 || report.Merged[0].NewID != row.String() || report.Merged[0].OldIDs[0] != merged.String() {
+		t.Errorf("report merged %+v, want %s merged into %s", report.Merged, merged, row)
+	}
+	for old, id := range db.expectedIDs(t) {
+		if old != id {
+			t.Errorf("dependency %s is not at its new ID %s", old, id)
+		}
+	}
+	if n := db.count(t, `SELECT count(*) FROM bill_of_materials_included_dependencies WHERE dependency_id = '`+expected[moved].String()+`'`); n != sboms {
+		t.Errorf("%d SBOMs include the moved dependency, want %d", n, sboms)
+	}
+	if n := db.count(t, `SELECT count(*) FROM bill_of_materials_included_dependencies WHERE dependency_id = '`+row.String()+`'`); n != sboms {
+		t.Errorf("%d SBOMs include the dependency merged into, want %d", n, sboms)
+	}
+	if n := db.count(t, `SELECT count(*) FROM `+auditTable+` WHERE table_name = 'dependencies' AND column_name = 'id' AND old_id IN ('`+moved.String()+`', '`+merged.String()+`')`); n != 2 {
+		t.Errorf("%d audit rows record the reconciled IDs, want 2", n)
+	}
+
+	report, err = db.migrate(t, func(o *options) { o.reconciling = true })
+	if err != nil || report.reconciled() != 0 {
+		t.Errorf("second pass reconciled %d dependencies, %v; want none", report.reconciled(), err)
+	}
+
+	// A dependency written once the first pass created the trigger is queued by it, and taken
+	// off the queue once migrated.
+	late := uuid.New()
+	db.exec(t, `INSERT INTO dependencies (id, package_id, dependent_package_name_id, version_range, dependency_type, justification, origin, collector, document_ref)
+		SELECT '`+late.String()+`', package_id, dependent_package_name_id, version_range, dependency_type, justification || ' (late)', origin, collector, document_ref
+		FROM dependencies WHERE id = '`+row.String()+`'`)
+	if n := db.count(t, `SELECT count(*) FROM `+reconcileQueueTable+` WHERE id = '`+late.String()+`'`); n != 1 {
+		t.Errorf("%d queue rows for the dependency written after the trigger, want 1", n)
+	}
+	report, err = db.migrate(t, func(o *options) { o.reconciling = true })
+	if err != nil || report.reconciled() != 1 {
+		t.Errorf("third pass reconciled %d dependencies, %v; want 1", report.reconciled(), err)
+	}
+	if n := db.count(t, `SELECT count(*) FROM `+reconcileQueueTable+` WHERE id = '`+late.String()+`'`); n != 0 {
+		t.Errorf("%d queue rows for the migrated dependency, want none", n)
+	}
+}
+
+// A role with DML privileges only migrates with --no-ddl, and the foreign key it cannot drop is
+// the one the database had before. Without a privilege it fails before changing anything.
+func TestMigrateNoDDL(t *testing.T) {
+	db := newTestDB(t)
+	db.load(t, "basic")
+	expected := db.expectedIDs(t)
+	sboms := db.sbomDependencies(t)
+	fk := `SELECT oid::text::bigint FROM pg_constraint WHERE conname = '` + dependencyFKName + `'`
+	before := db.count(t, fk)
+
+	role := fmt.Sprintf("guac_dml_%d", testDBCount.Add(1))
+	if _, err := db.conn.Exec(context.Background(), `CREATE ROLE `+role+` LOGIN PASSWORD 'dml'`); err != nil {
+		t.Skipf("cannot create a role on the test server: %v", err)
+	}
+	t.Cleanup(func() {
+		db.exec(t, `DROP OWNED BY `+role)
+		db.exec(t, `DROP ROLE `+role)
+	})
+	db.exec(t, `GRANT USAGE ON SCHEMA public TO `+role)
+	db.exec(t, `GRANT SELECT, INSERT, UPDATE, DELETE ON ALL TABLES IN SCHEMA public TO `+role)
+	db.exec(t, `REVOKE DELETE ON bill_of_materials_included_dependencies FROM `+role)
+	dsn, err := os.ReadFile(db.dsnFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, err := url.Parse(strings.TrimSpace(string(dsn)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	u.User = url.UserPassword(role, "dml")
+	dsnFile := filepath.Join(t.TempDir(), "dsn")
+	if err := os.WriteFile(dsnFile, []byte(u.String()+"\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	asRole := func(o *options) {
+		o.conn = connFlags{dsnFile: dsnFile}
+		o.noDDL = true
+	}
+
+	if _, err := db.migrate(t, asRole); err == nil || !strings.Contains(err.Error(), "DELETE on public.bill_of_materials_included_dependencies") {
+		t.Fatalf("migrate() without DELETE = %v, want it to name the missing privilege", err)
+	}
+	for old, id := range db.expectedIDs(t) {
+		if expected[old] != id {
+			t.Fatalf("migrate() without DELETE changed dependency %s", old)
+		}
+	}
+
+	db.exec(t, `GRANT DELETE ON bill_of_materials_included_dependencies TO `+role)
+	if _, err := db.migrate(t, asRole); err != nil {
+		t.Fatalf("migrate() with --no-ddl failed: %v", err)
+	}
+	db.assertMigrated(t, expected, sboms)
+	if after := db.count(t, fk); after != before {
+		t.Errorf("foreign key %s was re-created", dependencyFKName)
+	}
+}
+
+// GUAC's tables can live in a schema of their own, whose name needs quoting; the tool's tables
+// are created next to them and nothing is left in public.
+func TestMigrateInOtherSchema(t *testing.T) {
+	for _, fast := range []bool{false, true} {
+		t.Run(fmt.Sprintf("fast=%v", fast), func(t *testing.T) {
+			db := newTestDB(t)
+			db.load(t, "basic")
+			expected := db.expectedIDs(t)
+			sboms := db.sbomDependencies(t)
+			db.exec(t, `ALTER SCHEMA public RENAME TO "Tenant A"`)
+			db.exec(t, `CREATE SCHEMA public`)
+			db.exec(t, `SET search_path TO "Tenant A"`)
+
+			if _, err := db.migrate(t, func(o *options) { o.conn.schema = "Tenant A"; o.fast = fast; o.audit = true }); err != nil {
+				t.Fatalf("migrate() failed: %v", err)
+			}
+			db.assertMigrated(t, expected, sboms)
+			if n := db.count(t, `SELECT count(*) FROM pg_class c JOIN pg_namespace n ON n.oid = c.relnamespace WHERE n.nspname = 'public'`); n != 0 {
+				t.Errorf("%d relations were created in public", n)
+			}
+			if n := db.count(t, `SELECT count(*) FROM "Tenant A".`+auditTable); n == 0 {
+				t.Errorf("no audit rows in %q.%s", "Tenant A", auditTable)
+			}
+		})
+	}
+}
+
+// A fixture exported from a database loads into another one with the same rows, and an
+// anonymized one still migrates as the original did.
+func TestFixtureExportImport(t *testing.T) {
+	ctx := context.Background()
+	src := newTestDB(t)
+	src.load(t, "basic")
+	expected := src.expectedIDs(t)
+	sboms := src.sbomDependencies(t)
+
+	for _, anonymized := range []bool{false, true} {
+		var buf bytes.Buffer
+		var opts fixtures.ExportOptions
+		if anonymized {
+			var err error
+			if opts.Anonymizer, err = anonymize.New(); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if _, err := fixtures.Export(ctx, src.conn, &buf, opts); err != nil {
+			t.Fatalf("Export(anonymized %v) failed: %v", anonymized, err)
+		}
+		dst := newTestDB(t)
+		header, counts, err := fixtures.Import(ctx, dst.conn, &buf)
+		if err != nil {
+			t.Fatalf("Import(anonymized %v) failed: %v", anonymized, err)
+		}
+		if header.Anonymized != anonymized || counts["dependencies"] != int64(len(expected)) {
+			t.Errorf("Import(anonymized %v) = anonymized %v, %d dependencies; want %d", anonymized, header.Anonymized, counts["dependencies"], len(expected))
+		}
+		if !anonymized {
+			if !reflect.DeepEqual(dst.sbomDependencies(t), sboms) || !reflect.DeepEqual(dst.expectedIDs(t), expected) {
+				t.Errorf("the imported dependencies and SBOMs differ from the exported ones")
+			}
+			continue
+		}
+		if n := dst.count(t, `SELECT count(*) FROM package_names WHERE name NOT LIKE 'anon-%'`); n != 0 {
+			t.Errorf("%d package names not anonymized", n)
+		}
+		exported := make(map[uuid.UUID]bool)
+		for _, id := range src.dependencyIDs(t) {
+			exported[id] = true
+		}
+		for _, id := range dst.dependencyIDs(t) {
+			if exported[id] {
+				t.Errorf("dependency ID %s not anonymized", id)
+			}
+		}
+		anonymizedIDs, anonymizedSBOMs := dst.expectedIDs(t), dst.sbomDependencies(t)
+		if len(anonymizedSBOMs) != len(sboms) {
+			t.Errorf("%d SBOMs include dependencies after anonymizing, want %d", len(anonymizedSBOMs), len(sboms))
+		}
+		if _, err := dst.migrate(t, nil); err != nil {
+			t.Fatalf("migrate() of the anonymized fixture failed: %v", err)
+		}
+		dst.assertMigrated(t, anonymizedIDs, anonymizedSBOMs)
+	}
+}
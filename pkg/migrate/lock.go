@@ -0,0 +1,94 @@
+package migrate
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// migrationLockKey identifies the advisory lock held for the whole run. It is
+// the ASCII encoding of "guacmigr" so it is recognisable in pg_locks.
+const migrationLockKey int64 = 0x677561636d696772
+
+// errMigrationInProgress is returned when another session already holds the migration lock.
+var errMigrationInProgress = errors.New("another migration is already in progress against this database")
+
+// lockHolder returns errMigrationInProgress naming the session holding the migration lock.
+func lockHolder(ctx context.Context, conn *pgx.Conn) error {
+	var pid int32
+	var user, app string
+	err := conn.QueryRow(ctx, `
+		SELECT a.pid, coalesce(a.usename, ''), coalesce(a.application_name, '')
+		FROM pg_locks l JOIN pg_stat_activity a ON a.pid = l.pid
+		WHERE l.locktype = 'advisory' AND l.granted
+		  AND l.classid::bigint = ($1::bigint >> 32) AND l.objid::bigint = ($1::bigint & 4294967295) AND l.objsubid = 1
+		LIMIT 1
+	`, migrationLockKey).Scan(&pid, &user, &app)
+	if err != nil {
+		return errMigrationInProgress
+	}
+	return fmt.Errorf("%w (held by pid %d, user %q, application %q)", errMigrationInProgress, pid, user, app)
+}
+
+// heldLock is the migration lock of a run: a transaction-level advisory lock, in a transaction
+// left open on a connection of its own until the run ends. Unlike a session-level lock it
+// holds through a transaction pooler, which keeps the server connection of an open transaction
+// for it, so a run excludes the others whether or not --pooler-compat detects the pooler. The
+// transaction writes nothing, so the active writer check does not see it, and it is rolled back
+// by the server when the connection is lost.
+type heldLock struct {
+	conn *pgx.Conn
+	tx   pgx.Tx
+}
+
+// holdMigrationLock connects with config and takes the migration lock without waiting. Two runs
+// rewriting IDs at the same time would corrupt each other's work, so a busy lock fails
+// immediately and names the session holding it.
+func holdMigrationLock(ctx context.Context, config *pgx.ConnConfig) (*heldLock, error) {
+	conn, err := pgx.ConnectConfig(ctx, config)
+	if err != nil {
+		return nil, fmt.Errorf("unable to connect to database: %w", err)
+	}
+	tx, err := conn.Begin(ctx)
+	if err == nil {
+		// The transaction stays idle for the whole run.
+		_, err = tx.Exec(ctx, "SET LOCAL idle_in_transaction_session_timeout = 0")
+	}
+	var acquired bool
+	if err == nil {
+		err = tx.QueryRow(ctx, "SELECT pg_try_advisory_xact_lock($1)", migrationLockKey).Scan(&acquired)
+	}
+	switch {
+	case err != nil:
+		err = fmt.Errorf("failed to acquire migration lock: %w", err)
+	case !acquired:
+		err = lockHolder(ctx, conn)
+	default:
+		return &heldLock{conn: conn, tx: tx}, nil
+	}
+	conn.Close(ctx)
+	return nil, err
+}
+
+// alive reports whether the connection holding the lock is still up.
+func (l *heldLock) alive(ctx context.Context) bool {
+	return !l.conn.IsClosed() && l.conn.Ping(ctx) == nil
+}
+
+// release ends the transaction, and with it the lock, and closes the connection. The lock is
+// also released when the connection is lost, so failures here are not fatal.
+func (l *heldLock) release(ctx context.Context) error {
+	err := l.tx.Rollback(ctx)
+	if cerr := l.conn.Close(ctx); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// takesLock reports whether the run holds the migration lock. It cannot on CockroachDB, which
+// has no advisory locks.
+func (m *migration) takesLock() bool {
+	return m.dialect.advisoryLocks()
+}
@@ -0,0 +1,45 @@
+package migrate
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// Values of --post-maintenance.
+const (
+	maintenanceNone          = "none"
+	maintenanceAnalyze       = "analyze"
+	maintenanceVacuumAnalyze = "vacuum-analyze"
+)
+
+func validMaintenance(mode string) bool {
+	return mode == maintenanceNone || mode == maintenanceAnalyze || mode == maintenanceVacuumAnalyze
+}
+
+// runPostMaintenance refreshes the planner statistics of every rewritten table and, for
+// vacuum-analyze, reclaims the dead row versions the rewrite left behind. VACUUM cannot run
+// inside a transaction, so each table is a statement of its own.
+func (m *migration) runPostMaintenance(ctx context.Context) (int64, error) {
+	command := m.maintenanceCommand()
+	for _, table := range rewrittenTables {
+		err := m.retry(ctx, "post-maintenance", func(conn *pgx.Conn) error {
+			_, err := conn.Exec(ctx, command+" "+pgx.Identifier{m.schema.name(), table}.Sanitize())
+			return err
+		})
+		if err != nil {
+			return 0, fmt.Errorf("failed to %s %s: %w", command, table, err)
+		}
+		m.logger.Printf("post-maintenance: %s %s done\n", command, table)
+	}
+	return int64(len(rewrittenTables)), nil
+}
+
+// maintenanceCommand is the statement --post-maintenance runs on each table.
+func (m *migration) maintenanceCommand() string {
+	if m.postMaintenance == maintenanceVacuumAnalyze {
+		return "VACUUM (ANALYZE)"
+	}
+	return "ANALYZE"
+}
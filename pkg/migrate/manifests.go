@@ -0,0 +1,226 @@
+package migrate
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+
+	"gopkg.in/yaml.v3"
+)
+
+// secretMountPath is where the database secret is mounted in the generated Job.
+const secretMountPath = "/etc/guac-db"
+
+// manifestOptions describe the Kubernetes Job printed by "generate manifests".
+type manifestOptions struct {
+	name        string
+	namespace   string
+	image       string
+	secretName  string
+	passwordKey string
+	dsnKey      string
+	host        string
+	port        string
+	database    string
+	user        string
+	helmHook    bool
+	extraArgs   []string
+}
+
+func runGenerate(args []string) {
+	if len(args) > 0 {
+		switch args[0] {
+		case "manifests":
+			runGenerateManifests(args[1:])
+			return
+		case "atlas":
+			runGenerateAtlas(args[1:])
+			return
+		}
+	}
+	fmt.Fprintf(os.Stderr, "Usage: guac-update-db generate manifests [flags] [-- migrate flags]\n       guac-update-db generate atlas --dir <atlas migration directory> [flags]\n")
+	os.Exit(exitUsage)
+}
+
+func runGenerateManifests(args []string) {
+	o := &manifestOptions{}
+	fs := flag.NewFlagSet("generate manifests", flag.ExitOnError)
+	fs.StringVar(&o.name, "name", "guac-update-db", "name of the Job")
+	fs.StringVar(&o.namespace, "namespace", "guac", "namespace of the Job; it must match the namespace of the GUAC release")
+	fs.StringVar(&o.image, "image", "ghcr.io/pxp928/guac-update-db:latest", "container image running the migration")
+	fs.StringVar(&o.secretName, "secret-name", "guac-postgres", "name of the Secret holding the GUAC Postgres credentials")
+	fs.StringVar(&o.passwordKey, "secret-password-key", "password", "key of the password in the Secret; empty when the connection string in --secret-dsn-key carries it")
+	fs.StringVar(&o.dsnKey, "secret-dsn-key", "", "key of a full connection string in the Secret; when set the PG* settings below are not used")
+	fs.StringVar(&o.host, "pghost", "guac-postgres", "Postgres host (PGHOST)")
+	fs.StringVar(&o.port, "pgport", "5432", "Postgres port (PGPORT)")
+	fs.StringVar(&o.database, "pgdatabase", "guac", "Postgres database (PGDATABASE)")
+	fs.StringVar(&o.user, "pguser", "guac", "Postgres user (PGUSER)")
+	fs.BoolVar(&o.helmHook, "helm-hook", false, "annotate the Job as a Helm pre-upgrade hook so it runs before the GUAC chart is upgraded, and run the migration with --hook-mode")
+	fs.Parse(args)
+	o.extraArgs = fs.Args()
+
+	if err := writeJobManifest(os.Stdout, o); err != nil {
+		log.Fatalf("Failed to generate manifests: %v\n", err)
+	}
+}
+
+// Only the fields of the Kubernetes API the generated Job uses are modelled.
+type (
+	k8sObject struct {
+		APIVersion string      `yaml:"apiVersion"`
+		Kind       string      `yaml:"kind"`
+		Metadata   k8sMetadata `yaml:"metadata"`
+		Spec       k8sJobSpec  `yaml:"spec"`
+	}
+	k8sMetadata struct {
+		Name        string            `yaml:"name,omitempty"`
+		Namespace   string            `yaml:"namespace,omitempty"`
+		Labels      map[string]string `yaml:"labels,omitempty"`
+		Annotations map[string]string `yaml:"annotations,omitempty"`
+	}
+	k8sJobSpec struct {
+		BackoffLimit            int            `yaml:"backoffLimit"`
+		TTLSecondsAfterFinished int            `yaml:"ttlSecondsAfterFinished"`
+		Template                k8sPodTemplate `yaml:"template"`
+	}
+	k8sPodTemplate struct {
+		Metadata k8sMetadata `yaml:"metadata"`
+		Spec     k8sPodSpec  `yaml:"spec"`
+	}
+	k8sPodSpec struct {
+		RestartPolicy   string                 `yaml:"restartPolicy"`
+		SecurityContext map[string]interface{} `yaml:"securityContext"`
+		Containers      []k8sContainer         `yaml:"containers"`
+		Volumes         []k8sVolume            `yaml:"volumes"`
+	}
+	k8sContainer struct {
+		Name            string                 `yaml:"name"`
+		Image           string                 `yaml:"image"`
+		Args            []string               `yaml:"args"`
+		Env             []k8sEnvVar            `yaml:"env,omitempty"`
+		VolumeMounts    []k8sVolumeMount       `yaml:"volumeMounts"`
+		SecurityContext map[string]interface{} `yaml:"securityContext"`
+	}
+	k8sEnvVar struct {
+		Name  string `yaml:"name"`
+		Value string `yaml:"value"`
+	}
+	k8sVolumeMount struct {
+		Name      string `yaml:"name"`
+		MountPath string `yaml:"mountPath"`
+		ReadOnly  bool   `yaml:"readOnly"`
+	}
+	k8sVolume struct {
+		Name   string          `yaml:"name"`
+		Secret k8sSecretVolume `yaml:"secret"`
+	}
+	k8sSecretVolume struct {
+		SecretName string         `yaml:"secretName"`
+		Items      []k8sKeyToPath `yaml:"items"`
+	}
+	k8sKeyToPath struct {
+		Key  string `yaml:"key"`
+		Path string `yaml:"path"`
+	}
+)
+
+// writeJobManifest writes a one-shot Job running the migration. Credentials are mounted from the
+// Secret as files and passed with --password-file/--dsn-file, so they never appear in the pod
+// spec, process arguments or logs. The pod runs as the distroless nonroot user with a read-only
+// root filesystem.
+func writeJobManifest(w io.Writer, o *manifestOptions) error {
+	labels := map[string]string{
+		"app.kubernetes.io/name":      "guac-update-db",
+		"app.kubernetes.io/instance":  o.name,
+		"app.kubernetes.io/component": "migration",
+		"app.kubernetes.io/part-of":   "guac",
+	}
+
+	if o.passwordKey == "" && o.dsnKey == "" {
+		return fmt.Errorf("at least one of --secret-password-key and --secret-dsn-key is required")
+	}
+
+	var items []k8sKeyToPath
+	// A Job cannot answer the confirmation prompt.
+	args := []string{"migrate", "--yes"}
+	if o.passwordKey != "" {
+		items = append(items, k8sKeyToPath{Key: o.passwordKey, Path: "password"})
+		args = append(args, "--password-file", secretMountPath+"/password")
+	}
+	var env []k8sEnvVar
+	if o.dsnKey != "" {
+		items = append(items, k8sKeyToPath{Key: o.dsnKey, Path: "dsn"})
+		args = append(args, "--dsn-file", secretMountPath+"/dsn")
+	} else {
+		env = []k8sEnvVar{
+			{Name: "PGHOST", Value: o.host},
+			{Name: "PGPORT", Value: o.port},
+			{Name: "PGDATABASE", Value: o.database},
+			{Name: "PGUSER", Value: o.user},
+		}
+	}
+	// The root filesystem is read-only and goes with the pod; the constraint snapshot is kept
+	// in the database.
+	args = append(args, "--constraint-snapshot=")
+	if o.helmHook {
+		args = append(args, "--hook-mode")
+	}
+	args = append(args, o.extraArgs...)
+
+	job := k8sObject{
+		APIVersion: "batch/v1",
+		Kind:       "Job",
+		Metadata:   k8sMetadata{Name: o.name, Namespace: o.namespace, Labels: labels},
+		Spec: k8sJobSpec{
+			// The migration retries transient errors itself; a failed run needs an operator.
+			BackoffLimit:            0,
+			TTLSecondsAfterFinished: 86400,
+			Template: k8sPodTemplate{
+				Metadata: k8sMetadata{Labels: labels},
+				Spec: k8sPodSpec{
+					RestartPolicy: "Never",
+					SecurityContext: map[string]interface{}{
+						"runAsNonRoot":   true,
+						"runAsUser":      65532,
+						"runAsGroup":     65532,
+						"seccompProfile": map[string]string{"type": "RuntimeDefault"},
+					},
+					Containers: []k8sContainer{{
+						Name:  "migrate",
+						Image: o.image,
+						Args:  args,
+						Env:   env,
+						VolumeMounts: []k8sVolumeMount{
+							{Name: "db-credentials", MountPath: secretMountPath, ReadOnly: true},
+						},
+						SecurityContext: map[string]interface{}{
+							"allowPrivilegeEscalation": false,
+							"readOnlyRootFilesystem":   true,
+							"capabilities":             map[string][]string{"drop": {"ALL"}},
+						},
+					}},
+					Volumes: []k8sVolume{{
+						Name:   "db-credentials",
+						Secret: k8sSecretVolume{SecretName: o.secretName, Items: items},
+					}},
+				},
+			},
+		},
+	}
+	if o.helmHook {
+		job.Metadata.Annotations = map[string]string{
+			"helm.sh/hook":               "pre-upgrade",
+			"helm.sh/hook-weight":        "-5",
+			"helm.sh/hook-delete-policy": "before-hook-creation",
+		}
+	}
+
+	enc := yaml.NewEncoder(w)
+	enc.SetIndent(2)
+	if err := enc.Encode(job); err != nil {
+		return err
+	}
+	return enc.Close()
+}
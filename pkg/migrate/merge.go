@@ -0,0 +1,82 @@
+package migrate
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+)
+
+// splitMergeable separates the collisions whose new ID one of the rows already has, as the rows
+// a GUAC writing the new scheme ingests into the same database do, from those no row has yet.
+// A row already at its new ID is the same row as the old-scheme ones hashing to it, so they
+// are merged into it rather than failing the rewrite; the merges list only those duplicates.
+func splitMergeable(collisions []IDCollision) (merges, rest []IDCollision) {
+	for _, c := range collisions {
+		var duplicates []string
+		kept := false
+		for _, id := range c.OldIDs {
+			if id == c.NewID {
+				kept = true
+				continue
+			}
+			duplicates = append(duplicates, id)
+		}
+		if !kept {
+			rest = append(rest, c)
+			continue
+		}
+		merges = append(merges, IDCollision{NewID: c.NewID, OldIDs: duplicates})
+	}
+	return merges, rest
+}
+
+// mergeSQL are the statements merging the row of r's table with ID $2 into the one with ID $1.
+// Its references are re-inserted rather than updated, as the row kept may be referenced by the
+// same row already, and the row is deleted once nothing references it.
+func (m *migration) mergeSQL(r *idRewrite) []string {
+	var stmts []string
+	for _, ref := range r.referencers {
+		stmts = append(stmts,
+			fmt.Sprintf(`INSERT INTO %[1]s (%[2]s, %[3]s)
+SELECT DISTINCT r.%[2]s, $1::uuid FROM %[1]s r WHERE r.%[3]s = $2
+ON CONFLICT DO NOTHING`, m.schema.prefix()+ref.table, ref.rowID, ref.column),
+			m.audited(fmt.Sprintf(`DELETE FROM %s r WHERE r.%s = $2`, m.schema.prefix()+ref.table, ref.column),
+				"r."+ref.rowID+" AS row_id, $2::uuid AS old_id, $1::uuid AS new_id", ref.table, ref.column))
+	}
+	return append(stmts, m.audited(`DELETE FROM `+m.schema.prefix()+r.table+` WHERE id = $2`,
+		"id AS row_id, id AS old_id, $1::uuid AS new_id", r.table, "id"))
+}
+
+// mergeDuplicates merges the old-scheme duplicates of merges into the rows already at their new
+// ID, in one transaction of its own, and leaves them out of m.changes, so the rewrite moves the
+// remaining rows only. Merging them again finds nothing left to merge.
+func (m *migration) mergeDuplicates(ctx context.Context, step string, r *idRewrite, merges []IDCollision) error {
+	stmts := m.mergeSQL(r)
+	duplicates := make(map[uuid.UUID]bool)
+	batch := &pgx.Batch{}
+	for _, c := range merges {
+		kept := uuid.MustParse(c.NewID)
+		for _, id := range c.OldIDs {
+			old := uuid.MustParse(id)
+			duplicates[old] = true
+			for _, stmt := range stmts {
+				batch.Queue(stmt, kept, old)
+			}
+		}
+	}
+	err := m.retry(ctx, step, func(conn *pgx.Conn) error {
+		return sendBatch(ctx, conn, batch)
+	})
+	if err != nil {
+		return fmt.Errorf("failed to merge the %s rows already at their new ID: %w", r.singular, err)
+	}
+	if err := m.changes.remove(duplicates); err != nil {
+		return err
+	}
+	m.report.Merged = append(m.report.Merged, merges...)
+	m.logger.Printf("%s: %d %s rows already had the new ID of another, as GUAC writes them; merged %d old-scheme duplicates into them\n",
+		step, len(merges), r.singular, len(duplicates))
+	return nil
+}
@@ -0,0 +1,32 @@
+package migrate
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSplitMergeable(t *testing.T) {
+	const a, b, c = "00000000-0000-4000-8000-00000000000a", "00000000-0000-4000-8000-00000000000b", "00000000-0000-4000-8000-00000000000c"
+	merges, rest := splitMergeable([]IDCollision{
+		{NewID: a, OldIDs: []string{a, b, c}},
+		{NewID: b, OldIDs: []string{a, c}},
+	})
+	if want := []IDCollision{{NewID: a, OldIDs: []string{b, c}}}; !reflect.DeepEqual(merges, want) {
+		t.Errorf("merges = %v, want %v", merges, want)
+	}
+	if want := []IDCollision{{NewID: b, OldIDs: []string{a, c}}}; !reflect.DeepEqual(rest, want) {
+		t.Errorf("rest = %v, want %v", rest, want)
+	}
+}
+
+func TestMergeSQL(t *testing.T) {
+	m := &migration{}
+	want := []string{
+		"INSERT INTO public.bill_of_materials_included_dependencies (bill_of_materials_id, dependency_id)\nSELECT DISTINCT r.bill_of_materials_id, $1::uuid FROM public.bill_of_materials_included_dependencies r WHERE r.dependency_id = $2\nON CONFLICT DO NOTHING",
+		"DELETE FROM public.bill_of_materials_included_dependencies r WHERE r.dependency_id = $2",
+		"DELETE FROM public.dependencies WHERE id = $2",
+	}
+	if got := m.mergeSQL(dependencyIDs); !reflect.DeepEqual(got, want) {
+		t.Errorf("mergeSQL() = %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,144 @@
+package migrate
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// migrationMetrics are the Prometheus metrics published on --metrics-addr. They are always
+// recorded; serving them is optional. Every metric is labelled with the target of the run, so
+// the runs of a --targets --parallel run each have their own series.
+type migrationMetrics struct {
+	rowsProcessed    *prometheus.CounterVec
+	batchesCommitted *prometheus.CounterVec
+	errors           *prometheus.CounterVec
+	retries          *prometheus.CounterVec
+	deadlocks        *prometheus.CounterVec
+	throttledSeconds *prometheus.CounterVec
+	stepDuration     *prometheus.GaugeVec
+	stepRunning      *prometheus.GaugeVec
+	chunkSize        *prometheus.GaugeVec
+}
+
+var metrics = newMigrationMetrics(prometheus.DefaultRegisterer)
+
+func newMigrationMetrics(reg prometheus.Registerer) *migrationMetrics {
+	m := &migrationMetrics{
+		rowsProcessed: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "guac_migration",
+			Name:      "rows_processed_total",
+			Help:      "Number of rows processed by each migration step.",
+		}, []string{"target", "step"}),
+		batchesCommitted: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "guac_migration",
+			Name:      "batches_committed_total",
+			Help:      "Number of statement batches committed by each migration step.",
+		}, []string{"target", "step"}),
+		errors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "guac_migration",
+			Name:      "errors_total",
+			Help:      "Number of errors encountered by each migration step.",
+		}, []string{"target", "step"}),
+		retries: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "guac_migration",
+			Name:      "retries_total",
+			Help:      "Number of times each migration step retried a statement after a transient error.",
+		}, []string{"target", "step"}),
+		deadlocks: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "guac_migration",
+			Name:      "deadlocks_total",
+			Help:      "Number of statements of each migration step Postgres aborted to break a deadlock.",
+		}, []string{"target", "step"}),
+		throttledSeconds: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "guac_migration",
+			Name:      "throttled_seconds_total",
+			Help:      "Time each migration step spent waiting for --max-rows-per-second and --pause-between-batches.",
+		}, []string{"target", "step"}),
+		stepDuration: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: "guac_migration",
+			Name:      "step_duration_seconds",
+			Help:      "Wall-clock time spent in each migration step, updated while the step runs.",
+		}, []string{"target", "step"}),
+		stepRunning: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: "guac_migration",
+			Name:      "step_running",
+			Help:      "1 while the migration step is running, 0 otherwise.",
+		}, []string{"target", "step"}),
+		chunkSize: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: "guac_migration",
+			Name:      "chunk_size",
+			Help:      "Number of rows of the latest chunk of each keyset-paginated migration step, as sized by --target-batch-latency.",
+		}, []string{"target", "step"}),
+	}
+	reg.MustRegister(m.rowsProcessed, m.batchesCommitted, m.errors, m.retries, m.deadlocks, m.throttledSeconds, m.stepDuration, m.stepRunning, m.chunkSize)
+	return m
+}
+
+// observeStep runs fn as the step called name of target, recording its duration, outcome and
+// row count.
+func (m *migrationMetrics) observeStep(target, name string, fn func() (int64, error)) (int64, error) {
+	start := time.Now()
+	m.stepRunning.WithLabelValues(target, name).Set(1)
+
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(5 * time.Second)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				m.stepDuration.WithLabelValues(target, name).Set(time.Since(start).Seconds())
+			}
+		}
+	}()
+
+	rows, err := fn()
+	close(done)
+
+	m.stepRunning.WithLabelValues(target, name).Set(0)
+	m.stepDuration.WithLabelValues(target, name).Set(time.Since(start).Seconds())
+	m.rowsProcessed.WithLabelValues(target, name).Add(float64(rows))
+	if err != nil {
+		m.errors.WithLabelValues(target, name).Inc()
+	}
+	return rows, err
+}
+
+func (m *migrationMetrics) batchCommitted(target, step string) {
+	m.batchesCommitted.WithLabelValues(target, step).Inc()
+}
+
+func (m *migrationMetrics) retried(target, step string) {
+	m.retries.WithLabelValues(target, step).Inc()
+}
+
+func (m *migrationMetrics) deadlocked(target, step string) {
+	m.deadlocks.WithLabelValues(target, step).Inc()
+}
+
+func (m *migrationMetrics) throttled(target, step string, d time.Duration) {
+	m.throttledSeconds.WithLabelValues(target, step).Add(d.Seconds())
+}
+
+func (m *migrationMetrics) chunkSized(target, step string, rows int) {
+	m.chunkSize.WithLabelValues(target, step).Set(float64(rows))
+}
+
+// serveMetrics starts the Prometheus endpoint on addr in the background.
+func serveMetrics(addr string) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	srv := &http.Server{Addr: addr, Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+	go func() {
+		if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Printf("metrics endpoint stopped: %v", err)
+		}
+	}()
+}
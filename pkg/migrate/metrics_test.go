@@ -0,0 +1,29 @@
+package migrate
+
+import (
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// TestMetricsTargets checks that the runs of two targets with the same steps, as --targets
+// --parallel has, keep series of their own.
+func TestMetricsTargets(t *testing.T) {
+	m := newMigrationMetrics(prometheus.NewRegistry())
+	m.observeStep("team-a", "backfill", func() (int64, error) { return 10, nil })
+	m.observeStep("team-b", "backfill", func() (int64, error) { return 3, nil })
+	m.chunkSized("team-a", "backfill", 5000)
+	m.chunkSized("team-b", "backfill", 200)
+
+	for target, want := range map[string]float64{"team-a": 10, "team-b": 3} {
+		if got := testutil.ToFloat64(m.rowsProcessed.WithLabelValues(target, "backfill")); got != want {
+			t.Errorf("rows_processed_total{target=%q} = %v, want %v", target, got, want)
+		}
+	}
+	for target, want := range map[string]float64{"team-a": 5000, "team-b": 200} {
+		if got := testutil.ToFloat64(m.chunkSize.WithLabelValues(target, "backfill")); got != want {
+			t.Errorf("chunk_size{target=%q} = %v, want %v", target, got, want)
+		}
+	}
+}
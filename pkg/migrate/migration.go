@@ -0,0 +1,635 @@
+package migrate
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/pxp928/guac-update-db/internal/anonymize"
+	"github.com/pxp928/guac-update-db/pkg/keys"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+type dependency struct {
+	keys.Dependency
+	idChange
+}
+
+// dependencyFKName is the name GUAC's ent schema gives the foreign key from
+// bill_of_materials_included_dependencies to dependencies. The migration drops the foreign
+// keys it finds whatever their names; this one is added when none was recorded.
+const dependencyFKName = "bill_of_materials_included_dependencies_dependency_id"
+
+// rewrittenTables are the tables whose rows the migration rewrites.
+var rewrittenTables = dependencyIDs.tables()
+
+// progressInterval is how often long-running steps log their progress.
+const progressInterval = 10 * time.Second
+
+// migration holds the state shared between the steps of a single run.
+type migration struct {
+	config *pgx.ConnConfig
+	// pool holds the connections to the primary. session is a connection taken out of it for
+	// the whole run, and lock the migration lock; sessionChecked is when they were last seen
+	// alive. sessionMu guards them against the --workers.
+	pool           *connPool
+	poolSettings   poolSettings
+	sessionMu      sync.Mutex
+	session        *pgxpool.Conn
+	lock           *heldLock
+	sessionChecked time.Time
+	retryPolicy    retryPolicy
+	timeouts       *timeoutSettings
+	// schema is the Postgres schema GUAC's tables are in.
+	schema    dbSchema
+	chunkSize int
+	// targetLatency resizes the chunks of the backfill steps to commit in about this long, up
+	// to chunkSize; zero keeps them at chunkSize.
+	targetLatency time.Duration
+	// workers is the number of key ranges the backfill steps update at the same time.
+	workers int
+	// partitions are the partitions of the dependencies table, nil when it is not partitioned.
+	partitions *tablePartitions
+	// poolerCompat is set when the run goes through a transaction-pooling pooler, which the
+	// session-level lock of an --emit-sql script would not hold through.
+	poolerCompat bool
+	// dialect is the database being migrated.
+	dialect dialect
+	// scheme composes the IDs dependencies are rewritten to.
+	scheme *keys.Scheme
+	// fast stages the ID mapping with COPY and rewrites with set-based updates.
+	fast bool
+	// diskCheck is what checkDiskHeadroom does without enough free disk space, one of the
+	// diskCheck modes; diskAvailable, when not 0, is the free space it assumes.
+	diskCheck     string
+	diskAvailable int64
+	// indexRebuild drops secondary indexes around the rewrite and rebuilds them afterwards.
+	indexRebuild bool
+	// deferConstraints makes the foreign keys deferrable instead of dropping them, and
+	// rewrites the IDs and the references in one transaction that defers them to its commit.
+	deferConstraints bool
+	// online rewrites through shadow columns while GUAC keeps running, and checkWriters, unless
+	// --force is set, holds the cutover back until it stopped.
+	online       bool
+	checkWriters func(ctx context.Context) error
+	// noDDL rewrites the IDs without changing the schema, moving every row and its references
+	// in one statement while the foreign keys stay in place.
+	noDDL bool
+	// normalize merges the packages and dependencies that differ only in the spelling of their
+	// purls before the backfill.
+	normalize bool
+	// postMaintenance is the maintenance run on rewrittenTables after the last migration.
+	postMaintenance string
+	// analyzeConfig, when set, points the read-only scans at a separate database, typically a
+	// read replica of the primary, whose connections are in analyzePool.
+	analyzeConfig *pgx.ConnConfig
+	analyzePool   *connPool
+	// observer is told about the progress of the run.
+	observer Observer
+	// target is the target label of the metrics of the run: the name of its --targets target,
+	// or the database.
+	target string
+	// speedups are the settings of --unsafe-speedups, nil without it.
+	speedups *unsafeSpeedups
+	// recorder writes the trace of --record, which also records the errors of the attempts.
+	recorder *traceRecorder
+	// currentStep is the step being run, whose session settings a new connection needs.
+	currentStep string
+	// migrationNumber is the position of the data migration being run among the
+	// migrationCount of the run, from 1, and 0 once all of them ran.
+	migrationNumber, migrationCount int
+	// changes are the old and new IDs computeNewIDs computed, spilled to disk beyond their
+	// --max-memory budget.
+	changes idChanges
+	report  *Report
+	logger  *log.Logger
+	// idMapPath, when set, is where the old to new ID mapping is exported.
+	idMapPath string
+	// anonymizer, with --anonymize, replaces the IDs of the exported mapping with pseudonyms.
+	anonymizer *anonymize.Anonymizer
+	// snapshotPath, when set, is where snapshot-constraints writes the definitions it saves.
+	snapshotPath string
+	// steps selects the steps that run; the zero value runs all of them.
+	steps stepFilter
+	// idsComputed is set once computeNewIDs has filled changes during this run.
+	idsComputed bool
+	// throttle paces the batches of the backfill, rewrite-ids and fix-refs steps.
+	throttle throttle
+	// windows are the maintenance windows outside which the run pauses, and state is where
+	// its progress is saved for a later run to resume from, when --state-file is set.
+	windows windowList
+	state   *runState
+	// pauseMu lets one of the --workers at a time wait for the window, while the others wait
+	// for it.
+	pauseMu sync.Mutex
+	// constraintsDropped is set from drop-constraints until add-constraints has run; the run
+	// does not pause in between.
+	constraintsDropped bool
+	// rewriteStarted is set once a step past the backfill has completed: a failure from then on
+	// leaves the database between versions.
+	rewriteStarted bool
+	// deadline, when set, is the --deadline or --max-runtime past which the run stops at the
+	// next point it could pause at. stepTimeouts are the --step-timeout budgets of the steps,
+	// and stepDeadline the end of the budget of the current step, past which it stops the same
+	// way.
+	deadline     time.Time
+	stepTimeouts stepDurations
+	stepDeadline time.Time
+	// completedSteps are the steps this run completed, by stateKey.
+	completedSteps map[string]bool
+	// versionRanges is the --version-ranges policy of the backfill.
+	versionRanges string
+	// cleanup is the --cleanup-name-columns mode of the columns the backfill replaced.
+	cleanup string
+	// filter restricts the backfill, the rewrite and the verification to the dependencies of
+	// the --filter flags.
+	filter *rowFilter
+	// control, when set, is the --serve API that pauses the run where waitForWindow does.
+	control *controlServer
+	// backupWithin, when set, is how old the latest backup of backupSource may be before the
+	// first step that rewrites the database; backupChecked is set once it was checked.
+	backupWithin  time.Duration
+	backupSource  backupSource
+	backupChecked bool
+	// auditID, when set, is the migration_id under which --audit records the changed IDs.
+	auditID string
+	// quarantineID, when set, is the migration_id under which --error-policy=quarantine records
+	// the rows it leaves out, of which it fails the run beyond maxQuarantined.
+	quarantineID   string
+	maxQuarantined int
+	// planned, plannedChunks and emittedIndexes are what an --emit-sql run read from the
+	// database.
+	planned        []plannedDependency
+	plannedChunks  []chunkChecksum
+	emittedIndexes []savedIndex
+	// emittedForeignKeys are the foreign keys an --emit-sql script drops and restores.
+	emittedForeignKeys []foreignKey
+}
+
+// connect opens the connection pool and takes the migration lock.
+func (m *migration) connect(ctx context.Context) error {
+	pool, err := newConnPool(ctx, m.config, m.poolSettings, m.timeouts)
+	if err != nil {
+		return fmt.Errorf("unable to connect to database: %w", err)
+	}
+	m.pool = pool
+	pool.speedups = m.speedups
+	if err := m.lockSession(ctx); err != nil {
+		pool.close()
+		m.pool = nil
+		return err
+	}
+	return nil
+}
+
+// primaryConn returns a pooled connection to the primary with the timeouts of the current
+// step, after making sure the migration lock is still held.
+func (m *migration) primaryConn(ctx context.Context) (*pgxpool.Conn, error) {
+	m.sessionMu.Lock()
+	err := m.checkSession(ctx)
+	m.sessionMu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	return m.pool.acquire(ctx, m.currentStep)
+}
+
+// close releases the migration lock and closes the connections.
+func (m *migration) close(ctx context.Context) {
+	m.closeAnalysis()
+	m.changes.reset()
+	if m.pool == nil {
+		return
+	}
+	if m.lock != nil {
+		if err := m.lock.release(ctx); err != nil {
+			m.logger.Printf("Failed to release migration lock: %v\n", err)
+		}
+		m.lock = nil
+	}
+	if m.session != nil {
+		m.session.Release()
+	}
+	m.pool.close()
+}
+
+// step is a single phase of the migration. run returns the number of rows it processed. emit
+// writes the statements run would execute to an --emit-sql script; steps without it do not
+// change the database, or only write local files, and are left out of the script.
+type step struct {
+	name string
+	run  func(ctx context.Context) (int64, error)
+	emit func(ctx context.Context, w io.Writer) error
+}
+
+// dependencyVersionIDSteps are the steps of the dependency-version-ids data migration: the
+// backfill of the column its new IDs are derived from, the rewrite of dependencyIDs, the move
+// of the SBOMs whose IDs GUAC derives from those, and the check of the result.
+func (m *migration) dependencyVersionIDSteps() []step {
+	steps := []step{{name: "backfill", run: m.backfillVersionIDs, emit: m.emitBackfill}}
+	steps = append(steps, m.rewriteSteps(dependencyIDs)...)
+	steps = append(steps,
+		step{name: "fix-sbom-ids", run: m.fixSBOMIDs, emit: m.emitFixSBOMIDs},
+		step{name: "verify", run: m.verify, emit: m.emitVerify})
+	if m.cleanup == cleanupNull || m.cleanup == cleanupDrop {
+		steps = append(steps, step{name: "cleanup-name-columns", run: m.cleanupNameColumns, emit: m.emitCleanupNameColumns})
+	}
+	if m.idMapPath != "" {
+		after := "rewrite-ids"
+		if m.fast {
+			after = "stage-ids"
+		}
+		steps = m.withIDMapExport(steps, after)
+	}
+	if m.indexRebuild {
+		steps = m.withIndexRebuild(steps)
+	}
+	if m.normalize {
+		steps = m.withPurlNormalization(steps)
+	}
+	return m.withConstraintSnapshot(steps)
+}
+
+// plan returns the steps of every data migration, and the steps run once after all of them,
+// failing if --steps or --skip-steps names a step that is not part of the run.
+func (m *migration) plan(migrations []dataMigration) ([][]step, []step, error) {
+	plan := make([][]step, len(migrations))
+	var all []step
+	for i, dm := range migrations {
+		plan[i] = dm.steps(m)
+		all = append(all, plan[i]...)
+	}
+	var post []step
+	if m.postMaintenance != maintenanceNone {
+		post = []step{{name: "post-maintenance", run: m.runPostMaintenance, emit: m.emitPostMaintenance}}
+	}
+	if err := m.steps.check(append(all, post...)); err != nil {
+		return nil, nil, err
+	}
+	return plan, post, nil
+}
+
+// run executes the steps of every data migration in order, recording each step in the report,
+// and stops at the first failure. A data migration is deliberately not a transaction nor a
+// savepoint of one. Its backfill commits in chunks so as not to hold millions of row locks and
+// dead rows until the end. Holding the dropped foreign key, the rewrite and the re-added key
+// in one transaction would keep GUAC's tables locked for the whole rewrite. CREATE INDEX
+// CONCURRENTLY, CockroachDB's schema changes and --online's triggers cannot run in one at
+// all. A failed migration is resumed by the next run rather than rolled back, and its state
+// makes it a unit: once its last step committed, later runs skip it as a whole.
+func (m *migration) run(ctx context.Context, migrations []dataMigration) error {
+	plan, post, err := m.plan(migrations)
+	if err != nil {
+		return err
+	}
+	if err := m.checkPartitioning(ctx); err != nil {
+		return err
+	}
+	if err := m.createAuditTable(ctx); err != nil {
+		return err
+	}
+	if err := m.createQuarantineTable(ctx); err != nil {
+		return err
+	}
+
+	m.migrationCount = len(migrations)
+	for i, dm := range migrations {
+		m.migrationNumber = i + 1
+		m.report.Migrations = append(m.report.Migrations, dm.Name)
+		if m.state.completed(dm.Name) {
+			m.logger.Printf("Skipping data migration %s, completed by an earlier run\n", dm.Name)
+			m.report.CompletedMigrations = append(m.report.CompletedMigrations, dm.Name)
+			continue
+		}
+		m.logger.Printf("Running data migration %s (%d of %d, %s -> %s)\n", dm.Name, i+1, len(migrations), dm.From, dm.To)
+		if err := m.runSteps(ctx, dm.Name, plan[i]); err != nil {
+			if errors.Is(err, ErrDeadlineReached) {
+				m.recordRemaining(ctx, migrations, plan, post)
+			}
+			if i > 0 {
+				m.logger.Printf("The data migrations before %s are complete; the next run resumes at %s\n", dm.Name, dm.Name)
+			}
+			err = fmt.Errorf("%s: %w", dm.Name, err)
+			if m.rewriteStarted {
+				return &PartialError{Err: err}
+			}
+			return err
+		}
+		// A data migration is complete once all its steps are: a later run skips it as a
+		// whole, whatever happens to the ones after it.
+		m.report.CompletedMigrations = append(m.report.CompletedMigrations, dm.Name)
+		if err := m.state.complete(dm.Name); err != nil {
+			return err
+		}
+	}
+	m.migrationNumber = 0
+	if err := m.runSteps(ctx, "", post); err != nil {
+		if errors.Is(err, ErrDeadlineReached) {
+			m.recordRemaining(ctx, migrations, plan, post)
+		}
+		return err
+	}
+	if err := m.forgetConstraintSnapshot(ctx); err != nil {
+		return err
+	}
+	if n := len(m.report.Quarantined); n > 0 {
+		m.logger.Printf("%d rows failed to migrate and were left as they were; they are listed in %s with migration_id %s\n", n, quarantineTable, m.quarantineID)
+	}
+	return m.state.remove()
+}
+
+// runSteps runs the steps of the data migration called migration, or the steps after all of
+// them when it is empty.
+func (m *migration) runSteps(ctx context.Context, migration string, steps []step) error {
+	for _, s := range steps {
+		if !m.steps.selected(s.name) {
+			m.logger.Printf("Skipping step %s\n", s.name)
+			m.report.skipStep(s.name).Migration = migration
+			continue
+		}
+		key := stateKey(migration, s.name)
+		if m.state.completed(key) {
+			m.logger.Printf("Skipping step %s, completed by an earlier run\n", s.name)
+			m.report.skipStep(s.name).Migration = migration
+			m.stepCompleted(s.name)
+			continue
+		}
+		if err := m.waitForWindow(ctx, s.name); err != nil {
+			return fmt.Errorf("%s: %w", s.name, err)
+		}
+		if err := m.checkTimeLeft(s.name); err != nil {
+			return fmt.Errorf("%s: %w", s.name, err)
+		}
+		if rewrites(s.name) {
+			if err := m.checkBackup(ctx); err != nil {
+				return fmt.Errorf("%s: %w", s.name, err)
+			}
+		}
+		m.currentStep = s.name
+		m.stepStarted(migration, s.name)
+		before := m.serverSnapshot(ctx, s.name)
+		start := time.Now()
+		stepCtx, span := tracer.Start(ctx, "step "+s.name, trace.WithAttributes(attribute.String("guac.step", s.name)))
+		rows, err := metrics.observeStep(m.target, s.name, func() (int64, error) {
+			return s.run(stepCtx)
+		})
+		if err != nil {
+			err = m.timeouts.explainTimeout(s.name, err)
+		}
+		span.SetAttributes(attribute.Int64("guac.rows", rows))
+		endSpan(span, err)
+		sr := m.report.addStep(s.name, rows, time.Since(start), err)
+		sr.Migration = migration
+		if before != nil {
+			m.flushStatistics(ctx)
+		}
+		if sr.Server = m.serverSnapshot(ctx, s.name).since(before); sr.Server != nil {
+			m.logger.Printf("%s: server: %s\n", s.name, sr.Server)
+		}
+		if err != nil {
+			return fmt.Errorf("%s: %w", s.name, err)
+		}
+		m.stepCompleted(s.name)
+		m.stepDeadline = time.Time{}
+		m.completedSteps[key] = true
+		if err := m.state.complete(key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// stepCompleted tracks whether the rewrite has started and whether the foreign key is dropped,
+// in this run or the one it resumes.
+func (m *migration) stepCompleted(name string) {
+	if rewrites(name) {
+		m.rewriteStarted = true
+	}
+	switch name {
+	case "drop-constraints":
+		m.constraintsDropped = true
+	case "add-constraints":
+		m.constraintsDropped = false
+	}
+}
+
+// rewrites reports whether step changes the schema or the IDs, leaving the database between
+// versions if it fails. The backfill only fills in a column nothing reads yet.
+func rewrites(step string) bool {
+	switch step {
+	case "backfill", "verify", "snapshot-constraints", "post-maintenance":
+		return false
+	}
+	return !preparesCutover(step)
+}
+
+// Step 1: Update the dependencies table by setting dependent_package_version_id
+//
+// The table is walked in keyset-paginated chunks of primary keys, each updated and committed
+// on its own, so no single transaction rewrites millions of rows or holds their locks for long.
+// Every chunk is idempotent and can be retried or re-run after a failure. With --workers the
+// table is split into disjoint key ranges walked at the same time; every chunk locks its rows
+// in ID order before updating them, so it cannot deadlock with another transaction that does
+// the same. A partitioned table is walked one partition after the other, each chunk reading
+// its IDs from a single partition.
+func (m *migration) backfillVersionIDs(ctx context.Context) (int64, error) {
+	var total int64
+	err := m.retry(ctx, "backfill", func(conn *pgx.Conn) error {
+		var err error
+		total, err = estimatedRows(ctx, conn, m.schema.prefix()+"dependencies")
+		return err
+	})
+	if err != nil {
+		return 0, fmt.Errorf("failed to estimate dependencies table size: %w", err)
+	}
+	if err := m.checkVersionRanges(ctx); err != nil {
+		return 0, err
+	}
+
+	// A data-modifying CTE runs whether or not the query reads it.
+	audit := ""
+	if m.auditID != "" {
+		audit = ", audit AS (\n" + m.auditInsert("updated", "dependencies", "dependent_package_version_id") + "\n)"
+	}
+	var (
+		scanned  atomic.Int64
+		updated  atomic.Int64
+		logged   = newProgressLog()
+		progress = func() {
+			n := scanned.Load()
+			pct := 100.0
+			if total > 0 && n < total {
+				pct = float64(n) / float64(total) * 100
+			}
+			m.logger.Printf("backfill: %d of ~%d rows scanned (%.1f%%), %d updated\n", n, total, pct, updated.Load())
+		}
+	)
+	filter, filterArgs := m.filter.condition("d", 5)
+	relations := m.backfillRelations()
+	for _, relation := range relations[m.state.backfillResumesIn(relations):] {
+		partition := ""
+		if m.partitions != nil {
+			partition = relation
+			m.logger.Printf("backfill: walking partition %s\n", partition)
+		}
+		m.state.backfilling(partition)
+		err = m.forEachRange(ctx, func(ctx context.Context, worker int, kr keyRange, t *throttle) error {
+			lastID := m.state.backfillResumesAfter(worker, m.workers)
+			if lastID.Valid {
+				m.logger.Printf("backfill: resuming after id %s, where an earlier run stopped\n", lastID.UUID)
+			}
+			sizer := m.newChunkSizer("backfill")
+			for {
+				var chunkLast uuid.NullUUID
+				var chunkRows, chunkUpdated int64
+				started := time.Now()
+				err := m.retry(ctx, "backfill", func(conn *pgx.Conn) error {
+					return conn.QueryRow(ctx, `
+					WITH chunk AS (
+						SELECT id FROM `+relation+`
+						WHERE ($1::uuid IS NULL OR id > $1::uuid)
+						  AND id >= $3 AND ($4::uuid IS NULL OR id < $4::uuid)
+						ORDER BY id
+						LIMIT $2
+					), locked AS (
+						SELECT d.id FROM `+m.schema.prefix()+`dependencies d, chunk
+						WHERE d.id = chunk.id
+						  AND d.dependent_package_name_id IS NOT NULL
+						  AND d.dependent_package_version_id IS NULL
+						  AND `+filter+`
+						ORDER BY d.id
+						FOR UPDATE OF d
+					), updated AS (
+						UPDATE `+m.schema.prefix()+`dependencies d
+						SET dependent_package_version_id = pv.id
+						FROM locked, `+m.schema.prefix()+`package_versions pv
+						WHERE d.id = locked.id
+						  AND d.dependent_package_version_id IS NULL
+						  AND d.dependent_package_name_id = pv.name_id
+						  AND `+m.versionMatchSQL("d", "pv")+`
+						RETURNING d.id AS row_id, NULL::uuid AS old_id, d.dependent_package_version_id AS new_id
+					)`+audit+`
+					SELECT (SELECT id FROM chunk ORDER BY id DESC LIMIT 1),
+					       (SELECT count(*) FROM chunk),
+					       (SELECT count(*) FROM updated)
+				`, append([]interface{}{lastID, sizer.next(), kr.from, kr.to}, filterArgs...)...).Scan(&chunkLast, &chunkRows, &chunkUpdated)
+				})
+				if err != nil {
+					if lastID.Valid {
+						return fmt.Errorf("failed to update dependent_package_version_id after id %s: %w", lastID.UUID, err)
+					}
+					return fmt.Errorf("failed to update dependent_package_version_id of the %s: %w", kr, err)
+				}
+				if !chunkLast.Valid {
+					return nil
+				}
+				sizer.observe(chunkRows, time.Since(started))
+				m.batchCommitted("backfill", chunkRows)
+				lastID = chunkLast
+				scanned.Add(chunkRows)
+				updated.Add(chunkUpdated)
+				m.state.backfilled(worker, m.workers, lastID.UUID)
+				if err := t.wait(ctx, m.target, "backfill", chunkRows); err != nil {
+					return err
+				}
+				if err := m.waitForWindow(ctx, "backfill"); err != nil {
+					return err
+				}
+
+				if logged.due() {
+					progress()
+				}
+			}
+		})
+		if err != nil {
+			if partition != "" {
+				err = fmt.Errorf("partition %s: %w", partition, err)
+			}
+			return updated.Load(), err
+		}
+	}
+	progress()
+
+	err = m.retry(ctx, "backfill", func(conn *pgx.Conn) error {
+		var err error
+		m.report.UnresolvedRows, err = countUnresolved(ctx, conn, m.schema, m.filter)
+		return err
+	})
+	if err != nil {
+		return 0, fmt.Errorf("failed to count unresolved dependencies: %w", err)
+	}
+	return updated.Load(), nil
+}
+
+// countUnresolved counts the dependencies of f still without a dependent_package_version_id.
+func countUnresolved(ctx context.Context, q queryer, schema dbSchema, f *rowFilter) (int64, error) {
+	filter, args := f.condition("", 1)
+	var n int64
+	err := q.QueryRow(ctx, `
+		SELECT count(*) FROM `+schema.prefix()+`dependencies
+		WHERE dependent_package_name_id IS NOT NULL
+		  AND dependent_package_version_id IS NULL
+		  AND `+filter, args...).Scan(&n)
+	return n, err
+}
+
+// queryer is the query methods shared by *pgx.Conn and pgx.Tx.
+type queryer interface {
+	Query(ctx context.Context, sql string, args ...interface{}) (pgx.Rows, error)
+	QueryRow(ctx context.Context, sql string, args ...interface{}) pgx.Row
+}
+
+// scanDependencies streams every row of the dependencies table to visit. resolved is false when
+// the row has no dependent_package_version_id, in which case DependentPackageVersionID is zero.
+func scanDependencies(ctx context.Context, q queryer, schema dbSchema, visit func(dep dependency, resolved bool) error) error {
+	return scanDependencyRows(ctx, q, schema, "", nil, visit)
+}
+
+// scanDependencyIDs is scanDependencies for the rows with the given IDs only.
+func scanDependencyIDs(ctx context.Context, q queryer, schema dbSchema, ids []uuid.UUID, visit func(dep dependency, resolved bool) error) error {
+	return scanDependencyRows(ctx, q, schema, "WHERE id = ANY($1)", []interface{}{uuidStrings(ids)}, visit)
+}
+
+// uuidStrings formats ids as a uuid[] query argument.
+func uuidStrings(ids []uuid.UUID) []string {
+	s := make([]string, len(ids))
+	for i, id := range ids {
+		s[i] = id.String()
+	}
+	return s
+}
+
+func scanDependencyRows(ctx context.Context, q queryer, schema dbSchema, where string, args []interface{}, visit func(dep dependency, resolved bool) error) error {
+	rows, err := q.Query(ctx, `
+		SELECT id, package_id, dependent_package_version_id, dependency_type, justification, origin, collector, document_ref
+		FROM `+schema.prefix()+`dependencies
+		`+where, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var dep dependency
+		var versionID uuid.NullUUID
+
+		err := rows.Scan(&dep.oldID, &dep.PackageID, &versionID, &dep.DependencyType, &dep.Justification, &dep.Origin, &dep.Collector, &dep.DocumentRef)
+		if err != nil {
+			return fmt.Errorf("failed to scan row: %w", err)
+		}
+		dep.DependentPackageVersionID = versionID.UUID
+		if err := visit(dep, versionID.Valid); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
@@ -0,0 +1,146 @@
+package migrate
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// noDDLPrivileges are the privileges --no-ddl needs on every table of the rewrite and of
+// fix-sbom-ids: rows are moved with UPDATE, or inserted again and deleted, their references
+// deleted and inserted again, and duplicates merged with DELETE.
+var noDDLPrivileges = []string{"SELECT", "INSERT", "UPDATE", "DELETE"}
+
+// checkNoDDLOptions fails on the flags --no-ddl cannot be combined with: those that alter the
+// GUAC tables, and those that keep their records in tables of their own, which a user with
+// DML privileges only cannot create.
+func checkNoDDLOptions(o *options) error {
+	if !o.noDDL {
+		return nil
+	}
+	switch {
+	case o.fast, o.deferFKs, o.online, o.rebuildIndexes:
+		return errors.New("--no-ddl keeps the schema as it is and cannot be combined with --fast, --defer-constraints, --online or --rebuild-indexes, which change it")
+	case o.estimate:
+		return errors.New("--no-ddl cannot be combined with --estimate, which drops the foreign key inside the transaction it measures")
+	case o.cleanup == cleanupDrop:
+		return errors.New("--no-ddl cannot drop the name columns; use --cleanup-name-columns=null")
+	case o.audit, o.errorPolicy == errorPolicyQuarantine, o.completionRow:
+		return errors.New("--no-ddl cannot create the tables of --audit, --error-policy=quarantine and --completion-row")
+	case (o.hookMode || o.initContainer) && o.stateFile == "":
+		return errors.New("--no-ddl cannot create the table --hook-mode and --init-container save their progress in; pass --state-file")
+	}
+	return nil
+}
+
+// noDDLSteps are the steps rewriting the IDs of r for --no-ddl. The foreign keys stay in
+// place, so there is no fix-refs step: rewrite-ids moves every row and its references in one
+// statement, moveInPlaceSQL, all of them in one transaction. Every statement checks the
+// constraints, which makes it slower than dropping them.
+func (m *migration) noDDLSteps(r *idRewrite) []step {
+	return []step{{
+		name: "rewrite-ids",
+		run:  func(ctx context.Context) (int64, error) { return m.rewriteInPlace(ctx, r) },
+		emit: func(ctx context.Context, w io.Writer) error { return m.emitPerRow(ctx, w, r, m.moveInPlaceSQL(r)) },
+	}}
+}
+
+// rewriteInPlace moves every row of r's table to its new ID, repointing its references in the
+// same statement.
+func (m *migration) rewriteInPlace(ctx context.Context, r *idRewrite) (int64, error) {
+	if err := m.computeNewIDs(ctx, "rewrite-ids", r); err != nil {
+		return 0, err
+	}
+	stmt := m.moveInPlaceSQL(r)
+	err := m.sendPerRow(ctx, "rewrite-ids", r, func(batch *pgx.Batch, c idChange) {
+		batch.Queue(stmt, c.newID, c.oldID)
+	})
+	if err != nil {
+		return 0, fmt.Errorf("failed to move %s and the related tables to the new UUIDs: %w", r.table, err)
+	}
+	m.batchCommitted("rewrite-ids", int64(m.changes.len()))
+	return int64(m.changes.len()), nil
+}
+
+// moveInPlaceSQL moves the row of r's table with ID $2 to ID $1 while the foreign keys are
+// in place, in one statement: the references are deleted and inserted again with the new ID,
+// and the constraints are checked once the whole statement ran. The reconcile step and the
+// rewrite of --no-ddl use it. An audited run records the rows it changes as rewriteIDSQL and
+// updateReferenceSQL do.
+func (m *migration) moveInPlaceSQL(r *idRewrite) string {
+	var ctes []string
+	for i, ref := range r.referencers {
+		ctes = append(ctes, fmt.Sprintf(`refs_%d AS (
+DELETE FROM %s r WHERE r.%s = $2 RETURNING r.%s AS row_id
+)`, i, m.schema.prefix()+ref.table, ref.column, ref.rowID))
+	}
+	ctes = append(ctes, `moved AS (
+UPDATE `+m.schema.prefix()+r.table+` SET id = $1 WHERE id = $2 RETURNING id
+)`)
+	if m.auditID != "" {
+		ctes = append(ctes, "audit_moved AS (\n"+m.auditInsert("(SELECT $2::uuid AS row_id, $2::uuid AS old_id, id AS new_id FROM moved) changed", r.table, "id")+"\n)")
+	}
+	for i, ref := range r.referencers {
+		insert := fmt.Sprintf(`INSERT INTO %s (%s, %s) SELECT row_id, $1::uuid FROM refs_%d WHERE EXISTS (SELECT 1 FROM moved)`, m.schema.prefix()+ref.table, ref.rowID, ref.column, i)
+		if m.auditID == "" {
+			ctes = append(ctes, fmt.Sprintf("repointed_%d AS (\n%s\n)", i, insert))
+			continue
+		}
+		insert += "\nRETURNING " + ref.rowID + " AS row_id, $2::uuid AS old_id, " + ref.column + " AS new_id"
+		ctes = append(ctes,
+			fmt.Sprintf("repointed_%d AS (\n%s\n)", i, insert),
+			fmt.Sprintf("audit_repointed_%d AS (\n%s\n)", i, m.auditInsert(fmt.Sprintf("repointed_%d", i), ref.table, ref.column)))
+	}
+	return "WITH " + strings.Join(ctes, ",\n") + "\nSELECT count(*) FROM moved"
+}
+
+// checkDMLPrivileges fails a --no-ddl run before it changes anything when the user lacks one of
+// noDDLPrivileges on a table of the rewrite, rather than at the first statement needing it.
+func (m *migration) checkDMLPrivileges(ctx context.Context) error {
+	if !m.noDDL {
+		return nil
+	}
+	var tables []string
+	for _, t := range dependencyIDs.tables() {
+		tables = append(tables, m.schema.prefix()+t)
+	}
+	// fix-sbom-ids moves the SBOMs including the rewritten dependencies.
+	for _, t := range sbomTables() {
+		if !slices.Contains(tables, m.schema.prefix()+t) {
+			tables = append(tables, m.schema.prefix()+t)
+		}
+	}
+	var missing []string
+	err := m.retry(ctx, "check-privileges", func(conn *pgx.Conn) error {
+		missing = missing[:0]
+		rows, err := conn.Query(ctx, `
+			SELECT p.privilege || ' on ' || t.name
+			FROM unnest($1::text[]) t(name), unnest($2::text[]) p(privilege)
+			WHERE NOT has_table_privilege(t.name, p.privilege)
+		`, tables, noDDLPrivileges)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var s string
+			if err := rows.Scan(&s); err != nil {
+				return err
+			}
+			missing = append(missing, s)
+		}
+		return rows.Err()
+	})
+	if err != nil {
+		return fmt.Errorf("failed to check the privileges of the user: %w", err)
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("--no-ddl needs %s on the tables it rewrites; the user lacks %s", strings.Join(noDDLPrivileges, ", "), strings.Join(missing, ", "))
+	}
+	return nil
+}
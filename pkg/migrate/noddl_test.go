@@ -0,0 +1,56 @@
+package migrate
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestCheckNoDDLOptions(t *testing.T) {
+	for _, o := range []*options{
+		{},
+		{noDDL: true},
+		{noDDL: true, cleanup: cleanupNull, emitSQL: "migration.sql"},
+		{noDDL: true, hookMode: true, stateFile: "state.json"},
+	} {
+		if err := checkNoDDLOptions(o); err != nil {
+			t.Errorf("checkNoDDLOptions(%+v) = %v", o, err)
+		}
+	}
+	for _, o := range []*options{
+		{noDDL: true, fast: true},
+		{noDDL: true, deferFKs: true},
+		{noDDL: true, online: true},
+		{noDDL: true, rebuildIndexes: true},
+		{noDDL: true, estimate: true},
+		{noDDL: true, cleanup: cleanupDrop},
+		{noDDL: true, audit: true},
+		{noDDL: true, errorPolicy: errorPolicyQuarantine},
+		{noDDL: true, completionRow: true},
+		{noDDL: true, initContainer: true},
+	} {
+		if err := checkNoDDLOptions(o); err == nil {
+			t.Errorf("checkNoDDLOptions(%+v) succeeded", o)
+		}
+	}
+}
+
+func TestMoveInPlaceSQL(t *testing.T) {
+	m := &migration{}
+	sql := m.moveInPlaceSQL(dependencyIDs)
+	for _, want := range []string{
+		"DELETE FROM public.bill_of_materials_included_dependencies r WHERE r.dependency_id = $2",
+		"UPDATE public.dependencies SET id = $1 WHERE id = $2",
+		"INSERT INTO public.bill_of_materials_included_dependencies (bill_of_materials_id, dependency_id) SELECT row_id, $1::uuid FROM refs_0",
+	} {
+		if !strings.Contains(sql, want) {
+			t.Errorf("moveInPlaceSQL() = %s, want it to contain %s", sql, want)
+		}
+	}
+	if strings.Contains(sql, auditTable) {
+		t.Errorf("moveInPlaceSQL() without --audit writes the audit table: %s", sql)
+	}
+	m.auditID = "00000000-0000-0000-0000-000000000001"
+	if sql := m.moveInPlaceSQL(dependencyIDs); strings.Count(sql, "INSERT INTO "+m.schema.prefix()+auditTable) != 2 {
+		t.Errorf("moveInPlaceSQL() with --audit = %s, want the ID and the reference audited", sql)
+	}
+}
@@ -0,0 +1,232 @@
+package migrate
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// purlLevel is one of the package tables normalize-purls merges rows of: mapTable maps each row
+// that becomes identical to another onto the one kept, from the key of the row once its parent
+// is merged.
+type purlLevel struct {
+	table    string
+	mapTable string
+	mapSQL   string
+}
+
+// purlLevels are the package tables from the top of the purl down. A row is kept when it already
+// is canonical and hangs off the row its parent is merged into, and otherwise the one with the
+// lowest ID, so running the pass again changes nothing.
+func purlLevels(schema dbSchema) []purlLevel {
+	return []purlLevel{
+		{
+			table:    "package_types",
+			mapTable: "guac_update_db_purl_types",
+			mapSQL: `SELECT id AS old_id, first_value(id) OVER (PARTITION BY lower(type) ORDER BY type = lower(type) DESC, id) AS new_id
+FROM ` + schema.prefix() + `package_types`,
+		},
+		{
+			table:    "package_namespaces",
+			mapTable: "guac_update_db_purl_namespaces",
+			mapSQL: `SELECT ns.id AS old_id, first_value(ns.id) OVER (PARTITION BY p.new_id, ns.namespace ORDER BY ns.package_id = p.new_id DESC, ns.id) AS new_id
+FROM ` + schema.prefix() + `package_namespaces ns JOIN guac_update_db_purl_types p ON p.old_id = ns.package_id`,
+		},
+		{
+			table:    "package_names",
+			mapTable: "guac_update_db_purl_names",
+			mapSQL: `SELECT n.id AS old_id, first_value(n.id) OVER (PARTITION BY p.new_id, n.name ORDER BY n.namespace_id = p.new_id DESC, n.id) AS new_id
+FROM ` + schema.prefix() + `package_names n JOIN guac_update_db_purl_namespaces p ON p.old_id = n.namespace_id`,
+		},
+		{
+			// GUAC sorts the qualifiers before hashing them, so the hash of a version does not change.
+			table:    "package_versions",
+			mapTable: "guac_update_db_purl_versions",
+			mapSQL: `SELECT v.id AS old_id, first_value(v.id) OVER (PARTITION BY p.new_id, v.hash ORDER BY v.name_id = p.new_id DESC, v.id) AS new_id
+FROM ` + schema.prefix() + `package_versions v JOIN guac_update_db_purl_names p ON p.old_id = v.name_id`,
+		},
+	}
+}
+
+// purlDependencyMapTable maps each dependency that becomes identical to another once its
+// packages are merged onto the one kept.
+const purlDependencyMapTable = "guac_update_db_purl_dependencies"
+
+// purlDependencyMapSQL groups the dependencies by the columns of the unique indexes GUAC
+// creates on them, with the package references they will have. version_range is only part of
+// the index on the dependencies without dependent_package_version_id.
+func purlDependencyMapSQL(schema dbSchema) string {
+	return `SELECT old_id, new_id FROM (
+	SELECT d.id AS old_id, first_value(d.id) OVER (
+		PARTITION BY coalesce(p.new_id, d.package_id), coalesce(n.new_id, d.dependent_package_name_id), coalesce(v.new_id, d.dependent_package_version_id),
+		             CASE WHEN d.dependent_package_version_id IS NULL THEN d.version_range END,
+		             d.dependency_type, d.justification, d.origin, d.collector, d.document_ref
+		ORDER BY (p.old_id IS NULL AND n.old_id IS NULL AND v.old_id IS NULL) DESC, d.id) AS new_id
+	FROM ` + schema.prefix() + `dependencies d
+	LEFT JOIN guac_update_db_purl_versions p ON p.old_id = d.package_id
+	LEFT JOIN guac_update_db_purl_names n ON n.old_id = d.dependent_package_name_id
+	LEFT JOIN guac_update_db_purl_versions v ON v.old_id = d.dependent_package_version_id
+) m
+WHERE old_id <> new_id`
+}
+
+// sortQualifiersSQL puts the qualifiers of every package version in key order, as GUAC stores
+// them, leaving anything but an array as it is.
+func sortQualifiersSQL(schema dbSchema) string {
+	return `UPDATE ` + schema.prefix() + `package_versions v SET qualifiers = s.sorted
+FROM (
+	SELECT pv.id, (SELECT jsonb_agg(q ORDER BY q->>'key', q->>'value') FROM jsonb_array_elements(pv.qualifiers) q) AS sorted
+	FROM ` + schema.prefix() + `package_versions pv
+	WHERE CASE WHEN jsonb_typeof(pv.qualifiers) = 'array' THEN jsonb_array_length(pv.qualifiers) > 1 ELSE false END
+) s
+WHERE v.id = s.id AND v.qualifiers IS DISTINCT FROM s.sorted`
+}
+
+// checkNormalizeOptions rejects settings --normalize-purls does not support.
+func checkNormalizeOptions(opts *options) error {
+	if !opts.normalizePurls {
+		return nil
+	}
+	switch {
+	case opts.online:
+		return errors.New("--normalize-purls merges package rows GUAC writes to and cannot be combined with --online")
+	case opts.estimate:
+		return errors.New("--estimate does not measure --normalize-purls")
+	case opts.dialect == dialectCockroach:
+		return errors.New("--normalize-purls maps the merged rows in temporary tables and cannot be used with --dialect=cockroach")
+	}
+	return nil
+}
+
+// withPurlNormalization runs normalize-purls before the other steps, so the backfill resolves
+// versions and the rewrite derives the IDs from the merged packages.
+func (m *migration) withPurlNormalization(steps []step) []step {
+	return append([]step{{name: "normalize-purls", run: m.normalizePurls, emit: m.emitNormalizePurls}}, steps...)
+}
+
+// purlMapSQL returns the statements creating the tables that map the package rows and the
+// dependencies normalize-purls merges onto the ones kept. They are dropped at the commit.
+func purlMapSQL(schema dbSchema) []string {
+	levels := purlLevels(schema)
+	var stmts []string
+	for _, l := range levels {
+		stmts = append(stmts, `CREATE TEMPORARY TABLE `+l.mapTable+` ON COMMIT DROP AS `+l.mapSQL)
+	}
+	for _, l := range levels {
+		stmts = append(stmts, `DELETE FROM `+l.mapTable+` WHERE old_id = new_id`)
+	}
+	return append(stmts, `CREATE TEMPORARY TABLE `+purlDependencyMapTable+` ON COMMIT DROP AS `+purlDependencyMapSQL(schema))
+}
+
+// purlMergedSQL counts the rows the maps of purlMapSQL merge.
+func purlMergedSQL(schema dbSchema) string {
+	var counts []string
+	for _, l := range append(purlLevels(schema), purlLevel{mapTable: purlDependencyMapTable}) {
+		counts = append(counts, `(SELECT count(*) FROM `+l.mapTable+`)`)
+	}
+	return `SELECT ` + strings.Join(counts, " + ")
+}
+
+// normalizeSQL returns the statements of normalize-purls changing the database, to run after
+// those of purlMapSQL in the same transaction. They merge the package rows and the dependencies
+// that become identical, repointing the references to a merged row to the one kept before
+// deleting it, from the dependencies up, then lowercase the package types and sort the
+// qualifiers.
+func (m *migration) normalizeSQL(ctx context.Context, q queryer) ([]string, error) {
+	var stmts []string
+	for _, ref := range dependencyIDs.referencers {
+		// The references are re-inserted rather than updated, as the dependency kept may be
+		// referenced by the same row already; a referencing row is its rowID and column.
+		stmts = append(stmts,
+			fmt.Sprintf(`INSERT INTO %[1]s (%[2]s, %[3]s)
+SELECT DISTINCT r.%[2]s, m.new_id FROM %[1]s r JOIN %[4]s m ON m.old_id = r.%[3]s
+ON CONFLICT DO NOTHING`, m.schema.prefix()+ref.table, ref.rowID, ref.column, purlDependencyMapTable),
+			m.audited(fmt.Sprintf(`DELETE FROM %[1]s r USING %[3]s m WHERE r.%[2]s = m.old_id`, m.schema.prefix()+ref.table, ref.column, purlDependencyMapTable),
+				"r."+ref.rowID+" AS row_id, m.old_id, m.new_id", ref.table, ref.column))
+	}
+	stmts = append(stmts, m.audited(`DELETE FROM `+m.schema.prefix()+`dependencies d USING `+purlDependencyMapTable+` m WHERE d.id = m.old_id`,
+		"d.id AS row_id, m.old_id, m.new_id", "dependencies", "id"))
+
+	levels := purlLevels(m.schema)
+	for i := len(levels) - 1; i >= 0; i-- {
+		l := levels[i]
+		fks, err := foreignKeysReferencing(ctx, q, m.schema, l.table)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read the foreign keys referencing %s: %w", l.table, err)
+		}
+		for _, fk := range fks {
+			column := pgx.Identifier{fk.column}.Sanitize()
+			update := `UPDATE ` + fk.table + ` r SET ` + column + ` = m.new_id FROM ` + l.mapTable + ` m WHERE r.` + column + ` = m.old_id`
+			if fk.table == "dependencies" {
+				update = m.audited(update, "r.id AS row_id, m.old_id, m.new_id", "dependencies", fk.column)
+			}
+			stmts = append(stmts, update)
+		}
+		stmts = append(stmts, `DELETE FROM `+m.schema.prefix()+l.table+` t USING `+l.mapTable+` m WHERE t.id = m.old_id`)
+	}
+	return append(stmts, `UPDATE `+m.schema.prefix()+`package_types SET type = lower(type) WHERE type <> lower(type)`, sortQualifiersSQL(m.schema)), nil
+}
+
+// normalizePurls runs normalize-purls in one transaction and returns the rows it changed. A
+// table referencing the package tables whose rows become duplicates of each other fails it,
+// and nothing is changed.
+func (m *migration) normalizePurls(ctx context.Context) (int64, error) {
+	var changed, merged int64
+	err := m.retry(ctx, "normalize-purls", func(conn *pgx.Conn) error {
+		changed = 0
+		tx, err := conn.Begin(ctx)
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback(ctx)
+		for _, stmt := range purlMapSQL(m.schema) {
+			if _, err := tx.Exec(ctx, stmt); err != nil {
+				return err
+			}
+		}
+		if err := tx.QueryRow(ctx, purlMergedSQL(m.schema)).Scan(&merged); err != nil {
+			return err
+		}
+		stmts, err := m.normalizeSQL(ctx, tx)
+		if err != nil {
+			return err
+		}
+		for _, stmt := range stmts {
+			tag, err := tx.Exec(ctx, stmt)
+			if err != nil {
+				return err
+			}
+			changed += tag.RowsAffected()
+		}
+		return tx.Commit(ctx)
+	})
+	if err != nil {
+		return 0, fmt.Errorf("failed to normalize the purls: %w", err)
+	}
+	m.logger.Printf("normalize-purls: %d rows merged into identical ones, %d rows changed in all\n", merged, changed)
+	m.batchCommitted("normalize-purls", changed)
+	return changed, nil
+}
+
+// emitNormalizePurls writes the transaction of normalize-purls.
+func (m *migration) emitNormalizePurls(ctx context.Context, w io.Writer) error {
+	var stmts []string
+	err := m.retry(ctx, "normalize-purls", func(conn *pgx.Conn) error {
+		var err error
+		stmts, err = m.normalizeSQL(ctx, conn)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(w, "BEGIN;\n")
+	for _, stmt := range append(purlMapSQL(m.schema), stmts...) {
+		fmt.Fprintf(w, "%s;\n", stmt)
+	}
+	fmt.Fprintf(w, "COMMIT;\n")
+	return nil
+}
@@ -0,0 +1,36 @@
+package migrate
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestCheckNormalizeOptions(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		opts options
+		ok   bool
+	}{
+		{"off", options{online: true}, true},
+		{"normalize", options{normalizePurls: true, fast: true, emitSQL: "migrate.sql"}, true},
+		{"online", options{normalizePurls: true, online: true}, false},
+		{"estimate", options{normalizePurls: true, estimate: true}, false},
+		{"cockroach", options{normalizePurls: true, dialect: dialectCockroach}, false},
+	} {
+		if err := checkNormalizeOptions(&tc.opts); (err == nil) != tc.ok {
+			t.Errorf("%s: checkNormalizeOptions() = %v, want ok %v", tc.name, err, tc.ok)
+		}
+	}
+}
+
+func TestPurlNormalizationRunsFirst(t *testing.T) {
+	m := &migration{normalize: true}
+	steps := m.dependencyVersionIDSteps()
+	var names []string
+	for _, s := range steps {
+		names = append(names, s.name)
+	}
+	if len(names) < 2 || names[0] != "normalize-purls" || names[1] != "backfill" {
+		t.Errorf("steps = %s, want normalize-purls first, then backfill", strings.Join(names, ", "))
+	}
+}
@@ -0,0 +1,193 @@
+package migrate
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// notifyTimeout bounds each attempt to deliver a notification.
+const notifyTimeout = 30 * time.Second
+
+// notifyAttempts is how often a notification is tried before giving up.
+const notifyAttempts = 3
+
+// notifier posts the outcome of a run to --notify-url, so an unattended migration alerts
+// whoever is on call.
+type notifier struct {
+	url string
+	// format is webhook, slack or auto, which picks slack for Slack incoming webhook URLs.
+	format string
+	http   *http.Client
+}
+
+func (n *notifier) register(fs *flag.FlagSet) {
+	fs.StringVar(&n.url, "notify-url", "", "post the report or the failure of the run to this webhook `url` when it finishes")
+	fs.StringVar(&n.format, "notify-format", "auto", "`format` of the notification: webhook (the JSON report), slack, or auto to pick slack for hooks.slack.com URLs")
+}
+
+func (n *notifier) validate() error {
+	if n.format != "auto" && n.format != "webhook" && n.format != "slack" {
+		return fmt.Errorf("invalid --notify-format %q: must be auto, webhook or slack", n.format)
+	}
+	if n.url == "" {
+		return nil
+	}
+	u, err := url.Parse(n.url)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("invalid --notify-url: must be an http or https URL")
+	}
+	return nil
+}
+
+func (n *notifier) slack() bool {
+	if n.format != "auto" {
+		return n.format == "slack"
+	}
+	u, err := url.Parse(n.url)
+	return err == nil && u.Host == "hooks.slack.com"
+}
+
+// webhookNotification is the body posted in the webhook format.
+type webhookNotification struct {
+	// Event is migration.succeeded or migration.failed.
+	Event  string      `json:"event"`
+	Report interface{} `json:"report"`
+}
+
+// notifyRun reports the outcome of a single-database run.
+func (n *notifier) notifyRun(r *Report) {
+	if n.url == "" {
+		return
+	}
+	if n.slack() {
+		n.post(map[string]string{"text": slackRunText(r)})
+		return
+	}
+	n.post(webhookNotification{Event: notificationEvent(r.Success), Report: r})
+}
+
+// notifyTargets reports the outcome of a --targets run.
+func (n *notifier) notifyTargets(r *TargetsReport) {
+	if n.url == "" {
+		return
+	}
+	if n.slack() {
+		n.post(map[string]string{"text": slackTargetsText(r)})
+		return
+	}
+	n.post(webhookNotification{Event: notificationEvent(r.Success), Report: r})
+}
+
+func notificationEvent(success bool) string {
+	if success {
+		return "migration.succeeded"
+	}
+	return "migration.failed"
+}
+
+// post delivers body, retrying failed attempts. A notification that cannot be delivered is
+// logged and does not change the outcome of the run.
+func (n *notifier) post(body interface{}) {
+	data, err := json.Marshal(body)
+	if err != nil {
+		log.Printf("Failed to encode notification: %v\n", err)
+		return
+	}
+	client := n.http
+	if client == nil {
+		client = &http.Client{Timeout: notifyTimeout}
+	}
+	for attempt := 1; ; attempt++ {
+		err = postNotification(client, n.url, data)
+		if err == nil {
+			return
+		}
+		if attempt == notifyAttempts {
+			// The URL of a Slack webhook is a secret; only name the host.
+			host := n.url
+			if u, perr := url.Parse(n.url); perr == nil {
+				host = u.Host
+			}
+			log.Printf("Failed to send notification to %s: %v\n", host, err)
+			return
+		}
+		time.Sleep(time.Duration(attempt) * 2 * time.Second)
+	}
+}
+
+func postNotification(client *http.Client, endpoint string, data []byte) error {
+	ctx, cancel := context.WithTimeout(context.Background(), notifyTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := client.Do(req)
+	if err != nil {
+		// The error quotes the URL.
+		if uerr, ok := err.(*url.Error); ok {
+			return uerr.Err
+		}
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("webhook returned %s: %s", resp.Status, bytes.TrimSpace(msg))
+	}
+	return nil
+}
+
+// slackRunText summarises a run for a Slack message: the outcome, then one line per step.
+func slackRunText(r *Report) string {
+	var b strings.Builder
+	what := "Migration"
+	if r.Database != "" {
+		what = fmt.Sprintf("Migration of `%s`", r.Database)
+	}
+	duration := seconds(r.DurationSeconds).Round(time.Second)
+	if r.Success {
+		fmt.Fprintf(&b, ":white_check_mark: guac-update-db: %s succeeded in %s\n", what, duration)
+	} else {
+		fmt.Fprintf(&b, ":x: guac-update-db: %s failed after %s: %s\n", what, duration, r.Error)
+	}
+	for _, s := range r.Steps {
+		switch {
+		case s.Skipped:
+			fmt.Fprintf(&b, "• %s: skipped\n", s.Name)
+		case s.Error != "":
+			fmt.Fprintf(&b, "• %s: *failed* after %s\n", s.Name, seconds(s.DurationSeconds).Round(time.Millisecond))
+		default:
+			fmt.Fprintf(&b, "• %s: %d rows in %s\n", s.Name, s.Rows, seconds(s.DurationSeconds).Round(time.Millisecond))
+		}
+	}
+	return strings.TrimSuffix(b.String(), "\n")
+}
+
+func slackTargetsText(r *TargetsReport) string {
+	var b strings.Builder
+	duration := seconds(r.DurationSeconds).Round(time.Second)
+	if r.Success {
+		fmt.Fprintf(&b, ":white_check_mark: guac-update-db: migrated %d targets in %s\n", len(r.Targets), duration)
+	} else {
+		fmt.Fprintf(&b, ":x: guac-update-db: %d of %d targets failed after %s: %s\n", len(r.Failed), len(r.Targets), duration, strings.Join(r.Failed, ", "))
+	}
+	for _, t := range r.Targets {
+		if t.Success {
+			fmt.Fprintf(&b, "• %s: done in %s\n", t.Name, seconds(t.DurationSeconds).Round(time.Second))
+		} else {
+			fmt.Fprintf(&b, "• %s: *failed*: %s\n", t.Name, t.Error)
+		}
+	}
+	return strings.TrimSuffix(b.String(), "\n")
+}
@@ -0,0 +1,78 @@
+package migrate
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestNotifyRun(t *testing.T) {
+	var bodies []map[string]interface{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, _ := io.ReadAll(r.Body)
+		var body map[string]interface{}
+		if err := json.Unmarshal(data, &body); err != nil {
+			t.Errorf("notification is not JSON: %s", data)
+		}
+		bodies = append(bodies, body)
+	}))
+	defer server.Close()
+
+	report := newReport()
+	report.Database = "guac"
+	report.addStep("backfill", 42, 0, nil)
+	report.addStep("rewrite-ids", 0, 0, errors.New("deadlock detected"))
+	report.finish(errors.New("dependency-version-ids: rewrite-ids: deadlock detected"))
+
+	for _, format := range []string{"webhook", "slack"} {
+		bodies = nil
+		n := &notifier{url: server.URL, format: format, http: server.Client()}
+		n.notifyRun(report)
+		if len(bodies) != 1 {
+			t.Fatalf("%s: %d notifications posted, want 1", format, len(bodies))
+		}
+		body := bodies[0]
+		if format == "webhook" {
+			if body["event"] != "migration.failed" {
+				t.Errorf("webhook event = %v, want migration.failed", body["event"])
+			}
+			if r, ok := body["report"].(map[string]interface{}); !ok || r["database"] != "guac" || r["success"] != false {
+				t.Errorf("webhook report = %v, want the failed report of guac", body["report"])
+			}
+			continue
+		}
+		text, _ := body["text"].(string)
+		for _, want := range []string{":x:", "`guac`", "deadlock detected", "• backfill: 42 rows", "• rewrite-ids: *failed*"} {
+			if !strings.Contains(text, want) {
+				t.Errorf("slack text %q does not contain %q", text, want)
+			}
+		}
+	}
+}
+
+func TestNotifierFormat(t *testing.T) {
+	for _, tc := range []struct {
+		url, format string
+		slack       bool
+	}{
+		{"https://hooks.slack.com/services/T0/B0/x", "auto", true},
+		{"https://alerts.example.com/hook", "auto", false},
+		{"https://alerts.example.com/hook", "slack", true},
+		{"https://hooks.slack.com/services/T0/B0/x", "webhook", false},
+	} {
+		n := &notifier{url: tc.url, format: tc.format}
+		if err := n.validate(); err != nil {
+			t.Errorf("validate(%s, %s) = %v", tc.url, tc.format, err)
+		}
+		if got := n.slack(); got != tc.slack {
+			t.Errorf("slack() for %s with %s = %v, want %v", tc.url, tc.format, got, tc.slack)
+		}
+	}
+	if err := (&notifier{url: "ftp://example.com", format: "auto"}).validate(); err == nil {
+		t.Errorf("validate() accepted an ftp URL")
+	}
+}
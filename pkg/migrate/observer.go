@@ -0,0 +1,135 @@
+// Package migrate is the guac-update-db migration. Run runs it in the calling process and Main
+// is the guac-update-db command wrapping it. A run reports its progress to an Observer as it
+// goes, so programs driving it can follow it in their own UIs, chat bots or orchestration
+// systems without parsing its log.
+package migrate
+
+import (
+	"encoding/json"
+	"io"
+	"sync"
+	"time"
+)
+
+// Observer is told about the events of a run as they happen. The migration calls it from the
+// goroutines doing the work, several at a time with --workers or --parallel, so implementations
+// must be safe for concurrent use, and return quickly: the run waits for every call.
+type Observer interface {
+	// OnStepStart is called before a step runs.
+	OnStepStart(StepStart)
+	// OnBatchComplete is called after a step committed a batch of rows.
+	OnBatchComplete(Batch)
+	// OnCollision is called for every new ID more than one existing row would get. The run
+	// stops before rewriting any IDs when there are some.
+	OnCollision(Collision)
+	// OnFinish is called once the run against a database is over, whatever its outcome.
+	OnFinish(Result)
+}
+
+// StepStart is a step that is about to run.
+type StepStart struct {
+	Database string `json:"database"`
+	// Migration is the data migration the step belongs to, empty for the steps run once after
+	// all of them.
+	Migration string `json:"migration,omitempty"`
+	// MigrationNumber is the position of Migration among the Migrations data migrations of the
+	// run, from 1, for progress across all of them; it is 0 for the steps after all of them.
+	MigrationNumber int       `json:"migration_number,omitempty"`
+	Migrations      int       `json:"migrations,omitempty"`
+	Step            string    `json:"step"`
+	Time            time.Time `json:"time"`
+}
+
+// Batch is a batch of rows a step committed.
+type Batch struct {
+	Database string    `json:"database"`
+	Step     string    `json:"step"`
+	Rows     int64     `json:"rows"`
+	Time     time.Time `json:"time"`
+}
+
+// Collision is a new ID that more than one existing row of Table hashes to.
+type Collision struct {
+	Database string   `json:"database"`
+	Table    string   `json:"table"`
+	NewID    string   `json:"new_id"`
+	OldIDs   []string `json:"old_ids"`
+}
+
+// Result is the outcome of a run against one database. Outcome and ExitCode are the ones the
+// migrate command reports and exits with: success, already-migrated, schema-mismatch,
+// verification-failed, partial, transient-error or failed. Success is set for the first two,
+// which both exit with 0.
+type Result struct {
+	Database        string  `json:"database"`
+	Success         bool    `json:"success"`
+	Outcome         string  `json:"outcome"`
+	ExitCode        int     `json:"exit_code"`
+	Error           string  `json:"error,omitempty"`
+	DurationSeconds float64 `json:"duration_seconds"`
+}
+
+// NopObserver ignores every event. Embed it to implement only some of the methods of Observer.
+type NopObserver struct{}
+
+func (NopObserver) OnStepStart(StepStart) {}
+func (NopObserver) OnBatchComplete(Batch) {}
+func (NopObserver) OnCollision(Collision) {}
+func (NopObserver) OnFinish(Result)       {}
+
+// Observers returns an Observer passing every event to each of observers in turn.
+func Observers(observers ...Observer) Observer {
+	return multiObserver(observers)
+}
+
+type multiObserver []Observer
+
+func (m multiObserver) OnStepStart(e StepStart) {
+	for _, o := range m {
+		o.OnStepStart(e)
+	}
+}
+
+func (m multiObserver) OnBatchComplete(e Batch) {
+	for _, o := range m {
+		o.OnBatchComplete(e)
+	}
+}
+
+func (m multiObserver) OnCollision(e Collision) {
+	for _, o := range m {
+		o.OnCollision(e)
+	}
+}
+
+func (m multiObserver) OnFinish(e Result) {
+	for _, o := range m {
+		o.OnFinish(e)
+	}
+}
+
+// NewJSONLines returns an Observer writing every event to w as a line of JSON, the event's
+// fields under "data" and its kind under "event": step_start, batch_complete, collision or
+// finish. Errors writing to w are ignored; the run goes on without its events.
+func NewJSONLines(w io.Writer) Observer {
+	return &jsonLines{enc: json.NewEncoder(w)}
+}
+
+type jsonLines struct {
+	mu  sync.Mutex
+	enc *json.Encoder
+}
+
+func (j *jsonLines) write(event string, data interface{}) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	_ = j.enc.Encode(struct {
+		Event string      `json:"event"`
+		Data  interface{} `json:"data"`
+	}{event, data})
+}
+
+func (j *jsonLines) OnStepStart(e StepStart) { j.write("step_start", e) }
+func (j *jsonLines) OnBatchComplete(e Batch) { j.write("batch_complete", e) }
+func (j *jsonLines) OnCollision(e Collision) { j.write("collision", e) }
+func (j *jsonLines) OnFinish(e Result)       { j.write("finish", e) }
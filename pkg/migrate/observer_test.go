@@ -0,0 +1,60 @@
+package migrate
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+)
+
+// recorder is an Observer remembering the kinds of the events it was told about.
+type recorder struct {
+	NopObserver
+	events []string
+}
+
+func (r *recorder) OnStepStart(e StepStart) { r.events = append(r.events, "step_start "+e.Step) }
+func (r *recorder) OnFinish(e Result)       { r.events = append(r.events, "finish "+e.Outcome) }
+
+func TestObservers(t *testing.T) {
+	a, b := &recorder{}, &recorder{}
+	o := Observers(a, b)
+	o.OnStepStart(StepStart{Step: "backfill"})
+	o.OnBatchComplete(Batch{Step: "backfill", Rows: 3})
+	o.OnCollision(Collision{NewID: "n"})
+	o.OnFinish(Result{Outcome: "success"})
+
+	want := "step_start backfill,finish success"
+	for _, r := range []*recorder{a, b} {
+		if got := strings.Join(r.events, ","); got != want {
+			t.Errorf("observer got events %s, want %s", got, want)
+		}
+	}
+}
+
+func TestJSONLines(t *testing.T) {
+	var buf bytes.Buffer
+	o := NewJSONLines(&buf)
+	at := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	o.OnStepStart(StepStart{Database: "guac", Migration: "dependency-version-ids", MigrationNumber: 1, Migrations: 2, Step: "backfill", Time: at})
+	o.OnBatchComplete(Batch{Database: "guac", Step: "backfill", Rows: 10000, Time: at})
+	o.OnCollision(Collision{Database: "guac", Table: "dependencies", NewID: "n", OldIDs: []string{"a", "b"}})
+	o.OnFinish(Result{Database: "guac", Outcome: "verification-failed", ExitCode: 5, Error: "verification failed", DurationSeconds: 1.5})
+
+	want := []string{
+		`{"event":"step_start","data":{"database":"guac","migration":"dependency-version-ids","migration_number":1,"migrations":2,"step":"backfill","time":"2024-05-01T12:00:00Z"}}`,
+		`{"event":"batch_complete","data":{"database":"guac","step":"backfill","rows":10000,"time":"2024-05-01T12:00:00Z"}}`,
+		`{"event":"collision","data":{"database":"guac","table":"dependencies","new_id":"n","old_ids":["a","b"]}}`,
+		`{"event":"finish","data":{"database":"guac","success":false,"outcome":"verification-failed","exit_code":5,"error":"verification failed","duration_seconds":1.5}}`,
+	}
+	lines := strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n")
+	if len(lines) != len(want) {
+		t.Fatalf("wrote %d lines, want %d:\n%s", len(lines), len(want), buf.String())
+	}
+	for i, line := range lines {
+		if !json.Valid([]byte(line)) || line != want[i] {
+			t.Errorf("line %d = %s, want %s", i+1, line, want[i])
+		}
+	}
+}
@@ -0,0 +1,590 @@
+package migrate
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+)
+
+// shadowPrefix names the functions, triggers, check constraints and indexes --online adds
+// for the shadow columns. All of them are gone after the cutover.
+const shadowPrefix = "guac_shadow_"
+
+// shadowColumn is the column holding the new value of column until the cutover swaps it in.
+func shadowColumn(column string) string {
+	return "new_" + column
+}
+
+// shadowed is a column --online rewrites through a shadow column: the id column of the
+// rewritten table, or the column of a referencer.
+type shadowed struct {
+	table  string
+	column string
+}
+
+// shadowedColumns are the columns of r swapped at the cutover, the id column first.
+func (r *idRewrite) shadowedColumns() []shadowed {
+	cols := []shadowed{{table: r.table, column: "id"}}
+	for _, ref := range r.referencers {
+		cols = append(cols, shadowed{table: ref.table, column: ref.column})
+	}
+	return cols
+}
+
+// shadowTables are the tables of r with the shadowed columns of each, in order.
+func (r *idRewrite) shadowTables() ([]string, map[string][]string) {
+	var tables []string
+	columns := make(map[string][]string)
+	for _, s := range r.shadowedColumns() {
+		if _, ok := columns[s.table]; !ok {
+			tables = append(tables, s.table)
+		}
+		columns[s.table] = append(columns[s.table], s.column)
+	}
+	return tables, columns
+}
+
+// notNullConstraint is the check constraint proving the shadow column of s holds no NULL, so
+// the cutover can make it NOT NULL without scanning the table.
+func (s shadowed) notNullConstraint() string {
+	return shadowPrefix + s.column + "_not_null"
+}
+
+// shadowIndexName is the index on the shadow column replacing index at the cutover.
+func shadowIndexName(index string) string {
+	name := shadowPrefix + index
+	if len(name) > 63 {
+		name = name[:63]
+	}
+	return name
+}
+
+// tableIndex is an index including a shadowed column. constraint is the primary key or unique
+// constraint the index backs, of type contype, if any.
+type tableIndex struct {
+	name       string
+	method     string
+	unique     bool
+	constraint string
+	contype    string
+	columns    []string
+}
+
+// createShadowSQL builds the index on the shadow column of s matching ix, without locking out
+// writes.
+func (ix tableIndex) createShadowSQL(schema dbSchema, s shadowed) string {
+	cols := make([]string, len(ix.columns))
+	for i, c := range ix.columns {
+		if c == s.column {
+			c = shadowColumn(c)
+		}
+		cols[i] = pgx.Identifier{c}.Sanitize()
+	}
+	unique := ""
+	if ix.unique {
+		unique = "UNIQUE "
+	}
+	return fmt.Sprintf("CREATE %sINDEX CONCURRENTLY IF NOT EXISTS %s ON %s USING %s (%s)",
+		unique, pgx.Identifier{shadowIndexName(ix.name)}.Sanitize(), schema.prefix()+s.table, ix.method, strings.Join(cols, ", "))
+}
+
+// swapSQL puts the shadow index of ix in its place once the shadow column carries the name of
+// s's column: as the constraint ix backed, or renamed to its name.
+func (ix tableIndex) swapSQL(schema dbSchema, s shadowed) string {
+	shadow := pgx.Identifier{shadowIndexName(ix.name)}.Sanitize()
+	switch ix.contype {
+	case "p":
+		return `ALTER TABLE ` + schema.prefix() + s.table + ` ADD CONSTRAINT ` + pgx.Identifier{ix.constraint}.Sanitize() + ` PRIMARY KEY USING INDEX ` + shadow
+	case "u":
+		return `ALTER TABLE ` + schema.prefix() + s.table + ` ADD CONSTRAINT ` + pgx.Identifier{ix.constraint}.Sanitize() + ` UNIQUE USING INDEX ` + shadow
+	default:
+		return `ALTER INDEX ` + schema.prefix() + shadow + ` RENAME TO ` + pgx.Identifier{ix.name}.Sanitize()
+	}
+}
+
+// shadowedIndexes returns the indexes on the column of s. Indexes on expressions, partial
+// indexes and indexes with INCLUDE columns cannot be rebuilt on the shadow column and fail.
+func shadowedIndexes(ctx context.Context, q queryer, schema dbSchema, s shadowed) ([]tableIndex, error) {
+	rows, err := q.Query(ctx, `
+		SELECT i.relname, am.amname, ix.indisunique, coalesce(con.conname, ''), coalesce(con.contype::text, ''),
+		       ix.indexprs IS NOT NULL OR ix.indpred IS NOT NULL OR ix.indnkeyatts <> ix.indnatts,
+		       ARRAY(SELECT a.attname::text
+		             FROM unnest(ix.indkey::int2[]) WITH ORDINALITY k(attnum, n)
+		             JOIN pg_attribute a ON a.attrelid = ix.indrelid AND a.attnum = k.attnum
+		             ORDER BY k.n)
+		FROM pg_index ix
+		JOIN pg_class i ON i.oid = ix.indexrelid
+		JOIN pg_am am ON am.oid = i.relam
+		JOIN pg_attribute c ON c.attrelid = ix.indrelid AND c.attname = $2
+		LEFT JOIN pg_constraint con ON con.conindid = ix.indexrelid AND con.conrelid = ix.indrelid AND con.contype IN ('p', 'u')
+		WHERE ix.indrelid = to_regclass($1) AND c.attnum = ANY(ix.indkey::int2[])
+		ORDER BY i.relname
+	`, schema.prefix()+s.table, s.column)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var indexes []tableIndex
+	for rows.Next() {
+		var ix tableIndex
+		var unsupported bool
+		if err := rows.Scan(&ix.name, &ix.method, &ix.unique, &ix.constraint, &ix.contype, &unsupported, &ix.columns); err != nil {
+			return nil, err
+		}
+		if unsupported {
+			return nil, fmt.Errorf("index %s on %s(%s) has expressions, a predicate or INCLUDE columns and cannot be rebuilt on the shadow column; drop it or migrate without --online", ix.name, s.table, s.column)
+		}
+		indexes = append(indexes, ix)
+	}
+	return indexes, rows.Err()
+}
+
+// shadowTriggerSQL keeps the shadow columns of r current while GUAC writes: a row of r's table
+// gets its new ID computed, once the columns an earlier step fills in are filled in, when it is
+// inserted or updated, and an update changing it is passed on to the rows referencing it. A
+// referencing row gets the new ID of the row it references.
+func (m *migration) shadowTriggerSQL(r *idRewrite) []string {
+	tables, columns := r.shadowTables()
+	var stmts []string
+	trigger := func(table, name, when, body string) {
+		fn := m.schema.prefix() + shadowPrefix + name
+		stmts = append(stmts,
+			`CREATE OR REPLACE FUNCTION `+fn+`() RETURNS trigger LANGUAGE plpgsql AS $$
+BEGIN
+`+body+`END
+$$`,
+			`DROP TRIGGER IF EXISTS `+shadowPrefix+name+` ON `+m.schema.prefix()+table,
+			`CREATE TRIGGER `+shadowPrefix+name+` `+when+` ON `+m.schema.prefix()+table+` FOR EACH ROW EXECUTE FUNCTION `+fn+`()`,
+		)
+	}
+
+	trigger(r.table, r.table, "BEFORE INSERT OR UPDATE", r.fill(m)+"  NEW.new_id := "+r.keySQL(m.scheme, "NEW")+";\n  RETURN NEW;\n")
+	var propagate strings.Builder
+	for _, ref := range r.referencers {
+		fmt.Fprintf(&propagate, "    UPDATE %s SET %s = NEW.new_id WHERE %s = NEW.id;\n", m.schema.prefix()+ref.table, shadowColumn(ref.column), ref.column)
+	}
+	trigger(r.table, r.table+"_refs", "AFTER UPDATE", "  IF NEW.new_id IS DISTINCT FROM OLD.new_id THEN\n"+propagate.String()+"  END IF;\n  RETURN NULL;\n")
+	for _, table := range tables[1:] {
+		var body strings.Builder
+		for _, column := range columns[table] {
+			fmt.Fprintf(&body, "  NEW.%s := (SELECT t.new_id FROM %s t WHERE t.id = NEW.%s);\n", shadowColumn(column), m.schema.prefix()+r.table, column)
+		}
+		body.WriteString("  RETURN NEW;\n")
+		trigger(table, table, "BEFORE INSERT OR UPDATE OF "+strings.Join(columns[table], ", "), body.String())
+	}
+	return stmts
+}
+
+// dropShadowTriggerSQL removes what shadowTriggerSQL created.
+func dropShadowTriggerSQL(schema dbSchema, r *idRewrite) []string {
+	tables, _ := r.shadowTables()
+	stmts := []string{
+		`DROP TRIGGER IF EXISTS ` + shadowPrefix + r.table + `_refs ON ` + schema.prefix() + r.table,
+		`DROP FUNCTION IF EXISTS ` + schema.prefix() + shadowPrefix + r.table + `_refs()`,
+	}
+	for _, table := range tables {
+		stmts = append(stmts,
+			`DROP TRIGGER IF EXISTS `+shadowPrefix+table+` ON `+schema.prefix()+table,
+			`DROP FUNCTION IF EXISTS `+schema.prefix()+shadowPrefix+table+`()`,
+		)
+	}
+	return stmts
+}
+
+// addShadowColumns adds the nullable shadow columns, which only changes the catalog, and the
+// triggers filling them in, in one short transaction.
+func (m *migration) addShadowColumns(ctx context.Context, r *idRewrite) (int64, error) {
+	err := m.retry(ctx, "add-shadow-columns", func(conn *pgx.Conn) error {
+		tx, err := conn.Begin(ctx)
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback(ctx)
+		for _, s := range r.shadowedColumns() {
+			if _, err := tx.Exec(ctx, `ALTER TABLE `+m.schema.prefix()+s.table+` ADD COLUMN IF NOT EXISTS `+shadowColumn(s.column)+` uuid`); err != nil {
+				return err
+			}
+		}
+		for _, stmt := range m.shadowTriggerSQL(r) {
+			if _, err := tx.Exec(ctx, stmt); err != nil {
+				return err
+			}
+		}
+		return tx.Commit(ctx)
+	})
+	if err != nil {
+		return 0, fmt.Errorf("failed to add the shadow columns: %w", err)
+	}
+	for _, s := range r.shadowedColumns() {
+		m.logger.Printf("add-shadow-columns: %s.%s is kept current by a trigger\n", s.table, shadowColumn(s.column))
+	}
+	return 0, nil
+}
+
+// backfillShadowColumns fills in the shadow columns of the rows written before the triggers
+// were added, in keyset-paginated chunks of r's table committed one at a time like the
+// backfill: each chunk sets the new IDs of its rows and the shadow columns of the rows
+// referencing them. Chunks are idempotent, so the step can be run again at any time. The rows
+// are locked in ID order, and the referencing rows by the ID they reference, so chunks of
+// --workers walking disjoint key ranges do not deadlock with each other or with the triggers.
+func (m *migration) backfillShadowColumns(ctx context.Context, r *idRewrite) (int64, error) {
+	key := r.keySQL(m.scheme, "t")
+	var updated atomic.Int64
+	logged := newProgressLog()
+	err := m.forEachRange(ctx, func(ctx context.Context, worker int, kr keyRange, t *throttle) error {
+		var lastID uuid.NullUUID
+		sizer := m.newChunkSizer("backfill-shadow")
+		for {
+			var chunkLast uuid.NullUUID
+			var chunkRows, chunkUpdated int64
+			started := time.Now()
+			err := m.retry(ctx, "backfill-shadow", func(conn *pgx.Conn) error {
+				chunkUpdated = 0
+				tx, err := conn.Begin(ctx)
+				if err != nil {
+					return err
+				}
+				defer tx.Rollback(ctx)
+				err = tx.QueryRow(ctx, `
+				WITH chunk AS (
+					SELECT id FROM `+m.schema.prefix()+r.table+`
+					WHERE ($1::uuid IS NULL OR id > $1::uuid)
+					  AND id >= $3 AND ($4::uuid IS NULL OR id < $4::uuid)
+					ORDER BY id
+					LIMIT $2
+				)
+				SELECT (SELECT id FROM chunk ORDER BY id DESC LIMIT 1), (SELECT count(*) FROM chunk)
+			`, lastID, sizer.next(), kr.from, kr.to).Scan(&chunkLast, &chunkRows)
+				if err != nil || !chunkLast.Valid {
+					return err
+				}
+				tag, err := tx.Exec(ctx, `
+				UPDATE `+m.schema.prefix()+r.table+` t SET new_id = `+key+`
+				WHERE t.id IN (
+					SELECT t.id FROM `+m.schema.prefix()+r.table+` t
+					WHERE ($1::uuid IS NULL OR t.id > $1::uuid) AND t.id >= $3 AND t.id <= $2
+					  AND t.new_id IS DISTINCT FROM `+key+`
+					ORDER BY t.id
+					FOR UPDATE
+				) AND t.new_id IS DISTINCT FROM `+key, lastID, chunkLast.UUID, kr.from)
+				if err != nil {
+					return err
+				}
+				chunkUpdated += tag.RowsAffected()
+				for _, ref := range r.referencers {
+					tag, err := tx.Exec(ctx, `
+					WITH locked AS (
+						SELECT r.`+ref.rowID+` AS row_id, r.`+ref.column+` AS id, t.new_id
+						FROM `+m.schema.prefix()+ref.table+` r JOIN `+m.schema.prefix()+r.table+` t ON r.`+ref.column+` = t.id
+						WHERE ($1::uuid IS NULL OR t.id > $1::uuid) AND t.id >= $3 AND t.id <= $2
+						  AND r.`+shadowColumn(ref.column)+` IS DISTINCT FROM t.new_id
+						ORDER BY r.`+ref.column+`, r.`+ref.rowID+`
+						FOR UPDATE OF r
+					)
+					UPDATE `+m.schema.prefix()+ref.table+` r SET `+shadowColumn(ref.column)+` = locked.new_id
+					FROM locked
+					WHERE r.`+ref.rowID+` = locked.row_id AND r.`+ref.column+` = locked.id`, lastID, chunkLast.UUID, kr.from)
+					if err != nil {
+						return err
+					}
+					chunkUpdated += tag.RowsAffected()
+				}
+				return tx.Commit(ctx)
+			})
+			if err != nil {
+				if lastID.Valid {
+					return fmt.Errorf("failed to fill in the shadow columns after id %s: %w", lastID.UUID, err)
+				}
+				return fmt.Errorf("failed to fill in the shadow columns of the %s: %w", kr, err)
+			}
+			if !chunkLast.Valid {
+				return nil
+			}
+			sizer.observe(chunkRows, time.Since(started))
+			m.batchCommitted("backfill-shadow", chunkRows)
+			lastID = chunkLast
+			updated.Add(chunkUpdated)
+			if err := t.wait(ctx, m.target, "backfill-shadow", chunkRows); err != nil {
+				return err
+			}
+			if err := m.waitForWindow(ctx, "backfill-shadow"); err != nil {
+				return err
+			}
+			if logged.due() {
+				m.logger.Printf("backfill-shadow: %d rows updated, up to id %s\n", updated.Load(), lastID.UUID)
+			}
+		}
+	})
+	if err != nil {
+		return updated.Load(), err
+	}
+	m.logger.Printf("backfill-shadow: %d rows updated\n", updated.Load())
+	return updated.Load(), nil
+}
+
+// prepareCutover makes sure every row has a new ID and no two share one, then builds what the
+// cutover needs to swap the shadow columns in without scanning the tables under its lock: a
+// validated check constraint for every shadow column that is to be NOT NULL, and a copy of
+// every index on a shadowed column built concurrently on the shadow column. A failed build
+// leaves an invalid index behind, which is dropped before the build is retried.
+func (m *migration) prepareCutover(ctx context.Context, r *idRewrite) (int64, error) {
+	var missing, collisions int64
+	err := m.retry(ctx, "prepare-cutover", func(conn *pgx.Conn) error {
+		return conn.QueryRow(ctx, `
+		SELECT (SELECT count(*) FROM `+m.schema.prefix()+r.table+` WHERE new_id IS NULL),
+		       (SELECT count(*) FROM (SELECT 1 FROM `+m.schema.prefix()+r.table+` GROUP BY new_id HAVING count(*) > 1) c)
+	`).Scan(&missing, &collisions)
+	})
+	if err != nil {
+		return 0, fmt.Errorf("failed to check the new IDs: %w", err)
+	}
+	if missing > 0 {
+		m.report.UnresolvedRows = missing
+		return 0, fmt.Errorf("%d %s rows have no new ID because a key column is NULL; resolve them and run backfill-shadow again", missing, r.table)
+	}
+	if collisions > 0 {
+		return 0, fmt.Errorf("%d new IDs are shared by more than one existing %s row", collisions, r.singular)
+	}
+
+	var built int64
+	for _, s := range r.shadowedColumns() {
+		var notNull bool
+		err := m.retry(ctx, "prepare-cutover", func(conn *pgx.Conn) error {
+			err := conn.QueryRow(ctx, `
+			SELECT attnotnull FROM pg_attribute WHERE attrelid = to_regclass($1) AND attname = $2
+		`, m.schema.prefix()+s.table, s.column).Scan(&notNull)
+			if err != nil || !notNull {
+				return err
+			}
+			_, err = conn.Exec(ctx, `
+			DO $$
+			BEGIN
+			  IF NOT EXISTS (SELECT 1 FROM pg_constraint WHERE conrelid = `+m.schema.regclassLiteral(s.table)+` AND conname = '`+s.notNullConstraint()+`') THEN
+			    ALTER TABLE `+m.schema.prefix()+s.table+` ADD CONSTRAINT `+s.notNullConstraint()+` CHECK (`+shadowColumn(s.column)+` IS NOT NULL) NOT VALID;
+			  END IF;
+			END
+			$$`)
+			if err != nil {
+				return err
+			}
+			_, err = conn.Exec(ctx, `ALTER TABLE `+m.schema.prefix()+s.table+` VALIDATE CONSTRAINT `+s.notNullConstraint())
+			return err
+		})
+		if err != nil {
+			return built, fmt.Errorf("failed to check %s.%s for missing values: %w", s.table, shadowColumn(s.column), err)
+		}
+
+		var indexes []tableIndex
+		err = m.retry(ctx, "prepare-cutover", func(conn *pgx.Conn) error {
+			var err error
+			indexes, err = shadowedIndexes(ctx, conn, m.schema, s)
+			return err
+		})
+		if err != nil {
+			return built, fmt.Errorf("failed to read the indexes of %s: %w", s.table, err)
+		}
+		for _, ix := range indexes {
+			name := m.schema.prefix() + pgx.Identifier{shadowIndexName(ix.name)}.Sanitize()
+			err := m.retry(ctx, "prepare-cutover", func(conn *pgx.Conn) error {
+				var invalid bool
+				err := conn.QueryRow(ctx, `
+				SELECT EXISTS (SELECT 1 FROM pg_index WHERE indexrelid = to_regclass($1) AND NOT indisvalid)
+			`, name).Scan(&invalid)
+				if err != nil {
+					return err
+				}
+				if invalid {
+					if _, err := conn.Exec(ctx, `DROP INDEX CONCURRENTLY IF EXISTS `+name); err != nil {
+						return err
+					}
+				}
+				_, err = conn.Exec(ctx, ix.createShadowSQL(m.schema, s))
+				return err
+			})
+			if err != nil {
+				return built, fmt.Errorf("failed to build index %s on %s.%s: %w", shadowIndexName(ix.name), s.table, shadowColumn(s.column), err)
+			}
+			m.logger.Printf("prepare-cutover: built %s to replace %s\n", shadowIndexName(ix.name), ix.name)
+			built++
+		}
+	}
+	return built, nil
+}
+
+// shadowSwap is what the cutover reads about a shadowed column before dropping it.
+type shadowSwap struct {
+	shadowed
+	notNull bool
+	// defaultExpr is the column default, if it has one.
+	defaultExpr string
+	indexes     []tableIndex
+}
+
+// cutover swaps the shadow columns in, once GUAC stopped writing, in one transaction holding
+// exclusive locks on the tables for as long as it takes to change the catalog: the foreign
+// keys and the triggers are dropped, every shadowed column is dropped and its shadow column
+// renamed to it, the shadow indexes take the place of the dropped indexes and constraints, and
+// the foreign keys are added back NOT VALID for validate-constraints to check. A cutover that
+// already ran finds no shadow column and does nothing.
+func (m *migration) cutover(ctx context.Context, r *idRewrite) (int64, error) {
+	if m.checkWriters != nil {
+		if err := m.checkWriters(ctx); err != nil {
+			return 0, err
+		}
+	}
+	var done bool
+	var fks []foreignKey
+	err := m.retry(ctx, "cutover", func(conn *pgx.Conn) error {
+		tx, err := conn.Begin(ctx)
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback(ctx)
+
+		var shadow bool
+		err = tx.QueryRow(ctx, `
+		SELECT EXISTS (SELECT 1 FROM pg_attribute WHERE attrelid = to_regclass($1) AND attname = 'new_id' AND NOT attisdropped)
+	`, m.schema.prefix()+r.table).Scan(&shadow)
+		if err != nil {
+			return err
+		}
+		if done = !shadow; done {
+			return nil
+		}
+
+		tables := make([]string, 0, len(r.tables()))
+		for _, t := range r.tables() {
+			tables = append(tables, m.schema.prefix()+t)
+		}
+		if _, err := tx.Exec(ctx, `LOCK TABLE `+strings.Join(tables, ", ")+` IN ACCESS EXCLUSIVE MODE`); err != nil {
+			return err
+		}
+
+		var swaps []shadowSwap
+		for _, s := range r.shadowedColumns() {
+			sw := shadowSwap{shadowed: s}
+			err := tx.QueryRow(ctx, `
+			SELECT a.attnotnull, coalesce(pg_get_expr(d.adbin, d.adrelid), '')
+			FROM pg_attribute a
+			LEFT JOIN pg_attrdef d ON d.adrelid = a.attrelid AND d.adnum = a.attnum
+			WHERE a.attrelid = to_regclass($1) AND a.attname = $2
+		`, m.schema.prefix()+s.table, s.column).Scan(&sw.notNull, &sw.defaultExpr)
+			if err != nil {
+				return err
+			}
+			if sw.indexes, err = shadowedIndexes(ctx, tx, m.schema, s); err != nil {
+				return err
+			}
+			for _, ix := range sw.indexes {
+				var valid bool
+				err := tx.QueryRow(ctx, `
+				SELECT EXISTS (SELECT 1 FROM pg_index WHERE indexrelid = to_regclass($1) AND indisvalid)
+			`, m.schema.prefix()+pgx.Identifier{shadowIndexName(ix.name)}.Sanitize()).Scan(&valid)
+				if err != nil {
+					return err
+				}
+				if !valid {
+					return fmt.Errorf("index %s replacing %s has not been built; run prepare-cutover first", shadowIndexName(ix.name), ix.name)
+				}
+			}
+			swaps = append(swaps, sw)
+		}
+
+		if fks, err = findForeignKeys(ctx, tx, m.schema, r); err != nil {
+			return err
+		}
+		if err := r.checkForeignKeys(fks); err != nil {
+			return err
+		}
+		stmts := dropShadowTriggerSQL(m.schema, r)
+		for _, fk := range fks {
+			stmts = append(stmts, fk.dropSQL())
+		}
+		for _, sw := range swaps {
+			table, shadow := `ALTER TABLE `+m.schema.prefix()+sw.table, shadowColumn(sw.column)
+			stmts = append(stmts,
+				table+` DROP COLUMN `+sw.column,
+				table+` RENAME COLUMN `+shadow+` TO `+sw.column,
+			)
+			if sw.notNull {
+				stmts = append(stmts,
+					table+` ALTER COLUMN `+sw.column+` SET NOT NULL`,
+					table+` DROP CONSTRAINT `+sw.notNullConstraint(),
+				)
+			}
+			if sw.defaultExpr != "" {
+				stmts = append(stmts, table+` ALTER COLUMN `+sw.column+` SET DEFAULT `+sw.defaultExpr)
+			}
+			for _, ix := range sw.indexes {
+				stmts = append(stmts, ix.swapSQL(m.schema, sw.shadowed))
+			}
+		}
+		for _, fk := range fks {
+			stmts = append(stmts, fk.addSQL())
+		}
+		for _, stmt := range stmts {
+			if _, err := tx.Exec(ctx, stmt); err != nil {
+				return fmt.Errorf("%s: %w", stmt, err)
+			}
+		}
+		return tx.Commit(ctx)
+	})
+	if err != nil {
+		return 0, fmt.Errorf("failed to swap in the shadow columns: %w", err)
+	}
+	if done {
+		m.logger.Printf("cutover: %s has no shadow column, the cutover already ran\n", r.table)
+		return 0, nil
+	}
+	for _, s := range r.shadowedColumns() {
+		m.logger.Printf("cutover: swapped %s.%s in for %s\n", s.table, shadowColumn(s.column), s.column)
+	}
+	return 0, nil
+}
+
+// onlineSteps are the steps rewriting the IDs of r with --online. Everything up to the
+// cutover runs while GUAC keeps writing and leaves the database usable by the GUAC version it
+// is on.
+func (m *migration) onlineSteps(r *idRewrite) []step {
+	return []step{
+		{name: "add-shadow-columns", run: func(ctx context.Context) (int64, error) { return m.addShadowColumns(ctx, r) }},
+		{name: "backfill-shadow", run: func(ctx context.Context) (int64, error) { return m.backfillShadowColumns(ctx, r) }},
+		{name: "prepare-cutover", run: func(ctx context.Context) (int64, error) { return m.prepareCutover(ctx, r) }},
+		{name: "cutover", run: func(ctx context.Context) (int64, error) { return m.cutover(ctx, r) }},
+		{name: "validate-constraints", run: func(ctx context.Context) (int64, error) { return m.validateConstraints(ctx, r) }},
+	}
+}
+
+// preparesCutover reports whether step is one of the online steps before the cutover, which
+// leave the database on the version it was on.
+func preparesCutover(step string) bool {
+	switch step {
+	case "add-shadow-columns", "backfill-shadow", "prepare-cutover":
+		return true
+	}
+	return false
+}
+
+// checkOnlineOptions rejects settings --online does not support.
+func checkOnlineOptions(opts *options) error {
+	if !opts.online {
+		return nil
+	}
+	switch {
+	case opts.fast, opts.deferFKs, opts.rebuildIndexes:
+		return errors.New("--online rewrites through shadow columns and cannot be combined with --fast, --defer-constraints or --rebuild-indexes")
+	case opts.emitSQL != "", opts.estimate:
+		return errors.New("--online cannot be combined with --emit-sql or --estimate")
+	case opts.exportIDMap != "", opts.audit:
+		return errors.New("--online does not record the ID changes and cannot be combined with --export-id-map or --audit")
+	case opts.dialect == dialectCockroach:
+		return errors.New("--online relies on triggers and cannot be used with --dialect=cockroach")
+	}
+	return nil
+}
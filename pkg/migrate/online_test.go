@@ -0,0 +1,37 @@
+package migrate
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestShadowIndexSQL(t *testing.T) {
+	s := shadowed{table: "bill_of_materials_included_dependencies", column: "dependency_id"}
+	ix := tableIndex{
+		name:       "bill_of_materials_included_dependencies_pkey",
+		method:     "btree",
+		unique:     true,
+		constraint: "bill_of_materials_included_dependencies_pkey",
+		contype:    "p",
+		columns:    []string{"bill_of_materials_id", "dependency_id"},
+	}
+	if got, want := ix.createShadowSQL("public", s), `CREATE UNIQUE INDEX CONCURRENTLY IF NOT EXISTS "guac_shadow_bill_of_materials_included_dependencies_pkey" ON public.bill_of_materials_included_dependencies USING btree ("bill_of_materials_id", "new_dependency_id")`; got != want {
+		t.Errorf("createShadowSQL() = %s, want %s", got, want)
+	}
+	if got, want := ix.swapSQL("public", s), `ALTER TABLE public.bill_of_materials_included_dependencies ADD CONSTRAINT "bill_of_materials_included_dependencies_pkey" PRIMARY KEY USING INDEX "guac_shadow_bill_of_materials_included_dependencies_pkey"`; got != want {
+		t.Errorf("swapSQL() = %s, want %s", got, want)
+	}
+
+	ix = tableIndex{name: "bomdependencies_dependency_id", method: "hash", columns: []string{"dependency_id"}}
+	if got, want := ix.createShadowSQL("public", s), `CREATE INDEX CONCURRENTLY IF NOT EXISTS "guac_shadow_bomdependencies_dependency_id" ON public.bill_of_materials_included_dependencies USING hash ("new_dependency_id")`; got != want {
+		t.Errorf("createShadowSQL() = %s, want %s", got, want)
+	}
+	if got, want := ix.swapSQL("public", s), `ALTER INDEX public."guac_shadow_bomdependencies_dependency_id" RENAME TO "bomdependencies_dependency_id"`; got != want {
+		t.Errorf("swapSQL() = %s, want %s", got, want)
+	}
+
+	long := strings.Repeat("x", 60)
+	if got := shadowIndexName(long); len(got) != 63 || !strings.HasPrefix(got, shadowPrefix) {
+		t.Errorf("shadowIndexName(%q) = %q, want the first 63 bytes of the prefixed name", long, got)
+	}
+}
@@ -0,0 +1,396 @@
+package migrate
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+)
+
+// The policies of repair-orphans.
+const (
+	orphanPolicyReport = "report"
+	orphanPolicyDelete = "delete"
+	orphanPolicyRemap  = "remap"
+)
+
+// orphanRemapHops bounds how many mappings of successive runs an orphaned ID is followed
+// through to reach a dependency that exists.
+const orphanRemapHops = 8
+
+// orphan is a bill of materials row whose dependency_id matches no dependency.
+type orphan struct {
+	SBOM         string `json:"bill_of_materials_id"`
+	DependencyID string `json:"dependency_id"`
+	// RemapTo is the existing dependency the row is, or with --policy remap would be,
+	// repointed to.
+	RemapTo string `json:"remap_to,omitempty"`
+}
+
+// orphanRepair is the output of the repair-orphans subcommand.
+type orphanRepair struct {
+	Policy  string `json:"policy"`
+	Orphans int64  `json:"orphans"`
+	// Remappable are the orphans an ID mapping repoints to an existing dependency.
+	Remappable int64 `json:"remappable"`
+	Remapped   int64 `json:"remapped"`
+	Deleted    int64 `json:"deleted"`
+	Remaining  int64 `json:"remaining"`
+	// ConstraintMissing is set when the foreign key that prevents orphans was never restored.
+	ConstraintMissing bool     `json:"constraint_missing"`
+	MappingSources    []string `json:"mapping_sources"`
+	Rows              []orphan `json:"rows"`
+}
+
+func runRepairOrphans(args []string) {
+	var cf connFlags
+	fs := flag.NewFlagSet("repair-orphans", flag.ExitOnError)
+	cf.register(fs)
+	policy := fs.String("policy", orphanPolicyReport, "what to do with orphaned rows: report them, delete them, or remap them to the dependency their ID was rewritten to")
+	idMap := fs.String("id-map", "", "also map orphaned IDs with the old to new IDs of this --export-id-map `file`")
+	format := fs.String("format", "text", "output `format`: text or json")
+	list := fs.Int("list", 20, "list at most `n` orphaned rows")
+	yes := fs.Bool("yes", false, "do not ask for confirmation before modifying the database")
+	fs.BoolVar(yes, "non-interactive", false, "alias for --yes")
+	fs.Parse(args)
+
+	repaired, err := repairOrphans(&cf, *policy, *idMap, *format, *list, *yes, os.Stdout)
+	if err != nil {
+		log.Fatalf("%v\n", err)
+	}
+	if !repaired {
+		os.Exit(1)
+	}
+}
+
+// repairOrphans finds bill_of_materials_included_dependencies rows referencing a dependency ID
+// that does not exist, left behind by a failed or hand-run migration or a partial ingest, and
+// applies policy to them. It reports whether no orphans remain.
+func repairOrphans(cf *connFlags, policy, idMapPath, format string, listLimit int, yes bool, w io.Writer) (bool, error) {
+	if policy != orphanPolicyReport && policy != orphanPolicyDelete && policy != orphanPolicyRemap {
+		return false, fmt.Errorf("invalid --policy %q: must be report, delete or remap", policy)
+	}
+	if format != "text" && format != "json" {
+		return false, fmt.Errorf("invalid --format %q: must be text or json", format)
+	}
+	if idMapPath != "" && policy == orphanPolicyDelete {
+		return false, fmt.Errorf("--id-map cannot be combined with --policy delete")
+	}
+	ctx := context.Background()
+	config, err := cf.config()
+	if err != nil {
+		return false, err
+	}
+	conn, err := pgx.ConnectConfig(ctx, config)
+	if err != nil {
+		return false, fmt.Errorf("unable to connect to database: %w", err)
+	}
+	defer conn.Close(ctx)
+	if policy != orphanPolicyReport {
+		lock, err := holdMigrationLock(ctx, config)
+		if err != nil {
+			return false, err
+		}
+		defer lock.release(ctx)
+	}
+
+	r := &orphanRepair{Policy: policy, MappingSources: []string{}, Rows: []orphan{}}
+	fks, err := findForeignKeys(ctx, conn, cf.schema, dependencyIDs)
+	if err != nil {
+		return false, fmt.Errorf("failed to look for the foreign key: %w", err)
+	}
+	r.ConstraintMissing = len(fks) == 0
+	orphaned, err := orphanedDependencyIDs(ctx, conn, cf.schema)
+	if err != nil {
+		return false, fmt.Errorf("failed to find orphaned rows: %w", err)
+	}
+	for _, n := range orphaned {
+		r.Orphans += n
+	}
+
+	var remap map[uuid.UUID]uuid.UUID
+	if len(orphaned) > 0 {
+		var file map[uuid.UUID]uuid.UUID
+		if idMapPath != "" {
+			if file, err = readIDMap(idMapPath); err != nil {
+				return false, err
+			}
+			r.MappingSources = append(r.MappingSources, idMapPath)
+		}
+		if remap, err = orphanRemapping(ctx, conn, cf.schema, orphaned, file, r); err != nil {
+			return false, fmt.Errorf("failed to map orphaned IDs: %w", err)
+		}
+	}
+	for id, n := range orphaned {
+		if _, ok := remap[id]; ok {
+			r.Remappable += n
+		}
+	}
+
+	if err := listOrphans(ctx, conn, cf.schema, remap, listLimit, r); err != nil {
+		return false, fmt.Errorf("failed to list orphaned rows: %w", err)
+	}
+
+	r.Remaining = r.Orphans
+	if policy != orphanPolicyReport && r.Orphans > 0 && (policy == orphanPolicyDelete || r.Remappable > 0) {
+		if !yes {
+			r.printPlan(w)
+			if err := promptConfirmation(os.Stdin, w, cf.usesStdin()); err != nil {
+				return false, err
+			}
+		}
+		if policy == orphanPolicyDelete {
+			err = deleteOrphans(ctx, conn, cf.schema, r)
+		} else {
+			err = remapOrphans(ctx, conn, cf.schema, remap, r)
+		}
+		if err != nil {
+			return false, fmt.Errorf("failed to repair orphaned rows: %w", err)
+		}
+		r.Remaining = r.Orphans - r.Deleted - r.Remapped
+	}
+
+	if format == "json" {
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return r.Remaining == 0, enc.Encode(r)
+	}
+	r.print(w)
+	return r.Remaining == 0, nil
+}
+
+// orphanedDependencyIDs counts the orphaned rows of every missing dependency ID.
+func orphanedDependencyIDs(ctx context.Context, conn *pgx.Conn, schema dbSchema) (map[uuid.UUID]int64, error) {
+	rows, err := conn.Query(ctx, `
+		SELECT b.dependency_id, count(*) FROM `+schema.prefix()+`bill_of_materials_included_dependencies b
+		WHERE NOT EXISTS (SELECT 1 FROM `+schema.prefix()+`dependencies d WHERE d.id = b.dependency_id)
+		GROUP BY b.dependency_id
+	`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	orphaned := make(map[uuid.UUID]int64)
+	for rows.Next() {
+		var id uuid.UUID
+		var n int64
+		if err := rows.Scan(&id, &n); err != nil {
+			return nil, err
+		}
+		orphaned[id] = n
+	}
+	return orphaned, rows.Err()
+}
+
+// orphanRemapping maps every orphaned ID it can to an existing dependency. The mappings come
+// from file, then the --fast staging table and the --audit log of earlier runs when they
+// exist; the first source to map an ID wins. An ID is followed through the mappings of several
+// runs until it reaches a dependency.
+func orphanRemapping(ctx context.Context, conn *pgx.Conn, schema dbSchema, orphaned map[uuid.UUID]int64, file map[uuid.UUID]uuid.UUID, r *orphanRepair) (map[uuid.UUID]uuid.UUID, error) {
+	mapping := make(map[uuid.UUID]uuid.UUID)
+	for oldID, newID := range file {
+		mapping[oldID] = newID
+	}
+	sources := []struct{ table, query string }{
+		{dependencyIDStagingTable, `SELECT old_id, new_id FROM ` + schema.prefix() + dependencyIDStagingTable},
+		// The latest run's mapping of an ID comes first.
+		{auditTable, `SELECT old_id, new_id FROM ` + schema.prefix() + auditTable + `
+			WHERE table_name = 'dependencies' AND column_name = 'id' AND old_id IS NOT NULL ORDER BY id DESC`},
+	}
+	for _, src := range sources {
+		var exists bool
+		if err := conn.QueryRow(ctx, `SELECT to_regclass($1) IS NOT NULL`, schema.prefix()+src.table).Scan(&exists); err != nil {
+			return nil, err
+		}
+		if !exists {
+			continue
+		}
+		r.MappingSources = append(r.MappingSources, src.table)
+		rows, err := conn.Query(ctx, src.query)
+		if err != nil {
+			return nil, err
+		}
+		for rows.Next() {
+			var oldID, newID uuid.UUID
+			if err := rows.Scan(&oldID, &newID); err != nil {
+				rows.Close()
+				return nil, err
+			}
+			if _, ok := mapping[oldID]; !ok {
+				mapping[oldID] = newID
+			}
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return nil, err
+		}
+	}
+
+	var candidates []uuid.UUID
+	for id := range orphaned {
+		next := id
+		for hop := 0; hop < orphanRemapHops; hop++ {
+			var ok bool
+			if next, ok = mapping[next]; !ok || next == id {
+				break
+			}
+			candidates = append(candidates, next)
+		}
+	}
+	existing := make(map[uuid.UUID]bool)
+	if len(candidates) > 0 {
+		rows, err := conn.Query(ctx, `SELECT id FROM `+schema.prefix()+`dependencies WHERE id = ANY($1)`, uuidStrings(candidates))
+		if err != nil {
+			return nil, err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var id uuid.UUID
+			if err := rows.Scan(&id); err != nil {
+				return nil, err
+			}
+			existing[id] = true
+		}
+		if err := rows.Err(); err != nil {
+			return nil, err
+		}
+	}
+
+	remap := make(map[uuid.UUID]uuid.UUID)
+	for id := range orphaned {
+		next := id
+		for hop := 0; hop < orphanRemapHops; hop++ {
+			var ok bool
+			if next, ok = mapping[next]; !ok || next == id {
+				break
+			}
+			if existing[next] {
+				remap[id] = next
+				break
+			}
+		}
+	}
+	return remap, nil
+}
+
+// listOrphans fills r.Rows with at most listLimit orphaned rows.
+func listOrphans(ctx context.Context, conn *pgx.Conn, schema dbSchema, remap map[uuid.UUID]uuid.UUID, listLimit int, r *orphanRepair) error {
+	if listLimit <= 0 || r.Orphans == 0 {
+		return nil
+	}
+	rows, err := conn.Query(ctx, `
+		SELECT b.bill_of_materials_id, b.dependency_id FROM `+schema.prefix()+`bill_of_materials_included_dependencies b
+		WHERE NOT EXISTS (SELECT 1 FROM `+schema.prefix()+`dependencies d WHERE d.id = b.dependency_id)
+		ORDER BY b.dependency_id, b.bill_of_materials_id
+		LIMIT $1
+	`, listLimit)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var sbom, id uuid.UUID
+		if err := rows.Scan(&sbom, &id); err != nil {
+			return err
+		}
+		o := orphan{SBOM: sbom.String(), DependencyID: id.String()}
+		if newID, ok := remap[id]; ok {
+			o.RemapTo = newID.String()
+		}
+		r.Rows = append(r.Rows, o)
+	}
+	return rows.Err()
+}
+
+// deleteOrphans deletes every orphaned row.
+func deleteOrphans(ctx context.Context, conn *pgx.Conn, schema dbSchema, r *orphanRepair) error {
+	tag, err := conn.Exec(ctx, `
+		DELETE FROM `+schema.prefix()+`bill_of_materials_included_dependencies b
+		WHERE NOT EXISTS (SELECT 1 FROM `+schema.prefix()+`dependencies d WHERE d.id = b.dependency_id)
+	`)
+	r.Deleted = tag.RowsAffected()
+	return err
+}
+
+// remapOrphans repoints the orphaned rows of every ID in remap, in one transaction. A row
+// whose SBOM already references the new ID duplicates that reference and is deleted instead,
+// since the pair is the table's primary key.
+func remapOrphans(ctx context.Context, conn *pgx.Conn, schema dbSchema, remap map[uuid.UUID]uuid.UUID, r *orphanRepair) error {
+	tx, err := conn.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	batch := &pgx.Batch{}
+	for oldID, newID := range remap {
+		batch.Queue(`
+			DELETE FROM `+schema.prefix()+`bill_of_materials_included_dependencies b
+			WHERE b.dependency_id = $2 AND EXISTS (
+				SELECT 1 FROM `+schema.prefix()+`bill_of_materials_included_dependencies e
+				WHERE e.bill_of_materials_id = b.bill_of_materials_id AND e.dependency_id = $1)
+		`, newID, oldID)
+		batch.Queue(`UPDATE `+schema.prefix()+`bill_of_materials_included_dependencies SET dependency_id = $1 WHERE dependency_id = $2`, newID, oldID)
+	}
+	results := tx.SendBatch(ctx, batch)
+	for range remap {
+		deleted, err := results.Exec()
+		if err != nil {
+			results.Close()
+			return err
+		}
+		updated, err := results.Exec()
+		if err != nil {
+			results.Close()
+			return err
+		}
+		r.Deleted += deleted.RowsAffected()
+		r.Remapped += updated.RowsAffected()
+	}
+	if err := results.Close(); err != nil {
+		return err
+	}
+	return tx.Commit(ctx)
+}
+
+// printPlan summarises what the repair is about to change, before asking for confirmation.
+func (r *orphanRepair) printPlan(w io.Writer) {
+	if r.Policy == orphanPolicyDelete {
+		fmt.Fprintf(w, "This will delete %d orphaned bill_of_materials_included_dependencies rows.\n", r.Orphans)
+		return
+	}
+	fmt.Fprintf(w, "This will repoint %d of %d orphaned bill_of_materials_included_dependencies rows to the dependency their ID was rewritten to.\n", r.Remappable, r.Orphans)
+}
+
+func (r *orphanRepair) print(w io.Writer) {
+	fmt.Fprintf(w, "Found %d bill_of_materials_included_dependencies rows referencing a missing dependency", r.Orphans)
+	if len(r.MappingSources) > 0 {
+		fmt.Fprintf(w, "; %d can be remapped using %v", r.Remappable, r.MappingSources)
+	}
+	fmt.Fprintln(w)
+	for _, o := range r.Rows {
+		if o.RemapTo != "" {
+			fmt.Fprintf(w, "  orphan: SBOM %s -> dependency %s, remaps to %s\n", o.SBOM, o.DependencyID, o.RemapTo)
+		} else {
+			fmt.Fprintf(w, "  orphan: SBOM %s -> dependency %s\n", o.SBOM, o.DependencyID)
+		}
+	}
+	if shown := int64(len(r.Rows)); shown < r.Orphans {
+		fmt.Fprintf(w, "  ... %d more (raise --list)\n", r.Orphans-shown)
+	}
+	switch {
+	case r.Deleted > 0 || r.Remapped > 0:
+		fmt.Fprintf(w, "Remapped %d rows and deleted %d; %d orphaned rows remain.\n", r.Remapped, r.Deleted, r.Remaining)
+	case r.Orphans > 0 && r.Policy == orphanPolicyReport:
+		fmt.Fprintln(w, "Nothing was changed; pass --policy delete or --policy remap to repair them.")
+	}
+	if r.ConstraintMissing {
+		fmt.Fprintln(w, "The foreign key from bill_of_materials_included_dependencies to dependencies is missing; once no orphans remain, restore it with: guac-update-db --steps add-constraints,validate-constraints")
+	}
+}
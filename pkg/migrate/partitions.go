@@ -0,0 +1,121 @@
+package migrate
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// estimatedRowsSQL sums the planner's row estimate of $1 and every partition under it, since
+// a partitioned table has no rows of its own and no estimate.
+const estimatedRowsSQL = `
+	WITH RECURSIVE tree AS (
+		SELECT to_regclass($1)::oid AS oid
+		UNION ALL
+		SELECT i.inhrelid FROM pg_inherits i JOIN tree ON i.inhparent = tree.oid
+	)
+	SELECT coalesce(sum(greatest(c.reltuples, 0)), 0)::bigint FROM pg_class c JOIN tree ON c.oid = tree.oid
+`
+
+// estimatedRows returns the planner's estimate of the rows of table, including its partitions.
+func estimatedRows(ctx context.Context, q queryer, table string) (int64, error) {
+	var n int64
+	err := q.QueryRow(ctx, estimatedRowsSQL, table).Scan(&n)
+	return n, err
+}
+
+// tablePartitions describes how a table is declaratively partitioned.
+type tablePartitions struct {
+	// key is the partition key as pg_get_partkeydef prints it, e.g. HASH (id).
+	key string
+	// leaves are the partitions holding the rows, qualified and quoted, in name order.
+	leaves []string
+}
+
+// findPartitions returns the partitions of table, or nil when it is not partitioned. A
+// partitioned table without partitions holds no rows, and is treated as a plain one.
+func findPartitions(ctx context.Context, q queryer, table string) (*tablePartitions, error) {
+	p := &tablePartitions{}
+	err := q.QueryRow(ctx, `
+		SELECT pg_get_partkeydef(c.oid) FROM pg_class c WHERE c.oid = to_regclass($1) AND c.relkind = 'p'
+	`, table).Scan(&p.key)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	rows, err := q.Query(ctx, `
+		WITH RECURSIVE tree AS (
+			SELECT i.inhrelid AS oid FROM pg_inherits i WHERE i.inhparent = to_regclass($1)
+			UNION ALL
+			SELECT i.inhrelid FROM pg_inherits i JOIN tree ON i.inhparent = tree.oid
+		)
+		SELECT quote_ident(n.nspname) || '.' || quote_ident(c.relname)
+		FROM tree JOIN pg_class c ON c.oid = tree.oid JOIN pg_namespace n ON n.oid = c.relnamespace
+		WHERE c.relkind <> 'p'
+		ORDER BY 1
+	`, table)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var leaf string
+		if err := rows.Scan(&leaf); err != nil {
+			return nil, err
+		}
+		p.leaves = append(p.leaves, leaf)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if len(p.leaves) == 0 {
+		return nil, nil
+	}
+	return p, nil
+}
+
+// checkPartitioning looks up whether the dependencies table is partitioned, in which case the
+// backfill walks its partitions one at a time, and fails when the run relies on something a
+// partitioned table does not support. rewrite-ids updates through the partitioned table, so
+// Postgres moves a row whose new ID falls into another partition there.
+func (m *migration) checkPartitioning(ctx context.Context) error {
+	var major int
+	err := m.retry(ctx, "partitions", func(conn *pgx.Conn) error {
+		var err error
+		major = serverMajorVersion(conn)
+		m.partitions, err = findPartitions(ctx, conn, m.schema.prefix()+"dependencies")
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("failed to look up the partitions of dependencies: %w", err)
+	}
+	p := m.partitions
+	if p == nil {
+		return nil
+	}
+	m.logger.Printf("dependencies is partitioned by %s into %d partitions\n", p.key, len(p.leaves))
+	switch {
+	case major > 0 && major < 12:
+		return errors.New("dependencies is partitioned, and before Postgres 12 no foreign key can reference a partitioned table for add-constraints to restore")
+	case m.online:
+		return errors.New("--online cannot migrate a partitioned dependencies table: its shadow columns and cutover rename columns and swap indexes on a single table")
+	case m.indexRebuild:
+		return errors.New("--rebuild-indexes cannot rebuild the indexes of a partitioned dependencies table: Postgres cannot create or drop them CONCURRENTLY")
+	case m.deferConstraints && major > 0 && major < 15:
+		return errors.New("--defer-constraints cannot migrate a partitioned dependencies table before Postgres 15: moving a row to another partition deletes and re-inserts it, which fires the ON DELETE CASCADE of the foreign keys it keeps; run without --defer-constraints")
+	}
+	return nil
+}
+
+// backfillRelations are the tables the backfill walks: the partitions of the dependencies
+// table, or the table itself.
+func (m *migration) backfillRelations() []string {
+	if m.partitions == nil {
+		return []string{"" + m.schema.prefix() + "dependencies"}
+	}
+	return m.partitions.leaves
+}
@@ -0,0 +1,198 @@
+package migrate
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// poolSettings size the connection pools of a run and set how often their connections are
+// checked.
+type poolSettings struct {
+	maxConns int
+	// healthCheck is how long a connection may sit idle before it is pinged on reuse, and how
+	// often the session holding the migration lock is checked. 0 disables the pings.
+	healthCheck time.Duration
+}
+
+func (s *poolSettings) register(fs *flag.FlagSet) {
+	fs.IntVar(&s.maxConns, "max-conns", 4, "open at most `n` connections to each database, including the one holding the migration lock")
+	fs.DurationVar(&s.healthCheck, "health-check-period", 30*time.Second, "ping connections idle for longer than this before reusing them, and check the migration lock as often (0 disables)")
+}
+
+// connPool is a pool of connections to one database. A connection handed out by acquire has the
+// session timeouts of the requested step, and one that sat idle for longer than the health check
+// period is pinged first, so a connection the server or a proxy closed in the meantime is
+// replaced instead of failing the next statement.
+type connPool struct {
+	pool        *pgxpool.Pool
+	timeouts    *timeoutSettings
+	speedups    *unsafeSpeedups
+	healthCheck time.Duration
+
+	mu sync.Mutex
+	// sessions tracks every open connection of the pool.
+	sessions map[*pgx.Conn]*connSession
+}
+
+// connSession is what connPool knows about one of its connections.
+type connSession struct {
+	// step is the step whose timeouts the session has, "" until any were applied.
+	step     string
+	released time.Time
+}
+
+func newConnPool(ctx context.Context, config *pgx.ConnConfig, settings poolSettings, timeouts *timeoutSettings) (*connPool, error) {
+	pc, err := pgxpool.ParseConfig("")
+	if err != nil {
+		return nil, err
+	}
+	pc.ConnConfig = config.Copy()
+	if settings.maxConns > 0 {
+		pc.MaxConns = int32(settings.maxConns)
+	}
+	if settings.healthCheck > 0 {
+		pc.HealthCheckPeriod = settings.healthCheck
+	}
+	p := &connPool{timeouts: timeouts, healthCheck: settings.healthCheck, sessions: make(map[*pgx.Conn]*connSession)}
+	pc.AfterConnect = func(_ context.Context, conn *pgx.Conn) error {
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		p.sessions[conn] = &connSession{released: time.Now()}
+		return nil
+	}
+	pc.BeforeClose = func(conn *pgx.Conn) {
+		p.mu.Lock()
+		delete(p.sessions, conn)
+		p.mu.Unlock()
+		if t, ok := conn.Config().Tracer.(connCloseTracer); ok {
+			t.TraceClose(conn)
+		}
+	}
+	pc.BeforeAcquire = p.healthy
+	// AfterRelease only runs for connections that are still usable: pgxpool destroys closed
+	// connections and those left inside a transaction.
+	pc.AfterRelease = func(conn *pgx.Conn) bool {
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		if s, ok := p.sessions[conn]; ok {
+			s.released = time.Now()
+		}
+		return true
+	}
+	p.pool, err = pgxpool.NewWithConfig(ctx, pc)
+	if err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// healthy pings a connection that has been idle for longer than the health check period. A
+// connection that does not answer is dropped and pgxpool hands out another one.
+func (p *connPool) healthy(ctx context.Context, conn *pgx.Conn) bool {
+	p.mu.Lock()
+	s, ok := p.sessions[conn]
+	idle := ok && p.healthCheck > 0 && time.Since(s.released) > p.healthCheck
+	p.mu.Unlock()
+	if !idle {
+		return true
+	}
+	ctx, cancel := context.WithTimeout(ctx, pingTimeout)
+	defer cancel()
+	return conn.Ping(ctx) == nil
+}
+
+// pingTimeout bounds a health check ping.
+const pingTimeout = 10 * time.Second
+
+// acquire returns a connection of the pool with the session timeouts of step. The caller
+// releases it.
+func (p *connPool) acquire(ctx context.Context, step string) (*pgxpool.Conn, error) {
+	conn, err := p.pool.Acquire(ctx)
+	if err != nil {
+		return nil, err
+	}
+	p.mu.Lock()
+	s := p.sessions[conn.Conn()]
+	p.mu.Unlock()
+	if s != nil && s.step != step {
+		if err := p.timeouts.apply(ctx, conn.Conn(), step); err != nil {
+			conn.Release()
+			return nil, err
+		}
+		if err := p.speedups.apply(ctx, conn.Conn(), step); err != nil {
+			conn.Release()
+			return nil, err
+		}
+		p.mu.Lock()
+		s.step = step
+		p.mu.Unlock()
+	}
+	return conn, nil
+}
+
+func (p *connPool) close() {
+	p.pool.Close()
+}
+
+// lockSession takes a connection out of the pool for the whole run, and the migration lock on
+// a connection of its own unless the run already holds it.
+func (m *migration) lockSession(ctx context.Context) error {
+	conn, err := m.pool.acquire(ctx, "")
+	if err != nil {
+		return fmt.Errorf("unable to connect to database: %w", err)
+	}
+	if m.takesLock() && m.lock == nil {
+		if m.lock, err = holdMigrationLock(ctx, m.config); err != nil {
+			conn.Release()
+			return err
+		}
+	}
+	m.session = conn
+	m.sessionChecked = time.Now()
+	return nil
+}
+
+// checkSession makes sure the session and the connection holding the migration lock are still
+// alive, pinging them at most once per health check period. The advisory lock goes away with a
+// lost connection, so it is taken again on a new one; if another run grabbed it in the meantime
+// the migration stops.
+func (m *migration) checkSession(ctx context.Context) error {
+	if m.session == nil {
+		// A previous attempt to take the lock again failed.
+		return m.lockSession(ctx)
+	}
+	conn := m.session.Conn()
+	lost := conn.IsClosed() || m.lock != nil && m.lock.conn.IsClosed()
+	if !lost {
+		if m.poolSettings.healthCheck <= 0 || time.Since(m.sessionChecked) < m.poolSettings.healthCheck {
+			return nil
+		}
+		pingCtx, cancel := context.WithTimeout(ctx, pingTimeout)
+		lost = conn.Ping(pingCtx) != nil || m.lock != nil && !m.lock.alive(pingCtx)
+		cancel()
+		if !lost {
+			m.sessionChecked = time.Now()
+			return nil
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+	}
+	if !conn.IsClosed() {
+		conn.Close(ctx)
+	}
+	m.session.Release()
+	m.session = nil
+	if m.lock != nil {
+		m.lock.conn.Close(ctx)
+		m.lock = nil
+	}
+	m.logger.Printf("Reconnecting to database\n")
+	return m.lockSession(ctx)
+}
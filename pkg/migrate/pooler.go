@@ -0,0 +1,72 @@
+package migrate
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// poolerProbes is how many transactions the pooler detection runs. A transaction pooler with
+// spare server connections hands consecutive transactions to different backends.
+const poolerProbes = 5
+
+// resolvePoolerCompat decides whether to run in connection pooler compatibility mode. mode is
+// "on", "off" or "auto"; auto enables it when consecutive transactions are served by different
+// Postgres backends, which is what a transaction-pooling pgbouncer does.
+func resolvePoolerCompat(ctx context.Context, config *pgx.ConnConfig, logger *log.Logger, mode string) (bool, error) {
+	switch mode {
+	case "on":
+		return true, nil
+	case "off":
+		return false, nil
+	case "auto":
+	default:
+		return false, fmt.Errorf("invalid --pooler-compat %q: must be auto, on or off", mode)
+	}
+
+	probe := config.Copy()
+	usePoolerCompat(probe)
+	conn, err := pgx.ConnectConfig(ctx, probe)
+	if err != nil {
+		return false, fmt.Errorf("unable to connect to database: %w", err)
+	}
+	defer conn.Close(ctx)
+
+	pids := make(map[int32]bool)
+	for i := 0; i < poolerProbes; i++ {
+		var pid int32
+		if err := conn.QueryRow(ctx, "SELECT pg_backend_pid()").Scan(&pid); err != nil {
+			return false, fmt.Errorf("failed to detect connection pooler: %w", err)
+		}
+		pids[pid] = true
+	}
+	if len(pids) > 1 {
+		logger.Printf("Transactions are served by %d different backends; assuming a transaction-pooling connection pooler (--pooler-compat=on)\n", len(pids))
+		return true, nil
+	}
+	return false, nil
+}
+
+// usePoolerCompat configures pgx for a transaction-pooling pooler: every statement, including
+// the queued statements of a batch, is sent over the simple protocol so no prepared statement
+// has to survive from one transaction to the next.
+func usePoolerCompat(config *pgx.ConnConfig) {
+	config.DefaultQueryExecMode = pgx.QueryExecModeSimpleProtocol
+	config.StatementCacheCapacity = 0
+	config.DescriptionCacheCapacity = 0
+}
+
+// checkPoolerCompatOptions rejects settings that rely on session state, which a transaction
+// pooler does not preserve between transactions.
+func checkPoolerCompatOptions(opts *options) error {
+	if opts.timeouts.statement.configured() || opts.timeouts.lock.configured() {
+		return errors.New("--statement-timeout and --lock-timeout rely on session state and cannot be used through a transaction pooler; set them on the role instead (ALTER ROLE ... SET statement_timeout = ...)")
+	}
+	if opts.unsafeSpeedups {
+		return errors.New("--unsafe-speedups relies on session state and cannot be used through a transaction pooler")
+	}
+	return nil
+}
@@ -0,0 +1,248 @@
+package migrate
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+)
+
+// The values of --error-policy.
+const (
+	errorPolicyAbort      = "abort"
+	errorPolicyQuarantine = "quarantine"
+)
+
+// quarantineTable records the rows --error-policy=quarantine left out of the rewrite, with the
+// error that made it leave them out. Like the audit table it outlives the run.
+const quarantineTable = "guac_migration_quarantine"
+
+// createQuarantineTableSQL returns the statement creating the quarantine table. row_id is the
+// ID of the dependency whose ID or references could not be rewritten, as it was before the run.
+func createQuarantineTableSQL(schema dbSchema) string {
+	return `CREATE TABLE IF NOT EXISTS ` + schema.prefix() + quarantineTable + ` (
+	migration_id uuid NOT NULL,
+	step text NOT NULL,
+	table_name text NOT NULL,
+	row_id uuid NOT NULL,
+	error text NOT NULL,
+	quarantined_at timestamptz NOT NULL DEFAULT now(),
+	PRIMARY KEY (migration_id, table_name, row_id)
+)`
+}
+
+// quarantineSQL records a quarantined row. A retried step records it again with its latest
+// error.
+func quarantineSQL(schema dbSchema) string {
+	return `INSERT INTO ` + schema.prefix() + quarantineTable + ` (migration_id, step, table_name, row_id, error) VALUES ($1, $2, $3, $4, $5)
+ON CONFLICT (migration_id, table_name, row_id) DO UPDATE SET step = excluded.step, error = excluded.error, quarantined_at = now()`
+}
+
+// chunkSavepoint is the savepoint every chunk of a quarantining step is sent in.
+const chunkSavepoint = "guac_update_db_chunk"
+
+// Quarantined is a row --error-policy=quarantine left out of the run.
+type Quarantined struct {
+	Step  string `json:"step" yaml:"step"`
+	Table string `json:"table" yaml:"table"`
+	ID    string `json:"id" yaml:"id"`
+	Error string `json:"error" yaml:"error"`
+}
+
+func validErrorPolicy(p string) bool {
+	return p == errorPolicyAbort || p == errorPolicyQuarantine
+}
+
+// checkErrorPolicyOptions rejects settings --error-policy=quarantine does not support.
+func checkErrorPolicyOptions(opts *options) error {
+	if opts.errorPolicy != errorPolicyQuarantine {
+		return nil
+	}
+	switch {
+	case opts.emitSQL != "", opts.estimate:
+		return errors.New("--error-policy=quarantine records the failing rows as the migration runs and cannot be combined with --emit-sql or --estimate")
+	case opts.online:
+		return errors.New("--error-policy=quarantine cannot be combined with --online, whose cutover swaps every row in at once")
+	case opts.maxQuarantined < 0:
+		return errors.New("--max-quarantined must not be negative")
+	}
+	return nil
+}
+
+// quarantining reports whether failing rows are quarantined rather than failing the run.
+func (m *migration) quarantining() bool {
+	return m.quarantineID != ""
+}
+
+// createQuarantineTable creates the quarantine table unless the run does not quarantine.
+func (m *migration) createQuarantineTable(ctx context.Context) error {
+	if !m.quarantining() {
+		return nil
+	}
+	err := m.retry(ctx, "quarantine", func(conn *pgx.Conn) error {
+		_, err := conn.Exec(ctx, createQuarantineTableSQL(m.schema))
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("failed to create the quarantine table: %w", err)
+	}
+	m.logger.Printf("Quarantining rows that fail to migrate in %s with migration_id %s\n", quarantineTable, m.quarantineID)
+	return nil
+}
+
+// quarantine records rows found in a step that reads rather than updates them, and adds them
+// to the report.
+func (m *migration) quarantine(ctx context.Context, rows []Quarantined) error {
+	if len(rows) == 0 {
+		return nil
+	}
+	if err := m.checkQuarantineLimit(len(rows)); err != nil {
+		return err
+	}
+	err := m.retry(ctx, "quarantine", func(conn *pgx.Conn) error {
+		batch := &pgx.Batch{}
+		for _, row := range rows {
+			batch.Queue(quarantineSQL(m.schema), m.quarantineID, row.Step, row.Table, row.ID, row.Error)
+		}
+		return sendBatch(ctx, conn, batch)
+	})
+	if err != nil {
+		return fmt.Errorf("failed to record the quarantined rows: %w", err)
+	}
+	m.quarantined(rows)
+	return nil
+}
+
+// quarantined adds rows recorded in the quarantine table to the report.
+func (m *migration) quarantined(rows []Quarantined) {
+	for _, row := range rows {
+		m.logger.Printf("%s: quarantined %s %s: %s\n", row.Step, row.Table, row.ID, row.Error)
+	}
+	m.report.Quarantined = append(m.report.Quarantined, rows...)
+}
+
+// checkQuarantineLimit fails once more than --max-quarantined rows would be quarantined: that
+// many failing rows point at a problem with the run rather than with the rows.
+func (m *migration) checkQuarantineLimit(more int) error {
+	if n := len(m.report.Quarantined) + more; m.maxQuarantined > 0 && n > m.maxQuarantined {
+		return fmt.Errorf("%d rows failed to migrate, more than --max-quarantined %d; see %s for the first of them", n, m.maxQuarantined, quarantineTable)
+	}
+	return nil
+}
+
+// sendQuarantining is sendPerRow for --error-policy=quarantine, in a single explicit
+// transaction. Every chunk is sent in a savepoint. When a statement fails with an error that a
+// retry would not fix, the chunk is rolled back to the savepoint and sent again without the
+// change the statement belongs to, which is recorded in the quarantine table in the same
+// transaction and left out of m.changes once it commits, so later steps leave the row alone.
+func (m *migration) sendQuarantining(ctx context.Context, step string, r *idRewrite, queue func(batch *pgx.Batch, c idChange)) error {
+	var failed []Quarantined
+	var failedIDs map[uuid.UUID]bool
+	err := m.retry(ctx, step, func(conn *pgx.Conn) error {
+		failed, failedIDs = nil, make(map[uuid.UUID]bool)
+		tx, err := conn.Begin(ctx)
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback(ctx)
+		if m.deferConstraints {
+			if _, err := tx.Exec(ctx, deferConstraintsSQL); err != nil {
+				return err
+			}
+		}
+		err = m.changes.chunks(m.chunkSize, func(chunk []idChange) error {
+			chunk = slices.Clone(chunk)
+			sent := len(chunk)
+			for len(chunk) > 0 {
+				i, err := sendChunk(ctx, tx, chunk, queue)
+				if err == nil {
+					break
+				}
+				if i < 0 || isTransient(err) || ctx.Err() != nil {
+					return err
+				}
+				if err := m.checkQuarantineLimit(len(failed) + 1); err != nil {
+					return err
+				}
+				row := Quarantined{Step: step, Table: r.table, ID: chunk[i].oldID.String(), Error: err.Error()}
+				if _, err := tx.Exec(ctx, quarantineSQL(m.schema), m.quarantineID, row.Step, row.Table, row.ID, row.Error); err != nil {
+					return err
+				}
+				failed = append(failed, row)
+				failedIDs[chunk[i].oldID] = true
+				chunk = slices.Delete(chunk, i, i+1)
+			}
+			return m.throttle.wait(ctx, m.target, step, int64(sent))
+		})
+		if err != nil {
+			return err
+		}
+		return tx.Commit(ctx)
+	})
+	if err != nil {
+		return err
+	}
+	if err := m.changes.remove(failedIDs); err != nil {
+		return err
+	}
+	m.quarantined(failed)
+	return nil
+}
+
+// sendChunk sends the statements queue adds for every change of chunk in a savepoint. When one
+// of them fails, it rolls back to the savepoint and returns the error with the index in chunk
+// of the change the statement belongs to; any other failure returns -1.
+func sendChunk(ctx context.Context, tx pgx.Tx, chunk []idChange, queue func(batch *pgx.Batch, c idChange)) (int, error) {
+	if _, err := tx.Exec(ctx, `SAVEPOINT `+chunkSavepoint); err != nil {
+		return -1, err
+	}
+	batch := &pgx.Batch{}
+	var owner []int
+	for i, c := range chunk {
+		queue(batch, c)
+		for len(owner) < batch.Len() {
+			owner = append(owner, i)
+		}
+	}
+	results := tx.SendBatch(ctx, batch)
+	for _, i := range owner {
+		if _, err := results.Exec(); err != nil {
+			results.Close()
+			if _, rerr := tx.Exec(ctx, `ROLLBACK TO SAVEPOINT `+chunkSavepoint); rerr != nil {
+				return -1, rerr
+			}
+			return i, err
+		}
+	}
+	if err := results.Close(); err != nil {
+		return -1, err
+	}
+	_, err := tx.Exec(ctx, `RELEASE SAVEPOINT `+chunkSavepoint)
+	return -1, err
+}
+
+// quarantinedIDs returns the IDs of every dependency any run quarantined, which verify leaves
+// out of its counts.
+func quarantinedIDs(ctx context.Context, conn *pgx.Conn, schema dbSchema) ([]uuid.UUID, error) {
+	var exists bool
+	if err := conn.QueryRow(ctx, `SELECT to_regclass($1) IS NOT NULL`, schema.prefix()+quarantineTable).Scan(&exists); err != nil || !exists {
+		return nil, err
+	}
+	rows, err := conn.Query(ctx, `SELECT DISTINCT row_id FROM `+schema.prefix()+quarantineTable+` WHERE table_name = 'dependencies'`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var ids []uuid.UUID
+	for rows.Next() {
+		var id uuid.UUID
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
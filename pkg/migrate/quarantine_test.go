@@ -0,0 +1,41 @@
+package migrate
+
+import (
+	"io"
+	"log"
+	"testing"
+)
+
+func TestCheckErrorPolicyOptions(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		opts options
+		ok   bool
+	}{
+		{"abort", options{errorPolicy: errorPolicyAbort, online: true}, true},
+		{"quarantine", options{errorPolicy: errorPolicyQuarantine, fast: true, deferFKs: true}, true},
+		{"emit-sql", options{errorPolicy: errorPolicyQuarantine, emitSQL: "migrate.sql"}, false},
+		{"estimate", options{errorPolicy: errorPolicyQuarantine, estimate: true}, false},
+		{"online", options{errorPolicy: errorPolicyQuarantine, online: true}, false},
+		{"negative limit", options{errorPolicy: errorPolicyQuarantine, maxQuarantined: -1}, false},
+	} {
+		if err := checkErrorPolicyOptions(&tc.opts); (err == nil) != tc.ok {
+			t.Errorf("%s: checkErrorPolicyOptions() = %v, want ok %v", tc.name, err, tc.ok)
+		}
+	}
+}
+
+func TestCheckQuarantineLimit(t *testing.T) {
+	m := &migration{quarantineID: "q", maxQuarantined: 2, report: newReport(), logger: log.New(io.Discard, "", 0)}
+	m.quarantined([]Quarantined{{Step: "rewrite-ids", Table: "dependencies", ID: "a", Error: "boom"}})
+	if err := m.checkQuarantineLimit(1); err != nil {
+		t.Errorf("checkQuarantineLimit(1) = %v with 1 of 2 quarantined", err)
+	}
+	if err := m.checkQuarantineLimit(2); err == nil {
+		t.Errorf("checkQuarantineLimit(2) allowed 3 quarantined rows with --max-quarantined 2")
+	}
+	m.maxQuarantined = 0
+	if err := m.checkQuarantineLimit(1000); err != nil {
+		t.Errorf("checkQuarantineLimit() = %v without a limit", err)
+	}
+}
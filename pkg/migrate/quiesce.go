@@ -0,0 +1,122 @@
+package migrate
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+const (
+	// writerSamples and writerSampleInterval control how long the database is watched before
+	// it is considered quiet. Ingestion commits in short transactions, so a single look at
+	// pg_stat_activity could easily fall between two of them.
+	writerSamples        = 10
+	writerSampleInterval = 500 * time.Millisecond
+	// quiescePollInterval is how often an active database is re-checked with --wait-for-quiesce.
+	quiescePollInterval = 10 * time.Second
+)
+
+// errActiveWriters is returned when other sessions are writing to the database.
+var errActiveWriters = errors.New("other sessions are writing to the database; stop GUAC ingestion first, pass --wait-for-quiesce to wait, or --force to run anyway")
+
+// writer is another session that holds a write transaction on the database.
+type writer struct {
+	pid   int32
+	user  string
+	app   string
+	addr  string
+	state string
+	query string
+}
+
+func (w writer) String() string {
+	q := strings.Join(strings.Fields(w.query), " ")
+	if len(q) > 80 {
+		q = q[:77] + "..."
+	}
+	return fmt.Sprintf("pid %d user=%q application=%q client=%q state=%q query=%q", w.pid, w.user, w.app, w.addr, w.state, q)
+}
+
+// findWriters samples pg_stat_activity for other client sessions on the current database that
+// have been assigned a transaction ID, which Postgres only does once a transaction writes.
+func findWriters(ctx context.Context, conn *pgx.Conn) ([]writer, error) {
+	seen := make(map[int32]writer)
+	for i := 0; i < writerSamples; i++ {
+		if i > 0 {
+			select {
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			case <-time.After(writerSampleInterval):
+			}
+		}
+
+		rows, err := conn.Query(ctx, `
+			SELECT pid, coalesce(usename, ''), coalesce(application_name, ''),
+			       coalesce(client_addr::text, 'local'), coalesce(state, ''), coalesce(query, '')
+			FROM pg_stat_activity
+			WHERE datname = current_database()
+			  AND pid <> pg_backend_pid()
+			  AND backend_type = 'client backend'
+			  AND backend_xid IS NOT NULL
+		`)
+		if err != nil {
+			return nil, fmt.Errorf("failed to query pg_stat_activity: %w", err)
+		}
+		for rows.Next() {
+			var w writer
+			if err := rows.Scan(&w.pid, &w.user, &w.app, &w.addr, &w.state, &w.query); err != nil {
+				rows.Close()
+				return nil, fmt.Errorf("failed to scan pg_stat_activity: %w", err)
+			}
+			seen[w.pid] = w
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return nil, fmt.Errorf("failed to query pg_stat_activity: %w", err)
+		}
+	}
+
+	writers := make([]writer, 0, len(seen))
+	for _, w := range seen {
+		writers = append(writers, w)
+	}
+	return writers, nil
+}
+
+// checkQuiesced refuses to continue while other sessions are writing to the database, since
+// rewriting IDs under concurrent ingestion leaves inconsistent references. When wait is set it
+// polls until the database is quiet or timeout elapses.
+func checkQuiesced(ctx context.Context, conn *pgx.Conn, logger *log.Logger, wait bool, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for {
+		writers, err := findWriters(ctx, conn)
+		if err != nil {
+			return err
+		}
+		if len(writers) == 0 {
+			return nil
+		}
+
+		for _, w := range writers {
+			logger.Printf("Active writer: %s\n", w)
+		}
+		if !wait {
+			return fmt.Errorf("%w (%d active)", errActiveWriters, len(writers))
+		}
+		if time.Now().Add(quiescePollInterval).After(deadline) {
+			return fmt.Errorf("database did not quiesce within %s: %w", timeout, errActiveWriters)
+		}
+
+		logger.Printf("Waiting for %d active writers to finish\n", len(writers))
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(quiescePollInterval):
+		}
+	}
+}
@@ -0,0 +1,572 @@
+package migrate
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+	"github.com/pxp928/guac-update-db/pkg/keys"
+)
+
+// remediationPlanVersion is the version of the plan format audit writes; apply refuses others.
+const remediationPlanVersion = 1
+
+// planBatchSize is how many statements of a plan apply sends in one round trip.
+const planBatchSize = 1000
+
+// remediationPlan is what audit decided to change, for apply to execute once it was reviewed.
+type remediationPlan struct {
+	Version             int           `json:"version"`
+	CreatedAt           time.Time     `json:"created_at"`
+	DatabaseFingerprint string        `json:"database_fingerprint"`
+	IDScheme            string        `json:"id_scheme"`
+	Findings            auditFindings `json:"findings"`
+	// Statements run in order in one transaction. The values they change are inlined, and
+	// are all UUIDs.
+	Statements []planStatement `json:"statements"`
+}
+
+// planStatement is a statement of a plan and the number of rows it changed in the database
+// audit inspected. apply rolls the plan back when a statement changes any other number.
+type planStatement struct {
+	SQL  string `json:"sql"`
+	Rows int64  `json:"rows"`
+}
+
+// auditFindings are the inconsistencies audit found and how many of them the plan fixes.
+type auditFindings struct {
+	DependenciesChecked int64 `json:"dependencies_checked"`
+	// NullVersionIDs are the dependencies without dependent_package_version_id, of which
+	// Backfilled have a package version matching their name and version range.
+	NullVersionIDs int64 `json:"null_version_ids"`
+	Backfilled     int64 `json:"backfilled"`
+	// Unresolved lists the dependencies no package version matches, which are left alone.
+	Unresolved []string `json:"unresolved"`
+	// IDMismatches are the dependencies whose ID is not the one GUAC computes, of which
+	// Rewritten are given it. Collisions are the new IDs several of them would share.
+	IDMismatches int64         `json:"id_mismatches"`
+	Rewritten    int64         `json:"rewritten"`
+	Collisions   []IDCollision `json:"collisions"`
+	// DanglingReferences are the bill of materials rows referencing a missing dependency, of
+	// which Remapped are repointed to the dependency their ID was rewritten to and Deleted
+	// are deleted, as duplicates of a remapped row or with --delete-orphans.
+	DanglingReferences int64    `json:"dangling_references"`
+	Remapped           int64    `json:"remapped"`
+	Deleted            int64    `json:"deleted"`
+	MappingSources     []string `json:"mapping_sources"`
+}
+
+// consistent reports whether audit found nothing to fix.
+func (f *auditFindings) consistent() bool {
+	return f.NullVersionIDs == 0 && f.IDMismatches == 0 && f.DanglingReferences == 0
+}
+
+func runAudit(args []string) {
+	var cf connFlags
+	var scheme idSchemeFlag
+	fs := flag.NewFlagSet("audit", flag.ExitOnError)
+	cf.register(fs)
+	scheme.register(fs)
+	planPath := fs.String("plan", "guac-update-db-plan.json", "write the remediation plan to `path`, for apply --plan")
+	sqlPath := fs.String("sql", "", "also write the statements of the plan to a psql script at `path`, for review")
+	deleteOrphans := fs.Bool("delete-orphans", false, "plan to delete the bill of materials rows referencing a missing dependency that cannot be remapped")
+	format := fs.String("format", "text", "output `format`: text or json")
+	list := fs.Int("list", 20, "list at most `n` unresolved dependencies and n colliding IDs")
+	fs.Parse(args)
+
+	consistent, err := auditDatabase(&cf, scheme.get(), *planPath, *sqlPath, *deleteOrphans, *format, *list, os.Stdout)
+	if err != nil {
+		log.Fatalf("%v\n", err)
+	}
+	if !consistent {
+		os.Exit(exitVerificationFailed)
+	}
+}
+
+// auditDatabase inspects the database in a read-only transaction, without taking the migration
+// lock, and writes a plan fixing every inconsistency it can to planPath. The backfill is
+// planned first, as the ID of a dependency depends on its version, then the ID rewrites with
+// their references and the remapping of dangling references. The foreign keys referencing
+// dependencies are dropped around the rewrites and added back, validated, at the end. It
+// reports whether the database was consistent.
+func auditDatabase(cf *connFlags, scheme *keys.Scheme, planPath, sqlPath string, deleteOrphans bool, format string, listLimit int, w io.Writer) (bool, error) {
+	if format != "text" && format != "json" {
+		return false, fmt.Errorf("invalid --format %q: must be text or json", format)
+	}
+	if planPath == "" {
+		return false, errors.New("--plan is required")
+	}
+	ctx := context.Background()
+	config, err := cf.config()
+	if err != nil {
+		return false, err
+	}
+	conn, err := pgx.ConnectConfig(ctx, config)
+	if err != nil {
+		return false, fmt.Errorf("unable to connect to database: %w", err)
+	}
+	defer conn.Close(ctx)
+	id, err := identifyDatabase(ctx, conn, cf.schema)
+	if err != nil {
+		return false, err
+	}
+	tx, err := conn.BeginTx(ctx, pgx.TxOptions{IsoLevel: pgx.RepeatableRead, AccessMode: pgx.ReadOnly})
+	if err != nil {
+		return false, fmt.Errorf("failed to start a transaction: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	p := &remediationPlan{
+		Version:             remediationPlanVersion,
+		CreatedAt:           time.Now().UTC(),
+		DatabaseFingerprint: id.Fingerprint,
+		IDScheme:            scheme.Name,
+		Findings:            auditFindings{Unresolved: []string{}, Collisions: []IDCollision{}, MappingSources: []string{}},
+		Statements:          []planStatement{},
+	}
+	if err := p.plan(ctx, tx, cf.schema, scheme, deleteOrphans, listLimit); err != nil {
+		return false, err
+	}
+	if err := p.write(planPath); err != nil {
+		return false, err
+	}
+	if sqlPath != "" {
+		if err := p.writeSQL(sqlPath); err != nil {
+			return false, err
+		}
+	}
+
+	f := &p.Findings
+	if format == "json" {
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return f.consistent(), enc.Encode(struct {
+			Consistent bool   `json:"consistent"`
+			Plan       string `json:"plan"`
+			Statements int    `json:"statements"`
+			*auditFindings
+		}{f.consistent(), planPath, len(p.Statements), f})
+	}
+	p.print(w, planPath)
+	return f.consistent(), nil
+}
+
+// plan fills in the findings and statements of p from the database tx reads.
+func (p *remediationPlan) plan(ctx context.Context, tx pgx.Tx, schema dbSchema, scheme *keys.Scheme, deleteOrphans bool, listLimit int) error {
+	f := &p.Findings
+	versions, err := backfillableVersions(ctx, tx, schema)
+	if err != nil {
+		return fmt.Errorf("failed to match dependencies to package versions: %w", err)
+	}
+	var backfill []planStatement
+	var changes []idChange
+	err = scanDependencyRows(ctx, tx, schema, "ORDER BY id", nil, func(dep dependency, resolved bool) error {
+		f.DependenciesChecked++
+		if !resolved {
+			f.NullVersionIDs++
+			versionID, ok := versions[dep.oldID]
+			if !ok {
+				if len(f.Unresolved) < listLimit {
+					f.Unresolved = append(f.Unresolved, dep.oldID.String())
+				}
+				return nil
+			}
+			dep.DependentPackageVersionID = versionID
+			f.Backfilled++
+			backfill = append(backfill, planStatement{
+				SQL:  fmt.Sprintf(`UPDATE %sdependencies SET dependent_package_version_id = '%s' WHERE id = '%s' AND dependent_package_version_id IS NULL`, schema.prefix(), versionID, dep.oldID),
+				Rows: 1,
+			})
+		}
+		changes = append(changes, idChange{oldID: dep.oldID, newID: scheme.Key(dep.Dependency)})
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to query dependencies: %w", err)
+	}
+
+	// Rows that would share their new ID cannot all be given it, so none of them is.
+	colliding := make(map[string]bool)
+	for _, c := range findCollisions(changes) {
+		for _, oldID := range c.OldIDs {
+			colliding[oldID] = true
+		}
+		if len(f.Collisions) < listLimit {
+			f.Collisions = append(f.Collisions, c)
+		}
+	}
+	rewritten := make(map[uuid.UUID]uuid.UUID)
+	var mismatched []uuid.UUID
+	for _, c := range changes {
+		if c.oldID == c.newID {
+			continue
+		}
+		f.IDMismatches++
+		if !colliding[c.oldID.String()] {
+			rewritten[c.oldID] = c.newID
+			mismatched = append(mismatched, c.oldID)
+		}
+	}
+	f.Rewritten = int64(len(mismatched))
+	rewrites, err := planRewrites(ctx, tx, schema, mismatched, rewritten)
+	if err != nil {
+		return err
+	}
+	orphans, err := p.planOrphans(ctx, tx, schema, rewritten, deleteOrphans)
+	if err != nil {
+		return err
+	}
+
+	var fks []foreignKey
+	if len(rewrites) > 0 {
+		if fks, err = findForeignKeys(ctx, tx, schema, dependencyIDs); err != nil {
+			return fmt.Errorf("failed to look for the foreign keys: %w", err)
+		}
+		if err := dependencyIDs.checkForeignKeys(fks); err != nil {
+			return err
+		}
+	}
+	for _, fk := range fks {
+		p.Statements = append(p.Statements, planStatement{SQL: `ALTER TABLE ` + fk.table + ` DROP CONSTRAINT ` + pgx.Identifier{fk.name}.Sanitize()})
+	}
+	p.Statements = append(p.Statements, backfill...)
+	p.Statements = append(p.Statements, rewrites...)
+	p.Statements = append(p.Statements, orphans...)
+	for _, fk := range fks {
+		p.Statements = append(p.Statements, planStatement{SQL: `ALTER TABLE ` + fk.table + ` ADD CONSTRAINT ` + pgx.Identifier{fk.name}.Sanitize() + ` ` + fk.definition})
+	}
+	return nil
+}
+
+// backfillableVersions maps every dependency without dependent_package_version_id to the
+// package version the backfill fills in, the one with the lowest ID when several match.
+func backfillableVersions(ctx context.Context, q queryer, schema dbSchema) (map[uuid.UUID]uuid.UUID, error) {
+	rows, err := q.Query(ctx, `
+		SELECT DISTINCT ON (d.id) d.id, pv.id FROM `+schema.prefix()+`dependencies d
+		JOIN `+schema.prefix()+`package_versions pv ON pv.name_id = d.dependent_package_name_id AND `+versionMatchSQL(versionRangesSkip, "d", "pv")+`
+		WHERE d.dependent_package_version_id IS NULL
+		ORDER BY d.id, pv.id
+	`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	versions := make(map[uuid.UUID]uuid.UUID)
+	for rows.Next() {
+		var id, versionID uuid.UUID
+		if err := rows.Scan(&id, &versionID); err != nil {
+			return nil, err
+		}
+		versions[id] = versionID
+	}
+	return versions, rows.Err()
+}
+
+// planRewrites returns the statements giving every dependency in mismatched its new ID and
+// repointing the rows referencing it.
+func planRewrites(ctx context.Context, q queryer, schema dbSchema, mismatched []uuid.UUID, rewritten map[uuid.UUID]uuid.UUID) ([]planStatement, error) {
+	if len(mismatched) == 0 {
+		return nil, nil
+	}
+	references := make([]map[uuid.UUID]int64, len(dependencyIDs.referencers))
+	for i, ref := range dependencyIDs.referencers {
+		counts, err := countReferences(ctx, q, schema, ref, mismatched)
+		if err != nil {
+			return nil, fmt.Errorf("failed to count the references of %s: %w", ref.table, err)
+		}
+		references[i] = counts
+	}
+	var stmts []planStatement
+	for _, oldID := range mismatched {
+		newID := rewritten[oldID]
+		stmts = append(stmts, planStatement{SQL: fmt.Sprintf(`UPDATE %sdependencies SET id = '%s' WHERE id = '%s'`, schema.prefix(), newID, oldID), Rows: 1})
+		for i, ref := range dependencyIDs.referencers {
+			if n := references[i][oldID]; n > 0 {
+				stmts = append(stmts, planStatement{SQL: fmt.Sprintf(`UPDATE %s SET %s = '%s' WHERE %s = '%s'`, schema.prefix()+ref.table, ref.column, newID, ref.column, oldID), Rows: n})
+			}
+		}
+	}
+	return stmts, nil
+}
+
+// countReferences counts the rows of ref referencing each of ids.
+func countReferences(ctx context.Context, q queryer, schema dbSchema, ref referencer, ids []uuid.UUID) (map[uuid.UUID]int64, error) {
+	rows, err := q.Query(ctx, `SELECT `+ref.column+`, count(*) FROM `+schema.prefix()+ref.table+` WHERE `+ref.column+` = ANY($1) GROUP BY 1`, uuidStrings(ids))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	counts := make(map[uuid.UUID]int64)
+	for rows.Next() {
+		var id uuid.UUID
+		var n int64
+		if err := rows.Scan(&id, &n); err != nil {
+			return nil, err
+		}
+		counts[id] = n
+	}
+	return counts, rows.Err()
+}
+
+// planOrphans returns the statements repointing every dangling bill of materials reference
+// that repair-orphans --policy remap would remap, to the ID its dependency gets once
+// rewritten. A row whose SBOM already references that dependency is deleted instead, as are,
+// with deleteOrphans, the rows that cannot be remapped.
+func (p *remediationPlan) planOrphans(ctx context.Context, tx pgx.Tx, schema dbSchema, rewritten map[uuid.UUID]uuid.UUID, deleteOrphans bool) ([]planStatement, error) {
+	f := &p.Findings
+	orphaned, err := orphanedDependencyIDs(ctx, tx.Conn(), schema)
+	if err != nil {
+		return nil, fmt.Errorf("failed to find orphaned rows: %w", err)
+	}
+	if len(orphaned) == 0 {
+		return nil, nil
+	}
+	for _, n := range orphaned {
+		f.DanglingReferences += n
+	}
+	r := &orphanRepair{MappingSources: []string{}}
+	remap, err := orphanRemapping(ctx, tx.Conn(), schema, orphaned, nil, r)
+	if err != nil {
+		return nil, fmt.Errorf("failed to map orphaned IDs: %w", err)
+	}
+	f.MappingSources = r.MappingSources
+	final := func(id uuid.UUID) uuid.UUID {
+		if newID, ok := rewritten[id]; ok {
+			return newID
+		}
+		return id
+	}
+
+	type reference struct{ sbom, dependency uuid.UUID }
+	var rows []reference
+	var sboms, targets []uuid.UUID
+	err = queryEach(ctx, tx, `
+		SELECT b.bill_of_materials_id, b.dependency_id FROM `+schema.prefix()+`bill_of_materials_included_dependencies b
+		WHERE NOT EXISTS (SELECT 1 FROM `+schema.prefix()+`dependencies d WHERE d.id = b.dependency_id)
+		ORDER BY b.dependency_id, b.bill_of_materials_id
+	`, nil, func(sbom, dependency uuid.UUID) {
+		rows = append(rows, reference{sbom, dependency})
+		if target, ok := remap[dependency]; ok {
+			sboms, targets = append(sboms, sbom), append(targets, target)
+		}
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list orphaned rows: %w", err)
+	}
+	// The references that will exist once the rewrites ran, of the SBOMs with a remapped row.
+	existing := make(map[reference]bool)
+	if len(sboms) > 0 {
+		err = queryEach(ctx, tx, `
+			SELECT bill_of_materials_id, dependency_id FROM `+schema.prefix()+`bill_of_materials_included_dependencies
+			WHERE bill_of_materials_id = ANY($1) AND dependency_id = ANY($2)
+		`, []interface{}{uuidStrings(sboms), uuidStrings(targets)}, func(sbom, dependency uuid.UUID) {
+			existing[reference{sbom, final(dependency)}] = true
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to read the references of the remapped rows: %w", err)
+		}
+	}
+
+	var stmts []planStatement
+	for _, row := range rows {
+		target, ok := remap[row.dependency]
+		if !ok {
+			if deleteOrphans {
+				f.Deleted++
+				stmts = append(stmts, planStatement{SQL: fmt.Sprintf(`DELETE FROM %sbill_of_materials_included_dependencies WHERE bill_of_materials_id = '%s' AND dependency_id = '%s'`, schema.prefix(), row.sbom, row.dependency), Rows: 1})
+			}
+			continue
+		}
+		target = final(target)
+		if existing[reference{row.sbom, target}] {
+			f.Deleted++
+			stmts = append(stmts, planStatement{SQL: fmt.Sprintf(`DELETE FROM %sbill_of_materials_included_dependencies WHERE bill_of_materials_id = '%s' AND dependency_id = '%s'`, schema.prefix(), row.sbom, row.dependency), Rows: 1})
+			continue
+		}
+		existing[reference{row.sbom, target}] = true
+		f.Remapped++
+		stmts = append(stmts, planStatement{SQL: fmt.Sprintf(`UPDATE %sbill_of_materials_included_dependencies SET dependency_id = '%s' WHERE bill_of_materials_id = '%s' AND dependency_id = '%s'`, schema.prefix(), target, row.sbom, row.dependency), Rows: 1})
+	}
+	return stmts, nil
+}
+
+// queryEach visits the pairs of UUIDs query returns.
+func queryEach(ctx context.Context, q queryer, query string, args []interface{}, visit func(a, b uuid.UUID)) error {
+	rows, err := q.Query(ctx, query, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var a, b uuid.UUID
+		if err := rows.Scan(&a, &b); err != nil {
+			return err
+		}
+		visit(a, b)
+	}
+	return rows.Err()
+}
+
+// write saves the plan to path.
+func (p *remediationPlan) write(path string) error {
+	data, err := json.MarshalIndent(p, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(path, append(data, '\n'), 0o600); err != nil {
+		return fmt.Errorf("failed to write the plan: %w", err)
+	}
+	return nil
+}
+
+// writeSQL writes the statements of the plan to a psql script at path.
+func (p *remediationPlan) writeSQL(path string) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return fmt.Errorf("failed to create the SQL script: %w", err)
+	}
+	fmt.Fprintf(f, "-- Remediation plan for database %s, audited at %s.\n", p.DatabaseFingerprint, p.CreatedAt.Format(time.RFC3339))
+	fmt.Fprintf(f, "-- apply --plan also checks the rows every statement changes; this script does not.\n")
+	fmt.Fprintf(f, "BEGIN;\n")
+	for _, s := range p.Statements {
+		fmt.Fprintf(f, "%s;\n", s.SQL)
+	}
+	fmt.Fprintf(f, "COMMIT;\n")
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("failed to write the SQL script: %w", err)
+	}
+	return nil
+}
+
+func (p *remediationPlan) print(w io.Writer, planPath string) {
+	f := &p.Findings
+	fmt.Fprintf(w, "Audited %d dependencies against the %s ID scheme\n", f.DependenciesChecked, p.IDScheme)
+	fmt.Fprintf(w, "  %d without dependent_package_version_id: %d can be backfilled\n", f.NullVersionIDs, f.Backfilled)
+	for _, id := range f.Unresolved {
+		fmt.Fprintf(w, "    no matching package version: %s\n", id)
+	}
+	fmt.Fprintf(w, "  %d with an ID GUAC does not compute: %d can be rewritten\n", f.IDMismatches, f.Rewritten)
+	for _, c := range f.Collisions {
+		fmt.Fprintf(w, "    %s would be the ID of %d dependencies\n", c.NewID, len(c.OldIDs))
+	}
+	fmt.Fprintf(w, "  %d bill of materials rows referencing a missing dependency: %d can be remapped, %d deleted\n", f.DanglingReferences, f.Remapped, f.Deleted)
+	if f.consistent() {
+		fmt.Fprintln(w, "The database is consistent; the plan is empty.")
+		return
+	}
+	fmt.Fprintf(w, "Wrote the %d statements of the plan to %s; run them with: guac-update-db apply --plan %s\n", len(p.Statements), planPath, planPath)
+}
+
+func runApply(args []string) {
+	var cf connFlags
+	fs := flag.NewFlagSet("apply", flag.ExitOnError)
+	cf.register(fs)
+	planPath := fs.String("plan", "", "run the remediation plan audit wrote to `path`")
+	yes := fs.Bool("yes", false, "do not ask for confirmation before modifying the database")
+	fs.BoolVar(yes, "non-interactive", false, "alias for --yes")
+	fs.Parse(args)
+
+	if err := applyPlan(&cf, *planPath, *yes, os.Stdout); err != nil {
+		log.Fatalf("%v\n", err)
+	}
+}
+
+// applyPlan runs the statements of the plan at planPath in one transaction, holding the
+// migration lock. It only runs against the database the plan was made of, and rolls back when
+// a statement changes another number of rows than it did in the database audit inspected, as
+// the plan then no longer describes the database.
+func applyPlan(cf *connFlags, planPath string, yes bool, w io.Writer) error {
+	if planPath == "" {
+		return errors.New("--plan is required")
+	}
+	data, err := os.ReadFile(planPath)
+	if err != nil {
+		return fmt.Errorf("failed to read the plan: %w", err)
+	}
+	var p remediationPlan
+	if err := json.Unmarshal(data, &p); err != nil {
+		return fmt.Errorf("failed to parse the plan %s: %w", planPath, err)
+	}
+	if p.Version != remediationPlanVersion {
+		return fmt.Errorf("the plan %s has version %d; this binary applies version %d, audit the database again", planPath, p.Version, remediationPlanVersion)
+	}
+
+	ctx := context.Background()
+	config, err := cf.config()
+	if err != nil {
+		return err
+	}
+	conn, err := pgx.ConnectConfig(ctx, config)
+	if err != nil {
+		return fmt.Errorf("unable to connect to database: %w", err)
+	}
+	defer conn.Close(ctx)
+	id, err := identifyDatabase(ctx, conn, cf.schema)
+	if err != nil {
+		return err
+	}
+	if id.Fingerprint != p.DatabaseFingerprint {
+		return fmt.Errorf("the plan was made for database %s, but this is %s", p.DatabaseFingerprint, id.Fingerprint)
+	}
+	if len(p.Statements) == 0 {
+		fmt.Fprintln(w, "The plan is empty; nothing to apply.")
+		return nil
+	}
+	lock, err := holdMigrationLock(ctx, config)
+	if err != nil {
+		return err
+	}
+	defer lock.release(ctx)
+	if !yes {
+		fmt.Fprintf(w, "This will run the %d statements of the plan audit made at %s.\n", len(p.Statements), p.CreatedAt.Format(time.RFC3339))
+		if err := promptConfirmation(os.Stdin, w, cf.usesStdin()); err != nil {
+			return err
+		}
+	}
+
+	tx, err := conn.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+	for start := 0; start < len(p.Statements); start += planBatchSize {
+		if err := applyBatch(ctx, tx, p.Statements[start:min(start+planBatchSize, len(p.Statements))], start); err != nil {
+			return err
+		}
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return fmt.Errorf("failed to commit the plan: %w", err)
+	}
+	fmt.Fprintf(w, "Applied the %d statements of %s.\n", len(p.Statements), planPath)
+	return nil
+}
+
+// applyBatch runs stmts, the statements of a plan from offset on, in one round trip.
+func applyBatch(ctx context.Context, tx pgx.Tx, stmts []planStatement, offset int) error {
+	batch := &pgx.Batch{}
+	for _, s := range stmts {
+		batch.Queue(s.SQL)
+	}
+	results := tx.SendBatch(ctx, batch)
+	for i, s := range stmts {
+		tag, err := results.Exec()
+		if err != nil {
+			results.Close()
+			return fmt.Errorf("statement %d of the plan failed: %w", offset+i+1, err)
+		}
+		if tag.RowsAffected() != s.Rows {
+			results.Close()
+			return fmt.Errorf("statement %d of the plan changed %d rows where the audit expected %d; the database changed since, audit it again: %s",
+				offset+i+1, tag.RowsAffected(), s.Rows, s.SQL)
+		}
+	}
+	return results.Close()
+}
@@ -0,0 +1,57 @@
+package migrate
+
+import (
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRemediationPlanSQL(t *testing.T) {
+	dir := t.TempDir()
+	p := &remediationPlan{
+		Version:             remediationPlanVersion,
+		DatabaseFingerprint: "abc",
+		Statements: []planStatement{
+			{SQL: `UPDATE public.dependencies SET id = 'b' WHERE id = 'a'`, Rows: 1},
+			{SQL: `ALTER TABLE t ADD CONSTRAINT c FOREIGN KEY (x) REFERENCES dependencies(id)`},
+		},
+	}
+	script := filepath.Join(dir, "plan.sql")
+	if err := p.writeSQL(script); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(script)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "BEGIN;\n" + p.Statements[0].SQL + ";\n" + p.Statements[1].SQL + ";\nCOMMIT;\n"
+	if !strings.HasSuffix(string(data), want) {
+		t.Errorf("script =\n%s\nwant it to end with\n%s", data, want)
+	}
+
+	path := filepath.Join(dir, "plan.json")
+	if err := p.write(path); err != nil {
+		t.Fatal(err)
+	}
+	var read remediationPlan
+	if data, err = os.ReadFile(path); err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal(data, &read); err != nil || len(read.Statements) != 2 || read.Statements[0] != p.Statements[0] {
+		t.Errorf("plan read back = %+v, %v", read, err)
+	}
+}
+
+func TestApplyPlanRejectsOtherVersions(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "plan.json")
+	p := &remediationPlan{Version: remediationPlanVersion + 1}
+	if err := p.write(path); err != nil {
+		t.Fatal(err)
+	}
+	if err := applyPlan(&connFlags{}, path, true, io.Discard); err == nil || !strings.Contains(err.Error(), "version") {
+		t.Errorf("applyPlan() = %v, want the version rejected", err)
+	}
+}
@@ -0,0 +1,273 @@
+package migrate
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+func runReplay(args []string) {
+	var cf connFlags
+	fs := flag.NewFlagSet("replay", flag.ExitOnError)
+	cf.register(fs)
+	yes := fs.Bool("yes", false, "do not ask for confirmation before modifying the database")
+	fs.BoolVar(yes, "non-interactive", false, "alias for --yes")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		usageFatalf("usage: guac-update-db replay [flags] <trace>\n")
+	}
+
+	reproduced, err := replayTrace(&cf, fs.Arg(0), *yes, os.Stdout)
+	if err != nil {
+		log.Fatalf("%v\n", err)
+	}
+	if !reproduced {
+		os.Exit(exitVerificationFailed)
+	}
+}
+
+// replay runs the statements of a trace against a scratch database, one connection per
+// session of the recorded run, and compares the errors they fail with to the recorded ones.
+type replay struct {
+	cf       *connFlags
+	config   *pgx.ConnConfig
+	w        io.Writer
+	sessions map[int]*pgx.Conn
+	// batches are the batches being collected, by session, with the error recorded for them.
+	batches map[int]*replayBatch
+
+	opened, statements, copies int
+	recordedErrors, reproduced int
+	newErrors                  int
+}
+
+type replayBatch struct {
+	entry    int
+	batch    *pgx.Batch
+	recorded *traceErrorMsg
+}
+
+// replayTrace replays the trace at path and reports whether the run went as recorded: every
+// error of the recording reproduced, and no other.
+func replayTrace(cf *connFlags, path string, yes bool, w io.Writer) (bool, error) {
+	header, recorded, err := readTrace(path, func(int, *traceEntry) error { return nil })
+	if err != nil {
+		return false, err
+	}
+	config, err := cf.config()
+	if err != nil {
+		return false, err
+	}
+	ctx := context.Background()
+	r := &replay{cf: cf, config: config, w: w, sessions: make(map[int]*pgx.Conn), batches: make(map[int]*replayBatch)}
+	defer r.close(ctx)
+	if err := r.checkScratch(ctx, recorded, yes); err != nil {
+		return false, err
+	}
+
+	fmt.Fprintf(w, "Replaying %s, recorded by guac-update-db %s at %s.\n", path, header.Version, header.Recorded.Format(time.RFC3339))
+	_, _, err = readTrace(path, func(n int, e *traceEntry) error {
+		if err := r.entry(ctx, n, e); err != nil {
+			return fmt.Errorf("entry %d of the trace: %w", n, err)
+		}
+		return nil
+	})
+	if err != nil {
+		return false, err
+	}
+	for s := range r.batches {
+		if err := r.sendBatch(ctx, s, nil); err != nil {
+			return false, err
+		}
+	}
+
+	fmt.Fprintf(w, "Replayed %d statements in %d sessions, skipping %d COPYs whose rows are not recorded: %d of %d recorded errors reproduced, %d new errors.\n",
+		r.statements, r.opened, r.copies, r.reproduced, r.recordedErrors, r.newErrors)
+	return r.reproduced == r.recordedErrors && r.newErrors == 0, nil
+}
+
+// readTrace calls visit with every entry of the trace at path but the traceDatabase one, and
+// returns its header and the fingerprint of the database it was recorded in.
+func readTrace(path string, visit func(n int, e *traceEntry) error) (*traceHeader, string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to open the trace: %w", err)
+	}
+	defer f.Close()
+	tr, err := newTraceReader(f)
+	if err != nil {
+		return nil, "", err
+	}
+	var fingerprint string
+	for n := 1; ; n++ {
+		e, err := tr.next()
+		if errors.Is(err, io.EOF) {
+			return &tr.header, fingerprint, nil
+		}
+		if err != nil {
+			return nil, "", fmt.Errorf("failed to read entry %d of the trace: %w", n, err)
+		}
+		if e.Kind == traceDatabase {
+			fingerprint = e.Fingerprint
+			continue
+		}
+		if err := visit(n, e); err != nil {
+			return nil, "", err
+		}
+	}
+}
+
+// checkScratch refuses to replay against the database the trace was recorded in, and asks
+// for confirmation before changing the scratch database.
+func (r *replay) checkScratch(ctx context.Context, recorded string, yes bool) error {
+	conn, err := r.session(ctx, 0)
+	if err != nil {
+		return err
+	}
+	id, err := identifyDatabase(ctx, conn, r.cf.schema)
+	if err != nil {
+		return err
+	}
+	if recorded != "" && id.Fingerprint == recorded {
+		return fmt.Errorf("the trace was recorded in database %s; replay it against a scratch database", recorded)
+	}
+	if !yes {
+		fmt.Fprintf(r.w, "This will run the recorded statements against database %s, changing it as the recorded run changed its own.\n", id.Fingerprint)
+		return promptConfirmation(os.Stdin, r.w, r.cf.usesStdin())
+	}
+	return nil
+}
+
+// entry replays entry n of the trace.
+func (r *replay) entry(ctx context.Context, n int, e *traceEntry) error {
+	s := e.Session
+	if b := r.batches[s]; b != nil && e.Kind != traceBatched {
+		// The step error right after a batch is the one the batch failed with.
+		var recorded *traceErrorMsg
+		if e.Kind == traceError {
+			recorded = e.Error
+		}
+		if err := r.sendBatch(ctx, s, recorded); err != nil {
+			return err
+		}
+		if e.Kind == traceError {
+			return nil
+		}
+	}
+	switch e.Kind {
+	case traceExec, traceQuery:
+		conn, err := r.session(ctx, s)
+		if err != nil {
+			return err
+		}
+		args, err := replayArgs(e.Args)
+		if err != nil {
+			return err
+		}
+		r.statements++
+		_, err = conn.Exec(ctx, e.SQL, args...)
+		r.compare(n, s, e.Error, err)
+	case traceBatch:
+		r.batches[s] = &replayBatch{entry: n, batch: &pgx.Batch{}}
+	case traceBatched:
+		b := r.batches[s]
+		if b == nil {
+			return errors.New("a batched statement outside a batch")
+		}
+		args, err := replayArgs(e.Args)
+		if err != nil {
+			return err
+		}
+		b.batch.Queue(e.SQL, args...)
+		if b.recorded == nil {
+			b.recorded = e.Error
+		}
+	case traceCopy:
+		r.copies++
+	case traceClose:
+		if conn := r.sessions[s]; conn != nil {
+			conn.Close(ctx)
+			delete(r.sessions, s)
+		}
+	}
+	return nil
+}
+
+// sendBatch sends the batch collected for session s, which was recorded failing with
+// recorded, or one of its statements was.
+func (r *replay) sendBatch(ctx context.Context, s int, recorded *traceErrorMsg) error {
+	b := r.batches[s]
+	delete(r.batches, s)
+	if b.recorded != nil {
+		recorded = b.recorded
+	}
+	conn, err := r.session(ctx, s)
+	if err != nil {
+		return err
+	}
+	r.statements += b.batch.Len()
+	r.compare(b.entry, s, recorded, conn.SendBatch(ctx, b.batch).Close())
+	return nil
+}
+
+// compare reports how the statement of entry n replayed against how it was recorded.
+func (r *replay) compare(n, s int, recorded *traceErrorMsg, err error) {
+	var replayed *traceErrorMsg
+	if err != nil {
+		replayed = newTraceError(err)
+	}
+	switch {
+	case recorded == nil && replayed == nil:
+	case recorded == nil:
+		r.newErrors++
+		fmt.Fprintf(r.w, "entry %d (session %d): failed with %s, which the recorded run did not\n", n, s, replayed)
+	default:
+		r.recordedErrors++
+		outcome := "not reproduced"
+		if replayed != nil && replayed.Code == recorded.Code {
+			r.reproduced++
+			outcome = "reproduced"
+		}
+		fmt.Fprintf(r.w, "entry %d (session %d): recorded %s, replayed %s: %s\n", n, s, recorded, replayed, outcome)
+	}
+}
+
+// session returns the connection replaying session s, opening it on first use.
+func (r *replay) session(ctx context.Context, s int) (*pgx.Conn, error) {
+	if conn := r.sessions[s]; conn != nil {
+		return conn, nil
+	}
+	conn, err := pgx.ConnectConfig(ctx, r.config)
+	if err != nil {
+		return nil, fmt.Errorf("unable to connect to database: %w", err)
+	}
+	r.sessions[s] = conn
+	r.opened++
+	return conn, nil
+}
+
+func (r *replay) close(ctx context.Context) {
+	for _, conn := range r.sessions {
+		conn.Close(ctx)
+	}
+}
+
+// replayArgs are the parameters replay sends for args.
+func replayArgs(args []traceArg) ([]interface{}, error) {
+	values := make([]interface{}, len(args))
+	for i, a := range args {
+		v, err := a.value()
+		if err != nil {
+			return nil, fmt.Errorf("parameter $%d: %w", i+1, err)
+		}
+		values[i] = v
+	}
+	return values, nil
+}
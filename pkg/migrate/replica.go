@@ -0,0 +1,89 @@
+package migrate
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// replicaPollInterval is how often waitForReplica checks the replica's replay position.
+const replicaPollInterval = 500 * time.Millisecond
+
+// analysisConfig parses the --analyze-dsn connection string. Replicas usually share the
+// primary's credentials, so a DSN without a password, and without a PGPASSFILE entry, uses the
+// primary's password rather than appearing on the command line.
+func analysisConfig(dsn string, primary *pgx.ConnConfig) (*pgx.ConnConfig, error) {
+	config, err := pgx.ParseConfig(dsn)
+	if err != nil {
+		// pgconn redacts the password from parse errors.
+		return nil, fmt.Errorf("failed to parse --analyze-dsn: %w", err)
+	}
+	if config.Password == "" {
+		config.Password = primary.Password
+	}
+	return config, nil
+}
+
+// analysisConn returns a pooled --analyze-dsn connection with the timeouts of the current step,
+// opening the pool on first use. No migration lock is taken there: it only reads.
+func (m *migration) analysisConn(ctx context.Context) (*pgxpool.Conn, error) {
+	if m.analyzePool == nil {
+		pool, err := newConnPool(ctx, m.analyzeConfig, m.poolSettings, m.timeouts)
+		if err != nil {
+			return nil, fmt.Errorf("unable to connect to the analysis database: %w", err)
+		}
+		m.analyzePool = pool
+	}
+	return m.analyzePool.acquire(ctx, m.currentStep)
+}
+
+// waitForReplica blocks until the analysis database has replayed everything written on the
+// primary so far, so reads there see the result of the previous steps. A database that is not
+// in recovery, such as the primary itself, is always caught up.
+func (m *migration) waitForReplica(ctx context.Context, step string) error {
+	if m.analyzeConfig == nil {
+		return nil
+	}
+	var lsn string
+	err := m.retry(ctx, step, func(conn *pgx.Conn) error {
+		return conn.QueryRow(ctx, `SELECT pg_current_wal_lsn()::text`).Scan(&lsn)
+	})
+	if err != nil {
+		return fmt.Errorf("failed to read the primary's WAL position: %w", err)
+	}
+
+	start := time.Now()
+	lastLog := start
+	for {
+		var caughtUp bool
+		err := m.retryAnalysis(ctx, step, func(conn *pgx.Conn) error {
+			return conn.QueryRow(ctx, `
+			SELECT NOT pg_is_in_recovery() OR pg_last_wal_replay_lsn() >= $1::pg_lsn
+		`, lsn).Scan(&caughtUp)
+		})
+		if err != nil {
+			return fmt.Errorf("failed to read the replica's replay position: %w", err)
+		}
+		if caughtUp {
+			return nil
+		}
+		if time.Since(lastLog) >= progressInterval {
+			m.logger.Printf("%s: waiting for the analysis replica to replay up to %s (%s so far)\n", step, lsn, time.Since(start).Round(time.Second))
+			lastLog = time.Now()
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(replicaPollInterval):
+		}
+	}
+}
+
+func (m *migration) closeAnalysis() {
+	if m.analyzePool != nil {
+		m.analyzePool.close()
+	}
+}
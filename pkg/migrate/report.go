@@ -0,0 +1,186 @@
+package migrate
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Report is the machine-readable summary of a run written to --report-file.
+type Report struct {
+	StartedAt       time.Time `json:"started_at" yaml:"started_at"`
+	FinishedAt      time.Time `json:"finished_at" yaml:"finished_at"`
+	DurationSeconds float64   `json:"duration_seconds" yaml:"duration_seconds"`
+	Success         bool      `json:"success" yaml:"success"`
+	Outcome         string    `json:"outcome" yaml:"outcome"`
+	ExitCode        int       `json:"exit_code" yaml:"exit_code"`
+	Error           string    `json:"error,omitempty" yaml:"error,omitempty"`
+	Database        string    `json:"database,omitempty" yaml:"database,omitempty"`
+	// DatabaseFingerprint is the fingerprint --expect-db-fingerprint checks.
+	DatabaseFingerprint string   `json:"database_fingerprint,omitempty" yaml:"database_fingerprint,omitempty"`
+	Migrations          []string `json:"migrations" yaml:"migrations"`
+	// CompletedMigrations are those of Migrations whose every step completed, in this run or
+	// the one it resumes; a run failing in one of Migrations leaves those before it complete.
+	CompletedMigrations []string `json:"completed_migrations,omitempty" yaml:"completed_migrations,omitempty"`
+	IDScheme            string   `json:"id_scheme" yaml:"id_scheme"`
+	// GUACVersion is the installed GUAC version from --guac-version or --guac-endpoint.
+	GUACVersion string `json:"guac_version,omitempty" yaml:"guac_version,omitempty"`
+	// Filter is the subset of the dependencies the --filter flags restricted the run to.
+	Filter      string        `json:"filter,omitempty" yaml:"filter,omitempty"`
+	ToolVersion string        `json:"tool_version" yaml:"tool_version"`
+	Steps       []StepReport  `json:"steps" yaml:"steps"`
+	Collisions  []IDCollision `json:"collisions" yaml:"collisions"`
+	// Merged are the new IDs a row already had, with the old-scheme duplicates of it the
+	// rewrite merged into that row.
+	Merged         []IDCollision `json:"merged,omitempty" yaml:"merged,omitempty"`
+	UnresolvedRows int64         `json:"unresolved_rows" yaml:"unresolved_rows"`
+	// VersionRanges are the dependencies the backfill left because their version_range is a
+	// range rather than a version; they are part of UnresolvedRows.
+	VersionRanges int64         `json:"version_ranges,omitempty" yaml:"version_ranges,omitempty"`
+	Verification  *Verification `json:"verification,omitempty" yaml:"verification,omitempty"`
+	Estimates     []*Estimate   `json:"estimates,omitempty" yaml:"estimates,omitempty"`
+	// DiskHeadroom is the disk space the run was estimated to take, and the free space it was
+	// checked against.
+	DiskHeadroom     *DiskHeadroom `json:"disk_headroom,omitempty" yaml:"disk_headroom,omitempty"`
+	AuditMigrationID string        `json:"audit_migration_id,omitempty" yaml:"audit_migration_id,omitempty"`
+	// Quarantined are the rows --error-policy=quarantine left out of the run, recorded in the
+	// quarantine table with QuarantineMigrationID.
+	QuarantineMigrationID string        `json:"quarantine_migration_id,omitempty" yaml:"quarantine_migration_id,omitempty"`
+	Quarantined           []Quarantined `json:"quarantined,omitempty" yaml:"quarantined,omitempty"`
+	PausedSeconds         float64       `json:"paused_seconds,omitempty" yaml:"paused_seconds,omitempty"`
+	// UnsafeSpeedups are the settings --unsafe-speedups changed, and how each was restored.
+	UnsafeSpeedups []SpeedupChange `json:"unsafe_speedups,omitempty" yaml:"unsafe_speedups,omitempty"`
+	// Remaining is what a run stopped at its deadline left for the next run.
+	Remaining *Remaining `json:"remaining,omitempty" yaml:"remaining,omitempty"`
+
+	// batches are the batches the steps committed, for --report-html.
+	batches *batchLog
+}
+
+// StepReport records the outcome of a single step.
+type StepReport struct {
+	Name string `json:"name" yaml:"name"`
+	// Migration is the data migration the step belongs to, empty for the steps run once after
+	// all of them.
+	Migration       string  `json:"migration,omitempty" yaml:"migration,omitempty"`
+	Rows            int64   `json:"rows" yaml:"rows"`
+	DurationSeconds float64 `json:"duration_seconds" yaml:"duration_seconds"`
+	Error           string  `json:"error,omitempty" yaml:"error,omitempty"`
+	Skipped         bool    `json:"skipped,omitempty" yaml:"skipped,omitempty"`
+	// Server is what the step cost the database server, when its statistics could be read.
+	Server *ServerStats `json:"server,omitempty" yaml:"server,omitempty"`
+}
+
+// IDCollision is a new ID that more than one existing dependency row hashes to.
+type IDCollision struct {
+	NewID  string   `json:"new_id" yaml:"new_id"`
+	OldIDs []string `json:"old_ids" yaml:"old_ids"`
+}
+
+// Verification holds the results of the verify step.
+type Verification struct {
+	Passed             bool   `json:"passed" yaml:"passed"`
+	IDScheme           string `json:"id_scheme" yaml:"id_scheme"`
+	RowsChecked        int64  `json:"rows_checked" yaml:"rows_checked"`
+	IDMismatches       int64  `json:"id_mismatches" yaml:"id_mismatches"`
+	DanglingReferences int64  `json:"dangling_references" yaml:"dangling_references"`
+	UnresolvedRows     int64  `json:"unresolved_rows" yaml:"unresolved_rows"`
+	// Quarantined is the number of quarantined dependencies left out of the counts above.
+	Quarantined int64 `json:"quarantined,omitempty" yaml:"quarantined,omitempty"`
+}
+
+func newReport() *Report {
+	return &Report{StartedAt: time.Now().UTC(), ToolVersion: buildInfo().Version, Migrations: []string{}, Steps: []StepReport{}, Collisions: []IDCollision{}, batches: &batchLog{}}
+}
+
+func (r *Report) addStep(name string, rows int64, d time.Duration, err error) *StepReport {
+	s := StepReport{Name: name, Rows: rows, DurationSeconds: d.Seconds()}
+	if err != nil {
+		s.Error = err.Error()
+	}
+	r.Steps = append(r.Steps, s)
+	return &r.Steps[len(r.Steps)-1]
+}
+
+func (r *Report) skipStep(name string) *StepReport {
+	r.Steps = append(r.Steps, StepReport{Name: name, Skipped: true})
+	return &r.Steps[len(r.Steps)-1]
+}
+
+// finish records the end of the run and its final outcome. A database that was already
+// migrated is a success.
+func (r *Report) finish(err error) {
+	r.FinishedAt = time.Now().UTC()
+	r.DurationSeconds = r.FinishedAt.Sub(r.StartedAt).Seconds()
+	r.Outcome, r.ExitCode = outcome(err)
+	r.Success = err == nil || errors.Is(err, errAlreadyMigrated)
+	if !r.Success {
+		r.Error = err.Error()
+	}
+}
+
+// write writes the report of a run against a single database to --report-file and
+// --report-html, anonymized with --anonymize. Failing to write them only logs the error.
+func (r *Report) write(opts *options) {
+	if opts.reportFile == "" && opts.reportHTML == "" {
+		return
+	}
+	shared := r.anonymized(opts.anonymizer, &opts.filter)
+	if opts.reportFile != "" {
+		if err := shared.writeFile(opts.reportFile); err != nil {
+			log.Printf("Failed to write report: %v\n", err)
+		}
+	}
+	if opts.reportHTML != "" {
+		if err := shared.writeHTML(opts.reportHTML); err != nil {
+			log.Printf("Failed to write HTML report: %v\n", err)
+		}
+	}
+}
+
+// writeFile writes the report to path as YAML when the extension is .yaml or .yml and as
+// JSON otherwise.
+func (r *Report) writeFile(path string) error {
+	return writeReportFile(path, r)
+}
+
+func writeReportFile(path string, v interface{}) error {
+	var data []byte
+	var err error
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		data, err = yaml.Marshal(v)
+	default:
+		data, err = json.MarshalIndent(v, "", "  ")
+		data = append(data, '\n')
+	}
+	if err != nil {
+		return fmt.Errorf("failed to encode report: %w", err)
+	}
+	return os.WriteFile(path, data, 0o644)
+}
+
+// findCollisions returns every new ID that is shared by more than one row.
+func findCollisions(changes []idChange) []IDCollision {
+	byNewID := make(map[string][]string)
+	for _, c := range changes {
+		byNewID[c.newID.String()] = append(byNewID[c.newID.String()], c.oldID.String())
+	}
+
+	var collisions []IDCollision
+	for newID, oldIDs := range byNewID {
+		if len(oldIDs) > 1 {
+			collisions = append(collisions, IDCollision{NewID: newID, OldIDs: oldIDs})
+		}
+	}
+	sort.Slice(collisions, func(i, j int) bool { return collisions[i].NewID < collisions[j].NewID })
+	return collisions
+}
@@ -0,0 +1,221 @@
+package migrate
+
+import (
+	_ "embed"
+	"errors"
+	"fmt"
+	"html/template"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// reportTemplate renders --report-html: a single page with its styles and charts inline, so it
+// can be attached to a runbook or a ticket as it is.
+//
+//go:embed templates/report.html.tmpl
+var reportTemplate string
+
+var reportHTML = template.Must(template.New("report").Funcs(template.FuncMap{
+	"bytes":    formatBytes,
+	"add":      func(a, b int) int { return a + b },
+	"mul":      func(a, b int) int { return a * b },
+	"duration": func(s float64) time.Duration { return seconds(s).Round(time.Millisecond) },
+	"rate": func(rows int64, s float64) string {
+		if s <= 0 {
+			return ""
+		}
+		return fmt.Sprintf("%.0f", float64(rows)/s)
+	},
+}).Parse(reportTemplate))
+
+// The size of the charts of --report-html, in pixels, and how many intervals the throughput
+// of a step is averaged over.
+const (
+	chartWidth   = 640
+	chartHeight  = 160
+	chartBuckets = 40
+	barHeight    = 22
+	// maxHTMLCollisions is how many collisions the HTML report lists; the JSON report has all.
+	maxHTMLCollisions = 100
+)
+
+// batchLog records when the steps of a run committed their batches, for the throughput charts
+// of --report-html. Batches are committed from several goroutines at once with --workers.
+type batchLog struct {
+	mu     sync.Mutex
+	series []*stepSeries
+}
+
+// stepSeries are the batches of one run of a step.
+type stepSeries struct {
+	migration, step string
+	start           time.Time
+	batches         []batchSample
+}
+
+type batchSample struct {
+	at   time.Time
+	rows int64
+}
+
+// started begins the series of step.
+func (l *batchLog) started(migration, step string, at time.Time) {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.series = append(l.series, &stepSeries{migration: migration, step: step, start: at})
+}
+
+// committed adds a batch to the latest series of step, or to one of its own when step runs
+// within another, as stage-ids does within rewrite-ids.
+func (l *batchLog) committed(step string, rows int64, at time.Time) {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for i := len(l.series) - 1; i >= 0; i-- {
+		if s := l.series[i]; s.step == step {
+			s.batches = append(s.batches, batchSample{at: at, rows: rows})
+			return
+		}
+	}
+	l.series = append(l.series, &stepSeries{step: step, start: at, batches: []batchSample{{at: at, rows: rows}}})
+}
+
+// throughputCharts returns the charts of the series that committed batches, in the order the
+// steps started.
+func (l *batchLog) throughputCharts() []throughputChart {
+	if l == nil {
+		return nil
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	var charts []throughputChart
+	for _, s := range l.series {
+		if len(s.batches) > 0 {
+			charts = append(charts, s.chart())
+		}
+	}
+	return charts
+}
+
+// throughputChart is the rows per second a step committed over the time it ran.
+type throughputChart struct {
+	Migration, Step string
+	Rows            int64
+	Batches         int
+	Seconds         float64
+	MeanRate        float64
+	PeakRate        float64
+	// Points is the SVG polyline of the rate, averaged over chartBuckets intervals.
+	Points string
+}
+
+func (s *stepSeries) chart() throughputChart {
+	c := throughputChart{Migration: s.migration, Step: s.step, Batches: len(s.batches)}
+	end := s.start
+	for _, b := range s.batches {
+		c.Rows += b.rows
+		if b.at.After(end) {
+			end = b.at
+		}
+	}
+	span := end.Sub(s.start)
+	c.Seconds = span.Seconds()
+	if span <= 0 {
+		// All batches came at once, as the single statement of a set-based update does.
+		return c
+	}
+	c.MeanRate = float64(c.Rows) / c.Seconds
+	width := span / chartBuckets
+	rates := make([]float64, chartBuckets)
+	for _, b := range s.batches {
+		i := int(b.at.Sub(s.start) / width)
+		if i >= chartBuckets {
+			i = chartBuckets - 1
+		}
+		rates[i] += float64(b.rows) / width.Seconds()
+	}
+	for _, r := range rates {
+		c.PeakRate = max(c.PeakRate, r)
+	}
+	var points []string
+	for i, r := range rates {
+		y := chartHeight - r/c.PeakRate*chartHeight
+		points = append(points, fmt.Sprintf("%d,%.1f %d,%.1f", i*chartWidth/chartBuckets, y, (i+1)*chartWidth/chartBuckets, y))
+	}
+	c.Points = strings.Join(points, " ")
+	return c
+}
+
+// attentionBar is a count of rows the run could not migrate as they were.
+type attentionBar struct {
+	Label string
+	Count int64
+	// Y and Width place the bar in the chart.
+	Y, Width int
+}
+
+// attentionBars are the collisions, merged rows, unresolved rows and quarantined rows of r,
+// scaled to the widest.
+func (r *Report) attentionBars() []attentionBar {
+	bars := []attentionBar{
+		{Label: "collisions", Count: int64(len(r.Collisions))},
+		{Label: "merged", Count: int64(len(r.Merged))},
+		{Label: "unresolved rows", Count: r.UnresolvedRows},
+		{Label: "version ranges", Count: r.VersionRanges},
+		{Label: "quarantined", Count: int64(len(r.Quarantined))},
+	}
+	var most int64
+	for _, b := range bars {
+		most = max(most, b.Count)
+	}
+	for i := range bars {
+		bars[i].Y = i * barHeight
+		if most > 0 {
+			bars[i].Width = int(bars[i].Count * (chartWidth - 200) / most)
+		}
+	}
+	return bars
+}
+
+// htmlReport is what the template of --report-html renders.
+type htmlReport struct {
+	*Report
+	Charts    []throughputChart
+	Attention []attentionBar
+	// Listed are the first maxHTMLCollisions collisions, and MoreCollisions how many others
+	// there are.
+	Listed         []IDCollision
+	MoreCollisions int
+	ChartWidth     int
+	ChartHeight    int
+	BarHeight      int
+}
+
+// writeHTML writes r to path as the page of --report-html.
+func (r *Report) writeHTML(path string) error {
+	h := htmlReport{
+		Report:      r,
+		Charts:      r.batches.throughputCharts(),
+		Attention:   r.attentionBars(),
+		Listed:      r.Collisions,
+		ChartWidth:  chartWidth,
+		ChartHeight: chartHeight,
+		BarHeight:   barHeight,
+	}
+	if len(h.Listed) > maxHTMLCollisions {
+		h.Listed, h.MoreCollisions = h.Listed[:maxHTMLCollisions], len(h.Listed)-maxHTMLCollisions
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		return fmt.Errorf("failed to create HTML report: %w", err)
+	}
+	err = reportHTML.Execute(f, h)
+	return errors.Join(err, f.Close())
+}
@@ -0,0 +1,111 @@
+package migrate
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBatchLog(t *testing.T) {
+	start := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	l := &batchLog{}
+	l.started("dependency-version-ids", "backfill", start)
+	for i := 1; i <= 10; i++ {
+		l.committed("backfill", 100, start.Add(time.Duration(i)*time.Second))
+	}
+	l.started("dependency-version-ids", "rewrite-ids", start.Add(10*time.Second))
+	l.committed("stage-ids", 500, start.Add(11*time.Second))
+	l.started("dependency-version-ids", "verify", start.Add(12*time.Second))
+
+	charts := l.throughputCharts()
+	if len(charts) != 2 {
+		t.Fatalf("throughputCharts() = %+v, want backfill and stage-ids", charts)
+	}
+	backfill := charts[0]
+	if backfill.Step != "backfill" || backfill.Migration != "dependency-version-ids" || backfill.Rows != 1000 || backfill.Batches != 10 {
+		t.Errorf("backfill chart = %+v", backfill)
+	}
+	if backfill.Seconds != 10 || backfill.MeanRate != 100 || backfill.PeakRate == 0 {
+		t.Errorf("backfill rates = %v s, mean %v, peak %v", backfill.Seconds, backfill.MeanRate, backfill.PeakRate)
+	}
+	if n := len(strings.Fields(backfill.Points)); n != 2*chartBuckets {
+		t.Errorf("backfill chart has %d points, want %d", n, 2*chartBuckets)
+	}
+	// stage-ids committed once, at the moment its series began.
+	if stage := charts[1]; stage.Step != "stage-ids" || stage.Rows != 500 || stage.Points != "" {
+		t.Errorf("stage-ids chart = %+v", stage)
+	}
+
+	var none *batchLog
+	none.started("", "backfill", start)
+	none.committed("backfill", 1, start)
+	if got := none.throughputCharts(); got != nil {
+		t.Errorf("throughputCharts() of a nil log = %+v", got)
+	}
+}
+
+func TestAttentionBars(t *testing.T) {
+	r := newReport()
+	r.Collisions = []IDCollision{{NewID: "a"}, {NewID: "b"}}
+	r.UnresolvedRows = 4
+	bars := r.attentionBars()
+	want := map[string]int64{"collisions": 2, "merged": 0, "unresolved rows": 4, "version ranges": 0, "quarantined": 0}
+	if len(bars) != len(want) {
+		t.Fatalf("attentionBars() = %+v", bars)
+	}
+	for i, b := range bars {
+		if b.Count != want[b.Label] || b.Y != i*barHeight {
+			t.Errorf("bar %+v, want count %d at %d", b, want[b.Label], i*barHeight)
+		}
+	}
+	if bars[2].Width != chartWidth-200 || bars[0].Width != bars[2].Width/2 {
+		t.Errorf("bar widths %d and %d", bars[0].Width, bars[2].Width)
+	}
+	if bars := newReport().attentionBars(); bars[0].Width != 0 {
+		t.Errorf("attentionBars() of a clean run = %+v", bars)
+	}
+}
+
+func TestWriteHTML(t *testing.T) {
+	r := newReport()
+	r.Database = "guac"
+	r.Migrations = []string{"dependency-version-ids"}
+	start := time.Now()
+	r.batches.started("dependency-version-ids", "backfill", start)
+	r.batches.committed("backfill", 10, start.Add(time.Second))
+	r.batches.committed("backfill", 10, start.Add(2*time.Second))
+	r.addStep("backfill", 20, 2*time.Second, nil).Migration = "dependency-version-ids"
+	r.skipStep("rebuild-indexes")
+	r.addStep("rewrite-ids", 0, time.Second, errors.New(`duplicate key value violates unique constraint "<dependencies_pkey>"`))
+	r.Collisions = make([]IDCollision, maxHTMLCollisions+3)
+	r.finish(errors.New(r.Steps[2].Error))
+
+	path := filepath.Join(t.TempDir(), "report.html")
+	if err := r.writeHTML(path); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	page := string(data)
+	for _, want := range []string{
+		"<title>guac-update-db report: guac</title>",
+		`class="outcome failed"`,
+		"Rows per second of backfill",
+		"<polyline",
+		"skipped",
+		"&lt;dependencies_pkey&gt;",
+		"3 more collisions",
+	} {
+		if !strings.Contains(page, want) {
+			t.Errorf("HTML report does not contain %q", want)
+		}
+	}
+	if strings.Contains(page, "<dependencies_pkey>") {
+		t.Error("HTML report does not escape the error")
+	}
+}
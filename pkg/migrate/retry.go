@@ -0,0 +1,135 @@
+package migrate
+
+import (
+	"context"
+	"errors"
+	"io"
+	"math/rand"
+	"net"
+	"syscall"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// retryPolicy controls how transient database errors are retried.
+type retryPolicy struct {
+	// maxRetries is the number of times a failed operation is retried; 0 disables retries.
+	maxRetries     int
+	initialBackoff time.Duration
+	maxBackoff     time.Duration
+}
+
+// backoff returns how long to wait before retry number attempt (starting at 1): exponential
+// growth capped at maxBackoff, with the upper half jittered so concurrent clients spread out.
+func (p retryPolicy) backoff(attempt int) time.Duration {
+	d := p.initialBackoff << (attempt - 1)
+	if d <= 0 || d > p.maxBackoff {
+		d = p.maxBackoff
+	}
+	half := d / 2
+	return half + time.Duration(rand.Int63n(int64(half)+1))
+}
+
+// transientCodes are the SQLSTATEs worth retrying: the statement can succeed unchanged once
+// the conflicting session, the lock holder or the server itself has moved on.
+var transientCodes = map[string]bool{
+	"40001": true, // serialization_failure
+	"40003": true, // statement_completion_unknown, CockroachDB's ambiguous commit
+	"40P01": true, // deadlock_detected
+	"55P03": true, // lock_not_available (lock_timeout)
+	"53300": true, // too_many_connections
+	"57P01": true, // admin_shutdown
+	"57P02": true, // crash_shutdown
+	"57P03": true, // cannot_connect_now
+}
+
+// isDeadlock reports whether err is Postgres breaking a deadlock by aborting the statement.
+func isDeadlock(err error) bool {
+	var pgErr *pgconn.PgError
+	return errors.As(err, &pgErr) && pgErr.Code == "40P01"
+}
+
+// isTransient reports whether err is likely to go away if the operation is retried.
+func isTransient(err error) bool {
+	if err == nil || errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) {
+		// Class 08 covers every connection exception.
+		return transientCodes[pgErr.Code] || pgErr.Code[:2] == "08"
+	}
+
+	if pgconn.SafeToRetry(err) || pgconn.Timeout(err) {
+		return true
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return true
+	}
+	return errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.ECONNREFUSED) || errors.Is(err, syscall.EPIPE)
+}
+
+// retry runs fn on a pooled connection to the primary, retrying transient failures with
+// backoff. Every attempt takes a connection from the pool, which replaces lost connections;
+// the session holding the migration lock is re-established first if it was lost. fn must be
+// safe to run again after a failed attempt: every statement the migration issues is either
+// idempotent or runs in a single (implicit) transaction that is rolled back on failure.
+func (m *migration) retry(ctx context.Context, op string, fn func(conn *pgx.Conn) error) error {
+	return m.retryOn(ctx, op, m.config.Database, m.primaryConn, fn)
+}
+
+// retryAnalysis is retry for read-only statements, which run against the --analyze-dsn
+// connection when there is one.
+func (m *migration) retryAnalysis(ctx context.Context, op string, fn func(conn *pgx.Conn) error) error {
+	if m.analyzeConfig == nil {
+		return m.retry(ctx, op, fn)
+	}
+	return m.retryOn(ctx, op, m.analyzeConfig.Database, m.analysisConn, fn)
+}
+
+// retryOn is retry against the database of the connections acquire hands out. Every call is a
+// span, covering the statement or batch fn sends and its retries.
+func (m *migration) retryOn(ctx context.Context, op, database string, acquire func(ctx context.Context) (*pgxpool.Conn, error), fn func(conn *pgx.Conn) error) (err error) {
+	ctx, span := tracer.Start(ctx, op, trace.WithSpanKind(trace.SpanKindClient), trace.WithAttributes(dbAttributes(database)...))
+	defer func() { endSpan(span, err) }()
+	for attempt := 0; ; attempt++ {
+		conn, err := acquire(ctx)
+		var pid uint32
+		if err == nil {
+			pid = conn.Conn().PgConn().PID()
+			err = fn(conn.Conn())
+			conn.Release()
+		}
+		if err != nil {
+			m.recorder.failed(op, pid, err)
+		}
+		if err == nil || !isTransient(err) || attempt >= m.retryPolicy.maxRetries {
+			span.SetAttributes(attribute.Int("guac.retries", attempt))
+			return err
+		}
+
+		wait := m.retryPolicy.backoff(attempt + 1)
+		span.AddEvent("retry", trace.WithAttributes(attribute.String("error", err.Error()), attribute.Int64("guac.backoff_ms", wait.Milliseconds())))
+		if isDeadlock(err) {
+			metrics.deadlocked(m.target, op)
+			m.logger.Printf("%s: deadlock with another transaction, retrying in %s (attempt %d of %d): %v\n", op, wait.Round(time.Millisecond), attempt+1, m.retryPolicy.maxRetries, err)
+		} else {
+			m.logger.Printf("%s: transient error, retrying in %s (attempt %d of %d): %v\n", op, wait.Round(time.Millisecond), attempt+1, m.retryPolicy.maxRetries, err)
+		}
+		metrics.retried(m.target, op)
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(wait):
+		}
+	}
+}
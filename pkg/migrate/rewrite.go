@@ -0,0 +1,452 @@
+package migrate
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+	"github.com/pxp928/guac-update-db/pkg/keys"
+)
+
+// idRewrite declares a change in the way GUAC derives the IDs of one table: which columns make
+// up a row's canonical key, how the new ID is derived from them, and which columns of other
+// tables reference the row. rewriteSteps turns it into the steps that move every row to its
+// new ID and repoint the references, so a new breaking change to GUAC's IDs is a spec like
+// dependencyIDs, plus a golden-tested derivation in pkg/keys.
+type idRewrite struct {
+	// table is the table whose id column is rewritten, and singular names one of its rows in
+	// messages.
+	table    string
+	singular string
+	// keyColumns are the SQL expressions, on a row of table, whose text makes up the row's
+	// canonical key, in order. A row where one of them is NULL cannot be given a new ID and
+	// stops the rewrite.
+	keyColumns []string
+	// key derives the new ID of a row from the values of keyColumns, with the run's --id-scheme.
+	// keySQL is the same derivation as an SQL expression on the row aliased as row.
+	key    func(scheme *keys.Scheme, values []string) uuid.UUID
+	keySQL func(scheme *keys.Scheme, row string) string
+	// fill returns the PL/pgSQL filling in the key columns of the row NEW that an earlier step
+	// of m fills in, run by the trigger --online keeps the new IDs current with.
+	fill func(m *migration) string
+	// stagingTable holds the old to new IDs in --fast mode.
+	stagingTable string
+	// referencers are the columns of other tables holding IDs of table.
+	referencers []referencer
+	// plan computes the changes of an --emit-sql script, for a table whose key columns an
+	// earlier step fills in, as the backfill does for dependencies. When nil they are computed
+	// from the table as it is.
+	plan func(m *migration, ctx context.Context) ([]idChange, error)
+}
+
+// referencer is a column of another table holding IDs of the rewritten table.
+type referencer struct {
+	table  string
+	column string
+	// rowID is the column identifying a referencing row in the audit log.
+	rowID string
+	// constraint is the foreign key from column to the rewritten table, dropped while the IDs
+	// change, and onDelete its ON DELETE action.
+	constraint string
+	onDelete   string
+}
+
+// idChange is the old and new ID of a rewritten row.
+type idChange struct {
+	oldID uuid.UUID
+	newID uuid.UUID
+}
+
+// dependencyIDs is the rewrite of the dependency-version-ids migration: GUAC derives the ID of
+// a dependency from its package version, the version it depends on and its evidence fields.
+var dependencyIDs = &idRewrite{
+	table:      "dependencies",
+	singular:   "dependency",
+	keyColumns: keys.DependencyColumns(),
+	key: func(scheme *keys.Scheme, values []string) uuid.UUID {
+		return scheme.KeyOf(values)
+	},
+	keySQL: func(scheme *keys.Scheme, row string) string {
+		return scheme.KeySQL(row)
+	},
+	fill: func(m *migration) string {
+		return `  IF NEW.dependent_package_version_id IS NULL AND NEW.dependent_package_name_id IS NOT NULL THEN
+    SELECT pv.id INTO NEW.dependent_package_version_id FROM ` + m.schema.prefix() + `package_versions pv
+    WHERE pv.name_id = NEW.dependent_package_name_id AND ` + m.versionMatchSQL("NEW", "pv") + `
+    ORDER BY pv.id LIMIT 1;
+  END IF;
+`
+	},
+	stagingTable: dependencyIDStagingTable,
+	referencers: []referencer{{
+		table:      "bill_of_materials_included_dependencies",
+		column:     "dependency_id",
+		rowID:      "bill_of_materials_id",
+		constraint: dependencyFKName,
+		onDelete:   "CASCADE",
+	}},
+	plan: (*migration).plannedDependencyChanges,
+}
+
+// tables returns the rewritten table and the tables referencing it.
+func (r *idRewrite) tables() []string {
+	tables := []string{r.table}
+	for _, ref := range r.referencers {
+		tables = append(tables, ref.table)
+	}
+	return tables
+}
+
+// foreignKey is the default foreign key from ref to r, which add-constraints creates when no
+// dropped foreign key was recorded.
+func (ref referencer) foreignKey(r *idRewrite) foreignKey {
+	return foreignKey{
+		table:      ref.table,
+		column:     ref.column,
+		name:       ref.constraint,
+		definition: `FOREIGN KEY (` + ref.column + `) REFERENCES ` + r.table + `(id) ON DELETE ` + ref.onDelete,
+	}
+}
+
+// rewriteSteps are the steps rewriting the IDs of r. Instead of one UPDATE statement per row,
+// --fast bulk-loads the mapping with COPY and rewrites every table with a single set-based
+// UPDATE. The foreign keys are added back NOT VALID and validated by a step of their own. With
+// --defer-constraints they stay in place instead: rewrite-ids repoints the references in the
+// same transaction, and fix-refs is not a step of its own. --online rewrites through shadow
+// columns instead, as onlineSteps describes, and --no-ddl moves the rows in place, as
+// noDDLSteps does.
+func (m *migration) rewriteSteps(r *idRewrite) []step {
+	if m.online {
+		return m.onlineSteps(r)
+	}
+	if m.noDDL {
+		return m.noDDLSteps(r)
+	}
+	drop := step{name: "drop-constraints", run: func(ctx context.Context) (int64, error) { return m.dropConstraints(ctx, r) }, emit: func(ctx context.Context, w io.Writer) error { return m.emitDropConstraints(ctx, w, r) }}
+	restore := []step{
+		{name: "add-constraints", run: func(ctx context.Context) (int64, error) { return m.addConstraints(ctx, r) }, emit: func(ctx context.Context, w io.Writer) error { return m.emitAddConstraints(ctx, w, r) }},
+		{name: "validate-constraints", run: func(ctx context.Context) (int64, error) { return m.validateConstraints(ctx, r) }, emit: func(ctx context.Context, w io.Writer) error { return m.emitValidateConstraints(ctx, w, r) }},
+	}
+	if m.deferConstraints {
+		drop = step{name: "defer-constraints", run: func(ctx context.Context) (int64, error) { return m.deferForeignKeys(ctx, r) }, emit: func(ctx context.Context, w io.Writer) error { return m.emitDeferForeignKeys(ctx, w, r) }}
+		restore = []step{{name: "restore-constraints", run: m.restoreForeignKeys, emit: m.emitRestoreForeignKeys}}
+	}
+	if m.fast {
+		rewrite := []step{
+			{name: "rewrite-ids", run: func(ctx context.Context) (int64, error) { return m.rewriteStagedIDs(ctx, r) }, emit: emitStatement(m.stagedRewriteSQL(r))},
+			{name: "fix-refs", run: func(ctx context.Context) (int64, error) { return m.updateStagedReferences(ctx, r) }, emit: m.emitStagedReferences(r)},
+		}
+		if m.deferConstraints {
+			rewrite = []step{{name: "rewrite-ids", run: func(ctx context.Context) (int64, error) { return m.rewriteStagedDeferred(ctx, r) }, emit: m.emitStagedDeferred(r)}}
+		}
+		steps := []step{
+			drop,
+			{name: "stage-ids", run: func(ctx context.Context) (int64, error) { return m.stageIDs(ctx, r) }, emit: func(ctx context.Context, w io.Writer) error { return m.emitStageIDs(ctx, w, r) }},
+		}
+		steps = append(steps, rewrite...)
+		steps = append(steps, step{name: "drop-staging", run: func(ctx context.Context) (int64, error) { return m.dropStaging(ctx, r) }, emit: emitStatement(r.dropStagingSQL(m.schema))})
+		return append(steps, restore...)
+	}
+	if m.deferConstraints {
+		return append([]step{
+			drop,
+			{name: "rewrite-ids", run: func(ctx context.Context) (int64, error) { return m.rewriteDeferred(ctx, r) }, emit: m.emitDeferredRewrite(r)},
+		}, restore...)
+	}
+	return append([]step{
+		drop,
+		{name: "rewrite-ids", run: func(ctx context.Context) (int64, error) { return m.rewriteIDs(ctx, r) }, emit: func(ctx context.Context, w io.Writer) error { return m.emitPerRow(ctx, w, r, m.rewriteIDSQL(r)) }},
+		{name: "fix-refs", run: func(ctx context.Context) (int64, error) { return m.updateReferences(ctx, r) }, emit: m.emitUpdateReferences(r)},
+	}, restore...)
+}
+
+// computeNewIDs reads every row of r's table the --filter flags select and computes its new ID
+// into m.changes, failing if a row cannot be given one or two rows would end up with the same
+// ID. Rows whose new ID another row already has are merged into it first, see mergeDuplicates.
+// With --error-policy=quarantine a row that cannot be given one is quarantined and keeps its
+// ID.
+func (m *migration) computeNewIDs(ctx context.Context, step string, r *idRewrite) error {
+	if err := m.waitForReplica(ctx, step); err != nil {
+		return err
+	}
+	var skipped []Quarantined
+	err := m.retryAnalysis(ctx, step, func(conn *pgx.Conn) error {
+		m.changes.reset()
+		skipped = skipped[:0]
+		return scanKeys(ctx, conn, m.schema, r, m.filter, func(id uuid.UUID, values []*string) error {
+			text := make([]string, len(values))
+			for i, v := range values {
+				if v == nil {
+					err := fmt.Errorf("%s %s has no %s", r.singular, id, strings.TrimSuffix(r.keyColumns[i], "::text"))
+					if !m.quarantining() {
+						return err
+					}
+					skipped = append(skipped, Quarantined{Step: step, Table: r.table, ID: id.String(), Error: err.Error()})
+					return nil
+				}
+				text[i] = *v
+			}
+			return m.changes.add(idChange{oldID: id, newID: r.key(m.scheme, text)})
+		})
+	})
+	if err != nil {
+		return fmt.Errorf("failed to query %s: %w", r.table, err)
+	}
+	if err := m.quarantine(ctx, skipped); err != nil {
+		return err
+	}
+	if m.changes.spilled() {
+		m.logger.Printf("%s: the %d new IDs exceed --max-memory and were spilled to disk\n", step, m.changes.len())
+	}
+	// The rows are updated in the order of their IDs, which is the order an index scan locks
+	// them in, so a batch does not deadlock with another transaction updating them the same way.
+	collisions, err := m.changes.finish()
+	if err != nil {
+		return err
+	}
+	// Two rows that hash to the same new ID would violate the primary key and abort the
+	// whole rewrite, so report them up front instead, unless one of them already has it.
+	merges, collisions := splitMergeable(collisions)
+	if len(collisions) > 0 {
+		m.collisionsFound(r.table, collisions)
+		return fmt.Errorf("%d new IDs are shared by more than one existing %s row", len(collisions), r.singular)
+	}
+	if len(merges) > 0 {
+		if step == "emit-sql" {
+			return fmt.Errorf("%d %s rows already have the new ID of other rows; run the migration to merge them before generating the script", len(merges), r.singular)
+		}
+		if err := m.mergeDuplicates(ctx, step, r, merges); err != nil {
+			return err
+		}
+	}
+	m.idsComputed = true
+	return nil
+}
+
+// scanKeys streams the ID and the key column values of every row of r's table f selects to
+// visit. A NULL value is nil.
+func scanKeys(ctx context.Context, q queryer, schema dbSchema, r *idRewrite, f *rowFilter, visit func(id uuid.UUID, values []*string) error) error {
+	where, args := f.where("", 1)
+	rows, err := q.Query(ctx, `SELECT id, `+strings.Join(r.keyColumns, ", ")+` FROM `+schema.prefix()+r.table+` `+where, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var id uuid.UUID
+		values := make([]*string, len(r.keyColumns))
+		dest := []interface{}{&id}
+		for i := range values {
+			dest = append(dest, &values[i])
+		}
+		if err := rows.Scan(dest...); err != nil {
+			return fmt.Errorf("failed to scan row: %w", err)
+		}
+		if err := visit(id, values); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+// Step 2: Generate new UUIDs for the id field of the rewritten table
+func (m *migration) rewriteIDs(ctx context.Context, r *idRewrite) (int64, error) {
+	if err := m.computeNewIDs(ctx, "rewrite-ids", r); err != nil {
+		return 0, err
+	}
+
+	// The updates run as a single transaction, so a failed attempt leaves no partial rewrite
+	// behind and an attempt whose commit went unacknowledged matches no rows when it is
+	// repeated.
+	stmt := m.rewriteIDSQL(r)
+	err := m.sendPerRow(ctx, "rewrite-ids", r, func(batch *pgx.Batch, c idChange) {
+		batch.Queue(stmt, c.newID, c.oldID)
+	})
+	if err != nil {
+		return 0, fmt.Errorf("failed to update %s with new UUIDs: %w", r.table, err)
+	}
+	m.batchCommitted("rewrite-ids", int64(m.changes.len()))
+	return int64(m.changes.len()), nil
+}
+
+// rewriteDeferred moves every row of r's table to its new ID and repoints its references, in
+// one transaction that defers the foreign keys to its commit.
+func (m *migration) rewriteDeferred(ctx context.Context, r *idRewrite) (int64, error) {
+	if err := m.computeNewIDs(ctx, "rewrite-ids", r); err != nil {
+		return 0, err
+	}
+	stmts := m.deferredRewriteSQL(r)
+	err := m.sendPerRow(ctx, "rewrite-ids", r, func(batch *pgx.Batch, c idChange) {
+		for _, stmt := range stmts {
+			batch.Queue(stmt, c.newID, c.oldID)
+		}
+	})
+	if err != nil {
+		return 0, fmt.Errorf("failed to update %s and the related tables with new UUIDs: %w", r.table, err)
+	}
+	m.batchCommitted("rewrite-ids", int64(m.changes.len()))
+	return int64(m.changes.len()), nil
+}
+
+// deferredRewriteSQL are the statements rewriteDeferred runs for every changed ID.
+func (m *migration) deferredRewriteSQL(r *idRewrite) []string {
+	stmts := []string{m.rewriteIDSQL(r)}
+	for _, ref := range r.referencers {
+		stmts = append(stmts, m.updateReferenceSQL(ref))
+	}
+	return stmts
+}
+
+// emitDeferredRewrite writes the transaction of rewriteDeferred.
+func (m *migration) emitDeferredRewrite(r *idRewrite) func(ctx context.Context, w io.Writer) error {
+	return func(ctx context.Context, w io.Writer) error {
+		return m.emitPerRow(ctx, w, r, m.deferredRewriteSQL(r)...)
+	}
+}
+
+// sendPerRow sends the statements queue adds for every change in a single transaction. A plain
+// batch is an implicit transaction of its own; when throttled, the statements are sent
+// --chunk-size changes at a time inside an explicit one, with the throttle's waits between the
+// chunks. With --defer-constraints the transaction is always explicit, and defers the foreign
+// keys to its commit. Under --max-memory the statements are sent in chunks too, so they are
+// not all queued at once. With --error-policy=quarantine, sendQuarantining sends them.
+func (m *migration) sendPerRow(ctx context.Context, step string, r *idRewrite, queue func(batch *pgx.Batch, c idChange)) error {
+	if m.quarantining() {
+		return m.sendQuarantining(ctx, step, r, queue)
+	}
+	if !m.throttle.enabled() && !m.deferConstraints && m.changes.limit == 0 {
+		batch := &pgx.Batch{}
+		for _, c := range m.changes.mem {
+			queue(batch, c)
+		}
+		return m.retry(ctx, step, func(conn *pgx.Conn) error {
+			return sendBatch(ctx, conn, batch)
+		})
+	}
+	return m.retry(ctx, step, func(conn *pgx.Conn) error {
+		tx, err := conn.Begin(ctx)
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback(ctx)
+		if m.deferConstraints {
+			if _, err := tx.Exec(ctx, deferConstraintsSQL); err != nil {
+				return err
+			}
+		}
+		err = m.changes.chunks(m.chunkSize, func(chunk []idChange) error {
+			batch := &pgx.Batch{}
+			for _, c := range chunk {
+				queue(batch, c)
+			}
+			if err := sendBatch(ctx, tx, batch); err != nil {
+				return err
+			}
+			return m.throttle.wait(ctx, m.target, step, int64(len(chunk)))
+		})
+		if err != nil {
+			return err
+		}
+		return tx.Commit(ctx)
+	})
+}
+
+// rewriteIDSQL moves the row of r's table with ID $2 to ID $1.
+func (m *migration) rewriteIDSQL(r *idRewrite) string {
+	return m.audited("UPDATE "+m.schema.prefix()+r.table+" SET id = $1 WHERE id = $2",
+		"$2::uuid AS row_id, $2::uuid AS old_id, id AS new_id", r.table, "id")
+}
+
+// Step 3: Update the related tables to reference the new UUIDs
+func (m *migration) updateReferences(ctx context.Context, r *idRewrite) (int64, error) {
+	// Without --fast the mapping only exists in memory, so it cannot be recovered once the
+	// rows have their new IDs.
+	if !m.idsComputed {
+		return 0, fmt.Errorf("fix-refs needs the old to new ID mapping computed by rewrite-ids in the same run; with --fast the mapping is kept in the staging table and fix-refs can run on its own")
+	}
+	var stmts []string
+	for _, ref := range r.referencers {
+		stmts = append(stmts, m.updateReferenceSQL(ref))
+	}
+	err := m.sendPerRow(ctx, "fix-refs", r, func(batch *pgx.Batch, c idChange) {
+		for _, stmt := range stmts {
+			batch.Queue(stmt, c.newID, c.oldID)
+		}
+	})
+	if err != nil {
+		return 0, fmt.Errorf("failed to update related tables with new UUIDs: %w", err)
+	}
+	m.batchCommitted("fix-refs", int64(m.changes.len()))
+	return int64(m.changes.len()), nil
+}
+
+// updateReferenceSQL repoints the rows of ref from ID $2 to ID $1.
+func (m *migration) updateReferenceSQL(ref referencer) string {
+	return m.audited("UPDATE "+m.schema.prefix()+ref.table+" SET "+ref.column+" = $1 WHERE "+ref.column+" = $2",
+		ref.rowID+" AS row_id, $2::uuid AS old_id, "+ref.column+" AS new_id", ref.table, ref.column)
+}
+
+// emitPerReferencer writes the statement sql returns for every referencer of r.
+func (m *migration) emitPerReferencer(r *idRewrite, sql func(ref referencer) string) func(ctx context.Context, w io.Writer) error {
+	return func(ctx context.Context, w io.Writer) error {
+		for _, ref := range r.referencers {
+			if err := emitStatement(sql(ref))(ctx, w); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+// emitUpdateReferences writes one UPDATE per changed ID for every referencer, in a single
+// transaction each as fix-refs sends them.
+func (m *migration) emitUpdateReferences(r *idRewrite) func(ctx context.Context, w io.Writer) error {
+	return func(ctx context.Context, w io.Writer) error {
+		for _, ref := range r.referencers {
+			if err := m.emitPerRow(ctx, w, r, m.updateReferenceSQL(ref)); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+// plannedChanges returns the changes an --emit-sql script makes to r's table.
+func (m *migration) plannedChanges(ctx context.Context, r *idRewrite) ([]idChange, error) {
+	if r.plan != nil {
+		return r.plan(m, ctx)
+	}
+	if !m.idsComputed {
+		if err := m.computeNewIDs(ctx, "emit-sql", r); err != nil {
+			return nil, err
+		}
+	}
+	return m.changes.all()
+}
+
+// emitPerRow writes stmts, which take the new ID as $1 and the old one as $2, for every row of
+// r's table whose ID changes.
+func (m *migration) emitPerRow(ctx context.Context, w io.Writer, r *idRewrite, stmts ...string) error {
+	changes, err := m.plannedChanges(ctx, r)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(w, "BEGIN;\n")
+	if m.deferConstraints {
+		fmt.Fprintf(w, "%s;\n", deferConstraintsSQL)
+	}
+	for _, c := range changes {
+		if c.oldID != c.newID {
+			bind := strings.NewReplacer("$1", "'"+c.newID.String()+"'", "$2", "'"+c.oldID.String()+"'")
+			for _, stmt := range stmts {
+				fmt.Fprintf(w, "%s;\n", bind.Replace(stmt))
+			}
+		}
+	}
+	fmt.Fprintf(w, "COMMIT;\n")
+	return nil
+}
@@ -0,0 +1,52 @@
+package migrate
+
+import (
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/pxp928/guac-update-db/pkg/keys"
+)
+
+// The dependencies spec must keep producing the statements the migration has always run.
+func TestDependencyIDRewriteSQL(t *testing.T) {
+	m := &migration{}
+	ref := dependencyIDs.referencers[0]
+	for _, tc := range []struct{ got, want string }{
+		{ref.foreignKey(dependencyIDs).dropSQL(), `ALTER TABLE bill_of_materials_included_dependencies DROP CONSTRAINT "bill_of_materials_included_dependencies_dependency_id";`},
+		{ref.foreignKey(dependencyIDs).addSQL(), `ALTER TABLE bill_of_materials_included_dependencies ADD CONSTRAINT "bill_of_materials_included_dependencies_dependency_id" FOREIGN KEY (dependency_id) REFERENCES dependencies(id) ON DELETE CASCADE NOT VALID;`},
+		{m.rewriteIDSQL(dependencyIDs), `UPDATE public.dependencies SET id = $1 WHERE id = $2`},
+		{m.updateReferenceSQL(ref), `UPDATE public.bill_of_materials_included_dependencies SET dependency_id = $1 WHERE dependency_id = $2`},
+		{m.stagedRewriteSQL(dependencyIDs), "UPDATE public.dependencies d\nSET id = s.new_id\nFROM public.guac_dependency_id_staging s\nWHERE d.id = s.old_id"},
+		{m.stagedReferencesSQL(dependencyIDs, ref), "UPDATE public.bill_of_materials_included_dependencies b\nSET dependency_id = s.new_id\nFROM public.guac_dependency_id_staging s\nWHERE b.dependency_id = s.old_id"},
+	} {
+		if tc.got != tc.want {
+			t.Errorf("got %q, want %q", tc.got, tc.want)
+		}
+	}
+	if got, want := rewrittenTables, []string{"dependencies", "bill_of_materials_included_dependencies"}; len(got) != len(want) || got[0] != want[0] || got[1] != want[1] {
+		t.Errorf("rewrittenTables = %v, want %v", got, want)
+	}
+}
+
+// The key columns, read as text, must derive the same ID as the Dependency the other code
+// paths scan.
+func TestDependencyIDRewriteKey(t *testing.T) {
+	d := keys.Dependency{
+		PackageID:                 uuid.MustParse("6ba7b810-9dad-11d1-80b4-00c04fd430c8"),
+		DependentPackageVersionID: uuid.MustParse("6ba7b811-9dad-11d1-80b4-00c04fd430c8"),
+		DependencyType:            "DIRECT",
+		Justification:             "from the SBOM",
+		Origin:                    "file:///sbom.json",
+		Collector:                 "FileCollector",
+		DocumentRef:               "sha256:abc",
+	}
+	values := []string{d.PackageID.String(), d.DependentPackageVersionID.String(), d.DependencyType, d.Justification, d.Origin, d.Collector, d.DocumentRef}
+	if len(dependencyIDs.keyColumns) != len(values) {
+		t.Fatalf("dependencyIDs has %d key columns, want %d", len(dependencyIDs.keyColumns), len(values))
+	}
+	for _, scheme := range []*keys.Scheme{keys.GUACPR2060, keys.UpdateDBV1} {
+		if got, want := dependencyIDs.key(scheme, values), scheme.Key(d); got != want {
+			t.Errorf("%s: key() = %s, want %s", scheme.Name, got, want)
+		}
+	}
+}
@@ -0,0 +1,136 @@
+package migrate
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// Options configures a migration Run runs.
+type Options struct {
+	// Flags are the flags of the migrate command, as on its command line, such as
+	// {"--from", "v0.8.0", "--report-file", "report.json"}. --serve, --metrics-addr,
+	// --otlp-endpoint and --daemon, which serve or outlive the run, are not available, and
+	// --yes is implied: there is no terminal to ask for confirmation on.
+	Flags []string
+	// ConnConfig is the database to migrate. When nil, it is read from --dsn-file,
+	// --password-file and the PG* environment variables, as the migrate command does.
+	ConnConfig *pgx.ConnConfig
+	// Logger is where the run logs its progress; log.Default() when nil.
+	Logger *log.Logger
+}
+
+// Run runs a migration with opts in the calling process, until it is over or ctx is done, and
+// tells observer about the events of the run as they happen. It writes the files its flags ask
+// for, such as --report-file and --events-file, as the migrate command does. It returns nil
+// when the run succeeded, including a database that needed no migration, and otherwise the
+// error of the run: ErrSchemaMismatch, ErrIncompatibleGUAC, ErrVerificationFailed or
+// ErrDeadlineReached for errors.Is, a *PartialError for a run that left the database between
+// versions, or another error, such as for invalid flags. A run with --targets returns an error
+// naming the targets that failed once every target is over; observer is told about the
+// outcome of each.
+func Run(ctx context.Context, opts Options, observer Observer) error {
+	o, err := parseMigrateFlags(opts.Flags, flag.ContinueOnError)
+	if err != nil {
+		return err
+	}
+	if o.serveAddr != "" || o.metricsAddr != "" || o.otlpEndpoint != "" || o.daemon {
+		return errors.New("--serve, --metrics-addr, --otlp-endpoint and --daemon are only available to the migrate command")
+	}
+	if opts.ConnConfig != nil && (o.conn.dsnFile != "" || o.conn.passwordFile != "" || o.targetsFile != "") {
+		return errors.New("the connection settings of Options cannot be combined with --dsn-file, --password-file or --targets")
+	}
+	o.conn.base = opts.ConnConfig
+	o.yes = true
+	logger := opts.Logger
+	if logger == nil {
+		logger = log.Default()
+	}
+	if observer == nil {
+		observer = NopObserver{}
+	}
+
+	if err := removeCompletionFile(o.completionFile); err != nil {
+		return err
+	}
+	events, closeEvents, err := openEvents(o.eventsFile)
+	if err != nil {
+		return err
+	}
+	defer closeEvents()
+	o.observer = Observers(events, observer)
+	if o.anonymize {
+		if o.anonymizer, err = newAnonymizer(o.anonymizeKey); err != nil {
+			return err
+		}
+	}
+	if o.targetsFile != "" {
+		targets, err := loadTargets(o.targetsFile)
+		if err != nil {
+			return err
+		}
+		report, err := migrateTargets(ctx, o, targets, o.parallel, logger)
+		finishTargets(o, report, logger)
+		return err
+	}
+
+	report := newReport()
+	err = migrateDatabase(ctx, o, report, logger)
+	if werr := finishRun(o, report, err); werr != nil {
+		return werr
+	}
+	if errors.Is(err, errAlreadyMigrated) {
+		return nil
+	}
+	return err
+}
+
+// ReadJSONLines tells observer about every event NewJSONLines wrote to r, in order, until r
+// ends. Events of other kinds are skipped, so that readers keep working with files written by
+// newer releases.
+func ReadJSONLines(r io.Reader, observer Observer) error {
+	dec := json.NewDecoder(r)
+	for {
+		var line struct {
+			Event string          `json:"event"`
+			Data  json.RawMessage `json:"data"`
+		}
+		if err := dec.Decode(&line); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("failed to read event: %w", err)
+		}
+		var err error
+		switch line.Event {
+		case "step_start":
+			var e StepStart
+			if err = json.Unmarshal(line.Data, &e); err == nil {
+				observer.OnStepStart(e)
+			}
+		case "batch_complete":
+			var e Batch
+			if err = json.Unmarshal(line.Data, &e); err == nil {
+				observer.OnBatchComplete(e)
+			}
+		case "collision":
+			var e Collision
+			if err = json.Unmarshal(line.Data, &e); err == nil {
+				observer.OnCollision(e)
+			}
+		case "finish":
+			var e Result
+			if err = json.Unmarshal(line.Data, &e); err == nil {
+				observer.OnFinish(e)
+			}
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read %s event: %w", line.Event, err)
+		}
+	}
+}
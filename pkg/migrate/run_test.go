@@ -0,0 +1,55 @@
+package migrate
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/jackc/pgx/v5"
+)
+
+func TestRunRejectsFlags(t *testing.T) {
+	config, err := pgx.ParseConfig("postgres:///guac")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		name    string
+		opts    Options
+		wantErr string
+	}{
+		{"unknown", Options{Flags: []string{"--no-such-flag"}}, "flag provided but not defined: -no-such-flag"},
+		{"invalid", Options{Flags: []string{"--chunk-size", "0"}}, "--chunk-size must be positive"},
+		{"serve", Options{Flags: []string{"--serve", "localhost:8099"}}, "only available to the migrate command"},
+		{"daemon", Options{Flags: []string{"--daemon"}}, "only available to the migrate command"},
+		{"dsn-file", Options{Flags: []string{"--dsn-file", "dsn"}, ConnConfig: config}, "cannot be combined with --dsn-file"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			r := &recorder{}
+			err := Run(context.Background(), tc.opts, r)
+			if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+				t.Fatalf("Run() = %v, want an error containing %q", err, tc.wantErr)
+			}
+			if len(r.events) != 0 {
+				t.Errorf("observer got events %v before the run started", r.events)
+			}
+		})
+	}
+}
+
+func TestReadJSONLines(t *testing.T) {
+	input := `{"event":"step_start","data":{"database":"guac","step":"backfill","time":"2024-05-01T12:00:00Z"}}
+{"event":"progress","data":{"percent":50}}
+{"event":"finish","data":{"database":"guac","success":true,"outcome":"success","exit_code":0,"duration_seconds":1.5}}
+`
+	r := &recorder{}
+	if err := ReadJSONLines(strings.NewReader(input), r); err != nil {
+		t.Fatalf("ReadJSONLines() failed: %v", err)
+	}
+	if got, want := strings.Join(r.events, ","), "step_start backfill,finish success"; got != want {
+		t.Errorf("observer got events %s, want %s", got, want)
+	}
+	if err := ReadJSONLines(strings.NewReader(`{"event":"finish","data":{"exit_code":"five"}}`), r); err == nil {
+		t.Errorf("ReadJSONLines() of a malformed finish event succeeded")
+	}
+}
@@ -0,0 +1,214 @@
+package migrate
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+	"github.com/pxp928/guac-update-db/pkg/keys"
+)
+
+// sbomInclude is a join table of what a bill_of_materials row includes, and the column of the
+// included node.
+type sbomInclude struct {
+	table  string
+	column string
+}
+
+// sbomIncludes are GUAC's join tables referencing bill_of_materials. Their rows follow an SBOM
+// that fix-sbom-ids moves to a new ID.
+var sbomIncludes = []sbomInclude{
+	{table: "bill_of_materials_included_software_packages", column: "package_version_id"},
+	{table: "bill_of_materials_included_software_artifacts", column: "artifact_id"},
+	{table: "bill_of_materials_included_dependencies", column: "dependency_id"},
+	{table: "bill_of_materials_included_occurrences", column: "occurrence_id"},
+}
+
+// sbomTables returns bill_of_materials and the tables referencing it.
+func sbomTables() []string {
+	tables := []string{"bill_of_materials"}
+	for _, inc := range sbomIncludes {
+		tables = append(tables, inc.table)
+	}
+	return tables
+}
+
+// sbomCopiedColumns are the columns of bill_of_materials an SBOM keeps when it moves.
+var sbomCopiedColumns = []string{
+	"package_id", "artifact_id", "uri", "algorithm", "digest", "download_location", "origin", "collector", "document_ref", "known_since",
+	"included_packages_hash", "included_artifacts_hash", "included_occurrences_hash",
+}
+
+// sbomMove is an SBOM whose included_dependencies_hash, and with it its ID, changes.
+type sbomMove struct {
+	oldID uuid.UUID
+	newID uuid.UUID
+	hash  string
+}
+
+// fixSBOMIDs is the fix-sbom-ids step. GUAC stores in included_dependencies_hash a hash of the
+// IDs of the dependencies an SBOM includes, and derives the SBOM's ID from it, so both are stale
+// once the dependencies have new IDs: re-ingesting the SBOM would insert a second row rather
+// than find the first. Every SBOM whose hash no longer matches its dependencies is moved to the
+// ID GUAC derives from the new hash, with what it includes, and merged into the row already
+// there if there is one. SBOMs whose hash matches are left alone, so the step can run again.
+func (m *migration) fixSBOMIDs(ctx context.Context) (int64, error) {
+	var moves []sbomMove
+	err := m.retry(ctx, "fix-sbom-ids", func(conn *pgx.Conn) error {
+		var err error
+		moves, err = m.staleSBOMs(ctx, conn, nil)
+		return err
+	})
+	if err != nil {
+		return 0, fmt.Errorf("failed to query bill_of_materials: %w", err)
+	}
+	if len(moves) == 0 {
+		return 0, nil
+	}
+	stmts := m.moveSBOMSQL()
+	err = m.retry(ctx, "fix-sbom-ids", func(conn *pgx.Conn) error {
+		batch := &pgx.Batch{}
+		for _, mv := range moves {
+			batch.Queue(stmts[0], mv.newID, mv.oldID, mv.hash)
+			for _, stmt := range stmts[1:] {
+				batch.Queue(stmt, mv.newID, mv.oldID)
+			}
+		}
+		return sendBatch(ctx, conn, batch)
+	})
+	if err != nil {
+		return 0, fmt.Errorf("failed to move bill_of_materials to the IDs of their new dependency hashes: %w", err)
+	}
+	m.batchCommitted("fix-sbom-ids", int64(len(moves)))
+	return int64(len(moves)), nil
+}
+
+// staleSBOMs returns the SBOMs whose included_dependencies_hash is not the hash of the IDs of
+// the dependencies they include, with the ID and hash GUAC derives for them. newID, when not
+// nil, maps the ID of an included dependency to the one it will have, for --emit-sql.
+func (m *migration) staleSBOMs(ctx context.Context, q queryer, newID func(id string) string) ([]sbomMove, error) {
+	var moves []sbomMove
+	var unreproducible int
+	err := scanSBOMs(ctx, q, m.schema, func(id uuid.UUID, b keys.BillOfMaterials, dependencies []string) error {
+		if newID != nil {
+			for i, dep := range dependencies {
+				dependencies[i] = newID(dep)
+			}
+		}
+		hash := keys.IncludedHash(dependencyIDs.table, dependencies)
+		if hash == b.IncludedDependenciesHash {
+			return nil
+		}
+		if b.Key() != id {
+			unreproducible++
+		}
+		b.IncludedDependenciesHash = hash
+		moves = append(moves, sbomMove{oldID: id, newID: b.Key(), hash: hash})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if unreproducible > 0 {
+		// GUAC derives the ID from the SBOM as ingested, before it lowercases the algorithm
+		// and digest and Postgres rounds known_since to microseconds.
+		m.logger.Printf("fix-sbom-ids: %d SBOMs have an ID GUAC does not derive from their columns as stored; they are moved to the one it derives from them\n", unreproducible)
+	}
+	return moves, nil
+}
+
+// scanSBOMs streams the ID, the columns GUAC derives the ID from and the IDs of the included
+// dependencies of every SBOM including dependencies to visit, in the order of their IDs.
+func scanSBOMs(ctx context.Context, q queryer, schema dbSchema, visit func(id uuid.UUID, b keys.BillOfMaterials, dependencies []string) error) error {
+	rows, err := q.Query(ctx, `SELECT b.id, coalesce(b.package_id, b.artifact_id), b.included_packages_hash, b.included_artifacts_hash, b.included_dependencies_hash,
+  b.included_occurrences_hash, b.uri, b.algorithm, b.digest, b.download_location, b.origin, b.collector, b.known_since, b.document_ref,
+  array_agg(i.dependency_id::text)
+FROM `+schema.prefix()+`bill_of_materials b
+JOIN `+schema.prefix()+`bill_of_materials_included_dependencies i ON i.bill_of_materials_id = b.id
+GROUP BY b.id
+ORDER BY b.id`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var id uuid.UUID
+		var subject uuid.NullUUID
+		var b keys.BillOfMaterials
+		var dependencies []string
+		err := rows.Scan(&id, &subject, &b.IncludedPackagesHash, &b.IncludedArtifactsHash, &b.IncludedDependenciesHash, &b.IncludedOccurrencesHash,
+			&b.URI, &b.Algorithm, &b.Digest, &b.DownloadLocation, &b.Origin, &b.Collector, &b.KnownSince, &b.DocumentRef, &dependencies)
+		if err != nil {
+			return fmt.Errorf("failed to scan row: %w", err)
+		}
+		if !subject.Valid {
+			return fmt.Errorf("SBOM %s has neither a package_id nor an artifact_id", id)
+		}
+		b.SubjectID = subject.UUID
+		if err := visit(id, b, dependencies); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+// moveSBOMSQL are the statements moving the SBOM with ID $2 to ID $1. The first one takes the
+// new included_dependencies_hash as $3 and inserts the moved row, unless a row with its new ID
+// or columns is there already; the others copy what it includes, then delete it, which deletes
+// its old join rows by their ON DELETE CASCADE. Only a row on ID $1 is moved into: one with the
+// same columns under another ID leaves the SBOM where it is. An audited run records the move as
+// a change to bill_of_materials.id.
+func (m *migration) moveSBOMSQL() []string {
+	bom := m.schema.prefix() + "bill_of_materials"
+	columns := strings.Join(sbomCopiedColumns, ", ")
+	stmts := []string{`INSERT INTO ` + bom + ` (id, ` + columns + `, included_dependencies_hash)
+SELECT $1::uuid, ` + columns + `, $3::text FROM ` + bom + ` WHERE id = $2
+ON CONFLICT DO NOTHING`}
+	for _, inc := range sbomIncludes {
+		stmts = append(stmts, fmt.Sprintf(`INSERT INTO %[1]s (bill_of_materials_id, %[2]s)
+SELECT $1::uuid, %[2]s FROM %[1]s WHERE bill_of_materials_id = $2 AND EXISTS (SELECT 1 FROM %[3]s WHERE id = $1)
+ON CONFLICT DO NOTHING`, m.schema.prefix()+inc.table, inc.column, bom))
+	}
+	return append(stmts, m.audited(`DELETE FROM `+bom+` WHERE id = $2 AND EXISTS (SELECT 1 FROM `+bom+` WHERE id = $1)`,
+		"$2::uuid AS row_id, $2::uuid AS old_id, $1::uuid AS new_id", "bill_of_materials", "id"))
+}
+
+// emitFixSBOMIDs writes the statements fixSBOMIDs runs, for the hashes the dependencies have once
+// the rewrite before it gave them their new IDs.
+func (m *migration) emitFixSBOMIDs(ctx context.Context, w io.Writer) error {
+	changes, err := m.plannedChanges(ctx, dependencyIDs)
+	if err != nil {
+		return err
+	}
+	newIDs := make(map[string]string, len(changes))
+	for _, c := range changes {
+		newIDs[c.oldID.String()] = c.newID.String()
+	}
+	var moves []sbomMove
+	err = m.retry(ctx, "emit-sql", func(conn *pgx.Conn) error {
+		var err error
+		moves, err = m.staleSBOMs(ctx, conn, func(id string) string {
+			if newID, ok := newIDs[id]; ok {
+				return newID
+			}
+			return id
+		})
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("failed to query bill_of_materials: %w", err)
+	}
+	fmt.Fprintf(w, "BEGIN;\n")
+	for _, mv := range moves {
+		bind := strings.NewReplacer("$1", "'"+mv.newID.String()+"'", "$2", "'"+mv.oldID.String()+"'", "$3", "'"+mv.hash+"'")
+		for _, stmt := range m.moveSBOMSQL() {
+			fmt.Fprintf(w, "%s;\n", bind.Replace(stmt))
+		}
+	}
+	fmt.Fprintf(w, "COMMIT;\n")
+	return nil
+}
@@ -0,0 +1,418 @@
+package migrate
+
+import (
+	"context"
+	"embed"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// schemaFS holds the expected schema of the tables this tool touches for each GUAC release line.
+//
+//go:embed schemas/*.json
+var schemaFS embed.FS
+
+// schemaSnapshot is the expected shape of the relevant GUAC ENT tables for one release line.
+// Tables GUAC has that this tool never touches are deliberately not part of the snapshot.
+type schemaSnapshot struct {
+	Version     string                    `json:"version"`
+	Description string                    `json:"description"`
+	Tables      map[string][]schemaColumn `json:"tables"`
+}
+
+type schemaColumn struct {
+	Name string `json:"name"`
+	Type string `json:"type"`
+}
+
+// dataMigration is a data migration GUAC needs when moving between two schema versions, in
+// addition to the DDL Atlas applies.
+type dataMigration struct {
+	Name        string `json:"name"`
+	From        string `json:"from"`
+	To          string `json:"to"`
+	PRs         []int  `json:"prs"`
+	Description string `json:"description"`
+	// Requires are the data migrations that must have run before this one, when both are
+	// pending; orderMigrations puts them first.
+	Requires []string `json:"requires,omitempty"`
+	// steps returns the steps running the migration.
+	steps func(m *migration) []step
+	// estimate measures the migration on a sample of fraction of its rows for --estimate.
+	estimate func(m *migration, ctx context.Context, fraction float64) (*Estimate, error)
+}
+
+// dataMigrations lists every data migration this tool knows how to run, oldest first.
+var dataMigrations = []dataMigration{
+	{
+		Name:        "dependency-version-ids",
+		From:        "v0.8",
+		To:          "v0.9",
+		PRs:         []int{2021, 2060},
+		Description: "backfill dependencies.dependent_package_version_id and rewrite dependency IDs to the new deterministic key",
+		steps:       (*migration).dependencyVersionIDSteps,
+		estimate:    (*migration).estimateDependencyVersionIDs,
+	},
+}
+
+// loadSnapshots returns the embedded schema snapshots, oldest first.
+func loadSnapshots() ([]*schemaSnapshot, error) {
+	files, err := schemaFS.ReadDir("schemas")
+	if err != nil {
+		return nil, err
+	}
+	var snapshots []*schemaSnapshot
+	for _, f := range files {
+		data, err := schemaFS.ReadFile(path.Join("schemas", f.Name()))
+		if err != nil {
+			return nil, err
+		}
+		s := &schemaSnapshot{}
+		if err := json.Unmarshal(data, s); err != nil {
+			return nil, fmt.Errorf("invalid embedded schema %s: %w", f.Name(), err)
+		}
+		snapshots = append(snapshots, s)
+	}
+	sort.Slice(snapshots, func(i, j int) bool { return compareVersions(snapshots[i].Version, snapshots[j].Version) < 0 })
+	return snapshots, nil
+}
+
+// compareVersions compares GUAC release versions such as v0.8 or v0.9.1 numerically.
+func compareVersions(a, b string) int {
+	pa, pb := versionParts(a), versionParts(b)
+	for i := 0; i < len(pa) || i < len(pb); i++ {
+		var x, y int
+		if i < len(pa) {
+			x = pa[i]
+		}
+		if i < len(pb) {
+			y = pb[i]
+		}
+		if x != y {
+			if x < y {
+				return -1
+			}
+			return 1
+		}
+	}
+	return 0
+}
+
+func versionParts(v string) []int {
+	v = strings.TrimPrefix(v, "v")
+	if i := strings.IndexAny(v, "-+"); i >= 0 {
+		v = v[:i]
+	}
+	var parts []int
+	for _, p := range strings.Split(v, ".") {
+		n, _ := strconv.Atoi(p)
+		parts = append(parts, n)
+	}
+	return parts
+}
+
+// liveSchema maps table name to column name to data type for the tables that exist.
+type liveSchema map[string]map[string]string
+
+// introspectSchema reads the columns of tables from information_schema.
+func introspectSchema(ctx context.Context, conn *pgx.Conn, schema dbSchema, tables []string) (liveSchema, error) {
+	rows, err := conn.Query(ctx, `
+		SELECT table_name, column_name, data_type
+		FROM information_schema.columns
+		WHERE table_schema = $2 AND table_name = ANY($1)
+	`, tables, schema.name())
+	if err != nil {
+		return nil, fmt.Errorf("failed to read information_schema.columns: %w", err)
+	}
+	defer rows.Close()
+
+	live := make(liveSchema)
+	for rows.Next() {
+		var table, column, dataType string
+		if err := rows.Scan(&table, &column, &dataType); err != nil {
+			return nil, fmt.Errorf("failed to scan information_schema.columns: %w", err)
+		}
+		if live[table] == nil {
+			live[table] = make(map[string]string)
+		}
+		live[table][column] = dataType
+	}
+	return live, rows.Err()
+}
+
+// schemaDifference is one way the live schema differs from a snapshot.
+type schemaDifference struct {
+	Table    string `json:"table"`
+	Column   string `json:"column,omitempty"`
+	Kind     string `json:"kind"`
+	Expected string `json:"expected,omitempty"`
+	Actual   string `json:"actual,omitempty"`
+}
+
+func (d schemaDifference) String() string {
+	switch d.Kind {
+	case "missing-table":
+		return fmt.Sprintf("table %s is missing", d.Table)
+	case "missing-column":
+		return fmt.Sprintf("column %s.%s (%s) is missing", d.Table, d.Column, d.Expected)
+	case "extra-column":
+		return fmt.Sprintf("column %s.%s (%s) is not expected", d.Table, d.Column, d.Actual)
+	default:
+		return fmt.Sprintf("column %s.%s is %s, expected %s", d.Table, d.Column, d.Actual, d.Expected)
+	}
+}
+
+// diffSchema compares the live schema against a snapshot.
+func diffSchema(expected *schemaSnapshot, live liveSchema) []schemaDifference {
+	var diffs []schemaDifference
+	for table, columns := range expected.Tables {
+		liveColumns, ok := live[table]
+		if !ok {
+			diffs = append(diffs, schemaDifference{Table: table, Kind: "missing-table"})
+			continue
+		}
+		want := make(map[string]bool)
+		for _, c := range columns {
+			want[c.Name] = true
+			actual, ok := liveColumns[c.Name]
+			switch {
+			case !ok:
+				diffs = append(diffs, schemaDifference{Table: table, Column: c.Name, Kind: "missing-column", Expected: c.Type})
+			case actual != c.Type:
+				diffs = append(diffs, schemaDifference{Table: table, Column: c.Name, Kind: "type-mismatch", Expected: c.Type, Actual: actual})
+			}
+		}
+		for column, actual := range liveColumns {
+			if !want[column] {
+				diffs = append(diffs, schemaDifference{Table: table, Column: column, Kind: "extra-column", Actual: actual})
+			}
+		}
+	}
+	sort.Slice(diffs, func(i, j int) bool {
+		if diffs[i].Table != diffs[j].Table {
+			return diffs[i].Table < diffs[j].Table
+		}
+		return diffs[i].Column < diffs[j].Column
+	})
+	return diffs
+}
+
+// schemaMatch is the comparison of the live schema against one snapshot.
+type schemaMatch struct {
+	Version     string             `json:"version"`
+	Description string             `json:"description"`
+	Differences []schemaDifference `json:"differences"`
+}
+
+// schemaDiffResult is the output of the schema-diff subcommand.
+type schemaDiffResult struct {
+	Fingerprint       string          `json:"fingerprint"`
+	Closest           string          `json:"closest"`
+	Exact             bool            `json:"exact"`
+	Matches           []schemaMatch   `json:"matches"`
+	PendingMigrations []dataMigration `json:"pending_migrations"`
+}
+
+// closestSchema compares the live database against every snapshot and picks the release line
+// with the fewest differences; ties go to the newer release.
+func closestSchema(ctx context.Context, conn *pgx.Conn, schema dbSchema) (*schemaDiffResult, error) {
+	snapshots, err := loadSnapshots()
+	if err != nil {
+		return nil, err
+	}
+	tableSet := make(map[string]bool)
+	for _, s := range snapshots {
+		for table := range s.Tables {
+			tableSet[table] = true
+		}
+	}
+	var tables []string
+	for table := range tableSet {
+		tables = append(tables, table)
+	}
+	live, err := introspectSchema(ctx, conn, schema, tables)
+	if err != nil {
+		return nil, err
+	}
+
+	result := &schemaDiffResult{PendingMigrations: []dataMigration{}}
+	best := -1
+	for i, s := range snapshots {
+		diffs := diffSchema(s, live)
+		if diffs == nil {
+			diffs = []schemaDifference{}
+		}
+		result.Matches = append(result.Matches, schemaMatch{Version: s.Version, Description: s.Description, Differences: diffs})
+		if best < 0 || len(diffs) <= len(result.Matches[best].Differences) {
+			best = i
+		}
+	}
+	if best < 0 {
+		return nil, fmt.Errorf("no embedded schema snapshots")
+	}
+	result.Closest = result.Matches[best].Version
+	result.Exact = len(result.Matches[best].Differences) == 0
+	pending, err := migrationsBetween(result.Closest, latestVersion)
+	if err != nil {
+		return nil, err
+	}
+	if pending != nil {
+		result.PendingMigrations = pending
+	}
+	return result, nil
+}
+
+// latestVersion selects the newest release line in migrationsBetween.
+const latestVersion = "latest"
+
+// migrationsBetween returns, in the order they run, the data migrations a database at GUAC
+// version from needs to reach version to: those whose target release is newer than from but not
+// newer than to.
+func migrationsBetween(from, to string) ([]dataMigration, error) {
+	var pending []dataMigration
+	for _, m := range dataMigrations {
+		if compareVersions(from, m.To) < 0 && (to == latestVersion || compareVersions(m.To, to) <= 0) {
+			pending = append(pending, m)
+		}
+	}
+	return orderMigrations(pending)
+}
+
+// orderMigrations returns migrations in the order they can run: each after the ones among them
+// it requires, and otherwise in the order of dataMigrations. A required migration that is not
+// among them is one the database is past already.
+func orderMigrations(migrations []dataMigration) ([]dataMigration, error) {
+	known := make(map[string]bool)
+	for _, dm := range dataMigrations {
+		known[dm.Name] = true
+	}
+	pending := make(map[string]bool)
+	for _, dm := range migrations {
+		pending[dm.Name] = true
+	}
+	for _, dm := range migrations {
+		for _, req := range dm.Requires {
+			if !known[req] {
+				return nil, fmt.Errorf("data migration %s requires %s, which is not a known data migration", dm.Name, req)
+			}
+		}
+	}
+	ready := func(dm dataMigration, done map[string]bool) bool {
+		for _, req := range dm.Requires {
+			if pending[req] && !done[req] {
+				return false
+			}
+		}
+		return true
+	}
+	var ordered []dataMigration
+	done := make(map[string]bool)
+	for len(ordered) < len(migrations) {
+		next := -1
+		for i, dm := range migrations {
+			if !done[dm.Name] && ready(dm, done) {
+				next = i
+				break
+			}
+		}
+		if next < 0 {
+			var left []string
+			for _, dm := range migrations {
+				if !done[dm.Name] {
+					left = append(left, dm.Name)
+				}
+			}
+			return nil, fmt.Errorf("the data migrations %s require each other", strings.Join(left, ", "))
+		}
+		ordered = append(ordered, migrations[next])
+		done[migrations[next].Name] = true
+	}
+	return ordered, nil
+}
+
+func (r *schemaDiffResult) print(w io.Writer) {
+	if r.Fingerprint != "" {
+		fmt.Fprintf(w, "Database fingerprint: %s (for migrate --expect-db-fingerprint)\n\n", r.Fingerprint)
+	}
+	for _, m := range r.Matches {
+		fmt.Fprintf(w, "%s: %d differences (%s)\n", m.Version, len(m.Differences), m.Description)
+	}
+	fmt.Fprintln(w)
+	if r.Exact {
+		fmt.Fprintf(w, "The database matches the GUAC %s schema.\n", r.Closest)
+	} else {
+		fmt.Fprintf(w, "The database is closest to the GUAC %s schema, with differences:\n", r.Closest)
+		for _, m := range r.Matches {
+			if m.Version != r.Closest {
+				continue
+			}
+			for _, d := range m.Differences {
+				fmt.Fprintf(w, "  - %s\n", d)
+			}
+		}
+	}
+
+	if len(r.PendingMigrations) == 0 {
+		fmt.Fprintln(w, "No data migrations are needed; run Atlas as usual.")
+		return
+	}
+	fmt.Fprintln(w, "Data migrations to run with \"guac-update-db migrate\" before Atlas:")
+	for _, m := range r.PendingMigrations {
+		fmt.Fprintf(w, "  - %s (%s -> %s, GUAC PRs %v): %s\n", m.Name, m.From, m.To, m.PRs, m.Description)
+	}
+}
+
+func runSchemaDiff(args []string) {
+	var conn connFlags
+	fs := flag.NewFlagSet("schema-diff", flag.ExitOnError)
+	conn.register(fs)
+	format := fs.String("format", "text", "output `format`: text or json")
+	fs.Parse(args)
+
+	if err := schemaDiff(&conn, *format, os.Stdout); err != nil {
+		log.Fatalf("%v\n", err)
+	}
+}
+
+func schemaDiff(cf *connFlags, format string, w io.Writer) error {
+	if format != "text" && format != "json" {
+		return fmt.Errorf("invalid --format %q: must be text or json", format)
+	}
+	ctx := context.Background()
+	config, err := cf.config()
+	if err != nil {
+		return err
+	}
+	conn, err := pgx.ConnectConfig(ctx, config)
+	if err != nil {
+		return fmt.Errorf("unable to connect to database: %w", err)
+	}
+	defer conn.Close(ctx)
+
+	result, err := closestSchema(ctx, conn, cf.schema)
+	if err != nil {
+		return err
+	}
+	id, err := identifyDatabase(ctx, conn, cf.schema)
+	if err != nil {
+		return err
+	}
+	result.Fingerprint = id.Fingerprint
+	if format == "json" {
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(result)
+	}
+	result.print(w)
+	return nil
+}
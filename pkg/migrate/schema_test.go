@@ -0,0 +1,62 @@
+package migrate
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestOrderMigrations(t *testing.T) {
+	registered := dataMigrations
+	t.Cleanup(func() { dataMigrations = registered })
+	dataMigrations = []dataMigration{
+		{Name: "a", From: "v0.8", To: "v0.9"},
+		{Name: "c", From: "v0.9", To: "v0.10", Requires: []string{"b"}},
+		{Name: "b", From: "v0.9", To: "v0.10", Requires: []string{"a"}},
+		{Name: "d", From: "v0.10", To: "v0.11", Requires: []string{"a"}},
+	}
+	names := func(ms []dataMigration) []string {
+		var n []string
+		for _, m := range ms {
+			n = append(n, m.Name)
+		}
+		return n
+	}
+	for _, tc := range []struct {
+		from, to string
+		want     []string
+	}{
+		{"v0.8", latestVersion, []string{"a", "b", "c", "d"}},
+		{"v0.8", "v0.10", []string{"a", "b", "c"}},
+		// a ran already: the database is past it.
+		{"v0.9", latestVersion, []string{"b", "c", "d"}},
+		{"v0.10", latestVersion, []string{"d"}},
+	} {
+		got, err := migrationsBetween(tc.from, tc.to)
+		if err != nil {
+			t.Fatalf("migrationsBetween(%s, %s) failed: %v", tc.from, tc.to, err)
+		}
+		if !reflect.DeepEqual(names(got), tc.want) {
+			t.Errorf("migrationsBetween(%s, %s) = %v, want %v", tc.from, tc.to, names(got), tc.want)
+		}
+	}
+
+	dataMigrations[0].Requires = []string{"c"}
+	if got, err := migrationsBetween("v0.8", latestVersion); err == nil {
+		t.Errorf("migrationsBetween() with a cycle = %v, want an error", names(got))
+	}
+	dataMigrations[0].Requires = []string{"z"}
+	if got, err := migrationsBetween("v0.8", latestVersion); err == nil {
+		t.Errorf("migrationsBetween() requiring an unknown migration = %v, want an error", names(got))
+	}
+}
+
+// Every registered data migration can be ordered.
+func TestDataMigrationsOrder(t *testing.T) {
+	ordered, err := orderMigrations(dataMigrations)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ordered) != len(dataMigrations) {
+		t.Errorf("orderMigrations() returned %d of %d migrations", len(ordered), len(dataMigrations))
+	}
+}
@@ -0,0 +1,278 @@
+package migrate
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+// ServerStats is what a step cost the database server, from the differences in its statistics
+// views between the start and the end of the step. Before Postgres 15 a session publishes its
+// statistics at most every half second, so they can trail the step slightly.
+type ServerStats struct {
+	Tables []TableStats `json:"tables" yaml:"tables"`
+	// WALBytes is the WAL the whole cluster wrote during the step, by the migration and by any
+	// other session. It is missing when the server is a standby.
+	WALBytes *int64 `json:"wal_bytes,omitempty" yaml:"wal_bytes,omitempty"`
+	// Statements are the totals of pg_stat_statements for the migration's user and database,
+	// when the extension is installed.
+	Statements *StatementStats `json:"statements,omitempty" yaml:"statements,omitempty"`
+}
+
+// TableStats are the differences in pg_stat_user_tables of one table.
+type TableStats struct {
+	Table      string `json:"table" yaml:"table"`
+	Inserted   int64  `json:"tuples_inserted" yaml:"tuples_inserted"`
+	Updated    int64  `json:"tuples_updated" yaml:"tuples_updated"`
+	HOTUpdated int64  `json:"tuples_hot_updated" yaml:"tuples_hot_updated"`
+	Deleted    int64  `json:"tuples_deleted" yaml:"tuples_deleted"`
+	// DeadTuples is the change in the estimated number of dead tuples, which autovacuum can
+	// make negative.
+	DeadTuples int64 `json:"dead_tuples" yaml:"dead_tuples"`
+	SeqScans   int64 `json:"seq_scans" yaml:"seq_scans"`
+	IndexScans int64 `json:"index_scans" yaml:"index_scans"`
+}
+
+// StatementStats are the differences in the pg_stat_statements totals.
+type StatementStats struct {
+	Calls               int64   `json:"calls" yaml:"calls"`
+	ExecSeconds         float64 `json:"exec_seconds" yaml:"exec_seconds"`
+	Rows                int64   `json:"rows" yaml:"rows"`
+	SharedBlocksHit     int64   `json:"shared_blocks_hit" yaml:"shared_blocks_hit"`
+	SharedBlocksRead    int64   `json:"shared_blocks_read" yaml:"shared_blocks_read"`
+	SharedBlocksDirtied int64   `json:"shared_blocks_dirtied" yaml:"shared_blocks_dirtied"`
+	SharedBlocksWritten int64   `json:"shared_blocks_written" yaml:"shared_blocks_written"`
+	// WALBytes is missing before Postgres 13.
+	WALBytes *int64 `json:"wal_bytes,omitempty" yaml:"wal_bytes,omitempty"`
+}
+
+// serverSnapshot is the statistics read at the start or the end of a step.
+type serverSnapshot struct {
+	tables     map[string]TableStats
+	walLSN     string
+	statements *StatementStats
+}
+
+// statisticsTables are the tables whose statistics the report includes: the rewritten tables
+// and, with --audit, the audit table.
+func (m *migration) statisticsTables() []string {
+	tables := append([]string{}, rewrittenTables...)
+	if m.auditID != "" {
+		tables = append(tables, auditTable)
+	}
+	return tables
+}
+
+// serverSnapshot reads the statistics of the server. It returns nil, after logging why, when
+// they cannot be read: the statistics are informational and never fail the run.
+func (m *migration) serverSnapshot(ctx context.Context, step string) *serverSnapshot {
+	if !m.dialect.statisticsViews() {
+		return nil
+	}
+	s := &serverSnapshot{tables: map[string]TableStats{}}
+	err := m.retry(ctx, "server-stats", func(conn *pgx.Conn) error {
+		rows, err := conn.Query(ctx, `
+		SELECT relname, n_tup_ins, n_tup_upd, n_tup_hot_upd, n_tup_del, n_dead_tup, coalesce(seq_scan, 0), coalesce(idx_scan, 0)
+		FROM pg_stat_user_tables
+		WHERE schemaname = $2 AND relname = ANY($1)
+	`, m.statisticsTables(), m.schema.name())
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var t TableStats
+			if err := rows.Scan(&t.Table, &t.Inserted, &t.Updated, &t.HOTUpdated, &t.Deleted, &t.DeadTuples, &t.SeqScans, &t.IndexScans); err != nil {
+				return fmt.Errorf("failed to scan row: %w", err)
+			}
+			s.tables[t.Table] = t
+		}
+		if err := rows.Err(); err != nil {
+			return err
+		}
+		var lsn *string
+		if err := conn.QueryRow(ctx, `SELECT CASE WHEN pg_is_in_recovery() THEN NULL ELSE pg_current_wal_insert_lsn()::text END`).Scan(&lsn); err != nil {
+			return err
+		}
+		if lsn != nil {
+			s.walLSN = *lsn
+		}
+		s.statements, err = m.statementTotals(ctx, conn)
+		return err
+	})
+	if err != nil {
+		if ctx.Err() == nil {
+			m.logger.Printf("%s: failed to read the server statistics: %v\n", step, err)
+		}
+		return nil
+	}
+	return s
+}
+
+// flushStatistics makes the idle connections of the pool publish the statistics of their last
+// transactions, which Postgres 15 and later hold back for up to ten seconds when a session runs
+// many in a row, so the snapshot after a step counts all of them.
+func (m *migration) flushStatistics(ctx context.Context) {
+	for _, conn := range m.pool.pool.AcquireAllIdle(ctx) {
+		if serverMajorVersion(conn.Conn()) >= 15 {
+			// The statistics are flushed before the server reports it is ready for the next query.
+			if _, err := conn.Exec(ctx, `SELECT pg_stat_force_next_flush()`); err != nil {
+				m.logger.Printf("Failed to flush the server statistics: %v\n", err)
+			}
+		}
+		conn.Release()
+	}
+}
+
+// serverMajorVersion is the major version of the Postgres server conn is connected to, or 0
+// when it did not report one.
+func serverMajorVersion(conn *pgx.Conn) int {
+	v := conn.PgConn().ParameterStatus("server_version")
+	if i := strings.IndexFunc(v, func(r rune) bool { return r < '0' || r > '9' }); i >= 0 {
+		v = v[:i]
+	}
+	major, _ := strconv.Atoi(v)
+	return major
+}
+
+// statementTotals sums pg_stat_statements over the statements of the migration's user in its
+// database, or returns nil when the extension is not installed, or not loaded with
+// shared_preload_libraries. Columns renamed or added by later Postgres releases are read
+// through to_jsonb, so the query runs on every supported version.
+func (m *migration) statementTotals(ctx context.Context, conn *pgx.Conn) (*StatementStats, error) {
+	var schema string
+	err := conn.QueryRow(ctx, `
+		SELECT n.nspname FROM pg_extension e JOIN pg_namespace n ON n.oid = e.extnamespace
+		WHERE e.extname = 'pg_stat_statements'
+	`).Scan(&schema)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var st StatementStats
+	var walBytes *int64
+	err = conn.QueryRow(ctx, `
+		SELECT coalesce(sum(s.calls), 0)::bigint,
+		       coalesce(sum(coalesce((to_jsonb(s) ->> 'total_exec_time')::float8, (to_jsonb(s) ->> 'total_time')::float8)), 0) / 1000,
+		       coalesce(sum(s.rows), 0)::bigint,
+		       coalesce(sum(s.shared_blks_hit), 0)::bigint,
+		       coalesce(sum(s.shared_blks_read), 0)::bigint,
+		       coalesce(sum(s.shared_blks_dirtied), 0)::bigint,
+		       coalesce(sum(s.shared_blks_written), 0)::bigint,
+		       sum((to_jsonb(s) ->> 'wal_bytes')::numeric)::bigint
+		FROM `+pgx.Identifier{schema, "pg_stat_statements"}.Sanitize()+` s
+		WHERE s.dbid = (SELECT oid FROM pg_database WHERE datname = current_database())
+		  AND s.userid = (SELECT oid FROM pg_roles WHERE rolname = current_user)
+	`).Scan(&st.Calls, &st.ExecSeconds, &st.Rows, &st.SharedBlocksHit, &st.SharedBlocksRead, &st.SharedBlocksDirtied, &st.SharedBlocksWritten, &walBytes)
+	if err != nil {
+		if notPreloaded(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	st.WALBytes = walBytes
+	return &st, nil
+}
+
+// notPreloaded reports whether err is pg_stat_statements refusing to be read because it is not
+// in shared_preload_libraries.
+func notPreloaded(err error) bool {
+	var pgErr *pgconn.PgError
+	return errors.As(err, &pgErr) && pgErr.Code == "55000" // object_not_in_prerequisite_state
+}
+
+// since returns the statistics of the step that started at before. Missing snapshots give nil.
+func (s *serverSnapshot) since(before *serverSnapshot) *ServerStats {
+	if s == nil || before == nil {
+		return nil
+	}
+	tables := make([]string, 0, len(s.tables))
+	for table := range s.tables {
+		tables = append(tables, table)
+	}
+	sort.Strings(tables)
+	stats := &ServerStats{Tables: []TableStats{}}
+	for _, table := range tables {
+		t, b := s.tables[table], before.tables[table]
+		stats.Tables = append(stats.Tables, TableStats{
+			Table:      table,
+			Inserted:   t.Inserted - b.Inserted,
+			Updated:    t.Updated - b.Updated,
+			HOTUpdated: t.HOTUpdated - b.HOTUpdated,
+			Deleted:    t.Deleted - b.Deleted,
+			DeadTuples: t.DeadTuples - b.DeadTuples,
+			SeqScans:   t.SeqScans - b.SeqScans,
+			IndexScans: t.IndexScans - b.IndexScans,
+		})
+	}
+	if start, err := parseLSN(before.walLSN); err == nil {
+		if end, err := parseLSN(s.walLSN); err == nil {
+			wal := int64(end - start)
+			stats.WALBytes = &wal
+		}
+	}
+	if s.statements != nil && before.statements != nil {
+		a, b := s.statements, before.statements
+		st := &StatementStats{
+			Calls:               a.Calls - b.Calls,
+			ExecSeconds:         a.ExecSeconds - b.ExecSeconds,
+			Rows:                a.Rows - b.Rows,
+			SharedBlocksHit:     a.SharedBlocksHit - b.SharedBlocksHit,
+			SharedBlocksRead:    a.SharedBlocksRead - b.SharedBlocksRead,
+			SharedBlocksDirtied: a.SharedBlocksDirtied - b.SharedBlocksDirtied,
+			SharedBlocksWritten: a.SharedBlocksWritten - b.SharedBlocksWritten,
+		}
+		if a.WALBytes != nil && b.WALBytes != nil {
+			wal := *a.WALBytes - *b.WALBytes
+			st.WALBytes = &wal
+		}
+		stats.Statements = st
+	}
+	return stats
+}
+
+// parseLSN parses a WAL location in the X/Y form Postgres prints pg_lsn in.
+func parseLSN(s string) (uint64, error) {
+	hi, lo, ok := strings.Cut(s, "/")
+	if !ok {
+		return 0, fmt.Errorf("invalid WAL location %q", s)
+	}
+	h, err := strconv.ParseUint(hi, 16, 32)
+	if err != nil {
+		return 0, fmt.Errorf("invalid WAL location %q", s)
+	}
+	l, err := strconv.ParseUint(lo, 16, 32)
+	if err != nil {
+		return 0, fmt.Errorf("invalid WAL location %q", s)
+	}
+	return h<<32 | l, nil
+}
+
+// String summarizes the statistics in one line for the log.
+func (s *ServerStats) String() string {
+	var parts []string
+	for _, t := range s.Tables {
+		if t.Inserted == 0 && t.Updated == 0 && t.Deleted == 0 {
+			continue
+		}
+		parts = append(parts, fmt.Sprintf("%s %d inserted, %d updated (%d HOT), %d deleted, %+d dead tuples", t.Table, t.Inserted, t.Updated, t.HOTUpdated, t.Deleted, t.DeadTuples))
+	}
+	if s.WALBytes != nil {
+		parts = append(parts, formatBytes(*s.WALBytes)+" of WAL")
+	}
+	if st := s.Statements; st != nil {
+		parts = append(parts, fmt.Sprintf("%d statements in %.1fs, %d blocks read, %d dirtied", st.Calls, st.ExecSeconds, st.SharedBlocksRead, st.SharedBlocksDirtied))
+	}
+	if len(parts) == 0 {
+		return "no changes"
+	}
+	return strings.Join(parts, "; ")
+}
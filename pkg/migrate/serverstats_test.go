@@ -0,0 +1,66 @@
+package migrate
+
+import "testing"
+
+func TestParseLSN(t *testing.T) {
+	tests := []struct {
+		lsn     string
+		want    uint64
+		wantErr bool
+	}{
+		{lsn: "0/0", want: 0},
+		{lsn: "0/16B3748", want: 0x16B3748},
+		{lsn: "1A/FF000028", want: 0x1A<<32 | 0xFF000028},
+		{lsn: "", wantErr: true},
+		{lsn: "16B3748", wantErr: true},
+		{lsn: "0/XYZ", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := parseLSN(tt.lsn)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("parseLSN(%q) = %d, %v, want %d (error %v)", tt.lsn, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+func TestServerStatsSince(t *testing.T) {
+	wal := func(n int64) *int64 { return &n }
+	before := &serverSnapshot{
+		tables:     map[string]TableStats{"dependencies": {Table: "dependencies", Updated: 10, DeadTuples: 50}},
+		walLSN:     "0/FFFFFF00",
+		statements: &StatementStats{Calls: 3, SharedBlocksDirtied: 7, WALBytes: wal(100)},
+	}
+	after := &serverSnapshot{
+		tables: map[string]TableStats{
+			"dependencies": {Table: "dependencies", Updated: 25, HOTUpdated: 5, DeadTuples: 40},
+			"bill_of_materials_included_dependencies": {Table: "bill_of_materials_included_dependencies", Updated: 4},
+		},
+		walLSN:     "1/00000100",
+		statements: &StatementStats{Calls: 8, SharedBlocksDirtied: 9},
+	}
+
+	got := after.since(before)
+	if len(got.Tables) != 2 || got.Tables[0].Table != "bill_of_materials_included_dependencies" || got.Tables[1].Table != "dependencies" {
+		t.Fatalf("since() tables = %+v, want both tables in name order", got.Tables)
+	}
+	if d := got.Tables[1]; d.Updated != 15 || d.HOTUpdated != 5 || d.DeadTuples != -10 {
+		t.Errorf("dependencies = %+v, want 15 updated, 5 HOT and 10 fewer dead tuples", d)
+	}
+	if got.Tables[0].Updated != 4 {
+		t.Errorf("a table missing before the step has %d updates, want 4", got.Tables[0].Updated)
+	}
+	if got.WALBytes == nil || *got.WALBytes != 0x200 {
+		t.Errorf("WAL = %v, want 512 bytes across the segment boundary", got.WALBytes)
+	}
+	if st := got.Statements; st == nil || st.Calls != 5 || st.SharedBlocksDirtied != 2 || st.WALBytes != nil {
+		t.Errorf("statements = %+v, want 5 calls, 2 blocks dirtied and no WAL without both totals", st)
+	}
+
+	if (&serverSnapshot{}).since(nil) != nil || (*serverSnapshot)(nil).since(before) != nil {
+		t.Errorf("since() with a missing snapshot is not nil")
+	}
+	standby := &serverSnapshot{tables: map[string]TableStats{}}
+	if got := standby.since(&serverSnapshot{tables: map[string]TableStats{}}); got.WALBytes != nil || got.Statements != nil {
+		t.Errorf("since() on a standby without pg_stat_statements = %+v, want no WAL or statements", got)
+	}
+}
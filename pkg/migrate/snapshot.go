@@ -0,0 +1,447 @@
+package migrate
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// constraintSnapshotTable holds the definitions of the constraints and indexes of
+// rewrittenTables as they were before the migration changed any, so restore-constraints can put
+// back whatever a run that crashed halfway left missing.
+const constraintSnapshotTable = "guac_update_db_constraint_snapshot"
+
+// The kinds of savedDefinition.
+const (
+	definitionConstraint = "constraint"
+	definitionIndex      = "index"
+	definitionForeignKey = "foreign_key"
+)
+
+// savedDefinition is a constraint or index of one of rewrittenTables, as the catalog prints it.
+type savedDefinition struct {
+	Table      string `json:"table"`
+	Kind       string `json:"kind"`
+	Name       string `json:"name"`
+	Definition string `json:"definition"`
+}
+
+// restoreOrder is the order restore-constraints re-creates the kinds in: foreign keys need the
+// primary keys and unique constraints they reference.
+func (d savedDefinition) restoreOrder() int {
+	switch d.Kind {
+	case definitionConstraint:
+		return 0
+	case definitionIndex:
+		return 1
+	default:
+		return 2
+	}
+}
+
+// constraintSnapshot is the file --constraint-snapshot writes.
+type constraintSnapshot struct {
+	Database    string            `json:"database"`
+	TakenAt     time.Time         `json:"taken_at"`
+	Definitions []savedDefinition `json:"definitions"`
+}
+
+// withConstraintSnapshot adds a snapshot-constraints step before the first step that drops or
+// alters a constraint or index of rewrittenTables.
+func (m *migration) withConstraintSnapshot(steps []step) []step {
+	var wrapped []step
+	taken := false
+	for _, s := range steps {
+		switch s.name {
+		case "drop-constraints", "defer-constraints", "prepare-cutover":
+			if !taken {
+				wrapped = append(wrapped, step{name: "snapshot-constraints", run: m.snapshotConstraints})
+				taken = true
+			}
+		}
+		wrapped = append(wrapped, s)
+	}
+	return wrapped
+}
+
+// currentDefinitions returns the constraints and indexes of rewrittenTables, and the foreign
+// keys referencing them. Indexes backing a constraint are re-created with it, and left out, as
+// are the copies of a constraint on the partitions of a partitioned table.
+func currentDefinitions(ctx context.Context, q queryer, schema dbSchema) ([]savedDefinition, error) {
+	rows, err := q.Query(ctx, `
+		WITH t AS (SELECT to_regclass($2 || name) AS oid FROM unnest($1::text[]) name)
+		SELECT c.conrelid::regclass::text, CASE WHEN c.contype = 'f' THEN 'foreign_key' ELSE 'constraint' END, c.conname, pg_get_constraintdef(c.oid)
+		FROM pg_constraint c
+		WHERE c.conislocal AND (c.conrelid IN (SELECT oid FROM t) OR (c.contype = 'f' AND c.confrelid IN (SELECT oid FROM t)))
+		UNION ALL
+		SELECT i.indrelid::regclass::text, 'index', ic.relname, pg_get_indexdef(i.indexrelid)
+		FROM pg_index i
+		JOIN pg_class ic ON ic.oid = i.indexrelid
+		WHERE i.indrelid IN (SELECT oid FROM t)
+		  AND NOT EXISTS (SELECT 1 FROM pg_constraint c WHERE c.conindid = i.indexrelid AND c.contype IN ('p', 'u', 'x'))
+		ORDER BY 1, 3
+	`, rewrittenTables, schema.prefix())
+	if err != nil {
+		return nil, err
+	}
+	return scanDefinitions(rows)
+}
+
+func scanDefinitions(rows pgx.Rows) ([]savedDefinition, error) {
+	defer rows.Close()
+	defs := []savedDefinition{}
+	for rows.Next() {
+		var d savedDefinition
+		if err := rows.Scan(&d.Table, &d.Kind, &d.Name, &d.Definition); err != nil {
+			return nil, err
+		}
+		defs = append(defs, d)
+	}
+	return defs, rows.Err()
+}
+
+// snapshotConstraints saves the constraints and indexes of rewrittenTables in
+// constraintSnapshotTable and, with --constraint-snapshot, in a local file. A snapshot left by
+// an earlier run is kept: it was taken before that run dropped anything, and only gains the
+// definitions added since. The step is left out of --emit-sql scripts, which restore what
+// they drop themselves.
+func (m *migration) snapshotConstraints(ctx context.Context) (int64, error) {
+	var defs []savedDefinition
+	err := m.retry(ctx, "snapshot-constraints", func(conn *pgx.Conn) error {
+		tx, err := conn.Begin(ctx)
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback(ctx)
+
+		_, err = tx.Exec(ctx, `
+		CREATE TABLE IF NOT EXISTS `+m.schema.prefix()+constraintSnapshotTable+` (
+			table_name text NOT NULL,
+			kind text NOT NULL,
+			name text NOT NULL,
+			definition text NOT NULL,
+			taken_at timestamptz NOT NULL DEFAULT now(),
+			PRIMARY KEY (table_name, name)
+		)
+	`)
+		if err != nil {
+			return err
+		}
+		current, err := currentDefinitions(ctx, tx, m.schema)
+		if err != nil {
+			return err
+		}
+		for _, d := range current {
+			_, err := tx.Exec(ctx, `INSERT INTO `+m.schema.prefix()+constraintSnapshotTable+` (table_name, kind, name, definition) VALUES ($1, $2, $3, $4) ON CONFLICT DO NOTHING`, d.Table, d.Kind, d.Name, d.Definition)
+			if err != nil {
+				return err
+			}
+		}
+		if defs, err = savedDefinitions(ctx, tx, m.schema); err != nil {
+			return err
+		}
+		return tx.Commit(ctx)
+	})
+	if err != nil {
+		return 0, fmt.Errorf("failed to save the constraint and index definitions: %w", err)
+	}
+	m.logger.Printf("snapshot-constraints: saved %d constraint and index definitions in %s\n", len(defs), m.schema.prefix()+constraintSnapshotTable)
+	if m.snapshotPath == "" {
+		return int64(len(defs)), nil
+	}
+	s := constraintSnapshot{Database: m.config.Database, TakenAt: time.Now().UTC(), Definitions: defs}
+	if err := s.writeFile(m.snapshotPath); err != nil {
+		return 0, err
+	}
+	m.logger.Printf("snapshot-constraints: wrote them to %s\n", m.snapshotPath)
+	return int64(len(defs)), nil
+}
+
+// savedDefinitions returns the definitions in constraintSnapshotTable, if it exists, together
+// with the foreign keys and indexes recorded as dropped by runs that did not take a snapshot.
+func savedDefinitions(ctx context.Context, q queryer, schema dbSchema) ([]savedDefinition, error) {
+	defs := []savedDefinition{}
+	var snapshot, indexes bool
+	err := q.QueryRow(ctx, `
+		SELECT to_regclass($1) IS NOT NULL, to_regclass($2) IS NOT NULL
+	`, schema.prefix()+constraintSnapshotTable, schema.prefix()+droppedIndexesTable).Scan(&snapshot, &indexes)
+	if err != nil {
+		return nil, err
+	}
+	if snapshot {
+		rows, err := q.Query(ctx, `
+		SELECT table_name, kind, name, definition FROM `+schema.prefix()+constraintSnapshotTable+`
+		ORDER BY table_name, name
+	`)
+		if err != nil {
+			return nil, err
+		}
+		if defs, err = scanDefinitions(rows); err != nil {
+			return nil, err
+		}
+	}
+	seen := make(map[string]bool)
+	for _, d := range defs {
+		seen[d.Kind+"\x00"+d.Name] = true
+	}
+	fks, err := savedForeignKeys(ctx, q, schema)
+	if err != nil {
+		return nil, err
+	}
+	for _, fk := range fks {
+		if !seen[definitionForeignKey+"\x00"+fk.name] {
+			defs = append(defs, savedDefinition{Table: fk.table, Kind: definitionForeignKey, Name: fk.name, Definition: fk.definition})
+		}
+	}
+	if !indexes {
+		return defs, nil
+	}
+	rows, err := q.Query(ctx, `SELECT index_name, definition FROM `+schema.prefix()+droppedIndexesTable+` ORDER BY index_name`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var ix savedIndex
+		if err := rows.Scan(&ix.name, &ix.definition); err != nil {
+			return nil, err
+		}
+		if !seen[definitionIndex+"\x00"+ix.name] {
+			defs = append(defs, savedDefinition{Kind: definitionIndex, Name: ix.name, Definition: ix.definition})
+		}
+	}
+	return defs, rows.Err()
+}
+
+// writeFile writes the snapshot next to path and renames it into place, so a run killed while
+// writing it keeps the previous one.
+func (s *constraintSnapshot) writeFile(path string) error {
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*")
+	if err != nil {
+		return fmt.Errorf("failed to write the constraint snapshot: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	_, err = tmp.Write(append(data, '\n'))
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to write the constraint snapshot: %w", err)
+	}
+	return nil
+}
+
+// readSnapshotFile reads a --constraint-snapshot file taken of database.
+func readSnapshotFile(path, database string) (*constraintSnapshot, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the constraint snapshot: %w", err)
+	}
+	var s constraintSnapshot
+	if err := json.Unmarshal(data, &s); err != nil {
+		return nil, fmt.Errorf("invalid constraint snapshot %s: %w", path, err)
+	}
+	if s.Database != database {
+		return nil, fmt.Errorf("constraint snapshot %s was taken of database %s, not %s", path, s.Database, database)
+	}
+	return &s, nil
+}
+
+// missingDefinitions returns the definitions of defs that are not in the database, in the order
+// they are restored in. An index left invalid by a failed concurrent build counts as missing.
+func missingDefinitions(ctx context.Context, q queryer, schema dbSchema, defs []savedDefinition) ([]savedDefinition, error) {
+	var missing []savedDefinition
+	for _, d := range defs {
+		var exists bool
+		var err error
+		if d.Kind == definitionIndex {
+			err = q.QueryRow(ctx, `
+			SELECT EXISTS (SELECT 1 FROM pg_index WHERE indexrelid = to_regclass($1) AND indisvalid)
+		`, schema.prefix()+pgx.Identifier{d.Name}.Sanitize()).Scan(&exists)
+		} else {
+			err = q.QueryRow(ctx, `
+			SELECT EXISTS (SELECT 1 FROM pg_constraint WHERE conrelid = to_regclass($1) AND conname = $2)
+		`, d.Table, d.Name).Scan(&exists)
+		}
+		if err != nil {
+			return nil, err
+		}
+		if !exists {
+			missing = append(missing, d)
+		}
+	}
+	sort.SliceStable(missing, func(i, j int) bool { return missing[i].restoreOrder() < missing[j].restoreOrder() })
+	return missing, nil
+}
+
+// restoreSQL returns the statements re-creating d. Foreign keys are added NOT VALID and
+// validated afterwards, like add-constraints and validate-constraints do, and indexes are
+// built concurrently after dropping what a failed build left behind.
+func (d savedDefinition) restoreSQL(schema dbSchema) ([]string, error) {
+	switch d.Kind {
+	case definitionForeignKey:
+		fk := foreignKey{table: d.Table, name: d.Name, definition: d.Definition}
+		return []string{fk.addSQL(), fk.validateSQL()}, nil
+	case definitionIndex:
+		create, err := concurrentIndexDefinition(d.Definition)
+		if err != nil {
+			return nil, err
+		}
+		return []string{`DROP INDEX CONCURRENTLY IF EXISTS ` + schema.prefix() + pgx.Identifier{d.Name}.Sanitize() + `;`, create + `;`}, nil
+	default:
+		return []string{`ALTER TABLE ` + d.Table + ` ADD CONSTRAINT ` + pgx.Identifier{d.Name}.Sanitize() + ` ` + d.Definition + `;`}, nil
+	}
+}
+
+// forgetConstraintSnapshot drops constraintSnapshotTable at the end of a run that left every
+// definition in it in place. When some are missing, because --steps or --skip-steps left out
+// the steps restoring them, it is kept for the next run or restore-constraints.
+func (m *migration) forgetConstraintSnapshot(ctx context.Context) error {
+	var missing []savedDefinition
+	err := m.retry(ctx, "snapshot-constraints", func(conn *pgx.Conn) error {
+		var exists bool
+		err := conn.QueryRow(ctx, `SELECT to_regclass($1) IS NOT NULL`, m.schema.prefix()+constraintSnapshotTable).Scan(&exists)
+		if err != nil || !exists {
+			return err
+		}
+		rows, err := conn.Query(ctx, `SELECT table_name, kind, name, definition FROM `+m.schema.prefix()+constraintSnapshotTable)
+		if err != nil {
+			return err
+		}
+		defs, err := scanDefinitions(rows)
+		if err != nil {
+			return err
+		}
+		if missing, err = missingDefinitions(ctx, conn, m.schema, defs); err != nil || len(missing) > 0 {
+			return err
+		}
+		_, err = conn.Exec(ctx, `DROP TABLE `+m.schema.prefix()+constraintSnapshotTable)
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("failed to check the constraint snapshot: %w", err)
+	}
+	if len(missing) > 0 {
+		m.logger.Printf("%d of the constraints and indexes in %s are missing; the next run or restore-constraints restores them\n", len(missing), m.schema.prefix()+constraintSnapshotTable)
+	}
+	return nil
+}
+
+func runRestoreConstraints(args []string) {
+	var cf connFlags
+	fs := flag.NewFlagSet("restore-constraints", flag.ExitOnError)
+	cf.register(fs)
+	file := fs.String("file", "", "restore from this --constraint-snapshot `file` instead of the snapshot the migration saved in the database")
+	dryRun := fs.Bool("dry-run", false, "print the statements restoring the missing constraints and indexes without running them")
+	fs.Parse(args)
+
+	if err := restoreConstraints(&cf, *file, *dryRun, os.Stdout); err != nil {
+		log.Fatalf("%v\n", err)
+	}
+}
+
+// restoreConstraints re-creates the constraints and indexes of rewrittenTables that a crashed
+// or interrupted run dropped, from the snapshot the migration took before dropping them, and
+// forgets what the migration recorded once nothing is missing. It takes the migration lock, so
+// it cannot run while a migration is dropping or restoring them itself.
+func restoreConstraints(cf *connFlags, file string, dryRun bool, w io.Writer) error {
+	ctx := context.Background()
+	config, err := cf.config()
+	if err != nil {
+		return err
+	}
+	conn, err := pgx.ConnectConfig(ctx, config)
+	if err != nil {
+		return fmt.Errorf("unable to connect to database: %w", err)
+	}
+	defer conn.Close(ctx)
+	lock, err := holdMigrationLock(ctx, config)
+	if err != nil {
+		return err
+	}
+	defer lock.release(ctx)
+
+	var defs []savedDefinition
+	if file != "" {
+		s, err := readSnapshotFile(file, config.Database)
+		if err != nil {
+			return err
+		}
+		defs = s.Definitions
+	} else if defs, err = savedDefinitions(ctx, conn, cf.schema); err != nil {
+		return fmt.Errorf("failed to read the constraint snapshot: %w", err)
+	}
+	if len(defs) == 0 {
+		return fmt.Errorf("%s does not exist and no foreign key or index is recorded as dropped; pass the --constraint-snapshot file of the run with --file", cf.schema.prefix()+constraintSnapshotTable)
+	}
+	missing, err := missingDefinitions(ctx, conn, cf.schema, defs)
+	if err != nil {
+		return fmt.Errorf("failed to look for the missing constraints and indexes: %w", err)
+	}
+
+	for _, d := range missing {
+		stmts, err := d.restoreSQL(cf.schema)
+		if err != nil {
+			return err
+		}
+		for _, stmt := range stmts {
+			if dryRun {
+				fmt.Fprintf(w, "%s\n", stmt)
+				continue
+			}
+			if _, err := conn.Exec(ctx, stmt); err != nil {
+				return fmt.Errorf("failed to restore %s %s: %w", d.Kind, d.Name, err)
+			}
+		}
+		if !dryRun {
+			fmt.Fprintf(w, "Restored %s %s\n", strings.ReplaceAll(d.Kind, "_", " "), d.Name)
+		}
+	}
+
+	// A --defer-constraints run that failed leaves the foreign keys deferrable instead.
+	deferred, err := deferredForeignKeys(ctx, conn, cf.schema)
+	if err != nil {
+		return fmt.Errorf("failed to read the deferred foreign keys: %w", err)
+	}
+	for _, fk := range deferred {
+		if dryRun {
+			fmt.Fprintf(w, "%s\n", fk.undeferSQL())
+			continue
+		}
+		if _, err := conn.Exec(ctx, fk.undeferSQL()); err != nil {
+			return fmt.Errorf("failed to make foreign key %s NOT DEFERRABLE: %w", fk.name, err)
+		}
+		fmt.Fprintf(w, "Made foreign key %s NOT DEFERRABLE again\n", fk.name)
+	}
+	if dryRun {
+		return nil
+	}
+	for _, table := range []string{constraintSnapshotTable, droppedForeignKeysTable, droppedIndexesTable, deferredForeignKeysTable} {
+		if _, err := conn.Exec(ctx, `DROP TABLE IF EXISTS `+cf.schema.prefix()+table); err != nil {
+			return fmt.Errorf("failed to drop %s: %w", table, err)
+		}
+	}
+	if len(missing) == 0 {
+		fmt.Fprintf(w, "All %d constraints and indexes are in place\n", len(defs))
+		return nil
+	}
+	fmt.Fprintf(w, "Restored %d of %d constraints and indexes\n", len(missing), len(defs))
+	return nil
+}
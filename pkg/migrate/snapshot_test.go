@@ -0,0 +1,90 @@
+package migrate
+
+import (
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWithConstraintSnapshot(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		m    *migration
+		want string
+	}{
+		{"default", &migration{}, "backfill,snapshot-constraints,drop-constraints,rewrite-ids,fix-refs,add-constraints,validate-constraints,fix-sbom-ids,verify"},
+		{"rebuild-indexes", &migration{indexRebuild: true}, "backfill,snapshot-constraints,drop-constraints,drop-indexes,rewrite-ids,fix-refs,rebuild-indexes,add-constraints,validate-constraints,fix-sbom-ids,verify"},
+		{"defer-constraints", &migration{deferConstraints: true}, "backfill,snapshot-constraints,defer-constraints,rewrite-ids,restore-constraints,fix-sbom-ids,verify"},
+		{"online", &migration{online: true}, "backfill,add-shadow-columns,backfill-shadow,snapshot-constraints,prepare-cutover,cutover,validate-constraints,fix-sbom-ids,verify"},
+		{"no-ddl", &migration{noDDL: true}, "backfill,rewrite-ids,fix-sbom-ids,verify"},
+	} {
+		var names []string
+		for _, s := range tc.m.dependencyVersionIDSteps() {
+			names = append(names, s.name)
+		}
+		if got := strings.Join(names, ","); got != tc.want {
+			t.Errorf("%s: steps = %s, want %s", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestSavedDefinitionRestoreSQL(t *testing.T) {
+	for _, tc := range []struct {
+		def  savedDefinition
+		want []string
+	}{
+		{
+			savedDefinition{Table: "dependencies", Kind: definitionConstraint, Name: "dependencies_pkey", Definition: "PRIMARY KEY (id)"},
+			[]string{`ALTER TABLE dependencies ADD CONSTRAINT "dependencies_pkey" PRIMARY KEY (id);`},
+		},
+		{
+			savedDefinition{Table: "bill_of_materials_included_dependencies", Kind: definitionForeignKey, Name: dependencyFKName, Definition: "FOREIGN KEY (dependency_id) REFERENCES dependencies(id) ON DELETE CASCADE"},
+			[]string{
+				`ALTER TABLE bill_of_materials_included_dependencies ADD CONSTRAINT "bill_of_materials_included_dependencies_dependency_id" FOREIGN KEY (dependency_id) REFERENCES dependencies(id) ON DELETE CASCADE NOT VALID;`,
+				`ALTER TABLE bill_of_materials_included_dependencies VALIDATE CONSTRAINT "bill_of_materials_included_dependencies_dependency_id";`,
+			},
+		},
+		{
+			savedDefinition{Table: "dependencies", Kind: definitionIndex, Name: "dependency_package_id", Definition: "CREATE INDEX dependency_package_id ON public.dependencies USING btree (package_id)"},
+			[]string{
+				`DROP INDEX CONCURRENTLY IF EXISTS public."dependency_package_id";`,
+				`CREATE INDEX CONCURRENTLY IF NOT EXISTS dependency_package_id ON public.dependencies USING btree (package_id);`,
+			},
+		},
+	} {
+		got, err := tc.def.restoreSQL("public")
+		if err != nil {
+			t.Errorf("%s: restoreSQL() failed: %v", tc.def.Name, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%s: restoreSQL() = %q, want %q", tc.def.Name, got, tc.want)
+		}
+	}
+}
+
+func TestConstraintSnapshotFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "constraints.json")
+	s := &constraintSnapshot{
+		Database: "guac",
+		TakenAt:  time.Date(2024, 7, 1, 12, 0, 0, 0, time.UTC),
+		Definitions: []savedDefinition{
+			{Table: "dependencies", Kind: definitionConstraint, Name: "dependencies_pkey", Definition: "PRIMARY KEY (id)"},
+		},
+	}
+	if err := s.writeFile(path); err != nil {
+		t.Fatalf("writeFile() failed: %v", err)
+	}
+	got, err := readSnapshotFile(path, "guac")
+	if err != nil {
+		t.Fatalf("readSnapshotFile() failed: %v", err)
+	}
+	if !reflect.DeepEqual(got, s) {
+		t.Errorf("readSnapshotFile() = %+v, want %+v", got, s)
+	}
+	if _, err := readSnapshotFile(path, "guac_staging"); err == nil {
+		t.Errorf("readSnapshotFile() accepted the snapshot of another database")
+	}
+}
@@ -0,0 +1,171 @@
+package migrate
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// speedupMaintenanceWorkMem is the maintenance_work_mem --unsafe-speedups gives the steps in
+// maintenanceSteps, unless the server's is larger.
+const speedupMaintenanceWorkMem = "1GB"
+
+// maintenanceSteps build indexes or vacuum, which is what maintenance_work_mem sizes.
+var maintenanceSteps = map[string]bool{
+	"rebuild-indexes":      true,
+	"prepare-cutover":      true,
+	"cleanup-name-columns": true,
+	"post-maintenance":     true,
+}
+
+// unsafeSpeedups are the settings of --unsafe-speedups, which trade the durability of the
+// run's writes for speed. A nil *unsafeSpeedups changes nothing.
+type unsafeSpeedups struct {
+	// maintenanceWorkMem is the maintenance_work_mem of maintenanceSteps, empty when the
+	// server's is at least speedupMaintenanceWorkMem already.
+	maintenanceWorkMem string
+}
+
+// SpeedupChange is a setting --unsafe-speedups changed for the run, and how it was restored.
+type SpeedupChange struct {
+	Setting  string `json:"setting" yaml:"setting"`
+	Value    string `json:"value" yaml:"value"`
+	Previous string `json:"previous" yaml:"previous"`
+	Scope    string `json:"scope" yaml:"scope"`
+	Restored string `json:"restored,omitempty" yaml:"restored,omitempty"`
+}
+
+// apply sets the session settings of step on conn. Like the timeouts they are set whenever a
+// pooled connection is handed out for another step, and last as long as the session.
+func (u *unsafeSpeedups) apply(ctx context.Context, conn *pgx.Conn, step string) error {
+	for _, stmt := range u.statements(step) {
+		if _, err := conn.Exec(ctx, stmt); err != nil {
+			return fmt.Errorf("failed to run %s: %w", stmt, err)
+		}
+	}
+	return nil
+}
+
+// statements returns the SET and RESET statements that give a session the settings of step.
+func (u *unsafeSpeedups) statements(step string) []string {
+	if u == nil {
+		return nil
+	}
+	stmts := []string{"SET synchronous_commit = off"}
+	if u.maintenanceWorkMem != "" {
+		stmt := "RESET maintenance_work_mem"
+		if maintenanceSteps[step] {
+			stmt = "SET maintenance_work_mem = '" + u.maintenanceWorkMem + "'"
+		}
+		stmts = append(stmts, stmt)
+	}
+	return stmts
+}
+
+// stagingPersistence is how the --fast staging table is created: unlogged with
+// --unsafe-speedups, and logged otherwise, since once rewrite-ids has run it is the only record
+// of the old IDs, and a crash empties an unlogged table.
+func (u *unsafeSpeedups) stagingPersistence() string {
+	if u == nil {
+		return ""
+	}
+	return "UNLOGGED "
+}
+
+// prepareSpeedups reads the server settings --unsafe-speedups changes and records every
+// change in the report and the log.
+func (m *migration) prepareSpeedups(ctx context.Context) error {
+	if m.speedups == nil {
+		return nil
+	}
+	var syncCommit, workMem string
+	var workMemKB int64
+	err := m.retry(ctx, "unsafe-speedups", func(conn *pgx.Conn) error {
+		return conn.QueryRow(ctx, `
+		SELECT current_setting('synchronous_commit'), current_setting('maintenance_work_mem'),
+		       (SELECT setting::bigint FROM pg_settings WHERE name = 'maintenance_work_mem')
+	`).Scan(&syncCommit, &workMem, &workMemKB)
+	})
+	if err != nil {
+		return fmt.Errorf("failed to read the settings --unsafe-speedups changes: %w", err)
+	}
+	changes := []SpeedupChange{{Setting: "synchronous_commit", Value: "off", Previous: syncCommit, Scope: "every session of the run"}}
+	// maintenance_work_mem is in kB.
+	if workMemKB < 1<<20 {
+		m.speedups.maintenanceWorkMem = speedupMaintenanceWorkMem
+		changes = append(changes, SpeedupChange{Setting: "maintenance_work_mem", Value: speedupMaintenanceWorkMem, Previous: workMem, Scope: "the sessions of rebuild-indexes, prepare-cutover, cleanup-name-columns and post-maintenance"})
+	}
+	if m.fast {
+		changes = append(changes, SpeedupChange{Setting: "persistence of " + dependencyIDStagingTable, Value: "unlogged", Previous: "logged", Scope: "the staging table of --fast"})
+	}
+	for _, c := range changes {
+		m.logger.Printf("Unsafe speedup: %s = %s (was %s) for %s\n", c.Setting, c.Value, c.Previous, c.Scope)
+	}
+	m.report.UnsafeSpeedups = changes
+	return nil
+}
+
+// restoreSpeedups undoes what --unsafe-speedups changed, once the run is over. The session
+// settings go away with the sessions, which the run closes; a staging table the run left behind
+// is made logged again, as it may be the only record of the old IDs.
+func (m *migration) restoreSpeedups(ctx context.Context) {
+	if m.speedups == nil {
+		return
+	}
+	// The run may have been aborted, and the staging table must be made logged all the same.
+	ctx = context.WithoutCancel(ctx)
+	for i := range m.report.UnsafeSpeedups {
+		c := &m.report.UnsafeSpeedups[i]
+		if c.Value != "unlogged" {
+			c.Restored = "reset as the sessions of the run closed"
+			continue
+		}
+		left, err := m.restoreStagingLogged(ctx)
+		switch {
+		case err != nil:
+			m.logger.Printf("Failed to make %s logged again; run ALTER TABLE %s SET LOGGED before relying on it: %v\n", dependencyIDStagingTable, m.schema.prefix()+dependencyIDStagingTable, err)
+			continue
+		case left:
+			c.Restored = "left behind by the run and made logged again"
+		default:
+			c.Restored = "not left behind by the run"
+		}
+	}
+	for _, c := range m.report.UnsafeSpeedups {
+		if c.Restored != "" {
+			m.logger.Printf("Unsafe speedup restored: %s %s\n", c.Setting, c.Restored)
+		}
+	}
+}
+
+// restoreStagingLogged makes the unlogged staging table logged, reporting whether there was one.
+func (m *migration) restoreStagingLogged(ctx context.Context) (bool, error) {
+	var left bool
+	err := m.retry(ctx, "unsafe-speedups", func(conn *pgx.Conn) error {
+		err := conn.QueryRow(ctx, `
+		SELECT EXISTS (SELECT 1 FROM pg_class WHERE oid = to_regclass($1) AND relpersistence = 'u')
+	`, m.schema.prefix()+dependencyIDStagingTable).Scan(&left)
+		if err != nil || !left {
+			return err
+		}
+		_, err = conn.Exec(ctx, `ALTER TABLE `+m.schema.prefix()+dependencyIDStagingTable+` SET LOGGED`)
+		return err
+	})
+	return left, err
+}
+
+// checkSpeedupsOptions fails on the flags --unsafe-speedups cannot be combined with.
+func checkSpeedupsOptions(opts *options) error {
+	if !opts.unsafeSpeedups {
+		return nil
+	}
+	switch {
+	case opts.dialect == dialectCockroach:
+		return errors.New("--unsafe-speedups sets Postgres settings CockroachDB does not have")
+	case opts.emitSQL != "":
+		return errors.New("--unsafe-speedups changes the sessions of a run and cannot be combined with --emit-sql")
+	}
+	return nil
+}
@@ -0,0 +1,34 @@
+package migrate
+
+import (
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestUnsafeSpeedupsStatements(t *testing.T) {
+	var off *unsafeSpeedups
+	if stmts := off.statements("backfill"); len(stmts) != 0 {
+		t.Errorf("statements without --unsafe-speedups = %v, want none", stmts)
+	}
+	if sql := (&idRewrite{stagingTable: dependencyIDStagingTable}).createStagingSQL("public", off); strings.Contains(sql, "UNLOGGED") {
+		t.Errorf("staging table without --unsafe-speedups: %s, want it logged", sql)
+	}
+
+	u := &unsafeSpeedups{maintenanceWorkMem: speedupMaintenanceWorkMem}
+	for step, want := range map[string][]string{
+		"backfill":        {"SET synchronous_commit = off", "RESET maintenance_work_mem"},
+		"rebuild-indexes": {"SET synchronous_commit = off", "SET maintenance_work_mem = '1GB'"},
+	} {
+		if got := u.statements(step); !slices.Equal(got, want) {
+			t.Errorf("statements(%s) = %v, want %v", step, got, want)
+		}
+	}
+	// A server with a larger maintenance_work_mem keeps it.
+	if got := (&unsafeSpeedups{}).statements("rebuild-indexes"); !slices.Equal(got, []string{"SET synchronous_commit = off"}) {
+		t.Errorf("statements(rebuild-indexes) without a maintenance_work_mem = %v, want synchronous_commit only", got)
+	}
+	if sql := (&idRewrite{stagingTable: dependencyIDStagingTable}).createStagingSQL("public", u); !strings.HasPrefix(sql, "CREATE UNLOGGED TABLE ") {
+		t.Errorf("staging table with --unsafe-speedups: %s, want it unlogged", sql)
+	}
+}
@@ -0,0 +1,86 @@
+package migrate
+
+import "github.com/pxp928/guac-update-db/pkg/keys"
+
+// dependencyIDMapTable is the temporary table holding the old to new dependency ID mapping
+// while the set-based migration script runs.
+const dependencyIDMapTable = "guac_dependency_id_map"
+
+// dependencyFKTable is the temporary table holding the foreign keys referencing dependencies,
+// as they were found, while the set-based migration script runs.
+const dependencyFKTable = "guac_dependency_fks"
+
+// dependencyMigrationSQL returns the whole data migration as a set-based SQL script. It does the
+// same work as the migrate steps, but computes the new IDs inside Postgres so it can be
+// reviewed and applied without this tool, for example as an Atlas versioned migration. It
+// expects to run inside a single transaction. New IDs are composed with scheme.
+func dependencyMigrationSQL(schema dbSchema, scheme *keys.Scheme) string {
+	return `-- Step 1: Update the dependencies table by setting dependent_package_version_id
+UPDATE ` + schema.prefix() + `dependencies d
+SET dependent_package_version_id = pv.id
+FROM ` + schema.prefix() + `package_versions pv
+WHERE d.dependent_package_name_id IS NOT NULL
+  AND d.dependent_package_version_id IS NULL
+  AND d.dependent_package_name_id = pv.name_id
+  AND ` + versionMatchSQL(versionRangesSkip, "d", "pv") + `;
+
+-- Rows without a version cannot be given their new ID; resolve them before migrating.
+DO $$
+BEGIN
+  IF EXISTS (SELECT 1 FROM ` + schema.prefix() + `dependencies WHERE dependent_package_version_id IS NULL) THEN
+    RAISE EXCEPTION 'dependencies rows without dependent_package_version_id remain after the backfill';
+  END IF;
+END
+$$;
+
+-- Temporarily disable foreign key constraints, whatever this database named them
+CREATE TEMPORARY TABLE ` + dependencyFKTable + ` AS
+SELECT c.conrelid::regclass::text AS table_name, c.conname, pg_get_constraintdef(c.oid) AS definition
+FROM pg_constraint c
+WHERE c.contype = 'f' AND c.confrelid = ` + schema.regclassLiteral("dependencies") + ` AND c.conislocal;
+
+DO $$
+DECLARE
+  fk record;
+BEGIN
+  IF NOT EXISTS (SELECT 1 FROM ` + dependencyFKTable + `) THEN
+    RAISE EXCEPTION 'no foreign key references dependencies(id)';
+  END IF;
+  FOR fk IN SELECT * FROM ` + dependencyFKTable + ` LOOP
+    EXECUTE format('ALTER TABLE %s DROP CONSTRAINT %I', fk.table_name, fk.conname);
+  END LOOP;
+END
+$$;
+
+-- Step 2: Generate new UUIDs for the id field in the dependencies table
+CREATE TEMPORARY TABLE ` + dependencyIDMapTable + ` AS
+SELECT d.id AS old_id, ` + scheme.KeySQL("d") + ` AS new_id
+FROM ` + schema.prefix() + `dependencies d;
+
+UPDATE ` + schema.prefix() + `dependencies d
+SET id = m.new_id
+FROM ` + dependencyIDMapTable + ` m
+WHERE d.id = m.old_id AND m.old_id <> m.new_id;
+
+-- Step 3: Update the related tables to reference the new UUIDs
+UPDATE ` + schema.prefix() + `bill_of_materials_included_dependencies b
+SET dependency_id = m.new_id
+FROM ` + dependencyIDMapTable + ` m
+WHERE b.dependency_id = m.old_id AND m.old_id <> m.new_id;
+
+DROP TABLE ` + dependencyIDMapTable + `;
+
+-- Re-enable foreign key constraints
+DO $$
+DECLARE
+  fk record;
+BEGIN
+  FOR fk IN SELECT * FROM ` + dependencyFKTable + ` LOOP
+    EXECUTE format('ALTER TABLE %s ADD CONSTRAINT %I %s', fk.table_name, fk.conname, fk.definition);
+  END LOOP;
+END
+$$;
+
+DROP TABLE ` + dependencyFKTable + `;
+`
+}
@@ -0,0 +1,206 @@
+package migrate
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/tracelog"
+	"go.opentelemetry.io/otel/attribute"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// The statements --log-sql logs.
+const (
+	logSQLOff    = "off"
+	logSQLErrors = "errors"
+	logSQLAll    = "all"
+)
+
+func validLogSQL(mode string) bool {
+	return mode == logSQLOff || mode == logSQLErrors || mode == logSQLAll
+}
+
+// sqlTracer is the pgx tracer of the connections of a run: the statement spans, the statements
+// --log-sql logs and the trace --record writes.
+func sqlTracer(logger *log.Logger, logSQL string, recorder *traceRecorder) pgx.QueryTracer {
+	tracers := pgxTracers{statementSpans{}}
+	switch logSQL {
+	case logSQLErrors:
+		tracers = append(tracers, &tracelog.TraceLog{Logger: sqlLogger{logger}, LogLevel: tracelog.LogLevelError})
+	case logSQLAll:
+		tracers = append(tracers, &tracelog.TraceLog{Logger: sqlLogger{logger}, LogLevel: tracelog.LogLevelInfo})
+	}
+	if recorder != nil {
+		tracers = append(tracers, recorder)
+	}
+	return tracers
+}
+
+// connCloseTracer is told about the connections a pool closes, which pgx does not trace.
+type connCloseTracer interface {
+	TraceClose(conn *pgx.Conn)
+}
+
+// pgxTracers passes what pgx traces on to each of its tracers that traces it.
+type pgxTracers []pgx.QueryTracer
+
+func (ts pgxTracers) TraceQueryStart(ctx context.Context, conn *pgx.Conn, data pgx.TraceQueryStartData) context.Context {
+	for _, t := range ts {
+		ctx = t.TraceQueryStart(ctx, conn, data)
+	}
+	return ctx
+}
+
+func (ts pgxTracers) TraceQueryEnd(ctx context.Context, conn *pgx.Conn, data pgx.TraceQueryEndData) {
+	for _, t := range ts {
+		t.TraceQueryEnd(ctx, conn, data)
+	}
+}
+
+func (ts pgxTracers) TraceBatchStart(ctx context.Context, conn *pgx.Conn, data pgx.TraceBatchStartData) context.Context {
+	for _, t := range ts {
+		if t, ok := t.(pgx.BatchTracer); ok {
+			ctx = t.TraceBatchStart(ctx, conn, data)
+		}
+	}
+	return ctx
+}
+
+func (ts pgxTracers) TraceBatchQuery(ctx context.Context, conn *pgx.Conn, data pgx.TraceBatchQueryData) {
+	for _, t := range ts {
+		if t, ok := t.(pgx.BatchTracer); ok {
+			t.TraceBatchQuery(ctx, conn, data)
+		}
+	}
+}
+
+func (ts pgxTracers) TraceBatchEnd(ctx context.Context, conn *pgx.Conn, data pgx.TraceBatchEndData) {
+	for _, t := range ts {
+		if t, ok := t.(pgx.BatchTracer); ok {
+			t.TraceBatchEnd(ctx, conn, data)
+		}
+	}
+}
+
+func (ts pgxTracers) TraceCopyFromStart(ctx context.Context, conn *pgx.Conn, data pgx.TraceCopyFromStartData) context.Context {
+	for _, t := range ts {
+		if t, ok := t.(pgx.CopyFromTracer); ok {
+			ctx = t.TraceCopyFromStart(ctx, conn, data)
+		}
+	}
+	return ctx
+}
+
+func (ts pgxTracers) TraceCopyFromEnd(ctx context.Context, conn *pgx.Conn, data pgx.TraceCopyFromEndData) {
+	for _, t := range ts {
+		if t, ok := t.(pgx.CopyFromTracer); ok {
+			t.TraceCopyFromEnd(ctx, conn, data)
+		}
+	}
+}
+
+func (ts pgxTracers) TraceClose(conn *pgx.Conn) {
+	for _, t := range ts {
+		if t, ok := t.(connCloseTracer); ok {
+			t.TraceClose(conn)
+		}
+	}
+}
+
+// statementSpans traces every statement, batch and COPY as a span under the span of the
+// operation sending it, with the statement's text but not its parameters. Statements sent
+// outside a recorded span, such as the pings of the pool, are not traced.
+type statementSpans struct{}
+
+// statementSpanKey holds the span statementSpans started in the context pgx passes from the
+// start of a call to its end, so that the end does not close the span of the operation.
+type statementSpanKey struct{}
+
+func (statementSpans) start(ctx context.Context, conn *pgx.Conn, name string, attrs ...attribute.KeyValue) context.Context {
+	if !trace.SpanFromContext(ctx).IsRecording() {
+		return ctx
+	}
+	attrs = append(dbAttributes(conn.Config().Database), attrs...)
+	ctx, span := tracer.Start(ctx, name, trace.WithSpanKind(trace.SpanKindClient), trace.WithAttributes(attrs...))
+	return context.WithValue(ctx, statementSpanKey{}, span)
+}
+
+func (statementSpans) end(ctx context.Context, err error) {
+	if span, ok := ctx.Value(statementSpanKey{}).(trace.Span); ok {
+		endSpan(span, err)
+	}
+}
+
+func (s statementSpans) TraceQueryStart(ctx context.Context, conn *pgx.Conn, data pgx.TraceQueryStartData) context.Context {
+	op := sqlOperation(data.SQL)
+	return s.start(ctx, conn, op, semconv.DBOperationName(op), semconv.DBQueryText(data.SQL))
+}
+
+func (s statementSpans) TraceQueryEnd(ctx context.Context, _ *pgx.Conn, data pgx.TraceQueryEndData) {
+	s.end(ctx, data.Err)
+}
+
+func (s statementSpans) TraceBatchStart(ctx context.Context, conn *pgx.Conn, data pgx.TraceBatchStartData) context.Context {
+	return s.start(ctx, conn, "BATCH", semconv.DBOperationName("BATCH"), attribute.Int("db.batch.size", data.Batch.Len()))
+}
+
+// TraceBatchQuery records the statements of a batch that failed as errors of its span; a span
+// of their own each would be one per row of the per-row batches.
+func (statementSpans) TraceBatchQuery(ctx context.Context, _ *pgx.Conn, data pgx.TraceBatchQueryData) {
+	span, ok := ctx.Value(statementSpanKey{}).(trace.Span)
+	if ok && data.Err != nil {
+		span.RecordError(data.Err, trace.WithAttributes(semconv.DBQueryText(data.SQL)))
+	}
+}
+
+func (s statementSpans) TraceBatchEnd(ctx context.Context, _ *pgx.Conn, data pgx.TraceBatchEndData) {
+	s.end(ctx, data.Err)
+}
+
+func (s statementSpans) TraceCopyFromStart(ctx context.Context, conn *pgx.Conn, data pgx.TraceCopyFromStartData) context.Context {
+	return s.start(ctx, conn, "COPY", semconv.DBOperationName("COPY"), semconv.DBCollectionName(data.TableName.Sanitize()))
+}
+
+func (s statementSpans) TraceCopyFromEnd(ctx context.Context, _ *pgx.Conn, data pgx.TraceCopyFromEndData) {
+	s.end(ctx, data.Err)
+}
+
+// sqlOperation is the first keyword of a statement, which names its span.
+func sqlOperation(sql string) string {
+	if fields := strings.Fields(sql); len(fields) > 0 {
+		return strings.ToUpper(fields[0])
+	}
+	return "SQL"
+}
+
+// sqlLogger logs the statements pgx's tracelog reports for --log-sql to the log of the run, on
+// one line each, without their parameters: those are the IDs, names and versions of the rows.
+type sqlLogger struct {
+	logger *log.Logger
+}
+
+func (l sqlLogger) Log(_ context.Context, _ tracelog.LogLevel, msg string, data map[string]any) {
+	var b strings.Builder
+	b.WriteString("SQL " + msg)
+	if pid, ok := data["pid"].(uint32); ok {
+		fmt.Fprintf(&b, " [pid %d]", pid)
+	}
+	if sql, ok := data["sql"].(string); ok {
+		b.WriteString(": " + strings.Join(strings.Fields(sql), " "))
+	}
+	if table, ok := data["tableName"].(pgx.Identifier); ok {
+		b.WriteString(": " + table.Sanitize())
+	}
+	if d, ok := data["time"].(time.Duration); ok {
+		fmt.Fprintf(&b, " (%s)", d.Round(time.Microsecond))
+	}
+	if err, ok := data["err"].(error); ok {
+		fmt.Fprintf(&b, " failed: %v", err)
+	}
+	l.logger.Printf("%s\n", b.String())
+}
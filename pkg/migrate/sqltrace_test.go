@@ -0,0 +1,71 @@
+package migrate
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"log"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/tracelog"
+)
+
+func TestSQLLogger(t *testing.T) {
+	var buf bytes.Buffer
+	l := sqlLogger{log.New(&buf, "", 0)}
+	l.Log(context.Background(), tracelog.LogLevelError, "Query", map[string]any{
+		"sql":  "UPDATE dependencies\n\t\tSET id = $1 WHERE id = $2",
+		"args": []any{"secret"},
+		"time": 1500 * time.Microsecond,
+		"pid":  uint32(42),
+		"err":  errors.New("deadlock detected"),
+	})
+	l.Log(context.Background(), tracelog.LogLevelInfo, "CopyFrom", map[string]any{"tableName": pgx.Identifier{"guac", "staging"}, "time": time.Millisecond})
+	want := "SQL Query [pid 42]: UPDATE dependencies SET id = $1 WHERE id = $2 (1.5ms) failed: deadlock detected\n" +
+		`SQL CopyFrom: "guac"."staging" (1ms)` + "\n"
+	if got := buf.String(); got != want {
+		t.Errorf("logged %q, want %q", got, want)
+	}
+}
+
+type countingTracer struct{ queries, batches int }
+
+func (c *countingTracer) TraceQueryStart(ctx context.Context, _ *pgx.Conn, _ pgx.TraceQueryStartData) context.Context {
+	c.queries++
+	return ctx
+}
+
+func (c *countingTracer) TraceQueryEnd(context.Context, *pgx.Conn, pgx.TraceQueryEndData) {}
+
+type countingBatchTracer struct{ countingTracer }
+
+func (c *countingBatchTracer) TraceBatchStart(ctx context.Context, _ *pgx.Conn, _ pgx.TraceBatchStartData) context.Context {
+	c.batches++
+	return ctx
+}
+
+func (c *countingBatchTracer) TraceBatchQuery(context.Context, *pgx.Conn, pgx.TraceBatchQueryData) {}
+
+func (c *countingBatchTracer) TraceBatchEnd(context.Context, *pgx.Conn, pgx.TraceBatchEndData) {}
+
+func TestPgxTracers(t *testing.T) {
+	queries, batches := &countingTracer{}, &countingBatchTracer{}
+	ts := pgxTracers{statementSpans{}, queries, batches}
+	ctx := ts.TraceQueryStart(context.Background(), nil, pgx.TraceQueryStartData{SQL: "SELECT 1"})
+	ts.TraceQueryEnd(ctx, nil, pgx.TraceQueryEndData{})
+	ctx = ts.TraceBatchStart(context.Background(), nil, pgx.TraceBatchStartData{Batch: &pgx.Batch{}})
+	ts.TraceBatchEnd(ctx, nil, pgx.TraceBatchEndData{})
+	if queries.queries != 1 || batches.queries != 1 || batches.batches != 1 {
+		t.Errorf("traced %d and %d queries and %d batches, want 1 each", queries.queries, batches.queries, batches.batches)
+	}
+}
+
+func TestSQLOperation(t *testing.T) {
+	for sql, want := range map[string]string{"\n\t\tupdate t SET id = $1": "UPDATE", "WITH x AS (SELECT 1) SELECT * FROM x": "WITH", "": "SQL"} {
+		if got := sqlOperation(sql); got != want {
+			t.Errorf("sqlOperation(%q) = %q, want %q", sql, got, want)
+		}
+	}
+}
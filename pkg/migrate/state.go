@@ -0,0 +1,287 @@
+package migrate
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+)
+
+// runStateTable keeps the state of the runs that have nowhere to save a --state-file, such as
+// --hook-mode Jobs with a read-only root filesystem, one row per database.
+const runStateTable = "guac_update_db_run_state"
+
+// runState is the progress of a run saved to --state-file, so a run stopped while paused
+// outside its maintenance window, or killed, skips the steps it already completed when it is
+// started again. A nil *runState saves nothing.
+type runState struct {
+	// mu guards the state against the --workers saving their progress.
+	mu   sync.Mutex
+	path string
+	// config, when set, is the database the state is saved in, in the runStateTable of schema,
+	// instead of at path.
+	config   *pgx.ConnConfig
+	schema   dbSchema
+	Database string `json:"database"`
+	// Completed are the finished steps, as migration/step.
+	Completed []string `json:"completed"`
+	// BackfillAfter is the last dependency ID of the last chunk the backfill committed.
+	BackfillAfter *uuid.UUID `json:"backfill_after,omitempty"`
+	// BackfillRanges are the same for every key range of a backfill run with --workers.
+	BackfillRanges []*uuid.UUID `json:"backfill_ranges,omitempty"`
+	// BackfillPartition is the partition of a partitioned dependencies table BackfillAfter and
+	// BackfillRanges are in; the partitions before it are backfilled.
+	BackfillPartition string `json:"backfill_partition,omitempty"`
+	// Filter is the subset of the dependencies the --filter flags restricted the run to.
+	Filter string `json:"filter,omitempty"`
+}
+
+// loadState reads the state saved at path by an earlier run against database, or starts a new
+// one when the file does not exist.
+func loadState(path, database string) (*runState, error) {
+	s := &runState{path: path, Database: database, Completed: []string{}}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read state file: %w", err)
+	}
+	if err := json.Unmarshal(data, s); err != nil {
+		return nil, fmt.Errorf("invalid state file %s: %w", path, err)
+	}
+	if s.Database != database {
+		return nil, fmt.Errorf("state file %s belongs to a run against database %s, not %s", path, s.Database, database)
+	}
+	return s, nil
+}
+
+// loadDatabaseState reads the state an earlier run against the database of config saved in
+// runStateTable, or starts a new one.
+func loadDatabaseState(ctx context.Context, config *pgx.ConnConfig, schema dbSchema) (*runState, error) {
+	s := &runState{config: config, schema: schema, Database: config.Database, Completed: []string{}}
+	var data []byte
+	err := s.exec(ctx, func(ctx context.Context, conn *pgx.Conn) error {
+		if _, err := conn.Exec(ctx, `CREATE TABLE IF NOT EXISTS `+s.schema.prefix()+runStateTable+` (
+			database text PRIMARY KEY,
+			state jsonb NOT NULL,
+			saved_at timestamptz NOT NULL DEFAULT now()
+		)`); err != nil {
+			return err
+		}
+		err := conn.QueryRow(ctx, `SELECT state::text FROM `+s.schema.prefix()+runStateTable+` WHERE database = $1`, config.Database).Scan(&data)
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil
+		}
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the state from %s: %w", runStateTable, err)
+	}
+	if data != nil {
+		if err := json.Unmarshal(data, s); err != nil {
+			return nil, fmt.Errorf("invalid state in %s: %w", runStateTable, err)
+		}
+	}
+	return s, nil
+}
+
+// exec runs fn on a connection of its own to the database the state is saved in. The state
+// is saved at the end of a step and before a pause, whatever the pool is doing.
+func (s *runState) exec(ctx context.Context, fn func(ctx context.Context, conn *pgx.Conn) error) error {
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+	conn, err := pgx.ConnectConfig(ctx, s.config)
+	if err != nil {
+		return err
+	}
+	defer conn.Close(ctx)
+	return fn(ctx, conn)
+}
+
+// restrict fails when an earlier run saved its progress restricted to another subset of the
+// dependencies than filter, which is none of this run's, and records filter otherwise.
+func (s *runState) restrict(filter string) error {
+	if s == nil {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	started := len(s.Completed) > 0 || s.BackfillAfter != nil || len(s.BackfillRanges) > 0
+	if started && s.Filter != filter {
+		return fmt.Errorf("the saved state is of a run restricted to %q, not %q; pass the same --filter flags, or remove the state to start over", s.Filter, filter)
+	}
+	s.Filter = filter
+	return nil
+}
+
+func stateKey(migration, step string) string {
+	if migration == "" {
+		return step
+	}
+	return migration + "/" + step
+}
+
+// completed reports whether an earlier run finished the step.
+func (s *runState) completed(key string) bool {
+	if s == nil {
+		return false
+	}
+	for _, k := range s.Completed {
+		if k == key {
+			return true
+		}
+	}
+	return false
+}
+
+// complete records that the step finished and saves the state.
+func (s *runState) complete(key string) error {
+	if s == nil {
+		return nil
+	}
+	s.mu.Lock()
+	s.Completed = append(s.Completed, key)
+	s.mu.Unlock()
+	return s.save()
+}
+
+// backfillResumesAfter returns the dependency ID an interrupted backfill committed up to, in
+// key range i of n. An earlier run with a different number of --workers started over.
+func (s *runState) backfillResumesAfter(i, n int) uuid.NullUUID {
+	if s == nil {
+		return uuid.NullUUID{}
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	after := s.BackfillAfter
+	if n > 1 {
+		after = nil
+		if len(s.BackfillRanges) == n {
+			after = s.BackfillRanges[i]
+		}
+	}
+	if after == nil {
+		return uuid.NullUUID{}
+	}
+	return uuid.NullUUID{UUID: *after, Valid: true}
+}
+
+// backfillResumesIn returns the index in partitions of the partition an interrupted backfill
+// was walking, or 0 when it walked none of them.
+func (s *runState) backfillResumesIn(partitions []string) int {
+	if s == nil {
+		return 0
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, p := range partitions {
+		if p == s.BackfillPartition {
+			return i
+		}
+	}
+	return 0
+}
+
+// backfilling records that the backfill walks partition from now on, starting it over unless
+// it resumes the partition an earlier run was walking.
+func (s *runState) backfilling(partition string) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.BackfillPartition != partition {
+		s.BackfillPartition = partition
+		s.BackfillAfter = nil
+		s.BackfillRanges = nil
+	}
+}
+
+// backfilled records the last dependency ID of a committed backfill chunk in key range i of n.
+// It is saved with the rest of the state before a pause and when the step completes.
+func (s *runState) backfilled(i, n int, id uuid.UUID) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if n == 1 {
+		s.BackfillAfter = &id
+		return
+	}
+	if len(s.BackfillRanges) != n {
+		s.BackfillRanges = make([]*uuid.UUID, n)
+	}
+	s.BackfillRanges[i] = &id
+}
+
+// save writes the state next to its destination and renames it into place, so a run killed
+// while saving keeps the previous state.
+func (s *runState) save() error {
+	if s == nil {
+		return nil
+	}
+	s.mu.Lock()
+	data, err := json.MarshalIndent(s, "", "  ")
+	s.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	if s.config != nil {
+		err := s.exec(context.Background(), func(ctx context.Context, conn *pgx.Conn) error {
+			_, err := conn.Exec(ctx, `INSERT INTO `+s.schema.prefix()+runStateTable+` (database, state) VALUES ($1, $2::jsonb)
+				ON CONFLICT (database) DO UPDATE SET state = excluded.state, saved_at = now()`, s.Database, string(data))
+			return err
+		})
+		if err != nil {
+			return fmt.Errorf("failed to save state: %w", err)
+		}
+		return nil
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(s.path), "."+filepath.Base(s.path)+".*")
+	if err != nil {
+		return fmt.Errorf("failed to save state: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	_, err = tmp.Write(append(data, '\n'))
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), s.path)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to save state: %w", err)
+	}
+	return nil
+}
+
+// remove deletes the state of a run that finished.
+func (s *runState) remove() error {
+	if s == nil {
+		return nil
+	}
+	if s.config != nil {
+		err := s.exec(context.Background(), func(ctx context.Context, conn *pgx.Conn) error {
+			_, err := conn.Exec(ctx, `DELETE FROM `+s.schema.prefix()+runStateTable+` WHERE database = $1`, s.Database)
+			return err
+		})
+		if err != nil {
+			return fmt.Errorf("failed to remove the state from %s: %w", runStateTable, err)
+		}
+		return nil
+	}
+	if err := os.Remove(s.path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("failed to remove state file: %w", err)
+	}
+	return nil
+}
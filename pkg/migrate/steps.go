@@ -0,0 +1,71 @@
+package migrate
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// stepList is a flag.Value holding a comma-separated list of step names.
+type stepList []string
+
+func (l *stepList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *stepList) Set(s string) error {
+	*l = (*l)[:0]
+	for _, name := range strings.Split(s, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			*l = append(*l, name)
+		}
+	}
+	return nil
+}
+
+// stepFilter decides which steps of a run are executed, from --steps and --skip-steps.
+type stepFilter struct {
+	only []string
+	skip []string
+}
+
+// check fails on any step name that is not one of the steps of the run.
+func (f *stepFilter) check(steps []step) error {
+	known := make(map[string]bool)
+	for _, s := range steps {
+		known[s.name] = true
+	}
+	var unknown []string
+	for _, name := range append(append([]string{}, f.only...), f.skip...) {
+		if !known[name] {
+			unknown = append(unknown, name)
+		}
+	}
+	if len(unknown) == 0 {
+		return nil
+	}
+	var names []string
+	for name := range known {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return fmt.Errorf("unknown steps %s: this run has steps %s", strings.Join(unknown, ", "), strings.Join(names, ", "))
+}
+
+// selected reports whether the step called name runs.
+func (f *stepFilter) selected(name string) bool {
+	for _, s := range f.skip {
+		if s == name {
+			return false
+		}
+	}
+	if len(f.only) == 0 {
+		return true
+	}
+	for _, s := range f.only {
+		if s == name {
+			return true
+		}
+	}
+	return false
+}
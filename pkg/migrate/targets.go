@@ -0,0 +1,210 @@
+package migrate
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// target is one database of a --targets file.
+type target struct {
+	Name         string `yaml:"name"`
+	DSNFile      string `yaml:"dsn_file"`
+	PasswordFile string `yaml:"password_file"`
+	// Fingerprint is the --expect-db-fingerprint of the target.
+	Fingerprint string `yaml:"fingerprint"`
+	// Schema is the schema GUAC's tables are in on the target; --schema when empty.
+	Schema string `yaml:"schema"`
+}
+
+type targetsFile struct {
+	Targets []target `yaml:"targets"`
+}
+
+// loadTargets reads and validates a --targets file.
+func loadTargets(path string) ([]target, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read targets file: %w", err)
+	}
+	var f targetsFile
+	if err := yaml.Unmarshal(data, &f); err != nil {
+		return nil, fmt.Errorf("invalid targets file %s: %w", path, err)
+	}
+	if len(f.Targets) == 0 {
+		return nil, fmt.Errorf("targets file %s lists no targets", path)
+	}
+	seen := make(map[string]bool)
+	for i, t := range f.Targets {
+		switch {
+		case t.Name == "":
+			return nil, fmt.Errorf("target %d in %s has no name", i+1, path)
+		case seen[t.Name]:
+			return nil, fmt.Errorf("target %q is listed twice in %s", t.Name, path)
+		case t.DSNFile == "":
+			return nil, fmt.Errorf("target %q in %s has no dsn_file", t.Name, path)
+		case t.DSNFile == stdinPath || t.PasswordFile == stdinPath:
+			return nil, fmt.Errorf("target %q in %s cannot read credentials from stdin", t.Name, path)
+		}
+		seen[t.Name] = true
+	}
+	return f.Targets, nil
+}
+
+// targetPath inserts the target name before the extension of path, so every target writes a
+// file of its own: ids.csv becomes ids.team-a.csv.
+func targetPath(path, name string) string {
+	ext := filepath.Ext(path)
+	return strings.TrimSuffix(path, ext) + "." + name + ext
+}
+
+// TargetsReport is the report of a --targets run: one report per database.
+type TargetsReport struct {
+	StartedAt       time.Time      `json:"started_at" yaml:"started_at"`
+	FinishedAt      time.Time      `json:"finished_at" yaml:"finished_at"`
+	DurationSeconds float64        `json:"duration_seconds" yaml:"duration_seconds"`
+	Success         bool           `json:"success" yaml:"success"`
+	Failed          []string       `json:"failed" yaml:"failed"`
+	Targets         []TargetReport `json:"targets" yaml:"targets"`
+}
+
+// TargetReport is the report of the run against one target.
+type TargetReport struct {
+	Name   string `json:"name" yaml:"name"`
+	Report `yaml:",inline"`
+}
+
+// exitCode is the exit code of a --targets run that failed: the one shared by every failed
+// target, or exitFailure when they failed differently.
+func (r *TargetsReport) exitCode() int {
+	code := 0
+	for _, t := range r.Targets {
+		if t.Success {
+			continue
+		}
+		if code != 0 && code != t.ExitCode {
+			return exitFailure
+		}
+		code = t.ExitCode
+	}
+	if code == 0 {
+		return exitFailure
+	}
+	return code
+}
+
+// errTargetsFailed is returned when the migration failed on at least one target.
+var errTargetsFailed = errors.New("migration failed on some targets")
+
+// migrateTargets runs the migration against every target, at most parallel at a time. A failure
+// on one target does not stop the others; every target gets its own report, and logs to logger
+// with a prefix of its own.
+func migrateTargets(ctx context.Context, opts *options, targets []target, parallel int, logger *log.Logger) (*TargetsReport, error) {
+	r := &TargetsReport{StartedAt: time.Now().UTC(), Failed: []string{}, Targets: make([]TargetReport, len(targets))}
+
+	sem := make(chan struct{}, parallel)
+	var wg sync.WaitGroup
+	for i, t := range targets {
+		wg.Add(1)
+		go func(i int, t target) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+
+			o := *opts
+			o.conn = connFlags{dsnFile: t.DSNFile, passwordFile: t.PasswordFile, schema: opts.conn.schema}
+			if t.Schema != "" {
+				o.conn.schema = dbSchema(t.Schema)
+			}
+			o.expectDB = t.Fingerprint
+			o.target = t.Name
+			if o.exportIDMap != "" {
+				o.exportIDMap = targetPath(o.exportIDMap, t.Name)
+			}
+			if o.emitSQL != "" {
+				o.emitSQL = targetPath(o.emitSQL, t.Name)
+			}
+			if o.stateFile != "" {
+				o.stateFile = targetPath(o.stateFile, t.Name)
+			}
+			if o.snapshotFile != "" {
+				o.snapshotFile = targetPath(o.snapshotFile, t.Name)
+			}
+			if o.reportHTML != "" {
+				o.reportHTML = targetPath(o.reportHTML, t.Name)
+			}
+			logger := log.New(logger.Writer(), fmt.Sprintf("%s[%s] ", logger.Prefix(), t.Name), logger.Flags()|log.Lmsgprefix)
+
+			report := newReport()
+			err := migrateDatabase(ctx, &o, report, logger)
+			report.finish(err)
+			o.observer.OnFinish(report.result())
+			if o.reportHTML != "" {
+				if werr := report.writeHTML(o.reportHTML); werr != nil {
+					logger.Printf("Failed to write HTML report: %v\n", werr)
+				}
+			}
+			if !report.Success {
+				logger.Printf("Failed: %v\n", err)
+			} else {
+				logger.Printf("Done\n")
+			}
+			r.Targets[i] = TargetReport{Name: t.Name, Report: *report}
+		}(i, t)
+	}
+	wg.Wait()
+
+	r.FinishedAt = time.Now().UTC()
+	r.DurationSeconds = r.FinishedAt.Sub(r.StartedAt).Seconds()
+	for _, t := range r.Targets {
+		if !t.Success {
+			r.Failed = append(r.Failed, t.Name)
+		}
+	}
+	r.Success = len(r.Failed) == 0
+	if !r.Success {
+		return r, fmt.Errorf("%w: %v", errTargetsFailed, r.Failed)
+	}
+	return r, nil
+}
+
+// runMigrateTargets is runMigrate for a --targets run. flushTraces exports the spans of the run
+// before it exits.
+func runMigrateTargets(opts *options, flushTraces func()) {
+	targets, err := loadTargets(opts.targetsFile)
+	if err != nil {
+		log.Fatalf("%v\n", err)
+	}
+	if opts.parallel > 1 && !opts.yes {
+		log.Fatalf("--parallel cannot prompt for confirmation on several targets at once; pass --yes\n")
+	}
+
+	report, err := migrateTargets(opts.control.context(), opts, targets, opts.parallel, log.Default())
+	opts.control.close()
+	flushTraces()
+	finishTargets(opts, report, log.Default())
+	if err != nil {
+		log.Printf("%v\n", err)
+		os.Exit(report.exitCode())
+	}
+	fmt.Printf("Success! Migrated %d targets.\n", len(targets))
+}
+
+// finishTargets reports the outcome of a --targets run to the notification webhooks and
+// --report-file, logging to logger when the report cannot be written.
+func finishTargets(opts *options, report *TargetsReport, logger *log.Logger) {
+	opts.notify.notifyTargets(report)
+	if opts.reportFile != "" {
+		if err := writeReportFile(opts.reportFile, report); err != nil {
+			logger.Printf("Failed to write report: %v\n", err)
+		}
+	}
+}
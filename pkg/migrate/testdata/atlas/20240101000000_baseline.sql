@@ -0,0 +1,2 @@
+-- Create "dependencies" table
+CREATE TABLE "dependencies" ("id" uuid NOT NULL, PRIMARY KEY ("id"));
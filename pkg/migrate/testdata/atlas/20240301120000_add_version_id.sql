@@ -0,0 +1,2 @@
+-- Add column "dependent_package_version_id" to table: "dependencies"
+ALTER TABLE "dependencies" ADD COLUMN "dependent_package_version_id" uuid NULL;
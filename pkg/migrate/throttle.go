@@ -0,0 +1,53 @@
+package migrate
+
+import (
+	"context"
+	"time"
+)
+
+// throttle slows the batches of a run down so it can share a database cluster with GUAC
+// ingestion and other tenants without starving them of IO. The zero value does not throttle.
+type throttle struct {
+	// maxRowsPerSecond caps the average rate at which rows are sent; 0 leaves it unlimited.
+	maxRowsPerSecond float64
+	// pause is waited after every batch.
+	pause time.Duration
+	// next is when the rows sent so far are paid for at maxRowsPerSecond.
+	next time.Time
+}
+
+func (t *throttle) enabled() bool {
+	return t.maxRowsPerSecond > 0 || t.pause > 0
+}
+
+// wait is called after step of the run against target sent a batch of rows. It sleeps for the
+// pause between batches, or longer when the rows sent so far are ahead of maxRowsPerSecond.
+func (t *throttle) wait(ctx context.Context, target, step string, rows int64) error {
+	if !t.enabled() {
+		return nil
+	}
+	now := time.Now()
+	until := now.Add(t.pause)
+	if t.maxRowsPerSecond > 0 {
+		if t.next.Before(now) {
+			t.next = now
+		}
+		t.next = t.next.Add(time.Duration(float64(rows) / t.maxRowsPerSecond * float64(time.Second)))
+		if t.next.After(until) {
+			until = t.next
+		}
+	}
+	d := until.Sub(now)
+	if d <= 0 {
+		return nil
+	}
+	metrics.throttled(target, step, d)
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
@@ -0,0 +1,137 @@
+package migrate
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+// stepDurations is a flag value holding a default duration plus per-step overrides, written as
+// a comma-separated list such as "10m,backfill=1h,rewrite-ids=30m".
+type stepDurations struct {
+	def    *time.Duration
+	byStep map[string]time.Duration
+}
+
+func (d *stepDurations) String() string {
+	if d == nil {
+		return ""
+	}
+	var parts []string
+	if d.def != nil {
+		parts = append(parts, d.def.String())
+	}
+	for step, v := range d.byStep {
+		parts = append(parts, step+"="+v.String())
+	}
+	return strings.Join(parts, ",")
+}
+
+func (d *stepDurations) Set(s string) error {
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		step, value, perStep := strings.Cut(part, "=")
+		if !perStep {
+			value = step
+		}
+		v, err := time.ParseDuration(value)
+		if err != nil {
+			return err
+		}
+		if v < 0 {
+			return fmt.Errorf("negative duration %s", v)
+		}
+		if !perStep {
+			d.def = &v
+			continue
+		}
+		if d.byStep == nil {
+			d.byStep = make(map[string]time.Duration)
+		}
+		d.byStep[step] = v
+	}
+	return nil
+}
+
+func (d *stepDurations) configured() bool {
+	return d.def != nil || len(d.byStep) > 0
+}
+
+// forStep returns the duration configured for step, and false when neither an override nor a
+// default was given.
+func (d *stepDurations) forStep(step string) (time.Duration, bool) {
+	if v, ok := d.byStep[step]; ok {
+		return v, true
+	}
+	if d.def != nil {
+		return *d.def, true
+	}
+	return 0, false
+}
+
+// timeoutSettings are the per-step statement_timeout and lock_timeout values. Steps without a
+// configured value keep the server default.
+type timeoutSettings struct {
+	statement stepDurations
+	lock      stepDurations
+}
+
+// apply sets the session timeouts configured for step on conn. SET only lasts for the session,
+// so it runs whenever a pooled connection is handed out for a step it has not run yet.
+func (t *timeoutSettings) apply(ctx context.Context, conn *pgx.Conn, step string) error {
+	for _, stmt := range t.statements(step) {
+		if _, err := conn.Exec(ctx, stmt); err != nil {
+			return fmt.Errorf("failed to run %s: %w", stmt, err)
+		}
+	}
+	return nil
+}
+
+// statements returns the SET and RESET statements that give a session the timeouts of step.
+func (t *timeoutSettings) statements(step string) []string {
+	var stmts []string
+	for _, s := range []struct {
+		name string
+		d    *stepDurations
+	}{
+		{"statement_timeout", &t.statement},
+		{"lock_timeout", &t.lock},
+	} {
+		if !s.d.configured() {
+			continue
+		}
+		// A step without its own value must not inherit the previous step's.
+		stmt := "RESET " + s.name
+		if v, ok := s.d.forStep(step); ok {
+			// SET cannot take bind parameters; the value is an integer so formatting it is safe.
+			stmt = fmt.Sprintf("SET %s = %d", s.name, v.Milliseconds())
+		}
+		stmts = append(stmts, stmt)
+	}
+	return stmts
+}
+
+// explainTimeout adds guidance to errors caused by the configured timeouts firing.
+func (t *timeoutSettings) explainTimeout(step string, err error) error {
+	var pgErr *pgconn.PgError
+	if !errors.As(err, &pgErr) {
+		return err
+	}
+	switch {
+	case pgErr.Code == "57014" && strings.Contains(pgErr.Message, "statement timeout") && t.statement.configured():
+		v, _ := t.statement.forStep(step)
+		return fmt.Errorf("%w (statement_timeout of %s exceeded; the statement was rolled back, raise --statement-timeout=%s=<duration> and run again)", err, v, step)
+	case pgErr.Code == "55P03" && t.lock.configured():
+		v, _ := t.lock.forStep(step)
+		return fmt.Errorf("%w (lock_timeout of %s exceeded after all retries; stop whatever holds locks on the table or raise --lock-timeout=%s=<duration>)", err, v, step)
+	}
+	return err
+}
@@ -0,0 +1,440 @@
+package migrate
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+// traceFormat is the version of the traces --record writes and replay reads.
+const traceFormat = 1
+
+// The kinds of the entries of a trace.
+const (
+	// traceDatabase names the database the run migrated, by its fingerprint.
+	traceDatabase = "database"
+	// traceExec and traceQuery are a statement sent on its own. pgx v5 traces Exec and Query
+	// alike, so traces record every one as traceQuery; traceExec is in those of earlier
+	// releases.
+	traceExec  = "exec"
+	traceQuery = "query"
+	// traceBatch starts a batch, whose statements are the traceBatched entries of the same
+	// session after it.
+	traceBatch   = "batch"
+	traceBatched = "batched"
+	// traceCopy is a COPY, recorded without its rows.
+	traceCopy = "copy"
+	// traceClose is a session closed by the tool.
+	traceClose = "close"
+	// traceError is an error a step failed with, or retried after.
+	traceError = "error"
+)
+
+// traceHeader is the first line of a trace.
+type traceHeader struct {
+	Format   int       `json:"format"`
+	Version  string    `json:"version"`
+	Recorded time.Time `json:"recorded"`
+}
+
+// traceEntry is one line of a trace after the header.
+type traceEntry struct {
+	Kind string `json:"kind"`
+	// Session numbers the connections of the run in the order they were first used.
+	Session int        `json:"session,omitempty"`
+	Step    string     `json:"step,omitempty"`
+	SQL     string     `json:"sql,omitempty"`
+	Args    []traceArg `json:"args,omitempty"`
+	Table   string     `json:"table,omitempty"`
+	Rows    int64      `json:"rows,omitempty"`
+	// Fingerprint identifies the database of a traceDatabase entry.
+	Fingerprint     string         `json:"fingerprint,omitempty"`
+	DurationSeconds float64        `json:"duration_seconds,omitempty"`
+	Error           *traceErrorMsg `json:"error,omitempty"`
+}
+
+// traceArg is a statement parameter. Booleans, numbers and times are recorded as they are;
+// every other value, such as the IDs, names and versions of the rows, only as a keyed hash, so
+// that equal values have equal hashes within the trace but cannot be told from it.
+type traceArg struct {
+	Type  string          `json:"type"`
+	Value json.RawMessage `json:"value,omitempty"`
+	Hash  string          `json:"hash,omitempty"`
+	Elems []traceArg      `json:"elems,omitempty"`
+}
+
+// traceErrorMsg is an error of a trace. Of a server error it keeps the SQLSTATE and the names
+// Postgres gives, but not the detail, which quotes the rows.
+type traceErrorMsg struct {
+	Code       string `json:"code,omitempty"`
+	Message    string `json:"message"`
+	Constraint string `json:"constraint,omitempty"`
+	Table      string `json:"table,omitempty"`
+	Column     string `json:"column,omitempty"`
+}
+
+func newTraceError(err error) *traceErrorMsg {
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) {
+		return &traceErrorMsg{Code: pgErr.Code, Message: pgErr.Message, Constraint: pgErr.ConstraintName, Table: pgErr.TableName, Column: pgErr.ColumnName}
+	}
+	return &traceErrorMsg{Message: err.Error()}
+}
+
+func (e *traceErrorMsg) String() string {
+	if e == nil {
+		return "success"
+	}
+	if e.Code == "" {
+		return e.Message
+	}
+	return fmt.Sprintf("SQLSTATE %s (%s)", e.Code, e.Message)
+}
+
+// traceRecorder writes the trace of --record: a gzip of a JSON header line and an entry per
+// line. It is a pgx tracer of the connections of the run, which sees every statement, batched or
+// not, with its parameters and its error. A nil *traceRecorder records nothing.
+type traceRecorder struct {
+	mu       sync.Mutex
+	w        io.WriteCloser
+	gz       *gzip.Writer
+	enc      *json.Encoder
+	key      []byte
+	sessions map[uint32]int
+	// lastSession is the number of the latest session; those of closed sessions are not reused.
+	lastSession int
+	err         error
+}
+
+// openTrace creates the trace at path.
+func openTrace(path string) (*traceRecorder, error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create the trace: %w", err)
+	}
+	r, err := newTraceRecorder(f)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return r, nil
+}
+
+// newTraceRecorder writes a trace to w, hashing the parameters with a key of its own that is
+// not written anywhere.
+func newTraceRecorder(w io.WriteCloser) (*traceRecorder, error) {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	gz := gzip.NewWriter(w)
+	r := &traceRecorder{w: w, gz: gz, enc: json.NewEncoder(gz), key: key, sessions: make(map[uint32]int)}
+	r.err = r.enc.Encode(traceHeader{Format: traceFormat, Version: buildInfo().Version, Recorded: time.Now().UTC()})
+	return r, nil
+}
+
+// traceStatementKey holds the statement a traceRecorder is tracing in the context pgx passes
+// from the start of a call to its end.
+type traceStatementKey struct{}
+
+type traceStatement struct {
+	entry traceEntry
+	args  []any
+	start time.Time
+}
+
+// TraceQueryStart implements pgx.QueryTracer.
+func (r *traceRecorder) TraceQueryStart(ctx context.Context, _ *pgx.Conn, data pgx.TraceQueryStartData) context.Context {
+	return r.started(ctx, traceEntry{Kind: traceQuery, SQL: data.SQL}, data.Args)
+}
+
+// TraceQueryEnd implements pgx.QueryTracer.
+func (r *traceRecorder) TraceQueryEnd(ctx context.Context, conn *pgx.Conn, data pgx.TraceQueryEndData) {
+	r.ended(ctx, pid(conn), 0, data.Err)
+}
+
+// TraceBatchStart implements pgx.BatchTracer.
+func (r *traceRecorder) TraceBatchStart(ctx context.Context, conn *pgx.Conn, _ pgx.TraceBatchStartData) context.Context {
+	r.record(pid(conn), traceEntry{Kind: traceBatch}, nil)
+	return ctx
+}
+
+// TraceBatchQuery implements pgx.BatchTracer.
+func (r *traceRecorder) TraceBatchQuery(_ context.Context, conn *pgx.Conn, data pgx.TraceBatchQueryData) {
+	e := traceEntry{Kind: traceBatched, SQL: data.SQL}
+	if data.Err != nil {
+		e.Error = newTraceError(data.Err)
+	}
+	r.record(pid(conn), e, data.Args)
+}
+
+// TraceBatchEnd implements pgx.BatchTracer.
+func (r *traceRecorder) TraceBatchEnd(context.Context, *pgx.Conn, pgx.TraceBatchEndData) {}
+
+// TraceCopyFromStart implements pgx.CopyFromTracer.
+func (r *traceRecorder) TraceCopyFromStart(ctx context.Context, _ *pgx.Conn, data pgx.TraceCopyFromStartData) context.Context {
+	return r.started(ctx, traceEntry{Kind: traceCopy, Table: data.TableName.Sanitize()}, nil)
+}
+
+// TraceCopyFromEnd implements pgx.CopyFromTracer.
+func (r *traceRecorder) TraceCopyFromEnd(ctx context.Context, conn *pgx.Conn, data pgx.TraceCopyFromEndData) {
+	r.ended(ctx, pid(conn), data.CommandTag.RowsAffected(), data.Err)
+}
+
+// TraceClose implements connCloseTracer.
+func (r *traceRecorder) TraceClose(conn *pgx.Conn) {
+	r.record(pid(conn), traceEntry{Kind: traceClose}, nil)
+}
+
+// started begins the entry of a statement, which ended writes once its outcome is known.
+func (r *traceRecorder) started(ctx context.Context, e traceEntry, args []any) context.Context {
+	return context.WithValue(ctx, traceStatementKey{}, &traceStatement{entry: e, args: args, start: time.Now()})
+}
+
+// ended writes the entry started began for the session with pid.
+func (r *traceRecorder) ended(ctx context.Context, pid uint32, rows int64, err error) {
+	s, ok := ctx.Value(traceStatementKey{}).(*traceStatement)
+	if !ok {
+		return
+	}
+	e := s.entry
+	e.DurationSeconds = time.Since(s.start).Seconds()
+	e.Rows = rows
+	if err != nil {
+		e.Error = newTraceError(err)
+	}
+	r.record(pid, e, s.args)
+}
+
+// record writes e, with the parameters args, as an entry of the session with pid.
+func (r *traceRecorder) record(pid uint32, e traceEntry, args []any) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, a := range args {
+		e.Args = append(e.Args, r.arg(a))
+	}
+	r.write(pid, e)
+}
+
+// pid is the backend process ID of conn, which tells the sessions of a trace apart.
+func pid(conn *pgx.Conn) uint32 {
+	if conn == nil {
+		return 0
+	}
+	return conn.PgConn().PID()
+}
+
+// database records the fingerprint of the database the run migrates.
+func (r *traceRecorder) database(fingerprint string) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.write(0, traceEntry{Kind: traceDatabase, Fingerprint: fingerprint})
+}
+
+// failed records the error an attempt of step failed with on the session with pid.
+func (r *traceRecorder) failed(step string, pid uint32, err error) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.write(pid, traceEntry{Kind: traceError, Step: step, Error: newTraceError(err)})
+}
+
+// write writes e as an entry of the session with pid. The first error fails close.
+func (r *traceRecorder) write(pid uint32, e traceEntry) {
+	if r.err != nil {
+		return
+	}
+	if pid != 0 {
+		if _, ok := r.sessions[pid]; !ok {
+			r.lastSession++
+			r.sessions[pid] = r.lastSession
+		}
+		e.Session = r.sessions[pid]
+		if e.Kind == traceClose {
+			delete(r.sessions, pid)
+		}
+	}
+	r.err = r.enc.Encode(e)
+}
+
+// arg is the recorded form of a statement parameter.
+func (r *traceRecorder) arg(v interface{}) traceArg {
+	switch v := v.(type) {
+	case nil:
+		return traceArg{Type: "null"}
+	case uuid.UUID:
+		return traceArg{Type: "uuid", Hash: r.hash(v.String())}
+	case uuid.NullUUID:
+		if !v.Valid {
+			return traceArg{Type: "null"}
+		}
+		return r.arg(v.UUID)
+	case string:
+		return traceArg{Type: "text", Hash: r.hash(v)}
+	case time.Time:
+		return traceArg{Type: "time", Value: mustMarshal(v)}
+	}
+	rv := reflect.ValueOf(v)
+	switch rv.Kind() {
+	case reflect.Bool:
+		return traceArg{Type: "bool", Value: mustMarshal(v)}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64, reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return traceArg{Type: "int", Value: mustMarshal(v)}
+	case reflect.Float32, reflect.Float64:
+		return traceArg{Type: "float", Value: mustMarshal(v)}
+	case reflect.Slice:
+		a := traceArg{Type: "array", Elems: []traceArg{}}
+		for i := 0; i < rv.Len(); i++ {
+			a.Elems = append(a.Elems, r.arg(rv.Index(i).Interface()))
+		}
+		return a
+	}
+	return traceArg{Type: fmt.Sprintf("%T", v), Hash: r.hash(fmt.Sprint(v))}
+}
+
+// hash is the keyed hash of a parameter, 16 bytes so that it can stand in for a UUID.
+func (r *traceRecorder) hash(s string) string {
+	mac := hmac.New(sha256.New, r.key)
+	mac.Write([]byte(s))
+	return hex.EncodeToString(mac.Sum(nil)[:16])
+}
+
+func mustMarshal(v interface{}) json.RawMessage {
+	data, err := json.Marshal(v)
+	if err != nil {
+		panic(err)
+	}
+	return data
+}
+
+// close flushes the trace and reports the first error writing it.
+func (r *traceRecorder) close() error {
+	if r == nil {
+		return nil
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	err := errors.Join(r.err, r.gz.Close(), r.w.Close())
+	r.err = errors.New("the trace is closed")
+	if err != nil {
+		return fmt.Errorf("failed to write the trace: %w", err)
+	}
+	return nil
+}
+
+// traceReader reads the entries of a trace after its header.
+type traceReader struct {
+	header traceHeader
+	dec    *json.Decoder
+}
+
+func newTraceReader(r io.Reader) (*traceReader, error) {
+	gz, err := gzip.NewReader(bufio.NewReader(r))
+	if err != nil {
+		return nil, fmt.Errorf("not a trace written by --record: %w", err)
+	}
+	tr := &traceReader{dec: json.NewDecoder(gz)}
+	if err := tr.dec.Decode(&tr.header); err != nil {
+		return nil, fmt.Errorf("failed to read the trace header: %w", err)
+	}
+	if tr.header.Format != traceFormat {
+		return nil, fmt.Errorf("the trace has format %d; this binary replays format %d", tr.header.Format, traceFormat)
+	}
+	return tr, nil
+}
+
+// next returns the next entry, and io.EOF after the last one.
+func (tr *traceReader) next() (*traceEntry, error) {
+	var e traceEntry
+	if err := tr.dec.Decode(&e); err != nil {
+		if errors.Is(err, io.ErrUnexpectedEOF) {
+			// A run that was killed leaves the gzip stream unterminated.
+			return nil, io.EOF
+		}
+		return nil, err
+	}
+	return &e, nil
+}
+
+// value is the parameter replay sends for a: the recorded value, or one derived from the hash,
+// equal for equal hashes.
+func (a traceArg) value() (interface{}, error) {
+	switch a.Type {
+	case "null":
+		return nil, nil
+	case "uuid":
+		b, err := hex.DecodeString(a.Hash)
+		if err != nil {
+			return nil, err
+		}
+		return uuid.FromBytes(b)
+	case "bool":
+		var b bool
+		return b, json.Unmarshal(a.Value, &b)
+	case "int":
+		var n int64
+		return n, json.Unmarshal(a.Value, &n)
+	case "float":
+		var f float64
+		return f, json.Unmarshal(a.Value, &f)
+	case "time":
+		var t time.Time
+		return t, json.Unmarshal(a.Value, &t)
+	case "array":
+		return a.arrayValue()
+	}
+	return a.Hash, nil
+}
+
+// arrayValue is the value of an array of UUIDs, texts or integers.
+func (a traceArg) arrayValue() (interface{}, error) {
+	var ids []uuid.UUID
+	var texts []string
+	var ints []int64
+	for _, e := range a.Elems {
+		v, err := e.value()
+		if err != nil {
+			return nil, err
+		}
+		switch v := v.(type) {
+		case uuid.UUID:
+			ids = append(ids, v)
+		case string:
+			texts = append(texts, v)
+		case int64:
+			ints = append(ints, v)
+		default:
+			return nil, fmt.Errorf("cannot replay an array of %s", e.Type)
+		}
+	}
+	switch {
+	case len(a.Elems) == len(ids):
+		return ids, nil
+	case len(a.Elems) == len(texts):
+		return texts, nil
+	case len(a.Elems) == len(ints):
+		return ints, nil
+	}
+	return nil, errors.New("cannot replay an array of mixed types")
+}
@@ -0,0 +1,94 @@
+package migrate
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+type nopWriteCloser struct{ io.Writer }
+
+func (nopWriteCloser) Close() error { return nil }
+
+func TestTraceRecorder(t *testing.T) {
+	var buf bytes.Buffer
+	r, err := newTraceRecorder(nopWriteCloser{&buf})
+	if err != nil {
+		t.Fatal(err)
+	}
+	id := uuid.New()
+	ctx := context.Background()
+	stmt := r.TraceQueryStart(ctx, nil, pgx.TraceQueryStartData{SQL: "UPDATE t SET id = $1 WHERE id = $2", Args: []any{id, uuid.NullUUID{UUID: id, Valid: true}}})
+	r.ended(stmt, 41, 1, nil)
+	r.record(42, traceEntry{Kind: traceQuery, SQL: "SELECT $1, $2, $3"}, []any{"maven", 10000, []string{"a", "b"}})
+	r.record(41, traceEntry{Kind: traceBatched, SQL: "INSERT", Error: newTraceError(&pgconn.PgError{Code: "23505", Message: "duplicate key", Detail: "Key (id)=(secret) already exists."})}, nil)
+	r.failed("rewrite-ids", 41, errors.New("connection reset"))
+	r.record(41, traceEntry{Kind: traceClose}, nil)
+	r.record(41, traceEntry{Kind: traceQuery, SQL: "SELECT 1"}, nil)
+	if err := r.close(); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(buf.String(), id.String()) {
+		t.Error("the trace is not compressed")
+	}
+
+	tr, err := newTraceReader(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var entries []*traceEntry
+	for {
+		e, err := tr.next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		entries = append(entries, e)
+	}
+	if len(entries) != 6 {
+		t.Fatalf("got %d entries, want 6: %+v", len(entries), entries)
+	}
+
+	exec, query, batched, failed, reopened := entries[0], entries[1], entries[2], entries[3], entries[5]
+	if exec.Kind != traceQuery || exec.Session != 1 || query.Session != 2 || failed.Session != 1 {
+		t.Errorf("entries %+v %+v %+v: want sessions numbered by first use", exec, query, failed)
+	}
+	if exec.Rows != 1 || exec.SQL == "" {
+		t.Errorf("entry %+v, want the statement and its rows", exec)
+	}
+	if entries[4].Kind != traceClose || entries[4].Session != 1 || reopened.Session != 3 {
+		t.Errorf("entries %+v %+v: want a new session after the close", entries[4], reopened)
+	}
+	args, err := replayArgs(exec.Args)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if args[0] != args[1] || args[0] == id {
+		t.Errorf("replayed %v for %s twice, want equal UUIDs standing in for it", args, id)
+	}
+	args, err = replayArgs(query.Args)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if args[0] == "maven" || args[1] != int64(10000) {
+		t.Errorf("replayed %v, want the text hashed and the number as it was", args)
+	}
+	if texts, ok := args[2].([]string); !ok || len(texts) != 2 || texts[0] == texts[1] {
+		t.Errorf("replayed array %#v, want two distinct texts", args[2])
+	}
+	if batched.Kind != traceBatched || batched.Error.Code != "23505" || batched.Error.String() != "SQLSTATE 23505 (duplicate key)" {
+		t.Errorf("batched entry %+v, want the SQLSTATE without the detail", batched)
+	}
+	if failed.Kind != traceError || failed.Step != "rewrite-ids" || failed.Error.Message != "connection reset" {
+		t.Errorf("error entry %+v, want the step and the error", failed)
+	}
+}
@@ -0,0 +1,72 @@
+package migrate
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// tracer creates the spans of a run. Until setupTracing installs an exporter it is the global
+// no-op tracer, so the spans cost nothing when tracing is off.
+var tracer = otel.Tracer("github.com/pxp928/guac-update-db")
+
+// tracingShutdownTimeout bounds how long the spans of a finished run may take to be exported.
+const tracingShutdownTimeout = 10 * time.Second
+
+// setupTracing exports spans over OTLP/HTTP to endpoint, or to the endpoint of the standard
+// OTEL_EXPORTER_OTLP_ENDPOINT and OTEL_EXPORTER_OTLP_TRACES_ENDPOINT variables when it is
+// empty. Without either, tracing stays off. The returned function flushes the spans that are
+// still buffered and must run before the process exits.
+func setupTracing(ctx context.Context, endpoint string) (func(), error) {
+	if endpoint == "" && os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT") == "" && os.Getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT") == "" {
+		return func() {}, nil
+	}
+	var opts []otlptracehttp.Option
+	if endpoint != "" {
+		opts = append(opts, otlptracehttp.WithEndpointURL(endpoint))
+	}
+	exporter, err := otlptracehttp.New(ctx, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to set up the OTLP exporter: %w", err)
+	}
+	res, err := resource.Merge(resource.Default(), resource.NewWithAttributes(semconv.SchemaURL, semconv.ServiceName("guac-update-db"), semconv.ServiceVersion(buildInfo().Version)))
+	if err != nil {
+		return nil, err
+	}
+	provider := sdktrace.NewTracerProvider(sdktrace.WithBatcher(exporter), sdktrace.WithResource(res))
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	return func() {
+		ctx, cancel := context.WithTimeout(context.Background(), tracingShutdownTimeout)
+		defer cancel()
+		if err := provider.Shutdown(ctx); err != nil {
+			log.Printf("Failed to export traces: %v\n", err)
+		}
+	}, nil
+}
+
+// endSpan records the outcome of the operation span covered and ends it.
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// dbAttributes describe the database a span talks to.
+func dbAttributes(database string) []attribute.KeyValue {
+	return []attribute.KeyValue{semconv.DBSystemPostgreSQL, semconv.DBNamespace(database)}
+}
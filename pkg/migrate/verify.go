@@ -0,0 +1,362 @@
+package migrate
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/pxp928/guac-update-db/pkg/keys"
+)
+
+// idMismatch is a dependency whose ID is not the one GUAC computes for it.
+type idMismatch struct {
+	ID       string `json:"id" yaml:"id"`
+	Expected string `json:"expected" yaml:"expected"`
+}
+
+// checkDependencyIDs recomputes the deterministic ID of every dependency f selects with scheme
+// and records the results in v. At most listLimit mismatching and unresolved rows are returned
+// individually.
+func checkDependencyIDs(ctx context.Context, conn *pgx.Conn, schema dbSchema, scheme *keys.Scheme, v *Verification, listLimit int, f *rowFilter) (mismatches []idMismatch, unresolved []string, err error) {
+	where, args := f.where("", 1)
+	return checkDependencyRows(ctx, conn, schema, scheme, v, listLimit, where, args)
+}
+
+// checkDependencySample is checkDependencyIDs for a random sample of percent percent of the
+// rows.
+func checkDependencySample(ctx context.Context, conn *pgx.Conn, schema dbSchema, scheme *keys.Scheme, v *Verification, listLimit int, percent float64) (mismatches []idMismatch, unresolved []string, err error) {
+	return checkDependencyRows(ctx, conn, schema, scheme, v, listLimit, "TABLESAMPLE BERNOULLI ($1)", []interface{}{percent})
+}
+
+func checkDependencyRows(ctx context.Context, conn *pgx.Conn, schema dbSchema, scheme *keys.Scheme, v *Verification, listLimit int, where string, args []interface{}) (mismatches []idMismatch, unresolved []string, err error) {
+	v.IDScheme = scheme.Name
+	err = scanDependencyRows(ctx, conn, schema, where, args, func(dep dependency, resolved bool) error {
+		v.RowsChecked++
+		if !resolved {
+			v.UnresolvedRows++
+			if len(unresolved) < listLimit {
+				unresolved = append(unresolved, dep.oldID.String())
+			}
+			return nil
+		}
+		if expected := scheme.Key(dep.Dependency); expected != dep.oldID {
+			v.IDMismatches++
+			if len(mismatches) < listLimit {
+				mismatches = append(mismatches, idMismatch{ID: dep.oldID.String(), Expected: expected.String()})
+			}
+		}
+		return nil
+	})
+	return mismatches, unresolved, err
+}
+
+// countDanglingReferences counts bill of materials rows referencing a missing dependency.
+func countDanglingReferences(ctx context.Context, conn *pgx.Conn, schema dbSchema) (int64, error) {
+	var n int64
+	err := conn.QueryRow(ctx, `
+		SELECT count(*) FROM `+schema.prefix()+`bill_of_materials_included_dependencies b
+		WHERE NOT EXISTS (SELECT 1 FROM `+schema.prefix()+`dependencies d WHERE d.id = b.dependency_id)
+	`).Scan(&n)
+	return n, err
+}
+
+// countSampledDanglingReferences is countDanglingReferences for a random sample of percent
+// percent of the bill of materials rows, which it also returns the size of.
+func countSampledDanglingReferences(ctx context.Context, conn *pgx.Conn, schema dbSchema, percent float64) (checked, dangling int64, err error) {
+	err = conn.QueryRow(ctx, `
+		SELECT count(*), count(*) FILTER (WHERE NOT EXISTS (SELECT 1 FROM `+schema.prefix()+`dependencies d WHERE d.id = b.dependency_id))
+		FROM `+schema.prefix()+`bill_of_materials_included_dependencies b TABLESAMPLE BERNOULLI ($1)
+	`, percent).Scan(&checked, &dangling)
+	return checked, dangling, err
+}
+
+// confidenceZ is the standard score of the two-sided 95% confidence level verify-ids --sample
+// reports its bounds at.
+const confidenceZ = 1.96
+
+// maxFailureRate is the upper bound of the Wilson score interval of the failure rate of a
+// population in which a sample of n rows had failures failing rows: the rate the population
+// exceeds only with 2.5% probability. With no failures it is about 3.84/n.
+func maxFailureRate(failures, n int64) float64 {
+	if n == 0 {
+		return 1
+	}
+	z2 := confidenceZ * confidenceZ
+	p, fn := float64(failures)/float64(n), float64(n)
+	upper := (p + z2/(2*fn) + confidenceZ*math.Sqrt(p*(1-p)/fn+z2/(4*fn*fn))) / (1 + z2/fn)
+	return math.Min(upper, 1)
+}
+
+// sampleFraction is the share of the rows verify-ids --sample checks, as a percentage such as
+// 1% or a fraction such as 0.01. The zero value checks every row.
+type sampleFraction float64
+
+func (f *sampleFraction) String() string {
+	if *f == 0 {
+		return ""
+	}
+	return strconv.FormatFloat(float64(*f)*100, 'g', -1, 64) + "%"
+}
+
+func (f *sampleFraction) Set(s string) error {
+	v, err := strconv.ParseFloat(strings.TrimSuffix(s, "%"), 64)
+	if err != nil {
+		return fmt.Errorf("must be a percentage such as 1%% or a fraction such as 0.01")
+	}
+	if strings.HasSuffix(s, "%") {
+		v /= 100
+	}
+	if v <= 0 || v > 1 {
+		return fmt.Errorf("must be greater than 0%% and at most 100%%")
+	}
+	*f = sampleFraction(v)
+	return nil
+}
+
+// sampleEstimate is what verify-ids --sample infers about the whole database from the rows it
+// checked, at 95% confidence.
+type sampleEstimate struct {
+	Percent float64 `json:"percent"`
+	// EstimatedDependencies is the size of the dependencies table from the planner statistics.
+	EstimatedDependencies int64   `json:"estimated_dependencies"`
+	ReferencesChecked     int64   `json:"references_checked"`
+	Confidence            float64 `json:"confidence"`
+	// MaxWrongDependencyRate is the share of dependencies that could have a wrong or missing
+	// ID, MaxWrongDependencies the number of rows that is, and MaxDanglingReferenceRate the
+	// share of bill of materials references that could be dangling.
+	MaxWrongDependencyRate   float64 `json:"max_wrong_dependency_rate"`
+	MaxWrongDependencies     int64   `json:"max_wrong_dependencies"`
+	MaxDanglingReferenceRate float64 `json:"max_dangling_reference_rate"`
+}
+
+func (v *Verification) finish() error {
+	v.Passed = v.IDMismatches == 0 && v.DanglingReferences == 0 && v.UnresolvedRows == 0
+	if !v.Passed {
+		return fmt.Errorf("%w: %d ID mismatches, %d dangling references, %d unresolved rows",
+			ErrVerificationFailed, v.IDMismatches, v.DanglingReferences, v.UnresolvedRows)
+	}
+	return nil
+}
+
+// verify re-reads the migrated tables and checks that every dependency carries the ID GUAC
+// expects and that every bill of materials reference points at an existing dependency. With
+// --error-policy=quarantine the quarantined dependencies, and the references to them, are left
+// out.
+func (m *migration) verify(ctx context.Context) (int64, error) {
+	v := &Verification{}
+	m.report.Verification = v
+
+	if err := m.waitForReplica(ctx, "verify"); err != nil {
+		return 0, err
+	}
+	err := m.retryAnalysis(ctx, "verify", func(conn *pgx.Conn) error {
+		*v = Verification{}
+		_, _, err := checkDependencyIDs(ctx, conn, m.schema, m.scheme, v, 0, m.filter)
+		return err
+	})
+	if err != nil {
+		return 0, fmt.Errorf("failed to query dependencies: %w", err)
+	}
+
+	err = m.retryAnalysis(ctx, "verify", func(conn *pgx.Conn) error {
+		var err error
+		v.DanglingReferences, err = countDanglingReferences(ctx, conn, m.schema)
+		return err
+	})
+	if err != nil {
+		return 0, fmt.Errorf("failed to count dangling references: %w", err)
+	}
+	if m.quarantining() {
+		err = m.retryAnalysis(ctx, "verify", func(conn *pgx.Conn) error {
+			return excludeQuarantined(ctx, conn, m.schema, m.scheme, v)
+		})
+		if err != nil {
+			return 0, fmt.Errorf("failed to check the quarantined dependencies: %w", err)
+		}
+	}
+	return v.RowsChecked, v.finish()
+}
+
+// excludeQuarantined takes the quarantined dependencies, and the dangling references to them,
+// out of the failures counted in v.
+func excludeQuarantined(ctx context.Context, conn *pgx.Conn, schema dbSchema, scheme *keys.Scheme, v *Verification) error {
+	ids, err := quarantinedIDs(ctx, conn, schema)
+	if err != nil || len(ids) == 0 {
+		return err
+	}
+	q := &Verification{}
+	if _, _, err := checkDependencyRows(ctx, conn, schema, scheme, q, 0, "WHERE id = ANY($1)", []interface{}{uuidStrings(ids)}); err != nil {
+		return err
+	}
+	var dangling int64
+	err = conn.QueryRow(ctx, `
+		SELECT count(*) FROM `+schema.prefix()+`bill_of_materials_included_dependencies b
+		WHERE b.dependency_id = ANY($1)
+		  AND NOT EXISTS (SELECT 1 FROM `+schema.prefix()+`dependencies d WHERE d.id = b.dependency_id)
+	`, uuidStrings(ids)).Scan(&dangling)
+	if err != nil {
+		return err
+	}
+	v.IDMismatches -= q.IDMismatches
+	v.UnresolvedRows -= q.UnresolvedRows
+	v.DanglingReferences -= dangling
+	v.Quarantined = int64(len(ids))
+	return nil
+}
+
+// idVerificationResult is the output of the verify-ids subcommand.
+type idVerificationResult struct {
+	Verification
+	Mismatches []idMismatch `json:"mismatches"`
+	Unresolved []string     `json:"unresolved"`
+	// Sample is set when only a sample of the rows was checked.
+	Sample *sampleEstimate `json:"sample,omitempty"`
+	// Filter is set when only the dependencies of the --filter flags were checked.
+	Filter string `json:"filter,omitempty"`
+}
+
+func (r *idVerificationResult) print(w io.Writer) {
+	if s := r.Sample; s != nil {
+		fmt.Fprintf(w, "Sampled %g%% of ~%d dependencies and their bill of materials references: %d dependencies and %d references checked\n",
+			s.Percent, s.EstimatedDependencies, r.RowsChecked, s.ReferencesChecked)
+	}
+	if r.Filter != "" {
+		fmt.Fprintf(w, "Checking only the dependencies with %s\n", r.Filter)
+	}
+	fmt.Fprintf(w, "Checked %d dependencies against the %s ID scheme: %d ID mismatches, %d without dependent_package_version_id, %d dangling bill of materials references\n",
+		r.RowsChecked, r.IDScheme, r.IDMismatches, r.UnresolvedRows, r.DanglingReferences)
+	for _, m := range r.Mismatches {
+		fmt.Fprintf(w, "  mismatch: %s should be %s\n", m.ID, m.Expected)
+	}
+	for _, id := range r.Unresolved {
+		fmt.Fprintf(w, "  unresolved: %s\n", id)
+	}
+	if shown := int64(len(r.Mismatches) + len(r.Unresolved)); shown < r.IDMismatches+r.UnresolvedRows {
+		fmt.Fprintf(w, "  ... %d more (raise --list)\n", r.IDMismatches+r.UnresolvedRows-shown)
+	}
+	if s := r.Sample; s != nil {
+		fmt.Fprintf(w, "With %g%% confidence, at most %.4g%% of the dependencies (about %d rows) have a wrong ID and at most %.4g%% of the references dangle.\n",
+			s.Confidence*100, s.MaxWrongDependencyRate*100, s.MaxWrongDependencies, s.MaxDanglingReferenceRate*100)
+		if r.Passed {
+			fmt.Fprintln(w, "The sample is consistent with GUAC's dependency IDs; run without --sample to check every row.")
+		}
+		return
+	}
+	if r.Passed && r.Filter != "" {
+		fmt.Fprintf(w, "The dependencies with %s are consistent with GUAC's dependency IDs.\n", r.Filter)
+	} else if r.Passed {
+		fmt.Fprintln(w, "The database is consistent with GUAC's dependency IDs.")
+	}
+}
+
+func (r *idVerificationResult) checkAll(ctx context.Context, conn *pgx.Conn, schema dbSchema, scheme *keys.Scheme, listLimit int, f *rowFilter) error {
+	mismatches, unresolved, err := checkDependencyIDs(ctx, conn, schema, scheme, &r.Verification, listLimit, f)
+	if err != nil {
+		return fmt.Errorf("failed to query dependencies: %w", err)
+	}
+	r.Mismatches = append(r.Mismatches, mismatches...)
+	r.Unresolved = append(r.Unresolved, unresolved...)
+	if r.DanglingReferences, err = countDanglingReferences(ctx, conn, schema); err != nil {
+		return fmt.Errorf("failed to count dangling references: %w", err)
+	}
+	return nil
+}
+
+// checkSample checks percent percent of the dependencies and of the bill of materials rows,
+// each sampled independently, and bounds the share of wrong rows in the whole tables.
+func (r *idVerificationResult) checkSample(ctx context.Context, conn *pgx.Conn, schema dbSchema, scheme *keys.Scheme, listLimit int, percent float64) error {
+	s := &sampleEstimate{Percent: percent, Confidence: 0.95}
+	r.Sample = s
+	var err error
+	if s.EstimatedDependencies, err = estimatedRows(ctx, conn, schema.prefix()+"dependencies"); err != nil {
+		return fmt.Errorf("failed to estimate dependencies table size: %w", err)
+	}
+	mismatches, unresolved, err := checkDependencySample(ctx, conn, schema, scheme, &r.Verification, listLimit, percent)
+	if err != nil {
+		return fmt.Errorf("failed to query dependencies: %w", err)
+	}
+	r.Mismatches = append(r.Mismatches, mismatches...)
+	r.Unresolved = append(r.Unresolved, unresolved...)
+	if s.ReferencesChecked, r.DanglingReferences, err = countSampledDanglingReferences(ctx, conn, schema, percent); err != nil {
+		return fmt.Errorf("failed to count dangling references: %w", err)
+	}
+
+	s.MaxWrongDependencyRate = maxFailureRate(r.IDMismatches+r.UnresolvedRows, r.RowsChecked)
+	s.MaxWrongDependencies = int64(math.Ceil(s.MaxWrongDependencyRate * float64(max(s.EstimatedDependencies, r.RowsChecked))))
+	s.MaxDanglingReferenceRate = maxFailureRate(r.DanglingReferences, s.ReferencesChecked)
+	return nil
+}
+
+func runVerifyIDs(args []string) {
+	var cf connFlags
+	var scheme idSchemeFlag
+	fs := flag.NewFlagSet("verify-ids", flag.ExitOnError)
+	cf.register(fs)
+	scheme.register(fs)
+	format := fs.String("format", "text", "output `format`: text or json")
+	list := fs.Int("list", 20, "list at most `n` mismatching and n unresolved rows")
+	var sample sampleFraction
+	fs.Var(&sample, "sample", "check only a random `share` of the rows, as a percentage (1%) or a fraction (0.01), and estimate how many could be wrong")
+	var filter rowFilter
+	filter.register(fs)
+	fs.Parse(args)
+
+	passed, err := verifyIDs(&cf, scheme.get(), *format, *list, float64(sample), &filter, os.Stdout)
+	if err != nil {
+		log.Fatalf("%v\n", err)
+	}
+	if !passed {
+		os.Exit(exitVerificationFailed)
+	}
+}
+
+// verifyIDs audits the database without modifying it and reports whether it passed. With a
+// sample fraction it checks a random sample of the rows only, and when they pass reports how
+// many rows could still be wrong. With a non-empty filter it checks the dependencies it selects
+// only, and every bill of materials reference.
+func verifyIDs(cf *connFlags, scheme *keys.Scheme, format string, listLimit int, sample float64, f *rowFilter, w io.Writer) (bool, error) {
+	if format != "text" && format != "json" {
+		return false, fmt.Errorf("invalid --format %q: must be text or json", format)
+	}
+	if sample > 0 && !f.empty() {
+		return false, errors.New("--sample estimates the wrong rows of the whole table and cannot be combined with the --filter flags")
+	}
+	ctx := context.Background()
+	config, err := cf.config()
+	if err != nil {
+		return false, err
+	}
+	conn, err := pgx.ConnectConfig(ctx, config)
+	if err != nil {
+		return false, fmt.Errorf("unable to connect to database: %w", err)
+	}
+	defer conn.Close(ctx)
+
+	r := &idVerificationResult{Mismatches: []idMismatch{}, Unresolved: []string{}, Filter: f.String()}
+	if sample > 0 {
+		err = r.checkSample(ctx, conn, cf.schema, scheme, listLimit, sample*100)
+	} else {
+		err = r.checkAll(ctx, conn, cf.schema, scheme, listLimit, f)
+	}
+	if err != nil {
+		return false, err
+	}
+	r.finish()
+
+	if format == "json" {
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return r.Passed, enc.Encode(r)
+	}
+	r.print(w)
+	return r.Passed, nil
+}
@@ -0,0 +1,53 @@
+package migrate
+
+import (
+	"math"
+	"testing"
+)
+
+func TestMaxFailureRate(t *testing.T) {
+	tests := []struct {
+		failures, n int64
+		want        float64
+	}{
+		{0, 0, 1},
+		{0, 1000, 0.003826},
+		{0, 1000000, 0.00000384},
+		{10, 1000, 0.01832},
+		{1000, 1000, 1},
+	}
+	for _, tt := range tests {
+		got := maxFailureRate(tt.failures, tt.n)
+		if math.Abs(got-tt.want) > tt.want*0.001 {
+			t.Errorf("maxFailureRate(%d, %d) = %g, want %g", tt.failures, tt.n, got, tt.want)
+		}
+	}
+}
+
+func TestSampleFraction(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    float64
+		wantErr bool
+	}{
+		{in: "1%", want: 0.01},
+		{in: "0.5%", want: 0.005},
+		{in: "0.01", want: 0.01},
+		{in: "100%", want: 1},
+		{in: "0%", wantErr: true},
+		{in: "150%", wantErr: true},
+		{in: "2", wantErr: true},
+		{in: "some", wantErr: true},
+	}
+	for _, tt := range tests {
+		var f sampleFraction
+		err := f.Set(tt.in)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("Set(%q) = %v, want error %v", tt.in, err, tt.wantErr)
+			continue
+		}
+		if !tt.wantErr && math.Abs(float64(f)-tt.want) > 1e-12 {
+			t.Errorf("Set(%q) = %g, want %g", tt.in, float64(f), tt.want)
+		}
+	}
+}
@@ -0,0 +1,114 @@
+package migrate
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"runtime"
+	"runtime/debug"
+	"strconv"
+	"strings"
+)
+
+// version, commit and date are stamped at build time with -ldflags "-X
+// github.com/pxp928/guac-update-db/pkg/migrate.version=..." and likewise for commit and date.
+// Builds that do not stamp them fall back to what the Go toolchain recorded in the binary.
+var (
+	version = "dev"
+	commit  = ""
+	date    = ""
+)
+
+// BuildInfo describes the binary and the data migrations it runs.
+type BuildInfo struct {
+	Version    string          `json:"version"`
+	Commit     string          `json:"commit,omitempty"`
+	Date       string          `json:"date,omitempty"`
+	GoVersion  string          `json:"go_version"`
+	Platform   string          `json:"platform"`
+	Migrations []dataMigration `json:"migrations"`
+}
+
+// buildInfo returns the stamped version, completed from the module version and VCS settings
+// Go embeds when the binary is built with go install or from a git checkout.
+func buildInfo() BuildInfo {
+	b := BuildInfo{
+		Version:    version,
+		Commit:     commit,
+		Date:       date,
+		GoVersion:  runtime.Version(),
+		Platform:   runtime.GOOS + "/" + runtime.GOARCH,
+		Migrations: dataMigrations,
+	}
+	if info, ok := debug.ReadBuildInfo(); ok {
+		if b.Version == "dev" && info.Main.Version != "" && info.Main.Version != "(devel)" {
+			b.Version = info.Main.Version
+		}
+		for _, s := range info.Settings {
+			switch {
+			case s.Key == "vcs.revision" && b.Commit == "":
+				b.Commit = s.Value
+			case s.Key == "vcs.time" && b.Date == "":
+				b.Date = s.Value
+			}
+		}
+	}
+	return b
+}
+
+// String is the one-line version of the binary.
+func (b BuildInfo) String() string {
+	s := "guac-update-db " + b.Version
+	var details []string
+	if b.Commit != "" {
+		details = append(details, "commit "+b.Commit)
+	}
+	if b.Date != "" {
+		details = append(details, "built "+b.Date)
+	}
+	details = append(details, b.GoVersion, b.Platform)
+	return s + " (" + strings.Join(details, ", ") + ")"
+}
+
+// guacPRURL links the GUAC pull request behind a data migration.
+func guacPRURL(pr int) string {
+	return "https://github.com/guacsec/guac/pull/" + strconv.Itoa(pr)
+}
+
+// printMigrations lists the data migrations the binary runs and the GUAC PRs they cover.
+func printMigrations(w io.Writer) {
+	for _, dm := range dataMigrations {
+		fmt.Fprintf(w, "  %s (GUAC %s -> %s)\n      %s\n", dm.Name, dm.From, dm.To, dm.Description)
+		if len(dm.Requires) > 0 {
+			fmt.Fprintf(w, "      requires %s\n", strings.Join(dm.Requires, ", "))
+		}
+		for _, pr := range dm.PRs {
+			fmt.Fprintf(w, "      %s\n", guacPRURL(pr))
+		}
+	}
+}
+
+func runVersion(args []string) {
+	fs := flag.NewFlagSet("version", flag.ExitOnError)
+	format := fs.String("format", "text", "output `format`: text or json")
+	fs.Parse(args)
+
+	b := buildInfo()
+	switch *format {
+	case "text":
+		fmt.Println(b)
+		fmt.Println("Data migrations:")
+		printMigrations(os.Stdout)
+	case "json":
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(b); err != nil {
+			log.Fatalf("%v\n", err)
+		}
+	default:
+		usageFatalf("invalid --format %q: must be text or json\n", *format)
+	}
+}
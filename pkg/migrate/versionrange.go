@@ -0,0 +1,115 @@
+package migrate
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// The values of --version-ranges, what the backfill does with a dependency whose version_range
+// is a range rather than a version.
+const (
+	// versionRangesSkip leaves it without dependent_package_version_id and reports it.
+	versionRangesSkip = "skip"
+	// versionRangesFail stops the backfill before it changes anything.
+	versionRangesFail = "fail"
+	// versionRangesExact matches the text of version_range against the versions as it is,
+	// range or not, as the backfill always did.
+	versionRangesExact = "exact"
+)
+
+// versionRangePattern matches a version_range that is a range or a constraint rather than one
+// version: a leading operator (>=1.2.0, ^1.2, ~1.2, !=1.0), a wildcard (1.x, 1.*), a list or
+// alternatives (>=1.0, <2.0 and 1.0 || 2.0), a Maven interval ([1.0,2.0)) or a space. It is
+// both a Go and a Postgres regular expression, so the backfill and rewrite-dump agree.
+const versionRangePattern = `^[<>=!^~]|~>|[]*,|[() ]|(^|\.)[xX](\.|$)`
+
+var versionRange = regexp.MustCompile(versionRangePattern)
+
+// isVersionRange reports whether a version_range is a range rather than a plain version.
+func isVersionRange(s string) bool {
+	return versionRange.MatchString(s)
+}
+
+func validVersionRanges(p string) bool {
+	return p == versionRangesSkip || p == versionRangesFail || p == versionRangesExact
+}
+
+// versionMatchSQL is the condition under which the backfill resolves the dependency d to the
+// package version pv with policy: the version_range of d is the version of pv and, unless
+// policy is exact, a plain version.
+func versionMatchSQL(policy, d, pv string) string {
+	match := pv + `.version = ` + d + `.version_range`
+	if policy == versionRangesExact {
+		return match
+	}
+	return match + ` AND ` + d + `.version_range !~ '` + versionRangePattern + `'`
+}
+
+// versionMatchSQL is versionMatchSQL with the --version-ranges of the run.
+func (m *migration) versionMatchSQL(d, pv string) string {
+	return versionMatchSQL(m.versionRanges, d, pv)
+}
+
+// versionRangeExamples is how many of the dependencies with a range the backfill names.
+const versionRangeExamples = 5
+
+// countVersionRanges counts the dependencies of f the backfill has yet to resolve whose
+// version_range is a range, and describes the first of them.
+func countVersionRanges(ctx context.Context, q queryer, schema dbSchema, f *rowFilter) (int64, []string, error) {
+	filter, args := f.condition("d", 2)
+	rows, err := q.Query(ctx, `
+		SELECT d.id, d.version_range, count(*) OVER ()
+		FROM `+schema.prefix()+`dependencies d
+		WHERE d.dependent_package_name_id IS NOT NULL
+		  AND d.dependent_package_version_id IS NULL
+		  AND d.version_range ~ '`+versionRangePattern+`'
+		  AND `+filter+`
+		ORDER BY d.id
+		LIMIT $1
+	`, append([]interface{}{versionRangeExamples}, args...)...)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer rows.Close()
+	var n int64
+	var examples []string
+	for rows.Next() {
+		var id, r string
+		if err := rows.Scan(&id, &r, &n); err != nil {
+			return 0, nil, fmt.Errorf("failed to scan row: %w", err)
+		}
+		examples = append(examples, fmt.Sprintf("%s (%s)", id, r))
+	}
+	return n, examples, rows.Err()
+}
+
+// checkVersionRanges counts the dependencies whose version_range is a range before the backfill,
+// failing with --version-ranges=fail when there are any.
+func (m *migration) checkVersionRanges(ctx context.Context) error {
+	if m.versionRanges == versionRangesExact {
+		return nil
+	}
+	var n int64
+	var examples []string
+	err := m.retry(ctx, "backfill", func(conn *pgx.Conn) error {
+		var err error
+		n, examples, err = countVersionRanges(ctx, conn, m.schema, m.filter)
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("failed to count the dependencies with a version range: %w", err)
+	}
+	m.report.VersionRanges = n
+	if n == 0 {
+		return nil
+	}
+	if m.versionRanges == versionRangesFail {
+		return fmt.Errorf("%d dependencies have a version range rather than a version, such as %s; resolve them or pass --version-ranges=skip", n, strings.Join(examples, ", "))
+	}
+	m.logger.Printf("backfill: leaving %d dependencies whose version_range is a range rather than a version without dependent_package_version_id, such as %s\n", n, strings.Join(examples, ", "))
+	return nil
+}
@@ -0,0 +1,41 @@
+package migrate
+
+import "testing"
+
+func TestIsVersionRange(t *testing.T) {
+	for _, tc := range []struct {
+		in   string
+		want bool
+	}{
+		{"1.2.0", false},
+		{"1.0.0-rc.1+build.5", false},
+		{"1:2.3~rc1", false},
+		{"v1.2", false},
+		{"1.0-x86_64", false},
+		{"", false},
+		{">=1.2.0", true},
+		{"^1.2", true},
+		{"~1.2", true},
+		{"~> 1.2", true},
+		{"!=1.0", true},
+		{"1.x", true},
+		{"1.*", true},
+		{"*", true},
+		{">=1.0, <2.0", true},
+		{"1.0 || 2.0", true},
+		{"[1.0,2.0)", true},
+	} {
+		if got := isVersionRange(tc.in); got != tc.want {
+			t.Errorf("isVersionRange(%q) = %v, want %v", tc.in, got, tc.want)
+		}
+	}
+}
+
+func TestVersionMatchSQL(t *testing.T) {
+	if got, want := versionMatchSQL(versionRangesExact, "d", "pv"), "pv.version = d.version_range"; got != want {
+		t.Errorf("versionMatchSQL(exact) = %s, want %s", got, want)
+	}
+	if got, want := versionMatchSQL(versionRangesSkip, "d", "pv"), "pv.version = d.version_range AND d.version_range !~ '"+versionRangePattern+"'"; got != want {
+		t.Errorf("versionMatchSQL(skip) = %s, want %s", got, want)
+	}
+}
@@ -0,0 +1,170 @@
+package migrate
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// window is a daily period during which the migration may run, as offsets from local midnight.
+// A window whose end is before its start runs past midnight.
+type window struct {
+	start, end time.Duration
+}
+
+func (w window) String() string {
+	return formatTimeOfDay(w.start) + "-" + formatTimeOfDay(w.end)
+}
+
+func (w window) contains(tod time.Duration) bool {
+	if w.start < w.end {
+		return tod >= w.start && tod < w.end
+	}
+	return tod >= w.start || tod < w.end
+}
+
+// windowList is a flag.Value holding the comma-separated maintenance windows of --window. The
+// empty list places no restriction on when the migration runs.
+type windowList []window
+
+func (l *windowList) String() string {
+	parts := make([]string, len(*l))
+	for i, w := range *l {
+		parts[i] = w.String()
+	}
+	return strings.Join(parts, ",")
+}
+
+func (l *windowList) Set(s string) error {
+	*l = (*l)[:0]
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		from, to, ok := strings.Cut(part, "-")
+		if !ok {
+			return fmt.Errorf("invalid window %q: must be HH:MM-HH:MM", part)
+		}
+		start, err := parseTimeOfDay(from)
+		if err != nil {
+			return fmt.Errorf("invalid window %q: %w", part, err)
+		}
+		end, err := parseTimeOfDay(to)
+		if err != nil {
+			return fmt.Errorf("invalid window %q: %w", part, err)
+		}
+		if start == end {
+			return fmt.Errorf("invalid window %q: starts and ends at the same time", part)
+		}
+		*l = append(*l, window{start: start, end: end})
+	}
+	return nil
+}
+
+func parseTimeOfDay(s string) (time.Duration, error) {
+	t, err := time.Parse("15:04", strings.TrimSpace(s))
+	if err != nil {
+		return 0, fmt.Errorf("%q is not a time of day in HH:MM form", s)
+	}
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+}
+
+func formatTimeOfDay(d time.Duration) string {
+	return fmt.Sprintf("%02d:%02d", int(d/time.Hour), int(d%time.Hour/time.Minute))
+}
+
+// open reports whether t falls in one of the windows.
+func (l windowList) open(t time.Time) bool {
+	if len(l) == 0 {
+		return true
+	}
+	tod := sinceMidnight(t)
+	for _, w := range l {
+		if w.contains(tod) {
+			return true
+		}
+	}
+	return false
+}
+
+// nextOpen returns t when a window is open at t, and when the next one opens otherwise.
+func (l windowList) nextOpen(t time.Time) time.Time {
+	if l.open(t) {
+		return t
+	}
+	var next time.Time
+	for _, w := range l {
+		for day := 0; day <= 1; day++ {
+			at := time.Date(t.Year(), t.Month(), t.Day()+day, int(w.start/time.Hour), int(w.start%time.Hour/time.Minute), 0, 0, t.Location())
+			if at.After(t) {
+				if next.IsZero() || at.Before(next) {
+					next = at
+				}
+				break
+			}
+		}
+	}
+	return next
+}
+
+func sinceMidnight(t time.Time) time.Duration {
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute + time.Duration(t.Second())*time.Second
+}
+
+// waitForWindow pauses the run until a maintenance window is open. It is called between steps
+// and between backfill chunks, after the previous batch committed, and saves the run's state
+// before pausing so a process stopped while paused resumes where it left off. While the
+// foreign key is dropped the run is never paused: the rewrite runs to add-constraints so the
+// database is not left without the constraint, and possibly its indexes, outside the window.
+// The --workers pause one at a time: the others find the window open once the first resumes.
+// A pause requested through the --serve control API lasts until it is resumed, by the same
+// rules, and past the deadline or the --step-timeout of the step the run stops instead of
+// pausing.
+func (m *migration) waitForWindow(ctx context.Context, step string) error {
+	m.pauseMu.Lock()
+	defer m.pauseMu.Unlock()
+	if m.constraintsDropped {
+		return nil
+	}
+	if err := m.deadlineReached(step, time.Now()); err != nil {
+		if err := m.state.save(); err != nil {
+			return err
+		}
+		return err
+	}
+	if m.control.pauseRequested() {
+		if err := m.state.save(); err != nil {
+			return err
+		}
+		start := time.Now()
+		if err := m.control.wait(ctx, m.logger, step); err != nil {
+			return err
+		}
+		m.report.PausedSeconds += time.Since(start).Seconds()
+	}
+	now := time.Now()
+	if m.windows.open(now) {
+		return nil
+	}
+	if err := m.state.save(); err != nil {
+		return err
+	}
+	until := m.windows.nextOpen(now)
+	m.logger.Printf("%s: outside the maintenance window %s, pausing until %s\n", step, m.windows.String(), until.Format(time.RFC3339))
+	trace.SpanFromContext(ctx).AddEvent("paused", trace.WithAttributes(attribute.String("guac.resume_at", until.Format(time.RFC3339))))
+	timer := time.NewTimer(time.Until(until))
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+	}
+	m.report.PausedSeconds += time.Since(now).Seconds()
+	m.logger.Printf("%s: the maintenance window is open, resuming\n", step)
+	return nil
+}
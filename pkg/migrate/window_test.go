@@ -0,0 +1,50 @@
+package migrate
+
+import (
+	"testing"
+	"time"
+)
+
+func TestWindows(t *testing.T) {
+	var l windowList
+	if err := l.Set("22:00-06:00, 12:30-13:00"); err != nil {
+		t.Fatal(err)
+	}
+	if got := l.String(); got != "22:00-06:00,12:30-13:00" {
+		t.Errorf("String() = %q", got)
+	}
+	at := func(hour, min int) time.Time {
+		return time.Date(2024, 3, 1, hour, min, 0, 0, time.UTC)
+	}
+	for _, tc := range []struct {
+		now  time.Time
+		open bool
+		next time.Time
+	}{
+		{at(23, 0), true, at(23, 0)},
+		{at(5, 59), true, at(5, 59)},
+		{at(6, 0), false, at(12, 30)},
+		{at(12, 45), true, at(12, 45)},
+		{at(13, 0), false, at(22, 0)},
+	} {
+		if got := l.open(tc.now); got != tc.open {
+			t.Errorf("open(%s) = %v, want %v", tc.now.Format("15:04"), got, tc.open)
+		}
+		if got := l.nextOpen(tc.now); !got.Equal(tc.next) {
+			t.Errorf("nextOpen(%s) = %s, want %s", tc.now.Format("15:04"), got, tc.next)
+		}
+	}
+
+	var night windowList
+	if err := night.Set("01:00-02:00"); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := night.nextOpen(at(3, 0)), time.Date(2024, 3, 2, 1, 0, 0, 0, time.UTC); !got.Equal(want) {
+		t.Errorf("nextOpen(03:00) = %s, want %s", got, want)
+	}
+	for _, bad := range []string{"22:00", "25:00-01:00", "10:00-10:00"} {
+		if err := new(windowList).Set(bad); err == nil {
+			t.Errorf("Set(%q) succeeded", bad)
+		}
+	}
+}
@@ -0,0 +1,99 @@
+package migrate
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// keyRange is the IDs from from, inclusive, up to to, exclusive. A range without to runs to
+// the end of the table.
+type keyRange struct {
+	from uuid.UUID
+	to   uuid.NullUUID
+}
+
+// keyRanges splits the IDs into n disjoint ranges of about the same size, on their first four
+// bytes, so that each --workers worker updates rows no other worker touches. GUAC's IDs are
+// random or hashes, so the rows spread evenly over the ranges.
+func keyRanges(n int) []keyRange {
+	ranges := make([]keyRange, n)
+	for i := 1; i < n; i++ {
+		var bound uuid.UUID
+		binary.BigEndian.PutUint32(bound[:4], uint32(uint64(i)<<32/uint64(n)))
+		ranges[i-1].to = uuid.NullUUID{UUID: bound, Valid: true}
+		ranges[i].from = bound
+	}
+	return ranges
+}
+
+// String describes the range in log messages.
+func (kr keyRange) String() string {
+	if !kr.to.Valid {
+		return fmt.Sprintf("ids from %s", kr.from)
+	}
+	return fmt.Sprintf("ids from %s up to %s", kr.from, kr.to.UUID)
+}
+
+// forEachRange runs walk on every one of the --workers key ranges at the same time, each on a
+// connection of its own, and waits for all of them. The first failure cancels the others.
+// Every worker is throttled to its share of --max-rows-per-second, and pauses between batches
+// like a single one.
+func (m *migration) forEachRange(ctx context.Context, walk func(ctx context.Context, worker int, kr keyRange, t *throttle) error) error {
+	ranges := keyRanges(m.workers)
+	if len(ranges) > 1 {
+		m.logger.Printf("%s: updating %d key ranges with %d workers\n", m.currentStep, len(ranges), len(ranges))
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	errs := make([]error, len(ranges))
+	var wg sync.WaitGroup
+	for i, kr := range ranges {
+		t := throttle{maxRowsPerSecond: m.throttle.maxRowsPerSecond / float64(len(ranges)), pause: m.throttle.pause}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if errs[i] = walk(ctx, i, kr, &t); errs[i] != nil {
+				cancel()
+			}
+		}()
+	}
+	wg.Wait()
+	// The workers cancelled by the first failure report context.Canceled, which says nothing.
+	for _, err := range errs {
+		if err != nil && !errors.Is(err, context.Canceled) {
+			return err
+		}
+	}
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// progressLog rate-limits the progress messages of concurrent workers to one per
+// progressInterval.
+type progressLog struct {
+	last atomic.Int64
+}
+
+func newProgressLog() *progressLog {
+	p := &progressLog{}
+	p.last.Store(time.Now().UnixNano())
+	return p
+}
+
+// due reports whether a progress message is due, in which case the caller logs it.
+func (p *progressLog) due() bool {
+	last := p.last.Load()
+	now := time.Now()
+	return now.Sub(time.Unix(0, last)) >= progressInterval && p.last.CompareAndSwap(last, now.UnixNano())
+}
@@ -0,0 +1,37 @@
+package migrate
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+func TestKeyRanges(t *testing.T) {
+	for _, n := range []int{1, 2, 3, 7, 16} {
+		ranges := keyRanges(n)
+		if len(ranges) != n {
+			t.Fatalf("keyRanges(%d) returned %d ranges", n, len(ranges))
+		}
+		if ranges[0].from != (uuid.UUID{}) {
+			t.Errorf("keyRanges(%d) starts at %s, want the smallest ID", n, ranges[0].from)
+		}
+		if ranges[n-1].to.Valid {
+			t.Errorf("keyRanges(%d) ends at %s, want no upper bound", n, ranges[n-1].to.UUID)
+		}
+		for i := 1; i < n; i++ {
+			prev := ranges[i-1]
+			if !prev.to.Valid || prev.to.UUID != ranges[i].from {
+				t.Errorf("keyRanges(%d): range %d ends at %v, but range %d starts at %s", n, i-1, prev.to, i, ranges[i].from)
+			}
+			if bytes.Compare(prev.from[:], ranges[i].from[:]) >= 0 {
+				t.Errorf("keyRanges(%d): range %d starts at %s, not after range %d at %s", n, i, ranges[i].from, i-1, prev.from)
+			}
+		}
+	}
+
+	half := keyRanges(2)[1].from
+	if want := uuid.MustParse("80000000-0000-0000-0000-000000000000"); half != want {
+		t.Errorf("keyRanges(2) splits at %s, want %s", half, want)
+	}
+}